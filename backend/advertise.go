@@ -0,0 +1,1104 @@
+package main
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math/rand/v2"
+	"net"
+	"net/http"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+	"golang.org/x/net/ipv4"
+)
+
+// advertiseBucket persists the registered advertisements.
+const advertiseBucket = "advertise"
+
+// Record TTLs recommended by RFC 6762 §10: host names and SRV records 120s,
+// everything else 75 minutes.
+const (
+	hostRecordTTL    = 120
+	serviceRecordTTL = 4500
+)
+
+// Probing and announcing timings of RFC 6762 §8. Variables so tests can
+// shorten them.
+var (
+	probeInterval    = 250 * time.Millisecond
+	probeCount       = 3
+	announceInterval = time.Second
+	announceCount    = 2
+	// probeDeferral is how long a host that loses a simultaneous probe
+	// tiebreak waits before probing again (RFC 6762 §8.2)
+	probeDeferral = time.Second
+	// maxRenames bounds how many names are tried before giving up; RFC 6762
+	// §8.1 asks to slow down after 15 conflicts in 10 seconds, which this
+	// stays under
+	maxRenames = 10
+)
+
+// Conflict policies.
+const (
+	conflictRename = "rename" // try "Name (2)", "Name (3)", ...
+	conflictFail   = "fail"
+)
+
+// Advertisement states.
+const (
+	advertiseProbing   = "probing"
+	advertiseAnnounced = "announced"
+	advertiseConflict  = "conflict"
+)
+
+const servicesMetaQuery = "_services._dns-sd._udp.local."
+
+var (
+	errNameConflict    = errors.New("the name is already in use on the network")
+	errProbeDeferred   = errors.New("lost a simultaneous probe tiebreak")
+	serviceTypePattern = regexp.MustCompile(`^_[a-z0-9][a-z0-9-]{0,14}\._(tcp|udp)$`)
+	hostLabelPattern   = regexp.MustCompile(`^[A-Za-z0-9]([A-Za-z0-9-]{0,61}[A-Za-z0-9])?$`)
+)
+
+// Advertisement is a service the server publishes over mDNS on the
+// discovery interface. With an Address it is a proxy record: the service
+// runs on a host on another subnet, whose name the server answers for too,
+// so clients here can find it.
+type Advertisement struct {
+	ID   string            `json:"id"`
+	Name string            `json:"name"` // instance name, e.g. "Backup NAS"
+	Type string            `json:"type"` // e.g. "_smb._tcp"
+	Port uint16            `json:"port"`
+	TXT  map[string]string `json:"txt,omitempty"`
+	// Host is the target host name, without ".local"; this machine's by
+	// default
+	Host string `json:"host,omitempty"`
+	// Address is the IP of the proxied host; empty for this machine
+	Address string `json:"address,omitempty"`
+	// OnConflict is what to do when another host uses the name: rename
+	// (the default) or fail
+	OnConflict string `json:"onConflict,omitempty"`
+	// RequestedName and RequestedHost are the names asked for, when
+	// conflicts had them renamed
+	RequestedName string `json:"requestedName,omitempty"`
+	RequestedHost string `json:"requestedHost,omitempty"`
+	Conflicts     int    `json:"conflicts,omitempty"`
+	State         string `json:"state"`
+	Error         string `json:"error,omitempty"`
+	CreatedAt     int64  `json:"createdAt"`
+}
+
+// validate checks a registration and fills in its defaults.
+func (a *Advertisement) validate() error {
+	a.Name = strings.TrimSpace(a.Name)
+	a.Type = strings.TrimSuffix(strings.TrimSuffix(strings.ToLower(a.Type), "."), ".local")
+	a.Host = strings.TrimSuffix(strings.TrimSuffix(a.Host, "."), ".local")
+	switch {
+	case a.Name == "" || len(a.Name) > 63:
+		return errors.New("name must be 1 to 63 bytes")
+	case strings.ContainsFunc(a.Name, func(r rune) bool { return r < 0x20 || r == 0x7f }):
+		return errors.New("name must not contain control characters")
+	case !serviceTypePattern.MatchString(a.Type):
+		return fmt.Errorf("invalid service type %q, expected e.g. _http._tcp", a.Type)
+	case a.Port == 0:
+		return errors.New("port is required")
+	}
+	if a.Address != "" {
+		ip := net.ParseIP(a.Address)
+		if ip == nil {
+			return fmt.Errorf("invalid address %q", a.Address)
+		}
+		if a.Host == "" {
+			return errors.New("host is required with an address")
+		}
+		if strings.EqualFold(a.Host, localHostLabel()) {
+			return fmt.Errorf("host %q is this machine", a.Host)
+		}
+		a.Address = ip.String()
+	}
+	if a.Host == "" {
+		a.Host = localHostLabel()
+	}
+	switch a.OnConflict {
+	case "":
+		a.OnConflict = conflictRename
+	case conflictRename, conflictFail:
+	default:
+		return fmt.Errorf("onConflict must be %s or %s", conflictRename, conflictFail)
+	}
+	if !hostLabelPattern.MatchString(a.Host) {
+		return fmt.Errorf("invalid host name %q", a.Host)
+	}
+	for key, value := range a.TXT {
+		if key == "" || strings.Contains(key, "=") || len(key)+1+len(value) > 255 {
+			return fmt.Errorf("invalid TXT entry %q", key)
+		}
+	}
+	return nil
+}
+
+// localHostLabel returns this machine's host name as a single label.
+func localHostLabel() string {
+	name, _ := os.Hostname()
+	name, _, _ = strings.Cut(name, ".")
+	if !hostLabelPattern.MatchString(name) {
+		return "network-view"
+	}
+	return name
+}
+
+// canonicalName returns name in the escaped form names are unpacked in,
+// so names can be compared with strings.EqualFold.
+func canonicalName(name string) string {
+	buffer := make([]byte, 256)
+	n, err := dns.PackDomainName(dns.Fqdn(name), buffer, 0, nil, false)
+	if err != nil {
+		return name
+	}
+	canonical, _, err := dns.UnpackDomainName(buffer[:n], 0)
+	if err != nil {
+		return name
+	}
+	return canonical
+}
+
+// escapeLabel escapes the characters of an instance name that are special
+// in presentation format.
+func escapeLabel(label string) string {
+	return strings.NewReplacer(`\`, `\\`, `.`, `\.`).Replace(label)
+}
+
+// typeName is the name browsers query, e.g. "_smb._tcp.local.".
+func (a *Advertisement) typeName() string {
+	return a.Type + ".local."
+}
+
+// instanceName is the name of the SRV and TXT records, in canonical form.
+func (a *Advertisement) instanceName() string {
+	return canonicalName(escapeLabel(a.Name) + "." + a.typeName())
+}
+
+func (a *Advertisement) hostName() string {
+	return a.Host + ".local."
+}
+
+// advertiseRecords are the records of an advertisement.
+type advertiseRecords struct {
+	ptr, meta *dns.PTR // shared
+	srv       *dns.SRV // unique
+	txt       *dns.TXT // unique
+	addr      dns.RR   // A or AAAA, nil without an address
+	proxy     bool     // addr is of a proxied host
+}
+
+// records builds the records of a, pointing its host name at ip, or at
+// the proxied host's address.
+func (a *Advertisement) records(ip net.IP) advertiseRecords {
+	if a.Address != "" {
+		ip = net.ParseIP(a.Address)
+	}
+	header := func(name string, rrtype uint16, ttl uint32) dns.RR_Header {
+		return dns.RR_Header{Name: name, Rrtype: rrtype, Class: dns.ClassINET, Ttl: ttl}
+	}
+	var txt []string
+	for key, value := range a.TXT {
+		txt = append(txt, key+"="+value)
+	}
+	sort.Strings(txt)
+	if len(txt) == 0 {
+		txt = []string{""} // RFC 6763 §6.1: a TXT record has at least one string
+	}
+
+	records := advertiseRecords{
+		proxy: a.Address != "",
+		ptr:   &dns.PTR{Hdr: header(a.typeName(), dns.TypePTR, serviceRecordTTL), Ptr: a.instanceName()},
+		meta:  &dns.PTR{Hdr: header(servicesMetaQuery, dns.TypePTR, serviceRecordTTL), Ptr: a.typeName()},
+		srv:   &dns.SRV{Hdr: header(a.instanceName(), dns.TypeSRV, hostRecordTTL), Target: a.hostName(), Port: a.Port},
+		txt:   &dns.TXT{Hdr: header(a.instanceName(), dns.TypeTXT, serviceRecordTTL), Txt: txt},
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		records.addr = &dns.A{Hdr: header(a.hostName(), dns.TypeA, hostRecordTTL), A: ip4}
+	} else if ip != nil && a.Address != "" {
+		records.addr = &dns.AAAA{Hdr: header(a.hostName(), dns.TypeAAAA, hostRecordTTL), AAAA: ip}
+	}
+	return records
+}
+
+// all returns every record, unique ones with the cache-flush bit set.
+// This machine's address record never gets it: the host name is also
+// published by the system's own responder, whose other addresses must not
+// be flushed. A proxied host's name is ours alone.
+func (r advertiseRecords) all() []dns.RR {
+	srv, txt := *r.srv, *r.txt
+	srv.Hdr.Class |= 0x8000
+	txt.Hdr.Class |= 0x8000
+	rrs := []dns.RR{r.ptr, r.meta, &srv, &txt}
+	if r.addr != nil {
+		addr := dns.Copy(r.addr)
+		if r.proxy {
+			addr.Header().Class |= 0x8000
+		}
+		rrs = append(rrs, addr)
+	}
+	return rrs
+}
+
+// probeConflict is what a probe ran into.
+type probeConflict int
+
+const (
+	instanceConflict probeConflict = iota // the service instance name is taken
+	hostConflict                          // the proxied host name is taken
+	probeLost                             // another host probes for the name with later data
+)
+
+// advertised is a registered advertisement with its responder state.
+type advertised struct {
+	Advertisement
+	conflict chan probeConflict // signalled while probing
+}
+
+// rename returns the next name to try after a conflict: "Name (2)",
+// "Name (3)", and so on.
+func rename(name string) string {
+	if m := renamedPattern.FindStringSubmatch(name); m != nil {
+		n, _ := strconv.Atoi(m[2])
+		return fmt.Sprintf("%s (%d)", m[1], n+1)
+	}
+	return name + " (2)"
+}
+
+// renameHost returns the next host name to try: "nas-2", "nas-3", ...
+func renameHost(host string) string {
+	if m := renamedHostPattern.FindStringSubmatch(host); m != nil {
+		n, _ := strconv.Atoi(m[2])
+		return fmt.Sprintf("%s-%d", m[1], n+1)
+	}
+	return host + "-2"
+}
+
+var (
+	renamedPattern     = regexp.MustCompile(`^(.*) \(([0-9]+)\)$`)
+	renamedHostPattern = regexp.MustCompile(`^(.*)-([0-9]+)$`)
+)
+
+// Responder publishes user-defined services over mDNS: it probes for their
+// names (RFC 6762 §8.1), announces them, answers queries for them on the
+// discovery interface, and sends goodbyes when they are removed or the
+// server shuts down.
+type Responder struct {
+	store  Store
+	server *MDNSServer
+
+	// address returns the address of an interface; transmit sends a
+	// message on one, to the mDNS group when to is nil. Replaced in tests
+	address  func(iface string) net.IP
+	transmit func(msg *dns.Msg, iface string, to *net.UDPAddr) error
+
+	mu      sync.Mutex
+	ads     map[string]*advertised
+	iface   string // where the advertisements are announced
+	conn    *ipv4.PacketConn
+	closing bool
+}
+
+// NewResponder loads the persisted advertisements. Start announces them.
+func NewResponder(store Store, server *MDNSServer) (*Responder, error) {
+	r := &Responder{store: store, server: server, address: interfaceIPv4, ads: make(map[string]*advertised)}
+	r.transmit = r.multicast
+	entries, err := store.Load(advertiseBucket)
+	if err != nil {
+		return nil, err
+	}
+	for id, data := range entries {
+		var ad Advertisement
+		if err := json.Unmarshal(data, &ad); err != nil {
+			return nil, fmt.Errorf("advertisement %s: %v", id, err)
+		}
+		ad.State, ad.Error = advertiseProbing, ""
+		r.ads[id] = &advertised{Advertisement: ad}
+	}
+	return r, nil
+}
+
+// Start announces the persisted advertisements on the current interface
+// and moves them along when the interface switches.
+func (r *Responder) Start() {
+	r.mu.Lock()
+	r.iface = r.currentIface()
+	ads := make([]*advertised, 0, len(r.ads))
+	for _, ad := range r.ads {
+		ads = append(ads, ad)
+	}
+	r.mu.Unlock()
+	for _, ad := range ads {
+		go r.publish(ad)
+	}
+
+	r.server.bus.Subscribe("responder", func(e BusEvent) {
+		go r.switchInterface(e.Payload.(InterfaceEvent).Interface)
+	}, TopicInterface)
+}
+
+func (r *Responder) currentIface() string {
+	r.server.mu.RLock()
+	defer r.server.mu.RUnlock()
+	return r.server.currentIface
+}
+
+// multicast sends msg from port 5353, which responses must come from.
+func (r *Responder) multicast(msg *dns.Msg, iface string, to *net.UDPAddr) error {
+	packet, err := msg.Pack()
+	if err != nil {
+		return err
+	}
+	r.mu.Lock()
+	if r.conn == nil {
+		lc := net.ListenConfig{Control: reusePortControl}
+		conn, err := lc.ListenPacket(context.Background(), "udp4", fmt.Sprintf("0.0.0.0:%d", mdnsGroup.Port))
+		if err != nil {
+			r.mu.Unlock()
+			return err
+		}
+		r.conn = ipv4.NewPacketConn(conn)
+		r.conn.SetMulticastTTL(255)
+		r.conn.SetMulticastLoopback(true)
+	}
+	conn := r.conn
+	r.mu.Unlock()
+
+	if to == nil {
+		to = mdnsGroup
+		if ifi, err := net.InterfaceByName(iface); err == nil {
+			conn.SetMulticastInterface(ifi)
+		}
+	}
+	_, err = conn.WriteTo(packet, nil, to)
+	return err
+}
+
+// publish probes for ad's names and announces them. When another host uses
+// one, it tries the next name unless ad fails on conflicts, and returns
+// errNameConflict when it gives up.
+func (r *Responder) publish(ad *advertised) error {
+	r.mu.Lock()
+	iface := r.iface
+	ad.State, ad.Error = advertiseProbing, ""
+	r.mu.Unlock()
+
+	renamed := false
+	for attempt := 0; ; attempt++ {
+		r.mu.Lock()
+		if r.ads[ad.ID] != ad || r.iface != iface {
+			// Removed, or moved to another interface, meanwhile
+			r.mu.Unlock()
+			return nil
+		}
+		ad.conflict = make(chan probeConflict, 1)
+		records := ad.records(r.address(iface))
+		snapshot := ad.Advertisement
+		r.mu.Unlock()
+
+		conflict, err := r.probe(ad, snapshot, records, iface)
+
+		r.mu.Lock()
+		ad.conflict = nil
+		if r.ads[ad.ID] != ad {
+			r.mu.Unlock()
+			return nil
+		}
+		switch {
+		case err != nil:
+			ad.State, ad.Error = advertiseConflict, err.Error()
+			r.mu.Unlock()
+			log.Printf("⚠️  Not advertising %q (%s): %v", snapshot.Name, snapshot.Type, err)
+			return err
+
+		case conflict == nil:
+			ad.State = advertiseAnnounced
+			r.mu.Unlock()
+			log.Printf("Advertising %q (%s) on port %d on %s", snapshot.Name, snapshot.Type, snapshot.Port, iface)
+			if renamed {
+				r.save(snapshot)
+			}
+			go r.announce(records.all(), iface)
+			return nil
+
+		case *conflict == probeLost:
+			r.mu.Unlock()
+			// The winner announces next, and its answers decide
+			time.Sleep(probeDeferral)
+			continue
+		}
+
+		ad.Conflicts++
+		if ad.OnConflict == conflictFail || attempt >= maxRenames {
+			ad.State, ad.Error = advertiseConflict, errNameConflict.Error()
+			r.mu.Unlock()
+			log.Printf("⚠️  Not advertising %q (%s): %v", snapshot.Name, snapshot.Type, errNameConflict)
+			return errNameConflict
+		}
+		if *conflict == hostConflict {
+			if ad.RequestedHost == "" {
+				ad.RequestedHost = ad.Host
+			}
+			ad.Host = renameHost(ad.Host)
+			for r.hostTaken(ad) {
+				ad.Host = renameHost(ad.Host)
+			}
+			log.Printf("Host name %s.local is taken, trying %s.local", snapshot.Host, ad.Host)
+		} else {
+			if ad.RequestedName == "" {
+				ad.RequestedName = ad.Name
+			}
+			ad.Name = rename(ad.Name)
+			for r.nameTaken(ad) {
+				ad.Name = rename(ad.Name)
+			}
+			log.Printf("%q (%s) is taken, trying %q", snapshot.Name, snapshot.Type, ad.Name)
+		}
+		renamed = true
+		r.mu.Unlock()
+	}
+}
+
+// nameTaken reports whether another of our advertisements has ad's
+// instance name. r.mu must be held.
+func (r *Responder) nameTaken(ad *advertised) bool {
+	for _, other := range r.ads {
+		if other != ad && strings.EqualFold(other.instanceName(), ad.instanceName()) {
+			return true
+		}
+	}
+	return false
+}
+
+// hostTaken reports whether another of our advertisements uses ad's host
+// name for another address. r.mu must be held.
+func (r *Responder) hostTaken(ad *advertised) bool {
+	for _, other := range r.ads {
+		if other != ad && strings.EqualFold(other.Host, ad.Host) && other.Address != ad.Address {
+			return true
+		}
+	}
+	return false
+}
+
+// save persists ad.
+func (r *Responder) save(ad Advertisement) error {
+	data, _ := json.Marshal(ad)
+	return r.store.Put(advertiseBucket, map[string][]byte{ad.ID: data})
+}
+
+// probeQuery is the probe for ad's names: its instance name, and a proxied
+// host's name, with the proposed records in the authority section.
+func probeQuery(ad Advertisement, records advertiseRecords) *dns.Msg {
+	query := new(dns.Msg)
+	query.Question = []dns.Question{{Name: ad.instanceName(), Qtype: dns.TypeANY, Qclass: dns.ClassINET | 0x8000}}
+	query.Ns = []dns.RR{records.srv, records.txt}
+	if records.proxy && records.addr != nil {
+		query.Question = append(query.Question, dns.Question{Name: ad.hostName(), Qtype: dns.TypeANY, Qclass: dns.ClassINET | 0x8000})
+		query.Ns = append(query.Ns, records.addr)
+	}
+	return query
+}
+
+// probe sends the probe query three times, 250ms apart, and returns the
+// conflict it runs into, if any.
+func (r *Responder) probe(ad *advertised, snapshot Advertisement, records advertiseRecords, iface string) (*probeConflict, error) {
+	query := probeQuery(snapshot, records)
+	conflicts := ad.conflict
+
+	// A random initial delay keeps hosts starting together from probing
+	// in lockstep
+	time.Sleep(rand.N(probeInterval))
+	for i := 0; i < probeCount; i++ {
+		if err := r.transmit(query, iface, nil); err != nil {
+			return nil, err
+		}
+		select {
+		case conflict := <-conflicts:
+			return &conflict, nil
+		case <-time.After(probeInterval):
+		}
+	}
+	return nil, nil
+}
+
+// announce sends records unsolicited, announceCount times.
+func (r *Responder) announce(records []dns.RR, iface string) {
+	msg := new(dns.Msg)
+	msg.Response, msg.Authoritative = true, true
+	msg.Answer = records
+	for i := 0; i < announceCount; i++ {
+		if i > 0 {
+			time.Sleep(announceInterval)
+		}
+		if err := r.transmit(msg, iface, nil); err != nil {
+			log.Printf("mDNS announcement on %s failed: %v", iface, err)
+			return
+		}
+	}
+}
+
+// goodbye withdraws records by announcing them with TTL 0.
+func (r *Responder) goodbye(ad Advertisement, iface string) {
+	records := ad.records(r.address(iface)).all()
+	for i, rr := range records {
+		rr = dns.Copy(rr)
+		rr.Header().Ttl = 0
+		records[i] = rr
+	}
+	msg := new(dns.Msg)
+	msg.Response, msg.Authoritative = true, true
+	msg.Answer = records
+	if err := r.transmit(msg, iface, nil); err != nil {
+		log.Printf("mDNS goodbye on %s failed: %v", iface, err)
+	}
+}
+
+// switchInterface withdraws the advertisements from the previous interface
+// and publishes them on iface.
+func (r *Responder) switchInterface(iface string) {
+	r.mu.Lock()
+	previous := r.iface
+	r.iface = iface
+	var ads []*advertised
+	for _, ad := range r.ads {
+		if ad.State == advertiseAnnounced {
+			go r.goodbye(ad.Advertisement, previous)
+		}
+		ads = append(ads, ad)
+	}
+	r.mu.Unlock()
+	for _, ad := range ads {
+		go r.publish(ad)
+	}
+}
+
+// handle answers a query for our records, or watches a response for
+// conflicts with names being probed.
+func (r *Responder) handle(packet []byte, iface string, from *net.UDPAddr) {
+	msg := new(dns.Msg)
+	if msg.Unpack(packet) == nil {
+		r.handleMsg(msg, iface, from)
+	}
+}
+
+// handleMsg is handle for a packet the listener has already unpacked.
+func (r *Responder) handleMsg(msg *dns.Msg, iface string, from *net.UDPAddr) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	if len(r.ads) == 0 || r.closing || (iface != "" && iface != r.iface) {
+		r.mu.Unlock()
+		return
+	}
+	current := r.iface
+	r.mu.Unlock()
+
+	if msg.Opcode != dns.OpcodeQuery {
+		return
+	}
+	if msg.Response {
+		r.checkConflicts(msg)
+		return
+	}
+	if len(msg.Ns) > 0 {
+		r.tiebreak(msg)
+	}
+	r.answer(msg, current, from)
+}
+
+// checkConflicts looks for responses from other hosts with records other
+// than ours for the instance name, or for the name of a proxied host. A
+// probing advertisement moves on to the next name; an announced one is
+// probed for again (RFC 6762 §9).
+func (r *Responder) checkConflicts(msg *dns.Msg) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, ad := range r.ads {
+		if ad.State == advertiseConflict {
+			continue
+		}
+		records := ad.records(r.address(r.iface))
+		conflict, found := probeConflict(0), false
+		for _, rr := range append(msg.Answer, msg.Extra...) {
+			if rr.Header().Ttl == 0 {
+				// A goodbye gives the name up
+				continue
+			}
+			switch name := rr.Header().Name; {
+			case strings.EqualFold(name, ad.instanceName()):
+				if !sameRecord(rr, records.srv) && !sameRecord(rr, records.txt) {
+					conflict, found = instanceConflict, true
+				}
+			case records.proxy && strings.EqualFold(name, ad.hostName()):
+				if records.addr == nil || !sameRecord(rr, records.addr) {
+					conflict, found = hostConflict, true
+				}
+			}
+			if found {
+				break
+			}
+		}
+		if !found {
+			continue
+		}
+		switch {
+		case ad.State == advertiseProbing && ad.conflict != nil:
+			select {
+			case ad.conflict <- conflict:
+			default:
+			}
+		case ad.State == advertiseAnnounced:
+			log.Printf("⚠️  Another host answers for %q (%s), probing again", ad.Name, ad.Type)
+			ad.State = advertiseProbing
+			go r.publish(ad)
+		}
+	}
+}
+
+// tiebreak resolves simultaneous probing (RFC 6762 §8.2): when another host
+// probes for a name we are probing for, the one whose proposed records are
+// lexicographically later wins, and the other defers.
+func (r *Responder) tiebreak(query *dns.Msg) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, ad := range r.ads {
+		if ad.State != advertiseProbing || ad.conflict == nil {
+			continue
+		}
+		ours := probeQuery(ad.Advertisement, ad.records(r.address(r.iface)))
+		for _, q := range query.Question {
+			if !strings.EqualFold(q.Name, ad.instanceName()) && !strings.EqualFold(q.Name, ad.hostName()) {
+				continue
+			}
+			if compareProbeRecords(authorityFor(ours.Ns, q.Name), authorityFor(query.Ns, q.Name)) < 0 {
+				select {
+				case ad.conflict <- probeLost:
+				default:
+				}
+			}
+		}
+	}
+}
+
+// authorityFor returns the records of rrs named name.
+func authorityFor(rrs []dns.RR, name string) []dns.RR {
+	var named []dns.RR
+	for _, rr := range rrs {
+		if strings.EqualFold(rr.Header().Name, name) {
+			named = append(named, rr)
+		}
+	}
+	return named
+}
+
+// compareProbeRecords compares two sets of proposed records the way RFC
+// 6762 §8.2 orders them, by class, type and then raw data, record by
+// record after sorting each set. It returns -1 when ours are earlier, 0
+// when they are identical, e.g. our own probe looped back, and 1 when ours
+// are later.
+func compareProbeRecords(ours, theirs []dns.RR) int {
+	a, b := probeKeys(ours), probeKeys(theirs)
+	for i := 0; i < len(a) && i < len(b); i++ {
+		if c := a[i].compare(b[i]); c != 0 {
+			return c
+		}
+	}
+	return cmp.Compare(len(a), len(b))
+}
+
+// probeKey is what a proposed record is ordered by.
+type probeKey struct {
+	class, rrtype uint16
+	data          []byte
+}
+
+func (k probeKey) compare(other probeKey) int {
+	if c := cmp.Compare(k.class, other.class); c != 0 {
+		return c
+	}
+	if c := cmp.Compare(k.rrtype, other.rrtype); c != 0 {
+		return c
+	}
+	return bytes.Compare(k.data, other.data)
+}
+
+func probeKeys(rrs []dns.RR) []probeKey {
+	keys := make([]probeKey, 0, len(rrs))
+	for _, rr := range rrs {
+		keys = append(keys, probeKey{rr.Header().Class &^ 0x8000, rr.Header().Rrtype, rdata(rr)})
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i].compare(keys[j]) < 0 })
+	return keys
+}
+
+// rdata returns the uncompressed wire format of rr's data.
+func rdata(rr dns.RR) []byte {
+	rr = dns.Copy(rr)
+	rr.Header().Name = "."
+	buffer := make([]byte, dns.Len(rr)+16)
+	n, err := dns.PackRR(rr, buffer, 0, nil, false)
+	if err != nil || n < 11 {
+		return nil
+	}
+	// The root name, then type, class, TTL and length
+	return buffer[11:n]
+}
+
+// sameRecord reports whether a and b have the same name, type and data,
+// ignoring TTL and the cache-flush bit.
+func sameRecord(a, b dns.RR) bool {
+	a, b = dns.Copy(a), dns.Copy(b)
+	for _, rr := range []dns.RR{a, b} {
+		rr.Header().Ttl = 0
+		rr.Header().Class &^= 0x8000
+		rr.Header().Name = strings.ToLower(rr.Header().Name)
+	}
+	return dns.IsDuplicate(a, b)
+}
+
+// answer responds to the questions of query that ask for our records.
+func (r *Responder) answer(query *dns.Msg, iface string, from *net.UDPAddr) {
+	// Queries from other ports are legacy unicast (RFC 6762 §6.7): they
+	// get a conventional DNS reply
+	legacy := from != nil && from.Port != mdnsGroup.Port
+	unicast := legacy
+
+	r.mu.Lock()
+	var ads []Advertisement
+	for _, ad := range r.ads {
+		if ad.State == advertiseAnnounced {
+			ads = append(ads, ad.Advertisement)
+		}
+	}
+	r.mu.Unlock()
+
+	var answers, extras []dns.RR
+	shared := false
+	proxied := make(map[string]bool) // host names unique to us
+	for _, q := range query.Question {
+		if q.Qclass&0x8000 != 0 {
+			unicast = true
+		}
+		name := q.Name
+		for _, ad := range ads {
+			records := ad.records(r.address(iface))
+			matches := func(rrtype uint16) bool { return q.Qtype == rrtype || q.Qtype == dns.TypeANY }
+			switch {
+			case strings.EqualFold(name, ad.typeName()) && matches(dns.TypePTR):
+				answers = append(answers, records.ptr)
+				extras = append(extras, records.srv, records.txt)
+				shared = true
+			case strings.EqualFold(name, servicesMetaQuery) && matches(dns.TypePTR):
+				answers = append(answers, records.meta)
+				shared = true
+			case strings.EqualFold(name, ad.instanceName()):
+				if matches(dns.TypeSRV) {
+					answers = append(answers, records.srv)
+				}
+				if matches(dns.TypeTXT) {
+					answers = append(answers, records.txt)
+				}
+			case strings.EqualFold(name, ad.hostName()) && records.addr != nil && matches(records.addr.Header().Rrtype):
+				answers = append(answers, records.addr)
+			default:
+				continue
+			}
+			if records.addr != nil {
+				extras = append(extras, records.addr)
+			}
+			if records.proxy {
+				proxied[strings.ToLower(ad.hostName())] = true
+			}
+		}
+	}
+
+	answers = dedupeRecords(knownAnswerSuppression(answers, query.Answer), nil)
+	if len(answers) == 0 {
+		return
+	}
+	extras = dedupeRecords(extras, answers)
+
+	reply := new(dns.Msg)
+	reply.Response, reply.Authoritative = true, true
+	var to *net.UDPAddr
+	if legacy {
+		reply.Id = query.Id
+		reply.Question = query.Question
+		// Legacy resolvers cache for at most 10s (RFC 6762 §6.7)
+		answers, extras = capTTL(answers, 10), capTTL(extras, 10)
+	} else {
+		answers, extras = withCacheFlush(answers, proxied), withCacheFlush(extras, proxied)
+	}
+	if unicast {
+		to = from
+	}
+	reply.Answer, reply.Extra = answers, extras
+	if legacy {
+		// A conventional resolver reads at most 512 bytes unless its query
+		// carries an OPT record, which the reply then carries too; what
+		// doesn't fit is cut, with TC set (RFC 6891 §7)
+		size := dns.MinMsgSize
+		if opt := query.IsEdns0(); opt != nil {
+			size = int(min(opt.UDPSize(), mdnsPayloadSize))
+			reply.SetEdns0(mdnsPayloadSize, false)
+		}
+		reply.Truncate(size)
+	}
+
+	go func() {
+		// Shared answers are delayed 20-120ms so responders don't collide
+		// (RFC 6762 §6)
+		if shared && !legacy {
+			time.Sleep(20*time.Millisecond + rand.N(100*time.Millisecond))
+		}
+		if err := r.transmit(reply, iface, to); err != nil {
+			log.Printf("mDNS response on %s failed: %v", iface, err)
+		}
+	}()
+}
+
+// knownAnswerSuppression drops the answers the querier listed as known
+// with at least half their TTL left (RFC 6762 §7.1).
+func knownAnswerSuppression(answers, known []dns.RR) []dns.RR {
+	var kept []dns.RR
+	for _, rr := range answers {
+		suppressed := false
+		for _, k := range known {
+			if sameRecord(rr, k) && k.Header().Ttl >= rr.Header().Ttl/2 {
+				suppressed = true
+				break
+			}
+		}
+		if !suppressed {
+			kept = append(kept, rr)
+		}
+	}
+	return kept
+}
+
+// dedupeRecords drops repeated records and those in exclude.
+func dedupeRecords(rrs, exclude []dns.RR) []dns.RR {
+	var kept []dns.RR
+	for _, rr := range rrs {
+		duplicate := false
+		for _, other := range append(exclude, kept...) {
+			if sameRecord(rr, other) {
+				duplicate = true
+				break
+			}
+		}
+		if !duplicate {
+			kept = append(kept, rr)
+		}
+	}
+	return kept
+}
+
+// withCacheFlush copies rrs with the cache-flush bit on the records unique
+// to us: SRV and TXT, and the addresses of the proxied host names.
+func withCacheFlush(rrs []dns.RR, proxied map[string]bool) []dns.RR {
+	for i, rr := range rrs {
+		switch rr.Header().Rrtype {
+		case dns.TypeA, dns.TypeAAAA:
+			if !proxied[strings.ToLower(rr.Header().Name)] {
+				continue
+			}
+		case dns.TypeSRV, dns.TypeTXT:
+		default:
+			continue
+		}
+		rr = dns.Copy(rr)
+		rr.Header().Class |= 0x8000
+		rrs[i] = rr
+	}
+	return rrs
+}
+
+func capTTL(rrs []dns.RR, ttl uint32) []dns.RR {
+	for i, rr := range rrs {
+		rr = dns.Copy(rr)
+		rr.Header().Ttl = min(rr.Header().Ttl, ttl)
+		rrs[i] = rr
+	}
+	return rrs
+}
+
+// Register validates ad, probes for its name and announces it, under the
+// next free name when another host has it unless ad fails on conflicts.
+func (r *Responder) Register(ad Advertisement) (Advertisement, error) {
+	if err := ad.validate(); err != nil {
+		return ad, err
+	}
+	id := make([]byte, 8)
+	for i := range id {
+		id[i] = byte(rand.N(256))
+	}
+	ad.ID = hex.EncodeToString(id)
+	ad.CreatedAt = time.Now().Unix()
+	entry := &advertised{Advertisement: ad}
+
+	r.mu.Lock()
+	if r.nameTaken(entry) {
+		r.mu.Unlock()
+		return ad, errNameConflict
+	}
+	if r.hostTaken(entry) {
+		r.mu.Unlock()
+		return ad, fmt.Errorf("%w: host %q is advertised at another address", errNameConflict, ad.Host)
+	}
+	r.ads[ad.ID] = entry
+	r.mu.Unlock()
+
+	if err := r.publish(entry); err != nil {
+		r.mu.Lock()
+		delete(r.ads, ad.ID)
+		r.mu.Unlock()
+		return entry.Advertisement, err
+	}
+
+	saved := r.Get(ad.ID)
+	if err := r.save(saved); err != nil {
+		return saved, err
+	}
+	return saved, nil
+}
+
+// Get returns the advertisement with id, or one with an empty ID.
+func (r *Responder) Get(id string) Advertisement {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if ad := r.ads[id]; ad != nil {
+		return ad.Advertisement
+	}
+	return Advertisement{}
+}
+
+// List returns the advertisements, oldest first.
+func (r *Responder) List() []Advertisement {
+	r.mu.Lock()
+	ads := make([]Advertisement, 0, len(r.ads))
+	for _, ad := range r.ads {
+		ads = append(ads, ad.Advertisement)
+	}
+	r.mu.Unlock()
+	sort.Slice(ads, func(i, j int) bool {
+		if ads[i].CreatedAt != ads[j].CreatedAt {
+			return ads[i].CreatedAt < ads[j].CreatedAt
+		}
+		return ads[i].ID < ads[j].ID
+	})
+	return ads
+}
+
+// Remove withdraws the advertisement with id. It reports whether there was
+// one.
+func (r *Responder) Remove(id string) (bool, error) {
+	r.mu.Lock()
+	ad := r.ads[id]
+	delete(r.ads, id)
+	iface := r.iface
+	r.mu.Unlock()
+	if ad == nil {
+		return false, nil
+	}
+	if ad.State == advertiseAnnounced {
+		r.goodbye(ad.Advertisement, iface)
+	}
+	return true, r.store.Delete(advertiseBucket, id)
+}
+
+// Shutdown sends goodbyes for every announced advertisement.
+func (r *Responder) Shutdown() {
+	r.mu.Lock()
+	r.closing = true
+	iface := r.iface
+	var ads []Advertisement
+	for _, ad := range r.ads {
+		if ad.State == advertiseAnnounced {
+			ads = append(ads, ad.Advertisement)
+		}
+	}
+	r.mu.Unlock()
+	for _, ad := range ads {
+		r.goodbye(ad, iface)
+	}
+}
+
+// Advertise handles /api/advertise: GET lists the advertised services and
+// POST registers one, {"name", "type", "port", "txt", "host"}, with
+// "address" for a host on another subnet. It answers
+// once probing is done, with 409 when the name is taken.
+func (s *MDNSServer) Advertise(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		writeJSON(w, http.StatusOK, map[string]interface{}{"advertisements": s.responder.List()})
+
+	case http.MethodPost:
+		var req Advertisement
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		ad, err := s.responder.Register(req)
+		switch {
+		case errors.Is(err, errNameConflict):
+			writeError(w, http.StatusConflict, fmt.Sprintf("%q (%s): %v", ad.Name, ad.Type, err))
+		case err != nil && ad.ID == "":
+			writeError(w, http.StatusBadRequest, err.Error())
+		case err != nil:
+			writeError(w, http.StatusInternalServerError, err.Error())
+		default:
+			writeJSON(w, http.StatusCreated, ad)
+		}
+
+	default:
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+	}
+}
+
+// AdvertiseItem handles GET and DELETE /api/advertise/{id}. Deleting sends
+// a goodbye so caches drop the service right away.
+func (s *MDNSServer) AdvertiseItem(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	switch r.Method {
+	case http.MethodGet:
+		ad := s.responder.Get(id)
+		if ad.ID == "" {
+			writeError(w, http.StatusNotFound, "advertisement not found")
+			return
+		}
+		writeJSON(w, http.StatusOK, ad)
+
+	case http.MethodDelete:
+		found, err := s.responder.Remove(id)
+		if !found {
+			writeError(w, http.StatusNotFound, "advertisement not found")
+			return
+		}
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+	}
+}
@@ -0,0 +1,425 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// fakeNetwork records what a responder transmits, and lets a test answer
+// its probes as another host would.
+type fakeNetwork struct {
+	mu      sync.Mutex
+	sent    []*dns.Msg
+	to      []*net.UDPAddr
+	onProbe func(query *dns.Msg)
+}
+
+func (n *fakeNetwork) transmit(msg *dns.Msg, iface string, to *net.UDPAddr) error {
+	n.mu.Lock()
+	n.sent = append(n.sent, msg.Copy())
+	n.to = append(n.to, to)
+	onProbe := n.onProbe
+	n.mu.Unlock()
+	if !msg.Response && onProbe != nil {
+		onProbe(msg)
+	}
+	return nil
+}
+
+func (n *fakeNetwork) messages() []*dns.Msg {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return append([]*dns.Msg(nil), n.sent...)
+}
+
+// waitFor polls until a transmitted message satisfies ok.
+func (n *fakeNetwork) waitFor(t *testing.T, ok func(*dns.Msg) bool) *dns.Msg {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for time.Now().Before(deadline) {
+		for _, msg := range n.messages() {
+			if ok(msg) {
+				return msg
+			}
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	t.Fatalf("Expected a matching message, got %d others", len(n.messages()))
+	return nil
+}
+
+var shortenProbing sync.Once
+
+func newTestResponder(t *testing.T, store Store) (*Responder, *fakeNetwork) {
+	t.Helper()
+	// Set once: announcements of earlier tests may still be running
+	shortenProbing.Do(func() { probeInterval, announceInterval = 10*time.Millisecond, 10*time.Millisecond })
+
+	server := NewMDNSServer()
+	responder, err := NewResponder(store, server)
+	if err != nil {
+		t.Fatalf("Expected the responder to load, got %v", err)
+	}
+	network := &fakeNetwork{}
+	responder.transmit = network.transmit
+	responder.address = func(string) net.IP { return net.IPv4(192, 168, 1, 20) }
+	server.responder = responder
+	responder.Start()
+	return responder, network
+}
+
+// TestAdvertiseProbesThenAnnounces verifies a registration is probed for
+// three times before its records are announced with the cache-flush bit on
+// the unique ones.
+func TestAdvertiseProbesThenAnnounces(t *testing.T) {
+	responder, network := newTestResponder(t, openTestStore(t, "json", t.TempDir()))
+
+	ad, err := responder.Register(Advertisement{Name: "Backup NAS", Type: "_smb._tcp", Port: 445, TXT: map[string]string{"model": "Xserve"}, Host: "nas"})
+	if err != nil {
+		t.Fatalf("Expected the registration to succeed, got %v", err)
+	}
+	if ad.State != advertiseAnnounced {
+		t.Fatalf("Expected state %q, got %q", advertiseAnnounced, ad.State)
+	}
+
+	probes := 0
+	for _, msg := range network.messages() {
+		if !msg.Response {
+			probes++
+			if q := msg.Question[0]; q.Name != `Backup\ NAS._smb._tcp.local.` || q.Qtype != dns.TypeANY || q.Qclass&0x8000 == 0 {
+				t.Fatalf("Expected a QU ANY probe for the instance, got %v", q)
+			}
+			if len(msg.Ns) != 2 {
+				t.Fatalf("Expected the proposed records in the authority section, got %v", msg.Ns)
+			}
+		}
+	}
+	if probes != probeCount {
+		t.Fatalf("Expected %d probes, got %d", probeCount, probes)
+	}
+
+	announcement := network.waitFor(t, func(msg *dns.Msg) bool { return msg.Response })
+	var srv *dns.SRV
+	for _, rr := range announcement.Answer {
+		if s, ok := rr.(*dns.SRV); ok {
+			srv = s
+		}
+	}
+	if srv == nil || srv.Target != "nas.local." || srv.Port != 445 || srv.Hdr.Class&0x8000 == 0 {
+		t.Fatalf("Expected a cache-flush SRV for nas.local.:445, got %v", srv)
+	}
+}
+
+// TestAdvertiseAnswersQueries verifies PTR queries get the instance with
+// its SRV, TXT and address as additional records, and that answers the
+// querier already knows are suppressed.
+func TestAdvertiseAnswersQueries(t *testing.T) {
+	responder, network := newTestResponder(t, openTestStore(t, "json", t.TempDir()))
+	if _, err := responder.Register(Advertisement{Name: "Printer", Type: "_ipp._tcp", Port: 631, Host: "office"}); err != nil {
+		t.Fatalf("Expected the registration to succeed, got %v", err)
+	}
+
+	query := new(dns.Msg)
+	query.SetQuestion("_ipp._tcp.local.", dns.TypePTR)
+	query.Id = 0
+	packet, _ := query.Pack()
+	responder.handle(packet, "en5", mdnsGroup)
+
+	reply := network.waitFor(t, func(msg *dns.Msg) bool {
+		return msg.Response && len(msg.Answer) == 1 && msg.Answer[0].Header().Rrtype == dns.TypePTR
+	})
+	if ptr := reply.Answer[0].(*dns.PTR); ptr.Ptr != "Printer._ipp._tcp.local." {
+		t.Fatalf("Expected the instance in the answer, got %v", ptr)
+	}
+	types := map[uint16]bool{}
+	for _, rr := range reply.Extra {
+		types[rr.Header().Rrtype] = true
+	}
+	if !types[dns.TypeSRV] || !types[dns.TypeTXT] || !types[dns.TypeA] {
+		t.Fatalf("Expected SRV, TXT and A additional records, got %v", reply.Extra)
+	}
+
+	// A querier that already has the PTR gets no answer
+	before := len(network.messages())
+	query.Answer = []dns.RR{&dns.PTR{
+		Hdr: dns.RR_Header{Name: "_ipp._tcp.local.", Rrtype: dns.TypePTR, Class: dns.ClassINET, Ttl: serviceRecordTTL},
+		Ptr: "Printer._ipp._tcp.local.",
+	}}
+	packet, _ = query.Pack()
+	responder.handle(packet, "en5", mdnsGroup)
+	time.Sleep(200 * time.Millisecond)
+	if after := len(network.messages()); after != before {
+		t.Fatalf("Expected the known answer to be suppressed, got %d new messages", after-before)
+	}
+
+	// Legacy unicast queries get a DNS reply with the query's ID
+	legacy := new(dns.Msg)
+	legacy.SetQuestion("Printer._ipp._tcp.local.", dns.TypeSRV)
+	packet, _ = legacy.Pack()
+	from := &net.UDPAddr{IP: net.IPv4(192, 168, 1, 50), Port: 54321}
+	responder.handle(packet, "en5", from)
+	reply = network.waitFor(t, func(msg *dns.Msg) bool { return msg.Response && msg.Id == legacy.Id })
+	if len(reply.Question) != 1 || reply.Answer[0].Header().Ttl > 10 {
+		t.Fatalf("Expected the question echoed and TTLs capped at 10s, got %v", reply)
+	}
+}
+
+// TestAdvertiseLegacyEDNS0 verifies legacy unicast replies are cut to 512
+// bytes unless the query carries an OPT record, which the reply repeats
+func TestAdvertiseLegacyEDNS0(t *testing.T) {
+	responder, network := newTestResponder(t, openTestStore(t, "json", t.TempDir()))
+	txt := map[string]string{}
+	for _, key := range []string{"a", "b", "c", "d"} {
+		txt[key] = strings.Repeat("x", 200)
+	}
+	if _, err := responder.Register(Advertisement{Name: "Scanner", Type: "_uscan._tcp", Port: 8080, TXT: txt, Host: "scanner"}); err != nil {
+		t.Fatalf("Expected the registration to succeed, got %v", err)
+	}
+	from := &net.UDPAddr{IP: net.IPv4(192, 168, 1, 50), Port: 54321}
+
+	query := new(dns.Msg)
+	query.SetQuestion("Scanner._uscan._tcp.local.", dns.TypeTXT)
+	packet, _ := query.Pack()
+	responder.handle(packet, "en5", from)
+	reply := network.waitFor(t, func(msg *dns.Msg) bool { return msg.Response && msg.Id == query.Id })
+	if !reply.Truncated || len(reply.Answer) != 0 || reply.IsEdns0() != nil {
+		t.Fatalf("Expected a truncated reply without OPT, got %v", reply)
+	}
+
+	query = new(dns.Msg)
+	query.SetQuestion("Scanner._uscan._tcp.local.", dns.TypeTXT)
+	query.SetEdns0(4096, false)
+	packet, _ = query.Pack()
+	responder.handle(packet, "en5", from)
+	reply = network.waitFor(t, func(msg *dns.Msg) bool { return msg.Response && msg.Id == query.Id })
+	if reply.Truncated || len(reply.Answer) != 1 || reply.IsEdns0() == nil {
+		t.Fatalf("Expected the full reply with OPT, got %v", reply)
+	}
+}
+
+// conflictingAnswer is a response from a host with another SRV record for
+// name.
+func conflictingAnswer(name string) []byte {
+	answer := new(dns.Msg)
+	answer.Response = true
+	answer.Answer = []dns.RR{&dns.SRV{
+		Hdr:    dns.RR_Header{Name: name, Rrtype: dns.TypeSRV, Class: dns.ClassINET | 0x8000, Ttl: 120},
+		Target: "other.local.",
+		Port:   8080,
+	}}
+	packet, _ := answer.Pack()
+	return packet
+}
+
+// answerProbesFor makes the fake network answer probes for name as that
+// host would.
+func answerProbesFor(responder *Responder, network *fakeNetwork, name string) {
+	network.mu.Lock()
+	defer network.mu.Unlock()
+	network.onProbe = func(query *dns.Msg) {
+		if query.Question[0].Name == name {
+			go responder.handle(conflictingAnswer(name), "en5", mdnsGroup)
+		}
+	}
+}
+
+// TestAdvertiseConflictRename verifies a name another host answers for is
+// replaced by "Name (2)".
+func TestAdvertiseConflictRename(t *testing.T) {
+	responder, network := newTestResponder(t, openTestStore(t, "json", t.TempDir()))
+	answerProbesFor(responder, network, "Web._http._tcp.local.")
+
+	ad, err := responder.Register(Advertisement{Name: "Web", Type: "_http._tcp", Port: 80})
+	if err != nil {
+		t.Fatalf("Expected the registration to succeed, got %v", err)
+	}
+	if ad.Name != "Web (2)" || ad.RequestedName != "Web" || ad.Conflicts != 1 || ad.State != advertiseAnnounced {
+		t.Fatalf("Expected \"Web (2)\" announced after one conflict, got %+v", ad)
+	}
+	if got := rename("Web (9)"); got != "Web (10)" {
+		t.Fatalf("Expected \"Web (10)\", got %q", got)
+	}
+}
+
+// TestAdvertiseConflictFail verifies a registration that fails on
+// conflicts isn't registered and the API reports 409.
+func TestAdvertiseConflictFail(t *testing.T) {
+	responder, network := newTestResponder(t, openTestStore(t, "json", t.TempDir()))
+	answerProbesFor(responder, network, "Web._http._tcp.local.")
+
+	req := httptest.NewRequest(http.MethodPost, "/api/advertise", strings.NewReader(`{"name": "Web", "type": "_http._tcp", "port": 80, "onConflict": "fail"}`))
+	rec := httptest.NewRecorder()
+	responder.server.Advertise(rec, req)
+	if rec.Code != http.StatusConflict {
+		t.Fatalf("Expected status 409, got %d: %s", rec.Code, rec.Body.String())
+	}
+	if ads := responder.List(); len(ads) != 0 {
+		t.Fatalf("Expected nothing registered, got %v", ads)
+	}
+}
+
+// TestAdvertiseConflictAfterAnnouncing verifies an announced name another
+// host starts answering for is probed for again and renamed.
+func TestAdvertiseConflictAfterAnnouncing(t *testing.T) {
+	responder, network := newTestResponder(t, openTestStore(t, "json", t.TempDir()))
+	ad, err := responder.Register(Advertisement{Name: "Web", Type: "_http._tcp", Port: 80})
+	if err != nil {
+		t.Fatalf("Expected the registration to succeed, got %v", err)
+	}
+	answerProbesFor(responder, network, "Web._http._tcp.local.")
+	responder.handle(conflictingAnswer("Web._http._tcp.local."), "en5", mdnsGroup)
+
+	deadline := time.Now().Add(2 * time.Second)
+	for responder.Get(ad.ID).Name != "Web (2)" {
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected the advertisement to be renamed, got %+v", responder.Get(ad.ID))
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+// TestProbeTiebreak verifies simultaneous probes are ordered by their
+// proposed records, and identical ones, our own looped back, don't
+// conflict.
+func TestProbeTiebreak(t *testing.T) {
+	srv := func(port uint16) []dns.RR {
+		return []dns.RR{&dns.SRV{Hdr: dns.RR_Header{Name: "Web._http._tcp.local.", Rrtype: dns.TypeSRV, Class: dns.ClassINET}, Target: "a.local.", Port: port}}
+	}
+	if c := compareProbeRecords(srv(80), srv(8080)); c >= 0 {
+		t.Fatalf("Expected port 80 to be earlier than 8080, got %d", c)
+	}
+	if c := compareProbeRecords(srv(80), srv(80)); c != 0 {
+		t.Fatalf("Expected identical records to compare equal, got %d", c)
+	}
+
+	// Losing the tiebreak defers, and the name is kept
+	responder, network := newTestResponder(t, openTestStore(t, "json", t.TempDir()))
+	lost := false
+	network.onProbe = func(query *dns.Msg) {
+		if lost {
+			return
+		}
+		lost = true
+		theirs := query.Copy()
+		theirs.Ns[0].(*dns.SRV).Port = 65535
+		packet, _ := theirs.Pack()
+		responder.handle(packet, "en5", mdnsGroup)
+	}
+	ad, err := responder.Register(Advertisement{Name: "Web", Type: "_http._tcp", Port: 80})
+	if err != nil || ad.Name != "Web" || ad.Conflicts != 0 {
+		t.Fatalf("Expected the name kept after deferring, got %+v, %v", ad, err)
+	}
+	probes := 0
+	for _, msg := range network.messages() {
+		if !msg.Response {
+			probes++
+		}
+	}
+	if probes <= probeCount {
+		t.Fatalf("Expected probing to start over, got %d probes", probes)
+	}
+}
+
+// TestAdvertiseGoodbye verifies deleting an advertisement sends its records
+// with TTL 0.
+func TestAdvertiseGoodbye(t *testing.T) {
+	responder, network := newTestResponder(t, openTestStore(t, "json", t.TempDir()))
+	ad, err := responder.Register(Advertisement{Name: "Web", Type: "_http._tcp", Port: 8080})
+	if err != nil {
+		t.Fatalf("Expected the registration to succeed, got %v", err)
+	}
+
+	req := httptest.NewRequest(http.MethodDelete, "/api/advertise/"+ad.ID, nil)
+	req.SetPathValue("id", ad.ID)
+	rec := httptest.NewRecorder()
+	responder.server.AdvertiseItem(rec, req)
+	if rec.Code != http.StatusNoContent {
+		t.Fatalf("Expected status 204, got %d", rec.Code)
+	}
+	network.waitFor(t, func(msg *dns.Msg) bool {
+		if !msg.Response || len(msg.Answer) == 0 {
+			return false
+		}
+		for _, rr := range msg.Answer {
+			if rr.Header().Ttl != 0 {
+				return false
+			}
+		}
+		return true
+	})
+}
+
+// TestAdvertisePersisted verifies advertisements are announced again after
+// a restart.
+func TestAdvertisePersisted(t *testing.T) {
+	store := openTestStore(t, "json", t.TempDir())
+	responder, _ := newTestResponder(t, store)
+	if _, err := responder.Register(Advertisement{Name: "Web", Type: "_http._tcp", Port: 8080, Host: "box"}); err != nil {
+		t.Fatalf("Expected the registration to succeed, got %v", err)
+	}
+
+	restarted, network := newTestResponder(t, store)
+	if ads := restarted.List(); len(ads) != 1 || ads[0].Name != "Web" {
+		t.Fatalf("Expected the advertisement to be reloaded, got %v", ads)
+	}
+	network.waitFor(t, func(msg *dns.Msg) bool { return msg.Response })
+}
+
+// TestAdvertiseValidation verifies malformed registrations are rejected.
+func TestAdvertiseValidation(t *testing.T) {
+	for _, ad := range []Advertisement{
+		{Name: "", Type: "_http._tcp", Port: 80},
+		{Name: "Web", Type: "http", Port: 80},
+		{Name: "Web", Type: "_http._tcp"},
+		{Name: "Web", Type: "_http._tcp", Port: 80, Host: "not a host"},
+	} {
+		if err := ad.validate(); err == nil {
+			t.Fatalf("Expected %+v to be rejected", ad)
+		}
+	}
+}
+
+// TestAdvertiseProxy verifies a service of a host on another subnet is
+// advertised with that host's address, whose name is probed for and
+// answered as unique.
+func TestAdvertiseProxy(t *testing.T) {
+	responder, network := newTestResponder(t, openTestStore(t, "json", t.TempDir()))
+	ad := Advertisement{Name: "Office NAS", Type: "_adisk._tcp", Port: 9, Host: "nas-vlan20", Address: "10.20.0.5"}
+	if _, err := responder.Register(ad); err != nil {
+		t.Fatalf("Expected the registration to succeed, got %v", err)
+	}
+	for _, msg := range network.messages() {
+		if !msg.Response && (len(msg.Question) != 2 || msg.Question[1].Name != "nas-vlan20.local.") {
+			t.Fatalf("Expected the proxied host name to be probed for, got %v", msg.Question)
+		}
+	}
+
+	query := new(dns.Msg)
+	query.SetQuestion("nas-vlan20.local.", dns.TypeA)
+	query.Id = 0
+	packet, _ := query.Pack()
+	responder.handle(packet, "en5", mdnsGroup)
+	reply := network.waitFor(t, func(msg *dns.Msg) bool {
+		return msg.Response && len(msg.Answer) == 1 && msg.Answer[0].Header().Rrtype == dns.TypeA
+	})
+	if a := reply.Answer[0].(*dns.A); !a.A.Equal(net.ParseIP("10.20.0.5")) || a.Hdr.Class&0x8000 == 0 {
+		t.Fatalf("Expected a cache-flush A record for 10.20.0.5, got %v", a)
+	}
+
+	// The same host name can't point elsewhere
+	other := Advertisement{Name: "Other", Type: "_smb._tcp", Port: 445, Host: "nas-vlan20", Address: "10.20.0.6"}
+	if _, err := responder.Register(other); !errors.Is(err, errNameConflict) {
+		t.Fatalf("Expected a conflict for the host name, got %v", err)
+	}
+	if err := (&Advertisement{Name: "NAS", Type: "_smb._tcp", Port: 445, Address: "10.20.0.5"}).validate(); err == nil {
+		t.Fatalf("Expected a proxy without a host name to be rejected")
+	}
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// AdminAllowlist restricts requests that change state, such as editing
+// devices or adding notifiers, to clients on some networks, e.g. localhost
+// and a management VLAN. It applies whether or not the API needs
+// authentication, so a leaked token or session is of no use elsewhere on
+// the LAN.
+type AdminAllowlist struct {
+	networks []*net.IPNet
+	audit    *AuditLog // nil records nothing
+}
+
+// auditAdminDenied is the audit action of a request the allowlist refused.
+const auditAdminDenied = "admin-denied"
+
+// ParseAdminAllowlist parses comma-separated CIDRs or addresses, e.g.
+// "127.0.0.1,::1,10.20.0.0/24". An empty list allows everyone and returns
+// nil.
+func ParseAdminAllowlist(spec string) (*AdminAllowlist, error) {
+	networks, err := parseNetworks(strings.Split(spec, ","))
+	if err != nil {
+		return nil, err
+	}
+	if len(networks) == 0 {
+		return nil, nil
+	}
+	return &AdminAllowlist{networks: networks}, nil
+}
+
+// parseNetworks parses CIDRs and addresses, the latter as networks of one
+// address. Empty entries are skipped.
+func parseNetworks(entries []string) ([]*net.IPNet, error) {
+	var networks []*net.IPNet
+	for _, entry := range entries {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		if !strings.Contains(entry, "/") {
+			ip := net.ParseIP(entry)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid address %q", entry)
+			}
+			bits := 128
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 32
+			}
+			networks = append(networks, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, network, err := net.ParseCIDR(entry)
+		if err != nil {
+			return nil, fmt.Errorf("invalid network %q", entry)
+		}
+		networks = append(networks, network)
+	}
+	return networks, nil
+}
+
+// Allows reports whether a client address may change state.
+func (l *AdminAllowlist) Allows(ip net.IP) bool {
+	if l == nil {
+		return true
+	}
+	for _, network := range l.networks {
+		if ip != nil && network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// administrative reports whether a request to an API path changes state.
+// Logging in and out, GraphQL queries and dry runs of notifiers, which
+// only read, are not administrative.
+func administrative(method, path string) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+		return false
+	}
+	return path != "login" && path != "logout" && path != "graphql" && path != "rules/test"
+}
+
+// Wrap refuses administrative requests from clients outside the allowlist
+// with 403.
+func (l *AdminAllowlist) Wrap(next http.Handler) http.Handler {
+	if l == nil {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		path, ok := apiPath(r.URL.Path)
+		if ok && administrative(r.Method, path) {
+			ip := remoteIP(r)
+			if !l.Allows(net.ParseIP(ip)) {
+				l.audit.Record(auditAdminDenied, ip, r.Method+" "+r.URL.Path)
+				writeError(w, http.StatusForbidden, "changes are not allowed from "+ip)
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// TestParseAdminAllowlist verifies networks and bare addresses are parsed
+func TestParseAdminAllowlist(t *testing.T) {
+	if l, err := ParseAdminAllowlist(" "); err != nil || l != nil {
+		t.Fatalf("Expected no allowlist, got %v %v", l, err)
+	}
+	l, err := ParseAdminAllowlist("127.0.0.1, ::1, 10.20.0.0/24")
+	if err != nil {
+		t.Fatalf("Expected a valid allowlist, got %v", err)
+	}
+	for ip, allowed := range map[string]bool{"127.0.0.1": true, "::1": true, "::ffff:127.0.0.1": true, "10.20.0.99": true, "10.20.1.1": false, "192.168.1.5": false} {
+		if l.Allows(net.ParseIP(ip)) != allowed {
+			t.Fatalf("Expected %s allowed=%v", ip, allowed)
+		}
+	}
+	for _, invalid := range []string{"10.0.0.0/33", "localhost"} {
+		if _, err := ParseAdminAllowlist(invalid); err == nil {
+			t.Fatalf("Expected %q to be rejected", invalid)
+		}
+	}
+}
+
+// TestAdminAllowlistWrap verifies only administrative requests from other
+// networks are refused, and recorded in the audit log
+func TestAdminAllowlistWrap(t *testing.T) {
+	l, _ := ParseAdminAllowlist("10.20.0.0/24")
+	l.audit, _ = NewAuditLog(openTestStore(t, "json", t.TempDir()))
+	handler := l.Wrap(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	for _, tc := range []struct {
+		method, path, remote string
+		code                 int
+	}{
+		{http.MethodGet, "/api/devices", "192.168.1.5:5000", http.StatusOK},
+		{http.MethodPost, "/api/graphql", "192.168.1.5:5000", http.StatusOK},
+		{http.MethodPost, "/api/v1/login", "192.168.1.5:5000", http.StatusOK},
+		{http.MethodPut, "/api/v1/devices/nas.local", "192.168.1.5:5000", http.StatusForbidden},
+		{http.MethodDelete, "/api/notifiers/x", "192.168.1.5:5000", http.StatusForbidden},
+		{http.MethodPut, "/api/v1/devices/nas.local", "10.20.0.7:5000", http.StatusOK},
+		{http.MethodPost, "/somewhere", "192.168.1.5:5000", http.StatusOK},
+	} {
+		req := httptest.NewRequest(tc.method, tc.path, nil)
+		req.RemoteAddr = tc.remote
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		if rec.Code != tc.code {
+			t.Fatalf("Expected %d for %s %s from %s, got %d", tc.code, tc.method, tc.path, tc.remote, rec.Code)
+		}
+	}
+	if denied := l.audit.List(auditAdminDenied, 10); len(denied) != 2 || denied[0].IP != "192.168.1.5" {
+		t.Fatalf("Expected both refusals in the audit log, got %+v", denied)
+	}
+}
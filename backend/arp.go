@@ -0,0 +1,130 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"os"
+	"os/exec"
+	"regexp"
+	"runtime"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// arpRefreshInterval bounds how often the neighbor table is re-read.
+const arpRefreshInterval = 30 * time.Second
+
+var (
+	arpIPPattern  = regexp.MustCompile(`\b(\d{1,3}\.\d{1,3}\.\d{1,3}\.\d{1,3})\b`)
+	arpMACPattern = regexp.MustCompile(`\b([0-9a-fA-F]{1,2}[:-]){5}[0-9a-fA-F]{1,2}\b`)
+)
+
+// neighborTable caches the operating system's ARP table, mapping IPv4
+// addresses to MAC addresses.
+type neighborTable struct {
+	mu     sync.Mutex
+	macs   map[string]string
+	loaded time.Time
+	// disabled turns lookups off when the arp protocol is switched off
+	disabled atomic.Bool
+	// read loads the table; the privileged helper replaces it when set up
+	read func() (map[string]string, error)
+}
+
+var neighbors = &neighborTable{read: readARPTable}
+
+// lookup returns the MAC address of ip, or "" when it is not in the table.
+func (n *neighborTable) lookup(ip string) string {
+	if n.disabled.Load() {
+		return ""
+	}
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	n.refresh()
+	return n.macs[ip]
+}
+
+// snapshot returns a copy of the table, or nil when lookups are disabled.
+func (n *neighborTable) snapshot() map[string]string {
+	if n.disabled.Load() {
+		return nil
+	}
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	n.refresh()
+	macs := make(map[string]string, len(n.macs))
+	for ip, mac := range n.macs {
+		macs[ip] = mac
+	}
+	return macs
+}
+
+// refresh re-reads a stale table. Must be called with n.mu held.
+func (n *neighborTable) refresh() {
+	if time.Since(n.loaded) > arpRefreshInterval {
+		if macs, err := n.read(); err == nil {
+			n.macs = macs
+		}
+		n.loaded = time.Now()
+	}
+}
+
+// readARPTable reads the neighbor table from /proc on Linux and from the
+// arp command elsewhere.
+func readARPTable() (map[string]string, error) {
+	if runtime.GOOS == "linux" {
+		data, err := os.ReadFile("/proc/net/arp")
+		if err == nil {
+			return parseARPTable(data), nil
+		}
+	}
+
+	args := []string{"-an"}
+	if runtime.GOOS == "windows" {
+		args = []string{"-a"}
+	}
+	out, err := exec.Command("arp", args...).Output()
+	if err != nil {
+		return nil, fmt.Errorf("arp: %v", err)
+	}
+	return parseARPTable(out), nil
+}
+
+// parseARPTable extracts IP/MAC pairs from any of /proc/net/arp, BSD
+// "arp -an" or Windows "arp -a" output: every line holding both an IPv4 and
+// a MAC address is an entry.
+func parseARPTable(data []byte) map[string]string {
+	macs := make(map[string]string)
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		line := scanner.Text()
+		ip := arpIPPattern.FindString(line)
+		mac := arpMACPattern.FindString(line)
+		if ip == "" || mac == "" {
+			continue
+		}
+		if mac = normalizeMAC(mac); mac != "00:00:00:00:00:00" && mac != "ff:ff:ff:ff:ff:ff" {
+			macs[ip] = mac
+		}
+	}
+	return macs
+}
+
+// normalizeMAC lowercases a MAC address, uses colons as separators and pads
+// every octet to two digits (macOS prints "0:1b:...").
+func normalizeMAC(mac string) string {
+	parts := strings.FieldsFunc(strings.ToLower(mac), func(r rune) bool { return r == ':' || r == '-' })
+	for i, p := range parts {
+		if len(p) == 1 {
+			parts[i] = "0" + p
+		}
+	}
+	return strings.Join(parts, ":")
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"testing"
+)
+
+// TestParseARPTable verifies the Linux, macOS and Windows table formats
+func TestParseARPTable(t *testing.T) {
+	tables := map[string]string{
+		"linux": `IP address       HW type     Flags       HW address            Mask     Device
+192.168.1.20     0x1         0x2         b8:27:eb:12:34:56     *        eth0
+192.168.1.30     0x1         0x0         00:00:00:00:00:00     *        eth0`,
+		"darwin": `? (192.168.1.20) at b8:27:eb:12:34:56 on en0 ifscope [ethernet]
+? (192.168.1.21) at 0:1b:2:3c:4:5 on en0 ifscope [ethernet]
+? (192.168.1.30) at (incomplete) on en0 ifscope [ethernet]`,
+		"windows": `Interface: 192.168.1.10 --- 0x4
+  Internet Address      Physical Address      Type
+  192.168.1.20          b8-27-eb-12-34-56     dynamic
+  192.168.1.255         ff-ff-ff-ff-ff-ff     static`,
+	}
+
+	for os, table := range tables {
+		macs := parseARPTable([]byte(table))
+		if macs["192.168.1.20"] != "b8:27:eb:12:34:56" {
+			t.Fatalf("%s: expected the MAC of 192.168.1.20, got %v", os, macs)
+		}
+		if _, ok := macs["192.168.1.30"]; ok {
+			t.Fatalf("%s: expected the incomplete entry to be skipped", os)
+		}
+		if _, ok := macs["192.168.1.255"]; ok {
+			t.Fatalf("%s: expected the broadcast entry to be skipped", os)
+		}
+	}
+
+	if mac := parseARPTable([]byte(tables["darwin"]))["192.168.1.21"]; mac != "00:1b:02:3c:04:05" {
+		t.Fatalf("Expected short octets to be padded, got %q", mac)
+	}
+}
@@ -0,0 +1,249 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// ARP watch settings.
+const (
+	arpWatchInterval   = 30 * time.Second
+	gatewayRefresh     = 5 * time.Minute
+	garpWindow         = 10 * time.Second
+	garpStormThreshold = 20 // gratuitous ARPs from one MAC within garpWindow
+	maxARPAlerts       = 100
+)
+
+// arpPacket is a captured ARP request or reply.
+type arpPacket struct {
+	Op        uint16 // 1 request, 2 reply
+	SenderMAC string
+	SenderIP  string
+	TargetIP  string
+}
+
+// gratuitous reports whether the packet announces the sender's own binding
+// rather than asking for or answering about another address.
+func (p arpPacket) gratuitous() bool {
+	return p.SenderIP == p.TargetIP
+}
+
+// decodeARP decodes an Ethernet/IPv4 ARP packet, skipping VLAN tags.
+func decodeARP(frame []byte) (arpPacket, bool) {
+	if len(frame) < 14 {
+		return arpPacket{}, false
+	}
+	etherType := binary.BigEndian.Uint16(frame[12:14])
+	payload := frame[14:]
+	for (etherType == 0x8100 || etherType == 0x88a8) && len(payload) >= 4 {
+		etherType = binary.BigEndian.Uint16(payload[2:4])
+		payload = payload[4:]
+	}
+	// Hardware type Ethernet, protocol IPv4, 6-byte MACs, 4-byte addresses
+	if etherType != 0x0806 || len(payload) < 28 ||
+		binary.BigEndian.Uint16(payload[0:2]) != 1 || binary.BigEndian.Uint16(payload[2:4]) != 0x0800 ||
+		payload[4] != 6 || payload[5] != 4 {
+		return arpPacket{}, false
+	}
+	return arpPacket{
+		Op:        binary.BigEndian.Uint16(payload[6:8]),
+		SenderMAC: net.HardwareAddr(payload[8:14]).String(),
+		SenderIP:  net.IP(payload[14:18]).String(),
+		TargetIP:  net.IP(payload[24:28]).String(),
+	}, true
+}
+
+// ARPBinding is the MAC address an IPv4 address was last seen with.
+type ARPBinding struct {
+	IP        string `json:"ip"`
+	MAC       string `json:"mac"`
+	FirstSeen int64  `json:"firstSeen"` // when the address got this MAC
+	LastSeen  int64  `json:"lastSeen"`
+	Changes   int    `json:"changes"`
+}
+
+// ARPWatch tracks IP-to-MAC bindings from the ARP table and, with
+// -capture, from ARP packets. A binding that changes is an "arp-changed"
+// anomaly; a change of the default gateway's MAC, the classic sign of ARP
+// spoofing, is a high-severity "gateway-mac-changed" one. Storms of
+// gratuitous ARPs from one MAC are reported too.
+type ARPWatch struct {
+	bus *EventBus
+
+	mu        sync.Mutex
+	bindings  map[string]*ARPBinding
+	gateway   string
+	gatewayAt time.Time
+	garps     map[string][]time.Time // MAC -> recent gratuitous ARPs
+	storming  map[string]bool
+	alerts    []AnomalyEvent // latest last
+	// defaultGateway is replaced in tests
+	defaultGateway func() (string, error)
+}
+
+func NewARPWatch(bus *EventBus) *ARPWatch {
+	return &ARPWatch{
+		bus:            bus,
+		bindings:       make(map[string]*ARPBinding),
+		garps:          make(map[string][]time.Time),
+		storming:       make(map[string]bool),
+		defaultGateway: defaultGateway,
+	}
+}
+
+// Run compares the ARP table with the known bindings every
+// arpWatchInterval.
+func (a *ARPWatch) Run() {
+	for {
+		now := time.Now()
+		for ip, mac := range neighbors.snapshot() {
+			a.observe(ip, mac, "ARP table", now)
+		}
+		time.Sleep(arpWatchInterval)
+	}
+}
+
+// ObserveARP handles a captured ARP packet.
+func (a *ARPWatch) ObserveARP(p arpPacket, now time.Time) {
+	if p.SenderIP != "0.0.0.0" {
+		a.observe(p.SenderIP, p.SenderMAC, "ARP packet", now)
+	}
+	if p.gratuitous() {
+		a.gratuitousARP(p, now)
+	}
+}
+
+// refreshGateway re-reads the default gateway when stale. Must be called
+// with a.mu held.
+func (a *ARPWatch) refreshGateway(now time.Time) {
+	if now.Sub(a.gatewayAt) < gatewayRefresh {
+		return
+	}
+	a.gatewayAt = now
+	if ip, err := a.defaultGateway(); err == nil {
+		a.gateway = ip
+	}
+}
+
+// observe records that ip was seen with mac and reports a changed binding.
+func (a *ARPWatch) observe(ip, mac, source string, now time.Time) {
+	a.mu.Lock()
+	a.refreshGateway(now)
+	b := a.bindings[ip]
+	if b == nil {
+		a.bindings[ip] = &ARPBinding{IP: ip, MAC: mac, FirstSeen: now.Unix(), LastSeen: now.Unix()}
+		a.mu.Unlock()
+		return
+	}
+	b.LastSeen = now.Unix()
+	if b.MAC == mac {
+		a.mu.Unlock()
+		return
+	}
+
+	previous := b.MAC
+	b.MAC, b.FirstSeen = mac, now.Unix()
+	b.Changes++
+	// A spoofer answers for other addresses with its own MAC
+	var others []string
+	for _, other := range a.bindings {
+		if other.IP != ip && other.MAC == mac {
+			others = append(others, other.IP)
+		}
+	}
+	sort.Strings(others)
+
+	kind, severity := "arp-changed", "medium"
+	if ip == a.gateway {
+		kind, severity = "gateway-mac-changed", "high"
+	}
+	params := map[string]string{"ip": ip, "previous": previous, "mac": mac, "source": source}
+	key := kind
+	if len(others) > 0 {
+		key += "-shared-mac"
+		params["others"] = fmt.Sprint(others)
+	}
+	event := newAnomaly(kind, key, params)
+	event.Device, event.Severity = ip, severity
+	a.alert(event)
+	a.mu.Unlock()
+
+	a.bus.Publish(TopicAnomaly, event)
+}
+
+// gratuitousARP counts gratuitous ARPs per sender and reports a storm once
+// per burst.
+func (a *ARPWatch) gratuitousARP(p arpPacket, now time.Time) {
+	a.mu.Lock()
+	recent := a.garps[p.SenderMAC]
+	i := 0
+	for i < len(recent) && now.Sub(recent[i]) > garpWindow {
+		i++
+	}
+	recent = append(recent[i:], now)
+	a.garps[p.SenderMAC] = recent
+
+	if len(recent) < garpStormThreshold {
+		if len(recent) == 1 {
+			delete(a.storming, p.SenderMAC)
+		}
+		a.mu.Unlock()
+		return
+	}
+	if a.storming[p.SenderMAC] {
+		a.mu.Unlock()
+		return
+	}
+	a.storming[p.SenderMAC] = true
+	event := newAnomaly("gratuitous-arp-storm", "gratuitous-arp-storm", map[string]string{
+		"mac": p.SenderMAC, "count": strconv.Itoa(len(recent)), "ip": p.SenderIP, "window": garpWindow.String(),
+	})
+	event.Device, event.Severity = p.SenderIP, "high"
+	a.alert(event)
+	a.mu.Unlock()
+
+	a.bus.Publish(TopicAnomaly, event)
+}
+
+// alert keeps event for /api/arpwatch. Must be called with a.mu held.
+func (a *ARPWatch) alert(event AnomalyEvent) {
+	a.alerts = append(a.alerts, event)
+	if n := len(a.alerts) - maxARPAlerts; n > 0 {
+		a.alerts = append([]AnomalyEvent(nil), a.alerts[n:]...)
+	}
+}
+
+// ARPWatchStatus handles GET /api/arpwatch: the default gateway, the known
+// IP-to-MAC bindings and the latest alerts.
+func (s *MDNSServer) ARPWatchStatus(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	a := s.arpwatch
+	a.mu.Lock()
+	bindings := make([]ARPBinding, 0, len(a.bindings))
+	for _, b := range a.bindings {
+		bindings = append(bindings, *b)
+	}
+	gateway := map[string]string{"ip": a.gateway}
+	if b := a.bindings[a.gateway]; b != nil {
+		gateway["mac"] = b.MAC
+	}
+	alerts := append([]AnomalyEvent{}, a.alerts...)
+	a.mu.Unlock()
+
+	sort.Slice(bindings, func(i, j int) bool { return bindings[i].IP < bindings[j].IP })
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"gateway":  gateway,
+		"bindings": bindings,
+		"alerts":   alerts,
+	})
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// arpFrame builds an Ethernet ARP frame.
+func arpFrame(op uint16, senderMAC, senderIP, targetIP string) []byte {
+	frame := make([]byte, 14+28)
+	copy(frame[0:6], []byte{0xff, 0xff, 0xff, 0xff, 0xff, 0xff})
+	mac, _ := net.ParseMAC(senderMAC)
+	copy(frame[6:12], mac)
+	frame[12], frame[13] = 0x08, 0x06
+	arp := frame[14:]
+	arp[1] = 1    // Ethernet
+	arp[2] = 0x08 // IPv4
+	arp[4], arp[5] = 6, 4
+	arp[7] = byte(op)
+	copy(arp[8:14], mac)
+	copy(arp[14:18], net.ParseIP(senderIP).To4())
+	copy(arp[24:28], net.ParseIP(targetIP).To4())
+	return frame
+}
+
+// TestDecodeARP verifies that ARP packets are decoded and other frames
+// aren't.
+func TestDecodeARP(t *testing.T) {
+	p, ok := decodeARP(arpFrame(2, "aa:bb:cc:00:00:01", "10.0.0.1", "10.0.0.5"))
+	if !ok || p.Op != 2 || p.SenderMAC != "aa:bb:cc:00:00:01" || p.SenderIP != "10.0.0.1" || p.TargetIP != "10.0.0.5" {
+		t.Fatalf("Unexpected ARP packet %+v (%v)", p, ok)
+	}
+	if p.gratuitous() {
+		t.Fatalf("Expected a reply about another address not to be gratuitous")
+	}
+	if _, ok := decodeARP(testFrame("10.0.0.5", "10.0.0.1", protoTCP, 50000, 443, false)); ok {
+		t.Fatalf("Expected an IPv4 frame not to decode as ARP")
+	}
+}
+
+func newTestARPWatch(gateway string) (*ARPWatch, *[]AnomalyEvent) {
+	bus := NewEventBus()
+	var anomalies []AnomalyEvent
+	bus.Subscribe("test", func(e BusEvent) { anomalies = append(anomalies, e.Payload.(AnomalyEvent)) }, TopicAnomaly)
+	a := NewARPWatch(bus)
+	a.defaultGateway = func() (string, error) { return gateway, nil }
+	return a, &anomalies
+}
+
+// TestARPWatchBindingChanges verifies that a changed binding is a medium
+// anomaly and a changed gateway MAC a high one naming the spoofed addresses.
+func TestARPWatchBindingChanges(t *testing.T) {
+	a, anomalies := newTestARPWatch("10.0.0.1")
+	now := time.Now()
+	a.observe("10.0.0.1", "aa:bb:cc:00:00:01", "ARP table", now)
+	a.observe("10.0.0.5", "aa:bb:cc:00:00:05", "ARP table", now)
+	a.observe("10.0.0.9", "aa:bb:cc:00:00:09", "ARP table", now)
+	a.observe("10.0.0.5", "aa:bb:cc:00:00:05", "ARP table", now)
+	if len(*anomalies) != 0 {
+		t.Fatalf("Expected no anomalies for stable bindings, got %+v", *anomalies)
+	}
+
+	a.observe("10.0.0.5", "aa:bb:cc:00:00:55", "ARP table", now)
+	if len(*anomalies) != 1 || (*anomalies)[0].Kind != "arp-changed" || (*anomalies)[0].Severity != "medium" || (*anomalies)[0].Device != "10.0.0.5" {
+		t.Fatalf("Expected a medium arp-changed anomaly, got %+v", *anomalies)
+	}
+
+	a.ObserveARP(arpPacket{Op: 2, SenderMAC: "aa:bb:cc:00:00:09", SenderIP: "10.0.0.1", TargetIP: "10.0.0.5"}, now)
+	if len(*anomalies) != 2 {
+		t.Fatalf("Expected a gateway anomaly, got %+v", *anomalies)
+	}
+	event := (*anomalies)[1]
+	if event.Kind != "gateway-mac-changed" || event.Severity != "high" || event.Device != "10.0.0.1" {
+		t.Fatalf("Expected a high gateway-mac-changed anomaly, got %+v", event)
+	}
+	if !strings.HasSuffix(event.Message, "; aa:bb:cc:00:00:09 is also the MAC of [10.0.0.9]") {
+		t.Fatalf("Expected the message to name the other address, got %q", event.Message)
+	}
+
+	server := NewMDNSServer()
+	server.arpwatch = a
+	rec := httptest.NewRecorder()
+	server.ARPWatchStatus(rec, httptest.NewRequest(http.MethodGet, "/api/arpwatch", nil))
+	var resp struct {
+		Gateway  map[string]string `json:"gateway"`
+		Bindings []ARPBinding      `json:"bindings"`
+		Alerts   []AnomalyEvent    `json:"alerts"`
+	}
+	json.NewDecoder(rec.Body).Decode(&resp)
+	if resp.Gateway["ip"] != "10.0.0.1" || resp.Gateway["mac"] != "aa:bb:cc:00:00:09" {
+		t.Fatalf("Unexpected gateway %+v", resp.Gateway)
+	}
+	if len(resp.Bindings) != 3 || resp.Bindings[0].IP != "10.0.0.1" || resp.Bindings[0].Changes != 1 || len(resp.Alerts) != 2 {
+		t.Fatalf("Unexpected status %+v", resp)
+	}
+}
+
+// TestARPWatchGratuitousStorm verifies that a burst of gratuitous ARPs is
+// reported once, and again after it has died down.
+func TestARPWatchGratuitousStorm(t *testing.T) {
+	a, anomalies := newTestARPWatch("10.0.0.1")
+	garp := arpPacket{Op: 1, SenderMAC: "aa:bb:cc:00:00:66", SenderIP: "10.0.0.6", TargetIP: "10.0.0.6"}
+	now := time.Now()
+	for i := 0; i < 50; i++ {
+		a.ObserveARP(garp, now.Add(time.Duration(i)*100*time.Millisecond))
+	}
+	if len(*anomalies) != 1 || (*anomalies)[0].Kind != "gratuitous-arp-storm" || (*anomalies)[0].Severity != "high" {
+		t.Fatalf("Expected one gratuitous-arp-storm anomaly, got %+v", *anomalies)
+	}
+
+	later := now.Add(time.Minute)
+	for i := 0; i < garpStormThreshold; i++ {
+		a.ObserveARP(garp, later.Add(time.Duration(i)*100*time.Millisecond))
+	}
+	if len(*anomalies) != 2 {
+		t.Fatalf("Expected a second burst to be reported, got %+v", *anomalies)
+	}
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// auditBucket is the Store bucket the audit log is kept in.
+const auditBucket = "audit"
+
+// maxAuditEntries bounds the audit log between vacuum runs; the oldest
+// entries are dropped first.
+const maxAuditEntries = 10000
+
+// What the audit log records.
+const (
+	auditLogin       = "login"
+	auditLoginFailed = "login-failed"
+	auditTokenFailed = "token-failed"
+	auditLockout     = "lockout"
+	auditLogout      = "logout"
+)
+
+// AuditEntry is one security-relevant event on /api/audit.
+type AuditEntry struct {
+	Time   int64  `json:"time"`
+	Action string `json:"action"`
+	IP     string `json:"ip,omitempty"`
+	Detail string `json:"detail,omitempty"`
+
+	key string
+}
+
+// AuditLog keeps security-relevant events, such as logins and lockouts, in
+// the store. It is pruned by the vacuum job under the "audit" retention
+// policy.
+type AuditLog struct {
+	mu      sync.Mutex
+	store   Store
+	entries []AuditEntry // oldest first
+	seq     int
+}
+
+// NewAuditLog loads the audit log from store.
+func NewAuditLog(store Store) (*AuditLog, error) {
+	a := &AuditLog{store: store}
+	entries, err := store.Load(auditBucket)
+	if err != nil {
+		return nil, err
+	}
+	for key, data := range entries {
+		entry := AuditEntry{key: key}
+		if err := json.Unmarshal(data, &entry); err != nil {
+			return nil, fmt.Errorf("audit entry %s: %v", key, err)
+		}
+		a.entries = append(a.entries, entry)
+	}
+	sort.Slice(a.entries, func(i, j int) bool { return a.entries[i].key < a.entries[j].key })
+	return a, nil
+}
+
+// Record adds an event to the audit log and logs it. A nil log only logs.
+func (a *AuditLog) Record(action, ip, detail string) {
+	log.Printf("🔐 Audit: %s from %s %s", action, ip, detail)
+	if a == nil {
+		return
+	}
+	now := time.Now()
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.seq++
+	entry := AuditEntry{Time: now.Unix(), Action: action, IP: ip, Detail: detail,
+		key: fmt.Sprintf("%020d-%06d", now.UnixNano(), a.seq%1000000)}
+	data, err := json.Marshal(entry)
+	if err == nil {
+		err = a.store.Put(auditBucket, map[string][]byte{entry.key: data})
+	}
+	if err != nil {
+		log.Printf("⚠️  Failed to record %s in the audit log: %v", action, err)
+		return
+	}
+	a.entries = append(a.entries, entry)
+	if excess := len(a.entries) - maxAuditEntries; excess > 0 {
+		a.drop(excess)
+	}
+}
+
+// drop removes the n oldest entries. It must be called with a.mu held.
+func (a *AuditLog) drop(n int) {
+	keys := make([]string, n)
+	for i := range keys {
+		keys[i] = a.entries[i].key
+	}
+	if err := a.store.Delete(auditBucket, keys...); err != nil {
+		log.Printf("⚠️  Failed to prune the audit log: %v", err)
+	}
+	a.entries = append(a.entries[:0], a.entries[n:]...)
+}
+
+// List returns the latest entries, newest first, optionally only those of
+// one action, at most limit of them.
+func (a *AuditLog) List(action string, limit int) []AuditEntry {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	entries := []AuditEntry{}
+	for i := len(a.entries) - 1; i >= 0 && len(entries) < limit; i-- {
+		if action == "" || a.entries[i].Action == action {
+			entries = append(entries, a.entries[i])
+		}
+	}
+	return entries
+}
+
+// Prune drops entries recorded before the cutoff.
+func (a *AuditLog) Prune(before time.Time) int {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	n := sort.Search(len(a.entries), func(i int) bool { return a.entries[i].Time >= before.Unix() })
+	if n > 0 {
+		a.drop(n)
+	}
+	return n
+}
+
+// Records returns the number of entries in the audit log.
+func (a *AuditLog) Records() int {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return len(a.entries)
+}
+
+// remoteIP is the address a request came from, without the port.
+func remoteIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// Audit handles GET /api/audit: the latest audit log entries, newest
+// first, at most ?limit= (default 100) of them and only ?action= if given.
+func (s *MDNSServer) Audit(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	limit := 100
+	if v := r.URL.Query().Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			writeError(w, http.StatusBadRequest, "invalid limit")
+			return
+		}
+		limit = n
+	}
+	writeJSON(w, http.StatusOK, s.audit.List(r.URL.Query().Get("action"), limit))
+}
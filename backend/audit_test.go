@@ -0,0 +1,62 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// TestAuditLog verifies entries are persisted, listed newest first and
+// pruned by age
+func TestAuditLog(t *testing.T) {
+	dir := t.TempDir()
+	audit, err := NewAuditLog(openTestStore(t, "json", dir))
+	if err != nil {
+		t.Fatalf("Expected an empty audit log, got %v", err)
+	}
+	audit.Record(auditLoginFailed, "192.168.1.50", "wrong password")
+	audit.Record(auditLogin, "192.168.1.50", "")
+
+	reloaded, err := NewAuditLog(openTestStore(t, "json", dir))
+	if err != nil || reloaded.Records() != 2 {
+		t.Fatalf("Expected 2 persisted entries, got %v", err)
+	}
+	entries := reloaded.List("", 10)
+	if len(entries) != 2 || entries[0].Action != auditLogin || entries[1].IP != "192.168.1.50" {
+		t.Fatalf("Expected the entries newest first, got %+v", entries)
+	}
+	if failed := reloaded.List(auditLoginFailed, 10); len(failed) != 1 || failed[0].Detail != "wrong password" {
+		t.Fatalf("Expected the failed login only, got %+v", failed)
+	}
+
+	if n := reloaded.Prune(time.Now().Add(time.Hour)); n != 2 || reloaded.Records() != 0 {
+		t.Fatalf("Expected both entries pruned, got %d", n)
+	}
+	if again, _ := NewAuditLog(openTestStore(t, "json", dir)); again.Records() != 0 {
+		t.Fatalf("Expected the pruned entries deleted from the store, got %d", again.Records())
+	}
+}
+
+// TestAuditHandler verifies GET /api/audit limits and filters entries
+func TestAuditHandler(t *testing.T) {
+	server := NewMDNSServer()
+	server.audit, _ = NewAuditLog(openTestStore(t, "json", t.TempDir()))
+	for i := 0; i < 3; i++ {
+		server.audit.Record(auditTokenFailed, "10.0.0.1", "GET /api/devices")
+	}
+	server.audit.Record(auditLockout, "10.0.0.1", "")
+
+	rec := httptest.NewRecorder()
+	server.Audit(rec, httptest.NewRequest(http.MethodGet, "/api/audit?limit=2&action=token-failed", nil))
+	var entries []AuditEntry
+	if err := json.Unmarshal(rec.Body.Bytes(), &entries); err != nil || len(entries) != 2 || entries[0].Action != auditTokenFailed {
+		t.Fatalf("Expected 2 failed tokens, got %d %s", rec.Code, rec.Body.String())
+	}
+	rec = httptest.NewRecorder()
+	server.Audit(rec, httptest.NewRequest(http.MethodGet, "/api/audit?limit=x", nil))
+	if rec.Code != http.StatusBadRequest {
+		t.Fatalf("Expected an invalid limit to be rejected, got %d", rec.Code)
+	}
+}
@@ -0,0 +1,382 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// sessionCookie is the cookie a login sets. It is HttpOnly, so scripts on
+// the page can't read it; they send the session's CSRF token instead.
+const sessionCookie = "nv_session"
+
+// csrfHeader carries a session's CSRF token on requests that change state.
+const csrfHeader = "X-CSRF-Token"
+
+// Auth guards the API once a login password or an API token is set, as the
+// login-password and api-token secrets. API clients send the token as a
+// bearer token; browsers log in with the password and get a session cookie.
+// Sessions are kept in memory, so a restart logs everyone out.
+//
+// Clients that fail to authenticate attempts times within lockout are
+// locked out for lockout, and logins are rate limited per client, so
+// passwords and tokens can't be guessed.
+type Auth struct {
+	password [32]byte // SHA-256 of the login password, compared in constant time
+	token    [32]byte // likewise for the API token
+	login    bool
+	bearer   bool
+	ttl      time.Duration
+	attempts int
+	lockout  time.Duration
+	audit    *AuditLog // nil records nothing
+
+	mu       sync.Mutex
+	sessions map[string]*authSession
+	clients  map[string]*authClient // by IP
+}
+
+// loginRate is how many logins a client may try per minute.
+const loginRate = 10
+
+// authClient tracks one client's attempts to authenticate.
+type authClient struct {
+	failures    []time.Time // within the lockout window
+	logins      []time.Time // in the last minute
+	lockedUntil time.Time
+}
+
+type authSession struct {
+	csrf    string
+	expires time.Time
+}
+
+// NewAuth returns the guard for a login password and an API token, either
+// of which may be empty. With neither the API is open, as it was before.
+func NewAuth(password, token string, ttl time.Duration) *Auth {
+	a := &Auth{login: password != "", bearer: token != "", ttl: ttl, attempts: 5, lockout: 15 * time.Minute,
+		sessions: make(map[string]*authSession), clients: make(map[string]*authClient)}
+	a.password = sha256.Sum256([]byte(password))
+	a.token = sha256.Sum256([]byte(token))
+	return a
+}
+
+// Enabled reports whether the API needs authentication.
+func (a *Auth) Enabled() bool { return a != nil && (a.login || a.bearer) }
+
+func matches(secret [32]byte, value string) bool {
+	sum := sha256.Sum256([]byte(value))
+	return subtle.ConstantTimeCompare(secret[:], sum[:]) == 1
+}
+
+func randomToken() (string, error) {
+	raw := make([]byte, 32)
+	if _, err := rand.Read(raw); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(raw), nil
+}
+
+// apiPath returns the path of an API request below the API root, e.g.
+// "devices/abc" for /api/devices/abc and /api/v1/devices/abc, or "discover"
+// for /discover, and false for anything else, like the frontend's files.
+func apiPath(path string) (string, bool) {
+	if path == "/discover" || strings.HasPrefix(path, "/discover/") {
+		return strings.TrimPrefix(path, "/"), true
+	}
+	rest, ok := strings.CutPrefix(path, "/api/")
+	if !ok {
+		return "", false
+	}
+	if versioned, ok := strings.CutPrefix(rest, apiVersion+"/"); ok {
+		rest = versioned
+	}
+	return rest, true
+}
+
+// public reports whether an API path is open without authentication: the
+// login itself, and shared views, which carry their own token.
+func public(path string) bool {
+	return path == "login" || path == "session" || strings.HasPrefix(path, "shared/")
+}
+
+// session returns the valid session a request's cookie names, if any.
+func (a *Auth) session(r *http.Request) (string, *authSession) {
+	cookie, err := r.Cookie(sessionCookie)
+	if err != nil {
+		return "", nil
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	session := a.sessions[cookie.Value]
+	if session == nil {
+		return "", nil
+	}
+	if time.Now().After(session.expires) {
+		delete(a.sessions, cookie.Value)
+		return "", nil
+	}
+	return cookie.Value, session
+}
+
+// bearerToken returns the bearer token a request carries, if any.
+func bearerToken(r *http.Request) (string, bool) {
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	return strings.TrimSpace(token), ok
+}
+
+// client returns the attempts of the client at ip, dropping those that no
+// longer count. It must be called with a.mu held.
+func (a *Auth) client(ip string, now time.Time) *authClient {
+	c := a.clients[ip]
+	if c == nil {
+		if len(a.clients) >= 10000 {
+			for key, old := range a.clients {
+				if now.After(old.lockedUntil) && (len(old.failures) == 0 || now.Sub(old.failures[len(old.failures)-1]) > a.lockout) {
+					delete(a.clients, key)
+				}
+			}
+		}
+		c = &authClient{}
+		a.clients[ip] = c
+	}
+	c.failures = since(c.failures, now.Add(-a.lockout))
+	c.logins = since(c.logins, now.Add(-time.Minute))
+	return c
+}
+
+// since returns the times at or after cutoff, which are sorted.
+func since(times []time.Time, cutoff time.Time) []time.Time {
+	for len(times) > 0 && times[0].Before(cutoff) {
+		times = times[1:]
+	}
+	return times
+}
+
+// lockedOut returns how long the client at ip is still locked out.
+func (a *Auth) lockedOut(ip string) time.Duration {
+	now := time.Now()
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if wait := a.client(ip, now).lockedUntil.Sub(now); wait > 0 {
+		return wait
+	}
+	return 0
+}
+
+// fail counts a failed attempt of the client at ip and locks it out once
+// it has failed too often.
+func (a *Auth) fail(ip, action, detail string) {
+	a.audit.Record(action, ip, detail)
+	now := time.Now()
+	a.mu.Lock()
+	c := a.client(ip, now)
+	c.failures = append(c.failures, now)
+	locked := a.attempts > 0 && len(c.failures) >= a.attempts
+	if locked {
+		c.failures, c.lockedUntil = nil, now.Add(a.lockout)
+	}
+	a.mu.Unlock()
+	if locked {
+		a.audit.Record(auditLockout, ip, fmt.Sprintf("%d failed attempts, locked out for %s", a.attempts, a.lockout))
+	}
+}
+
+// tooManyAttempts answers a client that is locked out or rate limited.
+func tooManyAttempts(w http.ResponseWriter, wait time.Duration) {
+	w.Header().Set("Retry-After", strconv.Itoa(int((wait+time.Second-1)/time.Second)))
+	writeError(w, http.StatusTooManyRequests, "too many authentication attempts, try again later")
+}
+
+// Wrap requires authentication for the API behind next. Requests with a
+// session cookie that change state must also send the session's CSRF
+// token, so other sites can't make a logged-in browser change anything.
+func (a *Auth) Wrap(next http.Handler) http.Handler {
+	if !a.Enabled() {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		path, ok := apiPath(r.URL.Path)
+		if !ok || public(path) || r.Method == http.MethodOptions {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if token, ok := bearerToken(r); ok {
+			if a.checkToken(w, r, token) {
+				next.ServeHTTP(w, r)
+			}
+			return
+		}
+		_, session := a.session(r)
+		if session == nil {
+			writeError(w, http.StatusUnauthorized, "authentication required")
+			return
+		}
+		switch r.Method {
+		case http.MethodGet, http.MethodHead:
+		default:
+			if subtle.ConstantTimeCompare([]byte(r.Header.Get(csrfHeader)), []byte(session.csrf)) != 1 {
+				writeError(w, http.StatusForbidden, "missing or invalid "+csrfHeader+" header")
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// checkToken checks the API token of a request, counting a wrong one
+// against the client like a wrong password. It answers the request itself
+// and returns false unless the token is valid.
+func (a *Auth) checkToken(w http.ResponseWriter, r *http.Request, token string) bool {
+	ip := remoteIP(r)
+	if wait := a.lockedOut(ip); wait > 0 {
+		tooManyAttempts(w, wait)
+		return false
+	}
+	if !a.bearer || !matches(a.token, token) {
+		a.fail(ip, auditTokenFailed, r.Method+" "+r.URL.Path)
+		writeError(w, http.StatusUnauthorized, "invalid API token")
+		return false
+	}
+	return true
+}
+
+// sessionInfo is what /api/login and /api/session tell the frontend.
+type sessionInfo struct {
+	Authenticated bool   `json:"authenticated"`
+	Required      bool   `json:"required"` // whether the API needs authentication at all
+	Login         bool   `json:"login"`    // whether the password login is available
+	CSRFToken     string `json:"csrfToken,omitempty"`
+	ExpiresAt     int64  `json:"expiresAt,omitempty"`
+}
+
+// Login handles POST /api/login: a {"password"} checked against the login
+// password starts a session, set as an HttpOnly cookie, and returns its
+// CSRF token.
+func (a *Auth) Login(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	if !a.login {
+		writeError(w, http.StatusNotFound, "password login is not configured (set the login-password secret)")
+		return
+	}
+	var body struct {
+		Password string `json:"password"`
+	}
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 4096)).Decode(&body); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid JSON body")
+		return
+	}
+	ip := remoteIP(r)
+	if wait := a.lockedOut(ip); wait > 0 {
+		tooManyAttempts(w, wait)
+		return
+	}
+	now := time.Now()
+	a.mu.Lock()
+	c := a.client(ip, now)
+	var wait time.Duration
+	if len(c.logins) >= loginRate {
+		wait = time.Minute - now.Sub(c.logins[0])
+	} else {
+		c.logins = append(c.logins, now)
+	}
+	a.mu.Unlock()
+	if wait > 0 {
+		tooManyAttempts(w, wait)
+		return
+	}
+	if !matches(a.password, body.Password) {
+		a.fail(ip, auditLoginFailed, "wrong password")
+		writeError(w, http.StatusUnauthorized, "wrong password")
+		return
+	}
+
+	id, err := randomToken()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	csrf, err := randomToken()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	session := &authSession{csrf: csrf, expires: now.Add(a.ttl)}
+	a.mu.Lock()
+	for key, s := range a.sessions {
+		if now.After(s.expires) {
+			delete(a.sessions, key)
+		}
+	}
+	a.sessions[id] = session
+	delete(a.clients, ip)
+	a.mu.Unlock()
+	a.audit.Record(auditLogin, ip, "")
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionCookie,
+		Value:    id,
+		Path:     "/",
+		Expires:  session.expires,
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+		SameSite: http.SameSiteStrictMode,
+	})
+	writeJSON(w, http.StatusOK, a.info(session))
+}
+
+// Logout handles POST /api/logout, ending the request's session.
+func (a *Auth) Logout(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	if id, _ := a.session(r); id != "" {
+		a.mu.Lock()
+		delete(a.sessions, id)
+		a.mu.Unlock()
+		a.audit.Record(auditLogout, remoteIP(r), "")
+	}
+	http.SetCookie(w, &http.Cookie{Name: sessionCookie, Value: "", Path: "/", MaxAge: -1, HttpOnly: true, Secure: r.TLS != nil, SameSite: http.SameSiteStrictMode})
+	writeJSON(w, http.StatusOK, a.info(nil))
+}
+
+// Session handles GET /api/session, which tells the frontend whether it
+// needs to log in and, after a reload, the CSRF token of its session.
+func (a *Auth) Session(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	_, session := a.session(r)
+	info := a.info(session)
+	info.Authenticated = info.Authenticated || !a.Enabled()
+	// The endpoint is public, so a token is checked like on the protected
+	// ones rather than letting tokens be guessed here
+	if token, ok := bearerToken(r); ok && a.Enabled() {
+		if !a.checkToken(w, r, token) {
+			return
+		}
+		info.Authenticated = true
+	}
+	writeJSON(w, http.StatusOK, info)
+}
+
+func (a *Auth) info(session *authSession) sessionInfo {
+	info := sessionInfo{Required: a.Enabled(), Login: a.login}
+	if session != nil {
+		info.Authenticated, info.CSRFToken, info.ExpiresAt = true, session.csrf, session.expires.Unix()
+	}
+	return info
+}
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newAuthHandler(auth *Auth) http.Handler {
+	mux := http.NewServeMux()
+	handleAPI(mux, "/api/login", auth.Login)
+	handleAPI(mux, "/api/logout", auth.Logout)
+	handleAPI(mux, "/api/session", auth.Session)
+	handleAPI(mux, "/api/devices", func(w http.ResponseWriter, r *http.Request) { writeJSON(w, http.StatusOK, r.Method) })
+	handleAPI(mux, "/api/shared/{token}/devices", func(w http.ResponseWriter, r *http.Request) { writeJSON(w, http.StatusOK, "shared") })
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) { w.Write([]byte("index")) })
+	return auth.Wrap(mux)
+}
+
+func authRequest(handler http.Handler, method, path, body string, headers map[string]string, cookies ...*http.Cookie) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	for key, value := range headers {
+		req.Header.Set(key, value)
+	}
+	for _, cookie := range cookies {
+		req.AddCookie(cookie)
+	}
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	return rec
+}
+
+// TestAuthDisabled verifies the API stays open without a password or token
+func TestAuthDisabled(t *testing.T) {
+	handler := newAuthHandler(NewAuth("", "", time.Hour))
+	if rec := authRequest(handler, http.MethodPost, "/api/v1/devices", "", nil); rec.Code != http.StatusOK {
+		t.Fatalf("Expected an open API, got %d", rec.Code)
+	}
+	rec := authRequest(handler, http.MethodGet, "/api/session", "", nil)
+	var info sessionInfo
+	json.Unmarshal(rec.Body.Bytes(), &info)
+	if !info.Authenticated || info.Required {
+		t.Fatalf("Expected no authentication to be required, got %+v", info)
+	}
+}
+
+// TestAuthSession verifies the password login sets an HttpOnly session
+// cookie and that state-changing requests need its CSRF token
+func TestAuthSession(t *testing.T) {
+	handler := newAuthHandler(NewAuth("hunter2", "", time.Hour))
+	for _, path := range []string{"/api/devices", "/api/v1/devices", "/discover"} {
+		if rec := authRequest(handler, http.MethodGet, path, "", nil); rec.Code != http.StatusUnauthorized {
+			t.Fatalf("Expected %s to need a login, got %d", path, rec.Code)
+		}
+	}
+	for _, path := range []string{"/", "/assets/app.js", "/api/shared/abc/devices"} {
+		if rec := authRequest(handler, http.MethodGet, path, "", nil); rec.Code != http.StatusOK {
+			t.Fatalf("Expected %s to stay public, got %d", path, rec.Code)
+		}
+	}
+	if rec := authRequest(handler, http.MethodPost, "/api/login", `{"password":"wrong"}`, nil); rec.Code != http.StatusUnauthorized {
+		t.Fatalf("Expected a wrong password to be rejected, got %d", rec.Code)
+	}
+
+	rec := authRequest(handler, http.MethodPost, "/api/login", `{"password":"hunter2"}`, nil)
+	cookies := rec.Result().Cookies()
+	if rec.Code != http.StatusOK || len(cookies) != 1 || !cookies[0].HttpOnly || cookies[0].SameSite != http.SameSiteStrictMode {
+		t.Fatalf("Expected an HttpOnly session cookie, got %d %+v", rec.Code, cookies)
+	}
+	var info sessionInfo
+	json.Unmarshal(rec.Body.Bytes(), &info)
+	if !info.Authenticated || info.CSRFToken == "" {
+		t.Fatalf("Expected a session with a CSRF token, got %+v", info)
+	}
+	session := cookies[0]
+
+	if rec := authRequest(handler, http.MethodGet, "/api/devices", "", nil, session); rec.Code != http.StatusOK {
+		t.Fatalf("Expected the session to be accepted, got %d", rec.Code)
+	}
+	if rec := authRequest(handler, http.MethodPost, "/api/devices", "", nil, session); rec.Code != http.StatusForbidden {
+		t.Fatalf("Expected a POST without the CSRF token to be forbidden, got %d", rec.Code)
+	}
+	if rec := authRequest(handler, http.MethodPost, "/api/devices", "", map[string]string{csrfHeader: "guess"}, session); rec.Code != http.StatusForbidden {
+		t.Fatalf("Expected a wrong CSRF token to be forbidden, got %d", rec.Code)
+	}
+	csrf := map[string]string{csrfHeader: info.CSRFToken}
+	if rec := authRequest(handler, http.MethodPost, "/api/devices", "", csrf, session); rec.Code != http.StatusOK {
+		t.Fatalf("Expected a POST with the CSRF token, got %d", rec.Code)
+	}
+
+	rec = authRequest(handler, http.MethodGet, "/api/session", "", nil, session)
+	var reloaded sessionInfo
+	json.Unmarshal(rec.Body.Bytes(), &reloaded)
+	if reloaded.CSRFToken != info.CSRFToken {
+		t.Fatalf("Expected /api/session to return the CSRF token again, got %+v", reloaded)
+	}
+
+	if rec := authRequest(handler, http.MethodPost, "/api/logout", "", csrf, session); rec.Code != http.StatusOK {
+		t.Fatalf("Expected the logout to succeed, got %d", rec.Code)
+	}
+	if rec := authRequest(handler, http.MethodGet, "/api/devices", "", nil, session); rec.Code != http.StatusUnauthorized {
+		t.Fatalf("Expected the session to end with the logout, got %d", rec.Code)
+	}
+}
+
+// TestAuthExpiry verifies sessions end after their lifetime
+func TestAuthExpiry(t *testing.T) {
+	auth := NewAuth("hunter2", "", time.Hour)
+	handler := newAuthHandler(auth)
+	rec := authRequest(handler, http.MethodPost, "/api/login", `{"password":"hunter2"}`, nil)
+	session := rec.Result().Cookies()[0]
+	auth.sessions[session.Value].expires = time.Now().Add(-time.Second)
+	if rec := authRequest(handler, http.MethodGet, "/api/devices", "", nil, session); rec.Code != http.StatusUnauthorized {
+		t.Fatalf("Expected an expired session to be rejected, got %d", rec.Code)
+	}
+}
+
+// TestAuthBearer verifies API clients authenticate with the API token and
+// need no CSRF token
+func TestAuthBearer(t *testing.T) {
+	handler := newAuthHandler(NewAuth("", "tok3n", time.Hour))
+	if rec := authRequest(handler, http.MethodPost, "/api/devices", "", map[string]string{"Authorization": "Bearer tok3n"}); rec.Code != http.StatusOK {
+		t.Fatalf("Expected the API token to be accepted, got %d", rec.Code)
+	}
+	if rec := authRequest(handler, http.MethodGet, "/api/devices", "", map[string]string{"Authorization": "Bearer nope"}); rec.Code != http.StatusUnauthorized {
+		t.Fatalf("Expected a wrong token to be rejected, got %d", rec.Code)
+	}
+	if rec := authRequest(handler, http.MethodGet, "/api/session", "", map[string]string{"Authorization": "Bearer tok3n"}); rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), `"authenticated":true`) {
+		t.Fatalf("Expected /api/session to accept the API token, got %d %s", rec.Code, rec.Body)
+	}
+	if rec := authRequest(handler, http.MethodPost, "/api/login", `{"password":""}`, nil); rec.Code != http.StatusNotFound {
+		t.Fatalf("Expected no password login without a password, got %d", rec.Code)
+	}
+}
+
+// TestAuthLockout verifies clients that fail too often are locked out,
+// with the failures and the lockout in the audit log
+func TestAuthLockout(t *testing.T) {
+	auth := NewAuth("hunter2", "tok3n", time.Hour)
+	auth.attempts = 3
+	auth.audit, _ = NewAuditLog(openTestStore(t, "json", t.TempDir()))
+	handler := newAuthHandler(auth)
+
+	authRequest(handler, http.MethodPost, "/api/login", `{"password":"a"}`, nil)
+	authRequest(handler, http.MethodGet, "/api/devices", "", map[string]string{"Authorization": "Bearer b"})
+	if rec := authRequest(handler, http.MethodPost, "/api/login", `{"password":"c"}`, nil); rec.Code != http.StatusUnauthorized {
+		t.Fatalf("Expected the third wrong password to be rejected, got %d", rec.Code)
+	}
+	rec := authRequest(handler, http.MethodPost, "/api/login", `{"password":"hunter2"}`, nil)
+	if rec.Code != http.StatusTooManyRequests || rec.Header().Get("Retry-After") != "900" {
+		t.Fatalf("Expected the client to be locked out for 15 minutes, got %d %q", rec.Code, rec.Header().Get("Retry-After"))
+	}
+	if rec := authRequest(handler, http.MethodGet, "/api/devices", "", map[string]string{"Authorization": "Bearer tok3n"}); rec.Code != http.StatusTooManyRequests {
+		t.Fatalf("Expected the API token to be locked out as well, got %d", rec.Code)
+	}
+	if lockouts := auth.audit.List(auditLockout, 10); len(lockouts) != 1 || lockouts[0].IP != "192.0.2.1" {
+		t.Fatalf("Expected the lockout in the audit log, got %+v", lockouts)
+	}
+	if failures := auth.audit.List(auditLoginFailed, 10); len(failures) != 2 {
+		t.Fatalf("Expected 2 failed logins in the audit log, got %+v", failures)
+	}
+
+	auth.clients["192.0.2.1"].lockedUntil = time.Now().Add(-time.Second)
+	if rec := authRequest(handler, http.MethodPost, "/api/login", `{"password":"hunter2"}`, nil); rec.Code != http.StatusOK {
+		t.Fatalf("Expected a login once the lockout is over, got %d", rec.Code)
+	}
+	if logins := auth.audit.List(auditLogin, 10); len(logins) != 1 {
+		t.Fatalf("Expected the login in the audit log, got %+v", logins)
+	}
+}
+
+// TestAuthSessionLockout verifies tokens guessed on the public
+// /api/session count against the client like on the protected routes
+func TestAuthSessionLockout(t *testing.T) {
+	auth := NewAuth("hunter2", "tok3n", time.Hour)
+	auth.attempts = 2
+	auth.audit, _ = NewAuditLog(openTestStore(t, "json", t.TempDir()))
+	handler := newAuthHandler(auth)
+
+	for _, token := range []string{"a", "b"} {
+		if rec := authRequest(handler, http.MethodGet, "/api/session", "", map[string]string{"Authorization": "Bearer " + token}); rec.Code != http.StatusUnauthorized {
+			t.Fatalf("Expected a wrong token to be rejected, got %d", rec.Code)
+		}
+	}
+	if rec := authRequest(handler, http.MethodGet, "/api/session", "", map[string]string{"Authorization": "Bearer tok3n"}); rec.Code != http.StatusTooManyRequests {
+		t.Fatalf("Expected the client to be locked out, got %d", rec.Code)
+	}
+	if failures := auth.audit.List(auditTokenFailed, 10); len(failures) != 2 {
+		t.Fatalf("Expected 2 failed tokens in the audit log, got %+v", failures)
+	}
+}
+
+// TestAuthRateLimit verifies logins are rate limited per client
+func TestAuthRateLimit(t *testing.T) {
+	auth := NewAuth("hunter2", "", time.Hour)
+	auth.attempts = 0
+	handler := newAuthHandler(auth)
+	for i := 0; i < loginRate; i++ {
+		if rec := authRequest(handler, http.MethodPost, "/api/login", `{"password":"x"}`, nil); rec.Code != http.StatusUnauthorized {
+			t.Fatalf("Expected attempt %d to be tried, got %d", i, rec.Code)
+		}
+	}
+	if rec := authRequest(handler, http.MethodPost, "/api/login", `{"password":"hunter2"}`, nil); rec.Code != http.StatusTooManyRequests {
+		t.Fatalf("Expected the client to be rate limited, got %d", rec.Code)
+	}
+}
@@ -0,0 +1,354 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// presenceTimeout is how long a device may go without being sighted before
+// it is considered offline.
+const presenceTimeout = 2 * time.Minute
+
+// PresenceInterval is a span of time during which a device was online.
+type PresenceInterval struct {
+	Start int64 `json:"start"`
+	End   int64 `json:"end"`
+}
+
+// availabilityBucket is the Store bucket availability history is kept in.
+const availabilityBucket = "availability"
+
+// AvailabilityTracker records when devices were online, based on how often
+// their services are sighted, and periodically flushes the history to the
+// persistent Store.
+type AvailabilityTracker struct {
+	mu        sync.Mutex
+	store     Store
+	intervals map[string][]PresenceInterval
+	dirty     map[string]bool
+}
+
+// NewAvailabilityTracker loads the availability history from store.
+func NewAvailabilityTracker(store Store) (*AvailabilityTracker, error) {
+	tracker := &AvailabilityTracker{
+		store:     store,
+		intervals: make(map[string][]PresenceInterval),
+		dirty:     make(map[string]bool),
+	}
+
+	entries, err := store.Load(availabilityBucket)
+	if err != nil {
+		return nil, err
+	}
+	for id, data := range entries {
+		var intervals []PresenceInterval
+		if err := json.Unmarshal(data, &intervals); err != nil {
+			return nil, fmt.Errorf("availability %s: %v", id, err)
+		}
+		tracker.intervals[id] = intervals
+	}
+	return tracker, nil
+}
+
+// Sighted records that a device was seen on the network at t and reports
+// whether this brought it online, i.e. started a new presence interval.
+func (a *AvailabilityTracker) Sighted(id string, t time.Time) bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	now := t.Unix()
+	intervals := a.intervals[id]
+	a.dirty[id] = true
+	if n := len(intervals); n > 0 && now-intervals[n-1].End <= int64(presenceTimeout/time.Second) {
+		if now > intervals[n-1].End {
+			intervals[n-1].End = now
+		}
+		return false
+	}
+	a.intervals[id] = append(intervals, PresenceInterval{Start: now, End: now})
+	return true
+}
+
+// Intervals returns the number of online intervals recorded for a device;
+// 1 right after its first sighting within the retention period.
+func (a *AvailabilityTracker) Intervals(id string) int {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return len(a.intervals[id])
+}
+
+// Forget drops the history of a device; it is deleted from the store on the
+// next save.
+func (a *AvailabilityTracker) Forget(id string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if _, ok := a.intervals[id]; ok {
+		delete(a.intervals, id)
+		a.dirty[id] = true
+	}
+}
+
+// History returns a copy of the online intervals recorded for a device.
+func (a *AvailabilityTracker) History(id string) []PresenceInterval {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	return append([]PresenceInterval(nil), a.intervals[id]...)
+}
+
+// Prune drops history that ended before the cutoff, trimming intervals that
+// straddle it, and returns the number of intervals removed.
+func (a *AvailabilityTracker) Prune(before time.Time) int {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	cutoff := before.Unix()
+	removed := 0
+	for id, intervals := range a.intervals {
+		if len(intervals) == 0 || intervals[0].Start >= cutoff {
+			continue
+		}
+
+		kept := intervals[:0]
+		for _, iv := range intervals {
+			if iv.End < cutoff {
+				removed++
+				continue
+			}
+			if iv.Start < cutoff {
+				iv.Start = cutoff
+			}
+			kept = append(kept, iv)
+		}
+		if len(kept) == 0 {
+			delete(a.intervals, id)
+		} else {
+			a.intervals[id] = kept
+		}
+		a.dirty[id] = true
+	}
+	return removed
+}
+
+// Records returns the number of online intervals stored across all devices.
+func (a *AvailabilityTracker) Records() int {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	n := 0
+	for _, intervals := range a.intervals {
+		n += len(intervals)
+	}
+	return n
+}
+
+// Run periodically flushes the history to disk. It never returns.
+func (a *AvailabilityTracker) Run() {
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		if err := a.save(); err != nil {
+			log.Printf("Failed to save availability history: %v", err)
+		}
+	}
+}
+
+// save writes the history of every device that changed since the last call.
+func (a *AvailabilityTracker) save() error {
+	a.mu.Lock()
+	puts := make(map[string][]byte)
+	var deletes []string
+	for id := range a.dirty {
+		intervals, ok := a.intervals[id]
+		if !ok {
+			deletes = append(deletes, id)
+			continue
+		}
+		data, err := json.Marshal(intervals)
+		if err != nil {
+			a.mu.Unlock()
+			return err
+		}
+		puts[id] = data
+	}
+	a.dirty = make(map[string]bool)
+	a.mu.Unlock()
+
+	if len(puts) > 0 {
+		if err := a.store.Put(availabilityBucket, puts); err != nil {
+			return err
+		}
+	}
+	if len(deletes) > 0 {
+		return a.store.Delete(availabilityBucket, deletes...)
+	}
+	return nil
+}
+
+// DailyUptime is the share of one calendar day a device was online.
+type DailyUptime struct {
+	Date          string  `json:"date"`
+	UptimePercent float64 `json:"uptimePercent"`
+}
+
+// Outage is a window during which a device was offline. End is zero while
+// the outage is still ongoing.
+type Outage struct {
+	Start int64 `json:"start"`
+	End   int64 `json:"end,omitempty"`
+}
+
+// AvailabilityReport summarizes a device's availability over a number of days.
+type AvailabilityReport struct {
+	ID      string        `json:"id"`
+	From    int64         `json:"from"`
+	To      int64         `json:"to"`
+	Daily   []DailyUptime `json:"daily"`
+	Outages []Outage      `json:"outages"`
+}
+
+// buildAvailabilityReport computes daily uptime and outage windows for the
+// last days calendar days (in the server's timezone) up to now.
+func buildAvailabilityReport(id string, intervals []PresenceInterval, days int, now time.Time) *AvailabilityReport {
+	year, month, day := now.Date()
+	today := time.Date(year, month, day, 0, 0, 0, 0, now.Location())
+	from := today.AddDate(0, 0, -(days - 1))
+
+	report := &AvailabilityReport{
+		ID:      id,
+		From:    from.Unix(),
+		To:      now.Unix(),
+		Daily:   []DailyUptime{},
+		Outages: []Outage{},
+	}
+
+	for d := from; d.Before(now); d = d.AddDate(0, 0, 1) {
+		start, end := d.Unix(), d.AddDate(0, 0, 1).Unix()
+		if end > now.Unix() {
+			end = now.Unix()
+		}
+
+		var online int64
+		for _, iv := range intervals {
+			online += overlap(iv.Start, iv.End, start, end)
+		}
+
+		percent := 0.0
+		if end > start {
+			percent = float64(online) / float64(end-start) * 100
+		}
+		report.Daily = append(report.Daily, DailyUptime{
+			Date:          d.Format("2006-01-02"),
+			UptimePercent: float64(int(percent*100)) / 100,
+		})
+	}
+
+	// Outages are the gaps between online intervals, plus a trailing gap if
+	// the device has not been sighted recently
+	timeout := int64(presenceTimeout / time.Second)
+	for i := 1; i < len(intervals); i++ {
+		gapStart, gapEnd := intervals[i-1].End, intervals[i].Start
+		if gapEnd > report.From && gapStart < report.To {
+			report.Outages = append(report.Outages, Outage{Start: gapStart, End: gapEnd})
+		}
+	}
+	if n := len(intervals); n > 0 && report.To-intervals[n-1].End > timeout {
+		report.Outages = append(report.Outages, Outage{Start: intervals[n-1].End})
+	}
+
+	return report
+}
+
+// overlap returns the number of seconds [aStart, aEnd] and [bStart, bEnd)
+// have in common.
+func overlap(aStart, aEnd, bStart, bEnd int64) int64 {
+	if aStart < bStart {
+		aStart = bStart
+	}
+	if aEnd > bEnd {
+		aEnd = bEnd
+	}
+	if aEnd < aStart {
+		return 0
+	}
+	return aEnd - aStart
+}
+
+// writeICal renders a report's outage windows as an iCalendar feed, one
+// VEVENT per outage, so they can be overlaid on other calendars.
+func writeICal(w http.ResponseWriter, report *AvailabilityReport, now time.Time) {
+	const stamp = "20060102T150405Z"
+
+	var b strings.Builder
+	b.WriteString("BEGIN:VCALENDAR\r\n")
+	b.WriteString("VERSION:2.0\r\n")
+	b.WriteString("PRODID:-//network-view-osx//availability//EN\r\n")
+	for _, o := range report.Outages {
+		end := o.End
+		if end == 0 {
+			end = now.Unix()
+		}
+		b.WriteString("BEGIN:VEVENT\r\n")
+		fmt.Fprintf(&b, "UID:%s-%d@network-view-osx\r\n", report.ID, o.Start)
+		fmt.Fprintf(&b, "DTSTAMP:%s\r\n", now.UTC().Format(stamp))
+		fmt.Fprintf(&b, "DTSTART:%s\r\n", time.Unix(o.Start, 0).UTC().Format(stamp))
+		fmt.Fprintf(&b, "DTEND:%s\r\n", time.Unix(end, 0).UTC().Format(stamp))
+		fmt.Fprintf(&b, "SUMMARY:%s offline\r\n", icalEscape(report.ID))
+		b.WriteString("END:VEVENT\r\n")
+	}
+	b.WriteString("END:VCALENDAR\r\n")
+
+	w.Header().Set("Content-Type", "text/calendar; charset=utf-8")
+	// Device IDs come from the network, so the name is quoted or encoded
+	// as it needs to be
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": report.ID + "-availability.ics"}))
+	fmt.Fprint(w, b.String())
+}
+
+func icalEscape(s string) string {
+	return strings.NewReplacer(`\`, `\\`, ";", `\;`, ",", `\,`, "\n", `\n`).Replace(s)
+}
+
+// DeviceAvailability handles GET /api/devices/{id}/availability for a device
+// of the site selected by ?site=. ?days= selects the report length (default
+// 7, max 90) and ?format=ics returns the outage windows as an iCalendar feed
+// instead of JSON.
+func (s *MDNSServer) DeviceAvailability(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	days := 7
+	if v := r.URL.Query().Get("days"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > 90 {
+			writeError(w, http.StatusBadRequest, "days must be between 1 and 90")
+			return
+		}
+		days = n
+	}
+
+	id := r.PathValue("id")
+	now := time.Now()
+	history := s.availability.History(siteKey(s.deviceSite(r), id))
+	report := buildAvailabilityReport(id, history, days, now)
+
+	switch r.URL.Query().Get("format") {
+	case "", "json":
+		writeJSON(w, http.StatusOK, report)
+	case "ics", "ical":
+		writeICal(w, report, now)
+	default:
+		writeError(w, http.StatusBadRequest, "format must be json or ics")
+	}
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"mime"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// TestAvailabilityTrackerIntervals verifies sightings within the presence
+// timeout extend an interval and longer gaps start a new one
+func TestAvailabilityTrackerIntervals(t *testing.T) {
+	tracker, err := NewAvailabilityTracker(openTestStore(t, "json", t.TempDir()))
+	if err != nil {
+		t.Fatalf("Failed to create tracker: %v", err)
+	}
+
+	start := time.Date(2026, 3, 10, 12, 0, 0, 0, time.UTC)
+	tracker.Sighted("camera.local", start)
+	tracker.Sighted("camera.local", start.Add(time.Minute))
+	tracker.Sighted("camera.local", start.Add(time.Hour))
+
+	history := tracker.History("camera.local")
+	if len(history) != 2 {
+		t.Fatalf("Expected 2 intervals, got %d: %v", len(history), history)
+	}
+	if history[0].End != start.Add(time.Minute).Unix() {
+		t.Fatalf("Expected first interval to be extended to %d, got %d", start.Add(time.Minute).Unix(), history[0].End)
+	}
+}
+
+// TestBuildAvailabilityReport verifies daily percentages and outage windows
+func TestBuildAvailabilityReport(t *testing.T) {
+	day := time.Date(2026, 3, 10, 0, 0, 0, 0, time.UTC)
+	now := day.Add(36 * time.Hour) // noon on the following day
+
+	intervals := []PresenceInterval{
+		{Start: day.Unix(), End: day.Add(12 * time.Hour).Unix()},
+		{Start: day.Add(18 * time.Hour).Unix(), End: now.Unix()},
+	}
+
+	report := buildAvailabilityReport("camera.local", intervals, 2, now)
+	if len(report.Daily) != 2 {
+		t.Fatalf("Expected 2 days, got %d", len(report.Daily))
+	}
+	if report.Daily[0].UptimePercent != 75 {
+		t.Fatalf("Expected 75%% uptime on the first day, got %v", report.Daily[0].UptimePercent)
+	}
+	if report.Daily[1].UptimePercent != 100 {
+		t.Fatalf("Expected 100%% uptime so far today, got %v", report.Daily[1].UptimePercent)
+	}
+	if len(report.Outages) != 1 || report.Outages[0].Start != day.Add(12*time.Hour).Unix() {
+		t.Fatalf("Expected one outage starting at noon, got %v", report.Outages)
+	}
+}
+
+// TestWriteICalFilename verifies a device ID can't break out of the
+// download's file name
+func TestWriteICalFilename(t *testing.T) {
+	rec := httptest.NewRecorder()
+	writeICal(rec, &AvailabilityReport{ID: `tv"; name=x.local`}, time.Now())
+
+	_, params, err := mime.ParseMediaType(rec.Header().Get("Content-Disposition"))
+	if err != nil || len(params) != 1 || params["filename"] != `tv"; name=x.local-availability.ics` {
+		t.Fatalf("Expected the whole ID in the file name, got %q", rec.Header().Get("Content-Disposition"))
+	}
+}
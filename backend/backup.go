@@ -0,0 +1,624 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// snapshotVersion is the version of the backup file format.
+const snapshotVersion = 1
+
+// backupPrefix and backupSuffix make up the names of backup files, around
+// the UTC time they were taken, so they sort chronologically.
+const (
+	backupPrefix = "network-view-"
+	backupSuffix = ".json.gz"
+)
+
+// Snapshot is everything the storage backend holds: the configuration
+// (views, notifiers, expectations, maintenance windows...) and the
+// inventory (device metadata, stable IDs, the expected inventory...).
+// Snapshots of an encrypted store hold its records as they are stored, so
+// they stay encrypted.
+type Snapshot struct {
+	Version   int                                   `json:"version"`
+	CreatedAt int64                                 `json:"createdAt"`
+	Site      string                                `json:"site,omitempty"`
+	Encrypted bool                                  `json:"encrypted,omitempty"`
+	Buckets   map[string]map[string]json.RawMessage `json:"buckets"`
+}
+
+// takeSnapshot copies every bucket of store.
+func takeSnapshot(store Store, site string, now time.Time) (*Snapshot, error) {
+	raw := rawStore(store)
+	buckets, err := raw.Buckets()
+	if err != nil {
+		return nil, err
+	}
+	snapshot := &Snapshot{Version: snapshotVersion, CreatedAt: now.Unix(), Site: site, Encrypted: raw != store, Buckets: make(map[string]map[string]json.RawMessage, len(buckets))}
+	for _, bucket := range buckets {
+		entries, err := raw.Load(bucket)
+		if err != nil {
+			return nil, fmt.Errorf("load %s: %v", bucket, err)
+		}
+		records := make(map[string]json.RawMessage, len(entries))
+		for key, value := range entries {
+			records[key] = value
+		}
+		snapshot.Buckets[bucket] = records
+	}
+	return snapshot, nil
+}
+
+// encode returns the snapshot as gzipped JSON.
+func (s *Snapshot) encode() ([]byte, error) {
+	var b bytes.Buffer
+	zw := gzip.NewWriter(&b)
+	if err := json.NewEncoder(zw).Encode(s); err != nil {
+		return nil, err
+	}
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+	return b.Bytes(), nil
+}
+
+// snapshotWorkers is how many buckets writeSnapshot loads and encodes at
+// once.
+const snapshotWorkers = 4
+
+// writeSnapshot writes a snapshot of store to w as gzipped JSON, as
+// encode would, without holding all of it in memory: up to snapshotWorkers
+// buckets are loaded and encoded in parallel, and each is written out, in
+// order, as soon as it is done. It returns the number of records written.
+func writeSnapshot(w io.Writer, store Store, site string, now time.Time) (int, error) {
+	raw := rawStore(store)
+	buckets, err := raw.Buckets()
+	if err != nil {
+		return 0, err
+	}
+	sort.Strings(buckets)
+
+	type encodedBucket struct {
+		data    []byte
+		records int
+		err     error
+	}
+	results := make([]chan encodedBucket, len(buckets))
+	for i := range results {
+		results[i] = make(chan encodedBucket, 1)
+	}
+	slots := make(chan struct{}, snapshotWorkers)
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		for i, bucket := range buckets {
+			select {
+			case slots <- struct{}{}:
+			case <-done:
+				return
+			}
+			go func() {
+				entries, err := raw.Load(bucket)
+				if err != nil {
+					results[i] <- encodedBucket{err: fmt.Errorf("load %s: %v", bucket, err)}
+					return
+				}
+				records := make(map[string]json.RawMessage, len(entries))
+				for key, value := range entries {
+					records[key] = value
+				}
+				data, err := json.Marshal(records)
+				results[i] <- encodedBucket{data: data, records: len(records), err: err}
+			}()
+		}
+	}()
+
+	header, err := json.Marshal(struct {
+		Version   int    `json:"version"`
+		CreatedAt int64  `json:"createdAt"`
+		Site      string `json:"site,omitempty"`
+		Encrypted bool   `json:"encrypted,omitempty"`
+	}{snapshotVersion, now.Unix(), site, raw != store})
+	if err != nil {
+		return 0, err
+	}
+	zw := gzip.NewWriter(w)
+	write := func(data []byte) {
+		if err == nil {
+			_, err = zw.Write(data)
+		}
+	}
+	write(header[:len(header)-1])
+	write([]byte(`,"buckets":{`))
+	total := 0
+	for i, bucket := range buckets {
+		result := <-results[i]
+		<-slots
+		if result.err != nil {
+			return total, result.err
+		}
+		name, _ := json.Marshal(bucket)
+		if i > 0 {
+			write([]byte(","))
+		}
+		write(name)
+		write([]byte(":"))
+		write(result.data)
+		total += result.records
+	}
+	write([]byte("}}\n"))
+	if err != nil {
+		return total, err
+	}
+	return total, zw.Close()
+}
+
+// readSnapshot parses a backup file, gzipped or plain JSON.
+func readSnapshot(r io.Reader) (*Snapshot, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) > 2 && data[0] == 0x1f && data[1] == 0x8b {
+		zr, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return nil, err
+		}
+		if data, err = io.ReadAll(zr); err != nil {
+			return nil, err
+		}
+	}
+	var snapshot Snapshot
+	if err := json.Unmarshal(data, &snapshot); err != nil {
+		return nil, fmt.Errorf("not a backup: %v", err)
+	}
+	if snapshot.Version != snapshotVersion || snapshot.Buckets == nil {
+		return nil, fmt.Errorf("unsupported backup version %d", snapshot.Version)
+	}
+	for bucket := range snapshot.Buckets {
+		if err := checkBucketName(bucket); err != nil {
+			return nil, fmt.Errorf("not a backup: %v", err)
+		}
+	}
+	return &snapshot, nil
+}
+
+// restoreSnapshot replaces the contents of each bucket in the snapshot with
+// what it held then, and returns the number of records restored. Buckets
+// the snapshot doesn't have are left alone. An encrypted snapshot is
+// restored as it is, and a plain one into an encrypted store is encrypted.
+func restoreSnapshot(store Store, snapshot *Snapshot) (int, error) {
+	raw := rawStore(store)
+	if snapshot.Encrypted {
+		store = raw
+	}
+	restored := 0
+	for bucket, records := range snapshot.Buckets {
+		existing, err := raw.Load(bucket)
+		if err != nil {
+			return restored, fmt.Errorf("load %s: %v", bucket, err)
+		}
+		stale := make([]string, 0, len(existing))
+		for key := range existing {
+			stale = append(stale, key)
+		}
+		if len(stale) > 0 {
+			if err := raw.Delete(bucket, stale...); err != nil {
+				return restored, fmt.Errorf("clear %s: %v", bucket, err)
+			}
+		}
+		entries := make(map[string][]byte, len(records))
+		for key, value := range records {
+			entries[key] = value
+		}
+		if len(entries) > 0 {
+			if err := store.Put(bucket, entries); err != nil {
+				return restored, fmt.Errorf("write %s: %v", bucket, err)
+			}
+		}
+		restored += len(entries)
+	}
+	return restored, nil
+}
+
+// backupTarget is where backups are kept.
+type backupTarget interface {
+	Put(name string, data []byte) error
+	List() ([]string, error)
+	Delete(name string) error
+	String() string
+}
+
+// dirTarget keeps backups in a local directory.
+type dirTarget struct{ dir string }
+
+func (d dirTarget) Put(name string, data []byte) error {
+	if err := os.MkdirAll(d.dir, 0o700); err != nil {
+		return err
+	}
+	tmp := filepath.Join(d.dir, "."+name)
+	if err := os.WriteFile(tmp, data, 0o600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, filepath.Join(d.dir, name))
+}
+
+func (d dirTarget) List() ([]string, error) {
+	entries, err := os.ReadDir(d.dir)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	var names []string
+	for _, entry := range entries {
+		names = append(names, entry.Name())
+	}
+	return names, err
+}
+
+func (d dirTarget) Delete(name string) error { return os.Remove(filepath.Join(d.dir, name)) }
+func (d dirTarget) String() string           { return d.dir }
+
+// s3Target keeps backups in a bucket of an S3-compatible object store,
+// addressed path-style as https://host/bucket/prefix, so MinIO, Garage and
+// the like work too. Requests are signed with AWS Signature Version 4.
+type s3Target struct {
+	endpoint  *url.URL // scheme and host
+	bucket    string
+	prefix    string // with a trailing slash, or empty
+	region    string
+	accessKey string
+	secretKey string
+	client    *http.Client
+}
+
+// newS3Target parses an -backup-s3 URL. Credentials come from
+// $AWS_ACCESS_KEY_ID and $AWS_SECRET_ACCESS_KEY, or else the
+// aws-access-key-id and aws-secret-access-key secrets, the region from
+// $AWS_REGION (default us-east-1).
+func newS3Target(rawURL string) (*s3Target, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("invalid S3 URL %q (expected https://host/bucket/prefix)", rawURL)
+	}
+	bucket, prefix, _ := strings.Cut(strings.Trim(u.Path, "/"), "/")
+	if bucket == "" {
+		return nil, fmt.Errorf("S3 URL %q names no bucket", rawURL)
+	}
+	if prefix != "" {
+		prefix += "/"
+	}
+	t := &s3Target{
+		endpoint:  &url.URL{Scheme: u.Scheme, Host: u.Host},
+		bucket:    bucket,
+		prefix:    prefix,
+		region:    os.Getenv("AWS_REGION"),
+		accessKey: optionalSecret("aws-access-key-id", os.Getenv("AWS_ACCESS_KEY_ID")),
+		secretKey: optionalSecret("aws-secret-access-key", os.Getenv("AWS_SECRET_ACCESS_KEY")),
+		client:    &http.Client{Timeout: time.Minute},
+	}
+	if t.region == "" {
+		t.region = "us-east-1"
+	}
+	if t.accessKey == "" || t.secretKey == "" {
+		return nil, errors.New("S3 backups need AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY, in the environment or as secrets")
+	}
+	return t, nil
+}
+
+func (t *s3Target) String() string {
+	return t.endpoint.String() + "/" + t.bucket + "/" + t.prefix
+}
+
+// do sends a signed request for an object (or the bucket, for an empty key)
+// and returns the response body, failing on non-2xx responses.
+func (t *s3Target) do(method, key string, query url.Values, body []byte) ([]byte, error) {
+	u := *t.endpoint
+	u.Path = "/" + t.bucket
+	if key != "" {
+		u.Path += "/" + key
+	}
+	u.RawQuery = strings.ReplaceAll(query.Encode(), "+", "%20")
+	req, err := http.NewRequest(method, u.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	t.sign(req, body, time.Now())
+	resp, err := t.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode/100 != 2 {
+		return nil, fmt.Errorf("S3 %s %s: %s", method, u.Path, resp.Status)
+	}
+	return data, nil
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// sign adds AWS Signature Version 4 headers to req.
+func (t *s3Target) sign(req *http.Request, body []byte, now time.Time) {
+	amzDate := now.UTC().Format("20060102T150405Z")
+	day := amzDate[:8]
+	payloadHash := sha256Hex(body)
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	canonical := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.RawQuery,
+		"host:" + req.URL.Host + "\nx-amz-content-sha256:" + payloadHash + "\nx-amz-date:" + amzDate + "\n",
+		"host;x-amz-content-sha256;x-amz-date",
+		payloadHash,
+	}, "\n")
+	scope := day + "/" + t.region + "/s3/aws4_request"
+	toSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + sha256Hex([]byte(canonical))
+	key := hmacSHA256([]byte("AWS4"+t.secretKey), day)
+	for _, part := range []string{t.region, "s3", "aws4_request"} {
+		key = hmacSHA256(key, part)
+	}
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=host;x-amz-content-sha256;x-amz-date, Signature=%s",
+		t.accessKey, scope, hex.EncodeToString(hmacSHA256(key, toSign))))
+}
+
+func (t *s3Target) Put(name string, data []byte) error {
+	_, err := t.do(http.MethodPut, t.prefix+name, nil, data)
+	return err
+}
+
+func (t *s3Target) Delete(name string) error {
+	_, err := t.do(http.MethodDelete, t.prefix+name, nil, nil)
+	return err
+}
+
+// List pages through ListObjectsV2 for the objects under the prefix.
+func (t *s3Target) List() ([]string, error) {
+	var names []string
+	token := ""
+	for {
+		query := url.Values{"list-type": {"2"}, "prefix": {t.prefix}}
+		if token != "" {
+			query.Set("continuation-token", token)
+		}
+		data, err := t.do(http.MethodGet, "", query, nil)
+		if err != nil {
+			return nil, err
+		}
+		var result struct {
+			Contents []struct {
+				Key string `xml:"Key"`
+			} `xml:"Contents"`
+			IsTruncated           bool   `xml:"IsTruncated"`
+			NextContinuationToken string `xml:"NextContinuationToken"`
+		}
+		if err := xml.Unmarshal(data, &result); err != nil {
+			return nil, fmt.Errorf("S3 list: %v", err)
+		}
+		for _, object := range result.Contents {
+			names = append(names, strings.TrimPrefix(object.Key, t.prefix))
+		}
+		if !result.IsTruncated || result.NextContinuationToken == "" {
+			return names, nil
+		}
+		token = result.NextContinuationToken
+	}
+}
+
+// BackupInfo is one backup that was taken.
+type BackupInfo struct {
+	Name    string `json:"name"`
+	At      int64  `json:"at"`
+	Bytes   int    `json:"bytes"`
+	Records int    `json:"records"`
+}
+
+// Backups takes snapshots of the store on a schedule and keeps the latest
+// Keep of them at the target.
+type Backups struct {
+	mu        sync.Mutex
+	store     Store
+	site      string
+	target    backupTarget
+	keep      int
+	last      *BackupInfo
+	lastError string
+}
+
+// NewBackups backs store up to target, keeping the latest keep backups.
+func NewBackups(store Store, site string, target backupTarget, keep int) *Backups {
+	return &Backups{store: store, site: site, target: target, keep: max(keep, 1)}
+}
+
+// Backup takes a backup now and removes those beyond the latest Keep.
+func (b *Backups) Backup(now time.Time) (BackupInfo, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	info, err := b.backup(now)
+	if err != nil {
+		b.lastError = err.Error()
+		return info, err
+	}
+	b.last, b.lastError = &info, ""
+	return info, nil
+}
+
+func (b *Backups) backup(now time.Time) (BackupInfo, error) {
+	// Only the compressed snapshot is held in memory
+	var data bytes.Buffer
+	records, err := writeSnapshot(&data, b.store, b.site, now)
+	if err != nil {
+		return BackupInfo{}, err
+	}
+	info := BackupInfo{Name: backupPrefix + now.UTC().Format("20060102T150405Z") + backupSuffix, At: now.Unix(), Bytes: data.Len(), Records: records}
+	if err := b.target.Put(info.Name, data.Bytes()); err != nil {
+		return info, err
+	}
+
+	names, err := b.list()
+	if err != nil {
+		return info, err
+	}
+	for len(names) > b.keep {
+		if err := b.target.Delete(names[0]); err != nil {
+			return info, err
+		}
+		names = names[1:]
+	}
+	return info, nil
+}
+
+// list returns the names of the backups at the target, oldest first.
+func (b *Backups) list() ([]string, error) {
+	all, err := b.target.List()
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, name := range all {
+		if strings.HasPrefix(name, backupPrefix) && strings.HasSuffix(name, backupSuffix) {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// Run takes a backup every interval.
+func (b *Backups) Run(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for now := range ticker.C {
+		if info, err := b.Backup(now); err != nil {
+			log.Printf("⚠️  Backup to %s failed: %v", b.target, err)
+		} else {
+			log.Printf("💾 Backed up %d records to %s", info.Records, info.Name)
+		}
+	}
+}
+
+// BackupsHandler handles /api/backups: GET lists the backups at the target
+// with the outcome of the last one, POST takes one now.
+func (s *MDNSServer) BackupsHandler(w http.ResponseWriter, r *http.Request) {
+	if s.backups == nil {
+		writeError(w, http.StatusNotFound, "backups are not configured (-backup-dir or -backup-s3)")
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+		names, err := s.backups.list()
+		if err != nil {
+			writeError(w, http.StatusBadGateway, err.Error())
+			return
+		}
+		s.backups.mu.Lock()
+		response := map[string]interface{}{"target": s.backups.target.String(), "keep": s.backups.keep, "backups": append([]string{}, names...)}
+		if s.backups.last != nil {
+			response["last"] = s.backups.last
+		}
+		if s.backups.lastError != "" {
+			response["lastError"] = s.backups.lastError
+		}
+		s.backups.mu.Unlock()
+		writeJSON(w, http.StatusOK, response)
+
+	case http.MethodPost:
+		info, err := s.backups.Backup(time.Now())
+		if err != nil {
+			writeError(w, http.StatusBadGateway, err.Error())
+			return
+		}
+		writeJSON(w, http.StatusCreated, info)
+
+	default:
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+	}
+}
+
+// runRestore is the restore subcommand: it replaces the persisted state
+// with that of a backup file. The server must not be running.
+func runRestore(args []string, stdout, stderr io.Writer) int {
+	flags := flag.NewFlagSet("restore", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	dataDir := flags.String("data-dir", defaultDataDir(), "Directory of the persisted state to restore into")
+	storeKind := flags.String("store", "json", "Storage backend of the persisted state: json or bolt")
+	encryptionKey := flags.String("encryption-key", "", "Encrypt a plain backup into an encrypted store with this key (env:NAME, file:PATH, keychain:SERVICE or secret:NAME)")
+	flags.Usage = func() {
+		fmt.Fprintln(stderr, "Usage: network-view-osx restore [-data-dir dir] [-store json|bolt] [-encryption-key source] <backup file>")
+		flags.PrintDefaults()
+	}
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if flags.NArg() != 1 {
+		flags.Usage()
+		return 2
+	}
+
+	file, err := os.Open(flags.Arg(0))
+	if err != nil {
+		fmt.Fprintf(stderr, "restore: %v\n", err)
+		return 1
+	}
+	snapshot, err := readSnapshot(file)
+	file.Close()
+	if err != nil {
+		fmt.Fprintf(stderr, "restore: %s: %v\n", flags.Arg(0), err)
+		return 1
+	}
+	store, err := openStore(*storeKind, *dataDir)
+	if err != nil {
+		fmt.Fprintf(stderr, "restore: cannot open the %s store in %s (is the server still running?): %v\n", *storeKind, *dataDir, err)
+		return 1
+	}
+	defer store.Close()
+	if *encryptionKey != "" {
+		key, err := loadEncryptionKey(*encryptionKey)
+		if err == nil {
+			store, err = newEncryptedStore(store, key)
+		}
+		if err != nil {
+			fmt.Fprintf(stderr, "restore: -encryption-key: %v\n", err)
+			return 1
+		}
+	}
+	n, err := restoreSnapshot(store, snapshot)
+	if err != nil {
+		fmt.Fprintf(stderr, "restore: %v\n", err)
+		return 1
+	}
+	fmt.Fprintf(stdout, "Restored %d records in %d buckets from the backup of %s\n", n, len(snapshot.Buckets), time.Unix(snapshot.CreatedAt, 0).Format(time.RFC3339))
+	return 0
+}
@@ -0,0 +1,352 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"path"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// maxBlocklistSize bounds a downloaded blocklist.
+const maxBlocklistSize = 64 << 20
+
+// Blocklist is a loaded threat or ad blocklist: domains, addresses and
+// networks.
+type Blocklist struct {
+	Name     string `json:"name"`
+	Source   string `json:"source"`
+	Entries  int    `json:"entries"`
+	LoadedAt int64  `json:"loadedAt,omitempty"`
+	Error    string `json:"error,omitempty"`
+
+	domains map[string]bool
+	ips     map[string]bool
+	nets    []*net.IPNet
+}
+
+// parseBlocklist reads a blocklist in hosts format ("0.0.0.0 ads.example"),
+// as plain domains, addresses or CIDR networks one per line, or as
+// Adblock-style "||ads.example^" rules. Comments start with # or !.
+func parseBlocklist(r io.Reader) (*Blocklist, error) {
+	list := &Blocklist{domains: make(map[string]bool), ips: make(map[string]bool)}
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if i := strings.IndexAny(line, "#!"); i >= 0 {
+			line = line[:i]
+		}
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+
+		if ip := net.ParseIP(fields[0]); ip != nil && len(fields) > 1 {
+			// hosts format: the address is only where the names are sent
+			for _, name := range fields[1:] {
+				list.addDomain(name)
+			}
+			continue
+		}
+		entry := fields[0]
+		switch {
+		case strings.HasPrefix(entry, "||"):
+			list.addDomain(strings.TrimSuffix(strings.TrimPrefix(entry, "||"), "^"))
+		case net.ParseIP(entry) != nil:
+			list.ips[net.ParseIP(entry).String()] = true
+		case strings.Contains(entry, "/"):
+			if _, network, err := net.ParseCIDR(entry); err == nil {
+				list.nets = append(list.nets, network)
+			}
+		default:
+			list.addDomain(entry)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	list.Entries = len(list.domains) + len(list.ips) + len(list.nets)
+	return list, nil
+}
+
+func (l *Blocklist) addDomain(name string) {
+	name = strings.ToLower(strings.TrimSuffix(name, "."))
+	switch name {
+	case "", "localhost", "localhost.localdomain", "local", "broadcasthost", "ip6-localhost", "ip6-loopback", "0.0.0.0":
+		return
+	}
+	if strings.Contains(name, ".") {
+		l.domains[name] = true
+	}
+}
+
+// match returns the entry ip or one of names hits. A listed domain also
+// covers its subdomains.
+func (l *Blocklist) match(ip net.IP, names []string) string {
+	if l.ips[ip.String()] {
+		return ip.String()
+	}
+	for _, network := range l.nets {
+		if network.Contains(ip) {
+			return network.String()
+		}
+	}
+	for _, name := range names {
+		for name != "" {
+			if l.domains[name] {
+				return name
+			}
+			_, parent, ok := strings.Cut(name, ".")
+			if !ok || !strings.Contains(parent, ".") {
+				break
+			}
+			name = parent
+		}
+	}
+	return ""
+}
+
+// BlocklistHit is a device's flow to a listed destination.
+type BlocklistHit struct {
+	Device    string `json:"device"`
+	Remote    string `json:"remote"`
+	Name      string `json:"name,omitempty"` // the remote's name, when the entry is a domain
+	List      string `json:"list"`
+	Entry     string `json:"entry"`
+	FirstSeen int64  `json:"firstSeen"`
+	LastSeen  int64  `json:"lastSeen"`
+	Count     int    `json:"count"` // flows that hit the entry
+}
+
+// Blocklists matches the flows of local devices against blocklists loaded
+// from files or URLs, and reports hits as "blocklist-hit" anomalies.
+type Blocklists struct {
+	sources []string
+	bus     *EventBus
+	client  *http.Client
+
+	mu    sync.RWMutex
+	lists []*Blocklist
+	hits  map[string]*BlocklistHit // device, remote and entry
+}
+
+// NewBlocklists loads the blocklists at sources, files or http(s) URLs.
+// Lists that fail to load are reported on /api/blocklists and retried on
+// the next reload.
+func NewBlocklists(sources []string, bus *EventBus) *Blocklists {
+	b := &Blocklists{
+		sources: sources,
+		bus:     bus,
+		client:  &http.Client{Timeout: time.Minute},
+		hits:    make(map[string]*BlocklistHit),
+	}
+	b.Reload()
+	return b
+}
+
+// Reload reads every blocklist again, keeping the previous version of
+// lists that fail.
+func (b *Blocklists) Reload() {
+	b.mu.RLock()
+	previous := make(map[string]*Blocklist, len(b.lists))
+	for _, list := range b.lists {
+		previous[list.Source] = list
+	}
+	b.mu.RUnlock()
+
+	lists := make([]*Blocklist, 0, len(b.sources))
+	for _, source := range b.sources {
+		list, err := b.load(source)
+		if err != nil {
+			log.Printf("⚠️  Blocklist %s: %v", source, err)
+			if old := previous[source]; old != nil && old.Error == "" {
+				list = old
+			} else {
+				list = &Blocklist{}
+			}
+			list.Error = err.Error()
+		}
+		list.Name = blocklistName(source)
+		list.Source = source
+		lists = append(lists, list)
+	}
+
+	b.mu.Lock()
+	b.lists = lists
+	b.mu.Unlock()
+}
+
+func (b *Blocklists) load(source string) (*Blocklist, error) {
+	var r io.ReadCloser
+	if strings.HasPrefix(source, "http://") || strings.HasPrefix(source, "https://") {
+		resp, err := b.client.Get(source)
+		if err != nil {
+			return nil, err
+		}
+		if resp.StatusCode != http.StatusOK {
+			resp.Body.Close()
+			return nil, fmt.Errorf("%s", resp.Status)
+		}
+		r = resp.Body
+	} else {
+		f, err := os.Open(source)
+		if err != nil {
+			return nil, err
+		}
+		r = f
+	}
+	defer r.Close()
+
+	list, err := parseBlocklist(io.LimitReader(r, maxBlocklistSize))
+	if err != nil {
+		return nil, err
+	}
+	list.LoadedAt = time.Now().Unix()
+	return list, nil
+}
+
+// blocklistName names a list after its file.
+func blocklistName(source string) string {
+	name := path.Base(strings.TrimRight(source, "/"))
+	if i := strings.IndexAny(name, "?#"); i >= 0 {
+		name = name[:i]
+	}
+	return strings.TrimSuffix(name, path.Ext(name))
+}
+
+// Run reloads the blocklists every interval.
+func (b *Blocklists) Run(interval time.Duration) {
+	for {
+		time.Sleep(interval)
+		b.Reload()
+	}
+}
+
+// Check matches a new flow of device to remote, known by names, and
+// reports the first hit of each device and entry as an anomaly.
+func (b *Blocklists) Check(device string, remote net.IP, names []string, now time.Time) {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	var reported []*BlocklistHit
+	for _, list := range b.lists {
+		entry := list.match(remote, names)
+		if entry == "" {
+			continue
+		}
+		key := device + "|" + remote.String() + "|" + list.Name + "|" + entry
+		hit := b.hits[key]
+		if hit == nil {
+			hit = &BlocklistHit{Device: device, Remote: remote.String(), List: list.Name, Entry: entry, FirstSeen: now.Unix()}
+			for _, name := range names {
+				if name != "" {
+					hit.Name = name
+					break
+				}
+			}
+			b.hits[key] = hit
+			reported = append(reported, hit)
+		}
+		hit.LastSeen = now.Unix()
+		hit.Count++
+	}
+	b.mu.Unlock()
+
+	for _, hit := range reported {
+		destination := hit.Remote
+		if hit.Name != "" {
+			destination = hit.Name + " (" + hit.Remote + ")"
+		}
+		event := newAnomaly("blocklist-hit", "blocklist-hit", map[string]string{
+			"device": hit.Device, "destination": destination, "list": hit.List, "entry": hit.Entry,
+		})
+		event.Device = hit.Device
+		b.bus.Publish(TopicAnomaly, event)
+	}
+}
+
+// Hits returns the hits of device (every device when empty), latest first.
+func (b *Blocklists) Hits(device string) []BlocklistHit {
+	hits := []BlocklistHit{}
+	if b == nil {
+		return hits
+	}
+	b.mu.RLock()
+	for _, hit := range b.hits {
+		if device == "" || hit.Device == device {
+			hits = append(hits, *hit)
+		}
+	}
+	b.mu.RUnlock()
+	sort.Slice(hits, func(i, j int) bool {
+		if hits[i].LastSeen != hits[j].LastSeen {
+			return hits[i].LastSeen > hits[j].LastSeen
+		}
+		return hits[i].Device < hits[j].Device
+	})
+	return hits
+}
+
+// Flagged returns the names of the lists device's flows hit.
+func (b *Blocklists) Flagged(device string) []string {
+	var names []string
+	for _, hit := range b.Hits(device) {
+		if !slices.Contains(names, hit.List) {
+			names = append(names, hit.List)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Lists returns the loaded blocklists.
+func (b *Blocklists) Lists() []Blocklist {
+	lists := []Blocklist{}
+	if b == nil {
+		return lists
+	}
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	for _, list := range b.lists {
+		lists = append(lists, *list)
+	}
+	return lists
+}
+
+// BlocklistStatus handles GET /api/blocklists, the loaded blocklists and the
+// flows of local devices that hit them (?device= for a single device).
+func (s *MDNSServer) BlocklistStatus(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"enabled": s.blocklists != nil && s.capture != nil,
+		"lists":   s.blocklists.Lists(),
+		"hits":    s.blocklists.Hits(r.URL.Query().Get("device")),
+	})
+}
+
+// BlocklistReload handles POST /api/blocklists/reload.
+func (s *MDNSServer) BlocklistReload(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	if s.blocklists == nil {
+		writeError(w, http.StatusNotFound, "no blocklists configured")
+		return
+	}
+	s.blocklists.Reload()
+	writeJSON(w, http.StatusOK, map[string]interface{}{"lists": s.blocklists.Lists()})
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// TestParseBlocklist verifies hosts, domain, address, network and Adblock
+// entries are read
+func TestParseBlocklist(t *testing.T) {
+	list, err := parseBlocklist(strings.NewReader(`# ads
+0.0.0.0 ads.example.com tracker.example.net
+127.0.0.1 localhost
+telemetry.example.org
+||metrics.example.io^
+203.0.113.7 # a C2 server
+198.51.100.0/24
+! adblock comment
+`))
+	if err != nil {
+		t.Fatalf("Failed to parse: %v", err)
+	}
+	if list.Entries != 6 {
+		t.Fatalf("Expected 6 entries, got %d", list.Entries)
+	}
+
+	cases := []struct {
+		ip    string
+		name  string
+		entry string
+	}{
+		{"192.0.2.1", "ads.example.com", "ads.example.com"},
+		{"192.0.2.1", "eu.telemetry.example.org", "telemetry.example.org"},
+		{"192.0.2.1", "metrics.example.io", "metrics.example.io"},
+		{"203.0.113.7", "", "203.0.113.7"},
+		{"198.51.100.20", "", "198.51.100.0/24"},
+		{"192.0.2.1", "example.com", ""},
+		{"192.0.2.1", "localhost", ""},
+	}
+	for _, c := range cases {
+		if got := list.match(net.ParseIP(c.ip), []string{c.name}); got != c.entry {
+			t.Fatalf("match(%s, %s): expected %q, got %q", c.ip, c.name, c.entry, got)
+		}
+	}
+}
+
+// TestBlocklistHits verifies flows to listed destinations are flagged once
+// per device and entry, with an anomaly
+func TestBlocklistHits(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "threats.txt")
+	os.WriteFile(path, []byte("0.0.0.0 evil.example.com\n"), 0o644)
+
+	web := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("203.0.113.7\n"))
+	}))
+	defer web.Close()
+
+	bus := NewEventBus()
+	var anomalies []AnomalyEvent
+	bus.Subscribe("test", func(e BusEvent) { anomalies = append(anomalies, e.Payload.(AnomalyEvent)) }, TopicAnomaly)
+
+	blocklists := NewBlocklists([]string{path, web.URL + "/c2.txt", filepath.Join(t.TempDir(), "missing.txt")}, bus)
+	lists := blocklists.Lists()
+	if len(lists) != 3 || lists[0].Name != "threats" || lists[1].Name != "c2" || lists[2].Error == "" {
+		t.Fatalf("Unexpected lists %+v", lists)
+	}
+
+	server := NewMDNSServer()
+	server.addService("10.0.0.3:_airplay._tcp.local.:7000", &MDNSService{Host: "tv.local", IP: "10.0.0.3", Type: "_airplay._tcp.local.", Port: 7000})
+	flows := NewFlowTable(newDeviceIndex(server), nil, blocklists)
+	flows.rdns.lookup = func(ctx context.Context, addr string) ([]string, error) { return nil, nil }
+
+	// The TV resolves the listed name, then connects to it twice
+	answer := new(dns.Msg)
+	answer.SetQuestion("evil.example.com.", dns.TypeA)
+	answer.Response = true
+	answer.Answer = []dns.RR{&dns.A{Hdr: dns.RR_Header{Name: "evil.example.com.", Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60}, A: net.ParseIP("192.0.2.50")}}
+	payload, _ := answer.Pack()
+	now := time.Now()
+	flows.Record(packetInfo{Src: net.ParseIP("10.0.0.1"), Dst: net.ParseIP("10.0.0.3"), Protocol: protoUDP, SrcPort: 53, DstPort: 40000, Payload: payload}, now)
+	flows.Record(packetInfo{Src: net.ParseIP("10.0.0.3"), Dst: net.ParseIP("192.0.2.50"), Protocol: protoTCP, SrcPort: 50000, DstPort: 443, Length: 60}, now)
+	flows.Record(packetInfo{Src: net.ParseIP("10.0.0.3"), Dst: net.ParseIP("192.0.2.50"), Protocol: protoTCP, SrcPort: 50000, DstPort: 80, Length: 60}, now)
+	flows.Record(packetInfo{Src: net.ParseIP("10.0.0.3"), Dst: net.ParseIP("203.0.113.7"), Protocol: protoTCP, SrcPort: 50001, DstPort: 8443, Length: 60}, now)
+
+	hits := blocklists.Hits("tv.local")
+	if len(hits) != 2 {
+		t.Fatalf("Expected 2 hits, got %+v", hits)
+	}
+	if len(anomalies) != 2 || anomalies[0].Kind != "blocklist-hit" || anomalies[0].Device != "tv.local" {
+		t.Fatalf("Expected one anomaly per hit, got %+v", anomalies)
+	}
+	if got := blocklists.Flagged("tv.local"); len(got) != 2 || got[0] != "c2" || got[1] != "threats" {
+		t.Fatalf("Expected tv.local to be flagged by both lists, got %v", got)
+	}
+	if hits[0].Count+hits[1].Count != 3 {
+		t.Fatalf("Expected 3 flows to hit, got %+v", hits)
+	}
+	if name := flows.Connections("tv.local")[0].RemoteName; name != "evil.example.com" {
+		t.Fatalf("Expected the flow to be named after the DNS answer, got %q", name)
+	}
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// dispatchQueueSize bounds the events waiting for the dispatcher. Discovery
+// goroutines block in broadcast once it is full.
+const dispatchQueueSize = 4096
+
+// streamEvent is a broadcast event together with its JSON encoding, which is
+// marshaled once and shared by every client. The compact encoding is only
+// made once a ?compact=1 client needs it.
+type streamEvent struct {
+	response    *DiscoveryResponse
+	data        []byte
+	compactOnce sync.Once
+	compact     []byte
+}
+
+func newStreamEvent(response *DiscoveryResponse) *streamEvent {
+	data, _ := json.Marshal(response)
+	return &streamEvent{response: response, data: data}
+}
+
+// encoded returns the event's JSON encoding, compact or not.
+func (ev *streamEvent) encoded(compact bool) []byte {
+	if !compact {
+		return ev.data
+	}
+	ev.compactOnce.Do(func() {
+		ev.compact, _ = compactJSON(ev.response)
+	})
+	return ev.compact
+}
+
+// broadcast queues an event for every connected client. Delivery happens on
+// the dispatcher goroutine so discovery never waits on the client set.
+func (s *MDNSServer) broadcast(response *DiscoveryResponse) {
+	s.events <- newStreamEvent(response)
+}
+
+// dispatch fans queued events out to the clients, in broadcast order.
+func (s *MDNSServer) dispatch() {
+	for ev := range s.events {
+		s.fanOut(ev)
+	}
+}
+
+// fanOut records an event for replay and offers it to each client's queue,
+// counting it as dropped for clients whose queue is full and disconnecting
+// clients that stay saturated for longer than the slow-client timeout. It
+// runs under the same lock subscribeClient takes, and leaves out the events
+// a client's inventory is current to, so a subscribing client sees each
+// event either in its backlog or on its queue, never both.
+func (s *MDNSServer) fanOut(ev *streamEvent) {
+	now := time.Now()
+	var kicked []*streamClient
+
+	s.mu.RLock()
+	s.replay.Add(ev.response, now)
+
+	for c := range s.clients {
+		if ev.response.Seq != 0 && ev.response.Seq <= c.current || !s.delivers(c, &ev.response.Service) {
+			continue
+		}
+		select {
+		case c.ch <- ev:
+			c.saturatedSince.Store(0)
+		default:
+			// Skip if channel is full
+			if c.markSaturated(now, s.slowClientTimeout) {
+				c.kick()
+				kicked = append(kicked, c)
+			}
+		}
+	}
+	s.mu.RUnlock()
+
+	for _, c := range kicked {
+		// Off the dispatcher goroutine, which handlers may feed
+		go s.bus.Publish(TopicAnomaly, newAnomaly("slow-client", "slow-client", map[string]string{
+			"transport": c.transport, "id": fmt.Sprint(c.id), "remote": c.remoteAddr, "timeout": s.slowClientTimeout.String(),
+		}))
+	}
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"runtime"
+	"sync"
+	"testing"
+	"time"
+)
+
+// TestFanOutSiteFilter verifies clients only get events of their site queued
+func TestFanOutSiteFilter(t *testing.T) {
+	server := NewMDNSServer()
+	office := &streamClient{ch: make(chan *streamEvent, 1), site: "office"}
+	all := &streamClient{ch: make(chan *streamEvent, 2)}
+	server.registerClient(office)
+	server.registerClient(all)
+
+	server.fanOut(newStreamEvent(&DiscoveryResponse{Service: MDNSService{Site: "home"}}))
+	server.fanOut(newStreamEvent(&DiscoveryResponse{Service: MDNSService{Site: "office"}}))
+
+	if len(office.ch) != 1 || office.dropped.Load() != 0 {
+		t.Fatalf("Expected only the office event for the office client, got %d queued, %d dropped", len(office.ch), office.dropped.Load())
+	}
+	if len(all.ch) != 2 {
+		t.Fatalf("Expected both events for the unfiltered client, got %d", len(all.ch))
+	}
+	var decoded DiscoveryResponse
+	if ev := <-office.ch; json.Unmarshal(ev.data, &decoded) != nil || decoded.Service.Site != "office" {
+		t.Fatalf("Expected the encoded office event, got %s", ev.data)
+	}
+}
+
+// BenchmarkBroadcast measures marshaling an event and fanning it out to many
+// connected stream clients, each writing what it receives. To sustain 1k events/sec, an
+// operation needs to stay well under 1ms.
+func BenchmarkBroadcast(b *testing.B) {
+	for _, clients := range []int{100, 500} {
+		b.Run(fmt.Sprintf("clients=%d", clients), func(b *testing.B) {
+			server := NewMDNSServer()
+			var wg sync.WaitGroup
+			for i := 0; i < clients; i++ {
+				c := &streamClient{ch: make(chan *streamEvent, 100)}
+				server.registerClient(c)
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					for ev := range c.ch {
+						fmt.Fprintf(io.Discard, "data: %s\n\n", ev.data)
+					}
+				}()
+			}
+
+			response := &DiscoveryResponse{Service: MDNSService{
+				Name: "printer", Type: "_ipp._tcp.local.", Host: "printer.local", IP: "10.0.0.5", Port: 631, Site: defaultSite,
+			}}
+
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				server.fanOut(newStreamEvent(response))
+			}
+			b.StopTimer()
+
+			server.mu.RLock()
+			for c := range server.clients {
+				close(c.ch)
+			}
+			server.mu.RUnlock()
+			wg.Wait()
+		})
+	}
+}
+
+// TestSubscribeWhilePublishing verifies a client subscribing while changes
+// are published gets each one once: in its inventory, or queued after it,
+// even when the dispatcher hasn't fanned it out yet
+func TestSubscribeWhilePublishing(t *testing.T) {
+	server := NewMDNSServer()
+	for i := 0; i < 20; i++ {
+		done := make(chan struct{})
+		start := server.bus.Latest()
+		go func() {
+			defer close(done)
+			for j := 0; j < 2000; j++ {
+				server.changeService("nas", &MDNSService{Name: "nas", Type: "_smb._tcp.local.", IP: "10.0.0.20"}, j%2 == 1)
+			}
+		}()
+		// Halfway through, while the dispatcher lags behind the changes
+		for server.bus.Latest() < start+1000 {
+			runtime.Gosched()
+		}
+		client := &streamClient{ch: make(chan *streamEvent, 4096)}
+		backlog, _ := server.subscribeClient(client, 0)
+		<-done
+		last := server.bus.Latest()
+
+		// The service is added and removed in turn, so a change seen twice
+		// shows as two additions or two removals in a row
+		present := len(backlog) == 1
+		for seq := client.current; seq < last; {
+			select {
+			case ev := <-client.ch:
+				if ev.response.Removed != present {
+					t.Fatalf("Expected each change once, subscription %d got %+v with the service present=%v", i, ev.response, present)
+				}
+				present, seq = !ev.response.Removed, ev.response.Seq
+			case <-time.After(5 * time.Second):
+				t.Fatalf("Expected the events up to %d, subscription %d got up to %d", last, i, seq)
+			}
+		}
+		server.unregisterClient(client)
+	}
+}
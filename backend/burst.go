@@ -0,0 +1,38 @@
+package main
+
+import (
+	"log"
+	"sync"
+)
+
+// burstDiscovery sends the meta-query and browses and queries every service
+// type once, right away,
+// instead of waiting for the next ticks, so a dashboard opened after idle
+// fills within a second or two. Overlapping bursts are skipped.
+func (s *MDNSServer) burstDiscovery() {
+	if !s.bursting.CompareAndSwap(false, true) {
+		return
+	}
+	defer s.bursting.Store(false)
+
+	log.Printf("Client connected, running a discovery burst")
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		discoverServiceTypes(s)
+	}()
+	for _, serviceType := range s.serviceTypes.List() {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			discoverService(s, serviceType+".local.")
+		}()
+		go func() {
+			defer wg.Done()
+			lookupServiceType(s, serviceType)
+		}()
+	}
+	wg.Wait()
+}
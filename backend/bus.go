@@ -0,0 +1,142 @@
+package main
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Topic names a class of events on the internal event bus.
+type Topic string
+
+const (
+	TopicService   Topic = "service"   // *DiscoveryResponse
+	TopicHost      Topic = "host"      // HostEvent
+	TopicInterface Topic = "interface" // InterfaceEvent
+	TopicScan      Topic = "scan"      // ScanEvent
+	TopicAnomaly   Topic = "anomaly"   // AnomalyEvent
+	TopicInternet  Topic = "internet"  // InternetEvent
+)
+
+// BusEvent is one event published on the bus. The payload's type is fixed
+// by the topic.
+type BusEvent struct {
+	Topic   Topic
+	Seq     uint64 // see EventBus
+	Time    time.Time
+	Payload interface{}
+}
+
+// sequenced is a payload that carries its event's sequence number to the
+// sinks, which see the payload rather than the event.
+type sequenced interface {
+	setSeq(seq uint64)
+}
+
+// HostEvent reports a device coming online, i.e. being sighted after it had
+// been absent for longer than the presence timeout. New is set the first
+// time the device is seen.
+type HostEvent struct {
+	ID   string `json:"id"`
+	Site string `json:"site"`
+	New  bool   `json:"new,omitempty"`
+
+	service *MDNSService // the service it was sighted with
+}
+
+// InterfaceEvent reports the discovery interface being switched.
+type InterfaceEvent struct {
+	Interface string `json:"interface"`
+	Previous  string `json:"previous"`
+}
+
+// ScanEvent reports discovery being started or restarted on an interface.
+type ScanEvent struct {
+	Interface string `json:"interface"`
+	Reason    string `json:"reason"`
+}
+
+// AnomalyEvent reports something unexpected, such as a stream client being
+// disconnected for falling behind.
+type AnomalyEvent struct {
+	Kind    string `json:"kind"`
+	Message string `json:"message"`
+	// MessageKey and Params are the catalog message Message was rendered
+	// from, for clients that show it in another language
+	MessageKey string            `json:"messageKey,omitempty"`
+	Params     map[string]string `json:"params,omitempty"`
+	Device     string            `json:"device,omitempty"` // the device concerned, if any
+	// Severity is "high" for likely attacks and "medium" for suspicious
+	// changes; empty for operational anomalies
+	Severity string `json:"severity,omitempty"`
+}
+
+type busSubscription struct {
+	name    string
+	handler func(BusEvent)
+}
+
+// EventBus is the internal publish/subscribe hub between the discovery code
+// and every sink (the event stream, and later webhooks and the like).
+// Handlers run synchronously on the publishing goroutine, in subscription
+// order, so they must not block; sinks that do slow work queue it.
+//
+// Every event is numbered with a sequence number, increasing across all
+// topics over the life of the process. Publishers that need their events
+// delivered in sequence order, such as the changes to one service, must
+// publish them one at a time; see MDNSServer.changeService.
+type EventBus struct {
+	mu   sync.RWMutex
+	subs map[Topic][]*busSubscription
+	seq  atomic.Uint64
+}
+
+func NewEventBus() *EventBus {
+	return &EventBus{subs: make(map[Topic][]*busSubscription)}
+}
+
+// Subscribe registers handler for the given topics and returns a function
+// that removes the subscription again.
+func (b *EventBus) Subscribe(name string, handler func(BusEvent), topics ...Topic) func() {
+	sub := &busSubscription{name: name, handler: handler}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for _, topic := range topics {
+		b.subs[topic] = append(b.subs[topic], sub)
+	}
+
+	return func() {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		for _, topic := range topics {
+			subs := b.subs[topic]
+			for i, s := range subs {
+				if s == sub {
+					b.subs[topic] = append(subs[:i:i], subs[i+1:]...)
+					break
+				}
+			}
+		}
+	}
+}
+
+// Publish delivers an event to every subscriber of its topic.
+func (b *EventBus) Publish(topic Topic, payload interface{}) {
+	b.mu.RLock()
+	subs := b.subs[topic]
+	b.mu.RUnlock()
+
+	event := BusEvent{Topic: topic, Seq: b.seq.Add(1), Time: time.Now(), Payload: payload}
+	if p, ok := payload.(sequenced); ok {
+		p.setSeq(event.Seq)
+	}
+	for _, sub := range subs {
+		sub.handler(event)
+	}
+}
+
+// Latest returns the sequence number of the most recent event.
+func (b *EventBus) Latest() uint64 {
+	return b.seq.Load()
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"sync"
+	"testing"
+)
+
+// TestEventBusTopics verifies subscribers only receive their topics and stop
+// receiving events once unsubscribed
+func TestEventBusTopics(t *testing.T) {
+	bus := NewEventBus()
+
+	var hosts, all []BusEvent
+	bus.Subscribe("hosts", func(e BusEvent) { hosts = append(hosts, e) }, TopicHost)
+	unsubscribe := bus.Subscribe("all", func(e BusEvent) { all = append(all, e) }, TopicHost, TopicScan)
+
+	bus.Publish(TopicHost, HostEvent{ID: "nas.local", Site: defaultSite})
+	bus.Publish(TopicScan, ScanEvent{Interface: "en0", Reason: "start"})
+	unsubscribe()
+	bus.Publish(TopicHost, HostEvent{ID: "tv.local", Site: defaultSite})
+
+	if len(hosts) != 2 || hosts[0].Payload.(HostEvent).ID != "nas.local" {
+		t.Fatalf("Expected both host events for the host subscriber, got %v", hosts)
+	}
+	if len(all) != 2 || all[1].Topic != TopicScan {
+		t.Fatalf("Expected a host and a scan event before unsubscribing, got %v", all)
+	}
+}
+
+// TestServiceEventsReachStream verifies service events published on the bus
+// are queued for stream clients
+func TestServiceEventsReachStream(t *testing.T) {
+	server := NewMDNSServer()
+	client := &streamClient{ch: make(chan *streamEvent, 1)}
+	server.registerClient(client)
+
+	server.bus.Publish(TopicService, &DiscoveryResponse{Service: MDNSService{Name: "printer"}})
+	if ev := <-client.ch; ev.response.Service.Name != "printer" {
+		t.Fatalf("Expected the printer event on the stream, got %v", ev.response)
+	}
+}
+
+// TestEventBusSequence verifies events are numbered in publication order
+// across topics, and service events carry their number to the sinks
+func TestEventBusSequence(t *testing.T) {
+	bus := NewEventBus()
+	var seqs []uint64
+	bus.Subscribe("all", func(e BusEvent) { seqs = append(seqs, e.Seq) }, TopicService, TopicScan)
+
+	bus.Publish(TopicScan, ScanEvent{Interface: "en0", Reason: "start"})
+	response := &DiscoveryResponse{Service: MDNSService{Name: "printer"}}
+	bus.Publish(TopicService, response)
+	bus.Publish(TopicHost, HostEvent{ID: "nas.local"})
+
+	if len(seqs) != 2 || seqs[0] != 1 || seqs[1] != 2 || response.Seq != 2 {
+		t.Fatalf("Expected events 1 and 2 with the response numbered 2, got %v and %d", seqs, response.Seq)
+	}
+	if bus.Latest() != 3 {
+		t.Fatalf("Expected the unsubscribed host event to be numbered too, got %d", bus.Latest())
+	}
+}
+
+// TestChangeServiceOrder verifies the events of concurrent changes to one
+// service come out in the order the table applied them
+func TestChangeServiceOrder(t *testing.T) {
+	server := NewMDNSServer()
+	var mu sync.Mutex
+	var events []*DiscoveryResponse
+	server.bus.Subscribe("test", func(e BusEvent) {
+		mu.Lock()
+		events = append(events, e.Payload.(*DiscoveryResponse))
+		mu.Unlock()
+	}, TopicService)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 100; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			server.changeService("nas", &MDNSService{Name: "nas", Type: "_smb._tcp.local.", IP: "10.0.0.20"}, i%2 == 1)
+		}()
+	}
+	wg.Wait()
+
+	present := false
+	for i, event := range events {
+		if event.Removed != present || (i > 0 && event.Seq <= events[i-1].Seq) {
+			t.Fatalf("Expected additions and removals to alternate in sequence, event %d is %+v", i, event)
+		}
+		present = !event.Removed
+	}
+	if listed := len(server.listServices("")) == 1; listed != present {
+		t.Fatalf("Expected the last event to match the table")
+	}
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"net/http"
+	"time"
+)
+
+// forgetServices drops the services matching match from the service table
+// and the suppression state, publishes a removal for each one that was
+// listed, and returns how many were listed.
+func (s *MDNSServer) forgetServices(match func(service *MDNSService) bool) int {
+	s.order.Lock()
+	defer s.order.Unlock()
+
+	var removed []MDNSService
+	s.table.do(func() { removed = s.table.forget(match) })
+	for _, service := range removed {
+		s.bus.Publish(TopicService, &DiscoveryResponse{Service: service, Removed: true})
+	}
+	return len(removed)
+}
+
+// ClearCache handles POST /api/cache/clear. It forgets every discovered
+// service of the site selected by ?site= (?site=* for all sites), or only
+// those matching ?filter=, along with the cached ARP table, so everything
+// still present is rediscovered and announced again. Device metadata and availability history are kept.
+func (s *MDNSServer) ClearCache(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	filter, err := filterParam(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	site := s.siteParam(r)
+	n := s.forgetServices(func(service *MDNSService) bool {
+		return inSite(service, site) && filter.Match(s.serviceFields(service))
+	})
+
+	neighbors.mu.Lock()
+	neighbors.loaded = time.Time{}
+	neighbors.mu.Unlock()
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"status":  "ok",
+		"removed": n,
+	})
+}
+
+// forgetDevice drops all state kept about a device of a site: its services,
+// metadata and availability history. It returns the number of services
+// removed.
+func (s *MDNSServer) forgetDevice(site, id string) (int, error) {
+	n := s.forgetServices(func(service *MDNSService) bool {
+		return service.Site == site && deviceID(service) == id
+	})
+	if _, err := s.metadata.Delete(site, id); err != nil {
+		return n, err
+	}
+	s.availability.Forget(siteKey(site, id))
+	return n, nil
+}
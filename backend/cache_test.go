@@ -0,0 +1,47 @@
+package main
+
+import (
+	"testing"
+)
+
+// TestForgetDevice verifies forgetting a device drops its services, metadata
+// and history, announces the removal, and leaves other devices alone
+func TestForgetDevice(t *testing.T) {
+	store := openTestStore(t, "json", t.TempDir())
+	server := NewMDNSServer()
+	server.metadata, _ = NewMetadataStore(store)
+	server.availability, _ = NewAvailabilityTracker(store)
+
+	esp := &MDNSService{Name: "esp", Type: "_http._tcp.local.", Host: "esp.local", IP: "10.0.0.7", Port: 80}
+	nas := &MDNSService{Name: "NAS", Type: "_smb._tcp.local.", Host: "nas.local", IP: "10.0.0.2", Port: 445}
+	server.addService(server.identity(esp), esp)
+	server.addService(server.identity(nas), nas)
+	server.metadata.Update(defaultSite, "esp.local", func(d *DeviceMetadata) { d.Location = "garage" })
+
+	var removed []*DiscoveryResponse
+	server.bus.Subscribe("test", func(e BusEvent) {
+		removed = append(removed, e.Payload.(*DiscoveryResponse))
+	}, TopicService)
+
+	n, err := server.forgetDevice(defaultSite, "esp.local")
+	if err != nil || n != 1 {
+		t.Fatalf("Expected one service to be forgotten, got %d (%v)", n, err)
+	}
+	if len(removed) != 1 || !removed[0].Removed || removed[0].Service.Name != "esp" {
+		t.Fatalf("Expected a removal event for esp, got %v", removed)
+	}
+	if services := server.listServices(defaultSite); len(services) != 1 || services[0].Name != "NAS" {
+		t.Fatalf("Expected only the NAS to remain, got %v", services)
+	}
+	if server.metadata.Get(defaultSite, "esp.local") != nil {
+		t.Fatalf("Expected the esp metadata to be deleted")
+	}
+	if len(server.availability.History(siteKey(defaultSite, "esp.local"))) != 0 {
+		t.Fatalf("Expected the esp history to be forgotten")
+	}
+
+	again := &MDNSService{Name: "esp", Type: "_http._tcp.local.", Host: "esp.local", IP: "10.0.0.7", Port: 80}
+	if !server.addService(server.identity(again), again) {
+		t.Fatalf("Expected the forgotten device to be announced again")
+	}
+}
@@ -0,0 +1,262 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"log"
+	"net"
+	"sync"
+	"time"
+)
+
+// captureRetry is how long to wait before reopening a capture that failed.
+const captureRetry = time.Minute
+
+// deviceIndexRefresh is how often the IP-to-device index is rebuilt.
+const deviceIndexRefresh = 30 * time.Second
+
+var errCaptureUnsupported = errors.New("packet capture is not supported on this platform")
+
+// packetSource reads the Ethernet frames of an interface. ReadPacket
+// returns the captured frame and its length on the wire, or a nil frame
+// when its read timeout expired without a packet.
+type packetSource interface {
+	ReadPacket() (frame []byte, length int, err error)
+	Close() error
+}
+
+// openPacketSource opens a capture on iface in this process.
+func openPacketSource(iface string) (packetSource, error) {
+	fd, err := openCaptureFD(iface)
+	if err != nil {
+		return nil, err
+	}
+	return newPacketSource(fd)
+}
+
+// packetInfo is what the accounting needs of a captured packet.
+type packetInfo struct {
+	Src, Dst         net.IP
+	Protocol         uint8 // IP protocol number, e.g. 6 for TCP
+	SrcPort, DstPort uint16
+	Length           int // bytes on the wire, including the Ethernet header
+	// Payload is the captured UDP payload. It is only valid during the
+	// consumer call
+	Payload []byte
+}
+
+// IP protocol numbers.
+const (
+	protoTCP = 6
+	protoUDP = 17
+)
+
+// decodeFrame decodes the addresses and ports of an IPv4 or IPv6 packet in
+// an Ethernet frame, skipping 802.1Q VLAN tags.
+func decodeFrame(frame []byte, length int) (packetInfo, bool) {
+	if len(frame) < 14 {
+		return packetInfo{}, false
+	}
+	etherType := binary.BigEndian.Uint16(frame[12:14])
+	payload := frame[14:]
+	for etherType == 0x8100 || etherType == 0x88a8 {
+		if len(payload) < 4 {
+			return packetInfo{}, false
+		}
+		etherType = binary.BigEndian.Uint16(payload[2:4])
+		payload = payload[4:]
+	}
+
+	info := packetInfo{Length: length}
+	var transport []byte
+	switch etherType {
+	case 0x0800:
+		if len(payload) < 20 || payload[0]>>4 != 4 {
+			return packetInfo{}, false
+		}
+		headerLen := int(payload[0]&0x0f) * 4
+		if headerLen < 20 || len(payload) < headerLen {
+			return packetInfo{}, false
+		}
+		info.Src = net.IP(append([]byte(nil), payload[12:16]...))
+		info.Dst = net.IP(append([]byte(nil), payload[16:20]...))
+		info.Protocol = payload[9]
+		// Only the first fragment carries the transport header
+		if binary.BigEndian.Uint16(payload[6:8])&0x1fff == 0 {
+			transport = payload[headerLen:]
+		}
+	case 0x86dd:
+		if len(payload) < 40 || payload[0]>>4 != 6 {
+			return packetInfo{}, false
+		}
+		info.Src = net.IP(append([]byte(nil), payload[8:24]...))
+		info.Dst = net.IP(append([]byte(nil), payload[24:40]...))
+		// Extension headers aren't followed; their packets count
+		// without ports
+		info.Protocol = payload[6]
+		transport = payload[40:]
+	default:
+		return packetInfo{}, false
+	}
+
+	if (info.Protocol == protoTCP || info.Protocol == protoUDP) && len(transport) >= 4 {
+		info.SrcPort = binary.BigEndian.Uint16(transport[0:2])
+		info.DstPort = binary.BigEndian.Uint16(transport[2:4])
+		if info.Protocol == protoUDP && len(transport) >= 8 {
+			info.Payload = transport[8:]
+		}
+	}
+	return info, true
+}
+
+// deviceIndex attributes captured packets to the local site's devices by IP
+// address: to the device discovered with it, or to the address itself for
+// hosts on a local network that aren't discovered over mDNS.
+type deviceIndex struct {
+	server *MDNSServer
+
+	mu      sync.Mutex
+	ips     map[string]string // IP -> device ID, "" when not local
+	indexed time.Time
+}
+
+func newDeviceIndex(server *MDNSServer) *deviceIndex {
+	return &deviceIndex{server: server}
+}
+
+// lookup returns the ID of the device with address ip, or "" for addresses
+// off the local networks.
+func (d *deviceIndex) lookup(ip net.IP, now time.Time) string {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if now.Sub(d.indexed) >= deviceIndexRefresh {
+		d.ips = make(map[string]string)
+		for _, service := range d.server.listServices(d.server.site) {
+			if ip := net.ParseIP(service.IP); ip != nil {
+				d.ips[ip.String()] = deviceID(&service)
+			}
+		}
+		d.indexed = now
+	}
+
+	key := ip.String()
+	id, ok := d.ips[key]
+	if !ok {
+		if !ip.IsMulticast() && !ip.IsUnspecified() && localNetworks.interfaceFor(key) != "" {
+			id = key
+		}
+		d.ips[key] = id
+	}
+	return id
+}
+
+// Capture reads the packets of the discovery interface and hands them to
+// its consumers, such as the traffic accounting. It follows interface
+// changes and reopens the capture when it fails.
+type Capture struct {
+	consumers []func(packetInfo, time.Time)
+	// arp receives the ARP packets
+	arp func(arpPacket, time.Time)
+	// open opens the capture: openPacketSource, or the privileged helper's
+	// OpenCapture for a server without the privileges to capture itself
+	open func(iface string) (packetSource, error)
+
+	mu      sync.Mutex
+	iface   string
+	packets uint64
+	err     string
+}
+
+// CaptureStatus is the capture's state on /api/traffic.
+type CaptureStatus struct {
+	Interface string `json:"interface"`
+	Packets   uint64 `json:"packets"`
+	Error     string `json:"error,omitempty"`
+}
+
+// NewCapture creates a capture feeding consumers.
+func NewCapture(consumers ...func(packetInfo, time.Time)) *Capture {
+	return &Capture{consumers: consumers, open: openPacketSource}
+}
+
+// Status returns the capture's state.
+func (c *Capture) Status() CaptureStatus {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return CaptureStatus{Interface: c.iface, Packets: c.packets, Error: c.err}
+}
+
+func (c *Capture) setError(err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err == nil {
+		c.err = ""
+	} else {
+		c.err = err.Error()
+	}
+}
+
+// Run captures on the server's current interface.
+func (c *Capture) Run(server *MDNSServer) {
+	for {
+		server.mu.RLock()
+		iface := server.currentIface
+		server.mu.RUnlock()
+
+		src, err := c.open(iface)
+		if err != nil {
+			log.Printf("Capture on %s failed: %v", iface, err)
+			c.setError(err)
+			time.Sleep(captureRetry)
+			continue
+		}
+		log.Printf("Capturing packets on %s", iface)
+		c.mu.Lock()
+		c.iface, c.err = iface, ""
+		c.mu.Unlock()
+
+		err = c.read(server, src, iface)
+		src.Close()
+		if err != nil {
+			log.Printf("Capture on %s stopped: %v", iface, err)
+			c.setError(err)
+			time.Sleep(captureRetry)
+		}
+	}
+}
+
+// read hands the packets of src to the consumers until the capture fails
+// or the server switches to another interface.
+func (c *Capture) read(server *MDNSServer, src packetSource, iface string) error {
+	checked := time.Now()
+	for {
+		frame, length, err := src.ReadPacket()
+		if err != nil {
+			return err
+		}
+		now := time.Now()
+		if frame != nil {
+			if p, ok := decodeARP(frame); ok && c.arp != nil {
+				c.arp(p, now)
+			} else if info, ok := decodeFrame(frame, length); ok {
+				for _, consume := range c.consumers {
+					consume(info, now)
+				}
+			}
+			c.mu.Lock()
+			c.packets++
+			c.mu.Unlock()
+		}
+
+		if now.Sub(checked) >= time.Second {
+			checked = now
+			server.mu.RLock()
+			changed := server.currentIface != iface
+			server.mu.RUnlock()
+			if changed {
+				return nil
+			}
+		}
+	}
+}
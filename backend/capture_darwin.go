@@ -0,0 +1,113 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// bpfSource captures with a BPF device, which needs read access to
+// /dev/bpf* (root, or the access_bpf group Wireshark's ChmodBPF sets up).
+type bpfSource struct {
+	fd      int
+	buffer  []byte
+	pending []byte // records of the last read not yet returned
+}
+
+func ioctlPointer(fd int, req uint, arg unsafe.Pointer) error {
+	if _, _, errno := unix.Syscall(unix.SYS_IOCTL, uintptr(fd), uintptr(req), uintptr(arg)); errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+// openCaptureFD opens a BPF device attached to iface. It is split from
+// newPacketSource so the privileged helper can open it for the server.
+func openCaptureFD(iface string) (int, error) {
+	fd := -1
+	var err error
+	for i := 0; i < 256; i++ {
+		fd, err = unix.Open(fmt.Sprintf("/dev/bpf%d", i), unix.O_RDONLY, 0)
+		if !errors.Is(err, unix.EBUSY) {
+			break
+		}
+	}
+	if err != nil {
+		return -1, fmt.Errorf("open BPF device: %v", err)
+	}
+
+	fail := func(what string, err error) (int, error) {
+		unix.Close(fd)
+		return -1, fmt.Errorf("%s: %v", what, err)
+	}
+	var ifreq [32]byte
+	copy(ifreq[:unix.IFNAMSIZ-1], iface)
+	if err := ioctlPointer(fd, unix.BIOCSETIF, unsafe.Pointer(&ifreq)); err != nil {
+		return fail("attach to "+iface, err)
+	}
+	if dlt, err := unix.IoctlGetInt(fd, unix.BIOCGDLT); err != nil || dlt != 1 {
+		return fail(iface, errors.New("not an Ethernet interface"))
+	}
+	if err := unix.IoctlSetPointerInt(fd, unix.BIOCIMMEDIATE, 1); err != nil {
+		return fail("immediate mode", err)
+	}
+	// The timeout lets the reader notice interface changes
+	timeout := unix.Timeval{Sec: 1}
+	if err := ioctlPointer(fd, unix.BIOCSRTIMEOUT, unsafe.Pointer(&timeout)); err != nil {
+		return fail("read timeout", err)
+	}
+	return fd, nil
+}
+
+func newPacketSource(fd int) (packetSource, error) {
+	size, err := unix.IoctlGetInt(fd, unix.BIOCGBLEN)
+	if err != nil {
+		unix.Close(fd)
+		return nil, fmt.Errorf("buffer size: %v", err)
+	}
+	return &bpfSource{fd: fd, buffer: make([]byte, size)}, nil
+}
+
+func (s *bpfSource) ReadPacket() ([]byte, int, error) {
+	if len(s.pending) == 0 {
+		n, err := unix.Read(s.fd, s.buffer)
+		if errors.Is(err, unix.EINTR) {
+			return nil, 0, nil
+		}
+		if err != nil {
+			return nil, 0, err
+		}
+		s.pending = s.buffer[:n]
+		if n == 0 {
+			return nil, 0, nil
+		}
+	}
+
+	// A read returns several records, each a bpf_hdr followed by the frame
+	// and padding to a word boundary
+	if len(s.pending) < unix.SizeofBpfHdr {
+		s.pending = nil
+		return nil, 0, nil
+	}
+	hdr := (*unix.BpfHdr)(unsafe.Pointer(&s.pending[0]))
+	start := int(hdr.Hdrlen)
+	end := start + int(hdr.Caplen)
+	if end > len(s.pending) {
+		s.pending = nil
+		return nil, 0, nil
+	}
+	frame := s.pending[start:end]
+	next := (end + 3) &^ 3
+	if next >= len(s.pending) {
+		s.pending = nil
+	} else {
+		s.pending = s.pending[next:]
+	}
+	return frame, int(hdr.Datalen), nil
+}
+
+func (s *bpfSource) Close() error {
+	return unix.Close(s.fd)
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+
+	"golang.org/x/sys/unix"
+)
+
+// afPacketSource captures with an AF_PACKET socket, which needs root or
+// CAP_NET_RAW.
+type afPacketSource struct {
+	fd     int
+	buffer []byte
+}
+
+func htons(v uint16) uint16 { return v<<8 | v>>8 }
+
+// openCaptureFD opens a packet socket bound to iface. It is split from
+// newPacketSource so the privileged helper can open it for the server.
+func openCaptureFD(iface string) (int, error) {
+	ifi, err := net.InterfaceByName(iface)
+	if err != nil {
+		return -1, err
+	}
+	fd, err := unix.Socket(unix.AF_PACKET, unix.SOCK_RAW, int(htons(unix.ETH_P_ALL)))
+	if err != nil {
+		return -1, fmt.Errorf("packet socket: %v", err)
+	}
+	addr := &unix.SockaddrLinklayer{Protocol: htons(unix.ETH_P_ALL), Ifindex: ifi.Index}
+	if err := unix.Bind(fd, addr); err != nil {
+		unix.Close(fd)
+		return -1, fmt.Errorf("bind to %s: %v", iface, err)
+	}
+	// The timeout lets the reader notice interface changes
+	timeout := unix.Timeval{Sec: 1}
+	if err := unix.SetsockoptTimeval(fd, unix.SOL_SOCKET, unix.SO_RCVTIMEO, &timeout); err != nil {
+		unix.Close(fd)
+		return -1, err
+	}
+	return fd, nil
+}
+
+func newPacketSource(fd int) (packetSource, error) {
+	return &afPacketSource{fd: fd, buffer: make([]byte, 65536)}, nil
+}
+
+func (s *afPacketSource) ReadPacket() ([]byte, int, error) {
+	// MSG_TRUNC returns the length on the wire even if the frame didn't
+	// fit the buffer
+	n, _, err := unix.Recvfrom(s.fd, s.buffer, unix.MSG_TRUNC)
+	if errors.Is(err, unix.EAGAIN) || errors.Is(err, unix.EINTR) {
+		return nil, 0, nil
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+	return s.buffer[:min(n, len(s.buffer))], n, nil
+}
+
+func (s *afPacketSource) Close() error {
+	return unix.Close(s.fd)
+}
@@ -0,0 +1,11 @@
+//go:build !linux && !darwin
+
+package main
+
+func openCaptureFD(iface string) (int, error) {
+	return -1, errCaptureUnsupported
+}
+
+func newPacketSource(fd int) (packetSource, error) {
+	return nil, errCaptureUnsupported
+}
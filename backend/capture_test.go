@@ -0,0 +1,99 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+// testFrame builds an Ethernet frame carrying an IP packet with a TCP or
+// UDP header, optionally behind a VLAN tag.
+func testFrame(src, dst string, protocol uint8, srcPort, dstPort uint16, vlan bool) []byte {
+	frame := make([]byte, 12)
+	if vlan {
+		frame = append(frame, 0x81, 0x00, 0x00, 0x0a)
+	}
+	transport := make([]byte, 8)
+	binary.BigEndian.PutUint16(transport[0:2], srcPort)
+	binary.BigEndian.PutUint16(transport[2:4], dstPort)
+
+	if ip := net.ParseIP(src).To4(); ip != nil {
+		header := make([]byte, 20)
+		header[0] = 0x45
+		header[9] = protocol
+		copy(header[12:16], ip)
+		copy(header[16:20], net.ParseIP(dst).To4())
+		frame = append(frame, 0x08, 0x00)
+		frame = append(frame, header...)
+	} else {
+		header := make([]byte, 40)
+		header[0] = 0x60
+		header[6] = protocol
+		copy(header[8:24], net.ParseIP(src))
+		copy(header[24:40], net.ParseIP(dst))
+		frame = append(frame, 0x86, 0xdd)
+		frame = append(frame, header...)
+	}
+	return append(frame, transport...)
+}
+
+// TestDecodeFrame verifies addresses and ports are read from IPv4 and IPv6
+// packets, through VLAN tags
+func TestDecodeFrame(t *testing.T) {
+	info, ok := decodeFrame(testFrame("10.0.0.2", "1.1.1.1", protoTCP, 50000, 443, true), 1500)
+	if !ok {
+		t.Fatalf("Expected the tagged IPv4 frame to decode")
+	}
+	if info.Src.String() != "10.0.0.2" || info.Dst.String() != "1.1.1.1" || info.SrcPort != 50000 || info.DstPort != 443 || info.Length != 1500 {
+		t.Fatalf("Unexpected IPv4 packet %+v", info)
+	}
+
+	info, ok = decodeFrame(testFrame("fe80::1", "ff02::fb", protoUDP, 5353, 5353, false), 120)
+	if !ok || info.Src.String() != "fe80::1" || info.Protocol != protoUDP || info.DstPort != 5353 {
+		t.Fatalf("Unexpected IPv6 packet %+v (%v)", info, ok)
+	}
+
+	arp := make([]byte, 42)
+	arp[12], arp[13] = 0x08, 0x06
+	if _, ok := decodeFrame(arp, 42); ok {
+		t.Fatalf("Expected an ARP frame to be skipped")
+	}
+}
+
+// fakePacketSource returns its frames, then fails.
+type fakePacketSource struct {
+	frames [][]byte
+}
+
+func (s *fakePacketSource) ReadPacket() ([]byte, int, error) {
+	if len(s.frames) == 0 {
+		return nil, 0, errors.New("closed")
+	}
+	frame := s.frames[0]
+	s.frames = s.frames[1:]
+	return frame, len(frame), nil
+}
+
+func (s *fakePacketSource) Close() error { return nil }
+
+// TestCaptureRead verifies captured packets reach the consumers and read
+// timeouts are skipped
+func TestCaptureRead(t *testing.T) {
+	server := NewMDNSServer()
+	var received []packetInfo
+	capture := NewCapture(func(p packetInfo, _ time.Time) { received = append(received, p) })
+
+	src := &fakePacketSource{frames: [][]byte{
+		testFrame("10.0.0.2", "10.0.0.3", protoUDP, 1, 2, false),
+		nil, // read timeout
+		testFrame("10.0.0.3", "10.0.0.2", protoUDP, 2, 1, false),
+	}}
+	if err := capture.read(server, src, server.currentIface); err == nil {
+		t.Fatalf("Expected the source's error")
+	}
+	if len(received) != 2 || capture.Status().Packets != 2 {
+		t.Fatalf("Expected 2 packets, got %d (status %+v)", len(received), capture.Status())
+	}
+}
@@ -0,0 +1,241 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Nagios plugin states, which are also the exit codes of
+// "network-view check".
+const (
+	checkOK = iota
+	checkWarning
+	checkCritical
+	checkUnknown
+)
+
+var checkStates = []string{"OK", "WARNING", "CRITICAL", "UNKNOWN"}
+
+// Default latency thresholds of a check.
+const (
+	defaultCheckWarn = 200 * time.Millisecond
+	defaultCheckCrit = time.Second
+)
+
+// checkPing measures a device's round trip time; a variable so tests can
+// stand in for the privileged helper.
+var checkPing = (*HelperClient).Ping
+
+// CheckResult is the outcome of a device check, in the form monitoring
+// systems expect from a Nagios plugin: a state, and one line of output with
+// performance data after the "|".
+type CheckResult struct {
+	Device  string  `json:"device"`
+	Code    int     `json:"code"`
+	Status  string  `json:"status"`
+	Output  string  `json:"output"`
+	Present bool    `json:"present"`
+	RTTMs   float64 `json:"rttMs,omitempty"`
+}
+
+// httpStatus maps the check's state to a response status, for health
+// checkers that only look at the status: 200 while the device is up, even
+// when slow, 503 when it is down and 404 for a device nobody knows.
+func (c CheckResult) httpStatus() int {
+	switch c.Code {
+	case checkOK, checkWarning:
+		return http.StatusOK
+	case checkCritical:
+		return http.StatusServiceUnavailable
+	default:
+		return http.StatusNotFound
+	}
+}
+
+func newCheckResult(device string, code int, message string, perfdata ...string) CheckResult {
+	output := fmt.Sprintf("DEVICE %s - %s", checkStates[code], message)
+	if len(perfdata) > 0 {
+		output += " | " + strings.Join(perfdata, " ")
+	}
+	return CheckResult{Device: device, Code: code, Status: checkStates[code], Output: output}
+}
+
+// findDevice returns the device of site with the ID, address or MAC address
+// id, or nil.
+func (s *MDNSServer) findDevice(site, id string) *DeviceSummary {
+	id = strings.TrimSuffix(id, ".")
+	for _, device := range s.summarizeDevices(s.listDevices(site, ""), site) {
+		if strings.EqualFold(device.ID, id) || (device.MAC != "" && strings.EqualFold(device.MAC, id)) {
+			return device
+		}
+		for _, addr := range device.Addresses {
+			if addr == id {
+				return device
+			}
+		}
+	}
+	return nil
+}
+
+// checkDevice checks that a device is present, i.e. currently advertises
+// services, and, with the privileged helper, that it answers pings within
+// the warn and crit thresholds.
+func (s *MDNSServer) checkDevice(site, id string, warn, crit time.Duration) CheckResult {
+	device := s.findDevice(site, id)
+	if device == nil {
+		return newCheckResult(id, checkUnknown, fmt.Sprintf("%s is not a known device", id))
+	}
+	name := device.ID
+	services := fmt.Sprintf("services=%d;;;0", len(device.Services))
+	if len(device.Services) == 0 {
+		message := name + " is offline"
+		if device.LastSeen > 0 {
+			message += ", last seen " + time.Unix(device.LastSeen, 0).Format(time.RFC3339)
+		}
+		return newCheckResult(name, checkCritical, message, services)
+	}
+
+	present := fmt.Sprintf("%s is present with %d services", name, len(device.Services))
+	ip := ""
+	for _, addr := range device.Addresses {
+		if parsed := net.ParseIP(addr); parsed != nil && parsed.To4() != nil {
+			ip = addr
+			break
+		}
+	}
+	if s.helper == nil || ip == "" {
+		result := newCheckResult(name, checkOK, present, services)
+		result.Present = true
+		return result
+	}
+
+	rtt, err := checkPing(s.helper, ip, crit)
+	if err != nil {
+		result := newCheckResult(name, checkWarning, fmt.Sprintf("%s, but %s does not answer pings: %v", present, ip, err), services)
+		result.Present = true
+		return result
+	}
+	code := checkOK
+	switch {
+	case rtt >= crit:
+		code = checkCritical
+	case rtt >= warn:
+		code = checkWarning
+	}
+	result := newCheckResult(name, code, fmt.Sprintf("%s, rtt %.1f ms", present, milliseconds(rtt)),
+		fmt.Sprintf("rtt=%.3fms;%g;%g;0", milliseconds(rtt), milliseconds(warn), milliseconds(crit)), services)
+	result.Present = true
+	result.RTTMs = milliseconds(rtt)
+	return result
+}
+
+// parseCheckThreshold parses a latency threshold, a duration such as
+// "200ms" or a number of milliseconds as Nagios plugins take them.
+func parseCheckThreshold(v string, fallback time.Duration) (time.Duration, error) {
+	if v == "" {
+		return fallback, nil
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		d, err = time.ParseDuration(v + "ms")
+	}
+	if err != nil || d <= 0 {
+		return 0, fmt.Errorf("invalid threshold %q", v)
+	}
+	return d, nil
+}
+
+// Check handles GET /api/check/{id}: a Nagios-style check of the device
+// with that ID, address or MAC address, against the ?warn= and ?crit=
+// latency thresholds. The plugin output line is the plain-text body and the
+// state is in the X-Check-Code header and the response status; ?format=json
+// returns a CheckResult instead.
+func (s *MDNSServer) Check(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	warn, err := parseCheckThreshold(r.URL.Query().Get("warn"), defaultCheckWarn)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	crit, err := parseCheckThreshold(r.URL.Query().Get("crit"), defaultCheckCrit)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if warn > crit {
+		writeError(w, http.StatusBadRequest, "warn must not exceed crit")
+		return
+	}
+
+	result := s.checkDevice(s.deviceSite(r), r.PathValue("id"), warn, crit)
+	w.Header().Set("X-Check-Code", fmt.Sprint(result.Code))
+	if r.URL.Query().Get("format") == "json" {
+		writeJSON(w, result.httpStatus(), result)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.WriteHeader(result.httpStatus())
+	fmt.Fprintln(w, result.Output)
+}
+
+// runCheck runs "network-view check": it asks a running server for the
+// check of a device, prints the plugin output and returns the exit code, so
+// the binary can be used as a Nagios or Icinga plugin.
+func runCheck(args []string, stdout, stderr io.Writer) int {
+	flags := flag.NewFlagSet("check", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	device := flags.String("device", "", "ID, address or MAC address of the device to check")
+	server := flags.String("server", "http://localhost:9999", "URL of the network-view server")
+	site := flags.String("site", "", "Site of the device (default: the server's own)")
+	warn := flags.String("warn", "", "Round trip time above which the device is WARNING (default 200ms)")
+	crit := flags.String("crit", "", "Round trip time above which the device is CRITICAL (default 1s)")
+	timeout := flags.Duration("timeout", 10*time.Second, "How long to wait for the server")
+	if err := flags.Parse(args); err != nil {
+		return checkUnknown
+	}
+	if *device == "" {
+		fmt.Fprintln(stdout, "DEVICE UNKNOWN - --device is required")
+		return checkUnknown
+	}
+
+	query := url.Values{"format": {"json"}}
+	for name, value := range map[string]string{"site": *site, "warn": *warn, "crit": *crit} {
+		if value != "" {
+			query.Set(name, value)
+		}
+	}
+	endpoint := strings.TrimSuffix(*server, "/") + "/api/check/" + url.PathEscape(*device) + "?" + query.Encode()
+	client := &http.Client{Timeout: *timeout}
+	resp, err := client.Get(endpoint)
+	if err != nil {
+		fmt.Fprintf(stdout, "DEVICE UNKNOWN - cannot reach %s: %v\n", *server, err)
+		return checkUnknown
+	}
+	defer resp.Body.Close()
+
+	var result struct {
+		CheckResult
+		Error string `json:"error"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil || result.Status == "" {
+		message := result.Error
+		if message == "" {
+			message = fmt.Sprintf("unexpected response from %s: %s", *server, resp.Status)
+		}
+		fmt.Fprintf(stdout, "DEVICE UNKNOWN - %s\n", message)
+		return checkUnknown
+	}
+	fmt.Fprintln(stdout, result.Output)
+	return result.Code
+}
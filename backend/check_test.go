@@ -0,0 +1,106 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestCheckDevice verifies the check states for unknown, offline, present,
+// slow and unreachable devices
+func TestCheckDevice(t *testing.T) {
+	server := NewMDNSServer()
+	server.metadata, _ = NewMetadataStore(openTestStore(t, "json", t.TempDir()))
+	server.addService("a", &MDNSService{Name: "Printer", Type: "_ipp._tcp.local.", Host: "printer.local.", IP: "192.168.1.30", Port: 631, Site: defaultSite, Timestamp: time.Now().Unix()})
+	server.metadata.Update(defaultSite, "nas.local", func(d *DeviceMetadata) { d.Owner = "alex" })
+
+	if result := server.checkDevice(defaultSite, "tv.local", time.Second, 2*time.Second); result.Code != checkUnknown {
+		t.Fatalf("Expected UNKNOWN for an unknown device, got %+v", result)
+	}
+	if result := server.checkDevice(defaultSite, "nas.local", time.Second, 2*time.Second); result.Code != checkCritical || !strings.Contains(result.Output, "offline") {
+		t.Fatalf("Expected CRITICAL for an offline device, got %+v", result)
+	}
+	if result := server.checkDevice(defaultSite, "192.168.1.30", time.Second, 2*time.Second); result.Code != checkOK || result.Device != "printer.local" {
+		t.Fatalf("Expected OK for the printer by address without a helper, got %+v", result)
+	}
+
+	saved := checkPing
+	defer func() { checkPing = saved }()
+	server.helper = NewHelperClient("unused")
+	for _, tt := range []struct {
+		rtt  time.Duration
+		err  error
+		code int
+	}{
+		{5 * time.Millisecond, nil, checkOK},
+		{1500 * time.Millisecond, nil, checkWarning},
+		{3 * time.Second, nil, checkCritical},
+		{0, errors.New("timeout"), checkWarning},
+	} {
+		checkPing = func(*HelperClient, string, time.Duration) (time.Duration, error) { return tt.rtt, tt.err }
+		result := server.checkDevice(defaultSite, "printer.local", time.Second, 2*time.Second)
+		if result.Code != tt.code || !result.Present {
+			t.Fatalf("Expected code %d for rtt %v and error %v, got %+v", tt.code, tt.rtt, tt.err, result)
+		}
+	}
+	checkPing = func(*HelperClient, string, time.Duration) (time.Duration, error) { return 5 * time.Millisecond, nil }
+	if result := server.checkDevice(defaultSite, "printer.local", time.Second, 2*time.Second); !strings.HasSuffix(result.Output, "| rtt=5.000ms;1000;2000;0 services=1;;;0") {
+		t.Fatalf("Expected performance data, got %q", result.Output)
+	}
+}
+
+// TestCheckHandler verifies the plain-text output, status codes and the
+// check CLI against the endpoint
+func TestCheckHandler(t *testing.T) {
+	server := NewMDNSServer()
+	server.metadata, _ = NewMetadataStore(openTestStore(t, "json", t.TempDir()))
+	server.addService("a", &MDNSService{Name: "Printer", Type: "_ipp._tcp.local.", Host: "printer.local.", IP: "192.168.1.30", Port: 631, Site: defaultSite, Timestamp: time.Now().Unix()})
+
+	req := httptest.NewRequest(http.MethodGet, "/api/check/printer.local", nil)
+	req.SetPathValue("id", "printer.local")
+	rec := httptest.NewRecorder()
+	server.Check(rec, req)
+	if rec.Code != http.StatusOK || rec.Header().Get("X-Check-Code") != "0" || !strings.HasPrefix(rec.Body.String(), "DEVICE OK - printer.local is present") {
+		t.Fatalf("Expected an OK check, got %d %q", rec.Code, rec.Body.String())
+	}
+
+	req = httptest.NewRequest(http.MethodGet, "/api/check/tv.local", nil)
+	req.SetPathValue("id", "tv.local")
+	rec = httptest.NewRecorder()
+	server.Check(rec, req)
+	if rec.Code != http.StatusNotFound || rec.Header().Get("X-Check-Code") != "3" {
+		t.Fatalf("Expected 404 for an unknown device, got %d", rec.Code)
+	}
+
+	rec = httptest.NewRecorder()
+	server.Check(rec, httptest.NewRequest(http.MethodGet, "/api/check/printer.local?warn=2s&crit=1s", nil))
+	if rec.Code != http.StatusBadRequest {
+		t.Fatalf("Expected 400 for warn above crit, got %d", rec.Code)
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/check/{id}", server.Check)
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+
+	var stdout, stderr bytes.Buffer
+	if code := runCheck([]string{"--device", "printer.local", "--server", ts.URL}, &stdout, &stderr); code != checkOK || !strings.HasPrefix(stdout.String(), "DEVICE OK") {
+		t.Fatalf("Expected exit code 0 and the plugin output, got %d %q", code, stdout.String())
+	}
+	stdout.Reset()
+	if code := runCheck([]string{"--device", "tv.local", "--server", ts.URL}, &stdout, &stderr); code != checkUnknown {
+		t.Fatalf("Expected exit code 3 for an unknown device, got %d %q", code, stdout.String())
+	}
+	stdout.Reset()
+	if code := runCheck([]string{"--device", "printer.local", "--server", ts.URL, "--warn", "x"}, &stdout, &stderr); code != checkUnknown || !strings.Contains(stdout.String(), "invalid threshold") {
+		t.Fatalf("Expected exit code 3 with the server's error, got %d %q", code, stdout.String())
+	}
+	stdout.Reset()
+	if code := runCheck([]string{"--device", "printer.local", "--server", "http://127.0.0.1:1"}, &stdout, &stderr); code != checkUnknown || !strings.Contains(stdout.String(), "cannot reach") {
+		t.Fatalf("Expected exit code 3 without a server, got %d %q", code, stdout.String())
+	}
+}
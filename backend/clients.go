@@ -0,0 +1,139 @@
+package main
+
+import (
+	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// streamClient is one connected event consumer, such as a /discover stream
+// or a GraphQL subscription.
+type streamClient struct {
+	id          uint64
+	transport   string
+	ch          chan *streamEvent
+	site        string  // only events of this site are queued; "" means all
+	filter      *Filter // ?filter=: only events of matching services are queued
+	remoteAddr  string
+	userAgent   string
+	connectedAt time.Time
+	filters     map[string]string
+	compact     bool   // ?compact=1: events are sent with abbreviated fields
+	after       uint64 // Last-Event-ID or ?after=: resume after this event, 0 for none
+	// current is the seq the inventory the client was sent is current to.
+	// Events up to it may still be queued for the dispatcher, but are
+	// already part of the inventory.
+	current uint64
+
+	delivered atomic.Uint64
+	dropped   atomic.Uint64
+
+	// saturatedSince is when the client's queue last became full (Unix
+	// nanoseconds), or 0 while it is keeping up.
+	saturatedSince atomic.Int64
+	disconnect     chan struct{}
+	disconnectOnce sync.Once
+}
+
+var nextClientID atomic.Uint64
+
+// newStreamClient creates a client for a stream request. The request's query
+// parameters are recorded as the client's filters.
+func newStreamClient(r *http.Request, bufferSize int) *streamClient {
+	filters := make(map[string]string)
+	for name := range r.URL.Query() {
+		filters[name] = r.URL.Query().Get(name)
+	}
+
+	return &streamClient{
+		id:          nextClientID.Add(1),
+		transport:   "sse",
+		ch:          make(chan *streamEvent, bufferSize),
+		remoteAddr:  r.RemoteAddr,
+		userAgent:   r.UserAgent(),
+		connectedAt: time.Now(),
+		filters:     filters,
+		compact:     wantsCompact(r),
+		disconnect:  make(chan struct{}),
+	}
+}
+
+// delivers reports whether the events of a service are for a client.
+func (s *MDNSServer) delivers(c *streamClient, service *MDNSService) bool {
+	return inSite(service, c.site) && c.filter.Match(s.serviceFields(service))
+}
+
+// markSaturated is called when an event could not be queued. It reports
+// whether the queue has now been full for longer than timeout; a zero
+// timeout never gives up on a client.
+func (c *streamClient) markSaturated(now time.Time, timeout time.Duration) bool {
+	c.dropped.Add(1)
+	c.saturatedSince.CompareAndSwap(0, now.UnixNano())
+	return timeout > 0 && now.Sub(time.Unix(0, c.saturatedSince.Load())) > timeout
+}
+
+// kick asks the client's stream handler to disconnect it.
+func (c *streamClient) kick() {
+	c.disconnectOnce.Do(func() {
+		if c.disconnect != nil {
+			close(c.disconnect)
+		}
+	})
+}
+
+// ClientInfo describes a connected stream client on /api/clients.
+type ClientInfo struct {
+	ID          uint64            `json:"id"`
+	Transport   string            `json:"transport"`
+	RemoteAddr  string            `json:"remoteAddr"`
+	UserAgent   string            `json:"userAgent,omitempty"`
+	ConnectedAt int64             `json:"connectedAt"`
+	Duration    string            `json:"duration"`
+	Filters     map[string]string `json:"filters,omitempty"`
+	Delivered   uint64            `json:"delivered"`
+	Dropped     uint64            `json:"dropped"`
+	Queued      int               `json:"queued"`
+	Buffer      int               `json:"buffer"`
+	Saturated   bool              `json:"saturated"`
+}
+
+func (c *streamClient) info(now time.Time) ClientInfo {
+	return ClientInfo{
+		ID:          c.id,
+		Transport:   c.transport,
+		RemoteAddr:  c.remoteAddr,
+		UserAgent:   c.userAgent,
+		ConnectedAt: c.connectedAt.Unix(),
+		Duration:    now.Sub(c.connectedAt).Round(time.Second).String(),
+		Filters:     c.filters,
+		Delivered:   c.delivered.Load(),
+		Dropped:     c.dropped.Load(),
+		Queued:      len(c.ch),
+		Buffer:      cap(c.ch),
+		Saturated:   c.saturatedSince.Load() != 0,
+	}
+}
+
+// Clients handles GET /api/clients, listing connected stream clients with
+// their delivery counters, to tell a stalled dashboard from a stalled server.
+func (s *MDNSServer) Clients(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	now := time.Now()
+	s.mu.RLock()
+	clients := make([]ClientInfo, 0, len(s.clients))
+	for c := range s.clients {
+		clients = append(clients, c.info(now))
+	}
+	s.mu.RUnlock()
+	sort.Slice(clients, func(i, j int) bool { return clients[i].ID < clients[j].ID })
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"clients": clients,
+	})
+}
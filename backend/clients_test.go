@@ -0,0 +1,74 @@
+package main
+
+import (
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// TestBroadcastCountsDrops verifies events a full client buffer cannot take
+// are counted as dropped
+func TestBroadcastCountsDrops(t *testing.T) {
+	server := NewMDNSServer()
+	client := newStreamClient(httptest.NewRequest("GET", "/discover?site=office", nil), 1)
+	server.registerClient(client)
+
+	server.fanOut(newStreamEvent(&DiscoveryResponse{}))
+	server.fanOut(newStreamEvent(&DiscoveryResponse{}))
+
+	info := client.info(client.connectedAt)
+	if info.Queued != 1 || info.Dropped != 1 {
+		t.Fatalf("Expected 1 queued and 1 dropped event, got %d queued, %d dropped", info.Queued, info.Dropped)
+	}
+	if info.Filters["site"] != "office" {
+		t.Fatalf("Expected site filter to be recorded, got %v", info.Filters)
+	}
+}
+
+// TestSlowClientDisconnect verifies a client whose queue stays full past the
+// slow-client timeout is kicked, and that delivering an event resets it
+func TestSlowClientDisconnect(t *testing.T) {
+	client := newStreamClient(httptest.NewRequest("GET", "/discover", nil), 1)
+	start := time.Now()
+
+	if client.markSaturated(start, time.Second) {
+		t.Fatalf("Expected a freshly saturated client to stay connected")
+	}
+	if !client.markSaturated(start.Add(2*time.Second), time.Second) {
+		t.Fatalf("Expected a client saturated for 2s to exceed the 1s timeout")
+	}
+	if client.markSaturated(start.Add(time.Hour), 0) {
+		t.Fatalf("Expected a zero timeout never to disconnect")
+	}
+
+	server := NewMDNSServer()
+	server.slowClientTimeout = time.Nanosecond
+	server.registerClient(client)
+	client.ch <- newStreamEvent(&DiscoveryResponse{})
+	server.fanOut(newStreamEvent(&DiscoveryResponse{}))
+
+	select {
+	case <-client.disconnect:
+	default:
+		t.Fatalf("Expected the saturated client to be disconnected")
+	}
+}
+
+// TestClientsChangedHook verifies the hook sees the client count on connect
+// and disconnect
+func TestClientsChangedHook(t *testing.T) {
+	server := NewMDNSServer()
+	var counts []int
+	server.onClients = func(connected int) { counts = append(counts, connected) }
+
+	first := &streamClient{ch: make(chan *streamEvent, 1)}
+	second := &streamClient{ch: make(chan *streamEvent, 1)}
+	server.subscribeClient(first, 0)
+	server.registerClient(second)
+	server.unregisterClient(first)
+	server.unregisterClient(second)
+
+	if len(counts) != 4 || counts[0] != 1 || counts[1] != 2 || counts[3] != 0 {
+		t.Fatalf("Expected counts 1, 2, 1, 0, got %v", counts)
+	}
+}
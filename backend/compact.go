@@ -0,0 +1,136 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+)
+
+// compactKeys are the abbreviated field names of ?compact=1 responses, for
+// clients on metered links. Fields not listed keep their names.
+var compactKeys = map[string]string{
+	"service":       "sv",
+	"removed":       "rm",
+	"name":          "n",
+	"type":          "t",
+	"host":          "h",
+	"port":          "p",
+	"timestamp":     "ts",
+	"site":          "s",
+	"lastRefreshed": "lr",
+	"expiresAt":     "x",
+	"firstSeen":     "fs",
+	"lastSeen":      "ls",
+	"interfaces":    "if",
+	"source":        "src",
+	"confidence":    "c",
+	"rawRecordType": "rt",
+	"reachable":     "ok",
+	"checkedAt":     "ck",
+	"reachableAt":   "ra",
+	"freshness":     "fr",
+	"devices":       "d",
+	"addresses":     "a",
+	"services":      "ss",
+	"category":      "cat",
+	"owner":         "o",
+	"location":      "l",
+	"notes":         "nt",
+	"updatedAt":     "u",
+	"blocklists":    "bl",
+	"switchPort":    "sp",
+	"traffic":       "tr",
+	"inBytes":       "ib",
+	"outBytes":      "ob",
+	"events":        "e",
+	"cursor":        "cu",
+	"gap":           "g",
+}
+
+// compactOmitted are fields left out of compact responses entirely: TXT
+// records are bulky and rarely shown on a phone.
+var compactOmitted = map[string]bool{
+	"txt": true,
+}
+
+// wantsCompact reports whether r asks for compact responses with ?compact=1.
+func wantsCompact(r *http.Request) bool {
+	v := r.URL.Query().Get("compact")
+	return v == "1" || v == "true"
+}
+
+// compactJSON encodes v with abbreviated field names, leaving out fields
+// that are null, false, 0, or empty strings, arrays and objects, and TXT
+// records.
+func compactJSON(v interface{}) ([]byte, error) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber() // keep integers exact
+	var decoded interface{}
+	if err := decoder.Decode(&decoded); err != nil {
+		return nil, err
+	}
+	compacted, _ := compactValue(decoded)
+	return json.Marshal(compacted)
+}
+
+// compactValue compacts a decoded JSON value, reporting false for values to
+// leave out.
+func compactValue(v interface{}) (interface{}, bool) {
+	switch v := v.(type) {
+	case nil:
+		return nil, false
+	case bool:
+		return v, v
+	case string:
+		return v, v != ""
+	case json.Number:
+		f, err := v.Float64()
+		return v, err != nil || f != 0
+	case []interface{}:
+		out := make([]interface{}, 0, len(v))
+		for _, item := range v {
+			// Elements are kept even if empty, so positions don't shift
+			compacted, _ := compactValue(item)
+			out = append(out, compacted)
+		}
+		return out, len(out) > 0
+	case map[string]interface{}:
+		out := make(map[string]interface{}, len(v))
+		for key, value := range v {
+			if compactOmitted[key] {
+				continue
+			}
+			compacted, ok := compactValue(value)
+			if !ok {
+				continue
+			}
+			if short, ok := compactKeys[key]; ok {
+				key = short
+			}
+			out[key] = compacted
+		}
+		return out, len(out) > 0
+	default:
+		return v, true
+	}
+}
+
+// writeJSONFor is writeJSON, compacted if r asks for ?compact=1.
+func writeJSONFor(w http.ResponseWriter, r *http.Request, status int, v interface{}) {
+	if !wantsCompact(r) {
+		writeJSON(w, status, v)
+		return
+	}
+	data, err := compactJSON(v)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(append(data, '\n'))
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// TestCompactJSON verifies field names are abbreviated and empty fields and
+// TXT records left out, without changing array positions
+func TestCompactJSON(t *testing.T) {
+	data, err := compactJSON(map[string]interface{}{
+		"service": MDNSService{Name: "printer", Type: "_ipp._tcp", IP: "10.0.0.5", Port: 631, Timestamp: 1700000000},
+		"removed": false,
+		"txt":     []string{"rp=ipp/print"},
+		"ids":     []interface{}{"a", "", nil},
+	})
+	if err != nil {
+		t.Fatalf("Expected compact encoding, got %v", err)
+	}
+	var got map[string]interface{}
+	if err := json.Unmarshal(data, &got); err != nil {
+		t.Fatalf("Expected valid JSON, got %v", err)
+	}
+	if _, ok := got["rm"]; ok {
+		t.Fatalf("Expected false removed to be left out, got %s", data)
+	}
+	if _, ok := got["txt"]; ok {
+		t.Fatalf("Expected TXT to be left out, got %s", data)
+	}
+	if ids := got["ids"].([]interface{}); len(ids) != 3 {
+		t.Fatalf("Expected array elements to be kept, got %s", data)
+	}
+	service := got["sv"].(map[string]interface{})
+	if service["n"] != "printer" || service["t"] != "_ipp._tcp" || service["ip"] != "10.0.0.5" || service["p"] != 631.0 || service["ts"] != 1700000000.0 {
+		t.Fatalf("Expected abbreviated service fields, got %s", data)
+	}
+	for _, empty := range []string{"h", "s", "lr", "x", "fs", "if", "src", "c"} {
+		if _, ok := service[empty]; ok {
+			t.Fatalf("Expected empty %s to be left out, got %s", empty, data)
+		}
+	}
+}
+
+// TestCompactKeysUnique verifies no two fields share an abbreviation, and
+// no abbreviation is the name of another field
+func TestCompactKeysUnique(t *testing.T) {
+	seen := make(map[string]string)
+	for key, short := range compactKeys {
+		if other, ok := seen[short]; ok {
+			t.Fatalf("Expected unique abbreviations, %s and %s are both %s", key, other, short)
+		}
+		if _, ok := compactKeys[short]; ok {
+			t.Fatalf("Expected abbreviation %s of %s not to be a field name", short, key)
+		}
+		seen[short] = key
+	}
+}
+
+// TestCompactStreamEvent verifies the compact encoding of an event is made
+// once and only on demand
+func TestCompactStreamEvent(t *testing.T) {
+	ev := newStreamEvent(&DiscoveryResponse{Service: MDNSService{Name: "nas"}})
+	if ev.compact != nil {
+		t.Fatalf("Expected no compact encoding before a client asks for it")
+	}
+	compact := ev.encoded(true)
+	if string(compact) != `{"sv":{"n":"nas"}}` {
+		t.Fatalf("Expected the compact event, got %s", compact)
+	}
+	if string(ev.encoded(false)) != string(ev.data) || &ev.encoded(true)[0] != &compact[0] {
+		t.Fatalf("Expected the encodings to be shared")
+	}
+}
+
+// TestPollEventsCompact verifies ?compact=1 on the long-poll endpoint
+func TestPollEventsCompact(t *testing.T) {
+	server := NewMDNSServer()
+	server.replay = NewReplayBuffer(time.Minute)
+	server.fanOut(newStreamEvent(&DiscoveryResponse{Service: MDNSService{Name: "tv", Site: defaultSite}}))
+
+	rec := httptest.NewRecorder()
+	server.PollEvents(rec, httptest.NewRequest(http.MethodGet, "/api/events/poll?cursor=0&compact=1", nil))
+	var resp map[string]interface{}
+	if err := json.NewDecoder(rec.Body).Decode(&resp); err != nil {
+		t.Fatalf("Expected a JSON response, got %v", err)
+	}
+	events, ok := resp["e"].([]interface{})
+	if !ok || len(events) != 1 || resp["cu"] != 1.0 {
+		t.Fatalf("Expected one compact event at cursor 1, got %v", resp)
+	}
+	if name := events[0].(map[string]interface{})["sv"].(map[string]interface{})["n"]; name != "tv" {
+		t.Fatalf("Expected the tv event, got %v", events[0])
+	}
+}
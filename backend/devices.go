@@ -0,0 +1,368 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DeviceGroup is one bucket of a grouped /api/devices response.
+type DeviceGroup struct {
+	Key     string           `json:"key"`
+	Devices []*DeviceSummary `json:"devices"`
+}
+
+// DeviceSummary is a device on /api/devices: its metadata together with the
+// addresses and services it is currently discovered with, so clients don't
+// have to group the flat service list themselves.
+type DeviceSummary struct {
+	*DeviceMetadata
+	Addresses []string      `json:"addresses"`
+	Services  []MDNSService `json:"services"`
+	// LastSeen is the latest refresh of any of its services
+	LastSeen int64 `json:"lastSeen,omitempty"`
+	// SNMP is what the device's SNMP agent reported, if it has one
+	SNMP *SNMPInfo `json:"snmp,omitempty"`
+	// MAC is the device's MAC address from the ARP table, and SwitchPort
+	// the switch port it hangs off (local devices only)
+	MAC        string      `json:"mac,omitempty"`
+	SwitchPort *SwitchPort `json:"switchPort,omitempty"`
+	// Traffic is what the device sent and received over the last 24
+	// hours, with -capture
+	Traffic *DeviceTraffic `json:"traffic,omitempty"`
+	// Blocklists are the blocklists the device's flows hit
+	Blocklists []string `json:"blocklists,omitempty"`
+	// Category is what kind of device its services suggest, a key of the
+	// message catalog's categories
+	Category string `json:"category"`
+	// Vendor is the manufacturer of its MAC address, with -oui, or
+	// "random" for a randomized address
+	Vendor string `json:"vendor,omitempty"`
+	// StableID identifies the device across address and host name
+	// changes, see StableIDs
+	StableID string `json:"stableId,omitempty"`
+	// Self is set on this host, the device of the Self services
+	Self bool `json:"self,omitempty"`
+	// Freshness is the best freshness of its services, 0 without any
+	Freshness float64 `json:"freshness"`
+}
+
+// serviceCategories are the device categories service types suggest, in
+// order of precedence: a printer with a web interface is a printer.
+var serviceCategories = []struct {
+	category string
+	types    []string
+}{
+	{"printer", []string{"_ipp._tcp", "_ipps._tcp", "_printer._tcp", "_pdl-datastream._tcp"}},
+	{"media", []string{"_airplay._tcp", "_raop._tcp", "_googlecast._tcp", "_spotify-connect._tcp"}},
+	{"storage", []string{"_adisk._tcp", "_afpovertcp._tcp", "_nfs._tcp", "_smb._tcp"}},
+	{"smart-home", []string{"_hap._tcp"}},
+	{"phone", []string{"_apple-mobdev2._tcp"}},
+	{"computer", []string{"_ssh._tcp", "_sftp._tcp", "_workstation._tcp", "_rfb._tcp", "_companion-link._tcp"}},
+}
+
+// deviceCategory returns the category of a device: that of its most telling
+// service type, network equipment for an SNMP agent, and otherwise other.
+func deviceCategory(summary *DeviceSummary) string {
+	types := make(map[string]bool, len(summary.Services))
+	for _, service := range summary.Services {
+		types[strings.TrimSuffix(service.Type, ".local.")] = true
+	}
+	for _, c := range serviceCategories {
+		for _, t := range c.types {
+			if types[t] {
+				return c.category
+			}
+		}
+	}
+	if summary.SNMP != nil {
+		return "network"
+	}
+	return "other"
+}
+
+// deviceID returns the ID a service's device is known by: its mDNS hostname,
+// or its IP address when no hostname is known, unless the device was merged
+// into or split off another, see DeviceLinks.
+func deviceID(service *MDNSService) string {
+	id := service.IP
+	if host := strings.TrimSuffix(service.Host, "."); host != "" {
+		id = host
+	}
+	return deviceLinks.resolve(service.Site, id, service.IP)
+}
+
+// listDevices returns every device of a site that has either been
+// discovered or has stored metadata, filtered by the same semantics as
+// MetadataStore.List.
+func (s *MDNSServer) listDevices(site, query string) []*DeviceMetadata {
+	devices := make(map[string]*DeviceMetadata)
+	for _, d := range s.metadata.List(site, "") {
+		devices[siteKey(d.Site, d.ID)] = d
+	}
+
+	for _, service := range s.table.view() {
+		if !inSite(service, site) {
+			continue
+		}
+		id := deviceID(service)
+		if _, ok := devices[siteKey(service.Site, id)]; !ok {
+			devices[siteKey(service.Site, id)] = &DeviceMetadata{ID: id, Site: service.Site}
+		}
+	}
+
+	query = strings.ToLower(query)
+	result := make([]*DeviceMetadata, 0, len(devices))
+	for _, d := range devices {
+		if query == "" || d.matches(query) {
+			result = append(result, d)
+		}
+	}
+	sortDevices(result)
+	return result
+}
+
+// summarizeDevices nests the current services of site (every site when
+// empty) under the devices they belong to.
+func (s *MDNSServer) summarizeDevices(devices []*DeviceMetadata, site string) []*DeviceSummary {
+	summaries := make([]*DeviceSummary, len(devices))
+	index := make(map[string]*DeviceSummary, len(devices))
+	for i, d := range devices {
+		summaries[i] = &DeviceSummary{DeviceMetadata: d, Addresses: []string{}, Services: []MDNSService{}, SNMP: s.snmp.Get(d.Site, d.ID)}
+		if d.Site == s.site {
+			summaries[i].Traffic = s.traffic.Totals(d.ID)
+			summaries[i].Blocklists = s.blocklists.Flagged(d.ID)
+		}
+		index[siteKey(d.Site, d.ID)] = summaries[i]
+	}
+
+	now := time.Now()
+	for _, service := range s.listServices(site) {
+		summary, ok := index[siteKey(service.Site, deviceID(&service))]
+		if !ok {
+			continue
+		}
+		summary.Services = append(summary.Services, service)
+		for _, ip := range []string{service.IP, service.IP6} {
+			if ip != "" && !slices.Contains(summary.Addresses, ip) {
+				summary.Addresses = append(summary.Addresses, ip)
+			}
+		}
+		summary.LastSeen = max(summary.LastSeen, service.LastRefreshed)
+		summary.Self = summary.Self || service.Self
+		summary.Freshness = max(summary.Freshness, s.freshness(&service, now))
+	}
+	for _, summary := range summaries {
+		sort.Strings(summary.Addresses)
+		summary.Category = deviceCategory(summary)
+	}
+	s.locateDevices(summaries)
+	for _, summary := range summaries {
+		summary.Vendor = s.vendors.Lookup(summary.MAC)
+		summary.StableID = s.stableIDs.Assign(summary.Site, summary.ID, summary.MAC)
+	}
+	return summaries
+}
+
+// filteredDevices returns the devices of site matching the ?q= search and
+// the ?filter= expression of a request.
+func (s *MDNSServer) filteredDevices(r *http.Request, site string) ([]*DeviceSummary, error) {
+	filter, err := filterParam(r)
+	if err != nil {
+		return nil, err
+	}
+	devices := s.summarizeDevices(s.listDevices(site, r.URL.Query().Get("q")), site)
+	if filter == nil {
+		return devices, nil
+	}
+	matching := devices[:0]
+	for _, device := range devices {
+		if filter.Match(deviceFields(device)) {
+			matching = append(matching, device)
+		}
+	}
+	return matching, nil
+}
+
+// sortDevices orders devices by site, then ID.
+func sortDevices(devices []*DeviceMetadata) {
+	sort.Slice(devices, func(i, j int) bool {
+		if devices[i].Site != devices[j].Site {
+			return devices[i].Site < devices[j].Site
+		}
+		return devices[i].ID < devices[j].ID
+	})
+}
+
+// groupDevices buckets devices by owner or location. Devices without a value
+// for the attribute end up in the group with an empty key.
+func groupDevices(devices []*DeviceSummary, by string) []DeviceGroup {
+	index := make(map[string]int)
+	var groups []DeviceGroup
+	for _, d := range devices {
+		key := d.Location
+		if by == "owner" {
+			key = d.Owner
+		}
+		i, ok := index[key]
+		if !ok {
+			i = len(groups)
+			index[key] = i
+			groups = append(groups, DeviceGroup{Key: key})
+		}
+		groups[i].Devices = append(groups[i].Devices, d)
+	}
+	sort.Slice(groups, func(i, j int) bool { return groups[i].Key < groups[j].Key })
+	return groups
+}
+
+// Devices handles GET /api/devices, listing discovered and annotated devices
+// of the site selected by ?site= with their current services. The optional
+// ?q= parameter searches device IDs, owner, location and notes, and
+// ?groupBy=location|owner aggregates the result into groups, and ?compact=1
+// abbreviates it like the stream. seq is the sequence number of the latest
+// event the devices reflect.
+func (s *MDNSServer) Devices(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	site := s.siteParam(r)
+	// The devices are listed as of the seq of the latest event, so that
+	// clients can take it from there on the stream
+	s.order.Lock()
+	seq := s.bus.Latest()
+	devices, err := s.filteredDevices(r, site)
+	s.order.Unlock()
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	switch groupBy := r.URL.Query().Get("groupBy"); groupBy {
+	case "":
+		// Streamed, as a large inventory would be a large response
+		writeJSONList(w, r, "devices", len(devices), func(i int) interface{} { return devices[i] }, map[string]interface{}{"seq": seq})
+	case "location", "owner":
+		writeJSONFor(w, r, http.StatusOK, map[string]interface{}{
+			"groupBy": groupBy,
+			"groups":  groupDevices(devices, groupBy),
+			"seq":     seq,
+		})
+	default:
+		writeError(w, http.StatusBadRequest, "groupBy must be location or owner")
+	}
+}
+
+// devicePatch is a partial update of a device's metadata: only the fields
+// present are changed.
+type devicePatch struct {
+	Owner    *string            `json:"owner"`
+	Location *string            `json:"location"`
+	Notes    *map[string]string `json:"notes"`
+	Tags     *[]string          `json:"tags"`
+	// Revision is the revision the edit is based on, like If-Match
+	Revision *int64 `json:"revision"`
+}
+
+// revisionETag is the entity tag of a revision of device metadata.
+func revisionETag(revision int64) string {
+	return `"` + strconv.FormatInt(revision, 10) + `"`
+}
+
+// parseRevisionETag parses an If-Match header holding a revisionETag.
+func parseRevisionETag(header string) (int64, error) {
+	tag := strings.TrimPrefix(strings.TrimSpace(header), "W/")
+	revision, err := strconv.ParseInt(strings.Trim(tag, `"`), 10, 64)
+	if err != nil || revision < 0 || len(tag) < 2 || tag[0] != '"' || tag[len(tag)-1] != '"' {
+		return 0, fmt.Errorf("invalid If-Match %q (expected a revision like \"3\")", header)
+	}
+	return revision, nil
+}
+
+func (p devicePatch) apply(d *DeviceMetadata) {
+	if p.Owner != nil {
+		d.Owner = *p.Owner
+	}
+	if p.Location != nil {
+		d.Location = *p.Location
+	}
+	if p.Notes != nil {
+		d.Notes = *p.Notes
+	}
+	if p.Tags != nil {
+		d.Tags = nil
+		d.tag(*p.Tags, nil)
+	}
+}
+
+// Device handles GET, PUT and DELETE /api/devices/{id} for a device of the
+// site selected by ?site=. A PUT only changes the fields present in the
+// request body; a DELETE forgets the device entirely, so it shows up as new
+// when it is discovered again.
+func (s *MDNSServer) Device(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	site := s.deviceSite(r)
+
+	switch r.Method {
+	case http.MethodGet:
+		meta := s.metadata.Get(site, id)
+		if meta == nil {
+			meta = &DeviceMetadata{ID: id, Site: site}
+		}
+		w.Header().Set("ETag", revisionETag(meta.Revision))
+		writeJSON(w, http.StatusOK, meta)
+
+	case http.MethodPut:
+		var req devicePatch
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		revision := int64(-1)
+		if req.Revision != nil {
+			revision = *req.Revision
+		}
+		if match := r.Header.Get("If-Match"); match != "" && match != "*" {
+			var err error
+			if revision, err = parseRevisionETag(match); err != nil {
+				writeError(w, http.StatusBadRequest, err.Error())
+				return
+			}
+		}
+
+		meta, err := s.metadata.UpdateRevision(site, id, revision, req.apply)
+		if errors.Is(err, errRevisionConflict) {
+			w.Header().Set("ETag", revisionETag(meta.Revision))
+			writeJSON(w, http.StatusConflict, map[string]interface{}{"error": err.Error(), "device": meta})
+			return
+		}
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		w.Header().Set("ETag", revisionETag(meta.Revision))
+		writeJSON(w, http.StatusOK, meta)
+
+	case http.MethodDelete:
+		n, err := s.forgetDevice(site, id)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]interface{}{
+			"status":  "ok",
+			"removed": n,
+		})
+
+	default:
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+	}
+}
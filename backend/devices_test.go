@@ -0,0 +1,162 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// TestGroupDevices verifies devices are bucketed by location and owner
+func TestGroupDevices(t *testing.T) {
+	devices := []*DeviceSummary{
+		{DeviceMetadata: &DeviceMetadata{ID: "tv.local", Owner: "alex", Location: "living room"}},
+		{DeviceMetadata: &DeviceMetadata{ID: "camera.local", Location: "garage"}},
+		{DeviceMetadata: &DeviceMetadata{ID: "laptop.local", Owner: "alex"}},
+	}
+
+	groups := groupDevices(devices, "location")
+	if len(groups) != 3 {
+		t.Fatalf("Expected 3 location groups, got %d", len(groups))
+	}
+	if groups[0].Key != "" || groups[0].Devices[0].ID != "laptop.local" {
+		t.Fatalf("Expected unassigned group first with laptop.local, got %+v", groups[0])
+	}
+
+	groups = groupDevices(devices, "owner")
+	if len(groups) != 2 {
+		t.Fatalf("Expected 2 owner groups, got %d", len(groups))
+	}
+	if groups[1].Key != "alex" || len(groups[1].Devices) != 2 {
+		t.Fatalf("Expected alex to own 2 devices, got %+v", groups[1])
+	}
+}
+
+// TestDeviceID verifies hostnames are preferred over IPs
+func TestDeviceID(t *testing.T) {
+	if id := deviceID(&MDNSService{Host: "nas.local.", IP: "10.0.0.2"}); id != "nas.local" {
+		t.Fatalf("Expected nas.local, got %q", id)
+	}
+	if id := deviceID(&MDNSService{IP: "10.0.0.2"}); id != "10.0.0.2" {
+		t.Fatalf("Expected IP fallback, got %q", id)
+	}
+}
+
+// TestListDevicesBySite verifies devices from different sites never mix
+func TestListDevicesBySite(t *testing.T) {
+	server := NewMDNSServer()
+	server.metadata, _ = NewMetadataStore(openTestStore(t, "json", t.TempDir()))
+
+	server.addService("10.0.0.2:_smb._tcp.local.:445", &MDNSService{Host: "nas.local", IP: "10.0.0.2", Type: "_smb._tcp.local.", Port: 445})
+	server.addService("10.0.0.2:_smb._tcp.local.:445", &MDNSService{Host: "nas.local", IP: "10.0.0.2", Type: "_smb._tcp.local.", Port: 445, Site: "office"})
+
+	if got := server.listDevices(defaultSite, ""); len(got) != 1 || got[0].Site != defaultSite {
+		t.Fatalf("Expected one local device, got %+v", got)
+	}
+	if got := server.listDevices("office", ""); len(got) != 1 || got[0].Site != "office" {
+		t.Fatalf("Expected one office device, got %+v", got)
+	}
+	if got := server.listDevices("", ""); len(got) != 2 {
+		t.Fatalf("Expected the same hostname on both sites to be two devices, got %d", len(got))
+	}
+}
+
+// TestSummarizeDevices verifies services are nested under their device with
+// its addresses
+func TestSummarizeDevices(t *testing.T) {
+	server := NewMDNSServer()
+	server.metadata, _ = NewMetadataStore(openTestStore(t, "json", t.TempDir()))
+	server.addService("a", &MDNSService{Name: "NAS", Type: "_smb._tcp.local.", Host: "nas.local", IP: "192.168.1.10", Port: 445})
+	server.addService("b", &MDNSService{Name: "NAS", Type: "_http._tcp.local.", Host: "nas.local", IP: "192.168.1.10", Port: 80})
+	server.addService("c", &MDNSService{Name: "Printer", Type: "_ipp._tcp.local.", IP: "192.168.1.30", Port: 631})
+
+	summaries := server.summarizeDevices(server.listDevices(defaultSite, ""), defaultSite)
+	if len(summaries) != 2 {
+		t.Fatalf("Expected 2 devices, got %d", len(summaries))
+	}
+	nas := summaries[1]
+	if nas.ID != "nas.local" || len(nas.Services) != 2 || len(nas.Addresses) != 1 || nas.Addresses[0] != "192.168.1.10" {
+		t.Fatalf("Expected nas.local with 2 services on one address, got %+v", nas)
+	}
+	if printer := summaries[0]; printer.ID != "192.168.1.30" || len(printer.Services) != 1 || printer.LastSeen == 0 {
+		t.Fatalf("Expected the printer by IP with 1 service, got %+v", printer)
+	}
+}
+
+// TestDeviceCategory verifies devices are categorized by their most telling
+// service
+func TestDeviceCategory(t *testing.T) {
+	services := func(types ...string) *DeviceSummary {
+		summary := &DeviceSummary{}
+		for _, serviceType := range types {
+			summary.Services = append(summary.Services, MDNSService{Type: serviceType + ".local."})
+		}
+		return summary
+	}
+	for _, tc := range []struct {
+		summary  *DeviceSummary
+		category string
+	}{
+		{services("_http._tcp", "_ipp._tcp"), "printer"},
+		{services("_smb._tcp", "_ssh._tcp"), "storage"},
+		{services("_ssh._tcp"), "computer"},
+		{services("_http._tcp"), "other"},
+		{&DeviceSummary{SNMP: &SNMPInfo{}}, "network"},
+	} {
+		if got := deviceCategory(tc.summary); got != tc.category {
+			t.Fatalf("Expected %q, got %q", tc.category, got)
+		}
+	}
+}
+
+// TestDeviceRevisions verifies edits based on an outdated revision are
+// rejected with 409 instead of overwriting the newer one
+func TestDeviceRevisions(t *testing.T) {
+	server := NewMDNSServer()
+	server.metadata, _ = NewMetadataStore(openTestStore(t, "json", t.TempDir()))
+	put := func(body, ifMatch string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPut, "/api/devices/nas.local", strings.NewReader(body))
+		req.SetPathValue("id", "nas.local")
+		if ifMatch != "" {
+			req.Header.Set("If-Match", ifMatch)
+		}
+		w := httptest.NewRecorder()
+		server.Device(w, req)
+		return w
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/api/devices/nas.local", nil)
+	req.SetPathValue("id", "nas.local")
+	w := httptest.NewRecorder()
+	server.Device(w, req)
+	if etag := w.Header().Get("ETag"); etag != `"0"` {
+		t.Fatalf("Expected revision 0 for a device without metadata, got %s", etag)
+	}
+
+	if w := put(`{"owner":"alex"}`, `"0"`); w.Code != http.StatusOK || w.Header().Get("ETag") != `"1"` {
+		t.Fatalf("Expected the first edit to succeed with revision 1, got %d %s", w.Code, w.Header().Get("ETag"))
+	}
+	w = put(`{"location":"office"}`, `"0"`)
+	var conflict struct {
+		Device DeviceMetadata `json:"device"`
+	}
+	if json.Unmarshal(w.Body.Bytes(), &conflict); w.Code != http.StatusConflict || conflict.Device.Owner != "alex" || conflict.Device.Revision != 1 {
+		t.Fatalf("Expected 409 with the current metadata, got %d %s", w.Code, w.Body.String())
+	}
+	if meta := server.metadata.Get(defaultSite, "nas.local"); meta.Location != "" {
+		t.Fatalf("Expected the conflicting edit not to be applied, got %+v", meta)
+	}
+	if w := put(`{"location":"office","revision":0}`, ""); w.Code != http.StatusConflict {
+		t.Fatalf("Expected 409 for an outdated revision in the body, got %d", w.Code)
+	}
+	if w := put(`{"location":"office"}`, `W/"1"`); w.Code != http.StatusOK {
+		t.Fatalf("Expected an edit of the current revision to succeed, got %d", w.Code)
+	}
+	if w := put(`{"location":"garage"}`, ""); w.Code != http.StatusOK || server.metadata.Get(defaultSite, "nas.local").Revision != 3 {
+		t.Fatalf("Expected an edit without a revision to always succeed, got %d", w.Code)
+	}
+	if w := put(`{}`, "3"); w.Code != http.StatusBadRequest {
+		t.Fatalf("Expected 400 for an unquoted If-Match, got %d", w.Code)
+	}
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+)
+
+// RuleTestRequest is a dry run on /api/rules/test: a candidate notifier,
+// or an existing one by ID, tried on the notifications of the last Since
+// or on Sample.
+type RuleTestRequest struct {
+	Notifier *Notifier   `json:"notifier,omitempty"`
+	ID       string      `json:"id,omitempty"`
+	Since    string      `json:"since,omitempty"` // e.g. "1h" or "7d", default all that is kept
+	Sample   []RuleEvent `json:"sample,omitempty"`
+}
+
+// RuleEvent is a notification in a dry run's sample, with the service
+// that arrived or left for filters and payload templates.
+type RuleEvent struct {
+	Notification
+	Service *MDNSService `json:"service,omitempty"`
+}
+
+// RuleFiring is a notification a notifier would have sent, or for a
+// digest notifier the digest of everything it would have collected.
+type RuleFiring struct {
+	Notification *Notification `json:"notification,omitempty"`
+	ContentType  string        `json:"contentType"`
+	Payload      string        `json:"payload"`
+}
+
+// RuleTestResult tells what a dry run would have sent.
+type RuleTestResult struct {
+	Evaluated int          `json:"evaluated"`
+	Matched   int          `json:"matched"`
+	Fired     []RuleFiring `json:"fired"`
+}
+
+// Recent returns the notifications kept for dry runs, oldest first, from
+// since on.
+func (n *Notifiers) Recent(since time.Time) []Notification {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	var recent []Notification
+	for _, notification := range n.recent {
+		if notification.Time >= since.Unix() {
+			recent = append(recent, notification)
+		}
+	}
+	return recent
+}
+
+// Test runs notifications through a notifier without delivering anything,
+// and returns what it would have sent: a payload per notification it
+// wants in event mode, and a single digest of them in digest mode.
+func (n *Notifiers) Test(notifier Notifier, notifications []Notification, now time.Time) (RuleTestResult, error) {
+	// validate sets up the payload and digest settings, which an existing
+	// notifier shares with its live deliveries
+	if notifier.Payload != nil {
+		payload := *notifier.Payload
+		notifier.Payload = &payload
+	}
+	if notifier.Digest != nil {
+		digest := *notifier.Digest
+		notifier.Digest = &digest
+	}
+	if err := notifier.validate(); err != nil {
+		return RuleTestResult{}, err
+	}
+	result := RuleTestResult{Evaluated: len(notifications), Fired: []RuleFiring{}}
+	var wanted []Notification
+	for _, notification := range notifications {
+		if notifier.wants(notification, n.server.notificationFields(notification)) {
+			wanted = append(wanted, notification)
+		}
+	}
+	result.Matched = len(wanted)
+
+	if notifier.Mode == notifyDigest {
+		if len(wanted) == 0 {
+			return result, nil
+		}
+		since := time.Unix(wanted[0].Time, 0)
+		digest := newDigest(&notifier, &notifierState{pending: wanted, since: since}, now)
+		contentType, body, err := digest.render(notifier.Digest.Format)
+		if notifier.Payload != nil {
+			contentType = notifier.Payload.ContentType
+			body, err = notifier.Payload.execute(notifier.payloadData(Notification{}, &digest))
+		}
+		if err != nil {
+			return RuleTestResult{}, err
+		}
+		result.Fired = append(result.Fired, RuleFiring{ContentType: contentType, Payload: string(body)})
+		return result, nil
+	}
+
+	for i := range wanted {
+		contentType := "application/json"
+		var body []byte
+		var err error
+		if notifier.Payload != nil {
+			contentType = notifier.Payload.ContentType
+			body, err = notifier.Payload.execute(notifier.payloadData(wanted[i], nil))
+		} else {
+			body, err = json.Marshal(wanted[i])
+		}
+		if err != nil {
+			return RuleTestResult{}, err
+		}
+		result.Fired = append(result.Fired, RuleFiring{Notification: &wanted[i], ContentType: contentType, Payload: string(body)})
+	}
+	return result, nil
+}
+
+// RulesTest handles POST /api/rules/test: a dry run of a candidate
+// notifier, or an existing one, on the recent notifications or a supplied
+// sample, reporting what it would have sent without sending anything.
+func (s *MDNSServer) RulesTest(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	var req RuleTestRequest
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20)).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid JSON body")
+		return
+	}
+
+	var notifier Notifier
+	switch {
+	case req.Notifier != nil && req.ID == "":
+		notifier = *req.Notifier
+	case req.Notifier == nil && req.ID != "":
+		status := s.notifiers.Get(req.ID)
+		if status == nil {
+			writeError(w, http.StatusNotFound, "no notifier "+req.ID)
+			return
+		}
+		notifier = status.Notifier
+	default:
+		writeError(w, http.StatusBadRequest, "give either a notifier or the id of one")
+		return
+	}
+
+	now := time.Now()
+	var notifications []Notification
+	if req.Sample != nil {
+		if req.Since != "" {
+			writeError(w, http.StatusBadRequest, "since doesn't apply to a sample")
+			return
+		}
+		for _, event := range req.Sample {
+			notification := event.Notification
+			notification.service = event.Service
+			if notification.Time == 0 {
+				notification.Time = now.Unix()
+			}
+			if notification.Kind == "" || !containsString(notificationKinds, notification.Kind) {
+				writeError(w, http.StatusBadRequest, "sample events need a kind: new-device, departure or finding")
+				return
+			}
+			notifications = append(notifications, notification)
+		}
+	} else {
+		since := time.Time{}
+		if req.Since != "" {
+			d, err := parseDays(req.Since)
+			if err != nil || d <= 0 {
+				writeError(w, http.StatusBadRequest, "invalid since "+req.Since)
+				return
+			}
+			since = now.Add(-d)
+		}
+		notifications = s.notifiers.Recent(since)
+	}
+
+	result, err := s.notifiers.Test(notifier, notifications, now)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, result)
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func postRulesTest(server *MDNSServer, body string) *httptest.ResponseRecorder {
+	rec := httptest.NewRecorder()
+	server.RulesTest(rec, httptest.NewRequest(http.MethodPost, "/api/rules/test", strings.NewReader(body)))
+	return rec
+}
+
+// TestRulesTestReplay verifies a candidate notifier is tried on the recent
+// notifications without anything being delivered
+func TestRulesTestReplay(t *testing.T) {
+	server := newNotifyServer(t)
+	receiver := newWebhookReceiver(t)
+	existing, _ := server.notifiers.Add(Notifier{URL: receiver.URL, Events: []string{notifyFinding}})
+	server.addService("smb", &MDNSService{Name: "NAS", Type: "_smb._tcp.local.", Host: "nas.local.", IP: "192.168.1.20", Port: 445, Site: defaultSite})
+	server.addService("ipp", &MDNSService{Name: "Printer", Type: "_ipp._tcp.local.", Host: "printer.local.", IP: "192.168.1.30", Port: 631, Site: defaultSite})
+	server.notifiers.deliveries.Wait()
+
+	rec := postRulesTest(server, `{"notifier": {"url": "https://hooks.example.com/nv", "filter": "type=_ipp._tcp", "payload": {"template": "{{.Device}}", "contentType": "text/plain"}}, "since": "1h"}`)
+	var result RuleTestResult
+	if err := json.Unmarshal(rec.Body.Bytes(), &result); err != nil || rec.Code != http.StatusOK {
+		t.Fatalf("Expected a dry run, got %d %s", rec.Code, rec.Body.String())
+	}
+	if result.Evaluated != 2 || result.Matched != 1 || len(result.Fired) != 1 || result.Fired[0].Payload != "printer.local" || result.Fired[0].Notification.Kind != notifyNewDevice {
+		t.Fatalf("Expected the printer's arrival to fire, got %+v", result)
+	}
+
+	rec = postRulesTest(server, `{"id": "`+existing.ID+`"}`)
+	json.Unmarshal(rec.Body.Bytes(), &result)
+	if result.Evaluated != 2 || result.Matched != 0 {
+		t.Fatalf("Expected the findings notifier not to fire on arrivals, got %+v", result)
+	}
+	if _, bodies := receiver.received(); len(bodies) != 0 {
+		t.Fatalf("Expected a dry run to deliver nothing, got %v", bodies)
+	}
+}
+
+// TestRulesTestWhileDelivering verifies dry runs of an existing notifier
+// leave the template its live deliveries run alone, under -race
+func TestRulesTestWhileDelivering(t *testing.T) {
+	server := newNotifyServer(t)
+	receiver := newWebhookReceiver(t)
+	existing, _ := server.notifiers.Add(Notifier{URL: receiver.URL, Payload: &PayloadTemplate{Template: `{"device": {{json .Device}}}`}})
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 20; i++ {
+			server.addService(fmt.Sprint("smb", i), &MDNSService{Name: "NAS", Type: "_smb._tcp.local.", Host: fmt.Sprintf("nas%d.local.", i), IP: "192.168.1.20", Port: 445, Site: defaultSite})
+		}
+	}()
+	for running := true; running; {
+		select {
+		case <-done:
+			running = false
+		default:
+		}
+		if rec := postRulesTest(server, `{"id": "`+existing.ID+`"}`); rec.Code != http.StatusOK {
+			t.Fatalf("Expected a dry run, got %d %s", rec.Code, rec.Body.String())
+		}
+	}
+	server.notifiers.deliveries.Wait()
+}
+
+// TestRulesTestSample verifies dry runs on a supplied sample, including
+// digest notifiers, and that invalid requests are rejected
+func TestRulesTestSample(t *testing.T) {
+	server := newNotifyServer(t)
+	rec := postRulesTest(server, `{"notifier": {"url": "https://hooks.example.com/nv", "digest": {"interval": "1d", "format": "json"}, "filter": "owner=ops OR subnet=10.0.0.0/8"},
+		"sample": [{"kind": "new-device", "device": "cam.local", "message": "New device cam.local", "service": {"name": "Cam", "type": "_rtsp._tcp.local.", "host": "cam.local.", "ip": "10.1.2.3", "port": 554}},
+		           {"kind": "finding", "device": "tv.local", "message": "conflict"}]}`)
+	var result RuleTestResult
+	if err := json.Unmarshal(rec.Body.Bytes(), &result); err != nil || rec.Code != http.StatusOK {
+		t.Fatalf("Expected a dry run, got %d %s", rec.Code, rec.Body.String())
+	}
+	if result.Evaluated != 2 || result.Matched != 1 || len(result.Fired) != 1 || !strings.Contains(result.Fired[0].Payload, "cam.local") || result.Fired[0].Notification != nil {
+		t.Fatalf("Expected one digest with the camera, got %+v", result)
+	}
+
+	for body, code := range map[string]int{
+		`{}`:                               http.StatusBadRequest,
+		`{"id": "nope"}`:                   http.StatusNotFound,
+		`{"notifier": {"url": "ftp://x"}}`: http.StatusBadRequest,
+		`{"notifier": {"url": "https://x"}, "sample": [{"kind": "other"}]}`: http.StatusBadRequest,
+		`{"notifier": {"url": "https://x"}, "since": "soon"}`:               http.StatusBadRequest,
+	} {
+		if rec := postRulesTest(server, body); rec.Code != code {
+			t.Fatalf("Expected %d for %s, got %d", code, body, rec.Code)
+		}
+	}
+}
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hkdf"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// errDecrypt means a record could not be decrypted.
+var errDecrypt = errors.New("cannot decrypt a stored record (wrong -encryption-key, or a store that isn't encrypted?)")
+
+// encryptedStore encrypts a Store at rest. Each record is sealed with
+// AES-256-GCM together with its key, and stored under an HMAC of the key,
+// so neither device IDs, MAC addresses nor notes are readable on disk.
+// Bucket names, which only name subsystems, are left as they are.
+type encryptedStore struct {
+	inner  Store
+	aead   cipher.AEAD
+	keyMAC []byte
+}
+
+// newEncryptedStore wraps inner with the 32-byte key.
+func newEncryptedStore(inner Store, key []byte) (*encryptedStore, error) {
+	if len(key) != 32 {
+		return nil, fmt.Errorf("encryption key must be 32 bytes, got %d", len(key))
+	}
+	sealKey, err := hkdf.Key(sha256.New, key, nil, "network-view records", 32)
+	if err != nil {
+		return nil, err
+	}
+	keyMAC, err := hkdf.Key(sha256.New, key, nil, "network-view keys", 32)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(sealKey)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &encryptedStore{inner: inner, aead: aead, keyMAC: keyMAC}, nil
+}
+
+// rawStore returns the store beneath an encryption layer, or store itself.
+func rawStore(store Store) Store {
+	if e, ok := store.(*encryptedStore); ok {
+		return e.inner
+	}
+	return store
+}
+
+// sealedRecord is what an encrypted record holds once opened.
+type sealedRecord struct {
+	Key   string          `json:"k"`
+	Value json.RawMessage `json:"v"`
+}
+
+func (s *encryptedStore) storedKey(bucket, key string) string {
+	mac := hmac.New(sha256.New, s.keyMAC)
+	mac.Write([]byte(bucket + "\x00" + key))
+	return hex.EncodeToString(mac.Sum(nil)[:16])
+}
+
+func (s *encryptedStore) Load(bucket string) (map[string][]byte, error) {
+	entries, err := s.inner.Load(bucket)
+	if err != nil {
+		return nil, err
+	}
+	return s.open(bucket, entries)
+}
+
+// open decrypts the records of a bucket as they are stored.
+func (s *encryptedStore) open(bucket string, entries map[string][]byte) (map[string][]byte, error) {
+	records := make(map[string][]byte, len(entries))
+	for stored, data := range entries {
+		// Values are stored as JSON strings holding base64
+		var sealed []byte
+		if err := json.Unmarshal(data, &sealed); err != nil || len(sealed) < s.aead.NonceSize() {
+			return nil, errDecrypt
+		}
+		nonce, ciphertext := sealed[:s.aead.NonceSize()], sealed[s.aead.NonceSize():]
+		plaintext, err := s.aead.Open(nil, nonce, ciphertext, []byte(bucket+"\x00"+stored))
+		if err != nil {
+			return nil, errDecrypt
+		}
+		var record sealedRecord
+		if err := json.Unmarshal(plaintext, &record); err != nil {
+			return nil, errDecrypt
+		}
+		records[record.Key] = record.Value
+	}
+	return records, nil
+}
+
+func (s *encryptedStore) Put(bucket string, entries map[string][]byte) error {
+	sealed := make(map[string][]byte, len(entries))
+	for key, value := range entries {
+		plaintext, err := json.Marshal(sealedRecord{Key: key, Value: value})
+		if err != nil {
+			return err
+		}
+		stored := s.storedKey(bucket, key)
+		nonce := make([]byte, s.aead.NonceSize())
+		if _, err := rand.Read(nonce); err != nil {
+			return err
+		}
+		data, err := json.Marshal(s.aead.Seal(nonce, nonce, plaintext, []byte(bucket+"\x00"+stored)))
+		if err != nil {
+			return err
+		}
+		sealed[stored] = data
+	}
+	return s.inner.Put(bucket, sealed)
+}
+
+func (s *encryptedStore) Delete(bucket string, keys ...string) error {
+	stored := make([]string, len(keys))
+	for i, key := range keys {
+		stored[i] = s.storedKey(bucket, key)
+	}
+	return s.inner.Delete(bucket, stored...)
+}
+
+// migrationTarget returns the store to copy the records of src into when
+// migrating to dst. A plain src goes into dst, which encrypts it if it is
+// encrypted; a src already encrypted with dst's key goes into the store
+// beneath, so its records are copied as they are instead of encrypted
+// again. Whether src is encrypted is judged by its first bucket with
+// records.
+func migrationTarget(src, dst Store) (Store, error) {
+	e, ok := dst.(*encryptedStore)
+	if !ok {
+		return dst, nil
+	}
+	buckets, err := src.Buckets()
+	if err != nil {
+		return nil, err
+	}
+	for _, bucket := range buckets {
+		entries, err := src.Load(bucket)
+		if err != nil {
+			return nil, fmt.Errorf("load %s: %v", bucket, err)
+		}
+		if len(entries) == 0 {
+			continue
+		}
+		if _, err := e.open(bucket, entries); err == nil {
+			return e.inner, nil
+		}
+		return dst, nil
+	}
+	return dst, nil
+}
+
+func (s *encryptedStore) Buckets() ([]string, error) { return s.inner.Buckets() }
+func (s *encryptedStore) Size() int64                { return s.inner.Size() }
+func (s *encryptedStore) Close() error               { return s.inner.Close() }
+
+// loadEncryptionKey reads the key an -encryption-key names: env:NAME (an
+// environment variable), file:PATH, keychain:SERVICE (a generic password in
+// the macOS Keychain), or secret:NAME (one set with the secrets subcommand). The key is 32 bytes, as 64 hex digits or base64.
+func loadEncryptionKey(source string) ([]byte, error) {
+	kind, name, ok := strings.Cut(source, ":")
+	if !ok || name == "" {
+		return nil, fmt.Errorf("invalid key source %q (expected env:NAME, file:PATH, keychain:SERVICE or secret:NAME)", source)
+	}
+	var text string
+	switch kind {
+	case "env":
+		if text = os.Getenv(name); text == "" {
+			return nil, fmt.Errorf("$%s is not set", name)
+		}
+	case "file":
+		data, err := os.ReadFile(name)
+		if err != nil {
+			return nil, err
+		}
+		text = string(data)
+	case "keychain":
+		secret, err := readKeychain(name)
+		if err != nil {
+			return nil, err
+		}
+		text = secret
+	case "secret":
+		secret, err := lookupSecret(name)
+		if err != nil {
+			return nil, err
+		}
+		text = secret
+	default:
+		return nil, fmt.Errorf("unknown key source %q (expected env, file, keychain or secret)", kind)
+	}
+	return parseEncryptionKey(strings.TrimSpace(text))
+}
+
+// parseEncryptionKey decodes a 32-byte key from hex or base64, e.g. the
+// output of `openssl rand -hex 32`.
+func parseEncryptionKey(text string) ([]byte, error) {
+	if key, err := hex.DecodeString(text); err == nil && len(key) == 32 {
+		return key, nil
+	}
+	if key, err := base64.StdEncoding.DecodeString(text); err == nil && len(key) == 32 {
+		return key, nil
+	}
+	return nil, errors.New("encryption key must be 32 bytes as hex or base64 (e.g. from openssl rand -hex 32)")
+}
+
+// readKeychain returns the generic password stored for service in the
+// macOS Keychain, whatever its account.
+func readKeychain(service string) (string, error) {
+	secret, err := keychain.Get(service, "")
+	if errors.Is(err, errSecretNotSet) {
+		return "", fmt.Errorf("no Keychain item for %s", service)
+	}
+	return secret, err
+}
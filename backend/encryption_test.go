@@ -0,0 +1,137 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testEncryptionKey = "000102030405060708090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f"
+
+func openEncryptedTestStore(t *testing.T, dir, hexKey string) Store {
+	key, err := parseEncryptionKey(hexKey)
+	if err != nil {
+		t.Fatalf("Expected a valid key, got %v", err)
+	}
+	store, err := newEncryptedStore(openTestStore(t, "json", dir), key)
+	if err != nil {
+		t.Fatalf("Expected an encrypted store, got %v", err)
+	}
+	return store
+}
+
+// TestEncryptedStore verifies records and their keys are unreadable on disk
+// and only load with the right key
+func TestEncryptedStore(t *testing.T) {
+	dir := t.TempDir()
+	metadata, _ := NewMetadataStore(openEncryptedTestStore(t, dir, testEncryptionKey))
+	metadata.Update(defaultSite, "alex-iphone.local", func(d *DeviceMetadata) { d.Notes = map[string]string{"serial": "F2LXK9"} })
+	metadata.Update(defaultSite, "nas.local", func(d *DeviceMetadata) { d.Owner = "alex" })
+	metadata.Delete(defaultSite, "nas.local")
+
+	data, err := os.ReadFile(filepath.Join(dir, metadataBucket+".json"))
+	if err != nil {
+		t.Fatalf("Expected the bucket file, got %v", err)
+	}
+	for _, secret := range []string{"alex", "iphone", "F2LXK9", "serial"} {
+		if strings.Contains(string(data), secret) {
+			t.Fatalf("Expected %q not to be stored in the clear: %s", secret, data)
+		}
+	}
+
+	reloaded, err := NewMetadataStore(openEncryptedTestStore(t, dir, testEncryptionKey))
+	if err != nil || reloaded.Records() != 1 || reloaded.Get(defaultSite, "alex-iphone.local").Notes["serial"] != "F2LXK9" {
+		t.Fatalf("Expected the record to load with the key, got %v", err)
+	}
+	if _, err := NewMetadataStore(openEncryptedTestStore(t, dir, strings.Repeat("ff", 32))); err == nil {
+		t.Fatalf("Expected an error with the wrong key")
+	}
+	if _, err := NewMetadataStore(openTestStore(t, "json", dir)); err == nil {
+		t.Fatalf("Expected the encrypted records not to load in the clear")
+	}
+}
+
+// TestLoadEncryptionKey verifies keys are read from the environment and
+// files, in hex or base64
+func TestLoadEncryptionKey(t *testing.T) {
+	t.Setenv("NV_KEY", testEncryptionKey)
+	if key, err := loadEncryptionKey("env:NV_KEY"); err != nil || key[31] != 0x1f {
+		t.Fatalf("Expected the key from the environment, got %v", err)
+	}
+	file := filepath.Join(t.TempDir(), "key")
+	os.WriteFile(file, []byte("AAECAwQFBgcICQoLDA0ODxAREhMUFRYXGBkaGxwdHh8=\n"), 0o600)
+	if key, err := loadEncryptionKey("file:" + file); err != nil || key[31] != 0x1f {
+		t.Fatalf("Expected the base64 key from the file, got %v", err)
+	}
+	for _, invalid := range []string{"NV_KEY", "env:NV_MISSING", "vault:nv", "file:/nonexistent"} {
+		if _, err := loadEncryptionKey(invalid); err == nil {
+			t.Fatalf("Expected an error for %q", invalid)
+		}
+	}
+	if _, err := parseEncryptionKey("correct horse battery staple"); err == nil {
+		t.Fatalf("Expected a passphrase to be rejected")
+	}
+}
+
+// TestEncryptedBackups verifies backups of an encrypted store stay
+// encrypted, and that a plain backup can be restored into encryption
+func TestEncryptedBackups(t *testing.T) {
+	store := openEncryptedTestStore(t, t.TempDir(), testEncryptionKey)
+	metadata, _ := NewMetadataStore(store)
+	metadata.Update(defaultSite, "nas.local", func(d *DeviceMetadata) { d.Owner = "alex" })
+	snapshot, _ := takeSnapshot(store, defaultSite, time.Now())
+	data, _ := snapshot.encode()
+	if !snapshot.Encrypted || bytes.Contains(data, []byte("alex")) {
+		t.Fatalf("Expected an encrypted backup")
+	}
+
+	dir := t.TempDir()
+	plain := openTestStore(t, "json", dir)
+	if n, err := restoreSnapshot(plain, snapshot); err != nil || n != 1 {
+		t.Fatalf("Expected the encrypted records to be restored as they are, got %d %v", n, err)
+	}
+	if restored, err := NewMetadataStore(openEncryptedTestStore(t, dir, testEncryptionKey)); err != nil || restored.Get(defaultSite, "nas.local").Owner != "alex" {
+		t.Fatalf("Expected the restored store to open with the key, got %v", err)
+	}
+
+	plainMetadata, _ := NewMetadataStore(openTestStore(t, "json", t.TempDir()))
+	plainMetadata.Update(defaultSite, "tv.local", func(d *DeviceMetadata) { d.Location = "lounge" })
+	plainSnapshot, _ := takeSnapshot(plainMetadata.store, defaultSite, time.Now())
+	encrypted := openEncryptedTestStore(t, t.TempDir(), testEncryptionKey)
+	if _, err := restoreSnapshot(encrypted, plainSnapshot); err != nil {
+		t.Fatalf("Expected the plain backup to be restored, got %v", err)
+	}
+	if restored, _ := NewMetadataStore(encrypted); restored.Get(defaultSite, "tv.local").Location != "lounge" {
+		t.Fatalf("Expected the plain backup to be encrypted into the store")
+	}
+}
+
+// TestMigrateEncryptedStore verifies -migrate-from copies an encrypted store
+// as it is, and encrypts a plain one
+func TestMigrateEncryptedStore(t *testing.T) {
+	key, _ := parseEncryptionKey(testEncryptionKey)
+	for _, encrypted := range []bool{true, false} {
+		dir := t.TempDir()
+		src := openTestStore(t, "json", dir)
+		if encrypted {
+			src = openEncryptedTestStore(t, dir, testEncryptionKey)
+		}
+		metadata, _ := NewMetadataStore(src)
+		metadata.Update(defaultSite, "nas.local", func(d *DeviceMetadata) { d.Owner = "alex" })
+
+		dst, _ := newEncryptedStore(openTestStore(t, "bolt", dir), key)
+		target, err := migrationTarget(rawStore(src), dst)
+		if err == nil {
+			_, err = migrateStore(rawStore(src), target)
+		}
+		if err != nil {
+			t.Fatalf("Expected the migration to succeed, got %v", err)
+		}
+		if migrated, err := NewMetadataStore(dst); err != nil || migrated.Get(defaultSite, "nas.local").Owner != "alex" {
+			t.Fatalf("Expected the migrated records to open with the key (encrypted source %v), got %v", encrypted, err)
+		}
+	}
+}
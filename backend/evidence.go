@@ -0,0 +1,37 @@
+package main
+
+// Protocols a service's evidence can come from, reported as its Source.
+// Discovery is mDNS-only so far; the others name the sources being added
+// (SSDP, ARP, DHCP and BLE) so consumers can rely on the set.
+const (
+	evidenceMDNS = "mdns"
+	evidenceSSDP = "ssdp"
+	evidenceARP  = "arp"
+	evidenceDHCP = "dhcp"
+	evidenceBLE  = "ble"
+	// evidenceInjected marks services fabricated on /api/debug/inject, so
+	// they can't be mistaken for real ones downstream
+	evidenceInjected = "injected"
+)
+
+// pathConfidence is how much a service found along each discovery path is
+// worth, from 0 to 1. Answers to our own queries and browses come from the
+// advertiser itself. Unsolicited announcements may be replayed by a sleep
+// proxy for a host that is no longer awake, and their address was looked up
+// separately.
+var pathConfidence = map[string]float64{
+	sourceBrowse:    0.9,
+	sourceQuery:     0.9,
+	sourceMulticast: 0.8,
+}
+
+// setEvidence records where a service found along path came from, keeping
+// what the source already set.
+func (service *MDNSService) setEvidence(path string) {
+	if service.Source == "" {
+		service.Source = evidenceMDNS
+	}
+	if service.Confidence == 0 {
+		service.Confidence = pathConfidence[path]
+	}
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// TestServiceEvidence verifies published services carry their protocol, a
+// confidence for their discovery path and the record that revealed them,
+// and that a source's own evidence is kept.
+func TestServiceEvidence(t *testing.T) {
+	server := NewMDNSServer()
+	var events []*DiscoveryResponse
+	server.bus.Subscribe("test", func(e BusEvent) {
+		events = append(events, e.Payload.(*DiscoveryResponse))
+	}, TopicService)
+
+	announced := &MDNSService{Name: "Printer", Type: "_ipp._tcp.local.", IP: "192.168.1.30", Port: 631, RawRecordType: "SRV"}
+	server.publishService(sourceMulticast, server.identity(announced), announced, time.Now())
+	queried := &MDNSService{Name: "NAS", Type: "_smb._tcp.local.", IP: "192.168.1.40", Port: 445, RawRecordType: "PTR"}
+	server.publishService(sourceQuery, server.identity(queried), queried, time.Now())
+	reported := &MDNSService{Name: "TV", Type: "_airplay._tcp.local.", IP: "192.168.1.50", Port: 7000, Source: evidenceSSDP, Confidence: 0.5}
+	server.publishService(sourceQuery, server.identity(reported), reported, time.Now())
+
+	if len(events) != 3 {
+		t.Fatalf("Expected 3 events, got %d", len(events))
+	}
+	if s := events[0].Service; s.Source != evidenceMDNS || s.Confidence != 0.8 || s.RawRecordType != "SRV" {
+		t.Fatalf("Expected an unsolicited SRV from mdns at 0.8, got %q %v %q", s.Source, s.Confidence, s.RawRecordType)
+	}
+	if s := events[1].Service; s.Confidence <= events[0].Service.Confidence {
+		t.Fatalf("Expected a queried service to be worth more than an announced one, got %v", s.Confidence)
+	}
+	if s := events[2].Service; s.Source != evidenceSSDP || s.Confidence != 0.5 {
+		t.Fatalf("Expected the source's evidence to be kept, got %q %v", s.Source, s.Confidence)
+	}
+}
@@ -0,0 +1,422 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// expectationsBucket is the Store bucket expectations are kept in.
+const expectationsBucket = "expectations"
+
+// What an expectation checks.
+const (
+	expectAdvertise = "advertise" // the device advertises the service type
+	expectAnswer    = "answer"    // ... and accepts TCP connections on its port
+)
+
+// defaultExpectationGrace is how long an expectation fails before it is
+// reported, so a missed announcement or restart doesn't alert.
+const defaultExpectationGrace = 2 * time.Minute
+
+// expectationDialTimeout bounds the connection attempts of answer checks.
+const expectationDialTimeout = 3 * time.Second
+
+// Expectation states.
+const (
+	expectationPending = "pending" // not checked yet
+	expectationOK      = "ok"
+	expectationFailing = "failing" // failing for less than its grace period
+	expectationDown    = "down"    // failing and reported
+)
+
+// expectationDial connects to a service for answer checks; a variable so
+// tests can stand in for the network.
+var expectationDial = func(ctx context.Context, address string) error {
+	conn, err := (&net.Dialer{}).DialContext(ctx, "tcp", address)
+	if err != nil {
+		return err
+	}
+	return conn.Close()
+}
+
+// Expectation declares that a device must advertise a service type, e.g.
+// "nas.local must advertise _smb._tcp", and with the answer check also
+// accept connections on it, e.g. "the printer must answer IPP".
+type Expectation struct {
+	ID          string `json:"id"`
+	Site        string `json:"site"`
+	Device      string `json:"device"`
+	ServiceType string `json:"serviceType"` // e.g. "_smb._tcp"
+	Check       string `json:"check"`
+	// Port overrides the advertised port answer checks connect to
+	Port         uint16 `json:"port,omitempty"`
+	GraceSeconds int    `json:"graceSeconds,omitempty"`
+	CreatedAt    int64  `json:"createdAt"`
+}
+
+// ExpectationStatus is the state of an expectation as of its last check.
+// Since is when it entered the state; DowntimeSeconds counts from the first
+// failed check while it fails, and is the length of the last outage once it
+// is ok again.
+type ExpectationStatus struct {
+	State           string `json:"state"`
+	Since           int64  `json:"since,omitempty"`
+	LastCheck       int64  `json:"lastCheck,omitempty"`
+	Error           string `json:"error,omitempty"`
+	DowntimeSeconds int64  `json:"downtimeSeconds,omitempty"`
+	// Maintenance is set while a maintenance window covers the device
+	Maintenance bool `json:"maintenance,omitempty"`
+}
+
+// ExpectationReport is an expectation with its status.
+type ExpectationReport struct {
+	Expectation
+	Status ExpectationStatus `json:"status"`
+}
+
+var errExpectationExists = errors.New("expectation already exists")
+
+// normalize validates an expectation and fills in its defaults and ID, which
+// is derived from what it checks so the same expectation can't be declared
+// twice.
+func (e *Expectation) normalize() error {
+	e.Device = strings.TrimSuffix(strings.TrimSpace(e.Device), ".")
+	e.ServiceType = strings.TrimSuffix(strings.TrimSuffix(strings.TrimSpace(e.ServiceType), "."), ".local")
+	if e.Device == "" {
+		return errors.New("device is required")
+	}
+	if !strings.HasPrefix(e.ServiceType, "_") || (!strings.HasSuffix(e.ServiceType, "._tcp") && !strings.HasSuffix(e.ServiceType, "._udp")) {
+		return fmt.Errorf("invalid service type %q (expected e.g. _smb._tcp)", e.ServiceType)
+	}
+	switch e.Check {
+	case "":
+		e.Check = expectAdvertise
+	case expectAdvertise:
+	case expectAnswer:
+		if strings.HasSuffix(e.ServiceType, "._udp") {
+			return errors.New("answer checks need a TCP service type")
+		}
+	default:
+		return fmt.Errorf("check must be %s or %s", expectAdvertise, expectAnswer)
+	}
+	if e.GraceSeconds < 0 {
+		return errors.New("graceSeconds must not be negative")
+	}
+	sum := sha256.Sum256([]byte(fmt.Sprintf("%s/%s/%s/%s/%d", e.Site, strings.ToLower(e.Device), e.ServiceType, e.Check, e.Port)))
+	e.ID = hex.EncodeToString(sum[:6])
+	return nil
+}
+
+func (e *Expectation) grace() time.Duration {
+	if e.GraceSeconds == 0 {
+		return defaultExpectationGrace
+	}
+	return time.Duration(e.GraceSeconds) * time.Second
+}
+
+// describe names what is expected, for messages.
+func (e *Expectation) describe() string {
+	if e.Check == expectAnswer {
+		return "answer " + e.ServiceType
+	}
+	return "advertise " + e.ServiceType
+}
+
+// Expectations keeps the declared expectations, persisted, and their
+// status, in memory, and reports failures and recoveries on the bus.
+type Expectations struct {
+	mu           sync.Mutex
+	store        Store
+	bus          *EventBus
+	expectations map[string]*Expectation // by ID
+	status       map[string]*ExpectationStatus
+}
+
+// NewExpectations loads the expectations from store.
+func NewExpectations(store Store, bus *EventBus) (*Expectations, error) {
+	x := &Expectations{store: store, bus: bus, expectations: make(map[string]*Expectation), status: make(map[string]*ExpectationStatus)}
+	entries, err := store.Load(expectationsBucket)
+	if err != nil {
+		return nil, err
+	}
+	for key, data := range entries {
+		expectation := &Expectation{}
+		if err := json.Unmarshal(data, expectation); err != nil {
+			return nil, fmt.Errorf("expectation %s: %v", key, err)
+		}
+		x.expectations[expectation.ID] = expectation
+		x.status[expectation.ID] = &ExpectationStatus{State: expectationPending}
+	}
+	return x, nil
+}
+
+// Add declares an expectation, or returns errExpectationExists.
+func (x *Expectations) Add(expectation Expectation) (ExpectationReport, error) {
+	if err := expectation.normalize(); err != nil {
+		return ExpectationReport{}, err
+	}
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	if _, ok := x.expectations[expectation.ID]; ok {
+		return ExpectationReport{}, errExpectationExists
+	}
+	expectation.CreatedAt = time.Now().Unix()
+	data, err := json.Marshal(expectation)
+	if err != nil {
+		return ExpectationReport{}, err
+	}
+	if err := x.store.Put(expectationsBucket, map[string][]byte{expectation.ID: data}); err != nil {
+		return ExpectationReport{}, err
+	}
+	x.expectations[expectation.ID] = &expectation
+	x.status[expectation.ID] = &ExpectationStatus{State: expectationPending}
+	return ExpectationReport{Expectation: expectation, Status: *x.status[expectation.ID]}, nil
+}
+
+// Remove deletes an expectation and reports whether there was one.
+func (x *Expectations) Remove(id string) (bool, error) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	if _, ok := x.expectations[id]; !ok {
+		return false, nil
+	}
+	if err := x.store.Delete(expectationsBucket, id); err != nil {
+		return false, err
+	}
+	delete(x.expectations, id)
+	delete(x.status, id)
+	return true, nil
+}
+
+// Get returns an expectation with its status, or nil.
+func (x *Expectations) Get(id string, now time.Time) *ExpectationReport {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	expectation, ok := x.expectations[id]
+	if !ok {
+		return nil
+	}
+	return &ExpectationReport{Expectation: *expectation, Status: x.report(id, now)}
+}
+
+// List returns the expectations of site, every site when empty, with their
+// status, by device and service type.
+func (x *Expectations) List(site string, now time.Time) []ExpectationReport {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	reports := make([]ExpectationReport, 0, len(x.expectations))
+	for id, expectation := range x.expectations {
+		if site == "" || expectation.Site == site {
+			reports = append(reports, ExpectationReport{Expectation: *expectation, Status: x.report(id, now)})
+		}
+	}
+	sort.Slice(reports, func(i, j int) bool {
+		a, b := reports[i], reports[j]
+		if a.Device != b.Device {
+			return a.Device < b.Device
+		}
+		if a.ServiceType != b.ServiceType {
+			return a.ServiceType < b.ServiceType
+		}
+		return a.ID < b.ID
+	})
+	return reports
+}
+
+// report must be called with x.mu held.
+func (x *Expectations) report(id string, now time.Time) ExpectationStatus {
+	status := *x.status[id]
+	if status.State == expectationFailing || status.State == expectationDown {
+		status.DowntimeSeconds = now.Unix() - status.Since
+	}
+	return status
+}
+
+// verify checks one expectation against the current services and returns
+// why it fails, or "".
+func (s *MDNSServer) verify(ctx context.Context, expectation *Expectation) string {
+	var addresses []string
+	for _, service := range s.listServices(expectation.Site) {
+		if !strings.EqualFold(deviceID(&service), expectation.Device) || strings.TrimSuffix(service.Type, ".local.") != expectation.ServiceType {
+			continue
+		}
+		port := service.Port
+		if expectation.Port != 0 {
+			port = expectation.Port
+		}
+		addresses = append(addresses, net.JoinHostPort(service.IP, strconv.Itoa(int(port))))
+	}
+	if len(addresses) == 0 {
+		return "not advertised"
+	}
+	if expectation.Check != expectAnswer {
+		return ""
+	}
+	var errs []string
+	for _, address := range addresses {
+		host, _, _ := net.SplitHostPort(address)
+		if err := scanScope.check(host); err != nil {
+			errs = append(errs, err.Error())
+			continue
+		}
+		dialCtx, cancel := context.WithTimeout(ctx, expectationDialTimeout)
+		err := expectationDial(dialCtx, address)
+		cancel()
+		if err == nil {
+			return ""
+		}
+		errs = append(errs, err.Error())
+	}
+	return strings.Join(errs, "; ")
+}
+
+// Evaluate checks every expectation. One that has failed for longer than
+// its grace period is reported as an expectation-failed anomaly with how
+// long it has been down, and its recovery as expectation-recovered with the
+// total downtime. Neither is reported while a maintenance window covers the
+// device; a failure that outlasts the window is reported after it.
+func (x *Expectations) Evaluate(ctx context.Context, server *MDNSServer, now time.Time) {
+	x.mu.Lock()
+	expectations := make([]*Expectation, 0, len(x.expectations))
+	for _, expectation := range x.expectations {
+		c := *expectation
+		expectations = append(expectations, &c)
+	}
+	x.mu.Unlock()
+	sort.Slice(expectations, func(i, j int) bool { return expectations[i].ID < expectations[j].ID })
+
+	failures := make([]string, len(expectations))
+	var wg sync.WaitGroup
+	for i, expectation := range expectations {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			failures[i] = server.verify(ctx, expectation)
+		}()
+	}
+	wg.Wait()
+
+	var events []AnomalyEvent
+	x.mu.Lock()
+	for i, expectation := range expectations {
+		status, ok := x.status[expectation.ID]
+		if !ok {
+			continue // removed meanwhile
+		}
+		status.LastCheck, status.Error = now.Unix(), failures[i]
+		status.Maintenance = server.maintenance.Active(expectation.Site, expectation.Device, now) != nil
+		params := map[string]string{"device": expectation.Device, "expectation": expectation.describe(), "error": failures[i]}
+		switch {
+		case failures[i] == "" && status.State != expectationOK:
+			if status.State == expectationDown && !status.Maintenance {
+				downtime := now.Sub(time.Unix(status.Since, 0)).Round(time.Second)
+				params["downtime"] = downtime.String()
+				status.DowntimeSeconds = int64(downtime / time.Second)
+				event := newAnomaly("expectation-recovered", "expectation-recovered", params)
+				event.Device = expectation.Device
+				events = append(events, event)
+			}
+			status.State, status.Since = expectationOK, now.Unix()
+		case failures[i] != "" && (status.State == expectationOK || status.State == expectationPending):
+			status.State, status.Since = expectationFailing, now.Unix()
+			fallthrough
+		case failures[i] != "" && status.State == expectationFailing:
+			if downtime := now.Sub(time.Unix(status.Since, 0)); downtime >= expectation.grace() && !status.Maintenance {
+				status.State = expectationDown
+				params["downtime"] = downtime.Round(time.Second).String()
+				event := newAnomaly("expectation-failed", "expectation-failed", params)
+				event.Device = expectation.Device
+				events = append(events, event)
+			}
+		}
+	}
+	x.mu.Unlock()
+
+	for _, event := range events {
+		x.bus.Publish(TopicAnomaly, event)
+	}
+}
+
+// Run checks the expectations every interval.
+func (x *Expectations) Run(server *MDNSServer, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for now := range ticker.C {
+		x.Evaluate(context.Background(), server, now)
+	}
+}
+
+// ExpectationsHandler handles /api/expectations: GET lists the
+// expectations of ?site= with their status and POST declares one, by
+// default on this instance's site.
+func (s *MDNSServer) ExpectationsHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		writeJSON(w, http.StatusOK, map[string]interface{}{
+			"expectations": s.expectations.List(s.siteParam(r), time.Now()),
+		})
+
+	case http.MethodPost:
+		var expectation Expectation
+		if err := json.NewDecoder(r.Body).Decode(&expectation); err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		expectation.Site = s.scopeSite(expectation.Site)
+		if expectation.Site == "" {
+			expectation.Site = s.site
+		}
+		report, err := s.expectations.Add(expectation)
+		switch {
+		case errors.Is(err, errExpectationExists):
+			writeError(w, http.StatusConflict, err.Error())
+		case err != nil:
+			writeError(w, http.StatusBadRequest, err.Error())
+		default:
+			writeJSON(w, http.StatusCreated, report)
+		}
+
+	default:
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+	}
+}
+
+// ExpectationItem handles GET and DELETE /api/expectations/{id}.
+func (s *MDNSServer) ExpectationItem(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	switch r.Method {
+	case http.MethodGet:
+		report := s.expectations.Get(id, time.Now())
+		if report == nil {
+			writeError(w, http.StatusNotFound, "no expectation "+id)
+			return
+		}
+		writeJSON(w, http.StatusOK, report)
+
+	case http.MethodDelete:
+		removed, err := s.expectations.Remove(id)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		if !removed {
+			writeError(w, http.StatusNotFound, "no expectation "+id)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+	}
+}
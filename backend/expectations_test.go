@@ -0,0 +1,135 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestExpectationNormalize verifies expectations are validated and get IDs
+// from what they check
+func TestExpectationNormalize(t *testing.T) {
+	a := Expectation{Site: defaultSite, Device: "nas.local.", ServiceType: "_smb._tcp.local."}
+	b := Expectation{Site: defaultSite, Device: "NAS.local", ServiceType: "_smb._tcp", Check: expectAdvertise}
+	if err := a.normalize(); err != nil || b.normalize() != nil {
+		t.Fatalf("Expected valid expectations, got %v", err)
+	}
+	if a.ID != b.ID || a.Device != "nas.local" || a.ServiceType != "_smb._tcp" || a.Check != expectAdvertise {
+		t.Fatalf("Expected the same normalized expectation, got %+v and %+v", a, b)
+	}
+
+	for _, invalid := range []Expectation{
+		{ServiceType: "_smb._tcp"},
+		{Device: "nas.local", ServiceType: "smb"},
+		{Device: "nas.local", ServiceType: "_mdns._udp", Check: expectAnswer},
+		{Device: "nas.local", ServiceType: "_smb._tcp", Check: "ping"},
+	} {
+		if err := invalid.normalize(); err == nil {
+			t.Fatalf("Expected an error for %+v", invalid)
+		}
+	}
+}
+
+// TestExpectationsEvaluate verifies failures are reported after the grace
+// period and recoveries with the downtime
+func TestExpectationsEvaluate(t *testing.T) {
+	saved := expectationDial
+	defer func() { expectationDial = saved }()
+	var dialErr error
+	var dialed string
+	expectationDial = func(_ context.Context, address string) error {
+		dialed = address
+		return dialErr
+	}
+
+	server := NewMDNSServer()
+	var anomalies []AnomalyEvent
+	server.bus.Subscribe("test", func(e BusEvent) { anomalies = append(anomalies, e.Payload.(AnomalyEvent)) }, TopicAnomaly)
+	expectations, _ := NewExpectations(openTestStore(t, "json", t.TempDir()), server.bus)
+	printer := &MDNSService{Name: "Printer", Type: "_ipp._tcp.local.", Host: "printer.local.", IP: "192.168.1.30", Port: 631, Site: defaultSite}
+	server.addService("a", printer)
+	answer, _ := expectations.Add(Expectation{Site: defaultSite, Device: "printer.local", ServiceType: "_ipp._tcp", Check: expectAnswer, GraceSeconds: 60})
+	advertise, _ := expectations.Add(Expectation{Site: defaultSite, Device: "nas.local", ServiceType: "_smb._tcp", GraceSeconds: 60})
+
+	start := time.Unix(1700000000, 0)
+	expectations.Evaluate(context.Background(), server, start)
+	if dialed != "192.168.1.30:631" {
+		t.Fatalf("Expected the printer's IPP port dialed, got %q", dialed)
+	}
+	if status := expectations.Get(answer.ID, start).Status; status.State != expectationOK {
+		t.Fatalf("Expected the printer ok, got %+v", status)
+	}
+	if status := expectations.Get(advertise.ID, start).Status; status.State != expectationFailing || status.Error != "not advertised" {
+		t.Fatalf("Expected the NAS failing within its grace period, got %+v", status)
+	}
+	if len(anomalies) != 0 {
+		t.Fatalf("Expected no anomalies within the grace period, got %+v", anomalies)
+	}
+
+	expectations.Evaluate(context.Background(), server, start.Add(30*time.Second))
+	dialErr = errors.New("connection refused")
+	expectations.Evaluate(context.Background(), server, start.Add(90*time.Second))
+	if len(anomalies) != 1 || anomalies[0].Kind != "expectation-failed" || anomalies[0].Device != "nas.local" || anomalies[0].Params["downtime"] != "1m30s" {
+		t.Fatalf("Expected the NAS reported down for 1m30s, got %+v", anomalies)
+	}
+	expectations.Evaluate(context.Background(), server, start.Add(150*time.Second))
+	if len(anomalies) != 2 || !strings.Contains(anomalies[1].Message, "printer.local does not answer _ipp._tcp (connection refused)") {
+		t.Fatalf("Expected the printer reported once down, got %+v", anomalies)
+	}
+	if status := expectations.Get(answer.ID, start.Add(170*time.Second)).Status; status.State != expectationDown || status.DowntimeSeconds != 80 {
+		t.Fatalf("Expected the printer down for 80s, got %+v", status)
+	}
+
+	dialErr = nil
+	expectations.Evaluate(context.Background(), server, start.Add(200*time.Second))
+	if len(anomalies) != 3 || anomalies[2].Kind != "expectation-recovered" || anomalies[2].Params["downtime"] != "1m50s" {
+		t.Fatalf("Expected the printer's recovery after 1m50s, got %+v", anomalies)
+	}
+	if status := expectations.Get(answer.ID, start.Add(300*time.Second)).Status; status.State != expectationOK || status.DowntimeSeconds != 110 {
+		t.Fatalf("Expected the last outage kept, got %+v", status)
+	}
+}
+
+// TestExpectationsHandlers verifies declaring, listing and removing
+// expectations
+func TestExpectationsHandlers(t *testing.T) {
+	server := NewMDNSServer()
+	store := openTestStore(t, "json", t.TempDir())
+	server.expectations, _ = NewExpectations(store, server.bus)
+
+	post := func(body string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		server.ExpectationsHandler(rec, httptest.NewRequest(http.MethodPost, "/api/expectations", strings.NewReader(body)))
+		return rec
+	}
+	rec := post(`{"device": "nas.local", "serviceType": "_smb._tcp"}`)
+	var created ExpectationReport
+	json.NewDecoder(rec.Body).Decode(&created)
+	if rec.Code != http.StatusCreated || created.Site != defaultSite || created.Status.State != expectationPending {
+		t.Fatalf("Expected the expectation created, got %d %+v", rec.Code, created)
+	}
+	if rec := post(`{"device": "nas.local", "serviceType": "_smb._tcp"}`); rec.Code != http.StatusConflict {
+		t.Fatalf("Expected 409 for a duplicate, got %d", rec.Code)
+	}
+	if rec := post(`{"device": "nas.local", "serviceType": "smb"}`); rec.Code != http.StatusBadRequest {
+		t.Fatalf("Expected 400 for an invalid service type, got %d", rec.Code)
+	}
+
+	reloaded, _ := NewExpectations(store, server.bus)
+	if list := reloaded.List(defaultSite, time.Now()); len(list) != 1 || list[0].ID != created.ID {
+		t.Fatalf("Expected the expectation persisted, got %+v", list)
+	}
+
+	req := httptest.NewRequest(http.MethodDelete, "/api/expectations/"+created.ID, nil)
+	req.SetPathValue("id", created.ID)
+	rec = httptest.NewRecorder()
+	server.ExpectationItem(rec, req)
+	if rec.Code != http.StatusNoContent || len(server.expectations.List("", time.Now())) != 0 {
+		t.Fatalf("Expected the expectation removed, got %d", rec.Code)
+	}
+}
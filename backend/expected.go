@@ -0,0 +1,355 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// expectedBucket is the Store bucket expected inventories are kept in, one
+// entry per site.
+const expectedBucket = "expected"
+
+// maxExpectedDevices bounds the size of an imported inventory.
+const maxExpectedDevices = 10000
+
+// ExpectedDevice is a device the network should have, from an imported
+// inventory. It is matched against discovered devices by MAC address, or by
+// name, the device ID with or without ".local".
+type ExpectedDevice struct {
+	MAC      string `json:"mac,omitempty"`
+	Name     string `json:"name,omitempty"`
+	Owner    string `json:"owner,omitempty"`
+	Location string `json:"location,omitempty"`
+}
+
+// expectedInventory is the expected inventory of one site.
+type expectedInventory struct {
+	Site       string           `json:"site"`
+	Devices    []ExpectedDevice `json:"devices"`
+	ImportedAt int64            `json:"importedAt"`
+}
+
+// ExpectedStore keeps the expected inventories in memory and writes every
+// change through to the persistent Store.
+type ExpectedStore struct {
+	mu          sync.RWMutex
+	store       Store
+	inventories map[string]*expectedInventory // by site
+}
+
+// NewExpectedStore loads the expected inventories from store.
+func NewExpectedStore(store Store) (*ExpectedStore, error) {
+	e := &ExpectedStore{store: store, inventories: make(map[string]*expectedInventory)}
+	entries, err := store.Load(expectedBucket)
+	if err != nil {
+		return nil, err
+	}
+	for key, data := range entries {
+		inventory := &expectedInventory{}
+		if err := json.Unmarshal(data, inventory); err != nil {
+			return nil, fmt.Errorf("expected inventory %s: %v", key, err)
+		}
+		e.inventories[inventory.Site] = inventory
+	}
+	return e, nil
+}
+
+// Get returns a copy of the expected devices of site and when they were
+// imported, or nil and 0.
+func (e *ExpectedStore) Get(site string) ([]ExpectedDevice, int64) {
+	if e == nil {
+		return nil, 0
+	}
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	inventory, ok := e.inventories[site]
+	if !ok {
+		return nil, 0
+	}
+	return append([]ExpectedDevice(nil), inventory.Devices...), inventory.ImportedAt
+}
+
+// Replace makes devices the expected inventory of site; none clears it.
+func (e *ExpectedStore) Replace(site string, devices []ExpectedDevice) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if len(devices) == 0 {
+		if err := e.store.Delete(expectedBucket, site); err != nil {
+			return err
+		}
+		delete(e.inventories, site)
+		return nil
+	}
+
+	inventory := &expectedInventory{Site: site, Devices: devices, ImportedAt: time.Now().Unix()}
+	data, err := json.Marshal(inventory)
+	if err != nil {
+		return err
+	}
+	if err := e.store.Put(expectedBucket, map[string][]byte{site: data}); err != nil {
+		return err
+	}
+	e.inventories[site] = inventory
+	return nil
+}
+
+// normalize validates an expected device, normalizing its MAC address.
+func (d *ExpectedDevice) normalize() error {
+	d.MAC, d.Name = strings.TrimSpace(d.MAC), strings.TrimSuffix(strings.TrimSpace(d.Name), ".")
+	d.Owner, d.Location = strings.TrimSpace(d.Owner), strings.TrimSpace(d.Location)
+	if d.MAC == "" && d.Name == "" {
+		return errors.New("a MAC address or name is required")
+	}
+	if d.MAC != "" {
+		mac, err := net.ParseMAC(d.MAC)
+		if err != nil {
+			return fmt.Errorf("invalid MAC address %q", d.MAC)
+		}
+		d.MAC = mac.String()
+	}
+	return nil
+}
+
+// expectedColumns maps the CSV header names an inventory may use to the
+// ExpectedDevice fields.
+var expectedColumns = map[string]string{
+	"mac": "mac", "mac address": "mac", "macaddress": "mac",
+	"name": "name", "hostname": "name", "host": "name", "device": "name",
+	"owner":    "owner",
+	"location": "location",
+}
+
+// parseExpectedDevices parses an inventory: a JSON array of ExpectedDevice,
+// or a CSV file with a header row naming the mac, name, owner and location
+// columns, in any order, other columns being ignored. Every device is
+// validated, and MAC addresses and names must be unique.
+func parseExpectedDevices(data []byte) ([]ExpectedDevice, error) {
+	var devices []ExpectedDevice
+	if trimmed := bytes.TrimSpace(data); len(trimmed) > 0 && trimmed[0] == '[' {
+		if err := json.Unmarshal(trimmed, &devices); err != nil {
+			return nil, err
+		}
+	} else {
+		reader := csv.NewReader(bytes.NewReader(bytes.TrimPrefix(data, []byte("\xef\xbb\xbf"))))
+		reader.FieldsPerRecord = -1
+		reader.TrimLeadingSpace = true
+		header, err := reader.Read()
+		if err == io.EOF {
+			return nil, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		columns := make([]string, len(header))
+		known := false
+		for i, name := range header {
+			columns[i] = expectedColumns[strings.ToLower(strings.TrimSpace(name))]
+			known = known || columns[i] == "mac" || columns[i] == "name"
+		}
+		if !known {
+			return nil, errors.New("the header row must have a mac or name column")
+		}
+		for {
+			record, err := reader.Read()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return nil, err
+			}
+			var device ExpectedDevice
+			for i, value := range record {
+				if i >= len(columns) {
+					break
+				}
+				switch columns[i] {
+				case "mac":
+					device.MAC = value
+				case "name":
+					device.Name = value
+				case "owner":
+					device.Owner = value
+				case "location":
+					device.Location = value
+				}
+			}
+			devices = append(devices, device)
+		}
+	}
+
+	if len(devices) > maxExpectedDevices {
+		return nil, fmt.Errorf("more than %d devices", maxExpectedDevices)
+	}
+	macs := make(map[string]bool)
+	names := make(map[string]bool)
+	for i := range devices {
+		if err := devices[i].normalize(); err != nil {
+			return nil, fmt.Errorf("device %d: %v", i+1, err)
+		}
+		if mac := devices[i].MAC; mac != "" {
+			if macs[mac] {
+				return nil, fmt.Errorf("device %d: duplicate MAC address %s", i+1, mac)
+			}
+			macs[mac] = true
+		}
+		if name := strings.ToLower(devices[i].Name); name != "" {
+			if names[name] {
+				return nil, fmt.Errorf("device %d: duplicate name %s", i+1, devices[i].Name)
+			}
+			names[name] = true
+		}
+	}
+	return devices, nil
+}
+
+// matches reports whether a discovered device is the expected one, by MAC
+// address or by name.
+func (d *ExpectedDevice) matches(device *DeviceSummary, byMAC bool) bool {
+	if byMAC {
+		return d.MAC != "" && strings.EqualFold(d.MAC, device.MAC)
+	}
+	return d.Name != "" && (strings.EqualFold(d.Name, device.ID) || strings.EqualFold(d.Name+".local", device.ID))
+}
+
+// ReconciledDevice is a discovered device on the reconciliation report.
+type ReconciledDevice struct {
+	ID        string   `json:"id"`
+	StableID  string   `json:"stableId,omitempty"`
+	MAC       string   `json:"mac,omitempty"`
+	Addresses []string `json:"addresses"`
+	Category  string   `json:"category"`
+	Vendor    string   `json:"vendor,omitempty"`
+	LastSeen  int64    `json:"lastSeen,omitempty"`
+}
+
+func reconciledDevice(device *DeviceSummary) *ReconciledDevice {
+	return &ReconciledDevice{ID: device.ID, StableID: device.StableID, MAC: device.MAC, Addresses: device.Addresses,
+		Category: device.Category, Vendor: device.Vendor, LastSeen: device.LastSeen}
+}
+
+// ExpectedMatch pairs an expected device with the discovered one, if any.
+type ExpectedMatch struct {
+	Expected ExpectedDevice    `json:"expected"`
+	Device   *ReconciledDevice `json:"device,omitempty"`
+}
+
+// Reconciliation compares an expected inventory with the discovered
+// devices: the expected devices that are present, those missing, i.e.
+// never discovered or without current services, and the devices present
+// that nobody expected.
+type Reconciliation struct {
+	Site       string              `json:"site"`
+	Expected   int                 `json:"expected"`
+	ImportedAt int64               `json:"importedAt,omitempty"`
+	Present    []ExpectedMatch     `json:"present"`
+	Missing    []ExpectedMatch     `json:"missing"`
+	Unexpected []*ReconciledDevice `json:"unexpected"`
+}
+
+// reconcile matches expected devices against discovered ones. A discovered
+// device matches at most one expected device, by MAC address first.
+func reconcile(site string, expected []ExpectedDevice, devices []*DeviceSummary) Reconciliation {
+	result := Reconciliation{Site: site, Expected: len(expected), Present: []ExpectedMatch{}, Missing: []ExpectedMatch{}, Unexpected: []*ReconciledDevice{}}
+	matched := make(map[*DeviceSummary]bool)
+	found := make([]*DeviceSummary, len(expected))
+	for _, byMAC := range []bool{true, false} {
+		for i := range expected {
+			if found[i] != nil {
+				continue
+			}
+			for _, device := range devices {
+				if !matched[device] && expected[i].matches(device, byMAC) {
+					found[i] = device
+					matched[device] = true
+					break
+				}
+			}
+		}
+	}
+
+	for i, device := range found {
+		match := ExpectedMatch{Expected: expected[i]}
+		if device != nil {
+			match.Device = reconciledDevice(device)
+		}
+		if device != nil && len(device.Services) > 0 {
+			result.Present = append(result.Present, match)
+		} else {
+			result.Missing = append(result.Missing, match)
+		}
+	}
+	for _, device := range devices {
+		if !matched[device] && len(device.Services) > 0 {
+			result.Unexpected = append(result.Unexpected, reconciledDevice(device))
+		}
+	}
+	sort.Slice(result.Unexpected, func(i, j int) bool { return result.Unexpected[i].ID < result.Unexpected[j].ID })
+	return result
+}
+
+// Expected handles /api/expected, the expected inventory of the site
+// selected by ?site=: GET lists it, PUT replaces it with the CSV or JSON
+// body and DELETE clears it.
+func (s *MDNSServer) Expected(w http.ResponseWriter, r *http.Request) {
+	site := s.deviceSite(r)
+	switch r.Method {
+	case http.MethodGet:
+		devices, importedAt := s.expected.Get(site)
+		if devices == nil {
+			devices = []ExpectedDevice{}
+		}
+		writeJSON(w, http.StatusOK, expectedInventory{Site: site, Devices: devices, ImportedAt: importedAt})
+
+	case http.MethodPut:
+		data, err := io.ReadAll(http.MaxBytesReader(w, r.Body, 4<<20))
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		devices, err := parseExpectedDevices(data)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		if err := s.expected.Replace(site, devices); err != nil {
+			writeError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]interface{}{"site": site, "imported": len(devices)})
+
+	case http.MethodDelete:
+		if err := s.expected.Replace(site, nil); err != nil {
+			writeError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+	}
+}
+
+// Reconcile handles GET /api/expected/reconcile: the expected inventory of
+// ?site= against the devices discovered there.
+func (s *MDNSServer) Reconcile(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	site := s.deviceSite(r)
+	expected, importedAt := s.expected.Get(site)
+	result := reconcile(site, expected, s.summarizeDevices(s.listDevices(site, ""), site))
+	result.ImportedAt = importedAt
+	writeJSON(w, http.StatusOK, result)
+}
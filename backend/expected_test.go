@@ -0,0 +1,111 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestParseExpectedDevices verifies CSV and JSON inventories are parsed and
+// validated
+func TestParseExpectedDevices(t *testing.T) {
+	devices, err := parseExpectedDevices([]byte("\xef\xbb\xbfHostname,Serial,MAC Address,Owner\nnas.local.,X1,00-11-32-AA-BB-CC,alex\nprinter,,,\n"))
+	if err != nil {
+		t.Fatalf("Failed to parse the CSV: %v", err)
+	}
+	if len(devices) != 2 || devices[0] != (ExpectedDevice{MAC: "00:11:32:aa:bb:cc", Name: "nas.local", Owner: "alex"}) || devices[1].Name != "printer" {
+		t.Fatalf("Expected the NAS and printer, got %+v", devices)
+	}
+
+	devices, err = parseExpectedDevices([]byte(` [{"mac": "00:1b:21:01:02:03", "location": "office"}]`))
+	if err != nil || len(devices) != 1 || devices[0].Location != "office" {
+		t.Fatalf("Expected the JSON device, got %+v, %v", devices, err)
+	}
+
+	for _, input := range []string{
+		"serial,owner\nX1,alex\n",
+		"mac\nnot-a-mac\n",
+		"mac,name\n,\n",
+		"mac\n00:11:32:aa:bb:cc\n00-11-32-AA-BB-CC\n",
+		"name\nnas\nNAS\n",
+		`[{"mac": 1}]`,
+	} {
+		if _, err := parseExpectedDevices([]byte(input)); err == nil {
+			t.Fatalf("Expected an error for %q", input)
+		}
+	}
+}
+
+// TestReconcile verifies expected devices are matched by MAC address, then
+// by name, and the rest reported missing or unexpected
+func TestReconcile(t *testing.T) {
+	online := []MDNSService{{Name: "x"}}
+	devices := []*DeviceSummary{
+		{DeviceMetadata: &DeviceMetadata{ID: "diskstation.local"}, MAC: "00:11:32:aa:bb:cc", Services: online},
+		{DeviceMetadata: &DeviceMetadata{ID: "printer.local"}, Services: online},
+		{DeviceMetadata: &DeviceMetadata{ID: "tv.local"}},
+		{DeviceMetadata: &DeviceMetadata{ID: "phone.local"}, Services: online},
+	}
+	expected := []ExpectedDevice{
+		{Name: "nas", MAC: "00:11:32:aa:bb:cc"},
+		{Name: "printer"},
+		{Name: "tv"},
+		{MAC: "00:1b:21:01:02:03"},
+	}
+
+	result := reconcile(defaultSite, expected, devices)
+	if len(result.Present) != 2 || result.Present[0].Device.ID != "diskstation.local" || result.Present[1].Device.ID != "printer.local" {
+		t.Fatalf("Expected the NAS by MAC and the printer by name, got %+v", result.Present)
+	}
+	if len(result.Missing) != 2 || result.Missing[0].Device.ID != "tv.local" || result.Missing[1].Device != nil {
+		t.Fatalf("Expected the offline TV and the undiscovered device missing, got %+v", result.Missing)
+	}
+	if len(result.Unexpected) != 1 || result.Unexpected[0].ID != "phone.local" {
+		t.Fatalf("Expected the phone unexpected, got %+v", result.Unexpected)
+	}
+}
+
+// TestExpectedHandlers verifies importing, persisting and reconciling an
+// inventory
+func TestExpectedHandlers(t *testing.T) {
+	server := NewMDNSServer()
+	store := openTestStore(t, "json", t.TempDir())
+	server.metadata, _ = NewMetadataStore(store)
+	server.expected, _ = NewExpectedStore(store)
+	server.addService("a", &MDNSService{Name: "Printer", Type: "_ipp._tcp.local.", Host: "printer.local.", IP: "192.168.1.30", Port: 631, Site: defaultSite, Timestamp: time.Now().Unix()})
+
+	rec := httptest.NewRecorder()
+	server.Expected(rec, httptest.NewRequest(http.MethodPut, "/api/expected", strings.NewReader("name,owner\nprinter,alex\nnas,\n")))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Expected the import to succeed, got %d %s", rec.Code, rec.Body.String())
+	}
+	rec = httptest.NewRecorder()
+	server.Expected(rec, httptest.NewRequest(http.MethodPut, "/api/expected", strings.NewReader("serial\n1\n")))
+	if rec.Code != http.StatusBadRequest {
+		t.Fatalf("Expected 400 for an inventory without mac or name, got %d", rec.Code)
+	}
+
+	reloaded, _ := NewExpectedStore(store)
+	if devices, importedAt := reloaded.Get(defaultSite); len(devices) != 2 || importedAt == 0 {
+		t.Fatalf("Expected the inventory persisted, got %+v", devices)
+	}
+
+	rec = httptest.NewRecorder()
+	server.Reconcile(rec, httptest.NewRequest(http.MethodGet, "/api/expected/reconcile", nil))
+	var result Reconciliation
+	if err := json.NewDecoder(rec.Body).Decode(&result); err != nil {
+		t.Fatalf("Expected a JSON response, got %v", err)
+	}
+	if len(result.Present) != 1 || result.Present[0].Expected.Owner != "alex" || len(result.Missing) != 1 || result.Missing[0].Expected.Name != "nas" {
+		t.Fatalf("Expected the printer present and the NAS missing, got %+v", result)
+	}
+
+	rec = httptest.NewRecorder()
+	server.Expected(rec, httptest.NewRequest(http.MethodDelete, "/api/expected", nil))
+	if devices, _ := server.expected.Get(defaultSite); rec.Code != http.StatusNoContent || devices != nil {
+		t.Fatalf("Expected the inventory cleared, got %d %+v", rec.Code, devices)
+	}
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"log"
+	"strings"
+	"time"
+)
+
+// expiryInterval is how often the service table is checked for services
+// whose records have expired.
+const expiryInterval = time.Second
+
+// expireServices removes the local services whose records' TTL ran out
+// without them being announced again, and publishes their removal. Services
+// of other sites are left to their agents. It returns how many expired.
+func (s *MDNSServer) expireServices(now time.Time) int {
+	cutoff := now.Unix()
+	// Most checks find nothing, which the snapshot tells without bothering
+	// the writer
+	due := false
+	for _, service := range s.table.view() {
+		if service.Site == s.site && service.ExpiresAt > 0 && service.ExpiresAt < cutoff {
+			due = true
+			break
+		}
+	}
+	if !due {
+		return 0
+	}
+
+	s.order.Lock()
+	defer s.order.Unlock()
+	var expired []MDNSService
+	// Checked again on the writer, as a refresh may have come in meanwhile
+	s.table.do(func() { expired = s.table.expire(s.site, cutoff) })
+	for _, service := range expired {
+		log.Printf("Service expired: %s (%s) at %s", service.Name, service.Type, service.IP)
+		s.bus.Publish(TopicService, &DiscoveryResponse{Service: service, Removed: true})
+	}
+	return len(expired)
+}
+
+// runExpiry expires services every expiryInterval, and queries those
+// about to expire again. It never returns.
+func (s *MDNSServer) runExpiry() {
+	ticker := time.NewTicker(expiryInterval)
+	defer ticker.Stop()
+	reconfirm := newReconfirmer(s)
+	for now := range ticker.C {
+		s.expireServices(now)
+		reconfirm.check(now)
+	}
+}
+
+// goodbye removes the local services of an instance ("<name>.<type>") whose
+// records were announced with a TTL of 0, which a responder sends when the
+// service goes away (RFC 6762 §10.1), and publishes their removal.
+func (s *MDNSServer) goodbye(instance string) int {
+	return s.forgetServices(func(service *MDNSService) bool {
+		return service.Site == s.site && strings.EqualFold(instance, service.Name+"."+service.Type)
+	})
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// TestExpireServices verifies local services are removed once their
+// records expire, with a removal event, and other sites' services are left
+// to their agents
+func TestExpireServices(t *testing.T) {
+	server := NewMDNSServer()
+	var removed []string
+	server.bus.Subscribe("test", func(e BusEvent) {
+		if event := e.Payload.(*DiscoveryResponse); event.Removed {
+			removed = append(removed, event.Service.Name)
+		}
+	}, TopicService)
+
+	now := time.Now()
+	for name, site := range map[string]string{"stale": defaultSite, "fresh": defaultSite, "remote": "branch"} {
+		service := &MDNSService{Name: name, Type: "_http._tcp.local.", IP: "10.0.0.5", Site: site}
+		announced := now.Add(-5 * time.Minute)
+		if name == "fresh" {
+			announced = now
+		}
+		service.setTTL(announced, 120*time.Second)
+		server.changeService(server.identity(service), service, false)
+	}
+
+	if n := server.expireServices(now); n != 1 || len(removed) != 1 || removed[0] != "stale" {
+		t.Fatalf("Expected only the stale local service to expire, got %d and %v", n, removed)
+	}
+	if services := server.listServices(""); len(services) != 2 {
+		t.Fatalf("Expected the fresh and remote services to stay, got %+v", services)
+	}
+	if n := server.expireServices(now); n != 0 {
+		t.Fatalf("Expected nothing left to expire, got %d", n)
+	}
+}
+
+// TestHandleMDNSPacketGoodbye verifies an announcement with a TTL of 0
+// removes the service at once
+func TestHandleMDNSPacketGoodbye(t *testing.T) {
+	server := NewMDNSServer()
+	var events []*DiscoveryResponse
+	server.bus.Subscribe("test", func(e BusEvent) {
+		events = append(events, e.Payload.(*DiscoveryResponse))
+	}, TopicService)
+
+	msg := new(dns.Msg)
+	if err := msg.Unpack(announcement(t, 7)); err != nil {
+		t.Fatalf("Failed to unpack: %v", err)
+	}
+	handleMDNSPacket(server, msg, "en0", nil, time.Now())
+	for _, rr := range append(msg.Answer, msg.Extra...) {
+		rr.Header().Ttl = 0
+	}
+	handleMDNSPacket(server, msg, "en0", nil, time.Now())
+
+	if services := server.listServices(defaultSite); len(services) != 0 {
+		t.Fatalf("Expected the goodbye to remove device-7, got %+v", services)
+	}
+	if len(events) != 2 || events[0].Removed || !events[1].Removed || events[1].Service.Name != "device-7" {
+		t.Fatalf("Expected an addition and a removal, got %+v", events)
+	}
+}
@@ -0,0 +1,347 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Exports render services or devices as rows whose columns the consumer
+// chooses, so they drop directly into an existing spreadsheet. A row starts
+// as the record's JSON object; ?fields= maps columns to paths into it and
+// ?flatten= spreads nested values over dotted columns.
+
+// exportJoin separates the values of a list in a single cell.
+const exportJoin = "; "
+
+// fieldMapping is one column of a ?fields= template.
+type fieldMapping struct {
+	column string
+	path   []string
+}
+
+// parseFieldMapping parses a comma-separated list of "column=path" entries;
+// a bare path is also the column name. Paths are dotted, e.g.
+// "interfaces.name" collects the name of every interface.
+func parseFieldMapping(spec string) ([]fieldMapping, error) {
+	var mappings []fieldMapping
+	seen := make(map[string]bool)
+	for _, entry := range strings.Split(spec, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		column, path, ok := strings.Cut(entry, "=")
+		if !ok {
+			path = column
+		}
+		column, path = strings.TrimSpace(column), strings.TrimSpace(path)
+		if column == "" || path == "" {
+			return nil, fmt.Errorf("invalid field %q (expected column=path)", entry)
+		}
+		if seen[column] {
+			return nil, fmt.Errorf("duplicate column %q", column)
+		}
+		seen[column] = true
+		mappings = append(mappings, fieldMapping{column: column, path: strings.Split(path, ".")})
+	}
+	return mappings, nil
+}
+
+// exportRow converts a record to its JSON object.
+func exportRow(record interface{}) (map[string]interface{}, error) {
+	data, err := json.Marshal(record)
+	if err != nil {
+		return nil, err
+	}
+	var row map[string]interface{}
+	err = json.Unmarshal(data, &row)
+	return row, err
+}
+
+// lookupPath resolves a dotted path in a JSON value. Lists are indexed by a
+// number, or mapped over by any other path element.
+func lookupPath(v interface{}, path []string) interface{} {
+	if len(path) == 0 {
+		return v
+	}
+	switch v := v.(type) {
+	case map[string]interface{}:
+		return lookupPath(v[path[0]], path[1:])
+	case []interface{}:
+		if i, err := strconv.Atoi(path[0]); err == nil {
+			if i < 0 || i >= len(v) {
+				return nil
+			}
+			return lookupPath(v[i], path[1:])
+		}
+		values := make([]interface{}, 0, len(v))
+		for _, el := range v {
+			if value := lookupPath(el, path); value != nil {
+				values = append(values, value)
+			}
+		}
+		return values
+	default:
+		return nil
+	}
+}
+
+// flattenValue adds v to row as prefix, spreading objects and lists of
+// objects over "prefix.key" and "prefix.N" columns. A list of plain values
+// stays one column.
+func flattenValue(row map[string]interface{}, prefix string, v interface{}) {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		for key, value := range v {
+			flattenValue(row, prefix+"."+key, value)
+		}
+	case []interface{}:
+		if isPlainList(v) {
+			row[prefix] = v
+			return
+		}
+		for i, value := range v {
+			flattenValue(row, prefix+"."+strconv.Itoa(i), value)
+		}
+	default:
+		row[prefix] = v
+	}
+}
+
+func isPlainList(values []interface{}) bool {
+	for _, v := range values {
+		switch v.(type) {
+		case map[string]interface{}, []interface{}:
+			return false
+		}
+	}
+	return true
+}
+
+// cellValue renders a value for a CSV cell.
+func cellValue(v interface{}) string {
+	switch v := v.(type) {
+	case nil:
+		return ""
+	case string:
+		return v
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	case bool:
+		return strconv.FormatBool(v)
+	case []interface{}:
+		if isPlainList(v) {
+			cells := make([]string, len(v))
+			for i, value := range v {
+				cells[i] = cellValue(value)
+			}
+			return strings.Join(cells, exportJoin)
+		}
+	}
+	data, _ := json.Marshal(v)
+	return string(data)
+}
+
+// formulaPrefixes are the characters that make a spreadsheet evaluate a
+// cell as a formula.
+const formulaPrefixes = "=+-@\t\r"
+
+// csvCell renders a value for a CSV cell like cellValue, but prefixes text
+// a spreadsheet would evaluate with ', so a device named
+// "=HYPERLINK(...)" stays a name. Numbers and booleans are left alone.
+func csvCell(v interface{}) string {
+	cell := cellValue(v)
+	switch v.(type) {
+	case nil, float64, bool:
+		return cell
+	}
+	if cell != "" && strings.IndexByte(formulaPrefixes, cell[0]) >= 0 {
+		return "'" + cell
+	}
+	return cell
+}
+
+// rowShaper applies the ?fields= and ?flatten= parameters to rows, one at
+// a time, so an export never needs all of them at once.
+type rowShaper struct {
+	mappings  []fieldMapping
+	flattened map[string]bool
+	union     map[string]bool // the columns of the rows shaped so far, without mappings
+}
+
+func newRowShaper(fields, flatten string) (*rowShaper, error) {
+	mappings, err := parseFieldMapping(fields)
+	if err != nil {
+		return nil, err
+	}
+	shaper := &rowShaper{mappings: mappings, flattened: make(map[string]bool), union: make(map[string]bool)}
+	for _, key := range strings.Split(flatten, ",") {
+		if key = strings.TrimSpace(key); key != "" {
+			shaper.flattened[key] = true
+		}
+	}
+	return shaper, nil
+}
+
+func (s *rowShaper) shape(row map[string]interface{}) map[string]interface{} {
+	if len(s.mappings) > 0 {
+		shaped := make(map[string]interface{}, len(s.mappings))
+		for _, m := range s.mappings {
+			shaped[m.column] = lookupPath(row, m.path)
+		}
+		return shaped
+	}
+	shaped := make(map[string]interface{}, len(row))
+	for key, value := range row {
+		if s.flattened[key] || s.flattened["*"] {
+			flattenValue(shaped, key, value)
+		} else {
+			shaped[key] = value
+		}
+	}
+	for key := range shaped {
+		s.union[key] = true
+	}
+	return shaped
+}
+
+// fixedColumns reports whether the columns are known before any row is
+// shaped: those of ?fields=, rather than the union of the rows'.
+func (s *rowShaper) fixedColumns() bool {
+	return len(s.mappings) > 0
+}
+
+// columns returns the mapping's columns in order, or else those of the
+// rows shaped so far, sorted.
+func (s *rowShaper) columns() []string {
+	if s.fixedColumns() {
+		columns := make([]string, len(s.mappings))
+		for i, m := range s.mappings {
+			columns[i] = m.column
+		}
+		return columns
+	}
+	columns := make([]string, 0, len(s.union))
+	for key := range s.union {
+		columns = append(columns, key)
+	}
+	sort.Strings(columns)
+	return columns
+}
+
+// shapeRows applies the ?fields= and ?flatten= parameters to rows and
+// returns the columns in order.
+func shapeRows(rows []map[string]interface{}, fields, flatten string) ([]map[string]interface{}, []string, error) {
+	shaper, err := newRowShaper(fields, flatten)
+	if err != nil {
+		return nil, nil, err
+	}
+	shaped := make([]map[string]interface{}, len(rows))
+	for i, row := range rows {
+		shaped[i] = shaper.shape(row)
+	}
+	return shaped, shaper.columns(), nil
+}
+
+// writeExport writes the n records record returns as an export named name
+// (the CSV file name): JSON by default, or CSV with ?format=csv. Rows are
+// converted, shaped and written one at a time, so a large inventory is
+// never held as rows in memory. JSON exports list the columns after the
+// rows, once they are all known; CSV exports without ?fields= go over the
+// records twice, first to find the columns of the header.
+func writeExport(w http.ResponseWriter, r *http.Request, name string, n int, record func(i int) interface{}) {
+	q := r.URL.Query()
+	shaper, err := newRowShaper(q.Get("fields"), q.Get("flatten"))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	format := q.Get("format")
+	switch format {
+	case "", "json", "csv":
+	default:
+		writeError(w, http.StatusBadRequest, "format must be json or csv")
+		return
+	}
+	// Records are this server's own types, which always convert
+	row := func(i int) map[string]interface{} {
+		converted, err := exportRow(record(i))
+		if err != nil {
+			return nil
+		}
+		return shaper.shape(converted)
+	}
+
+	if format == "csv" {
+		if !shaper.fixedColumns() {
+			for i := 0; i < n; i++ {
+				row(i)
+			}
+		}
+		columns := shaper.columns()
+		w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+		w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s.csv"`, name))
+		cw := csv.NewWriter(w)
+		header := make([]string, len(columns))
+		for j, column := range columns {
+			header[j] = csvCell(column)
+		}
+		cw.Write(header)
+		for i := 0; i < n; i++ {
+			shaped := row(i)
+			if shaped == nil {
+				continue
+			}
+			cells := make([]string, len(columns))
+			for j, column := range columns {
+				cells[j] = csvCell(shaped[column])
+			}
+			cw.Write(cells)
+		}
+		cw.Flush()
+		return
+	}
+
+	stream := newJSONStream(w, http.StatusOK)
+	stream.raw(`{"rows":[`)
+	for i := 0; i < n && stream.err == nil; i++ {
+		if shaped := row(i); shaped != nil {
+			stream.element(shaped)
+		}
+	}
+	stream.raw(`],"columns":`)
+	stream.value(shaper.columns())
+	stream.raw("}\n")
+}
+
+// ExportServices handles GET /api/export/services, the services of the site
+// selected by ?site=.
+func (s *MDNSServer) ExportServices(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	services := s.listServices(s.siteParam(r))
+	writeExport(w, r, "services", len(services), func(i int) interface{} { return services[i] })
+}
+
+// ExportDevices handles GET /api/export/devices, the devices of the site
+// selected by ?site= as listed on /api/devices.
+func (s *MDNSServer) ExportDevices(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	site := s.siteParam(r)
+	devices, err := s.filteredDevices(r, site)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	writeExport(w, r, "devices", len(devices), func(i int) interface{} { return devices[i] })
+}
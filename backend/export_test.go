@@ -0,0 +1,116 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// TestExportFieldMapping verifies ?fields= renames columns and collects
+// values from lists
+func TestExportFieldMapping(t *testing.T) {
+	rows := []map[string]interface{}{{
+		"name":       "NAS",
+		"port":       float64(445),
+		"interfaces": []interface{}{map[string]interface{}{"name": "en0"}, map[string]interface{}{"name": "en5"}},
+	}}
+
+	shaped, columns, err := shapeRows(rows, "Asset=name,Port=port,Seen on=interfaces.name,First=interfaces.0.name", "")
+	if err != nil {
+		t.Fatalf("Failed to shape rows: %v", err)
+	}
+	if strings.Join(columns, ",") != "Asset,Port,Seen on,First" {
+		t.Fatalf("Expected the mapping's column order, got %v", columns)
+	}
+	row := shaped[0]
+	if cellValue(row["Asset"]) != "NAS" || cellValue(row["Port"]) != "445" || cellValue(row["Seen on"]) != "en0; en5" || cellValue(row["First"]) != "en0" {
+		t.Fatalf("Unexpected row %+v", row)
+	}
+
+	if _, _, err := shapeRows(rows, "Asset=name,Asset=host", ""); err == nil {
+		t.Fatalf("Expected an error for a duplicate column")
+	}
+}
+
+// TestExportFlatten verifies ?flatten= spreads nested values over dotted
+// columns
+func TestExportFlatten(t *testing.T) {
+	rows := []map[string]interface{}{{
+		"name":       "NAS",
+		"txt":        map[string]interface{}{"model": "DS220"},
+		"interfaces": []interface{}{map[string]interface{}{"name": "en0", "lastSeen": float64(100)}},
+	}}
+
+	shaped, columns, err := shapeRows(rows, "", "txt,interfaces")
+	if err != nil {
+		t.Fatalf("Failed to shape rows: %v", err)
+	}
+	if strings.Join(columns, ",") != "interfaces.0.lastSeen,interfaces.0.name,name,txt.model" {
+		t.Fatalf("Unexpected columns %v", columns)
+	}
+	if shaped[0]["txt.model"] != "DS220" {
+		t.Fatalf("Expected txt.model to be DS220, got %+v", shaped[0])
+	}
+}
+
+// TestExportServicesCSV verifies the CSV export
+func TestExportServicesCSV(t *testing.T) {
+	server := NewMDNSServer()
+	server.addService("a", &MDNSService{Name: "NAS", Type: "_smb._tcp.local.", Host: "nas.local", IP: "192.168.1.10", Port: 445})
+
+	rec := httptest.NewRecorder()
+	server.ExportServices(rec, httptest.NewRequest(http.MethodGet, "/api/export/services?format=csv&fields=Name=name,IP=ip,Port=port", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Expected 200, got %d: %s", rec.Code, rec.Body)
+	}
+	if got := rec.Body.String(); got != "Name,IP,Port\nNAS,192.168.1.10,445\n" {
+		t.Fatalf("Unexpected CSV %q", got)
+	}
+}
+
+// TestExportCSVFormulas verifies CSV cells that a spreadsheet would run as
+// formulas are exported as text
+func TestExportCSVFormulas(t *testing.T) {
+	server := NewMDNSServer()
+	server.addService("a", &MDNSService{Name: `=HYPERLINK("http://evil.example","NAS")`, Type: "_smb._tcp.local.", Host: "@nas.local", IP: "192.168.1.10", Port: 445, TXT: map[string]string{"model": "-1+1"}})
+
+	rec := httptest.NewRecorder()
+	server.ExportServices(rec, httptest.NewRequest(http.MethodGet, "/api/export/services?format=csv&fields=Name=name,Host=host,Model=txt.model,Port=port,%2BTTL=ttl", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Expected 200, got %d: %s", rec.Code, rec.Body)
+	}
+	want := "Name,Host,Model,Port,'+TTL\n\"'=HYPERLINK(\"\"http://evil.example\"\",\"\"NAS\"\")\",'@nas.local,'-1+1,445,\n"
+	if got := rec.Body.String(); got != want {
+		t.Fatalf("Expected formulas to be prefixed with ', got %q", got)
+	}
+
+	if csvCell(float64(-70)) != "-70" || csvCell("\tx") != "'\tx" || csvCell("NAS") != "NAS" {
+		t.Fatalf("Expected only text cells to be prefixed")
+	}
+}
+
+// TestExportServicesJSON verifies the streamed JSON export lists the union
+// of the rows' columns after them
+func TestExportServicesJSON(t *testing.T) {
+	server := NewMDNSServer()
+	server.addService("a", &MDNSService{Name: "NAS", Type: "_smb._tcp.local.", Host: "nas.local", IP: "192.168.1.10", Port: 445})
+	server.addService("b", &MDNSService{Name: "TV", Type: "_googlecast._tcp.local.", IP: "192.168.1.11", Port: 8009})
+
+	rec := httptest.NewRecorder()
+	server.ExportServices(rec, httptest.NewRequest(http.MethodGet, "/api/export/services?flatten=interfaces", nil))
+	var export struct {
+		Columns []string                 `json:"columns"`
+		Rows    []map[string]interface{} `json:"rows"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &export); err != nil || rec.Code != http.StatusOK {
+		t.Fatalf("Expected a JSON export, got %d %v: %s", rec.Code, err, rec.Body)
+	}
+	if len(export.Rows) != 2 || export.Rows[0]["name"] != "TV" || export.Rows[1]["interfaces.0.name"] != "en5" {
+		t.Fatalf("Expected both services flattened, got %+v", export.Rows)
+	}
+	if !strings.Contains(strings.Join(export.Columns, ","), "host,interfaces.0.lastSeen,interfaces.0.name,ip") {
+		t.Fatalf("Expected the columns of every row, got %v", export.Columns)
+	}
+}
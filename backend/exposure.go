@@ -0,0 +1,443 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// maxPortMappings bounds how many UPnP port mappings are read.
+const maxPortMappings = 256
+
+// PortMapping is a port forwarded by the gateway over UPnP IGD.
+type PortMapping struct {
+	Protocol       string `json:"protocol"` // TCP or UDP
+	ExternalPort   uint16 `json:"externalPort"`
+	InternalClient string `json:"internalClient"`
+	InternalPort   uint16 `json:"internalPort"`
+	Enabled        bool   `json:"enabled"`
+	Description    string `json:"description,omitempty"`
+	LeaseDuration  uint32 `json:"leaseDuration"` // seconds, 0 for permanent
+}
+
+// upnpWANConnection finds the control URL of the WAN connection service in
+// a UPnP description fetched from location.
+func upnpWANConnection(data []byte, location string) (serviceType, controlURL string, err error) {
+	var root struct {
+		URLBase string     `xml:"URLBase"`
+		Device  upnpDevice `xml:"device"`
+	}
+	if err := xml.Unmarshal(data, &root); err != nil {
+		return "", "", err
+	}
+	base, err := url.Parse(location)
+	if err != nil {
+		return "", "", err
+	}
+	if root.URLBase != "" {
+		if u, err := url.Parse(root.URLBase); err == nil {
+			base = u
+		}
+	}
+
+	var find func(d upnpDevice) bool
+	find = func(d upnpDevice) bool {
+		for _, s := range d.Services {
+			if strings.Contains(s.ServiceType, ":WANIPConnection:") || strings.Contains(s.ServiceType, ":WANPPPConnection:") {
+				if u, err := base.Parse(s.ControlURL); err == nil {
+					serviceType, controlURL = s.ServiceType, u.String()
+					return true
+				}
+			}
+		}
+		for _, child := range d.Devices {
+			if find(child) {
+				return true
+			}
+		}
+		return false
+	}
+	if !find(root.Device) {
+		return "", "", errors.New("no WAN connection service")
+	}
+	return serviceType, controlURL, nil
+}
+
+// errSOAPFault is returned for SOAP faults, which end the port mapping
+// list.
+var errSOAPFault = errors.New("SOAP fault")
+
+// soapCall invokes action of a UPnP service and returns the arguments of
+// its response.
+func soapCall(ctx context.Context, client *http.Client, controlURL, serviceType, action string, args map[string]string) (map[string]string, error) {
+	var body bytes.Buffer
+	body.WriteString(`<?xml version="1.0"?><s:Envelope xmlns:s="http://schemas.xmlsoap.org/soap/envelope/" s:encodingStyle="http://schemas.xmlsoap.org/soap/encoding/"><s:Body>`)
+	fmt.Fprintf(&body, `<u:%s xmlns:u="%s">`, action, serviceType)
+	for name, value := range args {
+		fmt.Fprintf(&body, "<%s>", name)
+		xml.EscapeText(&body, []byte(value))
+		fmt.Fprintf(&body, "</%s>", name)
+	}
+	fmt.Fprintf(&body, `</u:%s></s:Body></s:Envelope>`, action)
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, controlURL, &body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", `text/xml; charset="utf-8"`)
+	req.Header.Set("SOAPAction", `"`+serviceType+"#"+action+`"`)
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusInternalServerError {
+		return nil, errSOAPFault
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s: %s", action, resp.Status)
+	}
+
+	// The response arguments are the children of the one element in the
+	// body
+	var envelope struct {
+		Body struct {
+			Response struct {
+				Args []struct {
+					XMLName xml.Name
+					Value   string `xml:",chardata"`
+				} `xml:",any"`
+			} `xml:",any"`
+		} `xml:"Body"`
+	}
+	data, _ := io.ReadAll(io.LimitReader(resp.Body, 64*1024))
+	if err := xml.Unmarshal(data, &envelope); err != nil {
+		return nil, err
+	}
+	result := make(map[string]string)
+	for _, arg := range envelope.Body.Response.Args {
+		result[arg.XMLName.Local] = strings.TrimSpace(arg.Value)
+	}
+	return result, nil
+}
+
+// upnpPortMappings lists the gateway's port mappings and its external
+// address.
+func upnpPortMappings(ctx context.Context, client *http.Client, serviceType, controlURL string) ([]PortMapping, string, error) {
+	var external string
+	if result, err := soapCall(ctx, client, controlURL, serviceType, "GetExternalIPAddress", nil); err == nil {
+		external = result["NewExternalIPAddress"]
+	}
+
+	mappings := []PortMapping{}
+	for i := 0; i < maxPortMappings; i++ {
+		result, err := soapCall(ctx, client, controlURL, serviceType, "GetGenericPortMappingEntry", map[string]string{
+			"NewPortMappingIndex": strconv.Itoa(i),
+		})
+		if errors.Is(err, errSOAPFault) {
+			break // past the last entry
+		}
+		if err != nil {
+			return mappings, external, err
+		}
+		externalPort, _ := strconv.ParseUint(result["NewExternalPort"], 10, 16)
+		internalPort, _ := strconv.ParseUint(result["NewInternalPort"], 10, 16)
+		lease, _ := strconv.ParseUint(result["NewLeaseDuration"], 10, 32)
+		mappings = append(mappings, PortMapping{
+			Protocol:       strings.ToUpper(result["NewProtocol"]),
+			ExternalPort:   uint16(externalPort),
+			InternalClient: result["NewInternalClient"],
+			InternalPort:   uint16(internalPort),
+			Enabled:        result["NewEnabled"] == "1" || strings.EqualFold(result["NewEnabled"], "true"),
+			Description:    result["NewPortMappingDescription"],
+			LeaseDuration:  uint32(lease),
+		})
+	}
+	return mappings, external, nil
+}
+
+// ExternalCheck is the answer of the external reachability endpoint.
+type ExternalCheck struct {
+	Port  uint16 `json:"port"` // the public port tested
+	Open  bool   `json:"open"`
+	Error string `json:"error,omitempty"`
+}
+
+// Exposure is whether a discovered service appears reachable from the
+// internet.
+type Exposure struct {
+	Device   string         `json:"device"`
+	Name     string         `json:"name"`
+	Type     string         `json:"type"`
+	IP       string         `json:"ip"`
+	Port     uint16         `json:"port"`
+	Protocol string         `json:"protocol"`
+	Exposed  bool           `json:"exposed"`
+	Mapping  *PortMapping   `json:"mapping,omitempty"`  // the enabled mapping forwarding to it
+	External *ExternalCheck `json:"external,omitempty"` // with -exposure-check-url
+}
+
+// ExposureChecker finds discovered services the gateway forwards ports to
+// over UPnP and, with a user-configured endpoint, tests whether their
+// ports answer from the internet. Newly exposed services are reported as
+// "service-exposed" anomalies.
+type ExposureChecker struct {
+	// checkURL is called with {ip}, {port} and {protocol} replaced by the
+	// public address (empty when the gateway doesn't tell), port and
+	// protocol, and answers {"open": bool}
+	checkURL string
+	bus      *EventBus
+	client   *http.Client
+	// gateway returns the gateway's UPnP description URL; replaced in tests
+	gateway func() (string, error)
+
+	mu        sync.Mutex
+	results   []Exposure
+	external  string // the public address
+	mappings  []PortMapping
+	checkedAt time.Time
+	exposed   map[string]bool // services reported exposed
+}
+
+func NewExposureChecker(checkURL string, bus *EventBus) *ExposureChecker {
+	return &ExposureChecker{
+		checkURL: checkURL,
+		bus:      bus,
+		client:   &http.Client{Timeout: 5 * time.Second},
+		gateway:  gatewayUPnPLocation,
+		exposed:  make(map[string]bool),
+	}
+}
+
+// gatewayUPnPLocation returns the description URL of the default gateway.
+func gatewayUPnPLocation() (string, error) {
+	ip, err := defaultGateway()
+	if err != nil {
+		return "", err
+	}
+	if err := scanScope.check(ip); err != nil {
+		return "", err
+	}
+	location, err := ssdpLocation(ip, 2*time.Second)
+	if err != nil {
+		return "", fmt.Errorf("no UPnP answer from the gateway: %v", err)
+	}
+	if u, err := url.Parse(location); err != nil || u.Hostname() != ip {
+		return "", errors.New("UPnP description isn't served by the gateway")
+	}
+	return location, nil
+}
+
+// portMappings reads the gateway's current mappings.
+func (e *ExposureChecker) portMappings(ctx context.Context) ([]PortMapping, string, error) {
+	location, err := e.gateway()
+	if err != nil {
+		return nil, "", err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, location, nil)
+	if err != nil {
+		return nil, "", err
+	}
+	resp, err := e.client.Do(req)
+	if err != nil {
+		return nil, "", err
+	}
+	data, _ := io.ReadAll(io.LimitReader(resp.Body, 256*1024))
+	resp.Body.Close()
+	serviceType, controlURL, err := upnpWANConnection(data, location)
+	if err != nil {
+		return nil, "", err
+	}
+	return upnpPortMappings(ctx, e.client, serviceType, controlURL)
+}
+
+// externalCheck asks the check endpoint whether port is open on ip.
+func (e *ExposureChecker) externalCheck(ctx context.Context, ip string, port uint16, protocol string) *ExternalCheck {
+	check := &ExternalCheck{Port: port}
+	target := strings.NewReplacer(
+		"{ip}", url.QueryEscape(ip),
+		"{port}", strconv.Itoa(int(port)),
+		"{protocol}", strings.ToLower(protocol),
+	).Replace(e.checkURL)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, target, nil)
+	if err != nil {
+		check.Error = err.Error()
+		return check
+	}
+	resp, err := e.client.Do(req)
+	if err != nil {
+		check.Error = err.Error()
+		return check
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		check.Error = resp.Status
+		return check
+	}
+	var answer struct {
+		Open bool `json:"open"`
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 64*1024)).Decode(&answer); err != nil {
+		check.Error = err.Error()
+		return check
+	}
+	check.Open = answer.Open
+	return check
+}
+
+// Check examines services, publishing an anomaly for each one that is
+// newly exposed. The gateway's mapping error is returned along with the
+// results, which then only come from the external endpoint.
+func (e *ExposureChecker) Check(ctx context.Context, services []MDNSService) ([]Exposure, error) {
+	mappings, external, mappingErr := e.portMappings(ctx)
+
+	results := make([]Exposure, 0, len(services))
+	for _, service := range services {
+		exposure := Exposure{
+			Device:   deviceID(&service),
+			Name:     service.Name,
+			Type:     service.Type,
+			IP:       service.IP,
+			Port:     service.Port,
+			Protocol: "TCP",
+		}
+		if strings.Contains(service.Type, "._udp") {
+			exposure.Protocol = "UDP"
+		}
+		for _, mapping := range mappings {
+			if mapping.Enabled && mapping.Protocol == exposure.Protocol && mapping.InternalClient == service.IP && mapping.InternalPort == service.Port {
+				exposure.Mapping = &mapping
+				exposure.Exposed = true
+				break
+			}
+		}
+		results = append(results, exposure)
+	}
+
+	if e.checkURL != "" {
+		var wg sync.WaitGroup
+		for i := range results {
+			// The forwarded port when mapped, otherwise the same port
+			port := results[i].Port
+			if results[i].Mapping != nil {
+				port = results[i].Mapping.ExternalPort
+			}
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				results[i].External = e.externalCheck(ctx, external, port, results[i].Protocol)
+				if results[i].External.Open {
+					results[i].Exposed = true
+				}
+			}()
+		}
+		wg.Wait()
+	}
+
+	var reported []Exposure
+	e.mu.Lock()
+	for _, exposure := range results {
+		key := exposure.IP + ":" + exposure.Protocol + ":" + strconv.Itoa(int(exposure.Port))
+		if exposure.Exposed && !e.exposed[key] {
+			reported = append(reported, exposure)
+		}
+		e.exposed[key] = exposure.Exposed
+	}
+	e.results, e.external, e.mappings, e.checkedAt = results, external, mappings, time.Now()
+	e.mu.Unlock()
+
+	for _, exposure := range reported {
+		params := map[string]string{"name": exposure.Name, "type": exposure.Type, "ip": exposure.IP, "port": strconv.Itoa(int(exposure.Port))}
+		key := "service-exposed-external"
+		if exposure.Mapping != nil {
+			key = "service-exposed-upnp"
+			params["externalPort"] = strconv.Itoa(int(exposure.Mapping.ExternalPort))
+		}
+		event := newAnomaly("service-exposed", key, params)
+		event.Device, event.Severity = exposure.Device, "medium"
+		e.bus.Publish(TopicAnomaly, event)
+	}
+	return results, mappingErr
+}
+
+// Exposure handles /api/exposure. GET returns the last check; POST checks
+// the services given as "ip:port" in {"services": [...]}, or every service
+// of the local site when none are.
+func (s *MDNSServer) Exposure(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		e := s.exposure
+		e.mu.Lock()
+		response := map[string]interface{}{
+			"externalCheck": e.checkURL != "",
+			"services":      append([]Exposure{}, e.results...),
+			"mappings":      append([]PortMapping{}, e.mappings...),
+		}
+		if e.external != "" {
+			response["externalIp"] = e.external
+		}
+		if !e.checkedAt.IsZero() {
+			response["checkedAt"] = e.checkedAt.Unix()
+		}
+		e.mu.Unlock()
+		writeJSON(w, http.StatusOK, response)
+
+	case http.MethodPost:
+		var req struct {
+			Services []string `json:"services"`
+		}
+		if r.ContentLength != 0 {
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+				writeError(w, http.StatusBadRequest, err.Error())
+				return
+			}
+		}
+		selected := make(map[string]bool)
+		for _, target := range req.Services {
+			host, port, err := net.SplitHostPort(target)
+			if err != nil || net.ParseIP(host) == nil {
+				writeError(w, http.StatusBadRequest, "services must be ip:port, got "+strconv.Quote(target))
+				return
+			}
+			selected[net.JoinHostPort(net.ParseIP(host).String(), port)] = true
+		}
+
+		var services []MDNSService
+		for _, service := range s.listServices(s.site) {
+			if service.IP == "" || service.Port == 0 {
+				continue
+			}
+			if len(selected) == 0 || selected[net.JoinHostPort(service.IP, strconv.Itoa(int(service.Port)))] {
+				services = append(services, service)
+			}
+		}
+		sort.Slice(services, func(i, j int) bool {
+			if services[i].IP != services[j].IP {
+				return services[i].IP < services[j].IP
+			}
+			return services[i].Port < services[j].Port
+		})
+
+		results, err := s.exposure.Check(r.Context(), services)
+		response := map[string]interface{}{"services": results}
+		if err != nil {
+			response["upnpError"] = err.Error()
+		}
+		writeJSON(w, http.StatusOK, response)
+
+	default:
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+	}
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// testIGD serves a UPnP description with a WAN IP connection service that
+// forwards public port 8443 to 10.0.0.2:445.
+func testIGD(t *testing.T) *httptest.Server {
+	igd := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/desc.xml":
+			w.Write([]byte(`<?xml version="1.0"?><root xmlns="urn:schemas-upnp-org:device-1-0"><device>
+<deviceType>urn:schemas-upnp-org:device:InternetGatewayDevice:1</deviceType>
+<deviceList><device><deviceList><device><serviceList><service>
+<serviceType>urn:schemas-upnp-org:service:WANIPConnection:1</serviceType>
+<controlURL>/ctl/IPConn</controlURL>
+</service></serviceList></device></deviceList></device></deviceList></device></root>`))
+		case "/ctl/IPConn":
+			body, _ := io.ReadAll(r.Body)
+			action := r.Header.Get("SOAPAction")
+			switch {
+			case strings.HasSuffix(action, `#GetExternalIPAddress"`):
+				w.Write([]byte(`<s:Envelope xmlns:s="http://schemas.xmlsoap.org/soap/envelope/"><s:Body><u:GetExternalIPAddressResponse xmlns:u="urn:schemas-upnp-org:service:WANIPConnection:1"><NewExternalIPAddress>203.0.113.5</NewExternalIPAddress></u:GetExternalIPAddressResponse></s:Body></s:Envelope>`))
+			case strings.Contains(string(body), "<NewPortMappingIndex>0</NewPortMappingIndex>"):
+				w.Write([]byte(`<s:Envelope xmlns:s="http://schemas.xmlsoap.org/soap/envelope/"><s:Body><u:GetGenericPortMappingEntryResponse xmlns:u="urn:schemas-upnp-org:service:WANIPConnection:1">
+<NewRemoteHost></NewRemoteHost><NewExternalPort>8443</NewExternalPort><NewProtocol>TCP</NewProtocol><NewInternalPort>445</NewInternalPort>
+<NewInternalClient>10.0.0.2</NewInternalClient><NewEnabled>1</NewEnabled><NewPortMappingDescription>nas</NewPortMappingDescription><NewLeaseDuration>0</NewLeaseDuration>
+</u:GetGenericPortMappingEntryResponse></s:Body></s:Envelope>`))
+			default:
+				w.WriteHeader(http.StatusInternalServerError)
+			}
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	t.Cleanup(igd.Close)
+	return igd
+}
+
+// TestExposureCheck verifies that services are exposed by a UPnP mapping
+// or by the external check answering for their port, and that each is
+// reported once.
+func TestExposureCheck(t *testing.T) {
+	igd := testIGD(t)
+	checker := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]bool{"open": r.URL.Query().Get("port") == "80" && r.URL.Query().Get("ip") == "203.0.113.5"})
+	}))
+	defer checker.Close()
+
+	server := NewMDNSServer()
+	var anomalies []AnomalyEvent
+	server.bus.Subscribe("test", func(e BusEvent) { anomalies = append(anomalies, e.Payload.(AnomalyEvent)) }, TopicAnomaly)
+	server.exposure.checkURL = checker.URL + "/?ip={ip}&port={port}&proto={protocol}"
+	server.exposure.gateway = func() (string, error) { return igd.URL + "/desc.xml", nil }
+	server.addService("10.0.0.2:_smb._tcp.local.:445", &MDNSService{Name: "nas", Host: "nas.local", IP: "10.0.0.2", Type: "_smb._tcp.local.", Port: 445})
+	server.addService("10.0.0.3:_http._tcp.local.:80", &MDNSService{Name: "web", Host: "web.local", IP: "10.0.0.3", Type: "_http._tcp.local.", Port: 80})
+	server.addService("10.0.0.5:_ipp._tcp.local.:631", &MDNSService{Name: "printer", Host: "printer.local", IP: "10.0.0.5", Type: "_ipp._tcp.local.", Port: 631})
+
+	check := func(body string) []Exposure {
+		rec := httptest.NewRecorder()
+		server.Exposure(rec, httptest.NewRequest(http.MethodPost, "/api/exposure", strings.NewReader(body)))
+		var resp struct {
+			Services  []Exposure `json:"services"`
+			UPnPError string     `json:"upnpError"`
+		}
+		json.NewDecoder(rec.Body).Decode(&resp)
+		if resp.UPnPError != "" {
+			t.Fatalf("Unexpected UPnP error %s", resp.UPnPError)
+		}
+		return resp.Services
+	}
+
+	results := check("")
+	if len(results) != 3 {
+		t.Fatalf("Expected every service to be checked, got %+v", results)
+	}
+	nas, web, printer := results[0], results[1], results[2]
+	if !nas.Exposed || nas.Mapping == nil || nas.Mapping.ExternalPort != 8443 || nas.External == nil || nas.External.Port != 8443 || nas.External.Open {
+		t.Fatalf("Expected the NAS to be exposed by its mapping, got %+v", nas)
+	}
+	if !web.Exposed || web.Mapping != nil || !web.External.Open {
+		t.Fatalf("Expected the web server to answer from the internet, got %+v", web)
+	}
+	if printer.Exposed {
+		t.Fatalf("Expected the printer not to be exposed, got %+v", printer)
+	}
+	if len(anomalies) != 2 || anomalies[0].Kind != "service-exposed" || anomalies[0].Device != "nas.local" {
+		t.Fatalf("Expected two service-exposed anomalies, got %+v", anomalies)
+	}
+
+	results = check(`{"services": ["10.0.0.2:445"]}`)
+	if len(results) != 1 || results[0].IP != "10.0.0.2" || len(anomalies) != 2 {
+		t.Fatalf("Expected only the selected service and no new anomaly, got %+v %+v", results, anomalies)
+	}
+
+	rec := httptest.NewRecorder()
+	server.Exposure(rec, httptest.NewRequest(http.MethodGet, "/api/exposure", nil))
+	var last struct {
+		ExternalIP string        `json:"externalIp"`
+		Mappings   []PortMapping `json:"mappings"`
+	}
+	json.NewDecoder(rec.Body).Decode(&last)
+	if last.ExternalIP != "203.0.113.5" || len(last.Mappings) != 1 || last.Mappings[0].Description != "nas" {
+		t.Fatalf("Unexpected last check %+v", last)
+	}
+
+	if _, err := server.exposure.Check(context.Background(), nil); err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	rec = httptest.NewRecorder()
+	server.Exposure(rec, httptest.NewRequest(http.MethodPost, "/api/exposure", strings.NewReader(`{"services": ["nas.local"]}`)))
+	if rec.Code != http.StatusBadRequest {
+		t.Fatalf("Expected 400 for a service that isn't ip:port, got %d", rec.Code)
+	}
+}
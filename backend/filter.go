@@ -0,0 +1,412 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// filterFieldNames are the fields filter conditions can test. Services and
+// devices have all of them; a device has every address, port, type and
+// name of its services.
+var filterFieldNames = []string{
+	"type", "name", "host", "device", "ip", "port", "subnet", "site",
+	"mac", "vendor", "category", "owner", "location", "tag", "interface",
+}
+
+// filterFields returns the values a subject has for a field; a condition
+// holds if any of them matches.
+type filterFields func(field string) []string
+
+// Filter is a parsed filter expression, the one syntax for selecting
+// services and devices everywhere the API takes a ?filter=, e.g.
+//
+//	type=_ssh._tcp AND vendor~"Raspberry" AND subnet=10.0.1.0/24
+//
+// Conditions compare a field against a value with = and != (equal, ignoring
+// case), ~ and !~ (contains, ignoring case), or <, <=, > and >= (numbers).
+// A subnet condition tests whether an address lies in a CIDR prefix.
+// Conditions combine with AND, OR (binding looser) and NOT, and group with
+// parentheses. Values with spaces or operator characters are quoted.
+type Filter struct {
+	source string
+	root   filterNode
+}
+
+type filterNode interface {
+	match(fields filterFields) bool
+}
+
+type filterAnd struct{ left, right filterNode }
+type filterOr struct{ left, right filterNode }
+type filterNot struct{ node filterNode }
+
+func (n filterAnd) match(fields filterFields) bool {
+	return n.left.match(fields) && n.right.match(fields)
+}
+func (n filterOr) match(fields filterFields) bool {
+	return n.left.match(fields) || n.right.match(fields)
+}
+func (n filterNot) match(fields filterFields) bool { return !n.node.match(fields) }
+
+// filterCondition is one field comparison.
+type filterCondition struct {
+	field, op, value string
+	number           float64    // for <, <=, > and >=
+	prefix           *net.IPNet // for subnet
+}
+
+func (c filterCondition) match(fields filterFields) bool {
+	values := fields(c.field)
+	negated := c.op == "!=" || c.op == "!~"
+	for _, value := range values {
+		if c.matchValue(value) {
+			return !negated
+		}
+	}
+	return negated
+}
+
+func (c filterCondition) matchValue(value string) bool {
+	switch c.op {
+	case "=", "!=":
+		if c.prefix != nil {
+			ip := net.ParseIP(value)
+			return ip != nil && c.prefix.Contains(ip)
+		}
+		return normalizeFilterValue(c.field, value) == c.value
+	case "~", "!~":
+		return strings.Contains(strings.ToLower(value), c.value)
+	}
+	n, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		return false
+	}
+	switch c.op {
+	case "<":
+		return n < c.number
+	case "<=":
+		return n <= c.number
+	case ">":
+		return n > c.number
+	default:
+		return n >= c.number
+	}
+}
+
+// normalizeFilterValue makes the spellings of a value compare equal:
+// "_ssh._tcp.local." and "_ssh._tcp", or "NAS.local." and "nas.local".
+func normalizeFilterValue(field, value string) string {
+	value = strings.ToLower(value)
+	switch field {
+	case "type":
+		return strings.TrimSuffix(strings.TrimSuffix(value, "."), ".local")
+	case "host", "device":
+		return strings.TrimSuffix(value, ".")
+	case "mac":
+		return normalizeMAC(value)
+	}
+	return value
+}
+
+// ParseFilter parses a filter expression. An empty expression is a nil
+// Filter, which matches everything.
+func ParseFilter(expr string) (*Filter, error) {
+	tokens, err := lexFilter(expr)
+	if err != nil {
+		return nil, err
+	}
+	if len(tokens) == 0 {
+		return nil, nil
+	}
+	p := &filterParser{tokens: tokens}
+	root, err := p.or()
+	if err != nil {
+		return nil, err
+	}
+	if p.pos < len(p.tokens) {
+		return nil, fmt.Errorf("unexpected %q in filter", p.tokens[p.pos].text)
+	}
+	return &Filter{source: expr, root: root}, nil
+}
+
+// Match reports whether the subject whose fields are given matches.
+func (f *Filter) Match(fields filterFields) bool {
+	return f == nil || f.root.match(fields)
+}
+
+// String returns the expression the filter was parsed from.
+func (f *Filter) String() string {
+	if f == nil {
+		return ""
+	}
+	return f.source
+}
+
+type filterToken struct {
+	kind string // "word", "string", "op", "(" or ")"
+	text string
+}
+
+var filterOperators = []string{"!=", "!~", "<=", ">=", "=", "~", "<", ">"}
+
+func lexFilter(expr string) ([]filterToken, error) {
+	var tokens []filterToken
+	runes := []rune(expr)
+	for i := 0; i < len(runes); {
+		r := runes[i]
+		switch {
+		case unicode.IsSpace(r):
+			i++
+		case r == '(' || r == ')':
+			tokens = append(tokens, filterToken{kind: string(r), text: string(r)})
+			i++
+		case r == '"':
+			var b strings.Builder
+			i++
+			for ; i < len(runes) && runes[i] != '"'; i++ {
+				if runes[i] == '\\' && i+1 < len(runes) {
+					i++
+				}
+				b.WriteRune(runes[i])
+			}
+			if i == len(runes) {
+				return nil, fmt.Errorf("unterminated string in filter")
+			}
+			tokens = append(tokens, filterToken{kind: "string", text: b.String()})
+			i++
+		default:
+			if op := filterOperatorAt(runes[i:]); op != "" {
+				tokens = append(tokens, filterToken{kind: "op", text: op})
+				i += len(op)
+				continue
+			}
+			start := i
+			for i < len(runes) && !unicode.IsSpace(runes[i]) && !strings.ContainsRune(`()"`, runes[i]) && filterOperatorAt(runes[i:]) == "" {
+				i++
+			}
+			tokens = append(tokens, filterToken{kind: "word", text: string(runes[start:i])})
+		}
+	}
+	return tokens, nil
+}
+
+func filterOperatorAt(runes []rune) string {
+	for _, op := range filterOperators {
+		if strings.HasPrefix(string(runes[:min(len(runes), 2)]), op) {
+			return op
+		}
+	}
+	return ""
+}
+
+type filterParser struct {
+	tokens []filterToken
+	pos    int
+}
+
+func (p *filterParser) keyword(word string) bool {
+	if p.pos < len(p.tokens) && p.tokens[p.pos].kind == "word" && strings.EqualFold(p.tokens[p.pos].text, word) {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+func (p *filterParser) or() (filterNode, error) {
+	left, err := p.and()
+	for err == nil && p.keyword("OR") {
+		var right filterNode
+		if right, err = p.and(); err == nil {
+			left = filterOr{left, right}
+		}
+	}
+	return left, err
+}
+
+func (p *filterParser) and() (filterNode, error) {
+	left, err := p.not()
+	for err == nil && p.keyword("AND") {
+		var right filterNode
+		if right, err = p.not(); err == nil {
+			left = filterAnd{left, right}
+		}
+	}
+	return left, err
+}
+
+func (p *filterParser) not() (filterNode, error) {
+	if p.keyword("NOT") {
+		node, err := p.not()
+		return filterNot{node}, err
+	}
+	return p.primary()
+}
+
+func (p *filterParser) primary() (filterNode, error) {
+	if p.pos == len(p.tokens) {
+		return nil, fmt.Errorf("filter ends early")
+	}
+	if p.tokens[p.pos].kind == "(" {
+		p.pos++
+		node, err := p.or()
+		if err != nil {
+			return nil, err
+		}
+		if p.pos == len(p.tokens) || p.tokens[p.pos].kind != ")" {
+			return nil, fmt.Errorf("missing ) in filter")
+		}
+		p.pos++
+		return node, nil
+	}
+
+	if p.pos+2 >= len(p.tokens) {
+		return nil, fmt.Errorf("expected a condition like type=_ssh._tcp, got %q", p.tokens[p.pos].text)
+	}
+	field, op, value := p.tokens[p.pos], p.tokens[p.pos+1], p.tokens[p.pos+2]
+	if field.kind != "word" || op.kind != "op" || (value.kind != "word" && value.kind != "string") {
+		return nil, fmt.Errorf("expected a condition like type=_ssh._tcp, got %q", field.text)
+	}
+	p.pos += 3
+	return newFilterCondition(strings.ToLower(field.text), op.text, value.text)
+}
+
+func newFilterCondition(field, op, value string) (filterNode, error) {
+	known := false
+	for _, name := range filterFieldNames {
+		known = known || name == field
+	}
+	if !known {
+		return nil, fmt.Errorf("unknown filter field %q (expected one of %s)", field, strings.Join(filterFieldNames, ", "))
+	}
+	c := filterCondition{field: field, op: op, value: normalizeFilterValue(field, value)}
+	switch op {
+	case "~", "!~":
+		c.value = strings.ToLower(value)
+	case "<", "<=", ">", ">=":
+		n, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return nil, fmt.Errorf("%s%s needs a number, got %q", field, op, value)
+		}
+		c.number = n
+	}
+	if field == "subnet" {
+		_, prefix, err := net.ParseCIDR(value)
+		if err != nil || (op != "=" && op != "!=") {
+			return nil, fmt.Errorf("subnet needs = or != and a prefix like 10.0.1.0/24, got %s%s", op, value)
+		}
+		c.prefix = prefix
+	}
+	return c, nil
+}
+
+// serviceFields are the filter fields of a service. Its device's metadata
+// is looked up when a condition needs it, and its category is the one its
+// type suggests.
+func (s *MDNSServer) serviceFields(service *MDNSService) filterFields {
+	var meta *DeviceMetadata
+	metadata := func() *DeviceMetadata {
+		if meta == nil {
+			if meta = s.metadata.Get(service.Site, deviceID(service)); meta == nil {
+				meta = &DeviceMetadata{}
+			}
+		}
+		return meta
+	}
+	return func(field string) []string {
+		switch field {
+		case "type":
+			return []string{service.Type}
+		case "name":
+			return []string{service.Name}
+		case "host":
+			return []string{service.Host}
+		case "device":
+			return []string{deviceID(service)}
+		case "ip", "subnet":
+			return []string{service.IP}
+		case "port":
+			return []string{strconv.Itoa(int(service.Port))}
+		case "site":
+			return []string{service.Site}
+		case "mac":
+			return []string{neighbors.lookup(service.IP)}
+		case "vendor":
+			return []string{s.vendors.Lookup(neighbors.lookup(service.IP))}
+		case "category":
+			return []string{deviceCategory(&DeviceSummary{Services: []MDNSService{*service}})}
+		case "interface":
+			var names []string
+			for _, iface := range service.Interfaces {
+				names = append(names, iface.Name)
+			}
+			return names
+		}
+		return metadataFields(metadata(), field)
+	}
+}
+
+// deviceFields are the filter fields of a device on /api/devices.
+func deviceFields(summary *DeviceSummary) filterFields {
+	return func(field string) []string {
+		var values []string
+		switch field {
+		case "device":
+			return []string{summary.ID}
+		case "site":
+			return []string{summary.Site}
+		case "ip", "subnet":
+			return summary.Addresses
+		case "mac":
+			return []string{summary.MAC}
+		case "vendor":
+			return []string{summary.Vendor}
+		case "category":
+			return []string{summary.Category}
+		case "type", "name", "host", "port", "interface":
+			for _, service := range summary.Services {
+				switch field {
+				case "type":
+					values = append(values, service.Type)
+				case "name":
+					values = append(values, service.Name)
+				case "host":
+					values = append(values, service.Host)
+				case "port":
+					values = append(values, strconv.Itoa(int(service.Port)))
+				default:
+					for _, iface := range service.Interfaces {
+						values = append(values, iface.Name)
+					}
+				}
+			}
+			return values
+		}
+		return metadataFields(summary.DeviceMetadata, field)
+	}
+}
+
+func metadataFields(meta *DeviceMetadata, field string) []string {
+	switch field {
+	case "owner":
+		return []string{meta.Owner}
+	case "location":
+		return []string{meta.Location}
+	case "tag":
+		return meta.Tags
+	}
+	return nil
+}
+
+// ignored reports whether a service matches -ignore.
+func (s *MDNSServer) ignored(service *MDNSService) bool {
+	return s.ignore != nil && s.ignore.Match(s.serviceFields(service))
+}
+
+// filterParam parses the ?filter= expression of a request.
+func filterParam(r *http.Request) (*Filter, error) {
+	return ParseFilter(r.URL.Query().Get("filter"))
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+// TestParseFilter verifies filter expressions are parsed with AND binding
+// tighter than OR, and that malformed ones are rejected
+func TestParseFilter(t *testing.T) {
+	pi := &MDNSService{Name: "pi", Type: "_ssh._tcp.local.", Host: "pi.local.", IP: "10.0.1.7", Port: 22, Site: defaultSite}
+	printer := &MDNSService{Name: "Office Printer", Type: "_ipp._tcp.local.", Host: "printer.local.", IP: "10.0.2.9", Port: 631, Site: defaultSite}
+	server := NewMDNSServer()
+	server.metadata, _ = NewMetadataStore(openTestStore(t, "json", t.TempDir()))
+	server.metadata.Update(defaultSite, "printer.local", func(d *DeviceMetadata) { d.tag([]string{"office"}, nil) })
+
+	for _, tc := range []struct {
+		expr        string
+		pi, printer bool
+	}{
+		{"", true, true},
+		{"type=_ssh._tcp", true, false},
+		{"type=_SSH._tcp.local.", true, false},
+		{"subnet=10.0.1.0/24", true, false},
+		{"subnet!=10.0.1.0/24", false, true},
+		{`name~"office pr"`, false, true},
+		{"name!~print", true, false},
+		{"port>=600 AND port<1000", false, true},
+		{"type=_ssh._tcp OR type=_ipp._tcp AND subnet=10.0.1.0/24", true, false},
+		{"(type=_ssh._tcp OR type=_ipp._tcp) and subnet=10.0.2.0/24", false, true},
+		{"NOT device=pi.local", false, true},
+		{"tag=office", false, true},
+		{"category=printer", false, true},
+	} {
+		filter, err := ParseFilter(tc.expr)
+		if err != nil {
+			t.Fatalf("Expected %q to parse, got %v", tc.expr, err)
+		}
+		if got := filter.Match(server.serviceFields(pi)); got != tc.pi {
+			t.Fatalf("Expected %q to match pi: %v", tc.expr, tc.pi)
+		}
+		if got := filter.Match(server.serviceFields(printer)); got != tc.printer {
+			t.Fatalf("Expected %q to match the printer: %v", tc.expr, tc.printer)
+		}
+	}
+
+	for _, invalid := range []string{
+		"type", "type=", "color=red", "port>high", "subnet=10.0.1.0", "subnet~10.0", `name="open`,
+		"type=_ssh._tcp AND", "(type=_ssh._tcp", "type=_ssh._tcp port=22",
+	} {
+		if _, err := ParseFilter(invalid); err == nil {
+			t.Fatalf("Expected an error for %q", invalid)
+		}
+	}
+}
+
+// TestDevicesFilter verifies ?filter= on /api/devices matches any of a
+// device's services and addresses
+func TestDevicesFilter(t *testing.T) {
+	server := NewMDNSServer()
+	server.metadata, _ = NewMetadataStore(openTestStore(t, "json", t.TempDir()))
+	server.addService("a", &MDNSService{Name: "NAS", Type: "_smb._tcp.local.", Host: "nas.local.", IP: "10.0.1.20", Port: 445, Site: defaultSite})
+	server.addService("b", &MDNSService{Name: "NAS ssh", Type: "_ssh._tcp.local.", Host: "nas.local.", IP: "10.0.1.20", Port: 22, Site: defaultSite})
+	server.addService("c", &MDNSService{Name: "TV", Type: "_airplay._tcp.local.", Host: "tv.local.", IP: "10.0.3.5", Port: 7000, Site: defaultSite})
+
+	get := func(filter string) (int, []string) {
+		w := httptest.NewRecorder()
+		server.Devices(w, httptest.NewRequest(http.MethodGet, "/api/devices?filter="+url.QueryEscape(filter), nil))
+		var resp struct {
+			Devices []*DeviceSummary `json:"devices"`
+		}
+		json.Unmarshal(w.Body.Bytes(), &resp)
+		var ids []string
+		for _, d := range resp.Devices {
+			ids = append(ids, d.ID)
+		}
+		return w.Code, ids
+	}
+	if code, ids := get("type=_ssh._tcp AND category=storage"); code != http.StatusOK || len(ids) != 1 || ids[0] != "nas.local" {
+		t.Fatalf("Expected only the NAS, got %d %v", code, ids)
+	}
+	if _, ids := get("NOT subnet=10.0.1.0/24"); len(ids) != 1 || ids[0] != "tv.local" {
+		t.Fatalf("Expected only the TV, got %v", ids)
+	}
+	if code, _ := get("type=="); code != http.StatusBadRequest {
+		t.Fatalf("Expected 400 for an invalid filter, got %d", code)
+	}
+}
+
+// TestIgnoreFilter verifies services matching -ignore are never listed
+func TestIgnoreFilter(t *testing.T) {
+	server := NewMDNSServer()
+	server.ignore, _ = ParseFilter("type=_googlezone._tcp")
+	server.publishService(sourceMulticast, "a", &MDNSService{Name: "zone", Type: "_googlezone._tcp.local.", IP: "10.0.1.9", Port: 10001}, time.Now())
+	server.publishService(sourceMulticast, "b", &MDNSService{Name: "cast", Type: "_googlecast._tcp.local.", IP: "10.0.1.9", Port: 8009}, time.Now())
+	if services := server.listServices(""); len(services) != 1 || services[0].Name != "cast" {
+		t.Fatalf("Expected only the cast service, got %+v", services)
+	}
+}
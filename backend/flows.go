@@ -0,0 +1,356 @@
+package main
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// Flow table bounds.
+const (
+	flowIdleTimeout   = 10 * time.Minute // flows without packets for this long are dropped
+	maxFlowsPerDevice = 1024
+	rdnsConcurrency   = 4
+	rdnsTimeout       = 2 * time.Second
+	maxRDNSCache      = 10000
+	maxDNSNames       = 20000
+	minDNSNameTTL     = 10 * time.Minute
+)
+
+var flowProtocols = map[uint8]string{1: "icmp", protoTCP: "tcp", protoUDP: "udp", 58: "icmpv6"}
+
+// flowKey identifies a flow of a device: the remote address and the
+// service port. Connections to the same service from different ephemeral
+// ports are one flow.
+type flowKey struct {
+	protocol uint8
+	remote   string
+	port     uint16
+	inbound  bool // the device is the one offering the service
+}
+
+// Flow is a device's traffic with one remote endpoint.
+type Flow struct {
+	Protocol  string `json:"protocol"`
+	Direction string `json:"direction"` // "outbound" when the device connects to the remote, "inbound" when it serves it
+	Remote    string `json:"remote"`
+	// RemoteName is the remote's device ID when it is a local device,
+	// otherwise the name the device looked it up by, or its reverse DNS
+	// name once resolved
+	RemoteName string `json:"remoteName,omitempty"`
+	Port       uint16 `json:"port,omitempty"` // the service port
+	InBytes    uint64 `json:"inBytes"`
+	OutBytes   uint64 `json:"outBytes"`
+	Packets    uint64 `json:"packets"`
+	FirstSeen  int64  `json:"firstSeen"`
+	LastSeen   int64  `json:"lastSeen"`
+	// Geo is the network and country of external remotes, with -geoip
+	Geo *GeoInfo `json:"geo,omitempty"`
+}
+
+// FlowTable tracks the active flows of the local devices from captured
+// packets, aggregated per device and remote endpoint.
+type FlowTable struct {
+	devices    *deviceIndex
+	rdns       *reverseDNS
+	dns        *dnsNames
+	geo        *GeoIP      // nil without -geoip
+	blocklists *Blocklists // nil without -blocklist
+
+	mu     sync.Mutex
+	flows  map[string]map[flowKey]*Flow // device ID -> flows
+	pruned time.Time
+}
+
+// NewFlowTable creates the flow table of the devices in index.
+func NewFlowTable(index *deviceIndex, geo *GeoIP, blocklists *Blocklists) *FlowTable {
+	return &FlowTable{
+		devices:    index,
+		rdns:       newReverseDNS(),
+		dns:        newDNSNames(),
+		geo:        geo,
+		blocklists: blocklists,
+		flows:      make(map[string]map[flowKey]*Flow),
+	}
+}
+
+// Record adds a captured packet to the flows of the devices on either end.
+func (t *FlowTable) Record(p packetInfo, now time.Time) {
+	t.dns.observe(p, now)
+	src := t.devices.lookup(p.Src, now)
+	dst := t.devices.lookup(p.Dst, now)
+	if src == "" && dst == "" {
+		return
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if now.Sub(t.pruned) >= time.Minute {
+		t.prune(now)
+		t.pruned = now
+	}
+	if src != "" {
+		t.add(src, p.Protocol, p.Dst, p.SrcPort, p.DstPort, p.Length, true, now)
+	}
+	if dst != "" {
+		t.add(dst, p.Protocol, p.Src, p.DstPort, p.SrcPort, p.Length, false, now)
+	}
+}
+
+// add counts a packet of device with remote. The service port is the lower
+// of the two ports: clients connect from ephemeral ones. Must be called
+// with t.mu held.
+func (t *FlowTable) add(device string, protocol uint8, remote net.IP, localPort, remotePort uint16, length int, sent bool, now time.Time) {
+	key := flowKey{protocol: protocol, remote: remote.String(), port: remotePort}
+	if localPort != 0 && localPort < remotePort {
+		key.port, key.inbound = localPort, true
+	}
+
+	flows := t.flows[device]
+	if flows == nil {
+		flows = make(map[flowKey]*Flow)
+		t.flows[device] = flows
+	}
+	flow := flows[key]
+	if flow == nil {
+		if len(flows) >= maxFlowsPerDevice {
+			return
+		}
+		flow = &Flow{
+			Protocol:  flowProtocols[protocol],
+			Direction: "outbound",
+			Remote:    key.remote,
+			Port:      key.port,
+			FirstSeen: now.Unix(),
+		}
+		if flow.Protocol == "" {
+			flow.Protocol = strconv.Itoa(int(protocol))
+		}
+		if key.inbound {
+			flow.Direction = "inbound"
+		}
+		flows[key] = flow
+		t.rdns.resolve(key.remote)
+		t.blocklists.Check(device, remote, []string{t.dns.name(key.remote), t.rdns.name(key.remote)}, now)
+	}
+	if sent {
+		flow.OutBytes += uint64(length)
+	} else {
+		flow.InBytes += uint64(length)
+	}
+	flow.Packets++
+	flow.LastSeen = now.Unix()
+}
+
+// prune drops idle flows. Must be called with t.mu held.
+func (t *FlowTable) prune(now time.Time) {
+	cutoff := now.Add(-flowIdleTimeout).Unix()
+	for device, flows := range t.flows {
+		for key, flow := range flows {
+			if flow.LastSeen < cutoff {
+				delete(flows, key)
+			}
+		}
+		if len(flows) == 0 {
+			delete(t.flows, device)
+		}
+	}
+}
+
+// Connections returns the active flows of device, busiest first, with
+// their remotes named and located.
+func (t *FlowTable) Connections(device string) []Flow {
+	t.mu.Lock()
+	cutoff := time.Now().Add(-flowIdleTimeout).Unix()
+	flows := make([]Flow, 0, len(t.flows[device]))
+	for _, flow := range t.flows[device] {
+		if flow.LastSeen >= cutoff {
+			flows = append(flows, *flow)
+		}
+	}
+	t.mu.Unlock()
+
+	now := time.Now()
+	for i := range flows {
+		remote := net.ParseIP(flows[i].Remote)
+		if id := t.devices.lookup(remote, now); id != "" && id != flows[i].Remote {
+			flows[i].RemoteName = id
+		} else {
+			flows[i].RemoteName = t.dns.name(flows[i].Remote)
+			if flows[i].RemoteName == "" {
+				flows[i].RemoteName = t.rdns.name(flows[i].Remote)
+			}
+			flows[i].Geo = t.geo.Lookup(remote)
+		}
+	}
+	sort.Slice(flows, func(i, j int) bool {
+		a, b := flows[i].InBytes+flows[i].OutBytes, flows[j].InBytes+flows[j].OutBytes
+		if a != b {
+			return a > b
+		}
+		return flows[i].Remote < flows[j].Remote
+	})
+	return flows
+}
+
+// reverseDNS resolves the names of flow remotes in the background, a few at
+// a time, and caches them. Addresses without a name are cached too, so
+// they aren't looked up again.
+type reverseDNS struct {
+	lookup func(ctx context.Context, addr string) ([]string, error)
+	sem    chan struct{}
+
+	mu    sync.Mutex
+	names map[string]string
+	busy  map[string]bool
+}
+
+func newReverseDNS() *reverseDNS {
+	return &reverseDNS{
+		lookup: net.DefaultResolver.LookupAddr,
+		sem:    make(chan struct{}, rdnsConcurrency),
+		names:  make(map[string]string),
+		busy:   make(map[string]bool),
+	}
+}
+
+// resolve starts a lookup of addr unless it is cached or under way. When
+// every lookup slot is taken it is skipped and retried with the next flow.
+func (r *reverseDNS) resolve(addr string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if _, ok := r.names[addr]; ok || r.busy[addr] {
+		return
+	}
+	select {
+	case r.sem <- struct{}{}:
+	default:
+		return
+	}
+	r.busy[addr] = true
+	go func() {
+		defer func() { <-r.sem }()
+		ctx, cancel := context.WithTimeout(context.Background(), rdnsTimeout)
+		names, _ := r.lookup(ctx, addr)
+		cancel()
+
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		delete(r.busy, addr)
+		if len(r.names) >= maxRDNSCache {
+			r.names = make(map[string]string)
+		}
+		r.names[addr] = ""
+		if len(names) > 0 {
+			r.names[addr] = strings.TrimSuffix(names[0], ".")
+		}
+	}()
+}
+
+// name returns the cached name of addr, or "".
+func (r *reverseDNS) name(addr string) string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.names[addr]
+}
+
+// dnsNames remembers the names local devices looked addresses up by, from
+// the DNS answers in captured packets, for at least minDNSNameTTL.
+type dnsNames struct {
+	mu    sync.Mutex
+	names map[string]dnsName // IP -> name
+}
+
+type dnsName struct {
+	name    string
+	expires time.Time
+}
+
+func newDNSNames() *dnsNames {
+	return &dnsNames{names: make(map[string]dnsName)}
+}
+
+// observe records the addresses in a DNS response. Answers following a
+// CNAME chain are recorded under the name that was asked for.
+func (d *dnsNames) observe(p packetInfo, now time.Time) {
+	if p.Protocol != protoUDP || p.SrcPort != 53 || len(p.Payload) == 0 {
+		return
+	}
+	var msg dns.Msg
+	if err := msg.Unpack(p.Payload); err != nil || !msg.Response || len(msg.Question) == 0 {
+		return
+	}
+	name := strings.ToLower(strings.TrimSuffix(msg.Question[0].Name, "."))
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for _, rr := range msg.Answer {
+		var ip net.IP
+		switch rr := rr.(type) {
+		case *dns.A:
+			ip = rr.A
+		case *dns.AAAA:
+			ip = rr.AAAA
+		default:
+			continue
+		}
+		if len(d.names) >= maxDNSNames {
+			d.expire(now)
+		}
+		ttl := max(time.Duration(rr.Header().Ttl)*time.Second, minDNSNameTTL)
+		d.names[ip.String()] = dnsName{name: name, expires: now.Add(ttl)}
+	}
+}
+
+// expire drops expired names, and every name if none had expired. Must be
+// called with d.mu held.
+func (d *dnsNames) expire(now time.Time) {
+	for ip, n := range d.names {
+		if now.After(n.expires) {
+			delete(d.names, ip)
+		}
+	}
+	if len(d.names) >= maxDNSNames {
+		d.names = make(map[string]dnsName)
+	}
+}
+
+// name returns the name addr was looked up by, or "".
+func (d *dnsNames) name(addr string) string {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.names[addr].name
+}
+
+// DeviceConnections handles GET /api/devices/{id}/connections, the active
+// flows of a local device seen with -capture: who it is talking to, over
+// which protocol and port, and how much.
+func (s *MDNSServer) DeviceConnections(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	if s.flows == nil {
+		writeJSON(w, http.StatusOK, map[string]interface{}{"enabled": false, "connections": []Flow{}})
+		return
+	}
+	if s.deviceSite(r) != s.site {
+		writeError(w, http.StatusBadRequest, "connections are only captured for the local site")
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"enabled":     true,
+		"device":      r.PathValue("id"),
+		"connections": s.flows.Connections(r.PathValue("id")),
+	})
+}
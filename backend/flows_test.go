@@ -0,0 +1,89 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// TestFlowTable verifies flows are aggregated per remote and service port,
+// in the right direction, for the devices on both ends
+func TestFlowTable(t *testing.T) {
+	server := NewMDNSServer()
+	server.addService("10.0.0.2:_smb._tcp.local.:445", &MDNSService{Host: "nas.local", IP: "10.0.0.2", Type: "_smb._tcp.local.", Port: 445})
+	server.addService("10.0.0.3:_airplay._tcp.local.:7000", &MDNSService{Host: "tv.local", IP: "10.0.0.3", Type: "_airplay._tcp.local.", Port: 7000})
+	flows := NewFlowTable(newDeviceIndex(server), nil, nil)
+	flows.rdns.lookup = func(ctx context.Context, addr string) ([]string, error) {
+		return []string{"dns.example."}, nil
+	}
+
+	now := time.Now()
+	// Two connections of the TV to a cloud service, from different ports
+	flows.Record(packetInfo{Src: net.ParseIP("10.0.0.3"), Dst: net.ParseIP("8.8.8.8"), Protocol: protoTCP, SrcPort: 50001, DstPort: 443, Length: 100}, now)
+	flows.Record(packetInfo{Src: net.ParseIP("8.8.8.8"), Dst: net.ParseIP("10.0.0.3"), Protocol: protoTCP, SrcPort: 443, DstPort: 50001, Length: 1000}, now)
+	flows.Record(packetInfo{Src: net.ParseIP("10.0.0.3"), Dst: net.ParseIP("8.8.8.8"), Protocol: protoTCP, SrcPort: 50002, DstPort: 443, Length: 100}, now)
+	// The TV reading from the NAS
+	flows.Record(packetInfo{Src: net.ParseIP("10.0.0.2"), Dst: net.ParseIP("10.0.0.3"), Protocol: protoTCP, SrcPort: 445, DstPort: 50003, Length: 5000}, now)
+
+	// Let the reverse lookup finish
+	deadline := time.Now().Add(time.Second)
+	for flows.rdns.name("8.8.8.8") == "" && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+
+	tv := flows.Connections("tv.local")
+	if len(tv) != 2 {
+		t.Fatalf("Expected 2 flows for tv.local, got %+v", tv)
+	}
+	if tv[0].Remote != "10.0.0.2" || tv[0].RemoteName != "nas.local" || tv[0].Port != 445 || tv[0].Direction != "outbound" || tv[0].InBytes != 5000 {
+		t.Fatalf("Unexpected NAS flow %+v", tv[0])
+	}
+	if tv[1].Remote != "8.8.8.8" || tv[1].RemoteName != "dns.example" || tv[1].Packets != 3 || tv[1].OutBytes != 200 || tv[1].InBytes != 1000 {
+		t.Fatalf("Unexpected cloud flow %+v", tv[1])
+	}
+
+	nas := flows.Connections("nas.local")
+	if len(nas) != 1 || nas[0].Direction != "inbound" || nas[0].Port != 445 || nas[0].RemoteName != "tv.local" {
+		t.Fatalf("Expected the NAS to serve the TV on 445, got %+v", nas)
+	}
+}
+
+// TestFlowTablePrune verifies idle flows are dropped
+func TestFlowTablePrune(t *testing.T) {
+	server := NewMDNSServer()
+	server.addService("10.0.0.3:_airplay._tcp.local.:7000", &MDNSService{Host: "tv.local", IP: "10.0.0.3", Type: "_airplay._tcp.local.", Port: 7000})
+	flows := NewFlowTable(newDeviceIndex(server), nil, nil)
+	flows.rdns.lookup = func(ctx context.Context, addr string) ([]string, error) { return nil, nil }
+
+	old := time.Now().Add(-flowIdleTimeout - time.Minute)
+	flows.Record(packetInfo{Src: net.ParseIP("10.0.0.3"), Dst: net.ParseIP("1.1.1.1"), Protocol: protoUDP, SrcPort: 40000, DstPort: 53, Length: 80}, old)
+	if len(flows.Connections("tv.local")) != 0 {
+		t.Fatalf("Expected an idle flow not to be listed")
+	}
+	flows.Record(packetInfo{Src: net.ParseIP("10.0.0.3"), Dst: net.ParseIP("1.1.1.1"), Protocol: protoUDP, SrcPort: 40000, DstPort: 123, Length: 80}, time.Now())
+	flows.mu.Lock()
+	n := len(flows.flows["tv.local"])
+	flows.mu.Unlock()
+	if n != 1 {
+		t.Fatalf("Expected the idle flow to be pruned, got %d flows", n)
+	}
+}
+
+// TestDeviceConnectionsDisabled verifies the endpoint answers without
+// -capture
+func TestDeviceConnectionsDisabled(t *testing.T) {
+	server := NewMDNSServer()
+	req := httptest.NewRequest(http.MethodGet, "/api/devices/tv.local/connections", nil)
+	req.SetPathValue("id", "tv.local")
+	w := httptest.NewRecorder()
+	server.DeviceConnections(w, req)
+
+	var response map[string]interface{}
+	if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil || response["enabled"] != false {
+		t.Fatalf("Expected enabled false, got %s", w.Body)
+	}
+}
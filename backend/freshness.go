@@ -0,0 +1,138 @@
+package main
+
+import (
+	"hash/fnv"
+	"math"
+	"net"
+	"time"
+)
+
+// Weights of the evidence a freshness score combines. The records' TTL
+// weighs most, as it is what the advertiser itself promised.
+const (
+	freshnessTTL       = 0.6
+	freshnessReachable = 0.25
+	freshnessARP       = 0.15
+)
+
+// freshness scores from 0 to 1 how likely a service is still there at now:
+// the share of its records' TTL left, whether its port accepted the last
+// reachability check, and whether its address is in the ARP table. Evidence
+// that isn't available, such as the reachability of an unchecked service or
+// the ARP presence of an address off the local subnets, counts as half.
+func (s *MDNSServer) freshness(service *MDNSService, now time.Time) float64 {
+	ttl := 1.0
+	if lifetime := service.ExpiresAt - service.LastRefreshed; lifetime > 0 {
+		ttl = min(max(float64(service.ExpiresAt-now.Unix())/float64(lifetime), 0), 1)
+	}
+
+	reachable := 0.5
+	if service.Reachable != nil {
+		reachable = 0
+		if *service.Reachable {
+			reachable = 1
+		}
+	}
+
+	arp := 0.5
+	if ip := net.ParseIP(service.IP); ip != nil && ip.To4() != nil && s.protocols.Enabled(protocolARP) && localNetworks.interfaceFor(service.IP) != "" {
+		arp = 0
+		if neighbors.lookup(service.IP) != "" {
+			arp = 1
+		}
+	}
+
+	score := freshnessTTL*ttl + freshnessReachable*reachable + freshnessARP*arp
+	return math.Round(score*100) / 100
+}
+
+// scoredService is a service on /api/services, with its freshness.
+type scoredService struct {
+	MDNSService
+	Freshness float64 `json:"freshness"`
+}
+
+// reconfirmSteps are the shares of a record's TTL after which a service is
+// queried again if it hasn't been announced meanwhile, so services that are
+// still there are refreshed before they expire (RFC 6762 §5.2).
+var reconfirmSteps = []float64{0.80, 0.85, 0.90, 0.95}
+
+// reconfirmJitter is the most a service's steps are delayed by, as a share
+// of the TTL, so services announced together aren't queried together.
+const reconfirmJitter = 0.02
+
+// reconfirmState is how far a service is through the steps of the records
+// it was last refreshed with.
+type reconfirmState struct {
+	refreshed int64 // LastRefreshed of the records
+	step      int   // steps queried
+}
+
+// reconfirmer re-queries local mDNS services as their records near expiry.
+// It belongs to the expiry worker.
+type reconfirmer struct {
+	server *MDNSServer
+	// query asks for a service's records again; replaced in tests
+	query  func(service MDNSService)
+	states map[string]reconfirmState // by site key
+}
+
+func newReconfirmer(server *MDNSServer) *reconfirmer {
+	return &reconfirmer{
+		server: server,
+		query: func(service MDNSService) {
+			instance := service.Name + "." + serviceTypeName(service.Type) + ".local."
+			follow := newFollowUps(server.lookups, nil)
+			queryServiceDetails(server, instance, sourceQuery, &follow, time.Now())
+		},
+		states: make(map[string]reconfirmState),
+	}
+}
+
+// check queries the services that reached their next step by now, and
+// returns how many it queried.
+func (r *reconfirmer) check(now time.Time) int {
+	services := r.server.table.view()
+	for key := range r.states {
+		if _, ok := services[key]; !ok {
+			delete(r.states, key)
+		}
+	}
+	if !r.server.protocols.Enabled(protocolMDNSQuery) {
+		return 0
+	}
+
+	queried := 0
+	for key, service := range services {
+		lifetime := service.ExpiresAt - service.LastRefreshed
+		if service.Site != r.server.site || service.Source != evidenceMDNS || lifetime <= 0 {
+			continue
+		}
+		state := r.states[key]
+		if state.refreshed != service.LastRefreshed {
+			state = reconfirmState{refreshed: service.LastRefreshed}
+		}
+		elapsed := float64(now.UnixMilli()-service.LastRefreshed*1000) / float64(lifetime*1000)
+		jitter := reconfirmJitter * keyFraction(key)
+		step := state.step
+		for step < len(reconfirmSteps) && elapsed >= reconfirmSteps[step]+jitter {
+			step++
+		}
+		if step > state.step {
+			// Steps missed, e.g. while discovery was paused, are skipped
+			// rather than queried at once
+			state.step = step
+			queried++
+			go r.query(*service)
+		}
+		r.states[key] = state
+	}
+	return queried
+}
+
+// keyFraction maps a key to a fraction in [0, 1), the same every time.
+func keyFraction(key string) float64 {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return float64(h.Sum32()) / (1 << 32)
+}
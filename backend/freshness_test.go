@@ -0,0 +1,65 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// TestFreshness verifies the score falls as the records' TTL runs out and
+// when the service's port stops accepting connections
+func TestFreshness(t *testing.T) {
+	server := NewMDNSServer()
+	announced := time.Unix(1700000000, 0)
+	service := &MDNSService{Name: "printer", Type: "_ipp._tcp.local.", IP: "198.51.100.7", Port: 631}
+	service.setTTL(announced, 100*time.Second)
+
+	if score := server.freshness(service, announced); score != 0.8 {
+		t.Fatalf("Expected 0.8 for fresh records without other evidence, got %v", score)
+	}
+	if score := server.freshness(service, announced.Add(50*time.Second)); score != 0.5 {
+		t.Fatalf("Expected 0.5 halfway through the TTL, got %v", score)
+	}
+	reachable := true
+	service.Reachable = &reachable
+	up := server.freshness(service, announced)
+	reachable = false
+	if down := server.freshness(service, announced); down >= up || up != 0.93 {
+		t.Fatalf("Expected an unreachable service to score below a reachable one, got %v and %v", down, up)
+	}
+	if score := server.freshness(service, announced.Add(time.Hour)); score > 0.1 {
+		t.Fatalf("Expected an expired, unreachable service to score near 0, got %v", score)
+	}
+}
+
+// TestReconfirm verifies a service is queried again once at each step of
+// its TTL, skipping missed steps, and starts over when it is refreshed
+func TestReconfirm(t *testing.T) {
+	server := NewMDNSServer()
+	announced := time.Unix(1700000000, 0)
+	service := &MDNSService{Name: "printer", Type: "_ipp._tcp.local.", IP: "10.0.0.5", Source: evidenceMDNS}
+	service.setTTL(announced, 100*time.Second)
+	server.changeService(server.identity(service), service, false)
+
+	r := newReconfirmer(server)
+	queried := make(chan MDNSService, 10)
+	r.query = func(service MDNSService) { queried <- service }
+
+	for _, at := range []struct {
+		elapsed time.Duration
+		queries int
+	}{{50 * time.Second, 0}, {83 * time.Second, 1}, {84 * time.Second, 0}, {98 * time.Second, 1}, {99 * time.Second, 0}} {
+		if n := r.check(announced.Add(at.elapsed)); n != at.queries {
+			t.Fatalf("Expected %d queries after %v, got %d", at.queries, at.elapsed, n)
+		}
+	}
+	if got := <-queried; got.Name != "printer" {
+		t.Fatalf("Expected the printer to be queried, got %+v", got)
+	}
+
+	refreshed := *service
+	refreshed.setTTL(announced.Add(99*time.Second), 100*time.Second)
+	server.changeService(server.identity(&refreshed), &refreshed, false)
+	if n := r.check(announced.Add(183 * time.Second)); n != 1 {
+		t.Fatalf("Expected the steps to start over after a refresh, got %d queries", n)
+	}
+}
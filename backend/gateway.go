@@ -0,0 +1,298 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"regexp"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+)
+
+// gatewayCacheTTL is how long a gateway identification is reused.
+const gatewayCacheTTL = 10 * time.Minute
+
+var ssdpGroup = &net.UDPAddr{IP: net.IPv4(239, 255, 255, 250), Port: 1900}
+
+// GatewayInfo is what could be found out about the default gateway.
+type GatewayInfo struct {
+	IP           string    `json:"ip"`
+	MAC          string    `json:"mac,omitempty"`
+	Manufacturer string    `json:"manufacturer,omitempty"`
+	Model        string    `json:"model,omitempty"`
+	ModelNumber  string    `json:"modelNumber,omitempty"`
+	Firmware     string    `json:"firmware,omitempty"` // hints from UPnP, HTTP or SNMP
+	FriendlyName string    `json:"friendlyName,omitempty"`
+	UPnPLocation string    `json:"upnpLocation,omitempty"`
+	UPnPServices []string  `json:"upnpServices"`
+	HTTPServer   string    `json:"httpServer,omitempty"`
+	HTTPTitle    string    `json:"httpTitle,omitempty"`
+	SNMP         *SNMPInfo `json:"snmp,omitempty"`
+	IdentifiedAt int64     `json:"identifiedAt"`
+}
+
+// gatewayCache keeps the last identification.
+type gatewayCache struct {
+	mu   sync.Mutex
+	info *GatewayInfo
+	at   time.Time
+}
+
+// defaultGateway returns the IPv4 default gateway: from /proc/net/route on
+// Linux, from the route command elsewhere.
+func defaultGateway() (string, error) {
+	switch runtime.GOOS {
+	case "linux":
+		data, err := os.ReadFile("/proc/net/route")
+		if err != nil {
+			return "", err
+		}
+		return parseProcRoute(data)
+	case "windows":
+		out, err := exec.Command("route", "print", "0.0.0.0").Output()
+		if err != nil {
+			return "", fmt.Errorf("route: %v", err)
+		}
+		return parseRouteOutput(out)
+	default:
+		out, err := exec.Command("route", "-n", "get", "default").Output()
+		if err != nil {
+			return "", fmt.Errorf("route: %v", err)
+		}
+		return parseRouteOutput(out)
+	}
+}
+
+// parseProcRoute finds the default route in /proc/net/route, where the
+// gateway is a little-endian hex address.
+func parseProcRoute(data []byte) (string, error) {
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 3 || fields[1] != "00000000" {
+			continue
+		}
+		b, err := hex.DecodeString(fields[2])
+		if err != nil || len(b) != 4 {
+			continue
+		}
+		ip := make(net.IP, 4)
+		binary.LittleEndian.PutUint32(ip, binary.BigEndian.Uint32(b))
+		if !ip.IsUnspecified() {
+			return ip.String(), nil
+		}
+	}
+	return "", errors.New("no default route")
+}
+
+var (
+	gatewayLinePattern  = regexp.MustCompile(`gateway:\s*(\d+\.\d+\.\d+\.\d+)`)
+	windowsRoutePattern = regexp.MustCompile(`(?m)^\s*0\.0\.0\.0\s+0\.0\.0\.0\s+(\d+\.\d+\.\d+\.\d+)`)
+)
+
+// parseRouteOutput reads the gateway from BSD "route -n get default" or
+// Windows "route print" output.
+func parseRouteOutput(out []byte) (string, error) {
+	if m := gatewayLinePattern.FindSubmatch(out); m != nil {
+		return string(m[1]), nil
+	}
+	if m := windowsRoutePattern.FindSubmatch(out); m != nil {
+		return string(m[1]), nil
+	}
+	return "", errors.New("no default route")
+}
+
+// ssdpLocation sends an SSDP M-SEARCH and returns the description URL the
+// device at ip answers with.
+func ssdpLocation(ip string, timeout time.Duration) (string, error) {
+	conn, err := net.ListenPacket("udp4", ":0")
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+
+	search := "M-SEARCH * HTTP/1.1\r\n" +
+		"HOST: 239.255.255.250:1900\r\n" +
+		"MAN: \"ssdp:discover\"\r\n" +
+		"MX: 1\r\n" +
+		"ST: upnp:rootdevice\r\n\r\n"
+	// Ask the gateway directly as well as the group; some routers only
+	// answer one of them
+	targets := []net.Addr{ssdpGroup, &net.UDPAddr{IP: net.ParseIP(ip), Port: ssdpGroup.Port}}
+	for _, target := range targets {
+		conn.WriteTo([]byte(search), target)
+	}
+
+	conn.SetReadDeadline(time.Now().Add(timeout))
+	buffer := make([]byte, 4096)
+	for {
+		n, addr, err := conn.ReadFrom(buffer)
+		if err != nil {
+			return "", err
+		}
+		if udp, ok := addr.(*net.UDPAddr); !ok || udp.IP.String() != ip {
+			continue
+		}
+		if location := ssdpHeader(buffer[:n], "location"); location != "" {
+			return location, nil
+		}
+	}
+}
+
+// ssdpHeader returns a header of an SSDP response.
+func ssdpHeader(response []byte, name string) string {
+	for _, line := range strings.Split(string(response), "\r\n") {
+		key, value, ok := strings.Cut(line, ":")
+		if ok && strings.EqualFold(strings.TrimSpace(key), name) {
+			return strings.TrimSpace(value)
+		}
+	}
+	return ""
+}
+
+// upnpDevice is the part of a UPnP device description we use.
+type upnpDevice struct {
+	FriendlyName     string `xml:"friendlyName"`
+	Manufacturer     string `xml:"manufacturer"`
+	ModelName        string `xml:"modelName"`
+	ModelNumber      string `xml:"modelNumber"`
+	ModelDescription string `xml:"modelDescription"`
+	Services         []struct {
+		ServiceType string `xml:"serviceType"`
+		ControlURL  string `xml:"controlURL"`
+	} `xml:"serviceList>service"`
+	Devices []upnpDevice `xml:"deviceList>device"`
+}
+
+// parseUPnPDescription fills info from a UPnP description document,
+// collecting the services of every embedded device.
+func parseUPnPDescription(data []byte, info *GatewayInfo) error {
+	var root struct {
+		Device upnpDevice `xml:"device"`
+	}
+	if err := xml.Unmarshal(data, &root); err != nil {
+		return err
+	}
+	d := root.Device
+	info.FriendlyName = d.FriendlyName
+	info.Manufacturer = d.Manufacturer
+	info.Model = d.ModelName
+	info.ModelNumber = d.ModelNumber
+	if d.ModelDescription != "" && info.Firmware == "" {
+		info.Firmware = d.ModelDescription
+	}
+
+	var collect func(d upnpDevice)
+	collect = func(d upnpDevice) {
+		for _, s := range d.Services {
+			if s.ServiceType != "" {
+				info.UPnPServices = append(info.UPnPServices, s.ServiceType)
+			}
+		}
+		for _, child := range d.Devices {
+			collect(child)
+		}
+	}
+	collect(d)
+	return nil
+}
+
+var titlePattern = regexp.MustCompile(`(?is)<title[^>]*>(.*?)</title>`)
+
+// httpFingerprint reads the Server header and page title of the web
+// interface at base.
+func httpFingerprint(ctx context.Context, client *http.Client, base string, info *GatewayInfo) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, base, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	info.HTTPServer = resp.Header.Get("Server")
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 64*1024))
+	if m := titlePattern.FindSubmatch(body); m != nil {
+		info.HTTPTitle = strings.Join(strings.Fields(string(m[1])), " ")
+	}
+	return nil
+}
+
+// identifyGateway finds the default gateway and asks it what it is over
+// SSDP/UPnP, HTTP and, when configured, SNMP, unless it is outside the scan
+// scope.
+func (s *MDNSServer) identifyGateway(ctx context.Context) (*GatewayInfo, error) {
+	ip, err := defaultGateway()
+	if err != nil {
+		return nil, err
+	}
+	if err := scanScope.check(ip); err != nil {
+		return nil, err
+	}
+	info := &GatewayInfo{IP: ip, MAC: neighbors.lookup(ip), UPnPServices: []string{}, IdentifiedAt: time.Now().Unix()}
+	client := &http.Client{Timeout: 3 * time.Second}
+
+	if location, err := ssdpLocation(ip, 2*time.Second); err == nil {
+		// Only follow descriptions served by the gateway itself
+		if u, err := url.Parse(location); err == nil && u.Hostname() == ip {
+			info.UPnPLocation = location
+			req, err := http.NewRequestWithContext(ctx, http.MethodGet, location, nil)
+			if err == nil {
+				if resp, err := client.Do(req); err == nil {
+					data, _ := io.ReadAll(io.LimitReader(resp.Body, 256*1024))
+					resp.Body.Close()
+					parseUPnPDescription(data, info)
+				}
+			}
+		}
+	}
+
+	httpFingerprint(ctx, client, "http://"+ip+"/", info)
+
+	if s.snmp != nil && s.protocols.Enabled(protocolSNMP) {
+		if snmp, err := s.snmp.poll(ip); err == nil {
+			info.SNMP = snmp
+			if info.Firmware == "" {
+				info.Firmware = snmp.SysDescr
+			}
+		}
+	}
+	return info, nil
+}
+
+// Gateway handles GET /api/gateway, the identification of the default
+// gateway. Results are cached for 10 minutes; ?refresh=1 identifies again.
+func (s *MDNSServer) Gateway(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	s.gateway.mu.Lock()
+	defer s.gateway.mu.Unlock()
+
+	if s.gateway.info == nil || time.Since(s.gateway.at) > gatewayCacheTTL || r.URL.Query().Get("refresh") == "1" {
+		info, err := s.identifyGateway(r.Context())
+		if err != nil {
+			writeError(w, http.StatusServiceUnavailable, err.Error())
+			return
+		}
+		s.gateway.info, s.gateway.at = info, time.Now()
+	}
+	writeJSON(w, http.StatusOK, s.gateway.info)
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// TestParseDefaultGateway verifies the gateway is read from Linux, BSD and
+// Windows routing tables
+func TestParseDefaultGateway(t *testing.T) {
+	proc := "Iface\tDestination\tGateway \tFlags\tRefCnt\tUse\tMetric\tMask\n" +
+		"eth0\t0001A8C0\t00000000\t0001\t0\t0\t0\t00FFFFFF\n" +
+		"eth0\t00000000\t0101A8C0\t0003\t0\t0\t100\t00000000\n"
+	if ip, err := parseProcRoute([]byte(proc)); err != nil || ip != "192.168.1.1" {
+		t.Fatalf("Expected 192.168.1.1 from /proc/net/route, got %q (%v)", ip, err)
+	}
+
+	bsd := "   route to: default\ndestination: default\n       mask: default\n    gateway: 10.0.0.1\n  interface: en0\n"
+	if ip, err := parseRouteOutput([]byte(bsd)); err != nil || ip != "10.0.0.1" {
+		t.Fatalf("Expected 10.0.0.1 from route get, got %q (%v)", ip, err)
+	}
+
+	windows := "Network Destination        Netmask          Gateway       Interface  Metric\n          0.0.0.0          0.0.0.0      192.168.0.1    192.168.0.20     25\n"
+	if ip, err := parseRouteOutput([]byte(windows)); err != nil || ip != "192.168.0.1" {
+		t.Fatalf("Expected 192.168.0.1 from route print, got %q (%v)", ip, err)
+	}
+
+	if _, err := parseProcRoute([]byte("Iface\tDestination\tGateway\n")); err == nil {
+		t.Fatalf("Expected an error without a default route")
+	}
+}
+
+// TestParseUPnPDescription verifies model details and the services of
+// embedded devices are read
+func TestParseUPnPDescription(t *testing.T) {
+	description := `<?xml version="1.0"?>
+<root xmlns="urn:schemas-upnp-org:device-1-0">
+  <device>
+    <friendlyName>Home Router</friendlyName>
+    <manufacturer>ACME</manufacturer>
+    <modelName>R7000</modelName>
+    <modelNumber>V1.0.11</modelNumber>
+    <serviceList><service><serviceType>urn:schemas-upnp-org:service:Layer3Forwarding:1</serviceType></service></serviceList>
+    <deviceList><device>
+      <serviceList><service><serviceType>urn:schemas-upnp-org:service:WANIPConnection:1</serviceType></service></serviceList>
+    </device></deviceList>
+  </device>
+</root>`
+
+	info := &GatewayInfo{}
+	if err := parseUPnPDescription([]byte(description), info); err != nil {
+		t.Fatalf("Failed to parse: %v", err)
+	}
+	if info.Manufacturer != "ACME" || info.Model != "R7000" || info.ModelNumber != "V1.0.11" || info.FriendlyName != "Home Router" {
+		t.Fatalf("Unexpected model details %+v", info)
+	}
+	if len(info.UPnPServices) != 2 || !strings.HasSuffix(info.UPnPServices[1], "WANIPConnection:1") {
+		t.Fatalf("Expected the services of the embedded device too, got %v", info.UPnPServices)
+	}
+}
+
+// TestHTTPFingerprint verifies the Server header and page title are read
+func TestHTTPFingerprint(t *testing.T) {
+	web := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Server", "lighttpd/1.4.59")
+		w.Write([]byte("<html><head><TITLE>\n  Router Login </TITLE></head></html>"))
+	}))
+	defer web.Close()
+
+	info := &GatewayInfo{}
+	if err := httpFingerprint(context.Background(), web.Client(), web.URL, info); err != nil {
+		t.Fatalf("Fingerprint failed: %v", err)
+	}
+	if info.HTTPServer != "lighttpd/1.4.59" || info.HTTPTitle != "Router Login" {
+		t.Fatalf("Unexpected fingerprint %+v", info)
+	}
+}
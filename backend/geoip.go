@@ -0,0 +1,413 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"os"
+	"strings"
+)
+
+// MaxMind DB (MMDB) files, such as GeoLite2-ASN and GeoLite2-Country, are a
+// binary search tree over the bits of an address whose leaves point into a
+// data section of typed values; the metadata is a map at the end of the
+// file. See https://maxmind.github.io/MaxMind-DB/.
+
+var mmdbMetadataMarker = []byte("\xab\xcd\xefMaxMind.com")
+
+// mmdb is an MMDB file loaded into memory.
+type mmdb struct {
+	path       string
+	dbType     string
+	data       []byte
+	nodeCount  uint
+	recordSize uint
+	ipVersion  uint
+	dataStart  uint // offset of the data section
+	ipv4Start  uint // node at which IPv4 addresses start in an IPv6 tree
+}
+
+// openMMDB reads and validates an MMDB file.
+func openMMDB(path string) (*mmdb, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	db, err := parseMMDB(data)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	db.path = path
+	return db, nil
+}
+
+func parseMMDB(data []byte) (*mmdb, error) {
+	i := bytes.LastIndex(data, mmdbMetadataMarker)
+	if i < 0 {
+		return nil, errors.New("not a MaxMind DB file")
+	}
+	dec := mmdbDecoder{data: data[i+len(mmdbMetadataMarker):]}
+	value, _, err := dec.decode(0)
+	if err != nil {
+		return nil, fmt.Errorf("metadata: %v", err)
+	}
+	metadata, ok := value.(map[string]interface{})
+	if !ok {
+		return nil, errors.New("metadata is not a map")
+	}
+	number := func(key string) uint {
+		n, _ := metadata[key].(uint64)
+		return uint(n)
+	}
+
+	db := &mmdb{
+		data:       data,
+		nodeCount:  number("node_count"),
+		recordSize: number("record_size"),
+		ipVersion:  number("ip_version"),
+	}
+	db.dbType, _ = metadata["database_type"].(string)
+	if db.recordSize != 24 && db.recordSize != 28 && db.recordSize != 32 {
+		return nil, fmt.Errorf("unsupported record size %d", db.recordSize)
+	}
+	if db.ipVersion != 4 && db.ipVersion != 6 {
+		return nil, fmt.Errorf("unsupported IP version %d", db.ipVersion)
+	}
+	treeSize := db.nodeCount * db.recordSize / 4
+	if db.nodeCount > uint(i) || treeSize+16 > uint(i) {
+		return nil, errors.New("search tree is truncated")
+	}
+	db.dataStart = treeSize + 16
+
+	// IPv4 addresses are stored as ::a.b.c.d in IPv6 trees
+	if db.ipVersion == 6 {
+		node := uint(0)
+		for n := 0; n < 96 && node < db.nodeCount; n++ {
+			node = db.record(node, 0)
+		}
+		db.ipv4Start = node
+	}
+	return db, nil
+}
+
+// record returns the left (bit 0) or right (bit 1) record of node.
+func (db *mmdb) record(node, bit uint) uint {
+	b := db.data[node*db.recordSize/4:]
+	switch db.recordSize {
+	case 24:
+		if bit == 1 {
+			b = b[3:]
+		}
+		return uint(b[0])<<16 | uint(b[1])<<8 | uint(b[2])
+	case 28:
+		if bit == 0 {
+			return uint(b[3]&0xf0)<<20 | uint(b[0])<<16 | uint(b[1])<<8 | uint(b[2])
+		}
+		return uint(b[3]&0x0f)<<24 | uint(b[4])<<16 | uint(b[5])<<8 | uint(b[6])
+	default:
+		return uint(binary.BigEndian.Uint32(b[bit*4:]))
+	}
+}
+
+// lookup returns the record of ip, or nil when the database has none.
+func (db *mmdb) lookup(ip net.IP) (interface{}, error) {
+	addr := ip.To4()
+	node := uint(0)
+	if addr == nil {
+		if db.ipVersion == 4 {
+			return nil, nil
+		}
+		addr = ip.To16()
+	} else if db.ipVersion == 6 {
+		node = db.ipv4Start
+	}
+
+	for i := 0; i < len(addr)*8 && node < db.nodeCount; i++ {
+		bit := uint(addr[i/8]>>(7-i%8)) & 1
+		node = db.record(node, bit)
+	}
+	if node == db.nodeCount {
+		return nil, nil
+	}
+	if node < db.nodeCount {
+		return nil, errors.New("search tree is too deep")
+	}
+	// Records past the node count point 16 bytes into the data section,
+	// just after the separator
+	if node < db.nodeCount+16 {
+		return nil, errors.New("invalid data pointer")
+	}
+
+	dec := mmdbDecoder{data: db.data[db.dataStart:]}
+	value, _, err := dec.decode(node - db.nodeCount - 16)
+	return value, err
+}
+
+// Limits of a decoded value. Pointers may lead back into the value they are
+// part of, or to one value from many places, so a few bytes could otherwise
+// decode forever or into an enormous value.
+const (
+	mmdbMaxDepth  = 32      // nested maps, arrays and pointers
+	mmdbMaxValues = 1 << 16 // values decoded for one record
+)
+
+// mmdbDecoder decodes the values of a data section.
+type mmdbDecoder struct {
+	data   []byte
+	values int // decoded so far, up to mmdbMaxValues
+}
+
+// MMDB data types.
+const (
+	mmdbPointer = 1
+	mmdbString  = 2
+	mmdbDouble  = 3
+	mmdbBytes   = 4
+	mmdbUint16  = 5
+	mmdbUint32  = 6
+	mmdbMap     = 7
+	mmdbInt32   = 8
+	mmdbUint64  = 9
+	mmdbUint128 = 10
+	mmdbArray   = 11
+	mmdbBool    = 14
+	mmdbFloat   = 15
+)
+
+var errMMDBTruncated = errors.New("data section is truncated")
+
+func (d *mmdbDecoder) bytes(offset, n uint) ([]byte, error) {
+	if offset > uint(len(d.data)) || n > uint(len(d.data))-offset {
+		return nil, errMMDBTruncated
+	}
+	return d.data[offset : offset+n], nil
+}
+
+// decode decodes the value at offset and returns it with the offset after
+// it. Numbers are returned as uint64, int64 or float64.
+func (d *mmdbDecoder) decode(offset uint) (interface{}, uint, error) {
+	return d.decodeValue(offset, 0)
+}
+
+// decodeValue decodes the value at offset, depth levels into the value
+// being decoded.
+func (d *mmdbDecoder) decodeValue(offset uint, depth int) (interface{}, uint, error) {
+	if depth > mmdbMaxDepth {
+		return nil, 0, errors.New("data is nested too deeply")
+	}
+	if d.values++; d.values > mmdbMaxValues {
+		return nil, 0, errors.New("record has too many values")
+	}
+	b, err := d.bytes(offset, 1)
+	if err != nil {
+		return nil, 0, err
+	}
+	ctrl := b[0]
+	offset++
+	kind := uint(ctrl >> 5)
+
+	if kind == mmdbPointer {
+		n := uint(ctrl>>3)&3 + 1
+		p, err := d.bytes(offset, n)
+		if err != nil {
+			return nil, 0, err
+		}
+		var target uint
+		switch n {
+		case 1:
+			target = uint(ctrl&7)<<8 | uint(p[0])
+		case 2:
+			target = (uint(ctrl&7)<<16 | uint(p[0])<<8 | uint(p[1])) + 2048
+		case 3:
+			target = (uint(ctrl&7)<<24 | uint(p[0])<<16 | uint(p[1])<<8 | uint(p[2])) + 526336
+		default:
+			target = uint(binary.BigEndian.Uint32(p))
+		}
+		// Pointers never point to pointers; they may still point back into
+		// the value they are part of, which the depth limit stops
+		if t, err := d.bytes(target, 1); err != nil || t[0]>>5 == mmdbPointer {
+			return nil, 0, errors.New("invalid pointer")
+		}
+		value, _, err := d.decodeValue(target, depth+1)
+		return value, offset + n, err
+	}
+
+	if kind == 0 {
+		ext, err := d.bytes(offset, 1)
+		if err != nil {
+			return nil, 0, err
+		}
+		kind = 7 + uint(ext[0])
+		offset++
+	}
+
+	size := uint(ctrl & 0x1f)
+	if size >= 29 {
+		n := size - 28
+		s, err := d.bytes(offset, n)
+		if err != nil {
+			return nil, 0, err
+		}
+		offset += n
+		switch n {
+		case 1:
+			size = 29 + uint(s[0])
+		case 2:
+			size = 285 + (uint(s[0])<<8 | uint(s[1]))
+		default:
+			size = 65821 + (uint(s[0])<<16 | uint(s[1])<<8 | uint(s[2]))
+		}
+	}
+
+	// Every entry takes at least a byte, which keeps made-up sizes from
+	// allocating more than the data section could hold
+	if (kind == mmdbMap || kind == mmdbArray) && size > uint(len(d.data))-offset {
+		return nil, 0, errMMDBTruncated
+	}
+
+	switch kind {
+	case mmdbMap:
+		m := make(map[string]interface{}, size)
+		for i := uint(0); i < size; i++ {
+			key, next, err := d.decodeValue(offset, depth+1)
+			if err != nil {
+				return nil, 0, err
+			}
+			k, ok := key.(string)
+			if !ok {
+				return nil, 0, errors.New("map key is not a string")
+			}
+			m[k], offset, err = d.decodeValue(next, depth+1)
+			if err != nil {
+				return nil, 0, err
+			}
+		}
+		return m, offset, nil
+	case mmdbArray:
+		values := make([]interface{}, size)
+		for i := range values {
+			values[i], offset, err = d.decodeValue(offset, depth+1)
+			if err != nil {
+				return nil, 0, err
+			}
+		}
+		return values, offset, nil
+	case mmdbBool:
+		return size != 0, offset, nil
+	}
+
+	raw, err := d.bytes(offset, size)
+	if err != nil {
+		return nil, 0, err
+	}
+	offset += size
+	switch kind {
+	case mmdbString:
+		return string(raw), offset, nil
+	case mmdbBytes:
+		return append([]byte(nil), raw...), offset, nil
+	case mmdbDouble:
+		if size != 8 {
+			return nil, 0, errors.New("invalid double")
+		}
+		return math.Float64frombits(binary.BigEndian.Uint64(raw)), offset, nil
+	case mmdbFloat:
+		if size != 4 {
+			return nil, 0, errors.New("invalid float")
+		}
+		return float64(math.Float32frombits(binary.BigEndian.Uint32(raw))), offset, nil
+	case mmdbUint16, mmdbUint32, mmdbUint64, mmdbUint128:
+		var n uint64
+		for _, c := range raw {
+			n = n<<8 | uint64(c) // uint128 values beyond 64 bits are truncated
+		}
+		return n, offset, nil
+	case mmdbInt32:
+		var n uint32
+		for _, c := range raw {
+			n = n<<8 | uint32(c)
+		}
+		return int64(int32(n)), offset, nil
+	}
+	return nil, 0, fmt.Errorf("unsupported data type %d", kind)
+}
+
+// GeoInfo is the network and country of an external address.
+type GeoInfo struct {
+	ASN         uint64 `json:"asn,omitempty"`
+	ASOrg       string `json:"asOrg,omitempty"`
+	Country     string `json:"country,omitempty"` // ISO 3166 code
+	CountryName string `json:"countryName,omitempty"`
+}
+
+// GeoIP annotates addresses from local MMDB files, e.g. GeoLite2-ASN and
+// GeoLite2-Country; every database contributes the fields it has.
+type GeoIP struct {
+	dbs []*mmdb
+}
+
+// NewGeoIP opens a comma-separated list of MMDB files.
+func NewGeoIP(paths string) (*GeoIP, error) {
+	g := &GeoIP{}
+	for _, path := range strings.Split(paths, ",") {
+		if path = strings.TrimSpace(path); path == "" {
+			continue
+		}
+		db, err := openMMDB(path)
+		if err != nil {
+			return nil, err
+		}
+		g.dbs = append(g.dbs, db)
+	}
+	return g, nil
+}
+
+// Lookup returns what the databases know about ip, or nil.
+func (g *GeoIP) Lookup(ip net.IP) *GeoInfo {
+	if g == nil || ip == nil || ip.IsPrivate() || ip.IsLoopback() || ip.IsLinkLocalUnicast() || ip.IsMulticast() {
+		return nil
+	}
+	info := &GeoInfo{}
+	for _, db := range g.dbs {
+		value, err := db.lookup(ip)
+		if err != nil || value == nil {
+			continue
+		}
+		record, _ := value.(map[string]interface{})
+		if asn, ok := record["autonomous_system_number"].(uint64); ok {
+			info.ASN = asn
+		}
+		if org, ok := record["autonomous_system_organization"].(string); ok {
+			info.ASOrg = org
+		}
+		// City databases have a country too; registered_country is the
+		// fallback for addresses without a location
+		for _, key := range []string{"country", "registered_country"} {
+			country, _ := record[key].(map[string]interface{})
+			if code, ok := country["iso_code"].(string); ok && info.Country == "" {
+				info.Country = code
+				names, _ := country["names"].(map[string]interface{})
+				info.CountryName, _ = names["en"].(string)
+			}
+		}
+	}
+	if *info == (GeoInfo{}) {
+		return nil
+	}
+	return info
+}
+
+// Databases returns the types of the loaded databases.
+func (g *GeoIP) Databases() []string {
+	types := []string{}
+	if g == nil {
+		return types
+	}
+	for _, db := range g.dbs {
+		types = append(types, db.dbType)
+	}
+	return types
+}
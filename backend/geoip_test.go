@@ -0,0 +1,148 @@
+package main
+
+import (
+	"encoding/binary"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// mmdbMapValue is a map given as alternating keys and values, to keep
+// their order.
+type mmdbMapValue []interface{}
+
+// mmdbValue encodes a value in the MMDB data format, for values shorter
+// than 285 bytes.
+func mmdbValue(v interface{}) []byte {
+	header := func(kind, size int) []byte {
+		var extra []byte
+		if size >= 29 {
+			extra = []byte{byte(size - 29)}
+			size = 29
+		}
+		if kind <= 7 {
+			return append([]byte{byte(kind<<5 | size)}, extra...)
+		}
+		return append([]byte{byte(size), byte(kind - 7)}, extra...)
+	}
+	switch v := v.(type) {
+	case string:
+		return append(header(mmdbString, len(v)), v...)
+	case uint32:
+		b := binary.BigEndian.AppendUint32(nil, v)
+		return append(header(mmdbUint32, 4), b...)
+	case uint16:
+		b := binary.BigEndian.AppendUint16(nil, v)
+		return append(header(mmdbUint16, 2), b...)
+	case mmdbMapValue:
+		out := header(mmdbMap, len(v)/2)
+		for _, el := range v {
+			out = append(out, mmdbValue(el)...)
+		}
+		return out
+	case []byte: // a raw, already encoded value such as a pointer
+		return v
+	}
+	panic("unsupported value")
+}
+
+// buildMMDB builds an IPv4 database with record size 24 whose data section
+// is data, with the record of network/8 at offset.
+func buildMMDB(network byte, data []byte, offset int) []byte {
+	const nodeCount = 8
+	var tree []byte
+	dataPointer := uint32(nodeCount + 16 + offset)
+	for i := 0; i < 8; i++ {
+		bit := network >> (7 - i) & 1
+		next := uint32(i + 1)
+		if i == 7 {
+			next = dataPointer
+		}
+		records := [2]uint32{nodeCount, nodeCount}
+		records[bit] = next
+		for _, r := range records {
+			tree = append(tree, byte(r>>16), byte(r>>8), byte(r))
+		}
+	}
+
+	file := append(tree, make([]byte, 16)...)
+	file = append(file, data...)
+	file = append(file, mmdbMetadataMarker...)
+	return append(file, mmdbValue(mmdbMapValue{
+		"node_count", uint32(nodeCount),
+		"record_size", uint16(24),
+		"ip_version", uint16(4),
+		"database_type", "Test-ASN-Country",
+	})...)
+}
+
+// TestGeoIPLookup verifies ASN and country fields are read from an MMDB
+// file, including values behind pointers
+func TestGeoIPLookup(t *testing.T) {
+	// The organisation is stored once and referenced by a pointer, as
+	// real databases deduplicate repeated values
+	org := mmdbValue("Alibaba")
+	section := append([]byte(nil), org...)
+	section = append(section, mmdbValue(mmdbMapValue{
+		"autonomous_system_number", uint32(45102),
+		"autonomous_system_organization", []byte{mmdbPointer << 5, 0},
+		"country", mmdbMapValue{
+			"iso_code", "CN",
+			"names", mmdbMapValue{"en", "China"},
+		},
+	})...)
+	data := buildMMDB(47, section, len(org))
+
+	path := filepath.Join(t.TempDir(), "test.mmdb")
+	if err := os.WriteFile(path, data, 0o644); err != nil {
+		t.Fatalf("Failed to write database: %v", err)
+	}
+	geo, err := NewGeoIP(path)
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+
+	info := geo.Lookup(net.ParseIP("47.246.1.1"))
+	if info == nil || info.ASN != 45102 || info.ASOrg != "Alibaba" || info.Country != "CN" || info.CountryName != "China" {
+		t.Fatalf("Unexpected lookup result %+v", info)
+	}
+	if info := geo.Lookup(net.ParseIP("8.8.8.8")); info != nil {
+		t.Fatalf("Expected no record for 8.8.8.8, got %+v", info)
+	}
+	if info := geo.Lookup(net.ParseIP("10.0.0.2")); info != nil {
+		t.Fatalf("Expected private addresses not to be looked up, got %+v", info)
+	}
+	if got := geo.Databases(); len(got) != 1 || got[0] != "Test-ASN-Country" {
+		t.Fatalf("Unexpected database types %v", got)
+	}
+}
+
+// TestOpenMMDBInvalid verifies files without MMDB metadata are rejected
+func TestOpenMMDBInvalid(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "empty.mmdb")
+	os.WriteFile(path, []byte("not a database"), 0o644)
+	if _, err := NewGeoIP(path); err == nil {
+		t.Fatalf("Expected an error for an invalid database")
+	}
+}
+
+// FuzzParseMMDB verifies databases that are corrupt or made up are
+// rejected or looked up without panicking, recursing forever or reading
+// past the file
+func FuzzParseMMDB(f *testing.F) {
+	f.Add(buildMMDB(47, mmdbValue(mmdbMapValue{"autonomous_system_number", uint32(45102)}), 0))
+	// A map whose key points back to the map
+	f.Add([]byte("\xab\xcd\xefMaxMind.com\xe3 \x00"))
+	// A record pointing between the tree and the data section
+	f.Add(buildMMDB(47, nil, -8))
+	f.Fuzz(func(t *testing.T, data []byte) {
+		db, err := parseMMDB(data)
+		if err != nil {
+			return
+		}
+		for _, ip := range []string{"47.246.1.1", "8.8.8.8", "2001:db8::1"} {
+			db.lookup(net.ParseIP(ip))
+		}
+	})
+}
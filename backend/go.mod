@@ -4,15 +4,17 @@ go 1.24.0
 
 require (
 	connectrpc.com/connect v1.19.1
+	github.com/graph-gophers/graphql-go v1.5.0
+	github.com/hashicorp/mdns v1.0.6
 	github.com/miekg/dns v1.1.57
+	go.etcd.io/bbolt v1.3.11
+	golang.org/x/net v0.34.0
+	golang.org/x/sys v0.29.0
 	google.golang.org/protobuf v1.36.11
 )
 
 require (
-	github.com/hashicorp/mdns v1.0.6 // indirect
 	golang.org/x/mod v0.17.0 // indirect
-	golang.org/x/net v0.34.0 // indirect
 	golang.org/x/sync v0.10.0 // indirect
-	golang.org/x/sys v0.29.0 // indirect
 	golang.org/x/tools v0.21.1-0.20240508182429-e35e4ccd0d2d // indirect
 )
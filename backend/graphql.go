@@ -0,0 +1,477 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	graphql "github.com/graph-gophers/graphql-go"
+)
+
+// graphqlSchema exposes the service, device and event model so the frontend
+// can fetch nested data (device -> services -> history) in one round trip.
+// Timestamps are Unix seconds; GraphQL's Int is only 32 bits wide.
+const graphqlSchema = `
+schema {
+	query: Query
+	subscription: Subscription
+}
+
+type Query {
+	# Services of a site; site defaults to the local site, "*" means all sites
+	services(site: String, type: String): [Service!]!
+	devices(site: String, query: String): [Device!]!
+	device(id: ID!, site: String): Device
+}
+
+type Subscription {
+	# Discovery events as sent on /discover
+	events(site: String): Event!
+}
+
+type Service {
+	name: String!
+	type: String!
+	host: String!
+	ip: String!
+	# IPv6 address of dual-stack services
+	ip6: String
+	port: Int!
+	timestamp: Float!
+	site: String!
+	lastRefreshed: Float!
+	expiresAt: Float!
+	# timestamp and lastRefreshed in RFC 3339 with the server's UTC offset
+	firstSeen: String
+	lastSeen: String
+	interfaces: [ServiceInterface!]!
+	# Protocol the service was discovered by: mdns, ssdp, arp, dhcp or ble
+	source: String
+	# How much the evidence is worth, from 0 to 1
+	confidence: Float
+	# Record the service was revealed by, e.g. PTR or SRV
+	rawRecordType: String
+	# Whether the service accepted a TCP connection when last checked,
+	# null until it is checked
+	reachable: Boolean
+	checkedAt: Float
+	reachableAt: Float
+	# Hosts the instance's SRV records point to, in order of preference
+	targets: [ServiceTarget!]!
+}
+
+type ServiceTarget {
+	host: String!
+	port: Int!
+	priority: Int!
+	weight: Int!
+	ip: String
+	ip6: String
+	expiresAt: Float!
+}
+
+type ServiceInterface {
+	name: String!
+	lastSeen: Float!
+}
+
+type Device {
+	id: ID!
+	site: String!
+	owner: String
+	location: String
+	notes: [Note!]!
+	updatedAt: Float
+	services: [Service!]!
+	availability(days: Int = 7): Availability!
+}
+
+type Note {
+	key: String!
+	value: String!
+}
+
+type Availability {
+	daily: [DailyUptime!]!
+	outages: [Outage!]!
+}
+
+type DailyUptime {
+	date: String!
+	uptimePercent: Float!
+}
+
+type Outage {
+	start: Float!
+	end: Float
+}
+
+type Event {
+	removed: Boolean!
+	service: Service!
+}
+`
+
+type graphqlResolver struct {
+	s *MDNSServer
+}
+
+func (r *graphqlResolver) Services(args struct {
+	Site *string
+	Type *string
+}) []*serviceResolver {
+	var result []*serviceResolver
+	for _, service := range r.s.listServices(r.s.scopeSite(deref(args.Site))) {
+		if args.Type == nil || service.Type == *args.Type {
+			result = append(result, &serviceResolver{service})
+		}
+	}
+	return result
+}
+
+func (r *graphqlResolver) Devices(args struct {
+	Site  *string
+	Query *string
+}) []*deviceResolver {
+	var result []*deviceResolver
+	for _, d := range r.s.listDevices(r.s.scopeSite(deref(args.Site)), deref(args.Query)) {
+		result = append(result, &deviceResolver{s: r.s, d: d})
+	}
+	return result
+}
+
+func (r *graphqlResolver) Device(args struct {
+	ID   graphql.ID
+	Site *string
+}) *deviceResolver {
+	site := r.s.scopeSite(deref(args.Site))
+	if site == "" {
+		site = r.s.site
+	}
+	id := string(args.ID)
+
+	d := r.s.metadata.Get(site, id)
+	if d == nil {
+		d = &DeviceMetadata{ID: id, Site: site}
+	}
+	dr := &deviceResolver{s: r.s, d: d}
+	if d.UpdatedAt == 0 && len(dr.Services()) == 0 {
+		return nil
+	}
+	return dr
+}
+
+func (r *graphqlResolver) Events(ctx context.Context, args struct{ Site *string }) <-chan *eventResolver {
+	site := r.s.scopeSite(deref(args.Site))
+
+	client := &streamClient{
+		id:          nextClientID.Add(1),
+		transport:   "graphql",
+		ch:          make(chan *streamEvent, r.s.clientBuffer),
+		site:        site,
+		connectedAt: time.Now(),
+		filters:     map[string]string{"site": deref(args.Site)},
+		disconnect:  make(chan struct{}),
+	}
+	if info, ok := ctx.Value(graphqlRequestKey{}).(*http.Request); ok {
+		client.remoteAddr = info.RemoteAddr
+		client.userAgent = info.UserAgent()
+	}
+	r.s.registerClient(client)
+
+	events := make(chan *eventResolver)
+	go func() {
+		defer close(events)
+		defer r.s.unregisterClient(client)
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-client.disconnect:
+				return
+			case ev := <-client.ch:
+				select {
+				case events <- &eventResolver{ev.response}:
+					client.delivered.Add(1)
+				case <-ctx.Done():
+					return
+				}
+			}
+		}
+	}()
+	return events
+}
+
+type serviceResolver struct {
+	svc MDNSService
+}
+
+func (r *serviceResolver) Name() string       { return r.svc.Name }
+func (r *serviceResolver) Type() string       { return r.svc.Type }
+func (r *serviceResolver) Host() string       { return r.svc.Host }
+func (r *serviceResolver) IP() string         { return r.svc.IP }
+func (r *serviceResolver) IP6() *string       { return optional(r.svc.IP6) }
+func (r *serviceResolver) Port() int32        { return int32(r.svc.Port) }
+func (r *serviceResolver) Timestamp() float64 { return float64(r.svc.Timestamp) }
+func (r *serviceResolver) Site() string       { return r.svc.Site }
+
+func (r *serviceResolver) LastRefreshed() float64 { return float64(r.svc.LastRefreshed) }
+func (r *serviceResolver) ExpiresAt() float64     { return float64(r.svc.ExpiresAt) }
+
+func (r *serviceResolver) FirstSeen() *string     { return optional(r.svc.FirstSeen) }
+func (r *serviceResolver) LastSeen() *string      { return optional(r.svc.LastSeen) }
+func (r *serviceResolver) Source() *string        { return optional(r.svc.Source) }
+func (r *serviceResolver) RawRecordType() *string { return optional(r.svc.RawRecordType) }
+
+func (r *serviceResolver) Confidence() *float64 {
+	if r.svc.Confidence == 0 {
+		return nil
+	}
+	return &r.svc.Confidence
+}
+
+func (r *serviceResolver) Reachable() *bool { return r.svc.Reachable }
+
+func (r *serviceResolver) CheckedAt() *float64   { return optionalTime(r.svc.CheckedAt) }
+func (r *serviceResolver) ReachableAt() *float64 { return optionalTime(r.svc.ReachableAt) }
+
+func (r *serviceResolver) Interfaces() []*serviceInterfaceResolver {
+	result := make([]*serviceInterfaceResolver, len(r.svc.Interfaces))
+	for i, iface := range r.svc.Interfaces {
+		result[i] = &serviceInterfaceResolver{iface}
+	}
+	return result
+}
+
+func (r *serviceResolver) Targets() []*serviceTargetResolver {
+	result := make([]*serviceTargetResolver, len(r.svc.Targets))
+	for i, target := range r.svc.Targets {
+		result[i] = &serviceTargetResolver{target}
+	}
+	return result
+}
+
+type serviceTargetResolver struct {
+	target ServiceTarget
+}
+
+func (r *serviceTargetResolver) Host() string       { return r.target.Host }
+func (r *serviceTargetResolver) Port() int32        { return int32(r.target.Port) }
+func (r *serviceTargetResolver) Priority() int32    { return int32(r.target.Priority) }
+func (r *serviceTargetResolver) Weight() int32      { return int32(r.target.Weight) }
+func (r *serviceTargetResolver) IP() *string        { return optional(r.target.IP) }
+func (r *serviceTargetResolver) IP6() *string       { return optional(r.target.IP6) }
+func (r *serviceTargetResolver) ExpiresAt() float64 { return float64(r.target.ExpiresAt) }
+
+type serviceInterfaceResolver struct {
+	iface ServiceInterface
+}
+
+func (r *serviceInterfaceResolver) Name() string      { return r.iface.Name }
+func (r *serviceInterfaceResolver) LastSeen() float64 { return float64(r.iface.LastSeen) }
+
+type deviceResolver struct {
+	s *MDNSServer
+	d *DeviceMetadata
+}
+
+func (r *deviceResolver) ID() graphql.ID    { return graphql.ID(r.d.ID) }
+func (r *deviceResolver) Site() string      { return r.d.Site }
+func (r *deviceResolver) Owner() *string    { return optional(r.d.Owner) }
+func (r *deviceResolver) Location() *string { return optional(r.d.Location) }
+
+func (r *deviceResolver) UpdatedAt() *float64 {
+	if r.d.UpdatedAt == 0 {
+		return nil
+	}
+	t := float64(r.d.UpdatedAt)
+	return &t
+}
+
+func (r *deviceResolver) Notes() []*noteResolver {
+	keys := make([]string, 0, len(r.d.Notes))
+	for k := range r.d.Notes {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	notes := make([]*noteResolver, 0, len(keys))
+	for _, k := range keys {
+		notes = append(notes, &noteResolver{key: k, value: r.d.Notes[k]})
+	}
+	return notes
+}
+
+func (r *deviceResolver) Services() []*serviceResolver {
+	var result []*serviceResolver
+	for _, service := range r.s.listServices(r.d.Site) {
+		if deviceID(&service) == r.d.ID {
+			result = append(result, &serviceResolver{service})
+		}
+	}
+	return result
+}
+
+func (r *deviceResolver) Availability(args struct{ Days int32 }) (*availabilityResolver, error) {
+	if args.Days < 1 || args.Days > 90 {
+		return nil, fmt.Errorf("days must be between 1 and 90")
+	}
+	history := r.s.availability.History(siteKey(r.d.Site, r.d.ID))
+	return &availabilityResolver{buildAvailabilityReport(r.d.ID, history, int(args.Days), time.Now())}, nil
+}
+
+type noteResolver struct {
+	key, value string
+}
+
+func (r *noteResolver) Key() string   { return r.key }
+func (r *noteResolver) Value() string { return r.value }
+
+type availabilityResolver struct {
+	report *AvailabilityReport
+}
+
+func (r *availabilityResolver) Daily() []*dailyUptimeResolver {
+	result := make([]*dailyUptimeResolver, 0, len(r.report.Daily))
+	for _, d := range r.report.Daily {
+		result = append(result, &dailyUptimeResolver{d})
+	}
+	return result
+}
+
+func (r *availabilityResolver) Outages() []*outageResolver {
+	result := make([]*outageResolver, 0, len(r.report.Outages))
+	for _, o := range r.report.Outages {
+		result = append(result, &outageResolver{o})
+	}
+	return result
+}
+
+type dailyUptimeResolver struct {
+	d DailyUptime
+}
+
+func (r *dailyUptimeResolver) Date() string           { return r.d.Date }
+func (r *dailyUptimeResolver) UptimePercent() float64 { return r.d.UptimePercent }
+
+type outageResolver struct {
+	o Outage
+}
+
+func (r *outageResolver) Start() float64 { return float64(r.o.Start) }
+
+func (r *outageResolver) End() *float64 {
+	if r.o.End == 0 {
+		return nil
+	}
+	t := float64(r.o.End)
+	return &t
+}
+
+type eventResolver struct {
+	e *DiscoveryResponse
+}
+
+func (r *eventResolver) Removed() bool             { return r.e.Removed }
+func (r *eventResolver) Service() *serviceResolver { return &serviceResolver{r.e.Service} }
+
+func deref(s *string) string {
+	if s == nil {
+		return ""
+	}
+	return *s
+}
+
+func optionalTime(t int64) *float64 {
+	if t == 0 {
+		return nil
+	}
+	f := float64(t)
+	return &f
+}
+
+func optional(s string) *string {
+	if s == "" {
+		return nil
+	}
+	return &s
+}
+
+// graphqlRequestKey carries the HTTP request into subscription resolvers so
+// their clients show up with a remote address on /api/clients.
+type graphqlRequestKey struct{}
+
+// newGraphQLSchema parses the schema against the server's resolvers.
+func newGraphQLSchema(s *MDNSServer) *graphql.Schema {
+	return graphql.MustParseSchema(graphqlSchema, &graphqlResolver{s: s}, graphql.MaxDepth(10))
+}
+
+// GraphQL handles /api/graphql. Queries are accepted as GET ?query= or as a
+// JSON POST body {"query", "operationName", "variables"}. Requests sent with
+// "Accept: text/event-stream" are answered as a GraphQL-over-SSE stream,
+// which is how subscriptions are delivered.
+func (s *MDNSServer) GraphQL(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Query         string                 `json:"query"`
+		OperationName string                 `json:"operationName"`
+		Variables     map[string]interface{} `json:"variables"`
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		req.Query = r.URL.Query().Get("query")
+		req.OperationName = r.URL.Query().Get("operationName")
+		if v := r.URL.Query().Get("variables"); v != "" {
+			if err := json.Unmarshal([]byte(v), &req.Variables); err != nil {
+				writeError(w, http.StatusBadRequest, "invalid variables: "+err.Error())
+				return
+			}
+		}
+	case http.MethodPost:
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+	default:
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	if !strings.Contains(r.Header.Get("Accept"), "text/event-stream") {
+		response := s.graphql.Exec(r.Context(), req.Query, req.OperationName, req.Variables)
+		writeJSON(w, http.StatusOK, response)
+		return
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeError(w, http.StatusInternalServerError, "streaming unsupported")
+		return
+	}
+
+	ctx := context.WithValue(r.Context(), graphqlRequestKey{}, r)
+	responses, err := s.graphql.Subscribe(ctx, req.Query, req.OperationName, req.Variables)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	for response := range responses {
+		data, _ := json.Marshal(response)
+		fmt.Fprintf(w, "event: next\ndata: %s\n\n", data)
+		flusher.Flush()
+	}
+	fmt.Fprint(w, "event: complete\ndata:\n\n")
+	flusher.Flush()
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+)
+
+// TestGraphQLDeviceQuery verifies a nested device -> services query resolves
+func TestGraphQLDeviceQuery(t *testing.T) {
+	store := openTestStore(t, "json", t.TempDir())
+	server := NewMDNSServer()
+	server.metadata, _ = NewMetadataStore(store)
+	server.availability, _ = NewAvailabilityTracker(store)
+	server.graphql = newGraphQLSchema(server)
+
+	server.addService("10.0.0.2:_smb._tcp.local.:445", &MDNSService{Name: "NAS", Host: "nas.local", IP: "10.0.0.2", Type: "_smb._tcp.local.", Port: 445})
+	server.metadata.Update(defaultSite, "nas.local", func(d *DeviceMetadata) { d.Location = "office" })
+
+	query := `{ device(id: "nas.local") { location services { name port } availability(days: 1) { daily { date } } } }`
+	response := server.graphql.Exec(context.Background(), query, "", nil)
+	if len(response.Errors) > 0 {
+		t.Fatalf("Query failed: %v", response.Errors)
+	}
+
+	var data struct {
+		Device struct {
+			Location string
+			Services []struct {
+				Name string
+				Port int
+			}
+		}
+	}
+	if err := json.Unmarshal(response.Data, &data); err != nil {
+		t.Fatalf("Failed to decode response: %v", err)
+	}
+	if data.Device.Location != "office" || len(data.Device.Services) != 1 || data.Device.Services[0].Port != 445 {
+		t.Fatalf("Unexpected device data: %s", response.Data)
+	}
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+)
+
+// defaultCSP is the Content-Security-Policy of the frontend: everything
+// from this server, with inline styles, which Svelte's transitions use,
+// and the event streams, which may be WebSockets.
+const defaultCSP = "default-src 'self'; script-src 'self'; style-src 'self' 'unsafe-inline'; img-src 'self' data:; connect-src 'self' ws: wss:; object-src 'none'; base-uri 'self'; form-action 'self'"
+
+// SecurityHeaders are the headers the frontend is served with.
+type SecurityHeaders struct {
+	Policy         string // Content-Security-Policy, empty sends none
+	ReportOnly     bool   // send it as Content-Security-Policy-Report-Only
+	FrameAncestors string // who may frame the frontend, e.g. 'none' or 'self'
+}
+
+// policy is the CSP with the frame-ancestors directive, unless the policy
+// has its own.
+func (h SecurityHeaders) policy() string {
+	policy := strings.TrimSpace(strings.TrimSuffix(strings.TrimSpace(h.Policy), ";"))
+	if h.FrameAncestors == "" || strings.Contains(policy, "frame-ancestors") {
+		return policy
+	}
+	if policy != "" {
+		policy += "; "
+	}
+	return policy + "frame-ancestors " + h.FrameAncestors
+}
+
+// Wrap adds the headers to next's responses. X-Frame-Options repeats
+// frame-ancestors for browsers without CSP level 2; it isn't sent in
+// report-only mode, which shouldn't block anything.
+func (h SecurityHeaders) Wrap(next http.Handler) http.Handler {
+	policy := h.policy()
+	header := "Content-Security-Policy"
+	if h.ReportOnly {
+		header = "Content-Security-Policy-Report-Only"
+	}
+	frameOptions := ""
+	switch h.FrameAncestors {
+	case "'none'":
+		frameOptions = "DENY"
+	case "'self'":
+		frameOptions = "SAMEORIGIN"
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if policy != "" {
+			w.Header().Set(header, policy)
+		}
+		if frameOptions != "" && !h.ReportOnly {
+			w.Header().Set("X-Frame-Options", frameOptions)
+		}
+		w.Header().Set("X-Content-Type-Options", "nosniff")
+		w.Header().Set("Referrer-Policy", "same-origin")
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func securityHeadersOf(h SecurityHeaders) http.Header {
+	rec := httptest.NewRecorder()
+	h.Wrap(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+	return rec.Header()
+}
+
+// TestSecurityHeaders verifies the frontend's CSP, frame and content type
+// headers
+func TestSecurityHeaders(t *testing.T) {
+	headers := securityHeadersOf(SecurityHeaders{Policy: defaultCSP, FrameAncestors: "'none'"})
+	if headers.Get("Content-Security-Policy") != defaultCSP+"; frame-ancestors 'none'" {
+		t.Fatalf("Expected the default policy with frame-ancestors, got %q", headers.Get("Content-Security-Policy"))
+	}
+	if headers.Get("X-Frame-Options") != "DENY" || headers.Get("X-Content-Type-Options") != "nosniff" {
+		t.Fatalf("Expected framing and sniffing to be forbidden, got %v", headers)
+	}
+
+	headers = securityHeadersOf(SecurityHeaders{Policy: "default-src 'self'; frame-ancestors https://grafana.example.com;", ReportOnly: true, FrameAncestors: "'self'"})
+	if headers.Get("Content-Security-Policy") != "" || headers.Get("Content-Security-Policy-Report-Only") != "default-src 'self'; frame-ancestors https://grafana.example.com" {
+		t.Fatalf("Expected a report-only policy keeping its own frame-ancestors, got %v", headers)
+	}
+	if headers.Get("X-Frame-Options") != "" {
+		t.Fatalf("Expected no X-Frame-Options in report-only mode, got %q", headers.Get("X-Frame-Options"))
+	}
+
+	headers = securityHeadersOf(SecurityHeaders{FrameAncestors: "'self'"})
+	if headers.Get("Content-Security-Policy") != "frame-ancestors 'self'" || headers.Get("X-Frame-Options") != "SAMEORIGIN" {
+		t.Fatalf("Expected only frame-ancestors without a policy, got %v", headers)
+	}
+}
@@ -0,0 +1,383 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/user"
+	"strconv"
+	"sync"
+	"time"
+
+	"golang.org/x/net/icmp"
+	"golang.org/x/net/ipv4"
+)
+
+// The privileged helper runs the few operations that need root (raw
+// sockets, the neighbor table on some systems) in a separate process, so
+// the HTTP server never has to. It serves a fixed set of operations as JSON
+// lines over a Unix socket; nothing it receives is executed or forwarded.
+// Packet captures and raw sockets are opened by the helper and passed to the
+// server as descriptors.
+
+const defaultHelperSocket = "/var/run/network-view-osx.sock"
+
+// Helper operations.
+const (
+	helperOpNeighbors = "neighbors" // the ARP table
+	helperOpPing      = "ping"      // one ICMP echo
+	helperOpCapture   = "capture"   // a packet capture, passed as a descriptor
+	helperOpICMPv6    = "icmpv6"    // a raw ICMPv6 socket, passed as a descriptor
+)
+
+// maxPingTimeout bounds how long a single ping may keep the helper busy.
+const maxPingTimeout = 5 * time.Second
+
+type helperRequest struct {
+	Op        string `json:"op"`
+	IP        string `json:"ip,omitempty"`
+	Iface     string `json:"iface,omitempty"`
+	TimeoutMs int    `json:"timeoutMs,omitempty"`
+}
+
+type helperResponse struct {
+	Error     string            `json:"error,omitempty"`
+	Neighbors map[string]string `json:"neighbors,omitempty"`
+	RTTMs     float64           `json:"rttMs,omitempty"`
+}
+
+// runHelper serves the privileged helper on a Unix socket at path. Only
+// root and, when group is set, members of group may connect.
+func runHelper(path, group string) error {
+	os.Remove(path)
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		return err
+	}
+	defer l.Close()
+
+	mode := os.FileMode(0o600)
+	if group != "" {
+		g, err := user.LookupGroup(group)
+		if err != nil {
+			return err
+		}
+		gid, err := strconv.Atoi(g.Gid)
+		if err != nil {
+			return fmt.Errorf("group %s: %v", group, err)
+		}
+		if err := os.Chown(path, -1, gid); err != nil {
+			return err
+		}
+		mode = 0o660
+	}
+	if err := os.Chmod(path, mode); err != nil {
+		return err
+	}
+
+	log.Printf("🔒 Privileged helper listening on %s", path)
+	return serveHelper(l)
+}
+
+// serveHelper accepts helper connections until l is closed.
+func serveHelper(l net.Listener) error {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		go func() {
+			defer conn.Close()
+			dec := json.NewDecoder(conn)
+			enc := json.NewEncoder(conn)
+			for {
+				var req helperRequest
+				if err := dec.Decode(&req); err != nil {
+					return
+				}
+				if req.Op == helperOpCapture || req.Op == helperOpICMPv6 {
+					if err := serveDescriptor(conn, req); err != nil {
+						return
+					}
+					continue
+				}
+				if err := enc.Encode(handleHelperRequest(req)); err != nil {
+					return
+				}
+			}
+		}()
+	}
+}
+
+// serveDescriptor opens the packet capture or raw socket req asks for and
+// passes its descriptor to the client with the response, so a server that
+// dropped its privileges can still use it.
+func serveDescriptor(conn net.Conn, req helperRequest) error {
+	fd, err := -1, error(nil)
+	switch req.Op {
+	case helperOpCapture:
+		if _, err = net.InterfaceByName(req.Iface); err == nil {
+			fd, err = openCaptureFD(req.Iface)
+		}
+	case helperOpICMPv6:
+		fd, err = openICMPv6FD()
+	}
+	var resp helperResponse
+	if err != nil {
+		resp.Error = err.Error()
+	}
+	data, _ := json.Marshal(resp)
+	data = append(data, '\n')
+	if fd < 0 {
+		_, err = conn.Write(data)
+		return err
+	}
+	return writeWithFD(conn, data, fd)
+}
+
+func handleHelperRequest(req helperRequest) helperResponse {
+	switch req.Op {
+	case helperOpNeighbors:
+		macs, err := readARPTable()
+		if err != nil {
+			return helperResponse{Error: err.Error()}
+		}
+		return helperResponse{Neighbors: macs}
+
+	case helperOpPing:
+		ip := net.ParseIP(req.IP).To4()
+		if ip == nil {
+			return helperResponse{Error: "ping needs an IPv4 address"}
+		}
+		timeout := min(time.Duration(req.TimeoutMs)*time.Millisecond, maxPingTimeout)
+		if timeout <= 0 {
+			timeout = time.Second
+		}
+		rtt, err := pingICMP(ip, timeout)
+		if err != nil {
+			return helperResponse{Error: err.Error()}
+		}
+		return helperResponse{RTTMs: milliseconds(rtt)}
+
+	default:
+		return helperResponse{Error: fmt.Sprintf("unknown operation %q", req.Op)}
+	}
+}
+
+// pingICMP sends one ICMP echo request to ip over a raw socket and waits for
+// the reply. It needs root.
+func pingICMP(ip net.IP, timeout time.Duration) (time.Duration, error) {
+	conn, err := icmp.ListenPacket("ip4:icmp", "0.0.0.0")
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Close()
+
+	id := os.Getpid() & 0xffff
+	msg := icmp.Message{
+		Type: ipv4.ICMPTypeEcho,
+		Body: &icmp.Echo{ID: id, Seq: 1, Data: []byte("network-view")},
+	}
+	packet, err := msg.Marshal(nil)
+	if err != nil {
+		return 0, err
+	}
+
+	start := time.Now()
+	if _, err := conn.WriteTo(packet, &net.IPAddr{IP: ip}); err != nil {
+		return 0, err
+	}
+	conn.SetReadDeadline(start.Add(timeout))
+
+	buffer := make([]byte, 1500)
+	for {
+		n, peer, err := conn.ReadFrom(buffer)
+		if err != nil {
+			return 0, err
+		}
+		reply, err := icmp.ParseMessage(1, buffer[:n])
+		if err != nil || reply.Type != ipv4.ICMPTypeEchoReply || peer.String() != ip.String() {
+			continue
+		}
+		if echo, ok := reply.Body.(*icmp.Echo); ok && echo.ID == id {
+			return time.Since(start), nil
+		}
+	}
+}
+
+// errNoHelper is returned by privileged operations when no helper is
+// configured.
+var errNoHelper = errors.New("no privileged helper configured (-helper-socket)")
+
+// HelperClient talks to the privileged helper. It connects lazily and
+// reconnects after errors, so the helper may start after the server.
+type HelperClient struct {
+	path string
+
+	mu        sync.Mutex
+	conn      net.Conn
+	enc       *json.Encoder
+	dec       *json.Decoder
+	lastError string
+}
+
+func NewHelperClient(path string) *HelperClient {
+	return &HelperClient{path: path}
+}
+
+func (c *HelperClient) call(req helperRequest, timeout time.Duration) (helperResponse, error) {
+	if c == nil {
+		return helperResponse{}, errNoHelper
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	resp, err := c.roundTrip(req, timeout)
+	if err != nil {
+		if c.conn != nil {
+			c.conn.Close()
+			c.conn = nil
+		}
+		c.lastError = err.Error()
+		return resp, err
+	}
+	if resp.Error != "" {
+		return resp, errors.New(resp.Error)
+	}
+	return resp, nil
+}
+
+// roundTrip must be called with c.mu held.
+func (c *HelperClient) roundTrip(req helperRequest, timeout time.Duration) (helperResponse, error) {
+	var resp helperResponse
+	if c.conn == nil {
+		conn, err := net.DialTimeout("unix", c.path, time.Second)
+		if err != nil {
+			return resp, err
+		}
+		c.conn = conn
+		c.enc = json.NewEncoder(conn)
+		c.dec = json.NewDecoder(conn)
+	}
+
+	c.conn.SetDeadline(time.Now().Add(timeout))
+	if err := c.enc.Encode(req); err != nil {
+		return resp, err
+	}
+	err := c.dec.Decode(&resp)
+	return resp, err
+}
+
+// Neighbors returns the ARP table read by the helper.
+func (c *HelperClient) Neighbors() (map[string]string, error) {
+	resp, err := c.call(helperRequest{Op: helperOpNeighbors}, 5*time.Second)
+	return resp.Neighbors, err
+}
+
+// Ping sends one ICMP echo to ip through the helper and returns the round
+// trip time. Addresses outside the scan scope aren't pinged; the helper
+// refuses anything but an address itself.
+func (c *HelperClient) Ping(ip string, timeout time.Duration) (time.Duration, error) {
+	if net.ParseIP(ip) != nil {
+		if err := scanScope.check(ip); err != nil {
+			return 0, err
+		}
+	}
+	resp, err := c.call(helperRequest{Op: helperOpPing, IP: ip, TimeoutMs: int(timeout / time.Millisecond)}, timeout+time.Second)
+	return time.Duration(resp.RTTMs * float64(time.Millisecond)), err
+}
+
+// openDescriptor asks the helper for a descriptor. It dials a connection
+// of its own, so the descriptor can't get mixed up with the buffered
+// responses of other calls.
+func (c *HelperClient) openDescriptor(req helperRequest) (int, error) {
+	if c == nil {
+		return -1, errNoHelper
+	}
+	conn, err := net.DialTimeout("unix", c.path, time.Second)
+	if err != nil {
+		return -1, err
+	}
+	defer conn.Close()
+
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if err := json.NewEncoder(conn).Encode(req); err != nil {
+		return -1, err
+	}
+	_, fd, err := readResponseWithFD(conn)
+	return fd, err
+}
+
+// OpenCapture opens a packet capture on iface through the helper, which
+// passes the open socket or BPF device to this process.
+func (c *HelperClient) OpenCapture(iface string) (packetSource, error) {
+	fd, err := c.openDescriptor(helperRequest{Op: helperOpCapture, Iface: iface})
+	if err != nil {
+		return nil, err
+	}
+	return newPacketSource(fd)
+}
+
+// ListenICMPv6 opens a raw ICMPv6 socket through the helper, for the
+// router advertisement monitor.
+func (c *HelperClient) ListenICMPv6() (net.PacketConn, error) {
+	fd, err := c.openDescriptor(helperRequest{Op: helperOpICMPv6})
+	if err != nil {
+		return nil, err
+	}
+	return packetConnFromFD(fd)
+}
+
+// Status is the helper section of /api/status.
+func (c *HelperClient) Status() map[string]interface{} {
+	if c == nil {
+		return map[string]interface{}{"configured": false}
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return map[string]interface{}{
+		"configured": true,
+		"socket":     c.path,
+		"connected":  c.conn != nil,
+		"lastError":  c.lastError,
+	}
+}
+
+// Ping handles GET /api/ping/{ip}, an ICMP echo through the privileged
+// helper.
+func (s *MDNSServer) Ping(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	if s.helper == nil {
+		writeError(w, http.StatusServiceUnavailable, errNoHelper.Error())
+		return
+	}
+
+	ip := r.PathValue("ip")
+	rtt, err := s.helper.Ping(ip, time.Second)
+	if outOfScope(err) {
+		writeError(w, http.StatusForbidden, err.Error())
+		return
+	}
+	if err != nil {
+		writeJSON(w, http.StatusOK, map[string]interface{}{
+			"ip":        ip,
+			"reachable": false,
+			"error":     err.Error(),
+		})
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"ip":        ip,
+		"reachable": true,
+		"rttMs":     milliseconds(rtt),
+	})
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+)
+
+// startTestHelper serves the helper on a socket in a temp dir.
+func startTestHelper(t *testing.T) (string, net.Listener) {
+	path := filepath.Join(t.TempDir(), "helper.sock")
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatalf("Failed to listen on %s: %v", path, err)
+	}
+	go serveHelper(l)
+	return path, l
+}
+
+// TestHelperRejectsRequests verifies the helper only serves its fixed
+// operations with valid arguments
+func TestHelperRejectsRequests(t *testing.T) {
+	path, l := startTestHelper(t)
+	defer l.Close()
+	client := NewHelperClient(path)
+
+	if _, err := client.call(helperRequest{Op: "exec"}, time.Second); err == nil || !strings.Contains(err.Error(), "unknown operation") {
+		t.Fatalf("Expected an unknown operation error, got %v", err)
+	}
+	if _, err := client.Ping("example.com", time.Second); err == nil || !strings.Contains(err.Error(), "IPv4") {
+		t.Fatalf("Expected ping to require an IPv4 address, got %v", err)
+	}
+	if status := client.Status(); status["connected"] != true {
+		t.Fatalf("Expected the client to stay connected after request errors, got %v", status)
+	}
+}
+
+// TestHelperCapture verifies the helper passes a working packet capture to
+// the server and refuses interfaces that don't exist
+func TestHelperCapture(t *testing.T) {
+	path, l := startTestHelper(t)
+	defer l.Close()
+	client := NewHelperClient(path)
+
+	if _, err := client.OpenCapture("no-such-iface0"); err == nil {
+		t.Fatalf("Expected no capture on an unknown interface")
+	}
+	if runtime.GOOS != "linux" || os.Geteuid() != 0 {
+		t.Skip("capturing on lo needs root on Linux")
+	}
+
+	src, err := client.OpenCapture("lo")
+	if err != nil {
+		t.Fatalf("Expected a capture on lo, got %v", err)
+	}
+	defer src.Close()
+	conn, err := net.Dial("udp", "127.0.0.1:9")
+	if err != nil {
+		t.Fatalf("Failed to dial: %v", err)
+	}
+	defer conn.Close()
+	marker := []byte("helper capture test")
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		conn.Write(marker)
+		frame, _, err := src.ReadPacket()
+		if err != nil {
+			t.Fatalf("Failed to read the passed capture: %v", err)
+		}
+		if strings.Contains(string(frame), string(marker)) {
+			return
+		}
+	}
+	t.Fatalf("Expected the capture to see a packet sent to lo")
+}
+
+// TestHelperReconnect verifies the client reconnects once the helper is back
+func TestHelperReconnect(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "helper.sock")
+	client := NewHelperClient(path)
+
+	if _, err := client.call(helperRequest{Op: "exec"}, time.Second); err == nil || strings.Contains(err.Error(), "unknown operation") {
+		t.Fatalf("Expected a connection error without a helper, got %v", err)
+	}
+
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatalf("Failed to listen on %s: %v", path, err)
+	}
+	defer l.Close()
+	go serveHelper(l)
+
+	if _, err := client.call(helperRequest{Op: "exec"}, time.Second); err == nil || !strings.Contains(err.Error(), "unknown operation") {
+		t.Fatalf("Expected the helper's error after it started, got %v", err)
+	}
+}
+
+// TestNoHelper verifies privileged calls fail cleanly without a helper
+func TestNoHelper(t *testing.T) {
+	var client *HelperClient
+	if _, err := client.Ping("192.168.1.1", time.Second); err != errNoHelper {
+		t.Fatalf("Expected errNoHelper, got %v", err)
+	}
+	if _, err := client.OpenCapture("lo"); err != errNoHelper {
+		t.Fatalf("Expected errNoHelper for a capture, got %v", err)
+	}
+	if status := client.Status(); status["configured"] != false {
+		t.Fatalf("Expected an unconfigured helper status, got %v", status)
+	}
+}
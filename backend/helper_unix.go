@@ -0,0 +1,103 @@
+//go:build !windows
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// writeWithFD writes data to conn with fd attached, so the process on the
+// other end receives its own copy of the descriptor. fd is closed either
+// way.
+func writeWithFD(conn net.Conn, data []byte, fd int) error {
+	defer unix.Close(fd)
+	uc, ok := conn.(*net.UnixConn)
+	if !ok {
+		return errors.New("descriptors can only be passed over Unix sockets")
+	}
+	_, _, err := uc.WriteMsgUnix(data, unix.UnixRights(fd), nil)
+	return err
+}
+
+// readResponseWithFD reads a helper response and the descriptor passed
+// along with it. The descriptor is -1 when the response is an error or
+// carries none.
+func readResponseWithFD(conn net.Conn) (helperResponse, int, error) {
+	var resp helperResponse
+	uc, ok := conn.(*net.UnixConn)
+	if !ok {
+		return resp, -1, errors.New("descriptors can only be passed over Unix sockets")
+	}
+	buf := make([]byte, 4096)
+	oob := make([]byte, unix.CmsgSpace(4))
+	n, oobn, _, _, err := uc.ReadMsgUnix(buf, oob)
+	if err != nil {
+		return resp, -1, err
+	}
+
+	fd := -1
+	msgs, _ := unix.ParseSocketControlMessage(oob[:oobn])
+	for _, msg := range msgs {
+		fds, _ := unix.ParseUnixRights(&msg)
+		for _, f := range fds {
+			if fd < 0 {
+				fd = f
+				unix.CloseOnExec(fd)
+			} else {
+				unix.Close(f)
+			}
+		}
+	}
+	fail := func(err error) (helperResponse, int, error) {
+		if fd >= 0 {
+			unix.Close(fd)
+		}
+		return resp, -1, err
+	}
+
+	// The descriptor comes with the first bytes; a long error may need
+	// more reads
+	line := buf[:n]
+	for !bytes.HasSuffix(line, []byte("\n")) && len(line) < len(buf) {
+		m, err := conn.Read(buf[len(line):])
+		if err != nil {
+			return fail(err)
+		}
+		line = buf[:len(line)+m]
+	}
+	if err := json.Unmarshal(line, &resp); err != nil {
+		return fail(err)
+	}
+	if resp.Error != "" {
+		return fail(errors.New(resp.Error))
+	}
+	if fd < 0 {
+		return fail(errors.New("helper passed no capture"))
+	}
+	return resp, fd, nil
+}
+
+// openICMPv6FD opens the raw ICMPv6 socket of the router advertisement
+// monitor.
+func openICMPv6FD() (int, error) {
+	fd, err := unix.Socket(unix.AF_INET6, unix.SOCK_RAW, unix.IPPROTO_ICMPV6)
+	if err != nil {
+		return -1, fmt.Errorf("ICMPv6 socket: %v", err)
+	}
+	unix.CloseOnExec(fd)
+	return fd, nil
+}
+
+// packetConnFromFD wraps a socket passed by the helper. It takes over fd.
+func packetConnFromFD(fd int) (net.PacketConn, error) {
+	f := os.NewFile(uintptr(fd), "helper socket")
+	defer f.Close()
+	return net.FilePacketConn(f)
+}
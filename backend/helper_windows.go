@@ -0,0 +1,23 @@
+//go:build windows
+
+package main
+
+import "net"
+
+// Passing descriptors is not supported on Windows, which has no packet
+// capture or raw sockets to pass.
+func writeWithFD(conn net.Conn, data []byte, fd int) error {
+	return errCaptureUnsupported
+}
+
+func readResponseWithFD(conn net.Conn) (helperResponse, int, error) {
+	return helperResponse{}, -1, errCaptureUnsupported
+}
+
+func openICMPv6FD() (int, error) {
+	return -1, errCaptureUnsupported
+}
+
+func packetConnFromFD(fd int) (net.PacketConn, error) {
+	return nil, errCaptureUnsupported
+}
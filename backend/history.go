@@ -0,0 +1,71 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+var (
+	// historyWindow and historyMax bound the service changes and anomalies
+	// kept for reports
+	historyWindow = 7 * 24 * time.Hour
+	historyMax    = 1000
+)
+
+// HistoryEntry is a service change or anomaly, at the time it was published.
+type HistoryEntry struct {
+	Time    time.Time
+	Change  *DiscoveryResponse // a service appeared or was removed
+	Anomaly *AnomalyEvent
+}
+
+// EventHistory keeps the recent service changes and anomalies published on
+// the bus, in memory, for the report's findings and recent changes.
+type EventHistory struct {
+	mu      sync.Mutex
+	entries []HistoryEntry
+}
+
+// NewEventHistory records the service and anomaly events of bus.
+func NewEventHistory(bus *EventBus) *EventHistory {
+	h := &EventHistory{}
+	bus.Subscribe("history", h.record, TopicService, TopicAnomaly)
+	return h
+}
+
+func (h *EventHistory) record(e BusEvent) {
+	entry := HistoryEntry{Time: e.Time}
+	switch payload := e.Payload.(type) {
+	case *DiscoveryResponse:
+		entry.Change = payload
+	case AnomalyEvent:
+		entry.Anomaly = &payload
+	default:
+		return
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.entries = append(h.entries, entry)
+	cutoff := e.Time.Add(-historyWindow)
+	drop := max(len(h.entries)-historyMax, 0)
+	for drop < len(h.entries) && h.entries[drop].Time.Before(cutoff) {
+		drop++
+	}
+	if drop > 0 {
+		h.entries = append(h.entries[:0:0], h.entries[drop:]...)
+	}
+}
+
+// Since returns the entries recorded at or after since, oldest first.
+func (h *EventHistory) Since(since time.Time) []HistoryEntry {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	var entries []HistoryEntry
+	for _, entry := range h.entries {
+		if !entry.Time.Before(since) {
+			entries = append(entries, entry)
+		}
+	}
+	return entries
+}
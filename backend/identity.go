@@ -0,0 +1,47 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// identityFunc returns the key two sightings must share to be deduplicated
+// as the same service.
+type identityFunc func(service *MDNSService) string
+
+// identityFuncs are the selectable dedup identities (-identity).
+var identityFuncs = map[string]identityFunc{
+	// The DNS-SD instance name, e.g. "Office Printer._ipp._tcp.local.",
+	// which stays the same across DHCP renewals and address families
+	"instance": func(service *MDNSService) string {
+		return strings.ToLower(service.Name + "." + service.Type)
+	},
+	"host": func(service *MDNSService) string {
+		return fmt.Sprintf("%s:%s:%d", strings.ToLower(deviceID(service)), service.Type, service.Port)
+	},
+	// The device's MAC address from the ARP table, falling back to the IP
+	// address for devices that are not on a local segment
+	"mac": func(service *MDNSService) string {
+		if mac := neighbors.lookup(service.IP); mac != "" {
+			return fmt.Sprintf("%s:%s:%d", mac, service.Type, service.Port)
+		}
+		return ipIdentity(service)
+	},
+	"ip": ipIdentity,
+}
+
+// ipIdentity was the only identity before it became configurable.
+func ipIdentity(service *MDNSService) string {
+	return fmt.Sprintf("%s:%s:%d", service.IP, service.Type, service.Port)
+}
+
+// identityNames lists the selectable identities for flag help and errors.
+func identityNames() string {
+	names := make([]string, 0, len(identityFuncs))
+	for name := range identityFuncs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return strings.Join(names, ", ")
+}
@@ -0,0 +1,24 @@
+package main
+
+import (
+	"testing"
+)
+
+// TestIdentityFuncs verifies the instance identity survives an address
+// change while the legacy IP identity does not
+func TestIdentityFuncs(t *testing.T) {
+	before := &MDNSService{Name: "Office Printer", Type: "_ipp._tcp.local.", Host: "printer.local.", IP: "10.0.0.5", Port: 631}
+	after := *before
+	after.IP = "10.0.0.9"
+
+	for name, same := range map[string]bool{"instance": true, "host": true, "ip": false} {
+		identity := identityFuncs[name]
+		if got := identity(before) == identity(&after); got != same {
+			t.Fatalf("Expected %s identity equality after an IP change to be %v", name, same)
+		}
+	}
+
+	if key := identityFuncs["instance"](before); key != "office printer._ipp._tcp.local." {
+		t.Fatalf("Expected the instance name as key, got %q", key)
+	}
+}
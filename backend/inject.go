@@ -0,0 +1,96 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"time"
+)
+
+// maxInjectEvents bounds the events of one /api/debug/inject request.
+const maxInjectEvents = 1000
+
+// InjectResult tells what an injection did: how many of its services were
+// new, only refreshed an existing one, or removed one.
+type InjectResult struct {
+	Injected  int `json:"injected"`
+	New       int `json:"new"`
+	Refreshed int `json:"refreshed"`
+	Removed   int `json:"removed"`
+	Dropped   int `json:"dropped"` // filtered out, e.g. by -ignore, or removals of unknown services
+}
+
+// Inject pushes fabricated discovery events through the same pipeline as
+// discovered ones: the service table, the event bus and with it the
+// streams, history, notifiers and everything else subscribed. Services
+// are marked with the injected source.
+func (s *MDNSServer) Inject(events []DiscoveryResponse, now time.Time) (InjectResult, error) {
+	for i, event := range events {
+		service := event.Service
+		if service.Name == "" || service.Type == "" || net.ParseIP(service.IP) == nil {
+			return InjectResult{}, fmt.Errorf("event %d: the service needs a name, a type and an IP address", i)
+		}
+	}
+
+	result := InjectResult{Injected: len(events)}
+	for _, event := range events {
+		service := event.Service
+		service.Source = evidenceInjected
+		if service.Timestamp == 0 {
+			service.Timestamp = now.Unix()
+		}
+		key := s.identity(&service)
+		if event.Removed {
+			if s.changeService(key, &service, true) {
+				result.Removed++
+			} else {
+				result.Dropped++
+			}
+			continue
+		}
+		switch {
+		case s.publishService(sourceInject, key, &service, now):
+			result.New++
+		case s.self.excluded(&service) || s.ignored(&service):
+			result.Dropped++
+		default:
+			result.Refreshed++
+		}
+	}
+	return result, nil
+}
+
+// DebugInject handles POST /api/debug/inject, which is only there with
+// -debug-inject: {"events": [{"service": {...}, "removed": false}, ...]} are
+// fabricated discoveries and removals, for end-to-end tests of what
+// consumes the server's events without real devices.
+func (s *MDNSServer) DebugInject(w http.ResponseWriter, r *http.Request) {
+	if !s.debugInject {
+		writeError(w, http.StatusNotFound, "event injection is disabled (start with -debug-inject)")
+		return
+	}
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	var body struct {
+		Events []DiscoveryResponse `json:"events"`
+	}
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 4<<20)).Decode(&body); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid JSON body")
+		return
+	}
+	if len(body.Events) == 0 || len(body.Events) > maxInjectEvents {
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("give 1 to %d events", maxInjectEvents))
+		return
+	}
+	result, err := s.Inject(body.Events, time.Now())
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	log.Printf("🧪 Injected %d events from %s: %d new, %d removed", result.Injected, remoteIP(r), result.New, result.Removed)
+	writeJSON(w, http.StatusOK, result)
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestDebugInject verifies fabricated events go through the service table
+// and the bus, marked as injected
+func TestDebugInject(t *testing.T) {
+	server := newNotifyServer(t)
+	server.debugInject = true
+	var published []*DiscoveryResponse
+	server.bus.Subscribe("test", func(e BusEvent) { published = append(published, e.Payload.(*DiscoveryResponse)) }, TopicService)
+
+	body := `{"events": [
+		{"service": {"name": "Fake NAS", "type": "_smb._tcp.local.", "host": "fake-nas.local.", "ip": "192.168.1.200", "port": 445}},
+		{"service": {"name": "Fake NAS", "type": "_smb._tcp.local.", "host": "fake-nas.local.", "ip": "192.168.1.200", "port": 445}},
+		{"service": {"name": "Fake NAS", "type": "_smb._tcp.local.", "host": "fake-nas.local.", "ip": "192.168.1.200", "port": 445}, "removed": true},
+		{"service": {"name": "Ghost", "type": "_http._tcp.local.", "ip": "192.168.1.201", "port": 80}, "removed": true}
+	]}`
+	rec := httptest.NewRecorder()
+	server.DebugInject(rec, httptest.NewRequest(http.MethodPost, "/api/debug/inject", strings.NewReader(body)))
+	var result InjectResult
+	if err := json.Unmarshal(rec.Body.Bytes(), &result); err != nil || rec.Code != http.StatusOK {
+		t.Fatalf("Expected the events to be injected, got %d %s", rec.Code, rec.Body.String())
+	}
+	if result != (InjectResult{Injected: 4, New: 1, Refreshed: 1, Removed: 1, Dropped: 1}) {
+		t.Fatalf("Expected one arrival, refresh and removal, got %+v", result)
+	}
+	if len(published) != 2 || published[0].Removed || !published[1].Removed || published[0].Service.Source != evidenceInjected || published[0].Service.Site != defaultSite {
+		t.Fatalf("Expected an injected arrival and removal on the bus, got %+v", published)
+	}
+	if recent := server.notifiers.Recent(time.Time{}); len(recent) != 2 || recent[0].Kind != notifyNewDevice || recent[1].Kind != notifyDeparture {
+		t.Fatalf("Expected the notifiers to see the device arrive and leave, got %+v", recent)
+	}
+}
+
+// TestDebugInjectRejected verifies injection is off by default and that
+// invalid events are rejected before any is injected
+func TestDebugInjectRejected(t *testing.T) {
+	server := newNotifyServer(t)
+	inject := func(body string) int {
+		rec := httptest.NewRecorder()
+		server.DebugInject(rec, httptest.NewRequest(http.MethodPost, "/api/debug/inject", strings.NewReader(body)))
+		return rec.Code
+	}
+	valid := `{"events": [{"service": {"name": "A", "type": "_http._tcp.local.", "ip": "10.0.0.1", "port": 80}}]}`
+	if code := inject(valid); code != http.StatusNotFound {
+		t.Fatalf("Expected injection to be disabled by default, got %d", code)
+	}
+	server.debugInject = true
+	for _, body := range []string{`{"events": []}`, `nope`, `{"events": [{"service": {"name": "A", "type": "_http._tcp.local.", "ip": "10.0.0.1"}}, {"service": {"name": "B", "type": "_http._tcp.local.", "ip": "not an ip"}}]}`} {
+		if code := inject(body); code != http.StatusBadRequest {
+			t.Fatalf("Expected %s to be rejected, got %d", body, code)
+		}
+	}
+	if services := server.listServices(""); len(services) != 0 {
+		t.Fatalf("Expected nothing injected from a rejected request, got %+v", services)
+	}
+}
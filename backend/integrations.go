@@ -0,0 +1,283 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Integrations render the inventory in the formats other tools import, so
+// they can pick up discovered devices without custom glue.
+
+// zabbixHostInvalid matches what Zabbix does not allow in a technical host
+// name.
+var zabbixHostInvalid = regexp.MustCompile(`[^A-Za-z0-9 ._-]+`)
+
+// zabbixHost turns a device ID into a valid Zabbix host name.
+func zabbixHost(id string) string {
+	return strings.Trim(zabbixHostInvalid.ReplaceAllString(id, "_"), " ")
+}
+
+// zabbixDevices returns a low-level discovery row for each device with an
+// address, for host prototypes.
+func zabbixDevices(devices []*DeviceSummary) []map[string]string {
+	rows := []map[string]string{}
+	for _, device := range devices {
+		if len(device.Addresses) == 0 {
+			continue
+		}
+		types := make([]string, 0, len(device.Services))
+		seen := make(map[string]bool)
+		for _, service := range device.Services {
+			t := strings.TrimSuffix(service.Type, ".local.")
+			if !seen[t] {
+				seen[t] = true
+				types = append(types, t)
+			}
+		}
+		sort.Strings(types)
+		rows = append(rows, map[string]string{
+			"{#DEVICE.ID}": device.ID,
+			"{#HOST}":      zabbixHost(device.ID),
+			"{#IP}":        device.Addresses[0],
+			"{#MAC}":       device.MAC,
+			"{#SITE}":      device.Site,
+			"{#CATEGORY}":  device.Category,
+			"{#VENDOR}":    device.Vendor,
+			"{#OWNER}":     device.Owner,
+			"{#LOCATION}":  device.Location,
+			"{#TAGS}":      strings.Join(device.Tags, ","),
+			"{#SERVICES}":  strings.Join(types, ","),
+		})
+	}
+	return rows
+}
+
+// zabbixServices returns one low-level discovery row per service of the
+// devices, for item prototypes such as simple checks of each port.
+func zabbixServices(devices []*DeviceSummary) []map[string]string {
+	rows := []map[string]string{}
+	for _, device := range devices {
+		for _, service := range device.Services {
+			rows = append(rows, map[string]string{
+				"{#DEVICE.ID}":        device.ID,
+				"{#HOST}":             zabbixHost(device.ID),
+				"{#IP}":               service.IP,
+				"{#SERVICE.NAME}":     service.Name,
+				"{#SERVICE.TYPE}":     strings.TrimSuffix(service.Type, ".local."),
+				"{#SERVICE.PORT}":     strconv.Itoa(int(service.Port)),
+				"{#SERVICE.PROTOCOL}": serviceProtocol(service.Type),
+			})
+		}
+	}
+	return rows
+}
+
+// serviceProtocol returns "tcp" or "udp" from a service type such as
+// "_ipp._tcp.local.".
+func serviceProtocol(serviceType string) string {
+	if strings.Contains(serviceType, "._udp") {
+		return "udp"
+	}
+	return "tcp"
+}
+
+// Zabbix handles GET /api/integrations/zabbix: the devices of ?site= in
+// Zabbix low-level discovery JSON, for an HTTP agent item whose discovery
+// rule creates a host per device from host prototypes. ?type=services lists
+// each service instead.
+func (s *MDNSServer) Zabbix(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	site := s.siteParam(r)
+	devices := s.summarizeDevices(s.listDevices(site, ""), site)
+	switch r.URL.Query().Get("type") {
+	case "", "devices":
+		writeJSON(w, http.StatusOK, map[string]interface{}{"data": zabbixDevices(devices)})
+	case "services":
+		writeJSON(w, http.StatusOK, map[string]interface{}{"data": zabbixServices(devices)})
+	default:
+		writeError(w, http.StatusBadRequest, "type must be devices or services")
+	}
+}
+
+// sshServiceTypes are the service types that advertise an SSH server.
+var sshServiceTypes = map[string]bool{"_ssh._tcp": true, "_sftp-ssh._tcp": true}
+
+// ansibleGroupInvalid matches what Ansible does not allow in a group name.
+var ansibleGroupInvalid = regexp.MustCompile(`[^A-Za-z0-9_]+`)
+
+// ansibleGroup builds a valid Ansible group name from a prefix and a value,
+// e.g. "category_storage" or "subnet_192_168_1_0_24".
+func ansibleGroup(prefix, value string) string {
+	return prefix + "_" + strings.Trim(ansibleGroupInvalid.ReplaceAllString(strings.ToLower(value), "_"), "_")
+}
+
+// ansibleInventory builds an Ansible dynamic inventory, in the JSON format
+// of "--list", of the devices with an address: all SSH-capable ones, or
+// every one with all. They are grouped by category, tag and the subnet of
+// their first address, of prefix bits for IPv4 and 64 for IPv6, and the
+// SSH-capable ones are also in "ssh", with the advertised port as
+// ansible_port.
+func ansibleInventory(devices []*DeviceSummary, all bool, prefix int) map[string]interface{} {
+	groups := make(map[string][]string)
+	hostvars := make(map[string]map[string]interface{})
+	for _, device := range devices {
+		if len(device.Addresses) == 0 {
+			continue
+		}
+		vars := map[string]interface{}{
+			"ansible_host":          device.Addresses[0],
+			"network_view_site":     device.Site,
+			"network_view_category": device.Category,
+		}
+		ssh := false
+		for _, service := range device.Services {
+			if sshServiceTypes[strings.TrimSuffix(service.Type, ".local.")] {
+				ssh = true
+				vars["ansible_host"] = service.IP
+				vars["ansible_port"] = service.Port
+				break
+			}
+		}
+		if !ssh && !all {
+			continue
+		}
+		for name, value := range map[string]string{"network_view_mac": device.MAC, "network_view_vendor": device.Vendor, "network_view_owner": device.Owner, "network_view_location": device.Location} {
+			if value != "" {
+				vars[name] = value
+			}
+		}
+		if len(device.Tags) > 0 {
+			vars["network_view_tags"] = device.Tags
+		}
+		hostvars[device.ID] = vars
+
+		if ssh {
+			groups["ssh"] = append(groups["ssh"], device.ID)
+		}
+		groups[ansibleGroup("category", device.Category)] = append(groups[ansibleGroup("category", device.Category)], device.ID)
+		for _, tag := range device.Tags {
+			groups[ansibleGroup("tag", tag)] = append(groups[ansibleGroup("tag", tag)], device.ID)
+		}
+		if ip := net.ParseIP(vars["ansible_host"].(string)); ip != nil {
+			bits, size := prefix, 32
+			if ip.To4() == nil {
+				bits, size = 64, 128
+			}
+			subnet := net.IPNet{IP: ip.Mask(net.CIDRMask(bits, size)), Mask: net.CIDRMask(bits, size)}
+			groups[ansibleGroup("subnet", subnet.String())] = append(groups[ansibleGroup("subnet", subnet.String())], device.ID)
+		}
+	}
+
+	inventory := map[string]interface{}{"_meta": map[string]interface{}{"hostvars": hostvars}}
+	children := make([]string, 0, len(groups))
+	for name, hosts := range groups {
+		sort.Strings(hosts)
+		inventory[name] = map[string]interface{}{"hosts": hosts}
+		children = append(children, name)
+	}
+	sort.Strings(children)
+	inventory["all"] = map[string]interface{}{"children": children}
+	return inventory
+}
+
+// Ansible handles GET /api/integrations/ansible: an Ansible dynamic
+// inventory of the SSH-capable devices of ?site=, or of every device with
+// an address with ?all=1. ?prefix= (default 24) sets the IPv4 subnet size
+// hosts are grouped by.
+func (s *MDNSServer) Ansible(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	prefix := 24
+	if v := r.URL.Query().Get("prefix"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 8 || n > 32 {
+			writeError(w, http.StatusBadRequest, "prefix must be between 8 and 32")
+			return
+		}
+		prefix = n
+	}
+
+	site := s.siteParam(r)
+	devices := s.summarizeDevices(s.listDevices(site, ""), site)
+	writeJSON(w, http.StatusOK, ansibleInventory(devices, r.URL.Query().Get("all") == "1", prefix))
+}
+
+// runAnsibleInventory runs the binary as an Ansible inventory script, which
+// Ansible calls with --list, or --host <name>: it fetches the inventory
+// from the server at $NETWORK_VIEW_URL (default http://localhost:9999) and
+// prints it. NETWORK_VIEW_INVENTORY holds extra query parameters, e.g.
+// "all=1&site=office".
+func runAnsibleInventory(args []string, stdout, stderr io.Writer) int {
+	flags := flag.NewFlagSet("inventory", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	list := flags.Bool("list", false, "Print the whole inventory")
+	host := flags.String("host", "", "Print the variables of one host")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if !*list && *host == "" {
+		fmt.Fprintln(stderr, "either --list or --host is required")
+		return 2
+	}
+
+	server := os.Getenv("NETWORK_VIEW_URL")
+	if server == "" {
+		server = "http://localhost:9999"
+	}
+	endpoint := strings.TrimSuffix(server, "/") + "/api/integrations/ansible"
+	if query := os.Getenv("NETWORK_VIEW_INVENTORY"); query != "" {
+		endpoint += "?" + query
+	}
+	client := &http.Client{Timeout: 30 * time.Second}
+	resp, err := client.Get(endpoint)
+	if err != nil {
+		fmt.Fprintf(stderr, "Failed to fetch the inventory: %v\n", err)
+		return 1
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		fmt.Fprintf(stderr, "Failed to fetch the inventory: %s\n", resp.Status)
+		return 1
+	}
+
+	var inventory struct {
+		Meta struct {
+			Hostvars map[string]json.RawMessage `json:"hostvars"`
+		} `json:"_meta"`
+	}
+	data, err := io.ReadAll(resp.Body)
+	if err == nil {
+		err = json.Unmarshal(data, &inventory)
+	}
+	if err != nil {
+		fmt.Fprintf(stderr, "Invalid inventory: %v\n", err)
+		return 1
+	}
+	if *list {
+		stdout.Write(data)
+		return 0
+	}
+	vars := inventory.Meta.Hostvars[*host]
+	if vars == nil {
+		vars = json.RawMessage("{}")
+	}
+	fmt.Fprintf(stdout, "%s\n", vars)
+	return 0
+}
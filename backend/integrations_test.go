@@ -0,0 +1,131 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newIntegrationsServer returns a server with a discovered printer and NAS,
+// and a device only known from its metadata
+func newIntegrationsServer(t *testing.T) *MDNSServer {
+	server := NewMDNSServer()
+	server.metadata, _ = NewMetadataStore(openTestStore(t, "json", t.TempDir()))
+	now := time.Now().Unix()
+	server.addService("a", &MDNSService{Name: "Printer", Type: "_ipp._tcp.local.", Host: "printer.local.", IP: "192.168.1.30", Port: 631, Site: defaultSite, Timestamp: now})
+	server.addService("b", &MDNSService{Name: "NAS", Type: "_sftp-ssh._tcp.local.", Host: "nas.local.", IP: "192.168.1.40", Port: 22, Site: defaultSite, Timestamp: now})
+	server.addService("c", &MDNSService{Name: "NAS", Type: "_smb._tcp.local.", Host: "nas.local.", IP: "192.168.1.40", Port: 445, Site: defaultSite, Timestamp: now})
+	server.metadata.Update(defaultSite, "nas.local", func(d *DeviceMetadata) { d.tag([]string{"backup"}, nil) })
+	server.metadata.Update(defaultSite, "old (tv)", func(d *DeviceMetadata) { d.Owner = "alex" })
+	return server
+}
+
+// TestZabbix verifies the low-level discovery rows for devices and services
+func TestZabbix(t *testing.T) {
+	server := newIntegrationsServer(t)
+
+	var lld struct {
+		Data []map[string]string `json:"data"`
+	}
+	rec := httptest.NewRecorder()
+	server.Zabbix(rec, httptest.NewRequest(http.MethodGet, "/api/integrations/zabbix", nil))
+	if err := json.NewDecoder(rec.Body).Decode(&lld); err != nil {
+		t.Fatalf("Expected a JSON response, got %v", err)
+	}
+	if len(lld.Data) != 2 {
+		t.Fatalf("Expected the 2 devices with addresses, got %v", lld.Data)
+	}
+	var nas map[string]string
+	for _, row := range lld.Data {
+		if row["{#DEVICE.ID}"] == "nas.local" {
+			nas = row
+		}
+	}
+	if nas == nil || nas["{#IP}"] != "192.168.1.40" || nas["{#TAGS}"] != "backup" || nas["{#SERVICES}"] != "_sftp-ssh._tcp,_smb._tcp" {
+		t.Fatalf("Expected the NAS's macros, got %v", nas)
+	}
+
+	rec = httptest.NewRecorder()
+	server.Zabbix(rec, httptest.NewRequest(http.MethodGet, "/api/integrations/zabbix?type=services", nil))
+	lld.Data = nil
+	json.NewDecoder(rec.Body).Decode(&lld)
+	if len(lld.Data) != 3 {
+		t.Fatalf("Expected a row per service, got %v", lld.Data)
+	}
+	for _, row := range lld.Data {
+		if row["{#SERVICE.TYPE}"] == "_ipp._tcp" && (row["{#SERVICE.PORT}"] != "631" || row["{#SERVICE.PROTOCOL}"] != "tcp") {
+			t.Fatalf("Expected the printer's port, got %v", row)
+		}
+	}
+
+	if got := zabbixHost("old (tv)"); got != "old _tv_" {
+		t.Fatalf("Expected invalid host name characters replaced, got %q", got)
+	}
+}
+
+// TestAnsibleInventory verifies SSH-capable hosts are grouped by category,
+// tag and subnet with their SSH port
+func TestAnsibleInventory(t *testing.T) {
+	server := newIntegrationsServer(t)
+
+	rec := httptest.NewRecorder()
+	server.Ansible(rec, httptest.NewRequest(http.MethodGet, "/api/integrations/ansible", nil))
+	var inventory map[string]json.RawMessage
+	if err := json.NewDecoder(rec.Body).Decode(&inventory); err != nil {
+		t.Fatalf("Expected a JSON response, got %v", err)
+	}
+	for _, group := range []string{"ssh", "category_storage", "tag_backup", "subnet_192_168_1_0_24"} {
+		if string(inventory[group]) != `{"hosts":["nas.local"]}` {
+			t.Fatalf("Expected only the NAS in %s, got %s", group, inventory[group])
+		}
+	}
+	var meta struct {
+		Hostvars map[string]map[string]interface{} `json:"hostvars"`
+	}
+	json.Unmarshal(inventory["_meta"], &meta)
+	if nas := meta.Hostvars["nas.local"]; nas["ansible_host"] != "192.168.1.40" || nas["ansible_port"] != 22.0 {
+		t.Fatalf("Expected the NAS's SSH address and port, got %v", nas)
+	}
+	if _, ok := meta.Hostvars["printer.local"]; ok {
+		t.Fatalf("Expected the printer left out without SSH")
+	}
+
+	rec = httptest.NewRecorder()
+	server.Ansible(rec, httptest.NewRequest(http.MethodGet, "/api/integrations/ansible?all=1&prefix=16", nil))
+	inventory = nil
+	json.NewDecoder(rec.Body).Decode(&inventory)
+	if string(inventory["subnet_192_168_0_0_16"]) != `{"hosts":["nas.local","printer.local"]}` {
+		t.Fatalf("Expected both devices in the /16, got %s", inventory["subnet_192_168_0_0_16"])
+	}
+
+	rec = httptest.NewRecorder()
+	server.Ansible(rec, httptest.NewRequest(http.MethodGet, "/api/integrations/ansible?prefix=40", nil))
+	if rec.Code != http.StatusBadRequest {
+		t.Fatalf("Expected 400 for an invalid prefix, got %d", rec.Code)
+	}
+}
+
+// TestAnsibleInventoryScript verifies --list and --host against a server
+func TestAnsibleInventoryScript(t *testing.T) {
+	server := newIntegrationsServer(t)
+	ts := httptest.NewServer(http.HandlerFunc(server.Ansible))
+	defer ts.Close()
+	t.Setenv("NETWORK_VIEW_URL", ts.URL)
+
+	var stdout, stderr bytes.Buffer
+	if code := runAnsibleInventory([]string{"--list"}, &stdout, &stderr); code != 0 || !strings.Contains(stdout.String(), `"_meta"`) {
+		t.Fatalf("Expected the inventory, got %d %q %q", code, stdout.String(), stderr.String())
+	}
+	stdout.Reset()
+	if code := runAnsibleInventory([]string{"--host", "nas.local"}, &stdout, &stderr); code != 0 || !strings.Contains(stdout.String(), `"ansible_port":22`) {
+		t.Fatalf("Expected the NAS's variables, got %d %q", code, stdout.String())
+	}
+	stdout.Reset()
+	if code := runAnsibleInventory([]string{"--host", "tv.local"}, &stdout, &stderr); code != 0 || stdout.String() != "{}\n" {
+		t.Fatalf("Expected no variables for an unknown host, got %q", stdout.String())
+	}
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// Discovery modes.
+const (
+	modeActive = "active" // a client is connected: query and browse at full rate
+	modeIdle   = "idle"   // nobody is watching: query slowly, or only listen
+)
+
+// IntensityConfig holds the discovery intervals of each mode.
+type IntensityConfig struct {
+	QueryInterval  time.Duration // active mode PTR query interval
+	BrowseInterval time.Duration // active mode browse interval
+	IdleAfter      time.Duration // how long without clients before going idle
+	IdleInterval   time.Duration // idle query and browse interval; 0 only listens
+}
+
+var defaultIntensity = IntensityConfig{
+	QueryInterval:  5 * time.Second,
+	BrowseInterval: 10 * time.Second,
+	IdleAfter:      time.Minute,
+	IdleInterval:   time.Minute,
+}
+
+// Intensity adapts how aggressively discovery queries the network to
+// whether anyone is watching. It starts active, so the inventory fills at
+// startup, and goes idle once no client has been connected for IdleAfter.
+type Intensity struct {
+	config IntensityConfig
+
+	mu      sync.Mutex
+	mode    string
+	since   time.Time
+	clients int
+	timer   *time.Timer
+	changed chan struct{}
+	// requireQueries keeps querying in passive idle mode while the
+	// multicast listener is down, since queries are all that is left
+	requireQueries bool
+}
+
+// fallbackInterval replaces a passive idle interval while queries are
+// required.
+const fallbackInterval = time.Minute
+
+func NewIntensity(config IntensityConfig) *Intensity {
+	i := &Intensity{
+		config:  config,
+		mode:    modeActive,
+		since:   time.Now(),
+		changed: make(chan struct{}),
+	}
+	i.timer = time.AfterFunc(config.IdleAfter, i.goIdle)
+	return i
+}
+
+// ClientsChanged switches to active mode as soon as a client connects and
+// schedules the switch to idle mode when the last one disconnects.
+func (i *Intensity) ClientsChanged(connected int) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	i.clients = connected
+	i.timer.Stop()
+	if connected > 0 {
+		i.setMode(modeActive)
+	} else {
+		i.timer = time.AfterFunc(i.config.IdleAfter, i.goIdle)
+	}
+}
+
+func (i *Intensity) goIdle() {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	if i.clients == 0 {
+		i.setMode(modeIdle)
+	}
+}
+
+// setMode must be called with i.mu held.
+func (i *Intensity) setMode(mode string) {
+	if i.mode == mode {
+		return
+	}
+	i.mode = mode
+	i.since = time.Now()
+	i.wake()
+}
+
+// wake releases every Wait in progress; i.mu must be held.
+func (i *Intensity) wake() {
+	close(i.changed)
+	i.changed = make(chan struct{})
+}
+
+// RequireQueries sets whether queries must continue even in passive mode.
+func (i *Intensity) RequireQueries(required bool) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	if i.requireQueries != required {
+		i.requireQueries = required
+		i.wake()
+	}
+}
+
+// Mode returns the current mode and when it was entered.
+func (i *Intensity) Mode() (string, time.Time) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	return i.mode, i.since
+}
+
+// Intervals returns the current query and browse intervals.
+func (i *Intensity) Intervals() (query, browse time.Duration) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	return i.intervals()
+}
+
+// intervals must be called with i.mu held.
+func (i *Intensity) intervals() (query, browse time.Duration) {
+	if i.mode != modeIdle {
+		return i.config.QueryInterval, i.config.BrowseInterval
+	}
+	if i.config.IdleInterval <= 0 && i.requireQueries {
+		return fallbackInterval, fallbackInterval
+	}
+	return i.config.IdleInterval, i.config.IdleInterval
+}
+
+// Wait blocks for the current query (browse=false) or browse interval and
+// reports true when it elapsed. It returns false early when the mode
+// changes, so loops pick up the new interval right away.
+func (i *Intensity) Wait(browse bool) bool {
+	i.mu.Lock()
+	query, browseInterval := i.intervals()
+	changed := i.changed
+	i.mu.Unlock()
+
+	d := query
+	if browse {
+		d = browseInterval
+	}
+	if d <= 0 {
+		// Passive: only the multicast listener runs
+		<-changed
+		return false
+	}
+
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-changed:
+		return false
+	}
+}
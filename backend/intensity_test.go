@@ -0,0 +1,41 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// TestIntensityModes verifies discovery goes idle without clients and
+// becomes active again as soon as one connects
+func TestIntensityModes(t *testing.T) {
+	i := NewIntensity(IntensityConfig{
+		QueryInterval:  time.Second,
+		BrowseInterval: time.Second,
+		IdleAfter:      10 * time.Millisecond,
+		IdleInterval:   0,
+	})
+	if mode, _ := i.Mode(); mode != modeActive {
+		t.Fatalf("Expected to start active, got %s", mode)
+	}
+
+	// A passive idle mode waits until the mode changes
+	if i.Wait(false) {
+		t.Fatalf("Expected the wait to be cut short by going idle")
+	}
+	if mode, _ := i.Mode(); mode != modeIdle {
+		t.Fatalf("Expected idle mode without clients, got %s", mode)
+	}
+
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		i.ClientsChanged(1)
+	}()
+	start := time.Now()
+	i.Wait(true)
+	if time.Since(start) > 2*time.Second {
+		t.Fatalf("Expected a connecting client to end the passive wait")
+	}
+	if mode, _ := i.Mode(); mode != modeActive {
+		t.Fatalf("Expected active mode with a client, got %s", mode)
+	}
+}
@@ -0,0 +1,270 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// internetProbeTimeout bounds one captive portal probe.
+const internetProbeTimeout = 5 * time.Second
+
+// Internet states.
+const (
+	internetOnline  = "online"
+	internetCaptive = "captive" // a captive portal intercepts traffic until login
+	internetOffline = "offline"
+)
+
+// captiveProbe is a captive portal detection URL and what it answers when
+// nothing is in the way.
+type captiveProbe struct {
+	URL    string
+	Status int
+	Body   string // expected in the body, if not empty
+}
+
+// defaultCaptiveProbes are the URLs Apple, Android and Firefox check.
+var defaultCaptiveProbes = []captiveProbe{
+	{URL: "http://captive.apple.com/hotspot-detect.html", Status: http.StatusOK, Body: "Success"},
+	{URL: "http://connectivitycheck.gstatic.com/generate_204", Status: http.StatusNoContent},
+	{URL: "http://detectportal.firefox.com/success.txt", Status: http.StatusOK, Body: "success"},
+}
+
+// ProbeResult is the outcome of one captive portal probe.
+type ProbeResult struct {
+	URL       string `json:"url"`
+	Status    int    `json:"status,omitempty"`
+	Result    string `json:"result"` // online, captive or offline
+	PortalURL string `json:"portalUrl,omitempty"`
+	Error     string `json:"error,omitempty"`
+}
+
+// InternetState is whether the active interface reaches the internet.
+type InternetState struct {
+	State     string        `json:"state"`
+	Interface string        `json:"interface"`
+	PortalURL string        `json:"portalUrl,omitempty"` // the login page, when captive
+	CheckedAt int64         `json:"checkedAt"`
+	Probes    []ProbeResult `json:"probes"`
+}
+
+// InternetEvent reports the internet state of the active interface
+// changing, e.g. a captive portal appearing or being logged into.
+type InternetEvent struct {
+	State     string `json:"state"`
+	Previous  string `json:"previous"`
+	Interface string `json:"interface"`
+	PortalURL string `json:"portalUrl,omitempty"`
+}
+
+// InternetMonitor probes captive portal detection URLs from the discovery
+// interface and publishes an InternetEvent when the result changes.
+type InternetMonitor struct {
+	bus    *EventBus
+	probes []captiveProbe
+
+	mu    sync.Mutex
+	state *InternetState // nil before the first check
+}
+
+func NewInternetMonitor(bus *EventBus) *InternetMonitor {
+	return &InternetMonitor{bus: bus, probes: defaultCaptiveProbes}
+}
+
+// Run checks the server's current interface every interval, and right away
+// when it switches interfaces.
+func (m *InternetMonitor) Run(server *MDNSServer, interval time.Duration) {
+	switched := make(chan struct{}, 1)
+	m.bus.Subscribe("internet", func(BusEvent) {
+		select {
+		case switched <- struct{}{}:
+		default:
+		}
+	}, TopicInterface)
+
+	timer := time.NewTimer(0)
+	for {
+		select {
+		case <-timer.C:
+		case <-switched:
+			timer.Stop()
+		}
+		server.mu.RLock()
+		iface := server.currentIface
+		server.mu.RUnlock()
+		m.Check(context.Background(), iface)
+		timer.Reset(interval)
+	}
+}
+
+// State returns the last check, or nil.
+func (m *InternetMonitor) State() *InternetState {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.state
+}
+
+// Check probes every URL through iface and records the result. Any probe
+// that is intercepted makes the network captive; otherwise it is online if
+// any probe got through.
+func (m *InternetMonitor) Check(ctx context.Context, iface string) *InternetState {
+	client := probeClient(iface)
+	state := &InternetState{State: internetOffline, Interface: iface, CheckedAt: time.Now().Unix(), Probes: []ProbeResult{}}
+
+	results := make([]ProbeResult, len(m.probes))
+	var wg sync.WaitGroup
+	for i, probe := range m.probes {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			results[i] = runCaptiveProbe(ctx, client, probe)
+		}()
+	}
+	wg.Wait()
+
+	for _, result := range results {
+		state.Probes = append(state.Probes, result)
+		switch {
+		case result.Result == internetCaptive:
+			if state.State != internetCaptive {
+				state.State, state.PortalURL = internetCaptive, result.PortalURL
+			}
+		case result.Result == internetOnline && state.State == internetOffline:
+			state.State = internetOnline
+		}
+	}
+
+	m.mu.Lock()
+	previous := m.state
+	m.state = state
+	m.mu.Unlock()
+
+	if previous != nil && (previous.State != state.State || previous.Interface != state.Interface) {
+		log.Printf("Internet on %s: %s (was %s)", iface, state.State, previous.State)
+		m.bus.Publish(TopicInternet, InternetEvent{
+			State:     state.State,
+			Previous:  previous.State,
+			Interface: iface,
+			PortalURL: state.PortalURL,
+		})
+	}
+	return state
+}
+
+// probeClient returns an HTTP client whose connections leave from the IPv4
+// address of iface, so the check is of that network rather than whichever
+// one the default route happens to use. Redirects aren't followed: they
+// are how most portals intercept the probe.
+func probeClient(iface string) *http.Client {
+	dialer := &net.Dialer{Timeout: internetProbeTimeout}
+	network := "tcp"
+	if ip := interfaceIPv4(iface); ip != nil {
+		dialer.LocalAddr = &net.TCPAddr{IP: ip}
+		network = "tcp4"
+	}
+	return &http.Client{
+		Timeout: internetProbeTimeout,
+		Transport: &http.Transport{
+			Proxy: nil,
+			DialContext: func(ctx context.Context, _, addr string) (net.Conn, error) {
+				return dialer.DialContext(ctx, network, addr)
+			},
+			DisableKeepAlives: true,
+		},
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+}
+
+// interfaceIPv4 returns the first IPv4 address of iface, or nil.
+func interfaceIPv4(iface string) net.IP {
+	ifi, err := net.InterfaceByName(iface)
+	if err != nil {
+		return nil
+	}
+	addrs, err := ifi.Addrs()
+	if err != nil {
+		return nil
+	}
+	for _, addr := range addrs {
+		if ipnet, ok := addr.(*net.IPNet); ok && ipnet.IP.To4() != nil {
+			return ipnet.IP.To4()
+		}
+	}
+	return nil
+}
+
+var metaRefreshURL = regexp.MustCompile(`(?i)<meta[^>]+http-equiv=["']?refresh["']?[^>]+content=["']?\d+\s*;\s*url=([^"'>\s]+)`)
+
+// runCaptiveProbe fetches probe. A redirect, or any answer other than the
+// expected one, means something intercepted it.
+func runCaptiveProbe(ctx context.Context, client *http.Client, probe captiveProbe) ProbeResult {
+	result := ProbeResult{URL: probe.URL, Result: internetOffline}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, probe.URL, nil)
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+	// The agent of Apple's captive network assistant, which some portals
+	// only intercept
+	req.Header.Set("User-Agent", "CaptiveNetworkSupport/1.0 wispr")
+	resp, err := client.Do(req)
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 64*1024))
+	result.Status = resp.StatusCode
+
+	if resp.StatusCode == probe.Status && (probe.Body == "" || strings.Contains(string(body), probe.Body)) {
+		result.Result = internetOnline
+		return result
+	}
+	if resp.StatusCode >= 500 && resp.StatusCode != http.StatusNetworkAuthenticationRequired {
+		// A failing upstream isn't a portal
+		result.Error = fmt.Sprintf("unexpected status %s", resp.Status)
+		return result
+	}
+	result.Result = internetCaptive
+	if location, err := resp.Location(); err == nil {
+		result.PortalURL = location.String()
+	} else if m := metaRefreshURL.FindSubmatch(body); m != nil {
+		if u, err := req.URL.Parse(string(m[1])); err == nil {
+			result.PortalURL = u.String()
+		}
+	}
+	if result.PortalURL == "" {
+		// The portal answered in place of the probe
+		result.PortalURL = probe.URL
+	}
+	return result
+}
+
+// Internet handles GET /api/internet: whether the discovery interface
+// reaches the internet or sits behind a captive portal, and the portal's
+// login URL. ?refresh=1 checks again now.
+func (s *MDNSServer) Internet(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	s.mu.RLock()
+	iface := s.currentIface
+	s.mu.RUnlock()
+	state := s.internet.State()
+	if state == nil || state.Interface != iface || r.URL.Query().Get("refresh") == "1" {
+		state = s.internet.Check(r.Context(), iface)
+	}
+	writeJSON(w, http.StatusOK, state)
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// TestCaptiveProbe verifies that expected answers are online, redirects and
+// rewritten pages captive with their portal URL, and server errors offline.
+func TestCaptiveProbe(t *testing.T) {
+	web := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/ok":
+			w.Write([]byte("<HTML><BODY>Success</BODY></HTML>"))
+		case "/204":
+			w.WriteHeader(http.StatusNoContent)
+		case "/redirect":
+			http.Redirect(w, r, "https://portal.example/login?orig=probe", http.StatusFound)
+		case "/meta":
+			w.Write([]byte(`<html><head><meta http-equiv="refresh" content="0; url=/splash"></head></html>`))
+		default:
+			w.WriteHeader(http.StatusBadGateway)
+		}
+	}))
+	defer web.Close()
+
+	client := probeClient("")
+	tests := []struct {
+		probe  captiveProbe
+		result string
+		portal string
+	}{
+		{captiveProbe{URL: web.URL + "/ok", Status: http.StatusOK, Body: "Success"}, internetOnline, ""},
+		{captiveProbe{URL: web.URL + "/204", Status: http.StatusNoContent}, internetOnline, ""},
+		{captiveProbe{URL: web.URL + "/redirect", Status: http.StatusNoContent}, internetCaptive, "https://portal.example/login?orig=probe"},
+		{captiveProbe{URL: web.URL + "/meta", Status: http.StatusOK, Body: "Success"}, internetCaptive, web.URL + "/splash"},
+		{captiveProbe{URL: web.URL + "/broken", Status: http.StatusOK}, internetOffline, ""},
+	}
+	for _, test := range tests {
+		result := runCaptiveProbe(context.Background(), client, test.probe)
+		if result.Result != test.result || result.PortalURL != test.portal {
+			t.Fatalf("Expected %s %s for %s, got %+v", test.result, test.portal, test.probe.URL, result)
+		}
+	}
+}
+
+// TestInternetMonitor verifies that a captive probe makes the network
+// captive and that state changes are published.
+func TestInternetMonitor(t *testing.T) {
+	captive := false
+	web := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if captive {
+			http.Redirect(w, r, "http://10.0.0.1/login", http.StatusFound)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer web.Close()
+
+	server := NewMDNSServer()
+	var events []InternetEvent
+	server.bus.Subscribe("test", func(e BusEvent) { events = append(events, e.Payload.(InternetEvent)) }, TopicInternet)
+	server.internet.probes = []captiveProbe{
+		{URL: web.URL + "/generate_204", Status: http.StatusNoContent},
+		{URL: "http://127.0.0.1:1/unreachable", Status: http.StatusOK},
+	}
+
+	rec := httptest.NewRecorder()
+	server.Internet(rec, httptest.NewRequest(http.MethodGet, "/api/internet", nil))
+	var state InternetState
+	json.NewDecoder(rec.Body).Decode(&state)
+	if state.State != internetOnline || len(state.Probes) != 2 || state.Probes[1].Error == "" {
+		t.Fatalf("Expected online with one failed probe, got %+v", state)
+	}
+	if len(events) != 0 {
+		t.Fatalf("Expected no event for the first check, got %+v", events)
+	}
+
+	captive = true
+	rec = httptest.NewRecorder()
+	server.Internet(rec, httptest.NewRequest(http.MethodGet, "/api/internet", nil))
+	json.NewDecoder(rec.Body).Decode(&state)
+	if state.State != internetOnline {
+		t.Fatalf("Expected the cached state without ?refresh=1, got %+v", state)
+	}
+
+	rec = httptest.NewRecorder()
+	server.Internet(rec, httptest.NewRequest(http.MethodGet, "/api/internet?refresh=1", nil))
+	json.NewDecoder(rec.Body).Decode(&state)
+	if state.State != internetCaptive || state.PortalURL != "http://10.0.0.1/login" {
+		t.Fatalf("Expected captive behind http://10.0.0.1/login, got %+v", state)
+	}
+	if len(events) != 1 || events[0].State != internetCaptive || events[0].Previous != internetOnline || events[0].PortalURL != "http://10.0.0.1/login" {
+		t.Fatalf("Expected an online to captive event, got %+v", events)
+	}
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+// schemaVersion is bumped whenever a published model changes incompatibly.
+const schemaVersion = "v1"
+
+// apiModels are the payloads published on /api/schema, keyed by the name
+// external integrations refer to them by.
+var apiModels = map[string]reflect.Type{
+	"MDNSService":        reflect.TypeOf(MDNSService{}),
+	"Event":              reflect.TypeOf(DiscoveryResponse{}),
+	"Device":             reflect.TypeOf(DeviceMetadata{}),
+	"DeviceSummary":      reflect.TypeOf(DeviceSummary{}),
+	"AvailabilityReport": reflect.TypeOf(AvailabilityReport{}),
+	"Site":               reflect.TypeOf(SiteSummary{}),
+	"Client":             reflect.TypeOf(ClientInfo{}),
+	"StorageStats":       reflect.TypeOf(StorageStats{}),
+}
+
+// jsonSchema generates a JSON Schema (draft 2020-12) document for a model
+// from its Go type and json tags, so the published schema can never drift
+// from what the API actually sends.
+func jsonSchema(name string, t reflect.Type) map[string]interface{} {
+	defs := make(map[string]interface{})
+	doc := schemaForType(t, defs, true)
+	doc["$schema"] = "https://json-schema.org/draft/2020-12/schema"
+	doc["$id"] = versionedPath("/api/schema/" + name)
+	doc["title"] = name
+	if len(defs) > 0 {
+		doc["$defs"] = defs
+	}
+	return doc
+}
+
+func schemaForType(t reflect.Type, defs map[string]interface{}, root bool) map[string]interface{} {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+
+	switch t.Kind() {
+	case reflect.String:
+		return map[string]interface{}{"type": "string"}
+	case reflect.Bool:
+		return map[string]interface{}{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return map[string]interface{}{"type": "integer"}
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		schema := map[string]interface{}{"type": "integer", "minimum": 0}
+		if t.Kind() == reflect.Uint16 {
+			schema["maximum"] = 65535
+		}
+		return schema
+	case reflect.Float32, reflect.Float64:
+		return map[string]interface{}{"type": "number"}
+	case reflect.Slice, reflect.Array:
+		return map[string]interface{}{"type": "array", "items": schemaForType(t.Elem(), defs, false)}
+	case reflect.Map:
+		return map[string]interface{}{"type": "object", "additionalProperties": schemaForType(t.Elem(), defs, false)}
+	case reflect.Struct:
+		if !root {
+			if _, ok := defs[t.Name()]; !ok {
+				defs[t.Name()] = nil // placeholder to stop recursion
+				defs[t.Name()] = structSchema(t, defs)
+			}
+			return map[string]interface{}{"$ref": "#/$defs/" + t.Name()}
+		}
+		return structSchema(t, defs)
+	default:
+		return map[string]interface{}{}
+	}
+}
+
+func structSchema(t reflect.Type, defs map[string]interface{}) map[string]interface{} {
+	properties := make(map[string]interface{})
+	required := []string{}
+	addStructFields(t, defs, properties, &required)
+	sort.Strings(required)
+
+	return map[string]interface{}{
+		"type":                 "object",
+		"properties":           properties,
+		"required":             required,
+		"additionalProperties": false,
+	}
+}
+
+// addStructFields adds the properties of t's fields, flattening embedded
+// structs the way encoding/json does.
+func addStructFields(t reflect.Type, defs map[string]interface{}, properties map[string]interface{}, required *[]string) {
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		tag := field.Tag.Get("json")
+		if field.Anonymous && tag == "" {
+			embedded := field.Type
+			for embedded.Kind() == reflect.Ptr {
+				embedded = embedded.Elem()
+			}
+			if embedded.Kind() == reflect.Struct {
+				addStructFields(embedded, defs, properties, required)
+				continue
+			}
+		}
+		if !field.IsExported() || tag == "-" {
+			continue
+		}
+		name, opts, _ := strings.Cut(tag, ",")
+		if name == "" {
+			name = field.Name
+		}
+		properties[name] = schemaForType(field.Type, defs, false)
+		if !strings.Contains(opts, "omitempty") {
+			*required = append(*required, name)
+		}
+	}
+}
+
+// Schema handles GET /api/schema, listing the published models, and
+// GET /api/schema/{name}, returning a model's JSON Schema document.
+func (s *MDNSServer) Schema(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	name := r.PathValue("name")
+	if name == "" {
+		names := make([]string, 0, len(apiModels))
+		for n := range apiModels {
+			names = append(names, n)
+		}
+		sort.Strings(names)
+
+		models := make([]map[string]string, 0, len(names))
+		for _, n := range names {
+			models = append(models, map[string]string{
+				"name": n,
+				"url":  versionedPath("/api/schema/" + n),
+			})
+		}
+		writeJSON(w, http.StatusOK, map[string]interface{}{
+			"version": schemaVersion,
+			"models":  models,
+		})
+		return
+	}
+
+	t, ok := apiModels[name]
+	if !ok {
+		writeError(w, http.StatusNotFound, "unknown model "+name)
+		return
+	}
+	w.Header().Set("Content-Type", "application/schema+json")
+	json.NewEncoder(w).Encode(jsonSchema(name, t))
+}
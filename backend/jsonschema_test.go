@@ -0,0 +1,32 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+// TestJSONSchemaEvent verifies nested structs become $defs references and
+// fields without omitempty are required
+func TestJSONSchemaEvent(t *testing.T) {
+	doc := jsonSchema("Event", reflect.TypeOf(DiscoveryResponse{}))
+
+	properties := doc["properties"].(map[string]interface{})
+	service := properties["service"].(map[string]interface{})
+	if service["$ref"] != "#/$defs/MDNSService" {
+		t.Fatalf("Expected service to reference MDNSService, got %v", service)
+	}
+
+	defs := doc["$defs"].(map[string]interface{})
+	mdns := defs["MDNSService"].(map[string]interface{})
+	port := mdns["properties"].(map[string]interface{})["port"].(map[string]interface{})
+	if port["type"] != "integer" || port["maximum"] != 65535 {
+		t.Fatalf("Expected port to be a 16-bit integer, got %v", port)
+	}
+
+	device := jsonSchema("Device", reflect.TypeOf(DeviceMetadata{}))
+	for _, name := range device["required"].([]string) {
+		if name == "owner" {
+			t.Fatalf("Expected omitempty field owner not to be required")
+		}
+	}
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Sources of discovered services, used to break time-to-discovery down by
+// the path a service took through the discovery pipeline.
+const (
+	sourceBrowse    = "browse"    // hashicorp/mdns browser entries
+	sourceMulticast = "multicast" // unsolicited answers seen by the listener
+	sourceQuery     = "query"     // answers to our own periodic PTR queries
+	sourceInject    = "inject"    // fabricated on /api/debug/inject
+)
+
+// latencyBuckets are the upper bounds of the time-to-discovery histogram.
+var latencyBuckets = []time.Duration{
+	10 * time.Millisecond,
+	50 * time.Millisecond,
+	100 * time.Millisecond,
+	250 * time.Millisecond,
+	500 * time.Millisecond,
+	time.Second,
+	2500 * time.Millisecond,
+	5 * time.Second,
+	10 * time.Second,
+}
+
+// maxLatencySamples is how many recent observations per source are kept to
+// compute percentiles.
+const maxLatencySamples = 1024
+
+type latencyHistogram struct {
+	buckets []uint64 // one per latencyBuckets entry, plus +Inf
+	count   uint64
+	sum     time.Duration
+	max     time.Duration
+	samples []time.Duration
+	next    int
+}
+
+// DiscoveryLatency measures the time from the first packet about a service
+// to the service being published to stream clients, per discovery source.
+type DiscoveryLatency struct {
+	mu      sync.Mutex
+	sources map[string]*latencyHistogram
+}
+
+func NewDiscoveryLatency() *DiscoveryLatency {
+	return &DiscoveryLatency{sources: make(map[string]*latencyHistogram)}
+}
+
+// Observe records one time-to-discovery measurement.
+func (l *DiscoveryLatency) Observe(source string, d time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	h, ok := l.sources[source]
+	if !ok {
+		h = &latencyHistogram{buckets: make([]uint64, len(latencyBuckets)+1)}
+		l.sources[source] = h
+	}
+
+	i := sort.Search(len(latencyBuckets), func(i int) bool { return d <= latencyBuckets[i] })
+	h.buckets[i]++
+	h.count++
+	h.sum += d
+	h.max = max(h.max, d)
+
+	if len(h.samples) < maxLatencySamples {
+		h.samples = append(h.samples, d)
+	} else {
+		h.samples[h.next] = d
+		h.next = (h.next + 1) % maxLatencySamples
+	}
+}
+
+// LatencyBucket is one histogram bucket on /api/metrics/discovery. LeMs is
+// omitted for the final, unbounded bucket.
+type LatencyBucket struct {
+	LeMs  float64 `json:"leMs,omitempty"`
+	Count uint64  `json:"count"`
+}
+
+// LatencyStats summarizes time-to-discovery for one source. Percentiles are
+// computed over the most recent observations.
+type LatencyStats struct {
+	Source  string          `json:"source"`
+	Count   uint64          `json:"count"`
+	MeanMs  float64         `json:"meanMs"`
+	P50Ms   float64         `json:"p50Ms"`
+	P90Ms   float64         `json:"p90Ms"`
+	P99Ms   float64         `json:"p99Ms"`
+	MaxMs   float64         `json:"maxMs"`
+	Buckets []LatencyBucket `json:"buckets"`
+}
+
+// Stats returns the per-source summaries, ordered by source.
+func (l *DiscoveryLatency) Stats() []LatencyStats {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	stats := make([]LatencyStats, 0, len(l.sources))
+	for source, h := range l.sources {
+		sorted := append([]time.Duration(nil), h.samples...)
+		sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+
+		st := LatencyStats{
+			Source: source,
+			Count:  h.count,
+			MeanMs: milliseconds(h.sum / time.Duration(h.count)),
+			P50Ms:  milliseconds(percentile(sorted, 0.50)),
+			P90Ms:  milliseconds(percentile(sorted, 0.90)),
+			P99Ms:  milliseconds(percentile(sorted, 0.99)),
+			MaxMs:  milliseconds(h.max),
+		}
+		for i, n := range h.buckets {
+			b := LatencyBucket{Count: n}
+			if i < len(latencyBuckets) {
+				b.LeMs = milliseconds(latencyBuckets[i])
+			}
+			st.Buckets = append(st.Buckets, b)
+		}
+		stats = append(stats, st)
+	}
+	sort.Slice(stats, func(i, j int) bool { return stats[i].Source < stats[j].Source })
+	return stats
+}
+
+// percentile returns the nearest-rank percentile p of sorted samples.
+func percentile(sorted []time.Duration, p float64) time.Duration {
+	if len(sorted) == 0 {
+		return 0
+	}
+	i := int(p*float64(len(sorted))+0.5) - 1
+	return sorted[min(max(i, 0), len(sorted)-1)]
+}
+
+func milliseconds(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
+
+// publishService records a newly discovered service and publishes it,
+// measuring the time since firstPacket, the moment the packet that led to
+// the discovery was received. It reports whether the service was new.
+// Services on the server's own addresses are dropped (see SelfFilter), and
+// so are those matching -ignore.
+func (s *MDNSServer) publishService(source, key string, service *MDNSService, firstPacket time.Time) bool {
+	service.setEvidence(source)
+	if s.self.excluded(service) || s.ignored(service) || !s.changeService(key, service, false) {
+		return false
+	}
+	s.latency.Observe(source, time.Since(firstPacket))
+	return true
+}
+
+// DiscoveryMetrics handles GET /api/metrics/discovery, the time-to-discovery
+// histograms per discovery source.
+func (s *MDNSServer) DiscoveryMetrics(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"sources": s.latency.Stats(),
+	})
+}
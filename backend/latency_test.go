@@ -0,0 +1,38 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// TestDiscoveryLatencyStats verifies observations land in the right
+// histogram buckets and percentiles are computed per source
+func TestDiscoveryLatencyStats(t *testing.T) {
+	l := NewDiscoveryLatency()
+	for i := 1; i <= 100; i++ {
+		l.Observe(sourceQuery, time.Duration(i)*10*time.Millisecond)
+	}
+	l.Observe(sourceBrowse, 20*time.Second)
+
+	stats := l.Stats()
+	if len(stats) != 2 || stats[0].Source != sourceBrowse || stats[1].Source != sourceQuery {
+		t.Fatalf("Expected browse and query stats, got %+v", stats)
+	}
+
+	query := stats[1]
+	if query.Count != 100 {
+		t.Fatalf("Expected 100 observations, got %d", query.Count)
+	}
+	if query.P50Ms != 500 || query.P99Ms != 990 || query.MaxMs != 1000 {
+		t.Fatalf("Expected p50 500ms, p99 990ms and max 1000ms, got %+v", query)
+	}
+	if query.Buckets[0].LeMs != 10 || query.Buckets[0].Count != 1 {
+		t.Fatalf("Expected one observation in the 10ms bucket, got %+v", query.Buckets[0])
+	}
+
+	browse := stats[0]
+	last := browse.Buckets[len(browse.Buckets)-1]
+	if last.LeMs != 0 || last.Count != 1 {
+		t.Fatalf("Expected the 20s observation in the unbounded bucket, got %+v", last)
+	}
+}
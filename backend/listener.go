@@ -0,0 +1,307 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+var (
+	mdnsGroup  = &net.UDPAddr{IP: net.IPv4(224, 0, 0, 251), Port: 5353}
+	mdnsGroup6 = &net.UDPAddr{IP: net.ParseIP("ff02::fb"), Port: 5353}
+)
+
+// mdnsFamily is what the IPv4 and IPv6 listeners differ in. IPv6-only
+// devices are only heard on ff02::fb; dual-stack ones usually on both.
+type mdnsFamily struct {
+	network string // udp4 or udp6
+	group   *net.UDPAddr
+	suffix  string // of the socket names, to tell the listeners apart
+	// primary is the IPv4 listener: our queries are sent, and loop back,
+	// on IPv4 only, so only its silence is suspicious and only its
+	// failure makes discovery fall back to queries
+	primary bool
+}
+
+var (
+	mdnsIPv4 = mdnsFamily{network: "udp4", group: mdnsGroup, primary: true}
+	mdnsIPv6 = mdnsFamily{network: "udp6", group: mdnsGroup6, suffix: "6"}
+)
+
+// String is the group and port, e.g. for logs.
+func (f mdnsFamily) String() string {
+	return f.group.String()
+}
+
+// Multicast listener states.
+const (
+	listenerStarting  = "starting"
+	listenerListening = "listening"
+	listenerDegraded  = "degraded" // reopening after a failure or silence
+	listenerFallback  = "fallback" // given up for now; discovery is query-only
+)
+
+// listenerTimeout is how long the listener may receive nothing while we are
+// querying before it is considered degraded. Our own queries are looped
+// back to it, so a working socket never stays silent that long.
+var listenerTimeout = 2 * time.Minute
+
+// mdnsPayloadSize is the largest mDNS message (RFC 6762 §17): the size of
+// the listener's buffer, and the UDP payload size our queries advertise in
+// an EDNS0 OPT record (RFC 6891), so responders answering them directly
+// don't cut their answers to 512 bytes.
+const mdnsPayloadSize = 9000
+
+const (
+	maxListenerRetries    = 3
+	fallbackRetryInterval = 10 * time.Minute
+)
+
+// ListenerHealth tracks the state of the multicast listener on port 5353.
+type ListenerHealth struct {
+	mu         sync.Mutex
+	state      string
+	socket     string
+	since      time.Time
+	lastPacket time.Time
+	packets    uint64
+	restarts   int
+	lastError  string
+}
+
+// ListenerStatus is the listener section of /api/status.
+type ListenerStatus struct {
+	State      string `json:"state"`
+	Socket     string `json:"socket,omitempty"`
+	Since      int64  `json:"since"`
+	LastPacket int64  `json:"lastPacket,omitempty"`
+	Packets    uint64 `json:"packets"`
+	Restarts   int    `json:"restarts"`
+	LastError  string `json:"lastError,omitempty"`
+}
+
+func (h *ListenerHealth) set(state, socket string, err error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if state != listenerListening {
+		h.restarts++
+	}
+	h.state = state
+	h.socket = socket
+	h.since = time.Now()
+	if err != nil {
+		h.lastError = err.Error()
+	}
+}
+
+func (h *ListenerHealth) packet(t time.Time) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.lastPacket = t
+	h.packets++
+}
+
+func (h *ListenerHealth) Status() ListenerStatus {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	status := ListenerStatus{
+		State:     h.state,
+		Socket:    h.socket,
+		Since:     h.since.Unix(),
+		Packets:   h.packets,
+		Restarts:  h.restarts,
+		LastError: h.lastError,
+	}
+	if !h.lastPacket.IsZero() {
+		status.LastPacket = h.lastPacket.Unix()
+	}
+	return status
+}
+
+// queried records that a query was just sent.
+func (s *MDNSServer) queried() {
+	s.lastQuery.Store(time.Now().UnixNano())
+}
+
+// openMDNSListener joins the mDNS group of a family on port 5353. The first
+// attempt uses the standard library's multicast socket; retries bind with
+// SO_REUSEPORT and join the group on every interface explicitly, which
+// coexists with mDNSResponder where the former sometimes receives nothing.
+func openMDNSListener(family mdnsFamily, reusePort bool) (net.PacketConn, string, error) {
+	if !reusePort {
+		conn, err := net.ListenMulticastUDP(family.network, nil, family.group)
+		return conn, "multicast" + family.suffix, err
+	}
+
+	socket := "reuseport" + family.suffix
+	lc := net.ListenConfig{Control: reusePortControl}
+	conn, err := lc.ListenPacket(context.Background(), family.network, fmt.Sprintf(":%d", family.group.Port))
+	if err != nil {
+		return nil, socket, err
+	}
+
+	var p interface {
+		JoinGroup(ifi *net.Interface, group net.Addr) error
+	}
+	if family.primary {
+		p = ipv4.NewPacketConn(conn)
+	} else {
+		p = ipv6.NewPacketConn(conn)
+	}
+	joined := 0
+	ifaces, _ := net.Interfaces()
+	for i := range ifaces {
+		if ifaces[i].Flags&net.FlagUp != 0 && ifaces[i].Flags&net.FlagMulticast != 0 {
+			if p.JoinGroup(&ifaces[i], family.group) == nil {
+				joined++
+			}
+		}
+	}
+	if joined == 0 {
+		if err := p.JoinGroup(nil, family.group); err != nil {
+			conn.Close()
+			return nil, socket, err
+		}
+	}
+	return conn, socket, nil
+}
+
+// listenMDNSMulticast listens to mDNS multicast traffic on the group of a
+// family, reopening the socket with backoff when it fails or goes silent.
+// After maxListenerRetries failures in a row it gives up for a while and
+// tries again later; for IPv4, discovery falls back to query-only meanwhile
+// (legacy unicast queries don't need port 5353).
+func listenMDNSMulticast(server *MDNSServer, family mdnsFamily, health *ListenerHealth) {
+	failures := 0
+	for {
+		conn, socket, err := openMDNSListener(family, failures > 0)
+		if err == nil {
+			health.set(listenerListening, socket, nil)
+			log.Printf("Listening to mDNS multicast traffic on %s (%s socket)", family, socket)
+
+			var received bool
+			received, err = readMDNSListener(server, conn, family, health)
+			conn.Close()
+			if received {
+				failures = 0
+			}
+		}
+		failures++
+
+		server.bus.Publish(TopicAnomaly, newAnomaly("listener-degraded", "listener-degraded", map[string]string{
+			"socket": socket, "error": err.Error(),
+		}))
+
+		if failures > maxListenerRetries {
+			health.set(listenerFallback, "", err)
+			if family.primary {
+				server.intensity.RequireQueries(true)
+				log.Printf("⚠️  mDNS listener failed %d times (%v); falling back to query-only discovery", maxListenerRetries, err)
+			} else {
+				log.Printf("⚠️  mDNS listener on %s failed %d times (%v); IPv6-only devices won't be heard", family, maxListenerRetries, err)
+			}
+			time.Sleep(fallbackRetryInterval)
+			failures = 1
+			continue
+		}
+
+		health.set(listenerDegraded, socket, err)
+		log.Printf("⚠️  mDNS listener on %s degraded (%v); retrying with SO_REUSEPORT", family, err)
+		time.Sleep(time.Duration(failures) * 5 * time.Second)
+	}
+}
+
+// mdnsPacketReader reads a packet and the index of the interface it came
+// in on, 0 if unknown.
+type mdnsPacketReader func(b []byte) (n, ifIndex int, src net.Addr, err error)
+
+// newMDNSPacketReader reads from conn with the control message of its
+// family, which tells which interface each packet came in on.
+func newMDNSPacketReader(conn net.PacketConn, family mdnsFamily) mdnsPacketReader {
+	if family.primary {
+		p := ipv4.NewPacketConn(conn)
+		p.SetControlMessage(ipv4.FlagInterface, true)
+		return func(b []byte) (int, int, net.Addr, error) {
+			n, cm, src, err := p.ReadFrom(b)
+			if cm == nil {
+				return n, 0, src, err
+			}
+			return n, cm.IfIndex, src, err
+		}
+	}
+	p := ipv6.NewPacketConn(conn)
+	p.SetControlMessage(ipv6.FlagInterface, true)
+	return func(b []byte) (int, int, net.Addr, error) {
+		n, cm, src, err := p.ReadFrom(b)
+		if cm == nil {
+			return n, 0, src, err
+		}
+		return n, cm.IfIndex, src, err
+	}
+}
+
+// readMDNSListener reads packets until the socket fails or, for IPv4, stays
+// silent for listenerTimeout while queries are being sent. It reports
+// whether any packet was received.
+func readMDNSListener(server *MDNSServer, conn net.PacketConn, family mdnsFamily, health *ListenerHealth) (bool, error) {
+	read := newMDNSPacketReader(conn, family)
+
+	received := false
+	buffer := make([]byte, mdnsPayloadSize)
+	// Reused for every packet: Unpack replaces its sections rather than
+	// appending to them, so nothing handed on is overwritten
+	msg := new(dns.Msg)
+	for {
+		conn.SetReadDeadline(time.Now().Add(listenerTimeout))
+		n, ifIndex, src, err := read(buffer)
+		if err != nil {
+			var netErr net.Error
+			if !errors.As(err, &netErr) || !netErr.Timeout() {
+				return received, err
+			}
+			// Silence is only suspicious if we sent queries meanwhile
+			// (and not only just now)
+			if since := time.Since(time.Unix(0, server.lastQuery.Load())); family.primary && since < listenerTimeout && since > 5*time.Second {
+				return received, fmt.Errorf("no packets received in %s while querying", listenerTimeout)
+			}
+			continue
+		}
+
+		now := time.Now()
+		received = true
+		health.packet(now)
+		if family.primary {
+			server.intensity.RequireQueries(false)
+		}
+		// A disabled listener keeps its socket, so toggling it back on
+		// doesn't have to win the port again
+		if server.protocols.Enabled(protocolMDNSListener) {
+			iface := ""
+			if ifIndex != 0 {
+				iface = localNetworks.interfaceName(ifIndex)
+			}
+			// Invalid packets are ignored
+			if msg.Unpack(buffer[:n]) != nil {
+				continue
+			}
+			from, _ := src.(*net.UDPAddr)
+			handleMDNSPacket(server, msg, iface, from, now)
+			if !family.primary {
+				// The responder answers on IPv4, which can't reach an
+				// IPv6 sender directly: its queries get multicast answers
+				from = nil
+			}
+			server.responder.handleMsg(msg, iface, from)
+		}
+	}
+}
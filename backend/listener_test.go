@@ -0,0 +1,205 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// TestReusePortControl verifies two sockets can bind the same UDP port, as
+// the listener must alongside the system's mDNS responder
+func TestReusePortControl(t *testing.T) {
+	lc := net.ListenConfig{Control: reusePortControl}
+	first, err := lc.ListenPacket(context.Background(), "udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to bind first socket: %v", err)
+	}
+	defer first.Close()
+
+	second, err := lc.ListenPacket(context.Background(), "udp4", first.LocalAddr().String())
+	if err != nil {
+		t.Fatalf("Expected a second socket to share %s, got %v", first.LocalAddr(), err)
+	}
+	second.Close()
+}
+
+// TestRequireQueries verifies a passive idle mode keeps querying while the
+// listener is down
+func TestRequireQueries(t *testing.T) {
+	i := NewIntensity(IntensityConfig{QueryInterval: time.Second, BrowseInterval: time.Second, IdleAfter: 0, IdleInterval: 0})
+	time.Sleep(10 * time.Millisecond)
+
+	if query, _ := i.Intervals(); query != 0 {
+		t.Fatalf("Expected passive idle mode not to query, got %s", query)
+	}
+	i.RequireQueries(true)
+	if query, browse := i.Intervals(); query != fallbackInterval || browse != fallbackInterval {
+		t.Fatalf("Expected the fallback interval while queries are required, got %s/%s", query, browse)
+	}
+}
+
+// announcement is the packet a device sends announcing an HTTP service: the
+// PTR as the answer, with the SRV, TXT and address records in the
+// additional section.
+func announcement(tb testing.TB, device int) []byte {
+	tb.Helper()
+	instance := fmt.Sprintf("device-%d._http._tcp.local.", device)
+	host := fmt.Sprintf("device-%d.local.", device)
+	msg := new(dns.Msg)
+	msg.Response, msg.Authoritative = true, true
+	msg.Answer = []dns.RR{&dns.PTR{Hdr: dns.RR_Header{Name: "_http._tcp.local.", Rrtype: dns.TypePTR, Class: dns.ClassINET, Ttl: 4500}, Ptr: instance}}
+	msg.Extra = []dns.RR{
+		&dns.SRV{Hdr: dns.RR_Header{Name: instance, Rrtype: dns.TypeSRV, Class: dns.ClassINET | 0x8000, Ttl: 120}, Target: host, Port: 80},
+		&dns.TXT{Hdr: dns.RR_Header{Name: instance, Rrtype: dns.TypeTXT, Class: dns.ClassINET | 0x8000, Ttl: 4500}, Txt: []string{"path=/", "model=Benchmark"}},
+		&dns.A{Hdr: dns.RR_Header{Name: host, Rrtype: dns.TypeA, Class: dns.ClassINET | 0x8000, Ttl: 120}, A: net.IPv4(10, 1, byte(device>>8), byte(device))},
+	}
+	packet, err := msg.Pack()
+	if err != nil {
+		tb.Fatalf("Failed to pack the announcement: %v", err)
+	}
+	return packet
+}
+
+// query is a query from another host, listing the answers it knows.
+func query(tb testing.TB, known int) []byte {
+	tb.Helper()
+	msg := new(dns.Msg)
+	msg.Question = []dns.Question{{Name: "_http._tcp.local.", Qtype: dns.TypePTR, Qclass: dns.ClassINET}}
+	for i := 0; i < known; i++ {
+		msg.Answer = append(msg.Answer, &dns.PTR{Hdr: dns.RR_Header{Name: "_http._tcp.local.", Rrtype: dns.TypePTR, Class: dns.ClassINET, Ttl: 4500}, Ptr: fmt.Sprintf("device-%d._http._tcp.local.", i)})
+	}
+	packet, err := msg.Pack()
+	if err != nil {
+		tb.Fatalf("Failed to pack the query: %v", err)
+	}
+	return packet
+}
+
+// TestHandleMDNSPacketFromAnnouncement verifies an announcement carrying its
+// SRV and address records is published from the packet alone
+func TestHandleMDNSPacketFromAnnouncement(t *testing.T) {
+	server := NewMDNSServer()
+	msg := new(dns.Msg)
+	if err := msg.Unpack(announcement(t, 7)); err != nil {
+		t.Fatalf("Failed to unpack: %v", err)
+	}
+	handleMDNSPacket(server, msg, "en0", nil, time.Now())
+	services := server.listServices(defaultSite)
+	if len(services) != 1 || services[0].Name != "device-7" || services[0].Type != "_http._tcp.local." || services[0].IP != "10.1.0.7" || services[0].Host != "device-7.local" || services[0].Port != 80 {
+		t.Fatalf("Expected device-7 from the packet, got %+v", services)
+	}
+	if txt := services[0].TXT; len(txt) != 2 || txt["path"] != "/" || txt["model"] != "Benchmark" {
+		t.Fatalf("Expected the TXT record from the packet, got %v", txt)
+	}
+}
+
+// TestHandleMDNSPacketIPv6 verifies an IPv6-only device is listed at its
+// routable IPv6 address, and gets its IPv4 address once it announces one
+func TestHandleMDNSPacketIPv6(t *testing.T) {
+	server := NewMDNSServer()
+	msg := new(dns.Msg)
+	if err := msg.Unpack(announcement(t, 7)); err != nil {
+		t.Fatalf("Failed to unpack: %v", err)
+	}
+	v4 := msg.Extra[2]
+	aaaa := func(ip string) dns.RR {
+		return &dns.AAAA{Hdr: dns.RR_Header{Name: "device-7.local.", Rrtype: dns.TypeAAAA, Class: dns.ClassINET | 0x8000, Ttl: 120}, AAAA: net.ParseIP(ip)}
+	}
+	msg.Extra = append(msg.Extra[:2], aaaa("fe80::1"), aaaa("2001:db8::7"))
+	handleMDNSPacket(server, msg, "en0", nil, time.Now())
+	services := server.listServices(defaultSite)
+	if len(services) != 1 || services[0].IP != "2001:db8::7" || services[0].IP6 != "2001:db8::7" {
+		t.Fatalf("Expected device-7 at its routable IPv6 address, got %+v", services)
+	}
+
+	msg.Extra = append(msg.Extra, v4)
+	handleMDNSPacket(server, msg, "en0", nil, time.Now())
+	services = server.listServices(defaultSite)
+	if len(services) != 1 || services[0].IP != "10.1.0.7" || services[0].IP6 != "2001:db8::7" {
+		t.Fatalf("Expected device-7 at both addresses, got %+v", services)
+	}
+}
+
+// TestParseTXT verifies TXT strings are parsed like RFC 6763 §6 describes
+func TestParseTXT(t *testing.T) {
+	txt := parseTXT([]string{"txtvers=1", "Model=MacBookPro18,3", "model=ignored", "pw", "", "=nokey", "empty=", "note=a=b"})
+	want := map[string]string{"txtvers": "1", "model": "MacBookPro18,3", "pw": "", "empty": "", "note": "a=b"}
+	if !reflect.DeepEqual(txt, want) {
+		t.Fatalf("Expected %v, got %v", want, txt)
+	}
+	if txt := parseTXT([]string{""}); txt != nil {
+		t.Fatalf("Expected no pairs for an empty TXT record, got %v", txt)
+	}
+}
+
+// TestHandleMDNSPacketAllocations keeps the allocations of the common case on
+// a busy segment, a device announcing itself again, within budget
+func TestHandleMDNSPacketAllocations(t *testing.T) {
+	if raceEnabled {
+		t.Skip("the race detector allocates on its own")
+	}
+	server := NewMDNSServer()
+	packet := announcement(t, 1)
+	msg := new(dns.Msg)
+	handle := func() {
+		msg.Unpack(packet)
+		handleMDNSPacket(server, msg, "en0", nil, time.Now())
+	}
+	handle()
+	if allocs := testing.AllocsPerRun(100, handle); allocs > 40 {
+		t.Fatalf("Expected at most 40 allocations to handle a refresh, got %.0f", allocs)
+	}
+}
+
+// BenchmarkHandleMDNSPacket measures a packet from the listener through
+// unpacking, parsing, dedup and broadcast. A saturated segment carries a few
+// thousand packets a second; at 20µs an operation, 5000 packets a second
+// take a tenth of a core. "new" announces a device not seen before,
+// "refresh" cycles through 500 known ones, and "query" is another host's
+// query with 20 known answers.
+func BenchmarkHandleMDNSPacket(b *testing.B) {
+	corpora := map[string]func(b *testing.B) [][]byte{
+		"new": func(b *testing.B) [][]byte {
+			packets := make([][]byte, b.N)
+			for i := range packets {
+				packets[i] = announcement(b, 1000+i)
+			}
+			return packets
+		},
+		"refresh": func(b *testing.B) [][]byte {
+			packets := make([][]byte, 500)
+			for i := range packets {
+				packets[i] = announcement(b, i)
+			}
+			return packets
+		},
+		"query": func(b *testing.B) [][]byte { return [][]byte{query(b, 20)} },
+	}
+	for _, name := range []string{"new", "refresh", "query"} {
+		b.Run(name, func(b *testing.B) {
+			server := NewMDNSServer()
+			packets := corpora[name](b)
+			msg := new(dns.Msg)
+			for _, packet := range packets[:min(len(packets), 500)] {
+				if name == "refresh" && msg.Unpack(packet) == nil {
+					handleMDNSPacket(server, msg, "en0", nil, time.Now())
+				}
+			}
+
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if err := msg.Unpack(packets[i%len(packets)]); err != nil {
+					b.Fatalf("Failed to unpack: %v", err)
+				}
+				handleMDNSPacket(server, msg, "en0", nil, time.Now())
+			}
+			b.ReportMetric(float64(b.N)/b.Elapsed().Seconds(), "packets/s")
+		})
+	}
+}
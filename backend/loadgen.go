@@ -0,0 +1,435 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// loadgenType is the service type loadgen's devices advertise.
+const loadgenType = "_loadgen._tcp.local."
+
+// loadgenWorkers is how many events loadgen sends at once.
+const loadgenWorkers = 8
+
+// loadgenPending is a change loadgen expects to see on the stream.
+type loadgenPending struct {
+	removed bool
+	sent    time.Time
+}
+
+// loadgenKind counts the arrivals or removals of a run.
+type loadgenKind struct {
+	sent, seen int
+}
+
+// loadgen simulates devices announcing themselves and going away against
+// a running server, and measures how long the changes take to come out of
+// its event stream, and which never do.
+type loadgen struct {
+	server, token, site string
+	prefix              string // of the device names, unique per run
+	devices             int
+	flap                float64
+	send                func(events []DiscoveryResponse) error
+	client              *http.Client
+
+	mu        sync.Mutex
+	present   []bool
+	pending   map[string]loadgenPending // by device name
+	latencies []time.Duration
+	arrivals  loadgenKind
+	removals  loadgenKind
+	events    int // sent, including refreshes
+	errors    int
+	lastError string
+}
+
+// device is the service of loadgen device i, with an address in the
+// 198.18.0.0/15 benchmarking range.
+func (g *loadgen) device(i int) MDNSService {
+	name := fmt.Sprintf("%s%d", g.prefix, i)
+	return MDNSService{Name: name, Type: loadgenType, Host: name + ".local.", IP: fmt.Sprintf("198.18.%d.%d", i/254, i%254+1), Port: 9, Site: g.site}
+}
+
+// next picks the next event: a device that isn't there arrives, one that
+// is goes away with probability flap or else announces itself again. It
+// returns false when the picked device's last change hasn't been seen yet.
+func (g *loadgen) next() (DiscoveryResponse, bool) {
+	i := rand.IntN(g.devices)
+	service := g.device(i)
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	_, waiting := g.pending[service.Name]
+	var event DiscoveryResponse
+	switch {
+	case !g.present[i] && waiting:
+		return DiscoveryResponse{}, false
+	case g.present[i] && (waiting || rand.Float64() >= g.flap):
+		// A refresh, which doesn't show on the stream
+	case g.present[i]:
+		event.Removed = true
+		g.pending[service.Name] = loadgenPending{removed: true}
+		g.removals.sent++
+	default:
+		g.pending[service.Name] = loadgenPending{}
+		g.arrivals.sent++
+	}
+	g.present[i] = !event.Removed
+	g.events++
+	event.Service = service
+	return event, true
+}
+
+// observe matches an event from the stream with the change it shows.
+func (g *loadgen) observe(event DiscoveryResponse, now time.Time) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	pending, ok := g.pending[event.Service.Name]
+	if !ok || pending.removed != event.Removed {
+		return
+	}
+	delete(g.pending, event.Service.Name)
+	g.latencies = append(g.latencies, now.Sub(pending.sent))
+	if event.Removed {
+		g.removals.seen++
+	} else {
+		g.arrivals.seen++
+	}
+}
+
+func (g *loadgen) failed(err error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.errors++
+	g.lastError = err.Error()
+}
+
+func (g *loadgen) request(method, path string, body io.Reader) (*http.Request, error) {
+	req, err := http.NewRequest(method, strings.TrimSuffix(g.server, "/")+path, body)
+	if err == nil && g.token != "" {
+		req.Header.Set("Authorization", "Bearer "+g.token)
+	}
+	return req, err
+}
+
+// inject sends events through the server's /api/debug/inject.
+func (g *loadgen) inject(events []DiscoveryResponse) error {
+	body, err := json.Marshal(map[string]interface{}{"events": events})
+	if err != nil {
+		return err
+	}
+	req, err := g.request(http.MethodPost, "/api/v1/debug/inject", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := g.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		var e struct {
+			Error string `json:"error"`
+		}
+		json.NewDecoder(resp.Body).Decode(&e)
+		return fmt.Errorf("inject answered %s: %s", resp.Status, e.Error)
+	}
+	return nil
+}
+
+// multicaster announces loadgen's devices on the mDNS group, as the
+// devices would, and sends goodbyes (TTL 0) for removals.
+type multicaster struct {
+	conn *net.UDPConn
+}
+
+func newMulticaster() (*multicaster, error) {
+	conn, err := net.DialUDP("udp4", nil, &net.UDPAddr{IP: net.IPv4(224, 0, 0, 251), Port: 5353})
+	if err != nil {
+		return nil, err
+	}
+	return &multicaster{conn: conn}, nil
+}
+
+func (m *multicaster) send(events []DiscoveryResponse) error {
+	for _, event := range events {
+		service := event.Service
+		ttl := uint32(defaultRecordTTL / time.Second)
+		if event.Removed {
+			ttl = 0
+		}
+		instance := service.Name + "." + service.Type
+		header := func(name string, rrtype uint16) dns.RR_Header {
+			return dns.RR_Header{Name: name, Rrtype: rrtype, Class: dns.ClassINET, Ttl: ttl}
+		}
+		msg := new(dns.Msg)
+		msg.Response, msg.Authoritative = true, true
+		msg.Answer = []dns.RR{
+			&dns.PTR{Hdr: header(service.Type, dns.TypePTR), Ptr: instance},
+			&dns.SRV{Hdr: header(instance, dns.TypeSRV), Target: service.Host, Port: service.Port},
+			&dns.TXT{Hdr: header(instance, dns.TypeTXT), Txt: []string{"loadgen=1"}},
+			&dns.A{Hdr: header(service.Host, dns.TypeA), A: net.ParseIP(service.IP).To4()},
+		}
+		packet, err := msg.Pack()
+		if err != nil {
+			return err
+		}
+		if _, err := m.conn.Write(packet); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// watch reads the server's event stream for loadgen's devices until ctx
+// is done. It returns once the stream is connected, or fails.
+func (g *loadgen) watch(ctx context.Context) error {
+	query := url.Values{"filter": {fmt.Sprintf("name~%q", g.prefix)}}
+	if g.site != "" {
+		query.Set("site", g.site)
+	}
+	req, err := g.request(http.MethodGet, "/api/v1/discover?"+query.Encode(), nil)
+	if err != nil {
+		return err
+	}
+	resp, err := (&http.Client{}).Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return fmt.Errorf("stream answered %s", resp.Status)
+	}
+	go func() {
+		defer resp.Body.Close()
+		scanner := bufio.NewScanner(resp.Body)
+		scanner.Buffer(make([]byte, 64<<10), 1<<20)
+		for scanner.Scan() {
+			data, ok := strings.CutPrefix(scanner.Text(), "data: ")
+			if !ok {
+				continue
+			}
+			var event DiscoveryResponse
+			if json.Unmarshal([]byte(data), &event) == nil {
+				g.observe(event, time.Now())
+			}
+		}
+	}()
+	return nil
+}
+
+// run sends events at rate per second for duration, then waits up to
+// grace for the changes still expected. A server slower than the rate
+// holds the sending back, which shows as a lower rate in the report.
+func (g *loadgen) run(rate float64, duration, grace time.Duration) time.Duration {
+	queue := make(chan DiscoveryResponse)
+	var workers sync.WaitGroup
+	for range loadgenWorkers {
+		workers.Add(1)
+		go func() {
+			defer workers.Done()
+			for event := range queue {
+				g.sending(event.Service.Name, time.Now())
+				if err := g.send([]DiscoveryResponse{event}); err != nil {
+					g.failed(err)
+				}
+			}
+		}()
+	}
+
+	start := time.Now()
+	ticker := time.NewTicker(time.Duration(float64(time.Second) / rate))
+	for now := range ticker.C {
+		if now.Sub(start) >= duration {
+			break
+		}
+		if event, ok := g.next(); ok {
+			queue <- event
+		}
+	}
+	ticker.Stop()
+	close(queue)
+	workers.Wait()
+	elapsed := time.Since(start)
+
+	for deadline := time.Now().Add(grace); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		g.mu.Lock()
+		done := len(g.pending) == 0
+		g.mu.Unlock()
+		if done {
+			break
+		}
+	}
+	return elapsed
+}
+
+// sending starts the clock of the change expected for a device, if any,
+// as its event leaves: the time it waited for a sender doesn't count.
+func (g *loadgen) sending(name string, now time.Time) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if pending, ok := g.pending[name]; ok {
+		pending.sent = now
+		g.pending[name] = pending
+	}
+}
+
+// cleanup removes the devices still there, so the run leaves nothing
+// behind.
+func (g *loadgen) cleanup() error {
+	g.mu.Lock()
+	var events []DiscoveryResponse
+	for i, present := range g.present {
+		if present {
+			events = append(events, DiscoveryResponse{Service: g.device(i), Removed: true})
+		}
+	}
+	g.mu.Unlock()
+	for len(events) > 0 {
+		batch := events[:min(len(events), maxInjectEvents)]
+		events = events[len(batch):]
+		if err := g.send(batch); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// report prints what a run sent, saw and lost, and reports whether the
+// server kept up: no errors and nothing dropped.
+func (g *loadgen) report(w io.Writer, elapsed time.Duration) bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	fmt.Fprintf(w, "events:   %d in %s (%.1f/s), %d errors\n", g.events, elapsed.Round(time.Millisecond), float64(g.events)/elapsed.Seconds(), g.errors)
+	for _, kind := range []struct {
+		name string
+		loadgenKind
+	}{{"arrivals", g.arrivals}, {"removals", g.removals}} {
+		fmt.Fprintf(w, "%-9s %d sent, %d seen, %d dropped\n", kind.name+":", kind.sent, kind.seen, kind.sent-kind.seen)
+	}
+	sorted := append([]time.Duration(nil), g.latencies...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	if len(sorted) > 0 {
+		fmt.Fprintf(w, "latency:  p50 %s, p90 %s, p99 %s, max %s\n", percentile(sorted, 0.5), percentile(sorted, 0.9), percentile(sorted, 0.99), sorted[len(sorted)-1])
+	}
+	if g.lastError != "" {
+		fmt.Fprintf(w, "last error: %s\n", g.lastError)
+	}
+	return g.errors == 0 && len(g.pending) == 0
+}
+
+// runLoadgen is the loadgen subcommand, which simulates devices against a
+// running instance to find its capacity limits:
+//
+//	network-view-osx loadgen -devices 2000 -rate 500 -flap 0.2 -duration 1m
+//
+// Devices are injected through /api/debug/inject (the server needs
+// -debug-inject), or with -mode multicast announced on the mDNS group of
+// the local network. Either way the changes are timed until they come out
+// of the server's event stream; those that don't within -grace are dropped.
+func runLoadgen(args []string, stdout, stderr io.Writer) int {
+	flags := flag.NewFlagSet("loadgen", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	server := flags.String("server", "http://localhost:9999", "URL of the network-view server")
+	token := flags.String("token", "", "API token of the server (default: $NETWORK_VIEW_TOKEN or the api-token secret)")
+	mode := flags.String("mode", "inject", "How devices are simulated: inject (through /api/debug/inject) or multicast (real mDNS announcements)")
+	site := flags.String("site", "", "Site the injected devices belong to (default: the server's own)")
+	devices := flags.Int("devices", 100, "Number of simulated devices")
+	rate := flags.Float64("rate", 50, "Events sent per second, across all devices")
+	flap := flags.Float64("flap", 0.1, "Probability that an event of a present device removes it instead of announcing it again")
+	duration := flags.Duration("duration", 30*time.Second, "How long to send events")
+	grace := flags.Duration("grace", 5*time.Second, "How long to wait for the last changes to show on the stream before they count as dropped")
+	keep := flags.Bool("keep", false, "Leave the simulated devices on the server instead of removing them at the end")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if *devices < 1 || *devices > 254*254 || *rate <= 0 || *flap < 0 || *flap > 1 || *duration <= 0 {
+		fmt.Fprintln(stderr, "loadgen: -devices must be 1 to 64516, -rate positive, -flap between 0 and 1 and -duration positive")
+		return 2
+	}
+
+	g := &loadgen{
+		server:  *server,
+		token:   optionalSecret("api-token", firstNonEmpty(*token, os.Getenv("NETWORK_VIEW_TOKEN"))),
+		site:    *site,
+		prefix:  fmt.Sprintf("loadgen-%x-", rand.Uint32()),
+		devices: *devices,
+		flap:    *flap,
+		client:  &http.Client{Timeout: 10 * time.Second},
+		present: make([]bool, *devices),
+		pending: make(map[string]loadgenPending),
+	}
+	switch *mode {
+	case "inject":
+		g.send = g.inject
+	case "multicast":
+		if *site != "" {
+			fmt.Fprintln(stderr, "loadgen: -site only applies to -mode inject")
+			return 2
+		}
+		m, err := newMulticaster()
+		if err != nil {
+			fmt.Fprintf(stderr, "loadgen: %v\n", err)
+			return 1
+		}
+		defer m.conn.Close()
+		g.send = m.send
+	default:
+		fmt.Fprintln(stderr, "loadgen: -mode must be inject or multicast")
+		return 2
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if err := g.watch(ctx); err != nil {
+		fmt.Fprintf(stderr, "loadgen: cannot follow the event stream of %s: %v\n", *server, err)
+		return 1
+	}
+	if *mode == "inject" {
+		// Fail early, e.g. without -debug-inject, rather than count every
+		// event as an error
+		if err := g.inject([]DiscoveryResponse{{Service: g.device(0), Removed: true}}); err != nil {
+			fmt.Fprintf(stderr, "loadgen: %v\n", err)
+			return 1
+		}
+	}
+
+	fmt.Fprintf(stdout, "Simulating %d devices (%s*) at %.0f events/s for %s\n", *devices, g.prefix, *rate, *duration)
+	elapsed := g.run(*rate, *duration, *grace)
+	ok := g.report(stdout, elapsed)
+	if !*keep {
+		if err := g.cleanup(); err != nil {
+			fmt.Fprintf(stderr, "loadgen: cleaning up: %v\n", err)
+		}
+	}
+	if !ok {
+		return 1
+	}
+	return 0
+}
+
+func firstNonEmpty(values ...string) string {
+	for _, v := range values {
+		if v != "" {
+			return v
+		}
+	}
+	return ""
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newLoadgenTarget runs a server that accepts injected events and streams
+// them, as loadgen expects.
+func newLoadgenTarget(t *testing.T, debugInject bool) *httptest.Server {
+	t.Helper()
+	server := newNotifyServer(t)
+	server.debugInject = debugInject
+	mux := http.NewServeMux()
+	handleAPI(mux, "/api/discover", server.Discover)
+	handleAPI(mux, "/api/debug/inject", server.DebugInject)
+	ts := httptest.NewServer(mux)
+	t.Cleanup(ts.Close)
+	return ts
+}
+
+// TestLoadgen verifies a run against a server that keeps up sees every
+// arrival and removal it sends
+func TestLoadgen(t *testing.T) {
+	ts := newLoadgenTarget(t, true)
+	var stdout, stderr bytes.Buffer
+	code := runLoadgen([]string{"-server", ts.URL, "-devices", "5", "-rate", "200", "-flap", "0.5", "-duration", "300ms", "-grace", "2s"}, &stdout, &stderr)
+	if code != 0 {
+		t.Fatalf("Expected a clean run, got %d: %s%s", code, stdout.String(), stderr.String())
+	}
+	report := stdout.String()
+	for _, want := range []string{"0 errors", "latency:", "dropped"} {
+		if !strings.Contains(report, want) {
+			t.Fatalf("Expected %q in the report, got %s", want, report)
+		}
+	}
+	if strings.Contains(report, "arrivals: 0 sent") || !strings.Contains(report, ", 0 dropped\nremovals:") {
+		t.Fatalf("Expected arrivals to be sent and none dropped, got %s", report)
+	}
+}
+
+// TestLoadgenWithoutInject verifies loadgen stops at once when the server
+// doesn't accept injected events
+func TestLoadgenWithoutInject(t *testing.T) {
+	ts := newLoadgenTarget(t, false)
+	var stdout, stderr bytes.Buffer
+	if code := runLoadgen([]string{"-server", ts.URL, "-duration", "1s"}, &stdout, &stderr); code != 1 || !strings.Contains(stderr.String(), "404") {
+		t.Fatalf("Expected a failure naming the 404, got %d: %s", code, stderr.String())
+	}
+}
+
+// TestLoadgenObserve verifies stream events are matched with the change a
+// device is expected to make, and that others are ignored
+func TestLoadgenObserve(t *testing.T) {
+	g := &loadgen{prefix: "loadgen-test-", devices: 1, present: make([]bool, 1), pending: make(map[string]loadgenPending)}
+	event, ok := g.next()
+	if !ok || event.Removed || event.Service.Name != "loadgen-test-0" || event.Service.IP != "198.18.0.1" {
+		t.Fatalf("Expected the absent device to arrive, got %+v", event)
+	}
+	if refresh, ok := g.next(); !ok || refresh.Removed || g.arrivals.sent != 1 {
+		t.Fatalf("Expected only refreshes while the arrival is unseen, got %+v", refresh)
+	}
+	g.observe(DiscoveryResponse{Service: event.Service, Removed: true}, time.Now())
+	if g.arrivals.seen != 0 {
+		t.Fatalf("Expected a removal not to count as the arrival")
+	}
+	g.observe(event, time.Now())
+	if g.arrivals != (loadgenKind{sent: 1, seen: 1}) || len(g.pending) != 0 || len(g.latencies) != 1 {
+		t.Fatalf("Expected the arrival to be seen, got %+v, %d pending", g.arrivals, len(g.pending))
+	}
+}
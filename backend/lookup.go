@@ -0,0 +1,245 @@
+package main
+
+import (
+	"net"
+	"net/netip"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// Limits of the queries the records of a packet lead to. A responder
+// announcing instances without their SRV records, or SRV records without
+// their targets' addresses, has us query for them, and the answers reach
+// the listener as packets of their own; a responder answering every query
+// with fresh names would keep the chain going forever.
+const (
+	// maxFollowUps bounds the queries one packet leads to, over the whole
+	// chain from PTR to SRV to address
+	maxFollowUps = 8
+	// sourceBudget is the follow-ups a responder may cause in a burst; it
+	// gets one back every sourceRefill
+	sourceBudget = 64
+	sourceRefill = time.Second
+	// repeatInterval is how long a name isn't queried for again, as a
+	// record is asked for at most once a second (RFC 6762 §5.2)
+	repeatInterval = time.Second
+	// maxLookupEntries bounds the responders and names tracked
+	maxLookupEntries = 1024
+)
+
+type sourceState struct {
+	tokens   int
+	refilled time.Time
+}
+
+// LookupLimits bounds the follow-up queries of the service table. Each
+// responder has a budget of them, and a name that was just queried isn't
+// queried again.
+type LookupLimits struct {
+	mu      sync.Mutex
+	sources map[netip.Addr]*sourceState
+	recent  map[string]time.Time // lower case name, when queried
+
+	refused   atomic.Uint64 // past a packet's maxFollowUps
+	throttled atomic.Uint64 // past a responder's budget
+	repeated  atomic.Uint64 // names queried less than repeatInterval ago
+}
+
+func NewLookupLimits() *LookupLimits {
+	return &LookupLimits{
+		sources: make(map[netip.Addr]*sourceState),
+		recent:  make(map[string]time.Time),
+	}
+}
+
+// allow reports whether name may be queried at now for a packet from
+// source, which is invalid when unknown, and takes it from the source's
+// budget if so.
+func (l *LookupLimits) allow(source netip.Addr, name string, now time.Time) bool {
+	key := strings.ToLower(name)
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if queried, ok := l.recent[key]; ok && now.Sub(queried) < repeatInterval {
+		l.repeated.Add(1)
+		return false
+	}
+	if len(l.recent) >= maxLookupEntries {
+		for name, queried := range l.recent {
+			if now.Sub(queried) >= repeatInterval {
+				delete(l.recent, name)
+			}
+		}
+		if len(l.recent) >= maxLookupEntries {
+			l.throttled.Add(1)
+			return false
+		}
+	}
+
+	if source.IsValid() {
+		state := l.source(source, now)
+		if state == nil || state.tokens == 0 {
+			l.throttled.Add(1)
+			return false
+		}
+		state.tokens--
+	}
+	l.recent[key] = now
+	return true
+}
+
+// source returns the budget of a responder as of now, nil if there are too
+// many responders to track another. It must be called with l.mu held.
+func (l *LookupLimits) source(addr netip.Addr, now time.Time) *sourceState {
+	state, ok := l.sources[addr]
+	if !ok {
+		if len(l.sources) >= maxLookupEntries {
+			// Responders with their whole budget are as good as new
+			for addr, state := range l.sources {
+				if state.refill(now) == sourceBudget {
+					delete(l.sources, addr)
+				}
+			}
+			if len(l.sources) >= maxLookupEntries {
+				return nil
+			}
+		}
+		state = &sourceState{tokens: sourceBudget, refilled: now}
+		l.sources[addr] = state
+	}
+	state.refill(now)
+	return state
+}
+
+// refill gives back the follow-ups earned since the last refill, and
+// returns how many are left.
+func (s *sourceState) refill(now time.Time) int {
+	if n := int(now.Sub(s.refilled) / sourceRefill); n > 0 {
+		s.tokens = min(s.tokens+n, sourceBudget)
+		s.refilled = s.refilled.Add(time.Duration(n) * sourceRefill)
+	}
+	if s.tokens == sourceBudget {
+		s.refilled = now
+	}
+	return s.tokens
+}
+
+// Status is the lookups section of /api/status.
+func (l *LookupLimits) Status() map[string]interface{} {
+	l.mu.Lock()
+	sources := len(l.sources)
+	l.mu.Unlock()
+	return map[string]interface{}{
+		"sources":   sources,
+		"refused":   l.refused.Load(),
+		"throttled": l.throttled.Load(),
+		"repeated":  l.repeated.Load(),
+	}
+}
+
+// followUps is what is left of the follow-up queries of one packet.
+type followUps struct {
+	limits *LookupLimits
+	source netip.Addr // the responder, invalid when unknown
+	left   int
+}
+
+// newFollowUps returns the follow-ups of a packet from addr, which is nil
+// when unknown.
+func newFollowUps(limits *LookupLimits, addr *net.UDPAddr) followUps {
+	f := followUps{limits: limits, left: maxFollowUps}
+	if addr != nil {
+		f.source, _ = netip.AddrFromSlice(addr.IP)
+		f.source = f.source.Unmap()
+	}
+	return f
+}
+
+// allow reports whether name may be queried for the packet, at now, and
+// counts the query if so.
+func (f *followUps) allow(name string, now time.Time) bool {
+	if f.left <= 0 {
+		f.limits.refused.Add(1)
+		return false
+	}
+	if !f.limits.allow(f.source, name, now) {
+		return false
+	}
+	f.left--
+	return true
+}
+
+// splitInstance splits an instance name into its first label, in escaped
+// form, and its service type, e.g. `Living\ Room._airplay._tcp.local.` into
+// `Living\ Room` and "_airplay._tcp.local.". Unlike cutting at the first
+// dot it keeps escaped dots in the label.
+func splitInstance(instance string) (name, serviceType string, ok bool) {
+	for i := 0; i < len(instance); i++ {
+		switch instance[i] {
+		case '\\':
+			i++ // the escaped byte, or the first digit of \DDD
+		case '.':
+			if i == 0 || i == len(instance)-1 {
+				return "", "", false
+			}
+			return instance[:i], instance[i+1:], true
+		}
+	}
+	return "", "", false
+}
+
+// instanceOf reports whether a PTR record of owner may point to instance:
+// one label below the service type it browses, which subtype names
+// ("_printer._sub._http._tcp.local.") are a selection of. PTR records
+// pointing elsewhere would lead to queries of arbitrary names.
+func instanceOf(instance, owner string) bool {
+	if _, serviceType, ok := strings.Cut(owner, "._sub."); ok {
+		owner = serviceType
+	}
+	_, serviceType, ok := splitInstance(instance)
+	return ok && strings.EqualFold(serviceType, owner)
+}
+
+// localHost reports whether a host name is one mDNS resolves, under .local.
+func localHost(host string) bool {
+	host = dns.Fqdn(host)
+	return len(host) > len(".local.") && strings.EqualFold(host[len(host)-len(".local."):], ".local.")
+}
+
+// sanitizeName escapes the bytes of a name from the network that aren't
+// printable ASCII as \DDD, like the dns package presents names, so names
+// reported by agents can't break up log lines or pass for other names in
+// keys. Names unpacked from packets are already escaped and returned as
+// they are.
+func sanitizeName(name string) string {
+	i := 0
+	for i < len(name) && name[i] >= ' ' && name[i] <= '~' {
+		i++
+	}
+	if i == len(name) {
+		return name
+	}
+
+	var b strings.Builder
+	b.WriteString(name[:i])
+	for ; i < len(name); i++ {
+		if c := name[i]; c >= ' ' && c <= '~' {
+			b.WriteByte(c)
+		} else {
+			b.WriteByte('\\')
+			if c < 100 {
+				b.WriteByte('0')
+			}
+			if c < 10 {
+				b.WriteByte('0')
+			}
+			b.WriteString(strconv.Itoa(int(c)))
+		}
+	}
+	return b.String()
+}
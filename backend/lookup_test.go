@@ -0,0 +1,92 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// TestFollowUps verifies a packet leads to at most maxFollowUps queries, a
+// name isn't queried twice within repeatInterval and a responder's budget
+// refills over time
+func TestFollowUps(t *testing.T) {
+	limits := NewLookupLimits()
+	from := &net.UDPAddr{IP: net.IPv4(192, 168, 1, 66), Port: 5353}
+	now := time.Now()
+
+	follow := newFollowUps(limits, from)
+	if !follow.allow("a.local.", now) || follow.allow("A.local.", now) {
+		t.Fatalf("Expected a name to be queried once within %s", repeatInterval)
+	}
+	allowed := 1
+	for i := 0; i < 2*maxFollowUps; i++ {
+		if follow.allow(fmt.Sprintf("host-%d.local.", i), now) {
+			allowed++
+		}
+	}
+	if allowed != maxFollowUps || limits.refused.Load() != maxFollowUps+1 {
+		t.Fatalf("Expected %d follow-ups for a packet, got %d and %d refused", maxFollowUps, allowed, limits.refused.Load())
+	}
+
+	for i := 0; i < sourceBudget; i++ {
+		follow = newFollowUps(limits, from)
+		follow.allow(fmt.Sprintf("burst-%d.local.", i), now)
+	}
+	if limits.throttled.Load() != maxFollowUps {
+		t.Fatalf("Expected the budget of %d to run out, got %d throttled", sourceBudget, limits.throttled.Load())
+	}
+	follow = newFollowUps(limits, from)
+	if !follow.allow("later.local.", now.Add(sourceRefill)) || follow.allow("later-2.local.", now.Add(sourceRefill)) {
+		t.Fatalf("Expected one follow-up back after %s", sourceRefill)
+	}
+
+	other := newFollowUps(limits, &net.UDPAddr{IP: net.IPv4(192, 168, 1, 67), Port: 5353})
+	if !other.allow("other.local.", now) {
+		t.Fatalf("Expected another responder to have its own budget")
+	}
+}
+
+// TestInstanceNames verifies instance names split at their first unescaped
+// dot, PTR records are only followed to instances of their type and names
+// reported by agents are escaped
+func TestInstanceNames(t *testing.T) {
+	name, serviceType, ok := splitInstance(`Living\ Room\.2._airplay._tcp.local.`)
+	if !ok || name != `Living\ Room\.2` || serviceType != "_airplay._tcp.local." {
+		t.Fatalf("Expected the escaped dot kept in the label, got %q %q", name, serviceType)
+	}
+
+	for _, test := range []struct {
+		instance, owner string
+		want            bool
+	}{
+		{"Printer._ipp._tcp.local.", "_ipp._tcp.local.", true},
+		{"Printer._ipp._tcp.local.", "_universal._sub._ipp._tcp.local.", true},
+		{"Printer._http._tcp.local.", "_ipp._tcp.local.", false},
+		{"victim.example.com.", "_ipp._tcp.local.", false},
+		{"_ipp._tcp.local.", "_ipp._tcp.local.", false},
+	} {
+		if got := instanceOf(test.instance, test.owner); got != test.want {
+			t.Fatalf("Expected instanceOf(%q, %q) = %v", test.instance, test.owner, test.want)
+		}
+	}
+
+	if got := sanitizeName("NAS\nService expired: x"); got != `NAS\010Service expired: x` {
+		t.Fatalf("Expected the newline escaped, got %q", got)
+	}
+}
+
+// TestHandleMDNSPacketForeignPTR verifies PTR records pointing outside their
+// service type aren't followed
+func TestHandleMDNSPacketForeignPTR(t *testing.T) {
+	server := NewMDNSServer()
+	msg := new(dns.Msg)
+	msg.Response = true
+	msg.Answer = []dns.RR{&dns.PTR{Hdr: dns.RR_Header{Name: "_http._tcp.local.", Rrtype: dns.TypePTR, Class: dns.ClassINET, Ttl: 4500}, Ptr: "victim.example.com."}}
+	handleMDNSPacket(server, msg, "en0", &net.UDPAddr{IP: net.IPv4(192, 168, 1, 66), Port: 5353}, time.Now())
+	if len(server.lookups.recent) != 0 {
+		t.Fatalf("Expected no query for a foreign name, got %v", server.lookups.recent)
+	}
+}
@@ -1,18 +1,27 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
+	"io"
 	"log"
 	"net"
 	"net/http"
 	"os"
+	"os/signal"
 	"path/filepath"
+	"sort"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 
+	graphql "github.com/graph-gophers/graphql-go"
 	"github.com/hashicorp/mdns"
 	"github.com/miekg/dns"
 )
@@ -21,54 +30,431 @@ type MDNSService struct {
 	Name      string `json:"name"`
 	Type      string `json:"type"`
 	Host      string `json:"host"`
-	IP        string `json:"ip"`
+	IP        string `json:"ip"` // IPv4, or IPv6 for IPv6-only services
+	IP6       string `json:"ip6,omitempty"`
 	Port      uint16 `json:"port"`
 	Timestamp int64  `json:"timestamp"`
+	Site      string `json:"site"`
+	// LastRefreshed is when the service was last announced, and ExpiresAt
+	// when its record's TTL runs out unless it is announced again
+	LastRefreshed int64 `json:"lastRefreshed"`
+	ExpiresAt     int64 `json:"expiresAt"`
+	// FirstSeen and LastSeen are Timestamp and LastRefreshed in RFC 3339
+	// with the server's UTC offset, which the integers leave ambiguous
+	FirstSeen string `json:"firstSeen,omitempty"`
+	LastSeen  string `json:"lastSeen,omitempty"`
+	// Interfaces are the local interfaces the service was seen on, so a
+	// service reachable on several is one record
+	Interfaces []ServiceInterface `json:"interfaces,omitempty"`
+	// Source is the protocol the service was discovered by (mdns, ssdp,
+	// arp, dhcp or ble), Confidence how much that evidence is worth, from
+	// 0 to 1, and RawRecordType the record that revealed it, e.g. PTR
+	Source        string  `json:"source,omitempty"`
+	Confidence    float64 `json:"confidence,omitempty"`
+	RawRecordType string  `json:"rawRecordType,omitempty"`
+	// TXT holds the key/value pairs of the instance's TXT record, such as
+	// a printer's capabilities or a HomeKit accessory's pairing state.
+	// It is replaced, never modified, when the record changes
+	TXT map[string]string `json:"txt,omitempty"`
+	// Self is set on the services this host advertises, which are only
+	// listed with -include-self
+	Self bool `json:"self,omitempty"`
+	// Reachable is whether the service accepted a TCP connection when
+	// CheckedAt, with -reachability-interval; unset until it is checked.
+	// ReachableAt is the last time it did
+	Reachable   *bool `json:"reachable,omitempty"`
+	CheckedAt   int64 `json:"checkedAt,omitempty"`
+	ReachableAt int64 `json:"reachableAt,omitempty"`
+	// Targets are the hosts the instance's SRV records point to, in order
+	// of preference; Host, Port and the addresses are those of one of
+	// them. Replicated services have several
+	Targets []ServiceTarget `json:"targets,omitempty"`
+}
+
+// defaultRecordTTL is used when the TTL of a service's records is unknown:
+// the TTL RFC 6762 recommends for SRV and address records.
+const defaultRecordTTL = 120 * time.Second
+
+// setTTL sets a service's freshness from the TTL of the record announcing it.
+func (service *MDNSService) setTTL(now time.Time, ttl time.Duration) {
+	service.LastRefreshed = now.Unix()
+	service.LastSeen = formatUnix(service.LastRefreshed)
+	service.ExpiresAt = now.Add(ttl).Unix()
+}
+
+// setAddresses sets a service's addresses from those of its host. It
+// reports false if the host has neither.
+func (service *MDNSService) setAddresses(ip4, ip6 string) bool {
+	service.IP, service.IP6 = ip4, ip6
+	if ip4 == "" {
+		service.IP = ip6
+	}
+	return service.IP != ""
+}
+
+// formatUnix renders Unix seconds in RFC 3339 in the server's timezone, or
+// "" for 0.
+func formatUnix(secs int64) string {
+	if secs == 0 {
+		return ""
+	}
+	return time.Unix(secs, 0).Format(time.RFC3339)
 }
 
 type DiscoveryResponse struct {
 	Service MDNSService `json:"service"`
 	Removed bool        `json:"removed"`
+	// Seq is the event's sequence number, see EventBus; 0 for events
+	// that weren't published
+	Seq uint64 `json:"seq,omitempty"`
+}
+
+func (r *DiscoveryResponse) setSeq(seq uint64) {
+	r.Seq = seq
 }
 
 type MDNSServer struct {
-	clients      map[chan *DiscoveryResponse]bool
-	mu           sync.RWMutex
-	seen         map[string]bool
+	clients      map[*streamClient]bool
+	events       chan *streamEvent
+	bus          *EventBus
+	clientBuffer int
+	// slowClientTimeout disconnects clients whose queue stays full for
+	// longer than this; 0 keeps them connected and drops events instead
+	slowClientTimeout time.Duration
+	// onClients is called whenever a stream client connects or disconnects
+	onClients func(connected int)
+	bursting  atomic.Bool
+	intensity *Intensity
+	listener  *ListenerHealth // IPv4
+	listener6 *ListenerHealth
+	workers   *Supervisor
+	protocols *Protocols
+	serviceTypes *ServiceTypes
+	discovered   *DiscoveredTypes
+	helper    *HelperClient // nil without a privileged helper
+	auth       *Auth           // nil or disabled without API authentication
+	adminAllow *AdminAllowlist // nil without -admin-allow
+	self      *SelfFilter
+	negative  *NegativeCache
+	lookups   *LookupLimits
+	ignore    *Filter // -ignore: services never listed, nil for none
+	snmp      *SNMPPoller // nil without -snmp-community
+	reachability *ReachabilityChecker // nil without -reachability-interval
+	gateway   gatewayCache
+	speedtest *SpeedTester
+	internet  *InternetMonitor
+	exposure  *ExposureChecker
+	// ntpServers are checked on /api/time besides the discovered ones
+	ntpServers []string
+	capture   *Capture // nil without -capture
+	traffic   *TrafficAccounting
+	flows     *FlowTable
+	blocklists *Blocklists // nil without -blocklist
+	arpwatch   *ARPWatch
+	ra         *RAMonitor // nil without -ra-watch
+	responder  *Responder
+	vendors    *VendorDB // nil without -oui
+	views      *ViewStore
+	stableIDs  *StableIDs
+	expected   *ExpectedStore
+	expectations *Expectations
+	maintenance  *MaintenanceWindows
+	notifiers    *Notifiers
+	backups      *Backups // nil without -backup-dir or -backup-s3
+	audit        *AuditLog
+	debugInject  bool // -debug-inject enables /api/debug/inject
+	shares     *ShareStore
+	history    *EventHistory
+	dashboardBase string // -dashboard-url, overriding the URL /api/qr derives
+	lastQuery atomic.Int64 // Unix nanoseconds
+	replay       *ReplayBuffer
+	mu           sync.RWMutex // guards clients and currentIface
+	table        *ServiceTable
+	// order is held while a service changes and the change is published,
+	// so events come out in the order the table applied them
+	order        sync.Mutex
+	latency      *DiscoveryLatency
+	identity     identityFunc
 	currentIface string
+	site         string
+	metadata     *MetadataStore
+	availability *AvailabilityTracker
+	vacuum       *Vacuum
+	memory       *MemoryBudget
+	store        Store
+	storeKind    string
+	graphql      *graphql.Schema
 }
 
 func NewMDNSServer() *MDNSServer {
-	return &MDNSServer{
-		clients:      make(map[chan *DiscoveryResponse]bool),
-		seen:         make(map[string]bool),
+	s := &MDNSServer{
+		clients:      make(map[*streamClient]bool),
+		events:       make(chan *streamEvent, dispatchQueueSize),
+		bus:          NewEventBus(),
+		clientBuffer: 100,
+		replay:       NewReplayBuffer(0),
+		table:        NewServiceTable(),
+		latency:      NewDiscoveryLatency(),
+		identity:     identityFuncs["instance"],
+		intensity:    NewIntensity(defaultIntensity),
+		listener:     &ListenerHealth{state: listenerStarting, since: time.Now()},
+		listener6:    &ListenerHealth{state: listenerStarting, since: time.Now()},
+		workers:      NewSupervisor(),
+		protocols:    newProtocols(nil),
+		serviceTypes: newServiceTypes(defaultServiceTypes, nil),
+		discovered:   NewDiscoveredTypes(true),
+		self:         NewSelfFilter(false),
+		negative:     NewNegativeCache(),
+		lookups:      NewLookupLimits(),
 		currentIface: "en5",
+		site:         defaultSite,
 	}
+	s.workers.onFailure = func(name string, err error) {
+		s.bus.Publish(TopicAnomaly, newAnomaly("worker-failed", "worker-failed", map[string]string{
+			"worker": name, "error": err.Error(),
+		}))
+	}
+	s.arpwatch = NewARPWatch(s.bus)
+	s.internet = NewInternetMonitor(s.bus)
+	s.exposure = NewExposureChecker("", s.bus)
+	s.history = NewEventHistory(s.bus)
+	s.workers.Go("dispatch", s.dispatch)
+	s.workers.Go("table", s.table.Run)
+
+	// The event stream carries service events
+	s.bus.Subscribe("stream", func(e BusEvent) {
+		s.broadcast(e.Payload.(*DiscoveryResponse))
+	}, TopicService)
+	return s
 }
 
-func (s *MDNSServer) broadcast(response *DiscoveryResponse) {
-	s.mu.RLock()
-	defer s.mu.RUnlock()
+// addService records a service under its dedup key and reports whether it
+// was not already known. Services known before a restart only count as new
+// if they changed. Services without a site belong to this instance's
+// own site; keys are scoped per site so networks never mix. Sightings of a
+// local service on another interface are merged into its Interfaces.
+func (s *MDNSServer) addService(key string, service *MDNSService) bool {
+	if service.Site == "" {
+		service.Site = s.site
+	}
+	if id := siteKey(service.Site, deviceID(service)); s.availability != nil && s.availability.Sighted(id, time.Now()) {
+		s.bus.Publish(TopicHost, HostEvent{ID: deviceID(service), Site: service.Site, New: s.availability.Intervals(id) == 1, service: service})
+	}
 
-	for ch := range s.clients {
-		select {
-		case ch <- response:
-		default:
-			// Skip if channel is full
+	if service.LastRefreshed == 0 {
+		service.setTTL(time.Now(), defaultRecordTTL)
+	}
+	service.FirstSeen = formatUnix(service.Timestamp)
+	service.LastSeen = formatUnix(service.LastRefreshed)
+
+	if service.Site == s.site {
+		// The interface is set by the source when it knows it, and
+		// otherwise found from the service's address
+		iface := ""
+		if len(service.Interfaces) > 0 {
+			iface = service.Interfaces[0].Name
+		}
+		if iface == "" {
+			iface = localNetworks.interfaceFor(service.IP)
 		}
+		if iface == "" {
+			s.mu.RLock()
+			iface = s.currentIface
+			s.mu.RUnlock()
+		}
+		service.Interfaces = seenOn(nil, iface, service.LastRefreshed)
+	}
+
+	// From here on the table owns the service
+	key = siteKey(service.Site, key)
+	var added bool
+	s.table.do(func() { added = s.table.add(key, service) })
+	return added
+}
+
+// removeService drops a service from the table and reports whether it was
+// known.
+func (s *MDNSServer) removeService(key string, service *MDNSService) bool {
+	if service.Site == "" {
+		service.Site = s.site
 	}
+
+	key = siteKey(service.Site, key)
+	var removed bool
+	s.table.do(func() { removed = s.table.remove(key) })
+	return removed
+}
+
+// changeService adds a service, or removes it with removed, and publishes
+// the change if there was one. Changes are published in the order they are
+// applied, so every sink sees the events of a service, and of its device,
+// in order.
+func (s *MDNSServer) changeService(key string, service *MDNSService, removed bool) bool {
+	s.order.Lock()
+	defer s.order.Unlock()
+
+	var changed bool
+	if removed {
+		changed = s.removeService(key, service)
+	} else {
+		changed = s.addService(key, service)
+	}
+	if changed {
+		s.bus.Publish(TopicService, &DiscoveryResponse{Service: *service, Removed: removed})
+	}
+	return changed
+}
+
+// listServices returns copies of the known services of a site (every site
+// when site is empty), ordered by site, type and name.
+func (s *MDNSServer) listServices(site string) []MDNSService {
+	services := s.table.view()
+	result := make([]MDNSService, 0, len(services))
+	for _, service := range services {
+		if inSite(service, site) {
+			result = append(result, *service)
+		}
+	}
+
+	sort.Slice(result, func(i, j int) bool {
+		a, b := result[i], result[j]
+		if a.Site != b.Site {
+			return a.Site < b.Site
+		}
+		if a.Type != b.Type {
+			return a.Type < b.Type
+		}
+		if a.Name != b.Name {
+			return a.Name < b.Name
+		}
+		return a.IP < b.IP
+	})
+	return result
+}
+
+// clearLocalServices forgets every service discovered by this instance,
+// leaving services reported by agents for other sites in place.
+func (s *MDNSServer) clearLocalServices() {
+	s.table.do(func() {
+		for key, service := range s.table.services {
+			if service.Site == s.site {
+				delete(s.table.services, key)
+			}
+		}
+		s.table.changed()
+	})
+}
+
+func (s *MDNSServer) registerClient(c *streamClient) {
+	s.mu.Lock()
+	s.clients[c] = true
+	n := len(s.clients)
+	s.mu.Unlock()
+	s.clientsChanged(n)
 }
 
-func (s *MDNSServer) registerClient(ch chan *DiscoveryResponse) {
+// subscribeClient registers a client and returns its backlog: the buffered
+// events after the one it resumes from, or else those of the last replay
+// period. gap is true when some events it resumes after have expired from
+// the buffer or are from before a restart. Both happen under the same lock
+// as fanOut, so no event is either missed or delivered twice: events the
+// inventory already reflects but the dispatcher hasn't fanned out yet are
+// left out of the client's queue.
+func (s *MDNSServer) subscribeClient(c *streamClient, replay time.Duration) (backlog []*DiscoveryResponse, gap bool) {
+	// Held so no change falls between the inventory and the events the
+	// client is registered for
+	s.order.Lock()
 	s.mu.Lock()
-	defer s.mu.Unlock()
-	s.clients[ch] = true
+	s.clients[c] = true
+	n := len(s.clients)
+	switch {
+	case c.after > max(s.bus.Latest(), s.replay.Latest()):
+		gap = true
+	case c.after > 0:
+		backlog, _, gap, _ = s.replay.After(c.after)
+	case replay > 0:
+		backlog = s.replay.Since(time.Now().Add(-replay))
+	}
+	if gap || c.after == 0 && replay == 0 {
+		backlog = s.inventory()
+		c.current = s.bus.Latest()
+	}
+	s.mu.Unlock()
+	s.order.Unlock()
+
+	s.clientsChanged(n)
+	return backlog, gap
+}
+
+// inventory returns the known services as events, each with the seq of the
+// latest event they reflect, so a new stream client starts from the
+// current state and resumes after it when it reconnects. It must be called
+// with s.order held.
+func (s *MDNSServer) inventory() []*DiscoveryResponse {
+	seq := s.bus.Latest()
+	services := s.listServices("")
+	events := make([]*DiscoveryResponse, len(services))
+	for i := range services {
+		events[i] = &DiscoveryResponse{Service: services[i], Seq: seq}
+	}
+	return events
 }
 
-func (s *MDNSServer) unregisterClient(ch chan *DiscoveryResponse) {
+func (s *MDNSServer) unregisterClient(c *streamClient) {
 	s.mu.Lock()
-	defer s.mu.Unlock()
-	delete(s.clients, ch)
+	delete(s.clients, c)
+	n := len(s.clients)
+	s.mu.Unlock()
+	s.clientsChanged(n)
+}
+
+// clientsChanged runs the onClients hook with the number of connected
+// clients.
+func (s *MDNSServer) clientsChanged(n int) {
+	if s.onClients != nil {
+		s.onClients(n)
+	}
+}
+
+// replayParam returns the ?replay= duration of a stream request, capped to
+// the replay window.
+func (s *MDNSServer) replayParam(r *http.Request) (time.Duration, error) {
+	v := r.URL.Query().Get("replay")
+	if v == "" {
+		return 0, nil
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil || d < 0 {
+		return 0, errors.New("invalid replay duration")
+	}
+	return min(d, s.replay.Window()), nil
+}
+
+// resumeParam returns the event a stream request resumes after: the
+// Last-Event-ID an EventSource sends when it reconnects, or ?after=, e.g.
+// the seq of a snapshot. It is 0 when the request doesn't resume.
+func resumeParam(r *http.Request) (uint64, error) {
+	v := r.Header.Get("Last-Event-ID")
+	if v == "" {
+		v = r.URL.Query().Get("after")
+	}
+	if v == "" {
+		return 0, nil
+	}
+	seq, err := strconv.ParseUint(v, 10, 64)
+	if err != nil {
+		return 0, errors.New("invalid event ID")
+	}
+	return seq, nil
+}
+
+// writeSSE writes a stream message carrying an event, with its sequence
+// number as the message ID when it has one.
+func writeSSE(w io.Writer, seq uint64, data []byte) {
+	if seq > 0 {
+		fmt.Fprintf(w, "id: %d\n", seq)
+	}
+	fmt.Fprintf(w, "data: %s\n\n", data)
 }
 
 func (s *MDNSServer) Discover(w http.ResponseWriter, r *http.Request) {
@@ -77,10 +463,40 @@ func (s *MDNSServer) Discover(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Connection", "keep-alive")
 	w.Header().Set("Access-Control-Allow-Origin", "*")
 
-	responseChan := make(chan *DiscoveryResponse, 100)
-	s.registerClient(responseChan)
-	defer s.unregisterClient(responseChan)
-	defer close(responseChan)
+	// Only stream events for the requested site (?site=*, for all sites)
+	site := s.siteParam(r)
+
+	// ?replay=5m first sends the events of the last five minutes
+	replay, err := s.replayParam(r)
+	if err != nil {
+		http.Error(w, `{"error":"invalid replay duration"}`, http.StatusBadRequest)
+		return
+	}
+
+	// ?filter=type=_ssh._tcp only streams the events of matching services
+	filter, err := filterParam(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	// Last-Event-ID or ?after=42 first sends the buffered events after
+	// event 42, instead of the replay
+	after, err := resumeParam(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	// ?compact=1, which newStreamClient reads from r, sends events with
+	// abbreviated field names and without empty fields, for clients on
+	// metered links
+	client := newStreamClient(r, s.clientBuffer)
+	client.site = site
+	client.filter = filter
+	client.after = after
+	backlog, gap := s.subscribeClient(client, replay)
+	defer s.unregisterClient(client)
 
 	flusher, ok := w.(http.Flusher)
 	if !ok {
@@ -91,229 +507,307 @@ func (s *MDNSServer) Discover(w http.ResponseWriter, r *http.Request) {
 	// Explicitly write status line and headers to the client
 	w.WriteHeader(http.StatusOK)
 	flusher.Flush()
+
+	if gap {
+		// The client can't resume without missing events, so it should
+		// start over from a snapshot
+		fmt.Fprintf(w, "event: gap\ndata: {\"after\":%d}\n\n", after)
+	}
+	for _, response := range backlog {
+		if s.delivers(client, &response.Service) {
+			data, _ := json.Marshal(response)
+			if client.compact {
+				data, _ = compactJSON(response)
+			}
+			writeSSE(w, response.Seq, data)
+			client.delivered.Add(1)
+		}
+	}
+	flusher.Flush()
 	
 	for {
 		select {
 		case <-r.Context().Done():
 			return
-		case response := <-responseChan:
-			if response != nil {
-				data, _ := json.Marshal(response)
-				fmt.Fprintf(w, "data: %s\n\n", string(data))
-				flusher.Flush()
-			}
+		case <-client.disconnect:
+			// Tell the client why before closing, so it can tell this
+			// apart from a server restart
+			data, _ := json.Marshal(map[string]interface{}{
+				"reason":  "slow client: event queue full for longer than " + s.slowClientTimeout.String(),
+				"dropped": client.dropped.Load(),
+			})
+			fmt.Fprintf(w, "event: disconnect\ndata: %s\n\n", data)
+			flusher.Flush()
+			return
+		case ev := <-client.ch:
+			writeSSE(w, ev.response.Seq, ev.encoded(client.compact))
+			flusher.Flush()
+			client.delivered.Add(1)
 		}
 	}
 }
 
-func startMDNSDiscovery(server *MDNSServer, iface string) {
+func startMDNSDiscovery(server *MDNSServer, iface string, reason string) {
 	server.mu.Lock()
 	server.currentIface = iface
 	server.mu.Unlock()
+	server.bus.Publish(TopicScan, ScanEvent{Interface: iface, Reason: reason})
+
+	// The workers are supervised, so a restart only starts the ones
+	// that aren't already running
 
 	// Start proper mDNS browser using hashicorp/mdns library
-	go browseMDNSServices(server, iface)
+	browseMDNSServices(server, iface)
+
+	// Also start mDNS listeners to capture multicast responses
+	server.workers.Go("listener", func() { listenMDNSMulticast(server, mdnsIPv4, server.listener) })
+	server.workers.Go("listener6", func() { listenMDNSMulticast(server, mdnsIPv6, server.listener6) })
+
+	// Services whose records run out without being refreshed are removed
+	server.workers.Go("expiry", server.runExpiry)
 
-	// Also start mDNS listener to capture multicast responses
-	go listenMDNSMulticast(server)
+	// Our own addresses change with DHCP leases, VPNs and interfaces
+	server.workers.Go("self", func() { server.self.Watch(server.markSelf) })
 
 	// And periodic queries to trigger responses
-	go func() {
-		serviceTypes := []string{
-			"_http._tcp.local.",
-			"_https._tcp.local.",
-			"_ssh._tcp.local.",
-			"_sftp._tcp.local.",
-			"_smb._tcp.local.",
-			"_afpovertcp._tcp.local.",
-			"_nfs._tcp.local.",
-			"_ldap._tcp.local.",
-		}
-
-		ticker := time.NewTicker(5 * time.Second)
-		defer ticker.Stop()
-
-		for range ticker.C {
-			for _, serviceType := range serviceTypes {
-				discoverService(server, serviceType)
-			}
+	server.workers.Go("query", func() { queryServiceTypesLoop(server) })
+}
+
+// queryServiceTypesLoop queries for the service types on the network and
+// every service type as often as the discovery intensity allows.
+func queryServiceTypesLoop(server *MDNSServer) {
+	for {
+		if !server.intensity.Wait(false) {
+			continue
 		}
-	}()
+		discoverServiceTypes(server)
+		for _, serviceType := range server.serviceTypes.List() {
+			discoverService(server, serviceType+".local.")
+		}
+	}
 }
 
 func browseMDNSServices(server *MDNSServer, iface string) {
-	// Service types to browse
-	serviceTypes := []string{
-		"_http._tcp",
-		"_https._tcp",
-		"_ssh._tcp",
-		"_sftp._tcp",
-		"_smb._tcp",
-		"_afpovertcp._tcp",
-		"_nfs._tcp",
-		"_ldap._tcp",
-		"_sip._tcp",
-		"_xmpp._tcp",
-		"_workstation._tcp",
-		"_device-info._tcp",
+	// Browse each service type; types added at runtime get a browser
+	// when they are added
+	for _, serviceType := range server.serviceTypes.List() {
+		server.workers.Go("browse "+serviceType, func() { browseServiceType(server, serviceType) })
 	}
+}
 
-	// Browse each service type
-	for _, serviceType := range serviceTypes {
-		go browseServiceType(server, serviceType)
+func browseServiceType(server *MDNSServer, serviceType string) {
+	// Browse periodically, as often as the discovery intensity allows,
+	// idling while the type is removed
+	for {
+		if server.intensity.Wait(true) && server.serviceTypes.Has(serviceType) {
+			lookupServiceType(server, serviceType)
+		}
 	}
 }
 
-func browseServiceType(server *MDNSServer, serviceType string) {
-	// Set up periodic browsing with a timeout
-	ticker := time.NewTicker(10 * time.Second)
-	defer ticker.Stop()
+// lookupServiceType browses a service type once with the mDNS browser.
+func lookupServiceType(server *MDNSServer, serviceType string) {
+	if !server.protocols.Enabled(protocolMDNSBrowse) {
+		return
+	}
 
-	for range ticker.C {
-		// Create an mDNS query with a timeout
-		entriesChan := make(chan *mdns.ServiceEntry, 4)
-		
-		go func() {
-			for entry := range entriesChan {
-				if entry == nil {
-					continue
-				}
+	// Create an mDNS query with a timeout
+	entriesChan := make(chan *mdns.ServiceEntry, 4)
+	
+	go func() {
+		for entry := range entriesChan {
+			if entry == nil {
+				continue
+			}
+			received := time.Now()
 
-				// Extract service info
-				serviceName := entry.Name
-				if serviceName == "" {
-					serviceName = entry.Host
-				}
+			// Extract service info; entry.Name is the full instance
+			// name, e.g. "Printer._http._tcp.local."
+			serviceName := strings.TrimSuffix(entry.Name, "."+serviceType+".local.")
+			if serviceName == "" {
+				serviceName = entry.Host
+			}
 
-				// Get IP address - use AddrV4 or AddrV6
-				var ip string
-				if entry.AddrV4 != nil {
-					ip = entry.AddrV4.String()
-				} else if entry.AddrV6 != nil {
-					ip = entry.AddrV6.String()
-				}
+			service := &MDNSService{
+				Name:          serviceName,
+				Type:          serviceType + ".local.",
+				Host:          entry.Host,
+				Port:          uint16(entry.Port),
+				Timestamp:     time.Now().Unix(),
+				RawRecordType: "PTR",
+				TXT:           parseTXT(entry.InfoFields),
+			}
+			var ip4, ip6 string
+			if entry.AddrV4 != nil {
+				ip4 = entry.AddrV4.String()
+			}
+			if entry.AddrV6 != nil {
+				ip6 = entry.AddrV6.String()
+			}
+			if !service.setAddresses(ip4, ip6) {
+				continue
+			}
+			ip := service.IP
+			if server.publishService(sourceBrowse, server.identity(service), service, received) {
+				log.Printf("Discovered service: %s (%s) at %s:%d", serviceName, serviceType, ip, entry.Port)
+			}
+		}
+	}()
 
-				if ip == "" {
-					continue
-				}
+	// Browser lookup with 3 second timeout
+	server.queried()
+	mdns.Lookup(serviceType, entriesChan)
+	close(entriesChan)
+}
 
-				// Create unique key
-				key := fmt.Sprintf("%s:%s:%d", ip, serviceType, entry.Port)
-
-				server.mu.Lock()
-				seen := server.seen[key]
-				server.mu.Unlock()
-
-				if !seen {
-					server.mu.Lock()
-					server.seen[key] = true
-					server.mu.Unlock()
-
-					// Broadcast the discovered service
-					service := &MDNSService{
-						Name:      serviceName,
-						Type:      "_" + serviceType + ".local.",
-						Host:      entry.Host,
-						IP:        ip,
-						Port:      uint16(entry.Port),
-						Timestamp: time.Now().Unix(),
-					}
-
-					server.broadcast(&DiscoveryResponse{
-						Service: *service,
-						Removed: false,
-					})
-
-					log.Printf("Discovered service: %s (%s) at %s:%d", serviceName, serviceType, ip, entry.Port)
+// handleMDNSPacket processes a packet received by the multicast listener on
+// the interface iface ("" if unknown), already unpacked into msg. It runs
+// for every packet on the segment, so it avoids allocating where it can;
+// BenchmarkHandleMDNSPacket measures it.
+func handleMDNSPacket(server *MDNSServer, msg *dns.Msg, iface string, from *net.UDPAddr, received time.Time) {
+	// Queries are the responder's; the answers they list are what the
+	// querier already knows, and following each of them up would mean a
+	// query of ours for every PTR of every query on the segment
+	if server.self.ownPacket(msg) || !msg.Response {
+		return
+	}
+	server.negative.observe(msg, received)
+	// The queries the packet leads to, for records it lacks
+	follow := newFollowUps(server.lookups, from)
+
+	// Responses usually carry the SRV and address records of the instances
+	// they announce in the additional section (RFC 6763 §12), so those are
+	// taken from the packet rather than asked for again
+	for _, section := range [][]dns.RR{msg.Answer, msg.Extra} {
+		for _, rr := range section {
+			if record, ok := rr.(*dns.SRV); ok {
+				if record.Hdr.Ttl == 0 {
+					server.goodbye(record.Hdr.Name)
+				} else if firstSRV(msg, record) {
+					handleSRV(server, msg, record.Hdr.Name, iface, &follow, received)
 				}
 			}
-		}()
+		}
+	}
 
-		// Browser lookup with 3 second timeout
-		mdns.Lookup(serviceType, entriesChan)
-		close(entriesChan)
+	// Process answers in the message
+	// Note: mDNS can include answers even for unsolicited responses
+	for _, ans := range msg.Answer {
+		// PTR record points to service instances
+		record, ok := ans.(*dns.PTR)
+		switch {
+		case !ok:
+		case strings.EqualFold(record.Hdr.Name, servicesMetaQuery):
+			// Points to a service type rather than an instance
+			server.discoverServiceType(record, received)
+		case record.Hdr.Ttl == 0:
+			server.goodbye(record.Ptr)
+		case !instanceOf(record.Ptr, record.Hdr.Name):
+			// Not followed to names other than instances of the type
+		case !hasSRV(msg, record.Ptr) && follow.allow(record.Ptr, received):
+			queryServiceDetails(server, record.Ptr, sourceMulticast, &follow, received)
+		}
 	}
 }
 
-func listenMDNSMulticast(server *MDNSServer) {
-	// Listen to mDNS multicast traffic on 224.0.0.251:5353
-	addr, err := net.ResolveUDPAddr("udp", "224.0.0.251:5353")
-	if err != nil {
-		log.Printf("Failed to resolve mDNS address: %v", err)
+// handleSRV publishes the service whose SRV records ("<instance>.<type>")
+// a packet announces, at the addresses their targets have in the same
+// packet or else resolve to, within the packet's follow-ups.
+func handleSRV(server *MDNSServer, msg *dns.Msg, instance string, iface string, follow *followUps, received time.Time) {
+	name, serviceType, ok := splitInstance(instance)
+	if !ok {
 		return
 	}
-
-	conn, err := net.ListenMulticastUDP("udp", nil, addr)
-	if err != nil {
-		log.Printf("Failed to listen on mDNS multicast: %v", err)
+	service := &MDNSService{
+		Name:          name,
+		Type:          serviceType,
+		Timestamp:     received.Unix(),
+		RawRecordType: "SRV",
+	}
+	targets, ttl := srvTargets(server, msg, instance, follow, received)
+	if !service.setTargets(targets) {
 		return
 	}
-	defer conn.Close()
+	if txt := packetTXT(msg, instance); txt != nil {
+		service.TXT = parseTXT(txt.Txt)
+	}
+	service.setTTL(received, time.Duration(ttl)*time.Second)
+	if iface != "" {
+		service.Interfaces = []ServiceInterface{{Name: iface}}
+	}
 
-	log.Printf("Listening to mDNS multicast traffic on 224.0.0.251:5353")
+	server.publishService(sourceMulticast, server.identity(service), service, received)
+}
 
-	buffer := make([]byte, 4096)
-	for {
-		n, _, err := conn.ReadFromUDP(buffer)
-		if err != nil {
-			log.Printf("Error reading from mDNS: %v", err)
-			continue
+// packetTXT returns the TXT record of an instance in a packet, if any.
+func packetTXT(msg *dns.Msg, instance string) *dns.TXT {
+	for _, section := range [][]dns.RR{msg.Answer, msg.Extra} {
+		for _, rr := range section {
+			if txt, ok := rr.(*dns.TXT); ok && strings.EqualFold(txt.Hdr.Name, instance) {
+				return txt
+			}
 		}
+	}
+	return nil
+}
 
-		// Parse DNS message
-		msg := new(dns.Msg)
-		err = msg.Unpack(buffer[:n])
-		if err != nil {
-			// Ignore invalid messages
+// parseTXT parses the strings of a TXT record into its key/value pairs, or
+// nil if there are none (RFC 6763 §6). Keys are case-insensitive and kept
+// in lower case; only the first of a repeated key counts. A key without
+// "=" is a boolean attribute that is present, and has the value "".
+func parseTXT(entries []string) map[string]string {
+	var txt map[string]string
+	for _, entry := range entries {
+		key, value, _ := strings.Cut(entry, "=")
+		if key == "" {
+			// Empty strings, and values without a key, are ignored
 			continue
 		}
+		key = strings.ToLower(key)
+		if _, ok := txt[key]; ok {
+			continue
+		}
+		if txt == nil {
+			txt = make(map[string]string, len(entries))
+		}
+		txt[key] = value
+	}
+	return txt
+}
 
-		// Process answers in the message
-		// Note: mDNS can include answers even for unsolicited responses
-		for _, ans := range msg.Answer {
-			switch record := ans.(type) {
-			case *dns.PTR:
-				// PTR record points to service instances
-				queryServiceDetails(server, record.Ptr, record.Hdr.Name)
-			case *dns.SRV:
-				// SRV record has hostname and port
-				// Extract service name from record name
-				parts := strings.Split(record.Hdr.Name, ".")
-				if len(parts) >= 2 {
-					serviceType := record.Hdr.Name
-					ip := resolveHostIP(strings.TrimSuffix(record.Target, "."))
-					if ip != "" {
-						name := parts[0]
-						key := fmt.Sprintf("%s:%s:%d", ip, serviceType, record.Port)
-						
-						server.mu.Lock()
-						seen := server.seen[key]
-						server.mu.Unlock()
-						
-						if !seen {
-							server.mu.Lock()
-							server.seen[key] = true
-							server.mu.Unlock()
-							
-							service := &MDNSService{
-								Name:      name,
-								Type:      serviceType,
-								Host:      strings.TrimSuffix(record.Target, "."),
-								IP:        ip,
-								Port:      record.Port,
-								Timestamp: time.Now().Unix(),
-							}
-							
-							server.broadcast(&DiscoveryResponse{
-								Service: *service,
-								Removed: false,
-							})
-						}
-					}
+// packetAddress returns the IPv4 and IPv6 addresses a packet gives a host
+// name, "" for those it doesn't.
+func packetAddress(msg *dns.Msg, host string) (ip4, ip6 string) {
+	var v6 net.IP
+	for _, section := range [][]dns.RR{msg.Answer, msg.Extra} {
+		for _, rr := range section {
+			switch rr := rr.(type) {
+			case *dns.A:
+				if ip4 == "" && strings.EqualFold(rr.Hdr.Name, host) {
+					ip4 = rr.A.String()
+				}
+			case *dns.AAAA:
+				if betterIPv6(v6, rr.AAAA) && strings.EqualFold(rr.Hdr.Name, host) {
+					v6 = rr.AAAA
 				}
 			}
 		}
 	}
+	if v6 != nil {
+		ip6 = v6.String()
+	}
+	return ip4, ip6
+}
+
+// betterIPv6 reports whether ip is a better IPv6 address for a host than
+// the one found so far, if any. Hosts usually have a link-local address
+// besides a routable one; the link-local one only works with the
+// interface it is on, so it is only used when there is no other.
+func betterIPv6(found, ip net.IP) bool {
+	if ip.To4() != nil || ip.To16() == nil {
+		return false
+	}
+	return found == nil || found.IsLinkLocalUnicast() && !ip.IsLinkLocalUnicast()
 }
 
 func discoverService(server *MDNSServer, serviceType string) {
@@ -322,9 +816,12 @@ func discoverService(server *MDNSServer, serviceType string) {
 	// on some networks. For a more robust approach, consider using a dedicated
 	// mDNS browser library.
 	
-	m := new(dns.Msg)
-	m.SetQuestion(serviceType, dns.TypePTR)
-	m.RecursionDesired = false
+	if !server.protocols.Enabled(protocolMDNSQuery) {
+		return
+	}
+	server.queried()
+
+	m := server.self.newQuery(serviceType, dns.TypePTR)
 
 	c := new(dns.Client)
 	c.Net = "udp"
@@ -342,19 +839,31 @@ func discoverService(server *MDNSServer, serviceType string) {
 	if in == nil {
 		return
 	}
+	received := time.Now()
 
+	// The sender of a reply isn't known, so only the reply's own limit
+	// applies
+	follow := newFollowUps(server.lookups, nil)
 	for _, ans := range in.Answer {
-		if ptr, ok := ans.(*dns.PTR); ok {
-			queryServiceDetails(server, ptr.Ptr, serviceType)
+		if ptr, ok := ans.(*dns.PTR); ok && instanceOf(ptr.Ptr, serviceType) && follow.allow(ptr.Ptr, received) {
+			queryServiceDetails(server, ptr.Ptr, sourceQuery, &follow, received)
 		}
 	}
 }
 
-func queryServiceDetails(server *MDNSServer, serviceName string, serviceType string) {
+// queryServiceDetails queries an instance ("<name>.<type>") for its SRV and
+// TXT records and publishes it, resolving its targets within follow.
+func queryServiceDetails(server *MDNSServer, serviceName string, source string, follow *followUps, firstPacket time.Time) {
+	name, serviceType, ok := splitInstance(serviceName)
+	if !ok {
+		return
+	}
+	if server.negative.Absent(serviceName, dns.TypeSRV, time.Now()) {
+		return
+	}
+
 	// Query for SRV record
-	srvMsg := new(dns.Msg)
-	srvMsg.SetQuestion(serviceName, dns.TypeSRV)
-	srvMsg.RecursionDesired = false
+	srvMsg := server.self.newQuery(serviceName, dns.TypeSRV)
 
 	c := new(dns.Client)
 	c.Net = "udp"
@@ -368,70 +877,52 @@ func queryServiceDetails(server *MDNSServer, serviceName string, serviceType str
 	if srvIn == nil {
 		return
 	}
+	server.negative.observe(srvIn, time.Now())
 
-	for _, srvAns := range srvIn.Answer {
-		if srv, ok := srvAns.(*dns.SRV); ok {
-			queryHostIP(server, srv.Target, serviceName, serviceType, srv.Port)
-		}
-	}
-}
-
-func queryHostIP(server *MDNSServer, host string, serviceName string, serviceType string, port uint16) {
-	// Clean up host name
-	hostname := strings.TrimSuffix(host, ".")
-
-	// Try to resolve via mDNS
-	ip := resolveHostIP(hostname)
-	if ip == "" {
-		return
-	}
-
-	// Extract service name
-	name := strings.Split(serviceName, ".")[0]
-
-	// Create unique key to avoid duplicates
-	key := fmt.Sprintf("%s:%s:%d", ip, serviceType, port)
-
-	server.mu.Lock()
-	if server.seen[key] {
-		server.mu.Unlock()
-		return
+	// Responders usually add the TXT record to the SRV answer
+	var txt map[string]string
+	if record := packetTXT(srvIn, serviceName); record != nil {
+		txt = parseTXT(record.Txt)
 	}
-	server.seen[key] = true
-	server.mu.Unlock()
+	received := time.Now()
+	targets, ttl := srvTargets(server, srvIn, serviceName, follow, received)
 
+	// Reached from the answer to a PTR query or announcement
 	service := &MDNSService{
-		Name:      name,
-		Type:      serviceType,
-		Host:      hostname,
-		IP:        ip,
-		Port:      port,
-		Timestamp: time.Now().Unix(),
+		Name:          name,
+		Type:          serviceType,
+		Timestamp:     received.Unix(),
+		RawRecordType: "PTR",
+		TXT:           txt,
 	}
-
-	response := &DiscoveryResponse{
-		Service: *service,
-		Removed: false,
+	if !service.setTargets(targets) {
+		return
 	}
+	service.setTTL(received, time.Duration(ttl)*time.Second)
 
-	server.broadcast(response)
+	server.publishService(source, server.identity(service), service, firstPacket)
 }
 
-func resolveHostIP(hostname string) string {
-	// Try A record first
-	m := new(dns.Msg)
-	m.SetQuestion(hostname+".", dns.TypeA)
-	m.RecursionDesired = false
-
+// resolveHostIP returns the IPv4 and IPv6 addresses of a host, "" for
+// those it has none of. Responders add the AAAA records to the answer to an
+// A query (RFC 6762 §6.2), so AAAA is only asked for separately when the A
+// query goes unanswered, as for IPv6-only hosts.
+func resolveHostIP(server *MDNSServer, hostname string) (ip4, ip6 string) {
 	c := new(dns.Client)
 	c.Net = "udp"
 	c.Timeout = 1 * time.Second
 
-	in, _, err := c.Exchange(m, "224.0.0.251:5353")
-	if err == nil && in != nil {
-		for _, ans := range in.Answer {
-			if a, ok := ans.(*dns.A); ok {
-				return a.A.String()
+	for _, qtype := range []uint16{dns.TypeA, dns.TypeAAAA} {
+		// Not asked for a type the host said it doesn't have
+		if server.negative.Absent(hostname, qtype, time.Now()) {
+			continue
+		}
+		m := server.self.newQuery(hostname+".", qtype)
+		in, _, err := c.Exchange(m, "224.0.0.251:5353")
+		if err == nil && in != nil {
+			server.negative.observe(in, time.Now())
+			if ip4, ip6 = packetAddress(in, hostname+"."); ip4 != "" || ip6 != "" {
+				return ip4, ip6
 			}
 		}
 	}
@@ -439,16 +930,23 @@ func resolveHostIP(hostname string) string {
 	// Fallback to regular DNS resolution
 	ips, err := net.LookupIP(hostname)
 	if err != nil {
-		return ""
+		return "", ""
 	}
 
+	var v6 net.IP
 	for _, ip := range ips {
 		if ip.To4() != nil {
-			return ip.String()
+			if ip4 == "" {
+				ip4 = ip.String()
+			}
+		} else if betterIPv6(v6, ip) {
+			v6 = ip
 		}
 	}
-
-	return ""
+	if v6 != nil {
+		ip6 = v6.String()
+	}
+	return ip4, ip6
 }
 
 func getNetworkInterfaces() ([]map[string]string, error) {
@@ -475,24 +973,399 @@ func restartMDNSDiscovery(server *MDNSServer) {
 	
 	// Clear the seen services to force re-discovery
 	server.mu.Lock()
-	server.seen = make(map[string]bool)
+	server.clearLocalServices()
 	currentIface := server.currentIface
 	server.mu.Unlock()
 	
 	// Restart discovery on current interface
-	startMDNSDiscovery(server, currentIface)
+	startMDNSDiscovery(server, currentIface, "restart")
 	
 	log.Printf("✅ mDNS discovery restarted")
 }
 
 func main() {
+	// "network-view check --device <id>" is a Nagios plugin asking a
+	// running server, not a server
+	if len(os.Args) > 1 && os.Args[1] == "check" {
+		os.Exit(runCheck(os.Args[2:], os.Stdout, os.Stderr))
+	}
+	if len(os.Args) > 1 && os.Args[1] == "restore" {
+		os.Exit(runRestore(os.Args[2:], os.Stdout, os.Stderr))
+	}
+	if len(os.Args) > 1 && os.Args[1] == "secrets" {
+		os.Exit(runSecrets(os.Args[2:], os.Stdin, os.Stdout, os.Stderr))
+	}
+	if len(os.Args) > 1 && os.Args[1] == "loadgen" {
+		os.Exit(runLoadgen(os.Args[2:], os.Stdout, os.Stderr))
+	}
+	// With --list or --host, it is an Ansible inventory script
+	if len(os.Args) > 1 && (os.Args[1] == "--list" || os.Args[1] == "--host") {
+		os.Exit(runAnsibleInventory(os.Args[1:], os.Stdout, os.Stderr))
+	}
+
 	port := flag.String("port", "9999", "Port to listen on")
 	bindAddr := flag.String("bind", "", "IP address to bind to (default: all interfaces)")
 	iface := flag.String("iface", "en5", "Network interface for mDNS discovery (default: en5)")
+	site := flag.String("site", defaultSite, "Name of the site (network) this instance discovers on")
+	dataDir := flag.String("data-dir", defaultDataDir(), "Directory for persisted state such as device notes")
+	storeKind := flag.String("store", "json", "Storage backend for persisted state: json or bolt")
+	migrateFrom := flag.String("migrate-from", "", "Copy all persisted state from this storage backend into -store, then exit")
+	encryptionKey := flag.String("encryption-key", "", "Encrypt the persisted state with the 32-byte key from env:NAME, file:PATH, keychain:SERVICE or secret:NAME")
+	backupDir := flag.String("backup-dir", "", "Directory to back the persisted state up to every -backup-interval (restored with the restore subcommand)")
+	backupS3 := flag.String("backup-s3", "", "S3-compatible bucket to back up to instead, as https://host/bucket/prefix (credentials from $AWS_ACCESS_KEY_ID and $AWS_SECRET_ACCESS_KEY, or the aws-access-key-id and aws-secret-access-key secrets)")
+	backupInterval := flag.Duration("backup-interval", 24*time.Hour, "How often backups are taken with -backup-dir or -backup-s3")
+	backupKeep := flag.Int("backup-keep", 7, "Number of backups to keep")
+	replayWindow := flag.Duration("replay-window", 15*time.Minute, "How long broadcast events are kept for /discover?replay= (0 disables replay)")
+	clientBuffer := flag.Int("client-buffer", 100, "Number of events queued per stream client before events are dropped")
+	slowClientTimeout := flag.Duration("slow-client-timeout", 0, "Disconnect stream clients whose queue stays full for this long (0 never disconnects)")
+	queryInterval := flag.Duration("query-interval", defaultIntensity.QueryInterval, "How often service types are queried while clients are connected")
+	browseInterval := flag.Duration("browse-interval", defaultIntensity.BrowseInterval, "How often service types are browsed while clients are connected")
+	idleAfter := flag.Duration("idle-after", defaultIntensity.IdleAfter, "Switch to idle discovery once no client has been connected for this long")
+	idleInterval := flag.Duration("idle-interval", defaultIntensity.IdleInterval, "Query and browse interval in idle mode (0 only listens passively)")
+	discoverTypes := flag.Bool("discover-service-types", true, "Browse the service types responders answer the DNS-SD meta-query with, besides -service-types")
+	serviceTypes := flag.String("service-types", "", "Comma-separated service types to browse and query, e.g. _http._tcp,_prometheus-http._tcp, or a file listing one per line (default: the built-in list)")
+	identity := flag.String("identity", "instance", "How services are deduplicated: "+identityNames())
+	memoryBudget := flag.String("memory-budget", "", "Estimated size the in-memory state may take, e.g. 512MB, beyond which flows and then the oldest events are evicted (default: no limit)")
+	retention := flag.String("retention", "availability=90d,audit=90d", "Comma-separated name=duration retention policies for persisted history (device records are never pruned)")
+	helperMode := flag.Bool("helper", false, "Run as the privileged helper on -helper-socket instead of the server (as root)")
+	helperSocket := flag.String("helper-socket", "", "Unix socket of the privileged helper (default "+defaultHelperSocket+" with -helper)")
+	helperGroup := flag.String("helper-group", "", "Group allowed to connect to the privileged helper (default: root only)")
+	runAs := flag.String("user", "", "Drop root privileges to this user at startup")
+	includeSelf := flag.Bool("include-self", false, "Include services on this host's own addresses in discovery results")
+	ignore := flag.String("ignore", "", `Filter expression of services to leave out of discovery results, e.g. 'type=_googlezone._tcp OR vendor~"Sonos"'`)
+	snmpCommunity := flag.String("snmp-community", "", "SNMP v2c community used to poll discovered devices (default: the snmp-community secret; none disables SNMP)")
+	snmpInterval := flag.Duration("snmp-interval", 15*time.Minute, "How often discovered devices are polled over SNMP")
+	speedTestURL := flag.String("speedtest-url", "https://speed.cloudflare.com", "Server that /api/speedtest tests against")
+	speedTestKind := flag.String("speedtest-kind", "cloudflare", "URL layout of -speedtest-url: cloudflare or librespeed")
+	geoip := flag.String("geoip", "", "Comma-separated MaxMind DB files (e.g. GeoLite2-ASN.mmdb,GeoLite2-Country.mmdb) to annotate external connections with")
+	blocklist := flag.String("blocklist", "", "Comma-separated blocklist files or URLs (hosts, domain, IP/CIDR or Adblock format) to match -capture flows against")
+	blocklistRefresh := flag.Duration("blocklist-refresh", 24*time.Hour, "How often -blocklist lists are reloaded")
+	internetInterval := flag.Duration("internet-interval", 5*time.Minute, "How often the discovery interface is checked for internet access and captive portals (0 only checks on /api/internet)")
+	raWatch := flag.Bool("ra-watch", false, "Monitor IPv6 router advertisements on -iface and alert on unexpected routers (needs root or CAP_NET_RAW; with -user, opened by the -helper-socket helper)")
+	raRouters := flag.String("ra-routers", "", "Comma-separated link-local addresses or MACs of the legitimate IPv6 routers (default: trust routers seen in the first 10 minutes)")
+	ntpServers := flag.String("ntp-servers", "", "Comma-separated time servers /api/time checks besides _ntp._udp advertisers and the gateway")
+	exposureCheckURL := flag.String("exposure-check-url", "", "External endpoint /api/exposure asks whether a port is reachable from the internet, with {ip}, {port} and {protocol} placeholders; it answers {\"open\": true|false}")
+	capture := flag.Bool("capture", false, "Capture packets on -iface to count per-device traffic (needs root or CAP_NET_RAW; read access to /dev/bpf* on macOS; with -user, opened by the -helper-socket helper)")
+	locale := flag.String("locale", fallbackLocale, "Locale diagnostic messages are rendered in, and that /api/messages serves when the client asks for none it has")
+	localeDir := flag.String("locale-dir", "", "Directory of <locale>.json message catalogs to serve besides the built-in English one")
+	oui := flag.String("oui", "", "Wireshark manuf file, or the IEEE registry's oui.txt or oui.csv, to name device vendors from their MAC addresses")
+	dashboardURL := flag.String("dashboard-url", "", "URL /api/qr encodes, e.g. behind a reverse proxy (default: this server's address on -iface)")
+	sessionTTL := flag.Duration("session-ttl", 12*time.Hour, "How long a web UI login lasts (with the login-password secret set)")
+	csp := flag.String("csp", defaultCSP, "Content-Security-Policy the frontend is served with (empty sends none)")
+	cspReportOnly := flag.Bool("csp-report-only", false, "Send -csp as Content-Security-Policy-Report-Only, to try a policy out without enforcing it")
+	frameAncestors := flag.String("frame-ancestors", "'none'", "CSP frame-ancestors of the frontend, e.g. 'self' or https://grafana.example.com (empty allows framing anywhere)")
+	debugInject := flag.Bool("debug-inject", false, "Enable POST /api/debug/inject, which pushes fabricated discovery events through the pipeline for integration tests (needs API authentication)")
+	scanAllow := flag.String("scan-allow", scopeLocal, "Comma-separated networks or addresses active probes (pings, answer checks, SNMP, time and gateway queries) may go to; local is the subnets of the local interfaces (empty allows any)")
+	scanExclude := flag.String("scan-exclude", "", "Comma-separated networks or addresses never probed, e.g. the gateway or a NAS under load")
+	adminAllow := flag.String("admin-allow", "", "Comma-separated networks or addresses (e.g. 127.0.0.1,::1,10.20.0.0/24) that alone may change state through the API (default: anyone)")
+	loginAttempts := flag.Int("login-attempts", 5, "Failed logins or API tokens after which a client is locked out (0 never locks out)")
+	lockout := flag.Duration("lockout", 15*time.Minute, "How long clients are locked out, and the window failed attempts are counted in")
+	reachabilityInterval := flag.Duration("reachability-interval", 0, "How often the advertised port of every local TCP service is checked for accepting connections (0 disables checking)")
+	expectationInterval := flag.Duration("expectation-interval", 30*time.Second, "How often the expectations declared on /api/expectations are checked (0 disables checking)")
 	flag.Parse()
 
+	if *helperMode {
+		socket := *helperSocket
+		if socket == "" {
+			socket = defaultHelperSocket
+		}
+		log.Fatalf("Privileged helper stopped: %v", runHelper(socket, *helperGroup))
+	}
+
+	if *runAs != "" {
+		if err := dropPrivileges(*runAs); err != nil {
+			log.Fatalf("Failed to drop privileges: %v", err)
+		}
+		log.Printf("Running as %s", *runAs)
+	} else if runningAsRoot() {
+		log.Printf("⚠️  Running as root; prefer -user, with -helper for privileged features")
+	}
+
+	identify, ok := identityFuncs[*identity]
+	if !ok {
+		log.Fatalf("Invalid -identity %q (expected one of %s)", *identity, identityNames())
+	}
+
+	policies, err := parseRetention(*retention)
+	if err != nil {
+		log.Fatalf("Invalid -retention: %v", err)
+	}
+	memoryLimit, err := parseMemorySize(*memoryBudget)
+	if err != nil {
+		log.Fatalf("Invalid -memory-budget: %v", err)
+	}
+
+	if *localeDir != "" {
+		if err := messages.LoadDir(*localeDir); err != nil {
+			log.Fatalf("Failed to load message catalogs: %v", err)
+		}
+	}
+	if err := messages.SetDefault(*locale); err != nil {
+		log.Fatalf("Invalid -locale: %v", err)
+	}
+
+	store, err := openStore(*storeKind, *dataDir)
+	if err != nil {
+		log.Fatalf("Failed to open %s store: %v", *storeKind, err)
+	}
+	defer store.Close()
+	if *encryptionKey != "" {
+		key, err := loadEncryptionKey(*encryptionKey)
+		if err == nil {
+			store, err = newEncryptedStore(store, key)
+		}
+		if err != nil {
+			log.Fatalf("Invalid -encryption-key: %v", err)
+		}
+	}
+
+	if *migrateFrom != "" {
+		src, err := openStore(*migrateFrom, *dataDir)
+		if err != nil {
+			log.Fatalf("Failed to open %s store: %v", *migrateFrom, err)
+		}
+		var n int
+		dst, err := migrationTarget(src, store)
+		if err == nil {
+			n, err = migrateStore(src, dst)
+		}
+		src.Close()
+		if err != nil {
+			log.Fatalf("Migration failed: %v", err)
+		}
+		log.Printf("✅ Migrated %d records from %s to %s", n, *migrateFrom, *storeKind)
+		return
+	}
+
+	metadata, err := NewMetadataStore(store)
+	if err != nil {
+		log.Fatalf("Failed to load device metadata: %v", err)
+	}
+
+	views, err := NewViewStore(store)
+	if err != nil {
+		log.Fatalf("Failed to load dashboard views: %v", err)
+	}
+
+	stableIDs, err := NewStableIDs(store)
+	if err != nil {
+		log.Fatalf("Failed to load stable device IDs: %v", err)
+	}
+
+	expected, err := NewExpectedStore(store)
+	if err != nil {
+		log.Fatalf("Failed to load the expected inventory: %v", err)
+	}
+
+	deviceLinks, err = NewDeviceLinks(store)
+	if err != nil {
+		log.Fatalf("Failed to load device merges and splits: %v", err)
+	}
+
+	maintenance, err := NewMaintenanceWindows(store)
+	if err != nil {
+		log.Fatalf("Failed to load maintenance windows: %v", err)
+	}
+
+	shares, err := NewShareStore(store)
+	if err != nil {
+		log.Fatalf("Failed to load share links: %v", err)
+	}
+
+	protocols, err := NewProtocols(store)
+	if err != nil {
+		log.Fatalf("Failed to load protocol settings: %v", err)
+	}
+	configuredTypes, err := parseServiceTypes(*serviceTypes)
+	if err != nil {
+		log.Fatalf("Invalid -service-types: %v", err)
+	}
+	browsedTypes, err := NewServiceTypes(configuredTypes, store)
+	if err != nil {
+		log.Fatalf("Failed to load service types: %v", err)
+	}
+
+	availability, err := NewAvailabilityTracker(store)
+	if err != nil {
+		log.Fatalf("Failed to load availability history: %v", err)
+	}
+
+	speedtest, err := NewSpeedTester(store, SpeedTestEndpoint{Kind: *speedTestKind, URL: *speedTestURL})
+	if err != nil {
+		log.Fatalf("Failed to set up speed tests: %v", err)
+	}
+
+	audit, err := NewAuditLog(store)
+	if err != nil {
+		log.Fatalf("Failed to load the audit log: %v", err)
+	}
+
 	server := NewMDNSServer()
-	startMDNSDiscovery(server, *iface)
+	server.workers.Go("availability", availability.Run)
+
+	vacuum := NewVacuum(policies)
+	vacuum.Register("devices", metadata)
+	vacuum.Register("availability", availability)
+	vacuum.Register("audit", audit)
+	server.workers.Go("vacuum", func() { vacuum.Run(time.Hour) })
+
+	server.site = *site
+	server.identity = identify
+	server.intensity = NewIntensity(IntensityConfig{
+		QueryInterval:  *queryInterval,
+		BrowseInterval: *browseInterval,
+		IdleAfter:      *idleAfter,
+		IdleInterval:   *idleInterval,
+	})
+	server.replay = NewReplayBuffer(*replayWindow)
+	server.clientBuffer = max(*clientBuffer, 1)
+	server.slowClientTimeout = *slowClientTimeout
+	server.metadata = metadata
+	server.views = views
+	server.stableIDs = stableIDs
+	server.expected = expected
+	server.maintenance = maintenance
+	server.expectations, err = NewExpectations(store, server.bus)
+	if err != nil {
+		log.Fatalf("Failed to load expectations: %v", err)
+	}
+	if *expectationInterval > 0 {
+		server.workers.Go("expectations", func() { server.expectations.Run(server, *expectationInterval) })
+	}
+	if *reachabilityInterval > 0 {
+		server.reachability = NewReachabilityChecker(*reachabilityInterval)
+		server.workers.Go("reachability", func() { server.reachability.Run(server) })
+	}
+	server.notifiers, err = NewNotifiers(store, server)
+	if err != nil {
+		log.Fatalf("Failed to load notifiers: %v", err)
+	}
+	server.workers.Go("notifiers", server.notifiers.Run)
+	server.shares = shares
+	server.audit = audit
+	server.protocols = protocols
+	server.serviceTypes = browsedTypes
+	server.discovered = NewDiscoveredTypes(*discoverTypes)
+	server.self = NewSelfFilter(*includeSelf)
+	if server.ignore, err = ParseFilter(*ignore); err != nil {
+		log.Fatalf("Invalid -ignore: %v", err)
+	}
+	if *helperSocket != "" {
+		server.helper = NewHelperClient(*helperSocket)
+		neighbors.read = server.helper.Neighbors
+	}
+	server.availability = availability
+	server.vacuum = vacuum
+	server.speedtest = speedtest
+	server.exposure.checkURL = *exposureCheckURL
+	server.dashboardBase = *dashboardURL
+	for _, ntpServer := range strings.Split(*ntpServers, ",") {
+		if ntpServer = strings.TrimSpace(ntpServer); ntpServer != "" {
+			server.ntpServers = append(server.ntpServers, ntpServer)
+		}
+	}
+	if scanScope, err = ParseScanScope(*scanAllow, *scanExclude); err != nil {
+		log.Fatalf("Invalid -scan-allow or -scan-exclude: %v", err)
+	}
+	server.store = store
+	server.storeKind = *storeKind
+	var target backupTarget
+	switch {
+	case *backupS3 != "":
+		if target, err = newS3Target(*backupS3); err != nil {
+			log.Fatalf("Invalid -backup-s3: %v", err)
+		}
+	case *backupDir != "":
+		target = dirTarget{dir: *backupDir}
+	}
+	if target != nil {
+		if *backupInterval <= 0 {
+			log.Fatalf("Invalid -backup-interval %s", *backupInterval)
+		}
+		server.backups = NewBackups(store, *site, target, *backupKeep)
+		server.workers.Go("backups", func() { server.backups.Run(*backupInterval) })
+		log.Printf("💾 Backing up to %s every %s, keeping %d", target, *backupInterval, *backupKeep)
+	}
+	server.graphql = newGraphQLSchema(server)
+	server.onClients = func(connected int) {
+		server.intensity.ClientsChanged(connected)
+		// The first dashboard after idle gets results right away
+		if connected == 1 {
+			go server.burstDiscovery()
+		}
+	}
+	if err := server.restoreServices(store); err != nil {
+		log.Fatalf("Failed to load service table: %v", err)
+	}
+	server.workers.Go("services", func() { server.persistServices(store) })
+	if *capture {
+		devices := newDeviceIndex(server)
+		server.traffic = NewTrafficAccounting(devices)
+		geo, err := NewGeoIP(*geoip)
+		if err != nil {
+			log.Fatalf("Failed to open GeoIP database: %v", err)
+		}
+		if *geoip != "" {
+			log.Printf("GeoIP databases: %s", strings.Join(geo.Databases(), ", "))
+		}
+		if *blocklist != "" {
+			server.blocklists = NewBlocklists(strings.Split(*blocklist, ","), server.bus)
+			server.workers.Go("blocklists", func() { server.blocklists.Run(*blocklistRefresh) })
+		}
+		server.flows = NewFlowTable(devices, geo, server.blocklists)
+		server.capture = NewCapture(server.traffic.Record, server.flows.Record)
+		server.capture.arp = server.arpwatch.ObserveARP
+		// A server that dropped its privileges can't open the capture
+		// itself, so the helper opens it and passes it over
+		if server.helper != nil {
+			server.capture.open = server.helper.OpenCapture
+		} else if *runAs != "" {
+			log.Printf("⚠️  -capture with -user needs -helper-socket to open the capture")
+		}
+		server.workers.Go("capture", func() { server.capture.Run(server) })
+	}
+	if *oui != "" {
+		server.vendors, err = LoadVendorDB(*oui)
+		if err != nil {
+			log.Fatalf("Failed to load -oui: %v", err)
+		}
+		log.Printf("Vendor database: %d OUI assignments", server.vendors.Len())
+	}
+	if community := optionalSecret("snmp-community", *snmpCommunity); community != "" {
+		server.snmp = NewSNMPPoller(community)
+		server.workers.Go("snmp", func() { server.snmp.Run(server, *snmpInterval) })
+	}
+	server.workers.Go("arpwatch", server.arpwatch.Run)
+
+	// Flows go first when the budget is exceeded, then the oldest events
+	server.memory = NewMemoryBudget(memoryLimit)
+	if server.flows != nil {
+		server.memory.Register("flows", server.flows)
+	}
+	server.memory.Register("history", server.history)
+	server.memory.Register("replay", server.replay)
+	server.memory.Register("latency", server.latency)
+	server.memory.Register("services", server)
+	server.workers.Go("memory", func() { server.memory.Run(10 * time.Second) })
+	if *raWatch {
+		server.ra = NewRAMonitor(server.bus, strings.Split(*raRouters, ","))
+		if server.helper != nil {
+			server.ra.open = server.helper.ListenICMPv6
+		} else if *runAs != "" {
+			log.Printf("⚠️  -ra-watch with -user needs -helper-socket to open its socket")
+		}
+		server.workers.Go("ra", func() { server.ra.Run(server) })
+	}
+	responder, err := NewResponder(store, server)
+	if err != nil {
+		log.Fatalf("Failed to load advertisements: %v", err)
+	}
+	server.responder = responder
+	server.responder.Start()
+	if *internetInterval > 0 {
+		server.workers.Go("internet", func() { server.internet.Run(server, *internetInterval) })
+	}
+	startMDNSDiscovery(server, *iface, "start")
 
 	mux := http.NewServeMux()
 
@@ -503,7 +1376,7 @@ func main() {
 	})
 
 	// API endpoint for getting available network interfaces
-	mux.HandleFunc("/api/interfaces", func(w http.ResponseWriter, r *http.Request) {
+	handleAPI(mux, "/api/interfaces", func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Content-Type", "application/json")
 		w.Header().Set("Access-Control-Allow-Origin", "*")
 		
@@ -527,7 +1400,7 @@ func main() {
 	})
 
 	// API endpoint for setting network interface
-	mux.HandleFunc("/api/interfaces/set", func(w http.ResponseWriter, r *http.Request) {
+	handleAPI(mux, "/api/interfaces/set", func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Content-Type", "application/json")
 		w.Header().Set("Access-Control-Allow-Origin", "*")
 
@@ -570,15 +1443,17 @@ func main() {
 
 		// Update current interface and restart discovery
 		server.mu.Lock()
+		previous := server.currentIface
 		server.currentIface = ifaceName
-		server.seen = make(map[string]bool) // Reset seen services
+		server.clearLocalServices() // Reset seen services
 		server.mu.Unlock()
+		server.bus.Publish(TopicInterface, InterfaceEvent{Interface: ifaceName, Previous: previous})
 
 		fmt.Fprintf(w, `{"status":"ok","interface":"%s"}`, ifaceName)
 	})
 
 	// API endpoint for restarting mDNS discovery
-	mux.HandleFunc("/api/restart", func(w http.ResponseWriter, r *http.Request) {
+	handleAPI(mux, "/api/restart", func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Content-Type", "application/json")
 		w.Header().Set("Access-Control-Allow-Origin", "*")
 
@@ -599,50 +1474,196 @@ func main() {
 		fmt.Fprintf(w, `{"status":"ok","message":"mDNS discovery restarted"}`)
 	})
 
+	// API endpoints for device metadata and availability
+	handleAPI(mux, "/api/services", server.Services)
+	handleAPI(mux, "/api/devices", server.Devices)
+	handleAPI(mux, "/api/devices/merge", server.DeviceMerge)
+	handleAPI(mux, "/api/devices/split", server.DeviceSplit)
+	handleAPI(mux, "/api/devices/{id}", server.Device)
+	handleAPI(mux, "/api/devices/{id}/availability", server.DeviceAvailability)
+	handleAPI(mux, "/api/devices/{id}/connections", server.DeviceConnections)
+	mux.HandleFunc(versionedPath("/api/lookup/{key}"), server.Lookup)
+
+	// Declared service expectations, checked continuously
+	handleAPI(mux, "/api/expectations", server.ExpectationsHandler)
+	handleAPI(mux, "/api/expectations/{id}", server.ExpectationItem)
+
+	// Maintenance windows suppressing device-down alerts
+	handleAPI(mux, "/api/maintenance", server.Maintenance)
+	handleAPI(mux, "/api/maintenance/{id}", server.MaintenanceItem)
+
+	// Webhook notifications, per event or as digests
+	handleAPI(mux, "/api/notifiers", server.NotifiersHandler)
+	handleAPI(mux, "/api/notifiers/{id}", server.NotifierItem)
+	handleAPI(mux, "/api/notifiers/{id}/digest", server.NotifierDigest)
+	handleAPI(mux, "/api/notifiers/{id}/dead-letters", server.NotifierDeadLetters)
+	handleAPI(mux, "/api/rules/test", server.RulesTest)
+
+	// Expected inventory, reconciled against discovered devices
+	handleAPI(mux, "/api/expected", server.Expected)
+	handleAPI(mux, "/api/expected/reconcile", server.Reconcile)
+
+	// Blocklist matching of captured flows
+	handleAPI(mux, "/api/blocklists", server.BlocklistStatus)
+	handleAPI(mux, "/api/blocklists/reload", server.BlocklistReload)
+
+	// IPv6 router advertisements and rogue routers
+	handleAPI(mux, "/api/ipv6/routers", server.RouterAdvertisements)
+
+	// ARP spoofing detection
+	handleAPI(mux, "/api/arpwatch", server.ARPWatchStatus)
+
+	// API endpoints for sites and agent reporting
+	handleAPI(mux, "/api/sites", server.Sites)
+	handleAPI(mux, "/api/sites/{site}/services", server.SiteServices)
+
+	// Spreadsheet-friendly exports with configurable columns
+	handleAPI(mux, "/api/export/services", server.ExportServices)
+	handleAPI(mux, "/api/export/devices", server.ExportDevices)
+
+	// JSON Schema documents for the API models
+	handleAPI(mux, "/api/schema", server.Schema)
+	handleAPI(mux, "/api/schema/{name}", server.Schema)
+
+	// GraphQL API over services, devices and events
+	handleAPI(mux, "/api/graphql", server.GraphQL)
+
+	// Long-polling fallback for clients that cannot use /discover
+	handleAPI(mux, "/api/events/poll", server.PollEvents)
+
+	// API endpoint for the server's operating state
+	handleAPI(mux, "/api/status", server.Status)
+	handleAPI(mux, "/api/protocols", server.ProtocolList)
+	handleAPI(mux, "/api/service-types", server.ServiceTypeList)
+	handleAPI(mux, "/api/service-types/discovered", server.DiscoveredServiceTypes)
+	handleAPI(mux, "/api/protocols/{name}", server.Protocol)
+
+	// SNMP enrichment of discovered devices
+	handleAPI(mux, "/api/snmp", server.SNMP)
+	handleAPI(mux, "/api/topology", server.Topology)
+
+	// Identification of the default gateway
+	handleAPI(mux, "/api/gateway", server.Gateway)
+
+	// Internet access and captive portal detection
+	handleAPI(mux, "/api/internet", server.Internet)
+
+	// Public exposure of discovered services
+	handleAPI(mux, "/api/exposure", server.Exposure)
+
+	// Services advertised over mDNS by this server
+	handleAPI(mux, "/api/advertise", server.Advertise)
+	handleAPI(mux, "/api/advertise/{id}", server.AdvertiseItem)
+
+	// Localizable labels and messages
+	handleAPI(mux, "/api/messages", server.Messages)
+
+	// Saved dashboard views, per profile
+	handleAPI(mux, "/api/views", server.Views)
+	handleAPI(mux, "/api/views/{name}", server.ViewItem)
+
+	// Read-only guest links with redacted data
+	handleAPI(mux, "/api/share", server.Shares)
+	handleAPI(mux, "/api/share/{id}", server.ShareItem)
+	handleAPI(mux, "/api/shared/{token}/devices", server.SharedDevices)
+	handleAPI(mux, "/api/shared/{token}/discover", server.SharedDiscover)
+
+	// Printable inventory, findings and changes
+	handleAPI(mux, "/api/report", server.ReportHandler)
+
+	// Inventory for other tools to import
+	handleAPI(mux, "/api/integrations/zabbix", server.Zabbix)
+	handleAPI(mux, "/api/integrations/ansible", server.Ansible)
+
+	// Dashboard home screen counts
+	handleAPI(mux, "/api/summary", server.Summary)
+
+	// QR code of the dashboard's LAN URL, for opening it on a phone
+	handleAPI(mux, "/api/qr", server.QR)
+
+	// Clock skew against the network's time servers
+	handleAPI(mux, "/api/time", server.Time)
+
+	// Internet speed test and its history
+	handleAPI(mux, "/api/speedtest", server.SpeedTest)
+
+	// Per-device traffic from packet capture
+	handleAPI(mux, "/api/traffic", server.Traffic)
+
+	// ICMP echo through the privileged helper
+	handleAPI(mux, "/api/ping/{ip}", server.Ping)
+
+	// Nagios-style presence and latency checks for existing monitoring
+	handleAPI(mux, "/api/check/{id}", server.Check)
+
+	// API endpoint for dropping cached discovery state
+	handleAPI(mux, "/api/cache/clear", server.ClearCache)
+
+	// Time-to-discovery metrics per discovery source
+	handleAPI(mux, "/api/metrics/discovery", server.DiscoveryMetrics)
+
+	// API endpoint for connected stream clients
+	handleAPI(mux, "/api/clients", server.Clients)
+
+	// API endpoint for persisted storage statistics
+	handleAPI(mux, "/api/storage", server.Storage)
+
+	// Scheduled backups of the persisted state
+	handleAPI(mux, "/api/backups", server.BackupsHandler)
+
+	// Login for the web UI (API clients use the api-token secret as a
+	// bearer token instead)
+	auth := NewAuth(optionalSecret("login-password", ""), optionalSecret("api-token", ""), *sessionTTL)
+	auth.attempts, auth.lockout, auth.audit = *loginAttempts, *lockout, server.audit
+	if auth.Enabled() {
+		log.Printf("API authentication enabled")
+	}
+	handleAPI(mux, "/api/login", auth.Login)
+	handleAPI(mux, "/api/logout", auth.Logout)
+	handleAPI(mux, "/api/session", auth.Session)
+	handleAPI(mux, "/api/audit", server.Audit)
+
+	// Fabricated events for integration tests, only for authenticated
+	// clients
+	if *debugInject && !auth.Enabled() {
+		log.Fatalf("-debug-inject needs API authentication: set the api-token or login-password secret")
+	}
+	server.debugInject = *debugInject
+	handleAPI(mux, "/api/debug/inject", server.DebugInject)
+
+	// Changes only from the -admin-allow networks, whatever the credentials
+	allowlist, err := ParseAdminAllowlist(*adminAllow)
+	if err != nil {
+		log.Fatalf("Invalid -admin-allow: %v", err)
+	}
+	if allowlist != nil {
+		allowlist.audit = server.audit
+	}
+	// WebSocket commands are checked like REST requests
+	server.auth, server.adminAllow = auth, allowlist
+
 	// API endpoint for discovery
-	mux.HandleFunc("/discover", server.Discover)
+	handleAPI(mux, "/discover", server.Discover)
+	handleAPI(mux, "/discover/ws", server.DiscoverWS)
 
 	// Serve frontend files with SPA support
 	distPath := filepath.Join("..", "frontend", "dist")
 	if info, err := os.Stat(distPath); err == nil && info.IsDir() {
-		// Create custom handler for SPA - serve index.html for root and missing files
-		mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
-			// API routes should be handled by their specific handlers
-			if strings.HasPrefix(r.URL.Path, "/api") || strings.HasPrefix(r.URL.Path, "/discover") || strings.HasPrefix(r.URL.Path, "/health") {
-				http.NotFound(w, r)
-				return
-			}
-			
-			// Try to serve the requested file
-			fullPath := filepath.Join(distPath, filepath.Clean(r.URL.Path))
-			
-			// Security: prevent directory traversal
-			if !strings.HasPrefix(fullPath, distPath) {
-				http.NotFound(w, r)
-				return
-			}
-			
-			// Check if file exists
-			if _, err := os.Stat(fullPath); err == nil {
-				// File exists, serve it
-				http.ServeFile(w, r, fullPath)
-			} else if r.URL.Path == "/" {
-				// Root path, serve index.html
-				http.ServeFile(w, r, filepath.Join(distPath, "index.html"))
-			} else {
-				// File doesn't exist, serve index.html (for SPA routing)
-				w.Header().Set("Content-Type", "text/html")
-				http.ServeFile(w, r, filepath.Join(distPath, "index.html"))
-			}
-		})
+		spa, err := NewSPA(distPath)
+		if err != nil {
+			log.Fatalf("Failed to serve the frontend: %v", err)
+		}
+		security := SecurityHeaders{Policy: *csp, ReportOnly: *cspReportOnly, FrameAncestors: *frameAncestors}
+		mux.Handle("/", security.Wrap(spa))
 		log.Printf("Serving frontend from %s", distPath)
 	}
 
 	corsHandler := func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 			w.Header().Set("Access-Control-Allow-Origin", "*")
-			w.Header().Set("Access-Control-Allow-Methods", "GET, POST, OPTIONS")
-			w.Header().Set("Access-Control-Allow-Headers", "Content-Type")
+			w.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, DELETE, OPTIONS")
+			w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization, "+csrfHeader)
+			w.Header().Set("Access-Control-Expose-Headers", "Deprecation, Sunset, Link")
 			if r.Method == http.MethodOptions {
 				w.WriteHeader(http.StatusOK)
 				return
@@ -658,8 +1679,41 @@ func main() {
 		listenAddr = ":" + *port
 	}
 
+	// The root context ends on SIGINT or SIGTERM, and with it the requests,
+	// so streams return instead of holding up the shutdown
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	httpServer := &http.Server{
+		Addr:        listenAddr,
+		Handler:     corsHandler(allowlist.Wrap(auth.Wrap(mux))),
+		BaseContext: func(net.Listener) context.Context { return ctx },
+	}
+	serverErr := make(chan error, 1)
+	go func() { serverErr <- httpServer.ListenAndServe() }()
+
 	log.Printf("Starting mDNS discovery server on %s", listenAddr)
-	if err := http.ListenAndServe(listenAddr, corsHandler(mux)); err != nil {
+	select {
+	case err := <-serverErr:
 		log.Fatalf("Server error: %v", err)
+	case <-ctx.Done():
+	}
+
+	log.Printf("Shutting down")
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := httpServer.Shutdown(shutdownCtx); err != nil {
+		log.Printf("Failed to close connections: %v", err)
+	}
+	// Withdraw the advertised services, so caches don't keep them for their
+	// TTL, and save what the workers would have saved on their next tick.
+	// The deferred store.Close then runs as main returns.
+	server.responder.Shutdown()
+	now := time.Now()
+	server.notifiers.FlushDigests(now)
+	if err := server.saveServices(store, now); err != nil {
+		log.Printf("Failed to save service table: %v", err)
+	}
+	if err := server.availability.save(); err != nil {
+		log.Printf("Failed to save availability history: %v", err)
 	}
 }
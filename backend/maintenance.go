@@ -0,0 +1,319 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// maintenanceBucket is the Store bucket maintenance windows are kept in.
+const maintenanceBucket = "maintenance"
+
+// maxRecurringDuration bounds recurring windows, which are checked against
+// the day they start and the day before.
+const maxRecurringDuration = 24 * time.Hour
+
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday, "mon": time.Monday, "tue": time.Tuesday, "wed": time.Wednesday,
+	"thu": time.Thursday, "fri": time.Friday, "sat": time.Saturday,
+}
+
+// Recurrence repeats a maintenance window at a time of day, on the given
+// days of the week or every day.
+type Recurrence struct {
+	Days     []string `json:"days,omitempty"` // "mon" to "sun"
+	Start    string   `json:"start"`          // "03:00"
+	Duration string   `json:"duration"`       // "30m"
+	// Timezone is the IANA zone Start is in, default the server's
+	Timezone string `json:"timezone,omitempty"`
+
+	location *time.Location
+	hour     int
+	minute   int
+	duration time.Duration
+}
+
+// MaintenanceWindow is a time during which alerts about devices going down
+// are suppressed: for one device or, without one, every device of the site.
+// It is one-off, from Start to End, or recurring.
+type MaintenanceWindow struct {
+	ID        string      `json:"id"`
+	Label     string      `json:"label,omitempty"`
+	Site      string      `json:"site"`
+	Device    string      `json:"device,omitempty"`
+	Start     int64       `json:"start,omitempty"`
+	End       int64       `json:"end,omitempty"`
+	Recurring *Recurrence `json:"recurring,omitempty"`
+	CreatedAt int64       `json:"createdAt"`
+}
+
+// parse validates a recurrence and resolves its fields.
+func (r *Recurrence) parse() error {
+	for i, day := range r.Days {
+		r.Days[i] = strings.ToLower(strings.TrimSpace(day))
+		if len(r.Days[i]) > 3 {
+			r.Days[i] = r.Days[i][:3]
+		}
+		if _, ok := weekdays[r.Days[i]]; !ok {
+			return fmt.Errorf("invalid day %q", day)
+		}
+	}
+	start, err := time.Parse("15:04", r.Start)
+	if err != nil {
+		return fmt.Errorf("invalid start %q (expected HH:MM)", r.Start)
+	}
+	r.hour, r.minute = start.Hour(), start.Minute()
+	r.duration, err = time.ParseDuration(r.Duration)
+	if err != nil || r.duration <= 0 || r.duration > maxRecurringDuration {
+		return fmt.Errorf("invalid duration %q (at most %s)", r.Duration, maxRecurringDuration)
+	}
+	r.location = time.Local
+	if r.Timezone != "" {
+		if r.location, err = time.LoadLocation(r.Timezone); err != nil {
+			return fmt.Errorf("invalid timezone %q", r.Timezone)
+		}
+	}
+	return nil
+}
+
+// occurrence returns the occurrence of the recurrence covering t, if any.
+func (r *Recurrence) occurrence(t time.Time) (time.Time, time.Time, bool) {
+	local := t.In(r.location)
+	for _, offset := range []int{0, -1} {
+		day := local.AddDate(0, 0, offset)
+		if len(r.Days) > 0 && !containsWeekday(r.Days, day.Weekday()) {
+			continue
+		}
+		start := time.Date(day.Year(), day.Month(), day.Day(), r.hour, r.minute, 0, 0, r.location)
+		if end := start.Add(r.duration); !t.Before(start) && t.Before(end) {
+			return start, end, true
+		}
+	}
+	return time.Time{}, time.Time{}, false
+}
+
+func containsWeekday(days []string, weekday time.Weekday) bool {
+	for _, day := range days {
+		if weekdays[day] == weekday {
+			return true
+		}
+	}
+	return false
+}
+
+func (w *MaintenanceWindow) validate() error {
+	w.Device = strings.TrimSuffix(strings.TrimSpace(w.Device), ".")
+	if w.Recurring != nil {
+		if w.Start != 0 || w.End != 0 {
+			return errors.New("a window is either one-off (start, end) or recurring")
+		}
+		return w.Recurring.parse()
+	}
+	if w.Start == 0 || w.End <= w.Start {
+		return errors.New("start and end are required, with end after start")
+	}
+	return nil
+}
+
+// active reports whether the window covers t.
+func (w *MaintenanceWindow) active(t time.Time) bool {
+	if w.Recurring != nil {
+		_, _, ok := w.Recurring.occurrence(t)
+		return ok
+	}
+	return t.Unix() >= w.Start && t.Unix() < w.End
+}
+
+// MaintenanceWindows keeps the maintenance windows in memory and writes
+// every change through to the persistent Store.
+type MaintenanceWindows struct {
+	mu      sync.RWMutex
+	store   Store
+	windows map[string]*MaintenanceWindow
+}
+
+// NewMaintenanceWindows loads the maintenance windows from store. One-off
+// windows that have ended are dropped.
+func NewMaintenanceWindows(store Store) (*MaintenanceWindows, error) {
+	m := &MaintenanceWindows{store: store, windows: make(map[string]*MaintenanceWindow)}
+	entries, err := store.Load(maintenanceBucket)
+	if err != nil {
+		return nil, err
+	}
+	var ended []string
+	now := time.Now().Unix()
+	for key, data := range entries {
+		window := &MaintenanceWindow{}
+		if err := json.Unmarshal(data, window); err == nil {
+			err = window.validate()
+		}
+		if err != nil {
+			return nil, fmt.Errorf("maintenance window %s: %v", key, err)
+		}
+		if window.Recurring == nil && window.End <= now {
+			ended = append(ended, key)
+			continue
+		}
+		m.windows[window.ID] = window
+	}
+	if len(ended) > 0 {
+		if err := store.Delete(maintenanceBucket, ended...); err != nil {
+			return nil, err
+		}
+	}
+	return m, nil
+}
+
+// Add validates and stores a new window.
+func (m *MaintenanceWindows) Add(window MaintenanceWindow) (*MaintenanceWindow, error) {
+	if err := window.validate(); err != nil {
+		return nil, err
+	}
+	raw := make([]byte, 6)
+	if _, err := rand.Read(raw); err != nil {
+		return nil, err
+	}
+	window.ID = hex.EncodeToString(raw)
+	window.CreatedAt = time.Now().Unix()
+	data, err := json.Marshal(window)
+	if err != nil {
+		return nil, err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if err := m.store.Put(maintenanceBucket, map[string][]byte{window.ID: data}); err != nil {
+		return nil, err
+	}
+	m.windows[window.ID] = &window
+	c := window
+	return &c, nil
+}
+
+// Remove deletes a window and reports whether there was one.
+func (m *MaintenanceWindows) Remove(id string) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.windows[id]; !ok {
+		return false, nil
+	}
+	if err := m.store.Delete(maintenanceBucket, id); err != nil {
+		return false, err
+	}
+	delete(m.windows, id)
+	return true, nil
+}
+
+// List returns the windows of site, every site when empty, that haven't
+// ended by now, the earliest created first.
+func (m *MaintenanceWindows) List(site string, now time.Time) []MaintenanceWindow {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	windows := make([]MaintenanceWindow, 0, len(m.windows))
+	for _, window := range m.windows {
+		if (site == "" || window.Site == site) && (window.Recurring != nil || window.End > now.Unix()) {
+			windows = append(windows, *window)
+		}
+	}
+	sort.Slice(windows, func(i, j int) bool {
+		if windows[i].CreatedAt != windows[j].CreatedAt {
+			return windows[i].CreatedAt < windows[j].CreatedAt
+		}
+		return windows[i].ID < windows[j].ID
+	})
+	return windows
+}
+
+// Active returns the window covering a device of site at t, or nil. It is
+// nil-safe, so without maintenance windows nothing is suppressed.
+func (m *MaintenanceWindows) Active(site, device string, t time.Time) *MaintenanceWindow {
+	if m == nil {
+		return nil
+	}
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	for _, window := range m.windows {
+		if window.Site == site && (window.Device == "" || strings.EqualFold(window.Device, device)) && window.active(t) {
+			c := *window
+			return &c
+		}
+	}
+	return nil
+}
+
+// MaintenanceReport is a window on /api/maintenance, with whether it is in
+// effect and, for recurring windows, the current occurrence.
+type MaintenanceReport struct {
+	MaintenanceWindow
+	Active bool  `json:"active"`
+	From   int64 `json:"from,omitempty"`
+	Until  int64 `json:"until,omitempty"`
+}
+
+func maintenanceReport(window MaintenanceWindow, now time.Time) MaintenanceReport {
+	report := MaintenanceReport{MaintenanceWindow: window, Active: window.active(now)}
+	if report.Active && window.Recurring != nil {
+		start, end, _ := window.Recurring.occurrence(now)
+		report.From, report.Until = start.Unix(), end.Unix()
+	}
+	return report
+}
+
+// Maintenance handles /api/maintenance: GET lists the maintenance windows
+// of ?site= and POST adds one, by default on this instance's site.
+func (s *MDNSServer) Maintenance(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		now := time.Now()
+		reports := []MaintenanceReport{}
+		for _, window := range s.maintenance.List(s.siteParam(r), now) {
+			reports = append(reports, maintenanceReport(window, now))
+		}
+		writeJSON(w, http.StatusOK, map[string]interface{}{"windows": reports})
+
+	case http.MethodPost:
+		var window MaintenanceWindow
+		if err := json.NewDecoder(r.Body).Decode(&window); err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		window.Site = s.scopeSite(window.Site)
+		if window.Site == "" {
+			window.Site = s.site
+		}
+		added, err := s.maintenance.Add(window)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		writeJSON(w, http.StatusCreated, maintenanceReport(*added, time.Now()))
+
+	default:
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+	}
+}
+
+// MaintenanceItem handles DELETE /api/maintenance/{id}.
+func (s *MDNSServer) MaintenanceItem(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodDelete {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	removed, err := s.maintenance.Remove(r.PathValue("id"))
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if !removed {
+		writeError(w, http.StatusNotFound, "no maintenance window "+r.PathValue("id"))
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestRecurringMaintenance verifies recurring windows on given days,
+// including ones running past midnight
+func TestRecurringMaintenance(t *testing.T) {
+	utc := &MaintenanceWindow{Site: defaultSite, Recurring: &Recurrence{Days: []string{"Monday", "wed"}, Start: "23:30", Duration: "1h", Timezone: "UTC"}}
+	if err := utc.validate(); err != nil {
+		t.Fatalf("Expected a valid window, got %v", err)
+	}
+	monday := time.Date(2026, time.October, 12, 0, 0, 0, 0, time.UTC)
+	for _, tt := range []struct {
+		at     time.Time
+		active bool
+	}{
+		{monday.Add(23*time.Hour + 29*time.Minute), false},
+		{monday.Add(23*time.Hour + 30*time.Minute), true},
+		{monday.Add(24*time.Hour + 29*time.Minute), true}, // Tuesday, continuing Monday's
+		{monday.Add(24*time.Hour + 30*time.Minute), false},
+		{monday.Add(47*time.Hour + 45*time.Minute), false}, // Tuesday night
+		{monday.Add(71*time.Hour + 45*time.Minute), true},  // Wednesday night
+	} {
+		if got := utc.active(tt.at); got != tt.active {
+			t.Fatalf("Expected active %v at %s, got %v", tt.active, tt.at, got)
+		}
+	}
+
+	for _, invalid := range []*MaintenanceWindow{
+		{Recurring: &Recurrence{Start: "3am", Duration: "1h"}},
+		{Recurring: &Recurrence{Start: "03:00", Duration: "25h"}},
+		{Recurring: &Recurrence{Start: "03:00", Duration: "1h", Days: []string{"someday"}}},
+		{Recurring: &Recurrence{Start: "03:00", Duration: "1h", Timezone: "Mars/Olympus"}},
+		{Recurring: &Recurrence{Start: "03:00", Duration: "1h"}, Start: 1, End: 2},
+		{Start: 2, End: 1},
+	} {
+		if err := invalid.validate(); err == nil {
+			t.Fatalf("Expected an error for %+v", invalid)
+		}
+	}
+}
+
+// TestMaintenanceSuppressesExpectations verifies device-down alerts are
+// held back during a window and reported if the failure outlasts it
+func TestMaintenanceSuppressesExpectations(t *testing.T) {
+	server := NewMDNSServer()
+	store := openTestStore(t, "json", t.TempDir())
+	server.maintenance, _ = NewMaintenanceWindows(store)
+	var anomalies []AnomalyEvent
+	server.bus.Subscribe("test", func(e BusEvent) { anomalies = append(anomalies, e.Payload.(AnomalyEvent)) }, TopicAnomaly)
+	expectations, _ := NewExpectations(store, server.bus)
+	expectation, _ := expectations.Add(Expectation{Site: defaultSite, Device: "router.local", ServiceType: "_http._tcp", GraceSeconds: 60})
+
+	start := time.Now().Add(time.Hour).Truncate(time.Second)
+	if _, err := server.maintenance.Add(MaintenanceWindow{Site: defaultSite, Device: "Router.local", Start: start.Unix(), End: start.Add(10 * time.Minute).Unix()}); err != nil {
+		t.Fatalf("Failed to add the window: %v", err)
+	}
+	if server.maintenance.Active(defaultSite, "nas.local", start) != nil || server.maintenance.Active("office", "router.local", start) != nil {
+		t.Fatalf("Expected the window to cover only the router")
+	}
+
+	for _, minutes := range []int{0, 2, 9} {
+		expectations.Evaluate(context.Background(), server, start.Add(time.Duration(minutes)*time.Minute))
+	}
+	if status := expectations.Get(expectation.ID, start.Add(9*time.Minute)).Status; len(anomalies) != 0 || status.State != expectationFailing || !status.Maintenance {
+		t.Fatalf("Expected no alerts during maintenance, got %+v, %+v", anomalies, status)
+	}
+	expectations.Evaluate(context.Background(), server, start.Add(11*time.Minute))
+	if len(anomalies) != 1 || anomalies[0].Params["downtime"] != "11m0s" {
+		t.Fatalf("Expected the outage reported after the window, got %+v", anomalies)
+	}
+}
+
+// TestMaintenanceHandlers verifies adding, listing and removing windows
+func TestMaintenanceHandlers(t *testing.T) {
+	server := NewMDNSServer()
+	store := openTestStore(t, "json", t.TempDir())
+	server.maintenance, _ = NewMaintenanceWindows(store)
+
+	post := func(body string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		server.Maintenance(rec, httptest.NewRequest(http.MethodPost, "/api/maintenance", strings.NewReader(body)))
+		return rec
+	}
+	rec := post(`{"label": "nightly router reboot", "recurring": {"start": "00:00", "duration": "24h"}}`)
+	var created MaintenanceReport
+	json.NewDecoder(rec.Body).Decode(&created)
+	if rec.Code != http.StatusCreated || created.ID == "" || created.Site != defaultSite || !created.Active || created.Until <= created.From {
+		t.Fatalf("Expected an active all-day window, got %d %+v", rec.Code, created)
+	}
+	if rec := post(`{"start": 100, "end": 50}`); rec.Code != http.StatusBadRequest {
+		t.Fatalf("Expected 400 for a window ending before it starts, got %d", rec.Code)
+	}
+	if rec := post(`{"start": 100, "end": 200}`); rec.Code != http.StatusCreated {
+		t.Fatalf("Expected a past window to be accepted, got %d", rec.Code)
+	}
+
+	reloaded, err := NewMaintenanceWindows(store)
+	if err != nil {
+		t.Fatalf("Failed to reload windows: %v", err)
+	}
+	if windows := reloaded.List("", time.Now()); len(windows) != 1 || windows[0].ID != created.ID {
+		t.Fatalf("Expected only the recurring window after a restart, got %+v", windows)
+	}
+	if reloaded.Active(defaultSite, "anything.local", time.Now()) == nil {
+		t.Fatalf("Expected the site-wide window to cover every device")
+	}
+
+	req := httptest.NewRequest(http.MethodDelete, "/api/maintenance/"+created.ID, nil)
+	req.SetPathValue("id", created.ID)
+	rec = httptest.NewRecorder()
+	server.MaintenanceItem(rec, req)
+	if rec.Code != http.StatusNoContent || server.maintenance.Active(defaultSite, "router.local", time.Now()) != nil {
+		t.Fatalf("Expected the window removed, got %d", rec.Code)
+	}
+}
@@ -430,3 +430,54 @@ func TestNetworkInterfaces(t *testing.T) {
 		t.Logf("\n⚠️  en5 is not available: %v", err)
 	}
 }
+
+// TestServiceRefresh verifies re-announcing a known service refreshes its
+// freshness without announcing it again
+func TestServiceRefresh(t *testing.T) {
+	server := NewMDNSServer()
+	start := time.Now().Add(-time.Minute)
+
+	first := &MDNSService{Name: "NAS", IP: "10.0.0.2", Port: 445}
+	first.setTTL(start, 4500*time.Second)
+	if !server.addService("10.0.0.2:_smb._tcp.local.:445", first) {
+		t.Fatalf("Expected the first announcement to be new")
+	}
+	if first.ExpiresAt != start.Unix()+4500 {
+		t.Fatalf("Expected expiresAt to follow the record TTL, got %d", first.ExpiresAt)
+	}
+
+	again := &MDNSService{Name: "NAS", IP: "10.0.0.2", Port: 445}
+	if server.addService("10.0.0.2:_smb._tcp.local.:445", again) {
+		t.Fatalf("Expected the re-announcement not to be new")
+	}
+
+	services := server.listServices(defaultSite)
+	if len(services) != 1 || services[0].LastRefreshed <= start.Unix() {
+		t.Fatalf("Expected the service to be refreshed, got %+v", services)
+	}
+	if services[0].ExpiresAt != services[0].LastRefreshed+int64(defaultRecordTTL/time.Second) {
+		t.Fatalf("Expected the default TTL for an announcement without one, got %+v", services[0])
+	}
+}
+
+// TestServiceRFC3339Times verifies services carry their first and last
+// sighting in RFC 3339 next to the Unix seconds
+func TestServiceRFC3339Times(t *testing.T) {
+	server := NewMDNSServer()
+	start := time.Now().Add(-time.Minute).Truncate(time.Second)
+
+	service := &MDNSService{Name: "NAS", IP: "10.0.0.2", Port: 445, Timestamp: start.Unix()}
+	service.setTTL(start, 4500*time.Second)
+	server.addService("10.0.0.2:_smb._tcp.local.:445", service)
+	server.addService("10.0.0.2:_smb._tcp.local.:445", &MDNSService{Name: "NAS", IP: "10.0.0.2", Port: 445, Timestamp: time.Now().Unix()})
+
+	got := server.listServices(defaultSite)[0]
+	firstSeen, err := time.Parse(time.RFC3339, got.FirstSeen)
+	if err != nil || !firstSeen.Equal(start) {
+		t.Fatalf("Expected firstSeen %s, got %q", start.Format(time.RFC3339), got.FirstSeen)
+	}
+	lastSeen, err := time.Parse(time.RFC3339, got.LastSeen)
+	if err != nil || lastSeen.Unix() != got.LastRefreshed || got.LastRefreshed <= start.Unix() {
+		t.Fatalf("Expected lastSeen to follow the refresh at %d, got %q", got.LastRefreshed, got.LastSeen)
+	}
+}
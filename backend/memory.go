@@ -0,0 +1,358 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// memoryUser is in-memory state whose size is reported on /api/storage and
+// counts against the memory budget.
+type memoryUser interface {
+	// MemoryUsage estimates the entries held and the bytes they take.
+	MemoryUsage() (entries int, bytes int64)
+}
+
+// memoryEvicter is in-memory state the budget may shrink.
+type memoryEvicter interface {
+	memoryUser
+	// Evict drops entries, the least recent first, until about bytes are
+	// freed or nothing is left, and returns the entries and bytes dropped.
+	Evict(bytes int64) (entries int, freed int64)
+}
+
+// Estimated sizes of in-memory entries, besides the strings they hold.
+// They only need to be about right: they decide what is evicted when, not
+// what the process actually takes, which /api/storage reports alongside.
+const (
+	serviceOverhead = 256
+	flowOverhead    = 200
+	eventOverhead   = 64
+	anomalyOverhead = 256
+	sampleSize      = 8
+)
+
+func serviceBytes(s *MDNSService) int64 {
+	bytes := serviceOverhead + int64(len(s.Name)+len(s.Type)+len(s.Host)+len(s.IP)+len(s.IP6)+len(s.Site)+len(s.FirstSeen)+len(s.LastSeen)+len(s.Source)+len(s.RawRecordType)+32*len(s.Interfaces))
+	for key, value := range s.TXT {
+		bytes += int64(32 + len(key) + len(value))
+	}
+	for _, target := range s.Targets {
+		bytes += int64(64 + len(target.Host) + len(target.IP) + len(target.IP6))
+	}
+	return bytes
+}
+
+// MemoryBudget bounds the estimated size of the in-memory state. Over its
+// limit, it evicts from the subsystems in the order they were registered,
+// flows first and then the oldest events, until the state fits again.
+// Subsystems that can't be evicted, such as the service table, are only
+// reported.
+type MemoryBudget struct {
+	limit int64 // 0 only reports
+
+	mu           sync.Mutex
+	subsystems   []*memorySubsystem // in eviction order
+	lastEviction time.Time
+}
+
+type memorySubsystem struct {
+	name    string
+	user    memoryUser
+	evicted int
+}
+
+// NewMemoryBudget creates a budget of limit bytes, or without a limit for 0.
+func NewMemoryBudget(limit int64) *MemoryBudget {
+	return &MemoryBudget{limit: limit}
+}
+
+// Register adds in-memory state under name. State that also implements
+// memoryEvicter is evicted after the state registered before it.
+func (b *MemoryBudget) Register(name string, user memoryUser) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.subsystems = append(b.subsystems, &memorySubsystem{name: name, user: user})
+}
+
+// Run enforces the budget every interval. It never returns.
+func (b *MemoryBudget) Run(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for now := range ticker.C {
+		b.Enforce(now)
+	}
+}
+
+// Enforce evicts until the state fits the budget, and returns the bytes
+// freed.
+func (b *MemoryBudget) Enforce(now time.Time) int64 {
+	if b == nil || b.limit <= 0 {
+		return 0
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	var used int64
+	for _, sub := range b.subsystems {
+		_, bytes := sub.user.MemoryUsage()
+		used += bytes
+	}
+	excess := used - b.limit
+	if excess <= 0 {
+		return 0
+	}
+	var freed int64
+	for _, sub := range b.subsystems {
+		e, ok := sub.user.(memoryEvicter)
+		if !ok || freed >= excess {
+			continue
+		}
+		n, f := e.Evict(excess - freed)
+		if n > 0 {
+			sub.evicted += n
+			freed += f
+			log.Printf("🧹 Memory budget of %s exceeded: evicted %d %s entries (%s)", formatMemorySize(b.limit), n, sub.name, formatMemorySize(f))
+		}
+	}
+	b.lastEviction = now
+	return freed
+}
+
+// MemorySubsystemStats is one subsystem on /api/storage.
+type MemorySubsystemStats struct {
+	Name      string `json:"name"`
+	Entries   int    `json:"entries"`
+	Bytes     int64  `json:"bytes"` // estimated
+	Evictable bool   `json:"evictable"`
+	Evicted   int    `json:"evicted"`
+}
+
+// MemoryStats is the memory section of /api/storage.
+type MemoryStats struct {
+	Budget       int64                  `json:"budget"` // 0 without a limit
+	Used         int64                  `json:"used"`   // estimated, the sum of the subsystems
+	HeapBytes    uint64                 `json:"heapBytes"`
+	Subsystems   []MemorySubsystemStats `json:"subsystems"` // in eviction order
+	LastEviction int64                  `json:"lastEviction,omitempty"`
+}
+
+// Stats reports the estimated usage of every subsystem and the heap the
+// process actually has in use.
+func (b *MemoryBudget) Stats() MemoryStats {
+	var m runtime.MemStats
+	runtime.ReadMemStats(&m)
+	stats := MemoryStats{HeapBytes: m.HeapAlloc, Subsystems: []MemorySubsystemStats{}}
+	if b == nil {
+		return stats
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	stats.Budget = b.limit
+	for _, sub := range b.subsystems {
+		entries, bytes := sub.user.MemoryUsage()
+		_, evictable := sub.user.(memoryEvicter)
+		stats.Used += bytes
+		stats.Subsystems = append(stats.Subsystems, MemorySubsystemStats{
+			Name: sub.name, Entries: entries, Bytes: bytes, Evictable: evictable, Evicted: sub.evicted,
+		})
+	}
+	if !b.lastEviction.IsZero() {
+		stats.LastEviction = b.lastEviction.Unix()
+	}
+	return stats
+}
+
+// memoryUnits are the suffixes parseMemorySize accepts, powers of 1024.
+var memoryUnits = []struct {
+	suffix string
+	size   int64
+}{{"GB", 1 << 30}, {"MB", 1 << 20}, {"KB", 1 << 10}, {"B", 1}}
+
+// parseMemorySize parses a size such as "512MB" or "2GB"; "" and "0" are
+// no limit.
+func parseMemorySize(spec string) (int64, error) {
+	spec = strings.ToUpper(strings.TrimSpace(spec))
+	if spec == "" || spec == "0" {
+		return 0, nil
+	}
+	for _, unit := range memoryUnits {
+		if number, ok := strings.CutSuffix(spec, unit.suffix); ok {
+			n, err := strconv.ParseInt(strings.TrimSpace(number), 10, 64)
+			if err != nil || n < 0 {
+				return 0, fmt.Errorf("invalid size %q", spec)
+			}
+			return n * unit.size, nil
+		}
+	}
+	return 0, fmt.Errorf("invalid size %q (use e.g. 512MB or 2GB)", spec)
+}
+
+func formatMemorySize(n int64) string {
+	for _, unit := range memoryUnits {
+		if n >= unit.size && n%unit.size == 0 || unit.size == 1 {
+			return fmt.Sprintf("%d%s", n/unit.size, unit.suffix)
+		}
+	}
+	return ""
+}
+
+// MemoryUsage of the service table, which is never evicted: services that
+// are gone expire on their own.
+func (s *MDNSServer) MemoryUsage() (int, int64) {
+	services := s.table.view()
+	var bytes int64
+	for _, service := range services {
+		bytes += serviceBytes(service)
+	}
+	return len(services), bytes
+}
+
+func flowBytes(f *Flow) int64 {
+	bytes := int64(flowOverhead + 2*len(f.Remote) + len(f.RemoteName))
+	if f.Geo != nil {
+		bytes += 64
+	}
+	return bytes
+}
+
+// MemoryUsage of the flows of every device.
+func (t *FlowTable) MemoryUsage() (int, int64) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	entries, bytes := 0, int64(0)
+	for _, flows := range t.flows {
+		for _, flow := range flows {
+			entries++
+			bytes += flowBytes(flow)
+		}
+	}
+	return entries, bytes
+}
+
+// Evict drops the flows that have been idle the longest.
+func (t *FlowTable) Evict(bytes int64) (int, int64) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	type idle struct {
+		device string
+		key    flowKey
+		flow   *Flow
+	}
+	var all []idle
+	for device, flows := range t.flows {
+		for key, flow := range flows {
+			all = append(all, idle{device, key, flow})
+		}
+	}
+	sort.Slice(all, func(i, j int) bool { return all[i].flow.LastSeen < all[j].flow.LastSeen })
+	n, freed := 0, int64(0)
+	for _, f := range all {
+		if freed >= bytes {
+			break
+		}
+		delete(t.flows[f.device], f.key)
+		if len(t.flows[f.device]) == 0 {
+			delete(t.flows, f.device)
+		}
+		n++
+		freed += flowBytes(f.flow)
+	}
+	return n, freed
+}
+
+func historyBytes(entry HistoryEntry) int64 {
+	bytes := int64(eventOverhead)
+	if entry.Change != nil {
+		bytes += serviceBytes(&entry.Change.Service)
+	}
+	if a := entry.Anomaly; a != nil {
+		bytes += anomalyOverhead + int64(len(a.Message)+len(a.Device))
+		for k, v := range a.Params {
+			bytes += int64(len(k) + len(v))
+		}
+	}
+	return bytes
+}
+
+// MemoryUsage of the recorded events.
+func (h *EventHistory) MemoryUsage() (int, int64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	var bytes int64
+	for _, entry := range h.entries {
+		bytes += historyBytes(entry)
+	}
+	return len(h.entries), bytes
+}
+
+// Evict drops the oldest events.
+func (h *EventHistory) Evict(bytes int64) (int, int64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	n, freed := 0, int64(0)
+	for n < len(h.entries) && freed < bytes {
+		freed += historyBytes(h.entries[n])
+		n++
+	}
+	h.entries = append(h.entries[:0:0], h.entries[n:]...)
+	return n, freed
+}
+
+// MemoryUsage of the events kept for replay.
+func (b *ReplayBuffer) MemoryUsage() (int, int64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	var bytes int64
+	for _, rec := range b.events {
+		bytes += eventOverhead + serviceBytes(&rec.event.Service)
+	}
+	return len(b.events), bytes
+}
+
+// Evict drops the oldest events; clients resuming from before them are
+// told of the gap as when events expire.
+func (b *ReplayBuffer) Evict(bytes int64) (int, int64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	n, freed := 0, int64(0)
+	for n < len(b.events) && freed < bytes {
+		freed += eventOverhead + serviceBytes(&b.events[n].event.Service)
+		n++
+	}
+	if n > 0 {
+		b.expired = b.events[n-1].seq
+	}
+	b.events = append(b.events[:0], b.events[n:]...)
+	return n, freed
+}
+
+// MemoryUsage of the latency samples kept for percentiles.
+func (l *DiscoveryLatency) MemoryUsage() (int, int64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	samples := 0
+	for _, h := range l.sources {
+		samples += len(h.samples)
+	}
+	return samples, int64(samples) * sampleSize
+}
+
+// Evict drops the samples; the histograms and counts are kept, and the
+// percentiles start over from new observations.
+func (l *DiscoveryLatency) Evict(int64) (int, int64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	samples := 0
+	for _, h := range l.sources {
+		samples += len(h.samples)
+		h.samples, h.next = nil, 0
+	}
+	return samples, int64(samples) * sampleSize
+}
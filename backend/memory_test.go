@@ -0,0 +1,88 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+// TestParseMemorySize verifies budgets are given in binary units
+func TestParseMemorySize(t *testing.T) {
+	for spec, want := range map[string]int64{"": 0, "0": 0, "512MB": 512 << 20, "2gb": 2 << 30, "64 KB": 64 << 10, "100B": 100} {
+		if got, err := parseMemorySize(spec); err != nil || got != want {
+			t.Fatalf("Expected %q to be %d, got %d (%v)", spec, want, got, err)
+		}
+	}
+	for _, spec := range []string{"lots", "-1MB", "1.5GB", "12"} {
+		if _, err := parseMemorySize(spec); err == nil {
+			t.Fatalf("Expected %q to be rejected", spec)
+		}
+	}
+	if got := formatMemorySize(512 << 20); got != "512MB" {
+		t.Fatalf("Expected 512MB, got %s", got)
+	}
+}
+
+// TestMemoryBudgetEvictsFlowsFirst verifies an exceeded budget takes the
+// idlest flows before any event, and never the service table
+func TestMemoryBudgetEvictsFlowsFirst(t *testing.T) {
+	server := NewMDNSServer()
+	flows := NewFlowTable(newDeviceIndex(server), nil, nil)
+	flows.flows["nas.local"] = map[flowKey]*Flow{}
+	for i := 0; i < 10; i++ {
+		remote := fmt.Sprintf("203.0.113.%d", i)
+		flows.flows["nas.local"][flowKey{protocol: protoTCP, remote: remote, port: 443}] = &Flow{Remote: remote, LastSeen: int64(1000 + i)}
+	}
+	now := time.Now()
+	for i := 0; i < 10; i++ {
+		server.history.record(BusEvent{Time: now, Payload: &DiscoveryResponse{Service: MDNSService{Name: fmt.Sprintf("svc-%d", i), IP: "10.0.0.1"}}})
+	}
+	server.addService("nas", &MDNSService{Name: "nas", Type: "_smb._tcp.local.", IP: "10.0.0.20"})
+
+	budget := NewMemoryBudget(0)
+	budget.Register("flows", flows)
+	budget.Register("history", server.history)
+	budget.Register("services", server)
+	used := budget.Stats().Used
+	_, flowBytes := flows.MemoryUsage()
+
+	budget.limit = used - flowBytes/2
+	budget.Enforce(now)
+	stats := budget.Stats()
+	if stats.Subsystems[0].Evicted == 0 || stats.Subsystems[1].Evicted != 0 || stats.Used > budget.limit {
+		t.Fatalf("Expected only flows to be evicted, got %+v", stats)
+	}
+	for _, flow := range flows.flows["nas.local"] {
+		if flow.LastSeen < int64(1000+stats.Subsystems[0].Evicted) {
+			t.Fatalf("Expected the idlest flows to go first, %s is left", flow.Remote)
+		}
+	}
+
+	budget.limit = 1
+	budget.Enforce(now)
+	stats = budget.Stats()
+	if stats.Subsystems[0].Entries != 0 || stats.Subsystems[1].Entries != 0 || stats.Subsystems[2].Entries != 1 || stats.Subsystems[2].Evictable {
+		t.Fatalf("Expected flows and events to be evicted and the services kept, got %+v", stats)
+	}
+	if stats.LastEviction != now.Unix() {
+		t.Fatalf("Expected the eviction time, got %d", stats.LastEviction)
+	}
+}
+
+// TestMemoryBudgetWithoutLimit verifies a budget without a limit only reports
+func TestMemoryBudgetWithoutLimit(t *testing.T) {
+	server := NewMDNSServer()
+	server.latency.Observe(sourceMulticast, time.Millisecond)
+	budget := NewMemoryBudget(0)
+	budget.Register("latency", server.latency)
+	if freed := budget.Enforce(time.Now()); freed != 0 {
+		t.Fatalf("Expected nothing evicted without a limit, got %d bytes", freed)
+	}
+	if stats := budget.Stats(); stats.Used != sampleSize || stats.Subsystems[0].Entries != 1 || stats.HeapBytes == 0 {
+		t.Fatalf("Expected one latency sample reported, got %+v", stats)
+	}
+	var unset *MemoryBudget
+	if stats := unset.Stats(); stats.Subsystems == nil {
+		t.Fatalf("Expected an empty report without a budget")
+	}
+}
@@ -0,0 +1,326 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// deviceLinksBucket is the Store bucket manual merges and splits are kept
+// in.
+const deviceLinksBucket = "devicelinks"
+
+// DeviceLink is a manual decision about the device services belong to,
+// overriding the grouping by host name. A merge files every service of
+// Device under Into; a split files only those of Device at Address.
+type DeviceLink struct {
+	Site      string `json:"site"`
+	Device    string `json:"device"`
+	Address   string `json:"address,omitempty"`
+	Into      string `json:"into"`
+	CreatedAt int64  `json:"createdAt"`
+}
+
+func (l DeviceLink) key() string {
+	key := siteKey(l.Site, l.Device)
+	if l.Address != "" {
+		key += "@" + l.Address
+	}
+	return key
+}
+
+// DeviceLinks are the manual merges and splits of devices.
+type DeviceLinks struct {
+	mu    sync.RWMutex
+	store Store
+	links map[string]DeviceLink
+}
+
+// deviceLinks are consulted by deviceID, so every view of the devices
+// respects them. Nil until loaded, which leaves the grouping alone.
+var deviceLinks *DeviceLinks
+
+// NewDeviceLinks loads the merges and splits from store.
+func NewDeviceLinks(store Store) (*DeviceLinks, error) {
+	d := &DeviceLinks{store: store, links: make(map[string]DeviceLink)}
+	entries, err := store.Load(deviceLinksBucket)
+	if err != nil {
+		return nil, err
+	}
+	for key, data := range entries {
+		var link DeviceLink
+		if err := json.Unmarshal(data, &link); err != nil {
+			return nil, fmt.Errorf("device link %s: %v", key, err)
+		}
+		d.links[link.key()] = link
+	}
+	return d, nil
+}
+
+// resolve returns the device the services discovered as device id at
+// address belong to: split off by address first, then merged.
+func (d *DeviceLinks) resolve(site, id, address string) string {
+	if d == nil {
+		return id
+	}
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	if link, ok := d.links[siteKey(site, id)+"@"+address]; ok && address != "" {
+		id = link.Into
+	}
+	if link, ok := d.links[siteKey(site, id)]; ok {
+		id = link.Into
+	}
+	return id
+}
+
+// save must be called with d.mu held.
+func (d *DeviceLinks) save(put []DeviceLink, remove []string) error {
+	entries := make(map[string][]byte, len(put))
+	for _, link := range put {
+		data, err := json.Marshal(link)
+		if err != nil {
+			return err
+		}
+		entries[link.key()] = data
+	}
+	if len(remove) > 0 {
+		if err := d.store.Delete(deviceLinksBucket, remove...); err != nil {
+			return err
+		}
+	}
+	if len(entries) > 0 {
+		if err := d.store.Put(deviceLinksBucket, entries); err != nil {
+			return err
+		}
+	}
+	for _, key := range remove {
+		delete(d.links, key)
+	}
+	for _, link := range put {
+		d.links[link.key()] = link
+	}
+	return nil
+}
+
+// Merge files devices under into. Merging back a device split off into
+// undoes the split, and devices merged into one of devices follow it.
+func (d *DeviceLinks) Merge(site, into string, devices []string) (string, error) {
+	if into == "" || len(devices) == 0 {
+		return "", errors.New("into and devices are required")
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if link, ok := d.links[siteKey(site, into)]; ok {
+		into = link.Into
+	}
+
+	var put []DeviceLink
+	var remove []string
+	now := time.Now().Unix()
+	for _, device := range devices {
+		if device == "" || device == into {
+			return "", fmt.Errorf("cannot merge %q into %s", device, into)
+		}
+		undone := false
+		for key, link := range d.links {
+			switch {
+			case link.Address != "" && link.Device == into && link.Into == device && link.Site == site:
+				remove = append(remove, key)
+				undone = true
+			case link.Address == "" && link.Into == device && link.Site == site:
+				link.Into = into
+				put = append(put, link)
+			}
+		}
+		if !undone {
+			put = append(put, DeviceLink{Site: site, Device: device, Into: into, CreatedAt: now})
+		}
+	}
+	return into, d.save(put, remove)
+}
+
+// Unmerge makes devices merged into device their own devices again.
+func (d *DeviceLinks) Unmerge(site, device string, devices []string) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	remove := make([]string, 0, len(devices))
+	for _, merged := range devices {
+		key := siteKey(site, merged)
+		if link, ok := d.links[key]; !ok || link.Into != device {
+			return fmt.Errorf("%s is not merged into %s", merged, device)
+		}
+		remove = append(remove, key)
+	}
+	return d.save(nil, remove)
+}
+
+// Split files the services of device at addresses under the device as.
+func (d *DeviceLinks) Split(site, device string, addresses []string, as string) error {
+	if as == device {
+		return fmt.Errorf("cannot split %s off as itself", device)
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	put := make([]DeviceLink, 0, len(addresses))
+	now := time.Now().Unix()
+	for _, address := range addresses {
+		ip := net.ParseIP(address)
+		if ip == nil {
+			return fmt.Errorf("invalid address %q", address)
+		}
+		put = append(put, DeviceLink{Site: site, Device: device, Address: ip.String(), Into: as, CreatedAt: now})
+	}
+	return d.save(put, nil)
+}
+
+// List returns the merges (without addresses) or splits of site, every
+// site when empty.
+func (d *DeviceLinks) List(site string, splits bool) []DeviceLink {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	list := []DeviceLink{}
+	for _, link := range d.links {
+		if (site == "" || link.Site == site) && (link.Address != "") == splits {
+			list = append(list, link)
+		}
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].key() < list[j].key() })
+	return list
+}
+
+// deviceMerge is the body of POST /api/devices/merge.
+type deviceMerge struct {
+	Site    string   `json:"site"`
+	Into    string   `json:"into"`
+	Devices []string `json:"devices"`
+}
+
+// deviceSplit is the body of POST /api/devices/split: either the services
+// at addresses become the device As, or the merged devices are separated.
+type deviceSplit struct {
+	Site      string   `json:"site"`
+	Device    string   `json:"device"`
+	Addresses []string `json:"addresses"`
+	As        string   `json:"as"`
+	Devices   []string `json:"devices"`
+}
+
+// moveMetadata moves the metadata of a device merged into another onto it,
+// keeping what the other already has.
+func (s *MDNSServer) moveMetadata(site, from, into string) error {
+	meta := s.metadata.Get(site, from)
+	if meta == nil {
+		return nil
+	}
+	_, err := s.metadata.Update(site, into, func(d *DeviceMetadata) {
+		if d.Owner == "" {
+			d.Owner = meta.Owner
+		}
+		if d.Location == "" {
+			d.Location = meta.Location
+		}
+		for key, value := range meta.Notes {
+			if _, ok := d.Notes[key]; !ok {
+				if d.Notes == nil {
+					d.Notes = map[string]string{}
+				}
+				d.Notes[key] = value
+			}
+		}
+		d.tag(meta.Tags, nil)
+	})
+	if err == nil {
+		_, err = s.metadata.Delete(site, from)
+	}
+	return err
+}
+
+// summarize returns the summaries of devices of site as /api/devices lists
+// them.
+func (s *MDNSServer) summarize(site string, ids ...string) []*DeviceSummary {
+	devices := make([]*DeviceMetadata, len(ids))
+	for i, id := range ids {
+		if devices[i] = s.metadata.Get(site, id); devices[i] == nil {
+			devices[i] = &DeviceMetadata{ID: id, Site: site}
+		}
+	}
+	return s.summarizeDevices(devices, site)
+}
+
+// DeviceMerge handles /api/devices/merge: POST files devices under the
+// device into, GET lists the merges of ?site=.
+func (s *MDNSServer) DeviceMerge(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		writeJSON(w, http.StatusOK, map[string]interface{}{"merges": deviceLinks.List(s.siteParam(r), false)})
+
+	case http.MethodPost:
+		var req deviceMerge
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		site := s.scopeSite(req.Site)
+		into, err := deviceLinks.Merge(site, req.Into, req.Devices)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		for _, device := range req.Devices {
+			if err := s.moveMetadata(site, device, into); err != nil {
+				writeError(w, http.StatusInternalServerError, err.Error())
+				return
+			}
+		}
+		writeJSON(w, http.StatusOK, map[string]interface{}{"devices": s.summarize(site, into)})
+
+	default:
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+	}
+}
+
+// DeviceSplit handles /api/devices/split: POST separates a device, GET
+// lists the splits of ?site=.
+func (s *MDNSServer) DeviceSplit(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		writeJSON(w, http.StatusOK, map[string]interface{}{"splits": deviceLinks.List(s.siteParam(r), true)})
+
+	case http.MethodPost:
+		var req deviceSplit
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		site := s.scopeSite(req.Site)
+		var err error
+		var devices []string
+		switch {
+		case req.Device == "" || (len(req.Addresses) == 0) == (len(req.Devices) == 0):
+			err = errors.New("device and either addresses or devices are required")
+		case len(req.Devices) > 0:
+			err = deviceLinks.Unmerge(site, req.Device, req.Devices)
+			devices = append([]string{req.Device}, req.Devices...)
+		default:
+			if req.As == "" {
+				req.As = req.Addresses[0]
+			}
+			err = deviceLinks.Split(site, req.Device, req.Addresses, req.As)
+			devices = []string{req.Device, req.As}
+		}
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]interface{}{"devices": s.summarize(site, devices...)})
+
+	default:
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+	}
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func newMergeServer(t *testing.T) (*MDNSServer, Store) {
+	store := openTestStore(t, "json", t.TempDir())
+	saved := deviceLinks
+	deviceLinks, _ = NewDeviceLinks(store)
+	t.Cleanup(func() { deviceLinks = saved })
+
+	server := NewMDNSServer()
+	server.metadata, _ = NewMetadataStore(store)
+	server.addService("smb", &MDNSService{Name: "NAS", Type: "_smb._tcp.local.", Host: "nas.local.", IP: "192.168.1.20", Port: 445, Site: defaultSite})
+	server.addService("http", &MDNSService{Name: "NAS admin", Type: "_http._tcp.local.", IP: "192.168.1.20", Port: 5000, Site: defaultSite})
+	server.addService("ssh", &MDNSService{Name: "nas", Type: "_ssh._tcp.local.", Host: "nas.local.", IP: "192.168.1.21", Port: 22, Site: defaultSite})
+	return server, store
+}
+
+func postLinks(t *testing.T, handler http.HandlerFunc, body string) (int, []*DeviceSummary) {
+	w := httptest.NewRecorder()
+	handler(w, httptest.NewRequest(http.MethodPost, "/api/devices/merge", strings.NewReader(body)))
+	var resp struct {
+		Devices []*DeviceSummary `json:"devices"`
+	}
+	json.Unmarshal(w.Body.Bytes(), &resp)
+	return w.Code, resp.Devices
+}
+
+func deviceIDs(server *MDNSServer) []string {
+	var ids []string
+	for _, d := range server.listDevices(defaultSite, "") {
+		ids = append(ids, d.ID)
+	}
+	return ids
+}
+
+// TestDeviceMerge verifies merged devices are listed as one, with their
+// metadata moved, and can be separated again
+func TestDeviceMerge(t *testing.T) {
+	server, store := newMergeServer(t)
+	server.metadata.Update(defaultSite, "192.168.1.20", func(d *DeviceMetadata) { d.Owner = "alex"; d.tag([]string{"storage"}, nil) })
+	if ids := deviceIDs(server); len(ids) != 2 {
+		t.Fatalf("Expected the IP-only service to be its own device, got %v", ids)
+	}
+
+	code, devices := postLinks(t, server.DeviceMerge, `{"into":"nas.local","devices":["192.168.1.20"]}`)
+	if code != http.StatusOK || len(devices) != 1 || len(devices[0].Services) != 3 || devices[0].Owner != "alex" {
+		t.Fatalf("Expected one device with every service and the owner, got %d %+v", code, devices)
+	}
+	if ids := deviceIDs(server); len(ids) != 1 || ids[0] != "nas.local" {
+		t.Fatalf("Expected only nas.local to be listed, got %v", ids)
+	}
+	if code, _ := postLinks(t, server.DeviceMerge, `{"into":"nas.local","devices":["nas.local"]}`); code != http.StatusBadRequest {
+		t.Fatalf("Expected 400 merging a device into itself, got %d", code)
+	}
+
+	reloaded, _ := NewDeviceLinks(store)
+	if id := reloaded.resolve(defaultSite, "192.168.1.20", "192.168.1.20"); id != "nas.local" {
+		t.Fatalf("Expected the merge to be persisted, got %s", id)
+	}
+
+	code, devices = postLinks(t, server.DeviceSplit, `{"device":"nas.local","devices":["192.168.1.20"]}`)
+	if code != http.StatusOK || len(devices) != 2 || len(devices[1].Services) != 1 {
+		t.Fatalf("Expected the merge to be undone, got %d %+v", code, devices)
+	}
+	if code, _ := postLinks(t, server.DeviceSplit, `{"device":"nas.local","devices":["192.168.1.20"]}`); code != http.StatusBadRequest {
+		t.Fatalf("Expected 400 separating a device that isn't merged, got %d", code)
+	}
+}
+
+// TestDeviceSplit verifies the services of a device at some addresses can
+// be split off, and merging them back undoes the split
+func TestDeviceSplit(t *testing.T) {
+	server, _ := newMergeServer(t)
+
+	code, devices := postLinks(t, server.DeviceSplit, `{"device":"nas.local","addresses":["192.168.1.21"],"as":"backup-nas"}`)
+	if code != http.StatusOK || len(devices) != 2 || len(devices[0].Services) != 1 || len(devices[1].Services) != 1 || devices[1].Services[0].Port != 22 {
+		t.Fatalf("Expected the SSH service to be split off, got %d %+v", code, devices)
+	}
+	if len(deviceLinks.List(defaultSite, true)) != 1 || len(deviceLinks.List(defaultSite, false)) != 0 {
+		t.Fatalf("Expected one split and no merges")
+	}
+	if code, _ := postLinks(t, server.DeviceSplit, `{"device":"nas.local","addresses":["nas"]}`); code != http.StatusBadRequest {
+		t.Fatalf("Expected 400 for an invalid address, got %d", code)
+	}
+
+	code, devices = postLinks(t, server.DeviceMerge, `{"into":"nas.local","devices":["backup-nas"]}`)
+	if code != http.StatusOK || len(devices[0].Services) != 2 || len(deviceLinks.List(defaultSite, true)) != 0 || len(deviceLinks.List(defaultSite, false)) != 0 {
+		t.Fatalf("Expected the split to be undone, got %d %+v", code, devices)
+	}
+}
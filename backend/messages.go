@@ -0,0 +1,266 @@
+package main
+
+import (
+	"embed"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// fallbackLocale is the locale of the built-in catalog, used for anything a
+// translation leaves out.
+const fallbackLocale = "en"
+
+//go:embed locales/*.json
+var builtinLocales embed.FS
+
+// Catalog holds the user-facing strings of one locale: service-type labels,
+// device category names and diagnostic messages, whose {name} placeholders
+// are filled in from the event's parameters.
+type Catalog struct {
+	ServiceTypes map[string]string `json:"serviceTypes"`
+	Categories   map[string]string `json:"categories"`
+	Messages     map[string]string `json:"messages"`
+}
+
+// Catalogs are the message catalogs by locale, lower case, e.g. "pt-br".
+type Catalogs struct {
+	mu            sync.RWMutex
+	locales       map[string]*Catalog
+	defaultLocale string // for messages rendered without a request, -locale
+}
+
+// messages are the catalogs the server renders and serves strings from.
+var messages = mustLoadCatalogs()
+
+func mustLoadCatalogs() *Catalogs {
+	c := &Catalogs{locales: make(map[string]*Catalog), defaultLocale: fallbackLocale}
+	entries, err := builtinLocales.ReadDir("locales")
+	if err != nil {
+		panic(err)
+	}
+	for _, entry := range entries {
+		data, err := builtinLocales.ReadFile("locales/" + entry.Name())
+		if err == nil {
+			err = c.add(entry.Name(), data)
+		}
+		if err != nil {
+			panic(fmt.Sprintf("built-in locale %s: %v", entry.Name(), err))
+		}
+	}
+	return c
+}
+
+// add parses the catalog in file, named after its locale, e.g. "de.json".
+// Its strings override those already loaded for the locale.
+func (c *Catalogs) add(file string, data []byte) error {
+	var catalog Catalog
+	if err := json.Unmarshal(data, &catalog); err != nil {
+		return err
+	}
+	locale := strings.ToLower(strings.TrimSuffix(filepath.Base(file), filepath.Ext(file)))
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	existing := c.locales[locale]
+	if existing == nil {
+		existing = &Catalog{ServiceTypes: map[string]string{}, Categories: map[string]string{}, Messages: map[string]string{}}
+		c.locales[locale] = existing
+	}
+	for key, value := range catalog.ServiceTypes {
+		existing.ServiceTypes[key] = value
+	}
+	for key, value := range catalog.Categories {
+		existing.Categories[key] = value
+	}
+	for key, value := range catalog.Messages {
+		existing.Messages[key] = value
+	}
+	return nil
+}
+
+// LoadDir adds the <locale>.json catalogs in dir, e.g. translations the UI
+// ships, or overrides of the built-in English strings.
+func (c *Catalogs) LoadDir(dir string) error {
+	files, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		return err
+	}
+	for _, file := range files {
+		data, err := os.ReadFile(file)
+		if err == nil {
+			err = c.add(file, data)
+		}
+		if err != nil {
+			return fmt.Errorf("%s: %v", file, err)
+		}
+	}
+	return nil
+}
+
+// SetDefault selects the locale messages are rendered in when there is no
+// request to negotiate one from.
+func (c *Catalogs) SetDefault(locale string) error {
+	locale = strings.ToLower(locale)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.locales[locale] == nil {
+		return fmt.Errorf("no catalog for locale %q", locale)
+	}
+	c.defaultLocale = locale
+	return nil
+}
+
+// Locales lists the available locales.
+func (c *Catalogs) Locales() []string {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	locales := make([]string, 0, len(c.locales))
+	for locale := range c.locales {
+		locales = append(locales, locale)
+	}
+	sort.Strings(locales)
+	return locales
+}
+
+// Negotiate picks the locale for a request: ?lang=, then the preferences of
+// its Accept-Language header in order of quality, trying "de" for "de-AT",
+// and otherwise the default locale.
+func (c *Catalogs) Negotiate(r *http.Request) string {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	for _, tag := range append([]string{r.URL.Query().Get("lang")}, acceptLanguages(r.Header.Get("Accept-Language"))...) {
+		tag = strings.ToLower(strings.TrimSpace(tag))
+		if tag == "" || tag == "*" {
+			continue
+		}
+		if c.locales[tag] != nil {
+			return tag
+		}
+		if primary, _, ok := strings.Cut(tag, "-"); ok && c.locales[primary] != nil {
+			return primary
+		}
+	}
+	return c.defaultLocale
+}
+
+// acceptLanguages returns the language tags of an Accept-Language header,
+// most preferred first.
+func acceptLanguages(header string) []string {
+	type preference struct {
+		tag string
+		q   float64
+	}
+	var preferences []preference
+	for _, part := range strings.Split(header, ",") {
+		tag, params, _ := strings.Cut(part, ";")
+		q := 1.0
+		if v, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			if parsed, err := strconv.ParseFloat(v, 64); err == nil {
+				q = parsed
+			}
+		}
+		if tag = strings.TrimSpace(tag); tag != "" && q > 0 {
+			preferences = append(preferences, preference{tag, q})
+		}
+	}
+	sort.SliceStable(preferences, func(i, j int) bool { return preferences[i].q > preferences[j].q })
+	tags := make([]string, len(preferences))
+	for i, p := range preferences {
+		tags[i] = p.tag
+	}
+	return tags
+}
+
+// Catalog returns the strings of locale, with those it doesn't translate
+// taken from the fallback locale.
+func (c *Catalogs) Catalog(locale string) Catalog {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	merged := Catalog{ServiceTypes: map[string]string{}, Categories: map[string]string{}, Messages: map[string]string{}}
+	for _, l := range []string{fallbackLocale, locale} {
+		catalog := c.locales[l]
+		if catalog == nil {
+			continue
+		}
+		for key, value := range catalog.ServiceTypes {
+			merged.ServiceTypes[key] = value
+		}
+		for key, value := range catalog.Categories {
+			merged.Categories[key] = value
+		}
+		for key, value := range catalog.Messages {
+			merged.Messages[key] = value
+		}
+	}
+	return merged
+}
+
+var placeholderPattern = regexp.MustCompile(`\{([A-Za-z0-9_]+)\}`)
+
+// Format renders the message key in locale, falling back to English and
+// then to the key itself. Unknown placeholders are left as they are.
+func (c *Catalogs) Format(locale, key string, params map[string]string) string {
+	c.mu.RLock()
+	template := ""
+	for _, l := range []string{locale, fallbackLocale} {
+		if catalog := c.locales[l]; catalog != nil && catalog.Messages[key] != "" {
+			template = catalog.Messages[key]
+			break
+		}
+	}
+	c.mu.RUnlock()
+	if template == "" {
+		template = key
+	}
+	return placeholderPattern.ReplaceAllStringFunc(template, func(placeholder string) string {
+		if value, ok := params[placeholder[1:len(placeholder)-1]]; ok {
+			return value
+		}
+		return placeholder
+	})
+}
+
+// newAnomaly builds an anomaly whose message is the catalog's message key,
+// rendered in the default locale. Clients can render it in theirs from the
+// key and parameters.
+func newAnomaly(kind, key string, params map[string]string) AnomalyEvent {
+	messages.mu.RLock()
+	locale := messages.defaultLocale
+	messages.mu.RUnlock()
+	return AnomalyEvent{
+		Kind:       kind,
+		Message:    messages.Format(locale, key, params),
+		MessageKey: key,
+		Params:     params,
+	}
+}
+
+// Messages handles GET /api/messages: the service-type labels, device
+// category names and diagnostic message templates in the locale negotiated
+// from ?lang= or Accept-Language.
+func (s *MDNSServer) Messages(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	locale := messages.Negotiate(r)
+	catalog := messages.Catalog(locale)
+	w.Header().Set("Content-Language", locale)
+	w.Header().Set("Vary", "Accept-Language")
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"locale":       locale,
+		"locales":      messages.Locales(),
+		"serviceTypes": catalog.ServiceTypes,
+		"categories":   catalog.Categories,
+		"messages":     catalog.Messages,
+	})
+}
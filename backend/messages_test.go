@@ -0,0 +1,68 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// TestMessageCatalogs verifies translations are negotiated from
+// Accept-Language, fall back to English for what they leave out, and fill
+// in message parameters.
+func TestMessageCatalogs(t *testing.T) {
+	catalogs := mustLoadCatalogs()
+	dir := t.TempDir()
+	os.WriteFile(filepath.Join(dir, "de.json"), []byte(`{
+		"categories": {"printer": "Drucker"},
+		"messages": {"worker-failed": "{worker} ist ausgefallen: {error}"}
+	}`), 0o644)
+	if err := catalogs.LoadDir(dir); err != nil {
+		t.Fatalf("Expected the catalogs to load, got %v", err)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/api/messages", nil)
+	req.Header.Set("Accept-Language", "fr-CH, de-AT;q=0.9, en;q=0.5")
+	if locale := catalogs.Negotiate(req); locale != "de" {
+		t.Fatalf("Expected de, got %q", locale)
+	}
+	req = httptest.NewRequest(http.MethodGet, "/api/messages?lang=en", nil)
+	req.Header.Set("Accept-Language", "de")
+	if locale := catalogs.Negotiate(req); locale != "en" {
+		t.Fatalf("Expected ?lang= to win, got %q", locale)
+	}
+
+	catalog := catalogs.Catalog("de")
+	if catalog.Categories["printer"] != "Drucker" || catalog.Categories["storage"] != "Network storage" {
+		t.Fatalf("Expected the translation over English, got %v", catalog.Categories)
+	}
+	if got := catalogs.Format("de", "worker-failed", map[string]string{"worker": "query", "error": "boom"}); got != "query ist ausgefallen: boom" {
+		t.Fatalf("Expected the German message, got %q", got)
+	}
+	if got := catalogs.Format("de", "listener-degraded", map[string]string{"socket": "multicast"}); got != "mDNS listener (multicast socket): {error}" {
+		t.Fatalf("Expected English with the missing parameter left, got %q", got)
+	}
+}
+
+// TestMessagesEndpoint verifies /api/messages serves the negotiated catalog.
+func TestMessagesEndpoint(t *testing.T) {
+	server := NewMDNSServer()
+	req := httptest.NewRequest(http.MethodGet, "/api/messages", nil)
+	req.Header.Set("Accept-Language", "xx")
+	rec := httptest.NewRecorder()
+	server.Messages(rec, req)
+
+	if rec.Code != http.StatusOK || rec.Header().Get("Content-Language") != "en" {
+		t.Fatalf("Expected the English catalog, got %d %q", rec.Code, rec.Header().Get("Content-Language"))
+	}
+	var resp struct {
+		ServiceTypes map[string]string `json:"serviceTypes"`
+		Messages     map[string]string `json:"messages"`
+	}
+	json.NewDecoder(rec.Body).Decode(&resp)
+	if resp.ServiceTypes["_smb._tcp"] == "" || resp.Messages["rogue-ra"] == "" {
+		t.Fatalf("Expected service-type labels and messages, got %+v", resp)
+	}
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DeviceMetadata holds user-supplied information about a device that cannot
+// be learned from the network, such as its owner, location and free-form
+// notes.
+type DeviceMetadata struct {
+	ID        string            `json:"id"`
+	Site      string            `json:"site"`
+	Owner     string            `json:"owner,omitempty"`
+	Location  string            `json:"location,omitempty"`
+	Notes     map[string]string `json:"notes,omitempty"`
+	Tags      []string          `json:"tags,omitempty"`
+	UpdatedAt int64             `json:"updatedAt"`
+	// Revision counts the updates, so concurrent editors can tell they
+	// would overwrite each other; 0 without stored metadata
+	Revision int64 `json:"revision"`
+}
+
+// errRevisionConflict means the metadata changed since the revision an
+// update was based on.
+var errRevisionConflict = errors.New("device was changed by someone else")
+
+// metadataBucket is the Store bucket device metadata is kept in.
+const metadataBucket = "devices"
+
+// MetadataStore keeps device metadata in memory and writes every change
+// through to the persistent Store so it survives restarts.
+type MetadataStore struct {
+	mu      sync.RWMutex
+	store   Store
+	devices map[string]*DeviceMetadata
+}
+
+// NewMetadataStore loads all device metadata from store. Records written
+// before sites existed are assigned to defaultSite.
+func NewMetadataStore(store Store) (*MetadataStore, error) {
+	m := &MetadataStore{
+		store:   store,
+		devices: make(map[string]*DeviceMetadata),
+	}
+
+	entries, err := store.Load(metadataBucket)
+	if err != nil {
+		return nil, err
+	}
+	for id, data := range entries {
+		d := &DeviceMetadata{}
+		if err := json.Unmarshal(data, d); err != nil {
+			return nil, fmt.Errorf("device %s: %v", id, err)
+		}
+		if d.Site == "" {
+			d.Site = defaultSite
+		}
+		m.devices[siteKey(d.Site, d.ID)] = d
+	}
+	return m, nil
+}
+
+// Get returns a copy of the metadata for a device of a site, or nil if none
+// is stored.
+func (m *MetadataStore) Get(site, id string) *DeviceMetadata {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	d, ok := m.devices[siteKey(site, id)]
+	if !ok {
+		return nil
+	}
+	return d.copy()
+}
+
+// List returns copies of all stored metadata of a site whose fields or notes
+// contain query (case-insensitive). An empty site matches every site and an
+// empty query matches every device.
+func (m *MetadataStore) List(site, query string) []*DeviceMetadata {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	query = strings.ToLower(query)
+	result := make([]*DeviceMetadata, 0, len(m.devices))
+	for _, d := range m.devices {
+		if (site == "" || d.Site == site) && (query == "" || d.matches(query)) {
+			result = append(result, d.copy())
+		}
+	}
+	sortDevices(result)
+	return result
+}
+
+// Update applies fn to the metadata of a device of a site, creating it if
+// needed, and persists the change.
+func (m *MetadataStore) Update(site, id string, fn func(d *DeviceMetadata)) (*DeviceMetadata, error) {
+	return m.UpdateRevision(site, id, -1, fn)
+}
+
+// UpdateRevision is Update for an edit based on a revision of the metadata:
+// if it has changed since, nothing is updated and errRevisionConflict
+// returned along with the current metadata. A negative revision always
+// updates.
+func (m *MetadataStore) UpdateRevision(site, id string, revision int64, fn func(d *DeviceMetadata)) (*DeviceMetadata, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	key := siteKey(site, id)
+	current, ok := m.devices[key]
+	if !ok {
+		current = &DeviceMetadata{ID: id, Site: site}
+	}
+	if revision >= 0 && revision != current.Revision {
+		return current.copy(), errRevisionConflict
+	}
+	d := current.copy()
+	fn(d)
+	d.UpdatedAt = time.Now().Unix()
+	d.Revision++
+
+	data, err := json.Marshal(d)
+	if err != nil {
+		return nil, err
+	}
+	if err := m.store.Put(metadataBucket, map[string][]byte{key: data}); err != nil {
+		return nil, err
+	}
+	m.devices[key] = d
+	return d.copy(), nil
+}
+
+// Delete removes the metadata of a device of a site and reports whether
+// there was any.
+func (m *MetadataStore) Delete(site, id string) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	key := siteKey(site, id)
+	if _, ok := m.devices[key]; !ok {
+		return false, nil
+	}
+	if err := m.store.Delete(metadataBucket, key); err != nil {
+		return false, err
+	}
+	delete(m.devices, key)
+	return true, nil
+}
+
+// Records returns the number of devices with stored metadata.
+func (m *MetadataStore) Records() int {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return len(m.devices)
+}
+
+func (d *DeviceMetadata) copy() *DeviceMetadata {
+	c := *d
+	if d.Notes != nil {
+		c.Notes = make(map[string]string, len(d.Notes))
+		for k, v := range d.Notes {
+			c.Notes[k] = v
+		}
+	}
+	c.Tags = append([]string(nil), d.Tags...)
+	return &c
+}
+
+// tag adds and removes tags, keeping them sorted and unique.
+func (d *DeviceMetadata) tag(add, remove []string) {
+	tags := make(map[string]bool, len(d.Tags)+len(add))
+	for _, t := range append(d.Tags, add...) {
+		if t = strings.TrimSpace(t); t != "" {
+			tags[t] = true
+		}
+	}
+	for _, t := range remove {
+		delete(tags, strings.TrimSpace(t))
+	}
+	d.Tags = nil
+	for t := range tags {
+		d.Tags = append(d.Tags, t)
+	}
+	sort.Strings(d.Tags)
+}
+
+func (d *DeviceMetadata) matches(query string) bool {
+	for _, field := range []string{d.ID, d.Owner, d.Location} {
+		if strings.Contains(strings.ToLower(field), query) {
+			return true
+		}
+	}
+	for k, v := range d.Notes {
+		if strings.Contains(strings.ToLower(k), query) || strings.Contains(strings.ToLower(v), query) {
+			return true
+		}
+	}
+	for _, t := range d.Tags {
+		if strings.Contains(strings.ToLower(t), query) {
+			return true
+		}
+	}
+	return false
+}
+
+// defaultDataDir returns the directory used for persisted state when no
+// -data-dir flag is given.
+func defaultDataDir() string {
+	if dir, err := os.UserConfigDir(); err == nil {
+		return filepath.Join(dir, "network-view-osx")
+	}
+	return "data"
+}
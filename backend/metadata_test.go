@@ -0,0 +1,65 @@
+package main
+
+import "testing"
+
+// TestMetadataStorePersistence verifies notes survive reloading the store
+func TestMetadataStorePersistence(t *testing.T) {
+	dir := t.TempDir()
+
+	store, err := NewMetadataStore(openTestStore(t, "json", dir))
+	if err != nil {
+		t.Fatalf("Failed to create store: %v", err)
+	}
+
+	_, err = store.Update(defaultSite, "camera.local", func(d *DeviceMetadata) {
+		d.Notes = map[string]string{"warranty": "ends 2026-01"}
+		d.Location = "garage"
+	})
+	if err != nil {
+		t.Fatalf("Failed to set notes: %v", err)
+	}
+
+	reloaded, err := NewMetadataStore(openTestStore(t, "json", dir))
+	if err != nil {
+		t.Fatalf("Failed to reload store: %v", err)
+	}
+
+	meta := reloaded.Get(defaultSite, "camera.local")
+	if meta == nil {
+		t.Fatalf("Expected metadata for camera.local after reload")
+	}
+	if meta.Notes["warranty"] != "ends 2026-01" {
+		t.Fatalf("Expected warranty note to persist, got %q", meta.Notes["warranty"])
+	}
+	if meta.Location != "garage" {
+		t.Fatalf("Expected location to persist, got %q", meta.Location)
+	}
+}
+
+// TestMetadataStoreSearch verifies ?q= matching on IDs and note contents
+func TestMetadataStoreSearch(t *testing.T) {
+	store, err := NewMetadataStore(openTestStore(t, "json", t.TempDir()))
+	if err != nil {
+		t.Fatalf("Failed to create store: %v", err)
+	}
+
+	store.Update(defaultSite, "camera.local", func(d *DeviceMetadata) {
+		d.Notes = map[string]string{"spot": "Garage"}
+	})
+	store.Update(defaultSite, "nas.local", func(d *DeviceMetadata) {
+		d.Location = "office"
+	})
+
+	if got := store.List("", "garage"); len(got) != 1 || got[0].ID != "camera.local" {
+		t.Fatalf("Expected only camera.local to match note value, got %v", got)
+	}
+	if got := store.List("", "nas"); len(got) != 1 || got[0].ID != "nas.local" {
+		t.Fatalf("Expected only nas.local to match ID, got %v", got)
+	}
+	if got := store.List("", "office"); len(got) != 1 || got[0].ID != "nas.local" {
+		t.Fatalf("Expected only nas.local to match location, got %v", got)
+	}
+	if got := store.List("", ""); len(got) != 2 {
+		t.Fatalf("Expected empty query to match all devices, got %d", len(got))
+	}
+}
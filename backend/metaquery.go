@@ -0,0 +1,160 @@
+package main
+
+import (
+	"log"
+	"maps"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// maxDiscoveredTypes bounds the types kept from meta-query answers, so a
+// responder announcing made-up types can't grow the list, or the browsers,
+// without end.
+const maxDiscoveredTypes = 64
+
+// DiscoveredType is a service type a responder on the network said it has
+// instances of.
+type DiscoveredType struct {
+	Type      string `json:"type"` // browse form, e.g. "_http._tcp"
+	FirstSeen int64  `json:"firstSeen"`
+	LastSeen  int64  `json:"lastSeen"`
+	// ExpiresAt is when the last answer's TTL runs out
+	ExpiresAt int64 `json:"expiresAt"`
+	// Browsed is whether the type is browsed and queried
+	Browsed bool `json:"browsed"`
+}
+
+// DiscoveredTypes are the service types learned from the answers to the
+// DNS-SD meta-query, "_services._dns-sd._udp.local." (RFC 6763 §9), ours or
+// anyone else's. With browse set, types that aren't browsed yet are browsed
+// from then on, so services of types missing from -service-types are found
+// too.
+type DiscoveredTypes struct {
+	browse bool
+
+	mu        sync.Mutex
+	types     map[string]*DiscoveredType
+	dropped   int // types not kept past maxDiscoveredTypes
+	queriedAt time.Time
+}
+
+func NewDiscoveredTypes(browse bool) *DiscoveredTypes {
+	return &DiscoveredTypes{browse: browse, types: make(map[string]*DiscoveredType)}
+}
+
+// observe records the type a meta-query answer points to, and reports it
+// in browse form if it is new. Answers pointing to something other than a
+// service type are ignored.
+func (d *DiscoveredTypes) observe(record *dns.PTR, received time.Time) (string, bool) {
+	serviceType, err := parseServiceType(record.Ptr)
+	if err != nil {
+		return "", false
+	}
+	expiresAt := received.Add(time.Duration(record.Hdr.Ttl) * time.Second).Unix()
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if known, ok := d.types[serviceType]; ok {
+		known.LastSeen, known.ExpiresAt = received.Unix(), expiresAt
+		return serviceType, false
+	}
+	if len(d.types) >= maxDiscoveredTypes {
+		d.dropped++
+		return "", false
+	}
+	d.types[serviceType] = &DiscoveredType{
+		Type:      serviceType,
+		FirstSeen: received.Unix(),
+		LastSeen:  received.Unix(),
+		ExpiresAt: expiresAt,
+	}
+	return serviceType, true
+}
+
+// queried records when the meta-query was last sent.
+func (d *DiscoveredTypes) queried(now time.Time) {
+	d.mu.Lock()
+	d.queriedAt = now
+	d.mu.Unlock()
+}
+
+// List returns the discovered types by name, each marked browsed if it is
+// among browsed.
+func (d *DiscoveredTypes) List(browsed *ServiceTypes) []DiscoveredType {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	list := make([]DiscoveredType, 0, len(d.types))
+	for _, name := range slices.Sorted(maps.Keys(d.types)) {
+		discovered := *d.types[name]
+		discovered.Browsed = browsed.Has(name)
+		list = append(list, discovered)
+	}
+	return list
+}
+
+// discoverServiceType records the type a meta-query answer points to, and
+// starts browsing it if it is new and types are browsed as discovered.
+func (s *MDNSServer) discoverServiceType(record *dns.PTR, received time.Time) {
+	serviceType, ok := s.discovered.observe(record, received)
+	if !ok || !s.discovered.browse || !s.serviceTypes.Discover(serviceType) {
+		return
+	}
+	log.Printf("Discovered service type %s, browsing it", serviceType)
+	s.browseAdded(serviceType)
+}
+
+// discoverServiceTypes sends the meta-query, asking every responder for the
+// service types it has instances of.
+func discoverServiceTypes(server *MDNSServer) {
+	if !server.protocols.Enabled(protocolMDNSQuery) {
+		return
+	}
+	server.queried()
+	server.discovered.queried(time.Now())
+
+	m := server.self.newQuery(servicesMetaQuery, dns.TypePTR)
+	c := new(dns.Client)
+	c.Net = "udp"
+	c.Timeout = 500 * time.Millisecond
+
+	// Most answers are multicast and reach the listener instead
+	in, _, err := c.Exchange(m, "224.0.0.251:5353")
+	if err != nil || in == nil {
+		return
+	}
+	received := time.Now()
+	for _, ans := range in.Answer {
+		if ptr, ok := ans.(*dns.PTR); ok && strings.EqualFold(ptr.Hdr.Name, servicesMetaQuery) {
+			server.discoverServiceType(ptr, received)
+		}
+	}
+}
+
+// DiscoveredServiceTypes handles GET /api/service-types/discovered: the
+// types the network advertises, whether they are browsed, and when the
+// meta-query was last sent.
+func (s *MDNSServer) DiscoveredServiceTypes(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	response := map[string]interface{}{
+		"serviceTypes": s.discovered.List(s.serviceTypes),
+		"browse":       s.discovered.browse,
+	}
+	s.discovered.mu.Lock()
+	if !s.discovered.queriedAt.IsZero() {
+		response["queriedAt"] = s.discovered.queriedAt.Unix()
+	}
+	if s.discovered.dropped > 0 {
+		response["dropped"] = s.discovered.dropped
+	}
+	s.discovered.mu.Unlock()
+	writeJSON(w, http.StatusOK, response)
+}
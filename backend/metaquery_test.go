@@ -0,0 +1,71 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func metaAnswer(serviceTypes ...string) *dns.Msg {
+	msg := new(dns.Msg)
+	msg.Response = true
+	for _, serviceType := range serviceTypes {
+		msg.Answer = append(msg.Answer, &dns.PTR{
+			Hdr: dns.RR_Header{Name: servicesMetaQuery, Rrtype: dns.TypePTR, Class: dns.ClassINET, Ttl: 4500},
+			Ptr: serviceType,
+		})
+	}
+	return msg
+}
+
+// TestDiscoverServiceTypes verifies the types in meta-query answers are
+// listed and browsed, except those removed at runtime and names that
+// aren't service types
+func TestDiscoverServiceTypes(t *testing.T) {
+	server := NewMDNSServer()
+	server.protocols.Set(protocolMDNSQuery, false)
+	server.protocols.Set(protocolMDNSBrowse, false)
+	if _, err := server.serviceTypes.Change(map[string]bool{"_airplay._tcp": false}); err != nil {
+		t.Fatalf("Expected the removal to apply, got %v", err)
+	}
+
+	handleMDNSPacket(server, metaAnswer("_Printer._tcp.local.", "_airplay._tcp.local.", "_http._tcp.local.", "nas.local."), "en0", nil, time.Now())
+
+	list := server.discovered.List(server.serviceTypes)
+	if len(list) != 3 || list[0].Type != "_airplay._tcp" || list[2].Type != "_printer._tcp" {
+		t.Fatalf("Expected the three service types by name, got %+v", list)
+	}
+	if !server.serviceTypes.Has("_printer._tcp") || !list[2].Browsed {
+		t.Fatalf("Expected a discovered type to be browsed")
+	}
+	if server.serviceTypes.Has("_airplay._tcp") || list[0].Browsed {
+		t.Fatalf("Expected a type removed at runtime to stay removed")
+	}
+	if !list[1].Browsed {
+		t.Fatalf("Expected a default type to be listed as browsed")
+	}
+
+	rec := httptest.NewRecorder()
+	server.DiscoveredServiceTypes(rec, httptest.NewRequest(http.MethodGet, "/api/service-types/discovered", nil))
+	if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), `"_printer._tcp"`) {
+		t.Fatalf("Expected the discovered types, got %d %s", rec.Code, rec.Body)
+	}
+}
+
+// TestDiscoveredTypesLimit verifies types past maxDiscoveredTypes are
+// counted rather than kept
+func TestDiscoveredTypesLimit(t *testing.T) {
+	discovered := NewDiscoveredTypes(false)
+	for i := 0; i < maxDiscoveredTypes+5; i++ {
+		record := metaAnswer(fmt.Sprintf("_type%d._tcp.local.", i)).Answer[0].(*dns.PTR)
+		discovered.observe(record, time.Now())
+	}
+	if len(discovered.types) != maxDiscoveredTypes || discovered.dropped != 5 {
+		t.Fatalf("Expected %d types and 5 dropped, got %d and %d", maxDiscoveredTypes, len(discovered.types), discovered.dropped)
+	}
+}
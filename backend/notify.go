@@ -0,0 +1,738 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html/template"
+	"log"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// notifiersBucket is the Store bucket notifiers are kept in.
+const notifiersBucket = "notifiers"
+
+// What notifications are about.
+const (
+	notifyNewDevice = "new-device" // a device seen for the first time
+	notifyDeparture = "departure"  // the last service of a device went away
+	notifyFinding   = "finding"    // an anomaly
+)
+
+var notificationKinds = []string{notifyNewDevice, notifyDeparture, notifyFinding}
+
+// Notifier delivery modes.
+const (
+	notifyEvents = "event"  // one webhook per notification
+	notifyDigest = "digest" // a summary every digest interval
+)
+
+// Digest formats.
+const (
+	digestText = "text"
+	digestHTML = "html"
+	digestJSON = "json"
+)
+
+// maxDigestPending bounds the notifications a digest collects; later ones
+// are only counted.
+const maxDigestPending = 1000
+
+// notifyTimeout bounds a webhook delivery.
+const notifyTimeout = 10 * time.Second
+
+// Notification is one thing notifiers are told about.
+type Notification struct {
+	Kind    string        `json:"kind"`
+	Time    int64         `json:"time"`
+	Site    string        `json:"site,omitempty"`
+	Device  string        `json:"device,omitempty"`
+	Message string        `json:"message"`
+	Anomaly *AnomalyEvent `json:"anomaly,omitempty"`
+	// Seq is the sequence number of the event it is about, see EventBus
+	Seq uint64 `json:"seq,omitempty"`
+
+	service *MDNSService // the service that arrived or left, if any
+}
+
+// DigestConfig makes a notifier send a summary of what happened every
+// Interval, e.g. "1h" or "1d", instead of a webhook per notification.
+type DigestConfig struct {
+	Interval string `json:"interval"`
+	Format   string `json:"format,omitempty"` // text (default), html or json
+
+	interval time.Duration
+}
+
+// Notifier is a webhook notifications are POSTed to, as they happen or as a
+// digest.
+type Notifier struct {
+	ID     string        `json:"id"`
+	Name   string        `json:"name,omitempty"`
+	URL    string        `json:"url"`
+	Mode   string        `json:"mode"`
+	Events []string      `json:"events,omitempty"` // notification kinds, default all
+	Digest *DigestConfig `json:"digest,omitempty"`
+	// Site limits the notifier to one site's devices, default every site
+	Site string `json:"site,omitempty"`
+	// Filter limits it to the devices or services matching a filter
+	// expression, see Filter
+	Filter string `json:"filter,omitempty"`
+	// Secret names the secret deliveries are signed with, see signature
+	Secret string `json:"secret,omitempty"`
+	// Payload replaces the JSON notification or the rendered digest
+	Payload   *PayloadTemplate `json:"payload,omitempty"`
+	CreatedAt int64            `json:"createdAt"`
+
+	filter     *Filter
+	signingKey string // the value of Secret, looked up when loaded
+}
+
+func (n *Notifier) validate() error {
+	u, err := url.Parse(n.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("invalid webhook URL %q", n.URL)
+	}
+	if n.filter, err = ParseFilter(n.Filter); err != nil {
+		return err
+	}
+	if n.Secret != "" && !secretNamePattern.MatchString(n.Secret) {
+		return fmt.Errorf("invalid secret name %q", n.Secret)
+	}
+	for _, kind := range n.Events {
+		if !containsString(notificationKinds, kind) {
+			return fmt.Errorf("unknown event %q (expected one of %s)", kind, strings.Join(notificationKinds, ", "))
+		}
+	}
+	switch n.Mode {
+	case "":
+		n.Mode = notifyEvents
+		if n.Digest != nil {
+			n.Mode = notifyDigest
+		}
+	case notifyEvents, notifyDigest:
+	default:
+		return fmt.Errorf("mode must be %s or %s", notifyEvents, notifyDigest)
+	}
+	if n.Payload != nil {
+		if err := n.Payload.validate(n.Mode); err != nil {
+			return err
+		}
+	}
+	if n.Mode == notifyEvents {
+		if n.Digest != nil {
+			return errors.New("digest settings need the digest mode")
+		}
+		return nil
+	}
+	if n.Digest == nil {
+		return errors.New("digest mode needs digest settings")
+	}
+	n.Digest.interval, err = parseDays(n.Digest.Interval)
+	if err != nil || n.Digest.interval < time.Minute {
+		return fmt.Errorf("invalid digest interval %q (at least 1m)", n.Digest.Interval)
+	}
+	switch n.Digest.Format {
+	case "":
+		n.Digest.Format = digestText
+	case digestText, digestHTML, digestJSON:
+	default:
+		return fmt.Errorf("digest format must be %s, %s or %s", digestText, digestHTML, digestJSON)
+	}
+	return nil
+}
+
+func containsString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// wants reports whether the notifier is interested in a notification,
+// whose filter fields are given.
+func (n *Notifier) wants(notification Notification, fields filterFields) bool {
+	if n.Site != "" && notification.Site != "" && notification.Site != n.Site {
+		return false
+	}
+	return (len(n.Events) == 0 || containsString(n.Events, notification.Kind)) && n.filter.Match(fields)
+}
+
+// notifierState is what a notifier has collected and delivered.
+type notifierState struct {
+	pending   []Notification // for the next digest
+	dropped   int
+	since     time.Time // start of the current digest period
+	sent      int
+	lastSent  int64
+	lastError string
+}
+
+// NotifierStatus is a notifier on /api/notifiers, with its delivery state.
+type NotifierStatus struct {
+	Notifier
+	Pending   int    `json:"pending,omitempty"`
+	NextAt    int64  `json:"nextDigestAt,omitempty"`
+	Sent      int    `json:"sent"`
+	LastSent  int64  `json:"lastSent,omitempty"`
+	LastError string `json:"lastError,omitempty"`
+	// Queued deliveries are waiting to be sent or retried, see outboxEntry
+	Queued      int `json:"queued,omitempty"`
+	DeadLetters int `json:"deadLetters,omitempty"`
+}
+
+// Notifiers turns bus events into notifications and delivers them to the
+// configured webhooks. Digests are collected in memory, so what a digest
+// has collected is lost on restart; deliveries are persisted until they
+// succeed.
+type Notifiers struct {
+	mu        sync.Mutex
+	server    *MDNSServer
+	store     Store
+	client    *http.Client
+	notifiers map[string]*Notifier
+	states    map[string]*notifierState
+	// deliveries counts the queued deliveries
+	deliveries sync.WaitGroup
+	// lanes queue the deliveries of each notifier and device, the one
+	// being sent or retried first
+	lanes     map[string][]*outboxEntry
+	dead      []*outboxEntry // dead letters, the oldest first
+	lastEntry uint64         // ID of the latest entry
+	backoff   time.Duration  // after the first failure
+	// recent are the latest notifications, bounded like the event history,
+	// for trying out notifiers on /api/rules/test
+	recent []Notification
+}
+
+// NewNotifiers loads the notifiers from store and subscribes them to the
+// server's events.
+func NewNotifiers(store Store, server *MDNSServer) (*Notifiers, error) {
+	n := &Notifiers{server: server, store: store, client: &http.Client{Timeout: notifyTimeout}, notifiers: make(map[string]*Notifier), states: make(map[string]*notifierState), lanes: make(map[string][]*outboxEntry), backoff: outboxBackoff}
+	entries, err := store.Load(notifiersBucket)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	for key, data := range entries {
+		notifier := &Notifier{}
+		if err := json.Unmarshal(data, notifier); err == nil {
+			err = notifier.validate()
+		}
+		if err != nil {
+			return nil, fmt.Errorf("notifier %s: %v", key, err)
+		}
+		if notifier.Secret != "" {
+			if notifier.signingKey, err = lookupSecret(notifier.Secret); err != nil {
+				log.Printf("⚠️  Notifier %s won't deliver: %v", notifier.ID, err)
+			}
+		}
+		n.notifiers[notifier.ID] = notifier
+		n.states[notifier.ID] = &notifierState{since: now}
+	}
+	n.mu.Lock()
+	err = n.loadOutbox()
+	n.mu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+
+	server.bus.Subscribe("notifiers", func(e BusEvent) {
+		if notification, ok := server.notification(e); ok {
+			n.Notify(notification)
+		}
+	}, TopicHost, TopicService, TopicAnomaly)
+	return n, nil
+}
+
+// notification turns a bus event into a notification, if it is one.
+func (s *MDNSServer) notification(e BusEvent) (Notification, bool) {
+	switch payload := e.Payload.(type) {
+	case HostEvent:
+		if !payload.New {
+			return Notification{}, false
+		}
+		return Notification{Kind: notifyNewDevice, Time: e.Time.Unix(), Site: payload.Site, Device: payload.ID,
+			Message: fmt.Sprintf("New device %s", payload.ID), Seq: e.Seq, service: payload.service}, true
+	case *DiscoveryResponse:
+		if !payload.Removed {
+			return Notification{}, false
+		}
+		device := deviceID(&payload.Service)
+		for _, service := range s.listServices(payload.Service.Site) {
+			if deviceID(&service) == device {
+				return Notification{}, false
+			}
+		}
+		return Notification{Kind: notifyDeparture, Time: e.Time.Unix(), Site: payload.Service.Site, Device: device,
+			Message: fmt.Sprintf("%s left: its last service, %s, went away", device, payload.Service.Name), Seq: e.Seq, service: &payload.Service}, true
+	case AnomalyEvent:
+		return Notification{Kind: notifyFinding, Time: e.Time.Unix(), Device: payload.Device, Message: payload.Message, Anomaly: &payload, Seq: e.Seq}, true
+	}
+	return Notification{}, false
+}
+
+// notificationFields are the filter fields of a notification: those of
+// the service that arrived or left, or else the metadata of its device.
+func (s *MDNSServer) notificationFields(notification Notification) filterFields {
+	if notification.service != nil {
+		return s.serviceFields(notification.service)
+	}
+	var fields filterFields
+	return func(field string) []string {
+		if fields == nil {
+			site := notification.Site
+			if site == "" {
+				site = s.site
+			}
+			meta := s.metadata.Get(site, notification.Device)
+			if meta == nil {
+				meta = &DeviceMetadata{ID: notification.Device, Site: site}
+			}
+			fields = deviceFields(&DeviceSummary{DeviceMetadata: meta})
+		}
+		return fields(field)
+	}
+}
+
+// Notify hands a notification to every notifier that wants it: event
+// notifiers deliver it right away, digest notifiers collect it.
+func (n *Notifiers) Notify(notification Notification) {
+	fields := n.server.notificationFields(notification)
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.remember(notification)
+	for id, notifier := range n.notifiers {
+		if !notifier.wants(notification, fields) {
+			continue
+		}
+		state := n.states[id]
+		if notifier.Mode == notifyDigest {
+			if len(state.pending) < maxDigestPending {
+				state.pending = append(state.pending, notification)
+			} else {
+				state.dropped++
+			}
+			continue
+		}
+		contentType := "application/json"
+		var body []byte
+		var err error
+		if notifier.Payload != nil {
+			contentType = notifier.Payload.ContentType
+			body, err = notifier.Payload.execute(notifier.payloadData(notification, nil))
+		} else {
+			body, err = json.Marshal(notification)
+		}
+		if err != nil {
+			state.lastError = err.Error()
+			continue
+		}
+		n.deliver(notifier, siteKey(notification.Site, notification.Device), contentType, body)
+	}
+}
+
+// remember keeps a notification for dry runs. It must be called with n.mu
+// held.
+func (n *Notifiers) remember(notification Notification) {
+	n.recent = append(n.recent, notification)
+	cutoff := time.Unix(notification.Time, 0).Add(-historyWindow).Unix()
+	drop := max(len(n.recent)-historyMax, 0)
+	for drop < len(n.recent) && n.recent[drop].Time < cutoff {
+		drop++
+	}
+	if drop > 0 {
+		n.recent = append(n.recent[:0:0], n.recent[drop:]...)
+	}
+}
+
+// deliver queues body for a notifier's webhook, after the notifier's
+// earlier deliveries about the same device (digests are about device "").
+// It must be called with n.mu held.
+func (n *Notifiers) deliver(notifier *Notifier, device, contentType string, body []byte) {
+	if notifier.Secret != "" && notifier.signingKey == "" {
+		n.states[notifier.ID].lastError = fmt.Sprintf("secret %s is not set", notifier.Secret)
+		return
+	}
+	n.enqueue(notifier, device, contentType, body)
+}
+
+// signatureHeader carries the HMAC-SHA256 of a delivery's body, keyed with
+// the notifier's secret, as "sha256=<hex>", so receivers can check that a
+// notification came from this server.
+const signatureHeader = "X-Network-View-Signature"
+
+func signature(key string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(key))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+func (n *Notifiers) post(target, contentType, key string, body []byte) error {
+	ctx, cancel := context.WithTimeout(context.Background(), notifyTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, target, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", contentType)
+	req.Header.Set("User-Agent", "network-view-osx")
+	if key != "" {
+		req.Header.Set(signatureHeader, signature(key, body))
+	}
+	resp, err := n.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("webhook answered %s", resp.Status)
+	}
+	return nil
+}
+
+// Digest is what a digest notifier tells about one period.
+type Digest struct {
+	Notifier   string         `json:"notifier"`
+	From       time.Time      `json:"from"`
+	To         time.Time      `json:"to"`
+	NewDevices []Notification `json:"newDevices"`
+	Departures []Notification `json:"departures"`
+	Findings   []Notification `json:"findings"`
+	Dropped    int            `json:"dropped,omitempty"` // beyond maxDigestPending
+}
+
+func newDigest(notifier *Notifier, state *notifierState, now time.Time) Digest {
+	digest := Digest{Notifier: notifier.Name, From: state.since, To: now, Dropped: state.dropped,
+		NewDevices: []Notification{}, Departures: []Notification{}, Findings: []Notification{}}
+	if digest.Notifier == "" {
+		digest.Notifier = notifier.ID
+	}
+	for _, notification := range state.pending {
+		switch notification.Kind {
+		case notifyNewDevice:
+			digest.NewDevices = append(digest.NewDevices, notification)
+		case notifyDeparture:
+			digest.Departures = append(digest.Departures, notification)
+		default:
+			digest.Findings = append(digest.Findings, notification)
+		}
+	}
+	return digest
+}
+
+// Empty reports whether nothing happened in the digest's period.
+func (d Digest) Empty() bool {
+	return len(d.NewDevices)+len(d.Departures)+len(d.Findings)+d.Dropped == 0
+}
+
+// Subject is the digest's one-line summary.
+func (d Digest) Subject() string {
+	return fmt.Sprintf("Network digest: %s, %s, %s", plural(len(d.NewDevices), "new device"), plural(len(d.Departures), "departure"), plural(len(d.Findings), "finding"))
+}
+
+func plural(n int, noun string) string {
+	if n == 1 {
+		return "1 " + noun
+	}
+	return fmt.Sprintf("%d %ss", n, noun)
+}
+
+func digestTime(unix int64) string {
+	return time.Unix(unix, 0).Format("2006-01-02 15:04")
+}
+
+// Text renders the digest as plain text.
+func (d Digest) Text() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "%s\n%s to %s\n", d.Subject(), d.From.Format("2006-01-02 15:04"), d.To.Format("2006-01-02 15:04"))
+	for _, section := range []struct {
+		title         string
+		notifications []Notification
+	}{{"New devices", d.NewDevices}, {"Departures", d.Departures}, {"Findings", d.Findings}} {
+		if len(section.notifications) == 0 {
+			continue
+		}
+		fmt.Fprintf(&b, "\n%s\n", section.title)
+		for _, notification := range section.notifications {
+			fmt.Fprintf(&b, "- %s  %s\n", digestTime(notification.Time), notification.Message)
+		}
+	}
+	if d.Dropped > 0 {
+		fmt.Fprintf(&b, "\n%s more not listed\n", plural(d.Dropped, "notification"))
+	}
+	return b.String()
+}
+
+var digestTemplate = template.Must(template.New("digest").Funcs(template.FuncMap{
+	"time": digestTime,
+	"section": func(title string, n []Notification) map[string]interface{} {
+		return map[string]interface{}{"title": title, "n": n}
+	},
+}).Parse(`<!DOCTYPE html>
+<html lang="en">
+<head><meta charset="utf-8"><title>{{.Subject}}</title></head>
+<body style="font: 14px/1.4 -apple-system, 'Helvetica Neue', Arial, sans-serif; color: #222;">
+<h2 style="margin-bottom: 0;">{{.Subject}}</h2>
+<p style="color: #666;">{{.From.Format "2006-01-02 15:04"}} to {{.To.Format "2006-01-02 15:04"}}</p>
+{{define "section"}}{{if .n}}<h3>{{.title}}</h3>
+<table style="border-collapse: collapse;">
+{{range .n}}<tr><td style="padding: 2px 12px 2px 0; color: #666; white-space: nowrap;">{{time .Time}}</td><td>{{.Message}}</td></tr>
+{{end}}</table>
+{{end}}{{end}}{{template "section" (section "New devices" .NewDevices)}}{{template "section" (section "Departures" .Departures)}}{{template "section" (section "Findings" .Findings)}}{{if .Dropped}}<p>{{.Dropped}} more not listed.</p>
+{{end}}</body>
+</html>
+`))
+
+// HTML renders the digest as a self-contained HTML page.
+func (d Digest) HTML() (string, error) {
+	var b strings.Builder
+	err := digestTemplate.Execute(&b, d)
+	return b.String(), err
+}
+
+// render renders the digest in a notifier's format, with its content type.
+func (d Digest) render(format string) (string, []byte, error) {
+	switch format {
+	case digestHTML:
+		html, err := d.HTML()
+		return "text/html; charset=utf-8", []byte(html), err
+	case digestJSON:
+		data, err := json.Marshal(map[string]interface{}{"digest": d, "subject": d.Subject(), "text": d.Text()})
+		return "application/json", data, err
+	default:
+		return "text/plain; charset=utf-8", []byte(d.Text()), nil
+	}
+}
+
+// FlushDigests sends the digests whose period has ended by now. Empty
+// digests aren't sent.
+func (n *Notifiers) FlushDigests(now time.Time) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	for id, notifier := range n.notifiers {
+		state := n.states[id]
+		if notifier.Mode != notifyDigest || now.Before(state.since.Add(notifier.Digest.interval)) {
+			continue
+		}
+		digest := newDigest(notifier, state, now)
+		state.pending, state.dropped, state.since = nil, 0, now
+		if digest.Empty() {
+			continue
+		}
+		contentType, body, err := digest.render(notifier.Digest.Format)
+		if notifier.Payload != nil {
+			contentType = notifier.Payload.ContentType
+			body, err = notifier.Payload.execute(notifier.payloadData(Notification{}, &digest))
+		}
+		if err != nil {
+			state.lastError = err.Error()
+			continue
+		}
+		n.deliver(notifier, "", contentType, body)
+	}
+}
+
+// Run sends digests as their periods end.
+func (n *Notifiers) Run() {
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+	for now := range ticker.C {
+		n.FlushDigests(now)
+	}
+}
+
+// Add validates and stores a new notifier.
+func (n *Notifiers) Add(notifier Notifier) (NotifierStatus, error) {
+	if err := notifier.validate(); err != nil {
+		return NotifierStatus{}, err
+	}
+	if notifier.Secret != "" {
+		var err error
+		if notifier.signingKey, err = lookupSecret(notifier.Secret); err != nil {
+			return NotifierStatus{}, err
+		}
+	}
+	raw := make([]byte, 6)
+	if _, err := rand.Read(raw); err != nil {
+		return NotifierStatus{}, err
+	}
+	notifier.ID = hex.EncodeToString(raw)
+	notifier.CreatedAt = time.Now().Unix()
+	data, err := json.Marshal(notifier)
+	if err != nil {
+		return NotifierStatus{}, err
+	}
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if err := n.store.Put(notifiersBucket, map[string][]byte{notifier.ID: data}); err != nil {
+		return NotifierStatus{}, err
+	}
+	n.notifiers[notifier.ID] = &notifier
+	n.states[notifier.ID] = &notifierState{since: time.Now()}
+	return n.status(notifier.ID), nil
+}
+
+// Remove deletes a notifier and reports whether there was one.
+func (n *Notifiers) Remove(id string) (bool, error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if _, ok := n.notifiers[id]; !ok {
+		return false, nil
+	}
+	if err := n.store.Delete(notifiersBucket, id); err != nil {
+		return false, err
+	}
+	delete(n.notifiers, id)
+	delete(n.states, id)
+	n.dropOutbox(id)
+	return true, nil
+}
+
+// status must be called with n.mu held.
+func (n *Notifiers) status(id string) NotifierStatus {
+	notifier, state := n.notifiers[id], n.states[id]
+	status := NotifierStatus{Notifier: *notifier, Pending: len(state.pending) + state.dropped, Sent: state.sent, LastSent: state.lastSent, LastError: state.lastError}
+	status.Queued, status.DeadLetters = n.queued(id)
+	if notifier.Mode == notifyDigest {
+		status.NextAt = state.since.Add(notifier.Digest.interval).Unix()
+	}
+	return status
+}
+
+// List returns the notifiers with their state, the earliest created first.
+func (n *Notifiers) List() []NotifierStatus {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	list := make([]NotifierStatus, 0, len(n.notifiers))
+	for id := range n.notifiers {
+		list = append(list, n.status(id))
+	}
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].CreatedAt != list[j].CreatedAt {
+			return list[i].CreatedAt < list[j].CreatedAt
+		}
+		return list[i].ID < list[j].ID
+	})
+	return list
+}
+
+// Get returns a notifier with its state, or nil.
+func (n *Notifiers) Get(id string) *NotifierStatus {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if _, ok := n.notifiers[id]; !ok {
+		return nil
+	}
+	status := n.status(id)
+	return &status
+}
+
+// PendingDigest returns the digest a notifier has collected so far, or false
+// for an unknown or event notifier.
+func (n *Notifiers) PendingDigest(id string, now time.Time) (Digest, string, bool) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	notifier, ok := n.notifiers[id]
+	if !ok || notifier.Mode != notifyDigest {
+		return Digest{}, "", false
+	}
+	return newDigest(notifier, n.states[id], now), notifier.Digest.Format, true
+}
+
+// NotifiersHandler handles /api/notifiers: GET lists the notifiers and
+// POST adds one.
+func (s *MDNSServer) NotifiersHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		writeJSON(w, http.StatusOK, map[string]interface{}{"notifiers": s.notifiers.List()})
+
+	case http.MethodPost:
+		var notifier Notifier
+		if err := json.NewDecoder(r.Body).Decode(&notifier); err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		status, err := s.notifiers.Add(notifier)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		writeJSON(w, http.StatusCreated, status)
+
+	default:
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+	}
+}
+
+// NotifierItem handles GET and DELETE /api/notifiers/{id}.
+func (s *MDNSServer) NotifierItem(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	switch r.Method {
+	case http.MethodGet:
+		status := s.notifiers.Get(id)
+		if status == nil {
+			writeError(w, http.StatusNotFound, "no notifier "+id)
+			return
+		}
+		writeJSON(w, http.StatusOK, status)
+
+	case http.MethodDelete:
+		removed, err := s.notifiers.Remove(id)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		if !removed {
+			writeError(w, http.StatusNotFound, "no notifier "+id)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+	}
+}
+
+// NotifierDigest handles GET /api/notifiers/{id}/digest: a preview of the
+// digest a notifier has collected so far, in its format or ?format=,
+// without sending it.
+func (s *MDNSServer) NotifierDigest(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	digest, format, ok := s.notifiers.PendingDigest(r.PathValue("id"), time.Now())
+	if !ok {
+		writeError(w, http.StatusNotFound, "no digest notifier "+r.PathValue("id"))
+		return
+	}
+	if f := r.URL.Query().Get("format"); f != "" {
+		format = f
+	}
+	if format != digestText && format != digestHTML && format != digestJSON {
+		writeError(w, http.StatusBadRequest, "format must be text, html or json")
+		return
+	}
+	contentType, body, err := digest.render(format)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.Write(body)
+}
@@ -0,0 +1,273 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// webhookReceiver records the bodies POSTed to it.
+type webhookReceiver struct {
+	mu     sync.Mutex
+	types  []string
+	bodies []string
+	*httptest.Server
+}
+
+func newWebhookReceiver(t *testing.T) *webhookReceiver {
+	receiver := &webhookReceiver{}
+	receiver.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		receiver.mu.Lock()
+		receiver.types = append(receiver.types, r.Header.Get("Content-Type"))
+		receiver.bodies = append(receiver.bodies, string(body))
+		receiver.mu.Unlock()
+	}))
+	t.Cleanup(receiver.Close)
+	return receiver
+}
+
+func (r *webhookReceiver) received() ([]string, []string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]string(nil), r.types...), append([]string(nil), r.bodies...)
+}
+
+func newNotifyServer(t *testing.T) *MDNSServer {
+	store := openTestStore(t, "json", t.TempDir())
+	server := NewMDNSServer()
+	server.availability, _ = NewAvailabilityTracker(store)
+	server.metadata, _ = NewMetadataStore(store)
+	server.notifiers, _ = NewNotifiers(store, server)
+	return server
+}
+
+// TestNotifierValidate verifies notifier settings are checked and defaulted
+func TestNotifierValidate(t *testing.T) {
+	digest := Notifier{URL: "https://hooks.example.com/nv", Digest: &DigestConfig{Interval: "1d"}}
+	if err := digest.validate(); err != nil {
+		t.Fatalf("Expected a valid digest notifier, got %v", err)
+	}
+	if digest.Mode != notifyDigest || digest.Digest.Format != digestText || digest.Digest.interval != 24*time.Hour {
+		t.Fatalf("Expected a daily text digest, got %+v %+v", digest, digest.Digest)
+	}
+
+	for _, invalid := range []Notifier{
+		{URL: "ftp://example.com"},
+		{URL: "http://example.com", Events: []string{"reboot"}},
+		{URL: "http://example.com", Mode: notifyDigest},
+		{URL: "http://example.com", Mode: notifyEvents, Digest: &DigestConfig{Interval: "1h"}},
+		{URL: "http://example.com", Digest: &DigestConfig{Interval: "10s"}},
+		{URL: "http://example.com", Digest: &DigestConfig{Interval: "1h", Format: "pdf"}},
+		{URL: "http://example.com", Filter: "type="},
+	} {
+		if err := invalid.validate(); err == nil {
+			t.Fatalf("Expected an error for %+v", invalid)
+		}
+	}
+}
+
+// TestNotifierEvents verifies event notifiers get a webhook per new device
+// and departure they subscribed to
+func TestNotifierEvents(t *testing.T) {
+	server := newNotifyServer(t)
+	receiver := newWebhookReceiver(t)
+	added, err := server.notifiers.Add(Notifier{URL: receiver.URL, Events: []string{notifyNewDevice, notifyDeparture}})
+	if err != nil {
+		t.Fatalf("Expected the notifier to be added, got %v", err)
+	}
+
+	printers := newWebhookReceiver(t)
+	server.notifiers.Add(Notifier{URL: printers.URL, Filter: "type=_ipp._tcp"})
+
+	nas := &MDNSService{Name: "NAS", Type: "_smb._tcp.local.", Host: "nas.local.", IP: "192.168.1.20", Port: 445, Site: defaultSite}
+	web := &MDNSService{Name: "NAS web", Type: "_http._tcp.local.", Host: "nas.local.", IP: "192.168.1.20", Port: 80, Site: defaultSite}
+	server.addService("smb", nas)
+	server.addService("http", web)
+	server.bus.Publish(TopicAnomaly, AnomalyEvent{Kind: "arp-conflict", Message: "conflict"})
+	server.forgetServices(func(service *MDNSService) bool { return service.Port == 80 })
+	server.forgetServices(func(service *MDNSService) bool { return true })
+	server.notifiers.deliveries.Wait()
+
+	types, bodies := receiver.received()
+	if len(bodies) != 2 {
+		t.Fatalf("Expected a new-device and a departure webhook, got %v", bodies)
+	}
+	kinds := map[string]string{}
+	for i, body := range bodies {
+		var notification Notification
+		if err := json.Unmarshal([]byte(body), &notification); err != nil || types[i] != "application/json" {
+			t.Fatalf("Expected a JSON notification, got %s %q", types[i], body)
+		}
+		kinds[notification.Kind] = notification.Device
+	}
+	if kinds[notifyNewDevice] != "nas.local" || kinds[notifyDeparture] != "nas.local" {
+		t.Fatalf("Expected nas.local to arrive and leave, got %v", kinds)
+	}
+	if _, bodies := printers.received(); len(bodies) != 0 {
+		t.Fatalf("Expected nothing for the notifier filtering printers, got %v", bodies)
+	}
+	if status := server.notifiers.Get(added.ID); status.Sent != 2 || status.LastError != "" {
+		t.Fatalf("Expected 2 deliveries, got %+v", status)
+	}
+}
+
+// TestNotifierSecret verifies deliveries are signed with the notifier's
+// secret, and that a notifier can't name a secret that isn't set
+func TestNotifierSecret(t *testing.T) {
+	k := useMemoryKeychain(t)
+	server := newNotifyServer(t)
+	signatures := make(chan string, 1)
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		if r.Header.Get(signatureHeader) == signature("hook key", body) {
+			signatures <- r.Header.Get(signatureHeader)
+		}
+		close(signatures)
+	}))
+	defer receiver.Close()
+
+	if _, err := server.notifiers.Add(Notifier{URL: receiver.URL, Secret: "webhook-ops"}); err == nil {
+		t.Fatalf("Expected a notifier with an unset secret to be rejected")
+	}
+	k.Set(secretsService, "webhook-ops", "hook key")
+	if _, err := server.notifiers.Add(Notifier{URL: receiver.URL, Secret: "webhook-ops"}); err != nil {
+		t.Fatalf("Expected the notifier to be added, got %v", err)
+	}
+	server.bus.Publish(TopicAnomaly, AnomalyEvent{Kind: "arp-conflict", Message: "conflict"})
+	server.notifiers.deliveries.Wait()
+	if sig := <-signatures; !strings.HasPrefix(sig, "sha256=") {
+		t.Fatalf("Expected a signed delivery")
+	}
+}
+
+// TestNotifierDigest verifies digest notifiers collect notifications and
+// send one summary per period, skipping empty ones
+func TestNotifierDigest(t *testing.T) {
+	server := newNotifyServer(t)
+	receiver := newWebhookReceiver(t)
+	status, _ := server.notifiers.Add(Notifier{Name: "Daily", URL: receiver.URL, Digest: &DigestConfig{Interval: "1h", Format: digestHTML}})
+
+	server.addService("a", &MDNSService{Name: "TV", Type: "_airplay._tcp.local.", Host: "tv.local.", IP: "192.168.1.40", Port: 7000, Site: defaultSite})
+	server.bus.Publish(TopicAnomaly, newAnomaly("expectation", "expectation-failed", map[string]string{"device": "<nas>", "service": "_smb._tcp", "error": "refused"}))
+	server.notifiers.deliveries.Wait()
+	if _, bodies := receiver.received(); len(bodies) != 0 {
+		t.Fatalf("Expected nothing sent before the digest is due, got %v", bodies)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/api/notifiers/"+status.ID+"/digest?format=text", nil)
+	req.SetPathValue("id", status.ID)
+	w := httptest.NewRecorder()
+	server.NotifierDigest(w, req)
+	if w.Code != http.StatusOK || !strings.HasPrefix(w.Body.String(), "Network digest: 1 new device, 0 departures, 1 finding") || !strings.Contains(w.Body.String(), "New device tv.local") {
+		t.Fatalf("Expected a text preview, got %d %s", w.Code, w.Body.String())
+	}
+
+	server.notifiers.FlushDigests(time.Now().Add(30 * time.Minute))
+	server.notifiers.deliveries.Wait()
+	if _, bodies := receiver.received(); len(bodies) != 0 {
+		t.Fatalf("Expected no digest before the hour is up, got %v", bodies)
+	}
+	server.notifiers.FlushDigests(time.Now().Add(time.Hour))
+	server.notifiers.deliveries.Wait()
+	types, bodies := receiver.received()
+	if len(bodies) != 1 || !strings.HasPrefix(types[0], "text/html") {
+		t.Fatalf("Expected one HTML digest, got %v", types)
+	}
+	if !strings.Contains(bodies[0], "1 new device, 0 departures, 1 finding") || !strings.Contains(bodies[0], "&lt;nas&gt;") {
+		t.Fatalf("Expected the digest to list what happened, escaped, got %s", bodies[0])
+	}
+
+	server.notifiers.FlushDigests(time.Now().Add(3 * time.Hour))
+	server.notifiers.deliveries.Wait()
+	if _, bodies := receiver.received(); len(bodies) != 1 {
+		t.Fatalf("Expected the empty digest to be skipped, got %d", len(bodies))
+	}
+}
+
+// TestNotifiersHandler verifies notifiers are added, persisted, listed and
+// removed over the API
+func TestNotifiersHandler(t *testing.T) {
+	dir := t.TempDir()
+	store := openTestStore(t, "json", dir)
+	server := NewMDNSServer()
+	server.notifiers, _ = NewNotifiers(store, server)
+
+	w := httptest.NewRecorder()
+	server.NotifiersHandler(w, httptest.NewRequest(http.MethodPost, "/api/notifiers", strings.NewReader(`{"url":"ftp://x"}`)))
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("Expected 400 for an invalid URL, got %d", w.Code)
+	}
+	w = httptest.NewRecorder()
+	server.NotifiersHandler(w, httptest.NewRequest(http.MethodPost, "/api/notifiers", strings.NewReader(`{"url":"http://hooks.local/nv","digest":{"interval":"1d"}}`)))
+	var created NotifierStatus
+	if json.Unmarshal(w.Body.Bytes(), &created); w.Code != http.StatusCreated || created.ID == "" || created.NextAt == 0 {
+		t.Fatalf("Expected the notifier to be created, got %d %s", w.Code, w.Body.String())
+	}
+
+	reloaded, err := NewNotifiers(store, NewMDNSServer())
+	if err != nil || len(reloaded.List()) != 1 || reloaded.List()[0].Digest.Interval != "1d" {
+		t.Fatalf("Expected the notifier to be persisted, got %v", err)
+	}
+
+	req := httptest.NewRequest(http.MethodDelete, "/api/notifiers/"+created.ID, nil)
+	req.SetPathValue("id", created.ID)
+	w = httptest.NewRecorder()
+	server.NotifierItem(w, req)
+	if w.Code != http.StatusNoContent || len(server.notifiers.List()) != 0 {
+		t.Fatalf("Expected the notifier to be removed, got %d", w.Code)
+	}
+	w = httptest.NewRecorder()
+	server.NotifierItem(w, req)
+	if w.Code != http.StatusNotFound {
+		t.Fatalf("Expected 404 for a removed notifier, got %d", w.Code)
+	}
+}
+
+// TestNotifierDeviceOrder verifies a receiver gets the notifications of a
+// device in order, even when an earlier delivery is slow
+func TestNotifierDeviceOrder(t *testing.T) {
+	server := newNotifyServer(t)
+	release := make(chan struct{})
+	var mu sync.Mutex
+	var seqs []uint64
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var notification Notification
+		json.NewDecoder(r.Body).Decode(&notification)
+		if notification.Seq == 1 {
+			<-release
+		}
+		mu.Lock()
+		seqs = append(seqs, notification.Seq)
+		mu.Unlock()
+	}))
+	defer receiver.Close()
+	server.notifiers.Add(Notifier{URL: receiver.URL})
+
+	for seq := uint64(1); seq <= 3; seq++ {
+		server.notifiers.Notify(Notification{Kind: notifyFinding, Device: "nas.local", Message: "finding", Seq: seq})
+	}
+	server.notifiers.Notify(Notification{Kind: notifyFinding, Device: "tv.local", Message: "finding", Seq: 4})
+	for deadline := time.Now().Add(2 * time.Second); ; time.Sleep(time.Millisecond) {
+		mu.Lock()
+		n := len(seqs)
+		mu.Unlock()
+		if n == 1 || time.Now().After(deadline) {
+			break
+		}
+	}
+	close(release)
+	server.notifiers.deliveries.Wait()
+
+	if len(seqs) != 4 || seqs[0] != 4 || seqs[1] != 1 || seqs[2] != 2 || seqs[3] != 3 {
+		t.Fatalf("Expected the other device first and then nas.local's in order, got %v", seqs)
+	}
+	if len(server.notifiers.lanes) != 0 {
+		t.Fatalf("Expected no lanes left once delivered, got %d", len(server.notifiers.lanes))
+	}
+}
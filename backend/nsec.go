@@ -0,0 +1,137 @@
+package main
+
+import (
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// negativeTypes are the record types queries are suppressed for: those
+// resolving a host or an instance.
+var negativeTypes = []uint16{dns.TypeA, dns.TypeAAAA, dns.TypeSRV}
+
+// negativeSweep is the number of absences past which expired ones are
+// swept, as names that aren't asked about again are never looked up.
+const negativeSweep = 1024
+
+// maxNegativeEntries bounds the absences remembered, so responders can't
+// grow the cache without end with NSEC records for made-up names.
+const maxNegativeEntries = 4 * negativeSweep
+
+// negativeKey is a record type a name doesn't have.
+type negativeKey struct {
+	name  string // lower case, fully qualified
+	qtype uint16
+}
+
+// NegativeCache remembers the records responders said don't exist. An mDNS
+// responder answers a query for a type a name doesn't have with an NSEC
+// record listing the types it does have (RFC 6762 §6.1), e.g. no A record
+// for an IPv6-only host. Until the NSEC record's TTL runs out, queries for
+// the other types are pointless and not sent.
+type NegativeCache struct {
+	mu      sync.Mutex
+	absent  map[negativeKey]time.Time // until when
+	entries atomic.Int64              // len(absent), read without the lock
+	// suppressed counts the queries not sent
+	suppressed atomic.Uint64
+}
+
+func NewNegativeCache() *NegativeCache {
+	return &NegativeCache{absent: make(map[negativeKey]time.Time)}
+}
+
+// observe records the NSEC records of a packet, and forgets the absence
+// of the records it has. It runs for every packet the listener receives,
+// so it returns at once for the usual packet without NSEC records while no
+// absence is known.
+func (c *NegativeCache) observe(msg *dns.Msg, now time.Time) {
+	for _, section := range [][]dns.RR{msg.Answer, msg.Extra} {
+		for _, rr := range section {
+			var nsec *dns.NSEC
+			switch rr := rr.(type) {
+			case *dns.NSEC:
+				nsec = rr
+			case *dns.A, *dns.AAAA, *dns.SRV:
+				if c.entries.Load() == 0 {
+					continue
+				}
+			default:
+				continue
+			}
+			c.mu.Lock()
+			if nsec != nil {
+				c.record(nsec, now)
+			} else {
+				c.forget(negativeKey{strings.ToLower(rr.Header().Name), rr.Header().Rrtype})
+			}
+			c.mu.Unlock()
+		}
+	}
+}
+
+// record marks the types an NSEC record leaves out as absent, and those it
+// lists as present. It must be called with c.mu held.
+func (c *NegativeCache) record(nsec *dns.NSEC, now time.Time) {
+	if len(c.absent) >= negativeSweep {
+		for key, until := range c.absent {
+			if !now.Before(until) {
+				c.forget(key)
+			}
+		}
+	}
+	name := strings.ToLower(nsec.Hdr.Name)
+	until := now.Add(time.Duration(nsec.Hdr.Ttl) * time.Second)
+	for _, qtype := range negativeTypes {
+		key := negativeKey{name, qtype}
+		if nsec.Hdr.Ttl == 0 || slices.Contains(nsec.TypeBitMap, qtype) {
+			c.forget(key)
+		} else if _, ok := c.absent[key]; ok {
+			c.absent[key] = until
+		} else if len(c.absent) < maxNegativeEntries {
+			c.absent[key] = until
+			c.entries.Add(1)
+		}
+	}
+}
+
+// forget drops an absence. It must be called with c.mu held.
+func (c *NegativeCache) forget(key negativeKey) {
+	if _, ok := c.absent[key]; ok {
+		delete(c.absent, key)
+		c.entries.Add(-1)
+	}
+}
+
+// Absent reports whether a responder said name has no record of qtype, as
+// of now, and counts the query not sent if so.
+func (c *NegativeCache) Absent(name string, qtype uint16, now time.Time) bool {
+	if c.entries.Load() == 0 {
+		return false
+	}
+	key := negativeKey{strings.ToLower(dns.Fqdn(name)), qtype}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	until, ok := c.absent[key]
+	if !ok {
+		return false
+	}
+	if !now.Before(until) {
+		c.forget(key)
+		return false
+	}
+	c.suppressed.Add(1)
+	return true
+}
+
+// Status is the nsec section of /api/status.
+func (c *NegativeCache) Status() map[string]interface{} {
+	return map[string]interface{}{
+		"absent":     c.entries.Load(),
+		"suppressed": c.suppressed.Load(),
+	}
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// TestNegativeCache verifies an NSEC record marks the types it leaves out
+// as absent until its TTL runs out, and a record of the type seen later
+// clears that
+func TestNegativeCache(t *testing.T) {
+	cache := NewNegativeCache()
+	now := time.Now()
+	msg := new(dns.Msg)
+	msg.Answer = []dns.RR{&dns.AAAA{Hdr: dns.RR_Header{Name: "nas.local.", Rrtype: dns.TypeAAAA, Class: dns.ClassINET, Ttl: 120}, AAAA: net.ParseIP("2001:db8::5")}}
+	msg.Extra = []dns.RR{&dns.NSEC{Hdr: dns.RR_Header{Name: "nas.local.", Rrtype: dns.TypeNSEC, Class: dns.ClassINET, Ttl: 120}, NextDomain: "nas.local.", TypeBitMap: []uint16{dns.TypeAAAA}}}
+	cache.observe(msg, now)
+
+	if !cache.Absent("NAS.local", dns.TypeA, now.Add(time.Minute)) {
+		t.Fatalf("Expected the A record of an IPv6-only host to be absent")
+	}
+	if cache.Absent("nas.local", dns.TypeAAAA, now) {
+		t.Fatalf("Expected the AAAA record the NSEC lists to be present")
+	}
+	if cache.Absent("nas.local", dns.TypeA, now.Add(3*time.Minute)) {
+		t.Fatalf("Expected the absence to end with the NSEC record's TTL")
+	}
+
+	cache.observe(msg, now)
+	a := new(dns.Msg)
+	a.Answer = []dns.RR{&dns.A{Hdr: dns.RR_Header{Name: "nas.local.", Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 120}, A: net.IPv4(10, 0, 0, 5)}}
+	cache.observe(a, now)
+	if cache.Absent("nas.local", dns.TypeA, now) {
+		t.Fatalf("Expected an A record to clear the absence")
+	}
+	if status := cache.Status(); status["suppressed"] != uint64(1) {
+		t.Fatalf("Expected 1 suppressed query, got %v", status)
+	}
+}
+
+// TestHandleMDNSPacketNSEC verifies the listener records the NSEC records
+// of the responses it sees
+func TestHandleMDNSPacketNSEC(t *testing.T) {
+	server := NewMDNSServer()
+	msg := new(dns.Msg)
+	msg.Response = true
+	msg.Answer = []dns.RR{&dns.NSEC{Hdr: dns.RR_Header{Name: "printer._ipp._tcp.local.", Rrtype: dns.TypeNSEC, Class: dns.ClassINET, Ttl: 4500}, NextDomain: "printer._ipp._tcp.local.", TypeBitMap: []uint16{dns.TypeTXT}}}
+	handleMDNSPacket(server, msg, "en0", nil, time.Now())
+	if !server.negative.Absent("printer._ipp._tcp.local.", dns.TypeSRV, time.Now()) {
+		t.Fatalf("Expected the SRV record the NSEC leaves out to be absent")
+	}
+}
@@ -0,0 +1,350 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// outboxBucket is the Store bucket queued and dead-lettered webhook
+// deliveries are kept in.
+const outboxBucket = "outbox"
+
+// Webhook deliveries are retried with exponential backoff, from
+// outboxBackoff after the first failure up to outboxMaxBackoff, and
+// dead-lettered after outboxMaxAttempts attempts, about 14 hours in.
+const (
+	outboxBackoff     = 5 * time.Second
+	outboxMaxBackoff  = 4 * time.Hour
+	outboxMaxAttempts = 15
+)
+
+// maxDeadLetters bounds the dead letters kept per notifier; the oldest are
+// dropped first.
+const maxDeadLetters = 1000
+
+// outboxEntry is a webhook delivery that hasn't succeeded yet. Entries are
+// persisted until they are delivered, so a restart doesn't lose them.
+type outboxEntry struct {
+	ID          string `json:"id"` // increasing in the order they were queued
+	Notifier    string `json:"notifier"`
+	Device      string `json:"device,omitempty"` // site key; "" for digests
+	ContentType string `json:"contentType"`
+	Body        []byte `json:"body"`
+	QueuedAt    int64  `json:"queuedAt"`
+	Attempts    int    `json:"attempts"`
+	NextAt      int64  `json:"nextAt,omitempty"` // of the next retry
+	LastError   string `json:"lastError,omitempty"`
+	Dead        bool   `json:"dead,omitempty"`
+}
+
+// lane is where an entry waits: the queue of its notifier and device, so
+// the deliveries about one device go out one after the other, in order.
+func (e *outboxEntry) lane() string {
+	return e.Notifier + "/" + e.Device
+}
+
+// outboxBackoffAfter returns how long to wait before retrying a delivery
+// that failed attempts times.
+func outboxBackoffAfter(base time.Duration, attempts int) time.Duration {
+	d := base
+	for i := 1; i < attempts && d < outboxMaxBackoff; i++ {
+		d *= 2
+	}
+	return min(d, outboxMaxBackoff)
+}
+
+// loadOutbox queues the deliveries left from before a restart and starts
+// sending them. It must be called with n.mu held.
+func (n *Notifiers) loadOutbox() error {
+	entries, err := n.store.Load(outboxBucket)
+	if err != nil {
+		return err
+	}
+	var queued []*outboxEntry
+	for key, data := range entries {
+		entry := &outboxEntry{}
+		if err := json.Unmarshal(data, entry); err != nil {
+			return fmt.Errorf("outbox entry %s: %v", key, err)
+		}
+		if id, err := strconv.ParseUint(entry.ID, 10, 64); err == nil && id > n.lastEntry {
+			n.lastEntry = id
+		}
+		if _, ok := n.notifiers[entry.Notifier]; !ok {
+			// The notifier was removed while its deliveries were queued
+			n.store.Delete(outboxBucket, key)
+		} else if entry.Dead {
+			n.dead = append(n.dead, entry)
+		} else {
+			queued = append(queued, entry)
+		}
+	}
+	sort.Slice(n.dead, func(i, j int) bool { return n.dead[i].ID < n.dead[j].ID })
+	sort.Slice(queued, func(i, j int) bool { return queued[i].ID < queued[j].ID })
+	for _, entry := range queued {
+		n.queue(entry)
+	}
+	if len(queued) > 0 {
+		log.Printf("📬 Resuming %s to notifiers", plural(len(queued), "queued delivery"))
+	}
+	return nil
+}
+
+// enqueue persists a delivery and queues it in its lane. It must be called
+// with n.mu held.
+func (n *Notifiers) enqueue(notifier *Notifier, device, contentType string, body []byte) {
+	n.lastEntry++
+	entry := &outboxEntry{
+		ID:          fmt.Sprintf("%020d", n.lastEntry),
+		Notifier:    notifier.ID,
+		Device:      device,
+		ContentType: contentType,
+		Body:        body,
+		QueuedAt:    time.Now().Unix(),
+	}
+	if err := n.persist(entry); err != nil {
+		// It is still delivered, but lost on restart
+		log.Printf("⚠️  Notifier %s: can't persist delivery: %v", notifier.ID, err)
+	}
+	n.queue(entry)
+}
+
+// queue appends an entry to its lane, and starts sending the lane if it
+// was idle. It must be called with n.mu held.
+func (n *Notifiers) queue(entry *outboxEntry) {
+	lane := entry.lane()
+	n.deliveries.Add(1)
+	n.lanes[lane] = append(n.lanes[lane], entry)
+	if len(n.lanes[lane]) == 1 {
+		go n.send(lane)
+	}
+}
+
+func (n *Notifiers) persist(entry *outboxEntry) error {
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	return n.store.Put(outboxBucket, map[string][]byte{entry.ID: data})
+}
+
+// send tries the delivery at the head of a lane. Once it is delivered or
+// dead-lettered it goes on with the next one; after a failure it retries
+// later.
+func (n *Notifiers) send(lane string) {
+	n.mu.Lock()
+	if len(n.lanes[lane]) == 0 {
+		n.mu.Unlock()
+		return
+	}
+	entry := n.lanes[lane][0]
+	notifier, ok := n.notifiers[entry.Notifier]
+	var target, key, secret string
+	if ok {
+		target, key, secret = notifier.URL, notifier.signingKey, notifier.Secret
+	}
+	n.mu.Unlock()
+
+	var err error
+	switch {
+	case !ok:
+		// Removed, which dropped the lane; nothing to do
+		return
+	case secret != "" && key == "":
+		err = fmt.Errorf("secret %s is not set", secret)
+	default:
+		err = n.post(target, entry.ContentType, key, entry.Body)
+	}
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	state, ok := n.states[entry.Notifier]
+	if !ok || len(n.lanes[lane]) == 0 || n.lanes[lane][0] != entry {
+		return
+	}
+	entry.Attempts++
+	if err == nil {
+		state.sent++
+		state.lastSent, state.lastError = time.Now().Unix(), ""
+		n.store.Delete(outboxBucket, entry.ID)
+		n.advance(lane)
+		return
+	}
+
+	log.Printf("⚠️  Notifier %s: %v", entry.Notifier, err)
+	state.lastError = err.Error()
+	entry.LastError = err.Error()
+	if entry.Attempts >= outboxMaxAttempts {
+		log.Printf("⚠️  Notifier %s: giving up on a delivery after %d attempts", entry.Notifier, entry.Attempts)
+		entry.Dead, entry.NextAt = true, 0
+		n.persist(entry)
+		n.deadLetter(entry)
+		n.advance(lane)
+		return
+	}
+	delay := outboxBackoffAfter(n.backoff, entry.Attempts)
+	entry.NextAt = time.Now().Add(delay).Unix()
+	n.persist(entry)
+	time.AfterFunc(delay, func() { n.send(lane) })
+}
+
+// advance drops the head of a lane, which is done, and starts on the next
+// delivery. It must be called with n.mu held.
+func (n *Notifiers) advance(lane string) {
+	n.lanes[lane] = n.lanes[lane][1:]
+	if len(n.lanes[lane]) == 0 {
+		delete(n.lanes, lane)
+	} else {
+		go n.send(lane)
+	}
+	n.deliveries.Done()
+}
+
+// deadLetter keeps an entry that won't be retried, dropping the notifier's
+// oldest beyond maxDeadLetters. It must be called with n.mu held.
+func (n *Notifiers) deadLetter(entry *outboxEntry) {
+	n.dead = append(n.dead, entry)
+	if _, dead := n.queued(entry.Notifier); dead <= maxDeadLetters {
+		return
+	}
+	for i, e := range n.dead {
+		if e.Notifier == entry.Notifier {
+			n.store.Delete(outboxBucket, e.ID)
+			n.dead = append(n.dead[:i], n.dead[i+1:]...)
+			return
+		}
+	}
+}
+
+// takeDead removes a notifier's dead letters and returns them, the oldest
+// first. It must be called with n.mu held.
+func (n *Notifiers) takeDead(id string) []*outboxEntry {
+	var taken []*outboxEntry
+	kept := n.dead[:0]
+	for _, entry := range n.dead {
+		if entry.Notifier == id {
+			taken = append(taken, entry)
+		} else {
+			kept = append(kept, entry)
+		}
+	}
+	n.dead = kept
+	return taken
+}
+
+// dropOutbox forgets the queued and dead-lettered deliveries of a removed
+// notifier. It must be called with n.mu held.
+func (n *Notifiers) dropOutbox(id string) {
+	var keys []string
+	for lane, entries := range n.lanes {
+		if entries[0].Notifier != id {
+			continue
+		}
+		for _, entry := range entries {
+			keys = append(keys, entry.ID)
+			n.deliveries.Done()
+		}
+		delete(n.lanes, lane)
+	}
+	for _, entry := range n.takeDead(id) {
+		keys = append(keys, entry.ID)
+	}
+	if len(keys) > 0 {
+		n.store.Delete(outboxBucket, keys...)
+	}
+}
+
+// queued returns how many deliveries of a notifier are waiting and how
+// many were dead-lettered. It must be called with n.mu held.
+func (n *Notifiers) queued(id string) (queued, dead int) {
+	for _, entries := range n.lanes {
+		if entries[0].Notifier == id {
+			queued += len(entries)
+		}
+	}
+	for _, entry := range n.dead {
+		if entry.Notifier == id {
+			dead++
+		}
+	}
+	return queued, dead
+}
+
+// DeadLetters returns a notifier's dead-lettered deliveries, the oldest
+// first, or false for an unknown notifier.
+func (n *Notifiers) DeadLetters(id string) ([]outboxEntry, bool) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if _, ok := n.notifiers[id]; !ok {
+		return nil, false
+	}
+	list := []outboxEntry{}
+	for _, entry := range n.dead {
+		if entry.Notifier == id {
+			list = append(list, *entry)
+		}
+	}
+	return list, true
+}
+
+// Redeliver queues a notifier's dead-lettered deliveries again, with a
+// fresh set of attempts, and returns how many there were.
+func (n *Notifiers) Redeliver(id string) int {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	retry := n.takeDead(id)
+	for _, entry := range retry {
+		entry.Dead, entry.Attempts, entry.LastError = false, 0, ""
+		n.persist(entry)
+		n.queue(entry)
+	}
+	return len(retry)
+}
+
+// DiscardDeadLetters forgets a notifier's dead-lettered deliveries and
+// returns how many there were.
+func (n *Notifiers) DiscardDeadLetters(id string) (int, error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	var keys []string
+	for _, entry := range n.takeDead(id) {
+		keys = append(keys, entry.ID)
+	}
+	if len(keys) == 0 {
+		return 0, nil
+	}
+	return len(keys), n.store.Delete(outboxBucket, keys...)
+}
+
+// NotifierDeadLetters handles /api/notifiers/{id}/dead-letters: GET lists
+// the deliveries that were given up on, POST queues them again and DELETE
+// discards them.
+func (s *MDNSServer) NotifierDeadLetters(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	entries, ok := s.notifiers.DeadLetters(id)
+	if !ok {
+		writeError(w, http.StatusNotFound, "no notifier "+id)
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+		writeJSON(w, http.StatusOK, map[string]interface{}{"deadLetters": entries})
+
+	case http.MethodPost:
+		writeJSON(w, http.StatusOK, map[string]int{"requeued": s.notifiers.Redeliver(id)})
+
+	case http.MethodDelete:
+		if _, err := s.notifiers.DiscardDeadLetters(id); err != nil {
+			writeError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+	}
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// TestOutboxBackoff verifies retries back off exponentially up to the cap
+func TestOutboxBackoff(t *testing.T) {
+	for attempts, want := range map[int]time.Duration{1: 5 * time.Second, 2: 10 * time.Second, 4: 40 * time.Second, 20: outboxMaxBackoff} {
+		if got := outboxBackoffAfter(outboxBackoff, attempts); got != want {
+			t.Fatalf("Expected %v after %d attempts, got %v", want, attempts, got)
+		}
+	}
+}
+
+// TestOutboxRetry verifies a delivery the receiver refuses is retried
+// until it goes through, and the later ones about the device wait for it
+func TestOutboxRetry(t *testing.T) {
+	server := newNotifyServer(t)
+	server.notifiers.backoff = time.Millisecond
+	var calls atomic.Int32
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if calls.Add(1) <= 2 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer receiver.Close()
+	added, _ := server.notifiers.Add(Notifier{URL: receiver.URL})
+
+	server.notifiers.Notify(Notification{Kind: notifyFinding, Device: "nas.local", Message: "first"})
+	server.notifiers.Notify(Notification{Kind: notifyFinding, Device: "nas.local", Message: "second"})
+	server.notifiers.deliveries.Wait()
+
+	if status := server.notifiers.Get(added.ID); calls.Load() != 4 || status.Sent != 2 || status.Queued != 0 || status.LastError != "" {
+		t.Fatalf("Expected two failures and two deliveries, got %d calls and %+v", calls.Load(), status)
+	}
+	if entries, _ := server.notifiers.store.Load(outboxBucket); len(entries) != 0 {
+		t.Fatalf("Expected the outbox to be empty once delivered, got %d entries", len(entries))
+	}
+}
+
+// TestOutboxDeadLetter verifies a delivery is given up on after the last
+// attempt, kept as a dead letter and can be queued again
+func TestOutboxDeadLetter(t *testing.T) {
+	server := newNotifyServer(t)
+	server.notifiers.backoff = time.Microsecond
+	var up atomic.Bool
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !up.Load() {
+			w.WriteHeader(http.StatusBadGateway)
+		}
+	}))
+	defer receiver.Close()
+	added, _ := server.notifiers.Add(Notifier{URL: receiver.URL})
+
+	server.notifiers.Notify(Notification{Kind: notifyFinding, Device: "nas.local", Message: "finding"})
+	server.notifiers.deliveries.Wait()
+	dead, _ := server.notifiers.DeadLetters(added.ID)
+	if len(dead) != 1 || dead[0].Attempts != outboxMaxAttempts || !dead[0].Dead || dead[0].LastError == "" {
+		t.Fatalf("Expected a dead letter after %d attempts, got %+v", outboxMaxAttempts, dead)
+	}
+
+	up.Store(true)
+	if n := server.notifiers.Redeliver(added.ID); n != 1 {
+		t.Fatalf("Expected the dead letter to be queued again, got %d", n)
+	}
+	server.notifiers.deliveries.Wait()
+	if status := server.notifiers.Get(added.ID); status.Sent != 1 || status.DeadLetters != 0 {
+		t.Fatalf("Expected the redelivery to go through, got %+v", status)
+	}
+}
+
+// TestOutboxRestart verifies deliveries queued before a restart are sent
+// once the notifiers are loaded again
+func TestOutboxRestart(t *testing.T) {
+	store := openTestStore(t, "json", t.TempDir())
+	server := NewMDNSServer()
+	server.metadata, _ = NewMetadataStore(store)
+	notifiers, _ := NewNotifiers(store, server)
+	notifiers.backoff = time.Hour
+	var calls atomic.Int32
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if calls.Add(1) == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer receiver.Close()
+	added, _ := notifiers.Add(Notifier{URL: receiver.URL})
+	notifiers.Notify(Notification{Kind: notifyFinding, Device: "nas.local", Message: "finding"})
+	for notifiers.Get(added.ID).LastError == "" {
+		time.Sleep(time.Millisecond)
+	}
+
+	restarted, err := NewNotifiers(store, server)
+	if err != nil {
+		t.Fatalf("Expected the notifiers to load, got %v", err)
+	}
+	restarted.deliveries.Wait()
+	if status := restarted.Get(added.ID); calls.Load() != 2 || status.Sent != 1 {
+		t.Fatalf("Expected the queued delivery to be sent after the restart, got %d calls and %+v", calls.Load(), status)
+	}
+}
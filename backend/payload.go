@@ -0,0 +1,138 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// PayloadTemplate replaces what a notifier POSTs with the output of a Go
+// text/template, e.g. to match the schema of an existing incident system.
+// Event notifiers execute it for every notification, digest notifiers for
+// every digest, with a PayloadData.
+type PayloadTemplate struct {
+	Template    string `json:"template"`
+	ContentType string `json:"contentType,omitempty"` // default application/json
+
+	parsed *template.Template
+}
+
+// PayloadData is what payload templates are executed with. Event
+// notifiers fill in the notification's fields (.Kind, .Device, .Message...)
+// and .Service, digest notifiers .Digest.
+type PayloadData struct {
+	Notification
+	Service  *MDNSService `json:"service,omitempty"` // the service that arrived or left, if any
+	Digest   *Digest      `json:"digest,omitempty"`
+	Notifier string       `json:"notifier"` // the notifier's name, or else its ID
+}
+
+// payloadFuncs are the functions payload templates can use besides the
+// built-in ones.
+var payloadFuncs = template.FuncMap{
+	// json encodes a value, e.g. {{json .Message}} for a quoted string
+	"json": func(v interface{}) (string, error) {
+		data, err := json.Marshal(v)
+		return string(data), err
+	},
+	// rfc3339 formats a Unix time or a time.Time
+	"rfc3339": func(v interface{}) (string, error) {
+		switch t := v.(type) {
+		case int64:
+			return time.Unix(t, 0).UTC().Format(time.RFC3339), nil
+		case time.Time:
+			return t.UTC().Format(time.RFC3339), nil
+		}
+		return "", fmt.Errorf("rfc3339: %T is not a time", v)
+	},
+	"upper": strings.ToUpper,
+	"lower": strings.ToLower,
+	// default returns fallback for an empty value
+	"default": func(fallback, v string) string {
+		if v == "" {
+			return fallback
+		}
+		return v
+	},
+}
+
+// samplePayloads are what templates are tried with when they are loaded,
+// one for each kind of notification and a digest holding them.
+func samplePayloads() []PayloadData {
+	service := &MDNSService{Name: "NAS", Type: "_smb._tcp.local.", Host: "nas.local.", IP: "192.168.1.20", Port: 445, Site: defaultSite}
+	anomaly := newAnomaly("arp-conflict", "anomaly.arp-conflict", map[string]string{"ip": "192.168.1.20"})
+	notifications := []Notification{
+		{Kind: notifyNewDevice, Time: 1699564800, Site: defaultSite, Device: "nas.local", Message: "New device nas.local"},
+		{Kind: notifyDeparture, Time: 1699564800, Site: defaultSite, Device: "nas.local", Message: "nas.local left"},
+		{Kind: notifyFinding, Time: 1699564800, Device: "nas.local", Message: anomaly.Message, Anomaly: &anomaly},
+	}
+	var samples []PayloadData
+	for _, notification := range notifications {
+		sample := PayloadData{Notification: notification, Notifier: "sample"}
+		if notification.Kind != notifyFinding {
+			sample.Service = service
+		}
+		samples = append(samples, sample)
+	}
+	digest := &Digest{Notifier: "sample", From: time.Unix(1699478400, 0), To: time.Unix(1699564800, 0),
+		NewDevices: notifications[:1], Departures: notifications[1:2], Findings: notifications[2:]}
+	return append(samples, PayloadData{Digest: digest, Notifier: "sample"})
+}
+
+// validate parses the template and executes it with sample notifications,
+// so mistakes such as unknown fields are found when the notifier is
+// configured rather than when it first fires. JSON payloads must come out
+// as valid JSON.
+func (p *PayloadTemplate) validate(mode string) error {
+	if strings.TrimSpace(p.Template) == "" {
+		return fmt.Errorf("payload template is empty")
+	}
+	if p.ContentType == "" {
+		p.ContentType = "application/json"
+	}
+	parsed, err := template.New("payload").Funcs(payloadFuncs).Option("missingkey=error").Parse(p.Template)
+	if err != nil {
+		return fmt.Errorf("payload template: %v", err)
+	}
+	p.parsed = parsed
+	for _, sample := range samplePayloads() {
+		if (mode == notifyDigest) != (sample.Digest != nil) {
+			continue
+		}
+		body, err := p.execute(sample)
+		if err != nil {
+			return fmt.Errorf("payload template: %v", err)
+		}
+		if strings.Contains(p.ContentType, "json") && !json.Valid(body) {
+			return fmt.Errorf("payload template doesn't produce valid JSON for a %s: %s", sampleKind(sample), body)
+		}
+	}
+	return nil
+}
+
+func sampleKind(sample PayloadData) string {
+	if sample.Digest != nil {
+		return "digest"
+	}
+	return sample.Kind
+}
+
+func (p *PayloadTemplate) execute(data PayloadData) ([]byte, error) {
+	var b bytes.Buffer
+	if err := p.parsed.Execute(&b, data); err != nil {
+		return nil, err
+	}
+	return b.Bytes(), nil
+}
+
+// payloadData is what a notifier's template is executed with.
+func (n *Notifier) payloadData(notification Notification, digest *Digest) PayloadData {
+	name := n.Name
+	if name == "" {
+		name = n.ID
+	}
+	return PayloadData{Notification: notification, Service: notification.service, Digest: digest, Notifier: name}
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+)
+
+const incidentTemplate = `{"summary": {{json .Message}}, "severity": "{{if eq .Kind "finding"}}warning{{else}}info{{end}}", "source": {{json (default "unknown" .Device)}}, "timestamp": "{{rfc3339 .Time}}"{{with .Service}}, "ip": {{json .IP}}{{end}}}`
+
+// TestPayloadTemplateValidate verifies templates are parsed and tried
+// with sample notifications when a notifier is configured
+func TestPayloadTemplateValidate(t *testing.T) {
+	valid := Notifier{URL: "https://hooks.example.com/nv", Payload: &PayloadTemplate{Template: incidentTemplate}}
+	if err := valid.validate(); err != nil {
+		t.Fatalf("Expected the incident template to be valid, got %v", err)
+	}
+	if valid.Payload.ContentType != "application/json" {
+		t.Fatalf("Expected JSON payloads by default, got %q", valid.Payload.ContentType)
+	}
+	digest := Notifier{URL: "https://hooks.example.com/nv", Digest: &DigestConfig{Interval: "1d"},
+		Payload: &PayloadTemplate{Template: `{{.Digest.Subject}}: {{len .Digest.NewDevices}} new`, ContentType: "text/plain"}}
+	if err := digest.validate(); err != nil {
+		t.Fatalf("Expected the digest template to be valid, got %v", err)
+	}
+
+	for template, want := range map[string]string{
+		"":                             "empty",
+		`{{.Message`:                   "unclosed action",
+		`{{.Nope}}`:                    "can't evaluate field Nope",
+		`{"ip": {{json .Service.IP}}}`: "nil pointer",
+		`{"message": {{.Message}}}`:    "valid JSON",
+		`{{nosuch .Kind}}`:             "not defined",
+	} {
+		n := Notifier{URL: "https://hooks.example.com/nv", Payload: &PayloadTemplate{Template: template}}
+		if err := n.validate(); err == nil || !strings.Contains(err.Error(), want) {
+			t.Fatalf("Expected %q to be rejected with %q, got %v", template, want, err)
+		}
+	}
+}
+
+// TestPayloadTemplateDelivery verifies event and digest notifiers POST
+// their templates' output
+func TestPayloadTemplateDelivery(t *testing.T) {
+	server := newNotifyServer(t)
+	events := newWebhookReceiver(t)
+	if _, err := server.notifiers.Add(Notifier{URL: events.URL, Name: "incidents", Events: []string{notifyNewDevice}, Payload: &PayloadTemplate{Template: incidentTemplate}}); err != nil {
+		t.Fatalf("Expected the notifier to be added, got %v", err)
+	}
+	digests := newWebhookReceiver(t)
+	server.notifiers.Add(Notifier{URL: digests.URL, Digest: &DigestConfig{Interval: "1h"},
+		Payload: &PayloadTemplate{Template: `{{.Notifier}}: {{range .Digest.NewDevices}}{{.Device}} {{end}}`, ContentType: "text/plain"}})
+
+	server.addService("smb", &MDNSService{Name: "NAS", Type: "_smb._tcp.local.", Host: "nas.local.", IP: "192.168.1.20", Port: 445, Site: defaultSite})
+	server.notifiers.FlushDigests(time.Now().Add(2 * time.Hour))
+	server.notifiers.deliveries.Wait()
+
+	types, bodies := events.received()
+	if len(bodies) != 1 || types[0] != "application/json" {
+		t.Fatalf("Expected one JSON payload, got %v %v", types, bodies)
+	}
+	var incident map[string]string
+	if err := json.Unmarshal([]byte(bodies[0]), &incident); err != nil {
+		t.Fatalf("Expected the template's JSON, got %q: %v", bodies[0], err)
+	}
+	if incident["severity"] != "info" || incident["source"] != "nas.local" || incident["ip"] != "192.168.1.20" || incident["summary"] != "New device nas.local" {
+		t.Fatalf("Expected the new device as an incident, got %v", incident)
+	}
+
+	types, bodies = digests.received()
+	if len(bodies) != 1 || types[0] != "text/plain" || !strings.HasSuffix(bodies[0], ": nas.local ") {
+		t.Fatalf("Expected the templated digest, got %v %q", types, bodies)
+	}
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+)
+
+// A4 in points, and the page margin.
+const (
+	pdfPageWidth  = 595.0
+	pdfPageHeight = 842.0
+	pdfMargin     = 50.0
+)
+
+// pdfLine is a line of text placed on a page.
+type pdfLine struct {
+	text string
+	size float64
+	bold bool
+	y    float64
+}
+
+// pdfDocument lays out lines of text on A4 pages in the standard Helvetica
+// fonts, which every PDF reader has: enough for a printable report without
+// a PDF library.
+type pdfDocument struct {
+	pages [][]pdfLine
+	y     float64 // where the next line goes on the last page
+}
+
+// text adds a paragraph, wrapped to the page width and continued on a new
+// page when the page is full.
+func (d *pdfDocument) text(text string, size float64, bold bool) {
+	// Helvetica averages about half an em per character
+	width := int((pdfPageWidth - 2*pdfMargin) / (size * 0.5))
+	for _, line := range wrapText(text, width) {
+		leading := size * 1.35
+		if len(d.pages) == 0 || d.y-leading < pdfMargin {
+			d.pages = append(d.pages, nil)
+			d.y = pdfPageHeight - pdfMargin
+		}
+		d.y -= leading
+		page := len(d.pages) - 1
+		d.pages[page] = append(d.pages[page], pdfLine{text: line, size: size, bold: bold, y: d.y})
+	}
+}
+
+// space adds vertical space.
+func (d *pdfDocument) space(points float64) {
+	if len(d.pages) > 0 {
+		d.y -= points
+	}
+}
+
+// wrapText breaks text into lines of at most width characters, at spaces
+// where it can.
+func wrapText(text string, width int) []string {
+	var lines []string
+	for _, paragraph := range strings.Split(text, "\n") {
+		line := ""
+		for _, word := range strings.Fields(paragraph) {
+			for len([]rune(word)) > width {
+				if line != "" {
+					lines = append(lines, line)
+					line = ""
+				}
+				runes := []rune(word)
+				lines = append(lines, string(runes[:width]))
+				word = string(runes[width:])
+			}
+			switch {
+			case line == "":
+				line = word
+			case len([]rune(line))+1+len([]rune(word)) <= width:
+				line += " " + word
+			default:
+				lines = append(lines, line)
+				line = word
+			}
+		}
+		lines = append(lines, line)
+	}
+	return lines
+}
+
+// pdfString encodes s as a PDF string literal in WinAnsiEncoding: Latin-1
+// characters are kept, anything else becomes "?".
+func pdfString(s string) string {
+	var b strings.Builder
+	b.WriteByte('(')
+	for _, r := range s {
+		switch {
+		case r == '(' || r == ')' || r == '\\':
+			b.WriteByte('\\')
+			b.WriteRune(r)
+		case r >= 32 && r < 127:
+			b.WriteRune(r)
+		case r >= 160 && r <= 255:
+			fmt.Fprintf(&b, "\\%03o", r)
+		case r == '—' || r == '–':
+			b.WriteByte('-')
+		default:
+			b.WriteByte('?')
+		}
+	}
+	b.WriteByte(')')
+	return b.String()
+}
+
+// bytes renders the document.
+func (d *pdfDocument) bytes() []byte {
+	pages := d.pages
+	if len(pages) == 0 {
+		pages = [][]pdfLine{nil}
+	}
+
+	var out bytes.Buffer
+	var offsets []int
+	object := func(body string) {
+		offsets = append(offsets, out.Len())
+		fmt.Fprintf(&out, "%d 0 obj\n%s\nendobj\n", len(offsets), body)
+	}
+	out.WriteString("%PDF-1.4\n")
+
+	// 1 catalog, 2 pages, 3 and 4 fonts, then a page and its content
+	// stream per page
+	kids := make([]string, len(pages))
+	for i := range pages {
+		kids[i] = fmt.Sprintf("%d 0 R", 5+2*i)
+	}
+	object("<< /Type /Catalog /Pages 2 0 R >>")
+	object(fmt.Sprintf("<< /Type /Pages /Kids [%s] /Count %d >>", strings.Join(kids, " "), len(pages)))
+	object("<< /Type /Font /Subtype /Type1 /BaseFont /Helvetica /Encoding /WinAnsiEncoding >>")
+	object("<< /Type /Font /Subtype /Type1 /BaseFont /Helvetica-Bold /Encoding /WinAnsiEncoding >>")
+	for i, lines := range pages {
+		var content strings.Builder
+		for _, line := range lines {
+			font := "F1"
+			if line.bold {
+				font = "F2"
+			}
+			fmt.Fprintf(&content, "BT /%s %g Tf %g %g Td %s Tj ET\n", font, line.size, pdfMargin, line.y, pdfString(line.text))
+		}
+		object(fmt.Sprintf("<< /Type /Page /Parent 2 0 R /MediaBox [0 0 %g %g] /Resources << /Font << /F1 3 0 R /F2 4 0 R >> >> /Contents %d 0 R >>",
+			pdfPageWidth, pdfPageHeight, 6+2*i))
+		object(fmt.Sprintf("<< /Length %d >>\nstream\n%sendstream", content.Len(), content.String()))
+	}
+
+	xref := out.Len()
+	fmt.Fprintf(&out, "xref\n0 %d\n0000000000 65535 f \n", len(offsets)+1)
+	for _, offset := range offsets {
+		fmt.Fprintf(&out, "%010d 00000 n \n", offset)
+	}
+	fmt.Fprintf(&out, "trailer\n<< /Size %d /Root 1 0 R >>\nstartxref\n%d\n%%%%EOF\n", len(offsets)+1, xref)
+	return out.Bytes()
+}
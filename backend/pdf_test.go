@@ -0,0 +1,58 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// TestPDFDocument verifies long text wraps onto new pages and the xref table
+// points at each object
+func TestPDFDocument(t *testing.T) {
+	var doc pdfDocument
+	for i := 0; i < 120; i++ {
+		doc.text(fmt.Sprintf("Line %d (with parentheses) and a long enough tail to need wrapping at this font size, plus more words here", i), 9, i%10 == 0)
+	}
+	out := doc.bytes()
+	if !bytes.HasPrefix(out, []byte("%PDF-1.4\n")) || !bytes.HasSuffix(out, []byte("%%EOF\n")) {
+		t.Fatalf("Expected a PDF header and trailer")
+	}
+	if len(doc.pages) < 2 {
+		t.Fatalf("Expected the text to span pages, got %d", len(doc.pages))
+	}
+	if !bytes.Contains(out, []byte(`(Line 0 \(with parentheses\)`)) {
+		t.Fatalf("Expected parentheses escaped in strings")
+	}
+
+	startxref := regexp.MustCompile(`startxref\n(\d+)\n`).FindSubmatch(out)
+	if startxref == nil {
+		t.Fatalf("Expected a startxref")
+	}
+	xref, _ := strconv.Atoi(string(startxref[1]))
+	if !bytes.HasPrefix(out[xref:], []byte("xref\n")) {
+		t.Fatalf("Expected startxref to point at the xref table")
+	}
+	entries := regexp.MustCompile(`(\d{10}) 00000 n `).FindAllSubmatch(out[xref:], -1)
+	if len(entries) != 4+2*len(doc.pages) {
+		t.Fatalf("Expected %d objects, got %d", 4+2*len(doc.pages), len(entries))
+	}
+	for i, entry := range entries {
+		offset, _ := strconv.Atoi(string(entry[1]))
+		if want := fmt.Sprintf("%d 0 obj\n", i+1); !bytes.HasPrefix(out[offset:], []byte(want)) {
+			t.Fatalf("Expected object %d at offset %d", i+1, offset)
+		}
+	}
+}
+
+// TestPDFString verifies Latin-1 is kept and other characters replaced
+func TestPDFString(t *testing.T) {
+	if got := pdfString(`Café \ 東京 — ok`); got != `(Caf\351 \\ ?? - ok)` {
+		t.Fatalf("Expected WinAnsi escapes, got %s", got)
+	}
+	if lines := wrapText(strings.Repeat("word ", 30), 20); len(lines) < 7 || len(lines[0]) > 20 {
+		t.Fatalf("Expected lines of at most 20 characters, got %q", lines)
+	}
+}
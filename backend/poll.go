@@ -0,0 +1,100 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// maxPollWait bounds how long a long-poll request blocks waiting for events.
+const maxPollWait = 30 * time.Second
+
+// PollEvents handles GET /api/events/poll, a long-polling fallback for
+// clients that cannot use the /discover stream. It returns the events after
+// ?cursor= (filtered by ?site= like the stream), blocking up to ?timeout=
+// (default and maximum 30s) until at least one arrives. Without a cursor it
+// waits for the next new event, just like connecting to the stream. The
+// response carries the cursor for the next request; "gap" is true when
+// events between the two cursors have expired from the buffer, or the
+// cursor is from before a restart. Cursors are event sequence numbers, so
+// the seq of a snapshot or of a stream event also serves as one. ?compact=1
+// abbreviates it like the stream.
+func (s *MDNSServer) PollEvents(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	if s.replay.Window() <= 0 {
+		writeError(w, http.StatusServiceUnavailable, "event buffer disabled (-replay-window=0)")
+		return
+	}
+
+	cursor := s.replay.Latest()
+	if v := r.URL.Query().Get("cursor"); v != "" {
+		n, err := strconv.ParseUint(v, 10, 64)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "invalid cursor")
+			return
+		}
+		cursor = n
+	}
+
+	gapped := false
+	if latest := max(s.bus.Latest(), s.replay.Latest()); cursor > latest {
+		// The cursor is from before a restart; start over from now
+		cursor, gapped = latest, true
+	}
+
+	wait := maxPollWait
+	if v := r.URL.Query().Get("timeout"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d < 0 {
+			writeError(w, http.StatusBadRequest, "invalid timeout")
+			return
+		}
+		wait = min(d, maxPollWait)
+	}
+	timeout := time.NewTimer(wait)
+	defer timeout.Stop()
+
+	filter, err := filterParam(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	site := s.siteParam(r)
+	for {
+		events, next, gap, changed := s.replay.After(cursor)
+		gapped = gapped || gap
+		cursor = next
+
+		matching := make([]*DiscoveryResponse, 0, len(events))
+		for _, event := range events {
+			if inSite(&event.Service, site) && filter.Match(s.serviceFields(&event.Service)) {
+				matching = append(matching, event)
+			}
+		}
+		if len(matching) > 0 {
+			writePoll(w, r, cursor, matching, gapped)
+			return
+		}
+
+		select {
+		case <-changed:
+		case <-timeout.C:
+			writePoll(w, r, cursor, matching, gapped)
+			return
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+func writePoll(w http.ResponseWriter, r *http.Request, cursor uint64, events []*DiscoveryResponse, gap bool) {
+	writeJSONFor(w, r, http.StatusOK, map[string]interface{}{
+		"cursor": cursor,
+		"events": events,
+		"gap":    gap,
+	})
+}
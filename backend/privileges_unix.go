@@ -0,0 +1,47 @@
+//go:build !windows
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/user"
+	"strconv"
+	"syscall"
+)
+
+// dropPrivileges switches the process to the user name, so a server started
+// as root keeps running without root's privileges.
+func dropPrivileges(name string) error {
+	u, err := user.Lookup(name)
+	if err != nil {
+		return err
+	}
+	uid, err := strconv.Atoi(u.Uid)
+	if err != nil {
+		return fmt.Errorf("user %s: %v", name, err)
+	}
+	gid, err := strconv.Atoi(u.Gid)
+	if err != nil {
+		return fmt.Errorf("user %s: %v", name, err)
+	}
+
+	if err := syscall.Setgroups([]int{gid}); err != nil {
+		return err
+	}
+	if err := syscall.Setgid(gid); err != nil {
+		return err
+	}
+	if err := syscall.Setuid(uid); err != nil {
+		return err
+	}
+	if os.Geteuid() == 0 {
+		return fmt.Errorf("still running as root after switching to %s", name)
+	}
+	return nil
+}
+
+// runningAsRoot reports whether the process has root privileges.
+func runningAsRoot() bool {
+	return os.Geteuid() == 0
+}
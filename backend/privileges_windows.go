@@ -0,0 +1,14 @@
+package main
+
+import "errors"
+
+// dropPrivileges is not supported on Windows; run the server as an
+// unprivileged account instead.
+func dropPrivileges(name string) error {
+	return errors.New("-user is not supported on Windows")
+}
+
+// runningAsRoot reports false: Windows has no root to drop.
+func runningAsRoot() bool {
+	return false
+}
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"sync/atomic"
+)
+
+const protocolsBucket = "protocols"
+
+// Discovery protocols that can be switched off at runtime.
+const (
+	protocolMDNSBrowse   = "mdns-browse"
+	protocolMDNSQuery    = "mdns-query"
+	protocolMDNSListener = "mdns-listener"
+	protocolARP          = "arp"
+	protocolSNMP         = "snmp"
+)
+
+type protocol struct {
+	name        string
+	description string
+	source      string // latency source of the services it discovers
+	// apply is called when the protocol is toggled, for protocols that
+	// aren't checked where they run
+	apply   func(enabled bool)
+	enabled atomic.Bool
+}
+
+func newProtocolList() []*protocol {
+	return []*protocol{
+		{name: protocolMDNSBrowse, description: "Browse service types with the mDNS browser", source: sourceBrowse},
+		{name: protocolMDNSQuery, description: "Send periodic mDNS PTR queries", source: sourceQuery},
+		{name: protocolMDNSListener, description: "Listen to mDNS multicast traffic on port 5353", source: sourceMulticast},
+		{name: protocolARP, description: "Read the ARP table for MAC addresses", apply: func(enabled bool) {
+			neighbors.disabled.Store(!enabled)
+		}},
+		{name: protocolSNMP, description: "Poll devices' SNMP agents (needs -snmp-community)"},
+	}
+}
+
+// Protocols holds which discovery protocols are enabled. Every protocol is
+// enabled unless it was switched off; the choice persists across restarts.
+type Protocols struct {
+	store  Store
+	mu     sync.Mutex // serializes Set
+	list   []*protocol
+	byName map[string]*protocol
+}
+
+// protocolState is a persisted entry of the protocols bucket.
+type protocolState struct {
+	Enabled bool `json:"enabled"`
+}
+
+// newProtocols returns every protocol enabled, persisting changes to store
+// unless it is nil.
+func newProtocols(store Store) *Protocols {
+	p := &Protocols{store: store, list: newProtocolList(), byName: make(map[string]*protocol)}
+	for _, proto := range p.list {
+		p.byName[proto.name] = proto
+		proto.enabled.Store(true)
+		if proto.apply != nil {
+			proto.apply(true)
+		}
+	}
+	return p
+}
+
+// NewProtocols loads the protocol states persisted in store.
+func NewProtocols(store Store) (*Protocols, error) {
+	p := newProtocols(store)
+
+	entries, err := store.Load(protocolsBucket)
+	if err != nil {
+		return nil, err
+	}
+	for name, data := range entries {
+		var state protocolState
+		if err := json.Unmarshal(data, &state); err != nil {
+			return nil, fmt.Errorf("protocol %s: %v", name, err)
+		}
+		if proto, ok := p.byName[name]; ok {
+			proto.enabled.Store(state.Enabled)
+			if proto.apply != nil {
+				proto.apply(state.Enabled)
+			}
+		}
+	}
+	return p, nil
+}
+
+// Enabled reports whether the protocol name is enabled.
+func (p *Protocols) Enabled(name string) bool {
+	proto, ok := p.byName[name]
+	return ok && proto.enabled.Load()
+}
+
+// Set enables or disables the protocol name and persists the choice.
+func (p *Protocols) Set(name string, enabled bool) error {
+	proto, ok := p.byName[name]
+	if !ok {
+		return fmt.Errorf("unknown protocol %q", name)
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.store != nil {
+		data, err := json.Marshal(protocolState{Enabled: enabled})
+		if err != nil {
+			return err
+		}
+		if err := p.store.Put(protocolsBucket, map[string][]byte{name: data}); err != nil {
+			return err
+		}
+	}
+	proto.enabled.Store(enabled)
+	if proto.apply != nil {
+		proto.apply(enabled)
+	}
+	return nil
+}
+
+// ProtocolStatus is a protocol's entry on /api/protocols.
+type ProtocolStatus struct {
+	Name        string `json:"name"`
+	Description string `json:"description"`
+	Enabled     bool   `json:"enabled"`
+	// Status is "disabled", "enabled", or the listener state for the
+	// multicast listener
+	Status     string  `json:"status"`
+	Discovered *uint64 `json:"discovered,omitempty"`
+}
+
+// protocolStatus returns the status of one protocol.
+func (s *MDNSServer) protocolStatus(proto *protocol) ProtocolStatus {
+	status := ProtocolStatus{
+		Name:        proto.name,
+		Description: proto.description,
+		Enabled:     proto.enabled.Load(),
+		Status:      "enabled",
+	}
+	switch {
+	case !status.Enabled:
+		status.Status = "disabled"
+	case proto.name == protocolMDNSListener:
+		status.Status = s.listener.Status().State
+	case proto.name == protocolSNMP && s.snmp == nil:
+		status.Status = "not configured"
+	}
+	if proto.source != "" {
+		var n uint64
+		for _, st := range s.latency.Stats() {
+			if st.Source == proto.source {
+				n = st.Count
+			}
+		}
+		status.Discovered = &n
+	}
+	return status
+}
+
+// ProtocolList handles GET /api/protocols.
+func (s *MDNSServer) ProtocolList(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	statuses := make([]ProtocolStatus, 0, len(s.protocols.list))
+	for _, proto := range s.protocols.list {
+		statuses = append(statuses, s.protocolStatus(proto))
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"protocols": statuses,
+	})
+}
+
+// Protocol handles GET and PUT /api/protocols/{name}.
+func (s *MDNSServer) Protocol(w http.ResponseWriter, r *http.Request) {
+	proto, ok := s.protocols.byName[r.PathValue("name")]
+	if !ok {
+		writeError(w, http.StatusNotFound, "unknown protocol")
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		writeJSON(w, http.StatusOK, s.protocolStatus(proto))
+
+	case http.MethodPut:
+		var req struct {
+			Enabled *bool `json:"enabled"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		if req.Enabled == nil {
+			writeError(w, http.StatusBadRequest, "enabled is required")
+			return
+		}
+		if err := s.protocols.Set(proto.name, *req.Enabled); err != nil {
+			writeError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		writeJSON(w, http.StatusOK, s.protocolStatus(proto))
+
+	default:
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+	}
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// TestProtocolsPersistence verifies a disabled protocol stays disabled
+// after reloading
+func TestProtocolsPersistence(t *testing.T) {
+	dir := t.TempDir()
+	defer neighbors.disabled.Store(false)
+
+	protocols, err := NewProtocols(openTestStore(t, "json", dir))
+	if err != nil {
+		t.Fatalf("Failed to load protocols: %v", err)
+	}
+	if err := protocols.Set(protocolARP, false); err != nil {
+		t.Fatalf("Failed to disable arp: %v", err)
+	}
+	if err := protocols.Set("bluetooth", false); err == nil {
+		t.Fatalf("Expected an error for an unknown protocol")
+	}
+	neighbors.disabled.Store(false)
+
+	reloaded, err := NewProtocols(openTestStore(t, "json", dir))
+	if err != nil {
+		t.Fatalf("Failed to reload protocols: %v", err)
+	}
+	if reloaded.Enabled(protocolARP) || !reloaded.Enabled(protocolMDNSQuery) {
+		t.Fatalf("Expected only arp to be disabled after reload")
+	}
+	if neighbors.lookup("192.168.1.1") != "" || !neighbors.disabled.Load() {
+		t.Fatalf("Expected ARP lookups to be off while arp is disabled")
+	}
+}
+
+// TestProtocolHandler verifies toggling a protocol over the API
+func TestProtocolHandler(t *testing.T) {
+	server := NewMDNSServer()
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/protocols/{name}", server.Protocol)
+
+	req := httptest.NewRequest(http.MethodPut, "/api/protocols/mdns-query", strings.NewReader(`{"enabled":false}`))
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Expected 200, got %d: %s", rec.Code, rec.Body)
+	}
+
+	var status ProtocolStatus
+	if err := json.Unmarshal(rec.Body.Bytes(), &status); err != nil {
+		t.Fatalf("Failed to decode status: %v", err)
+	}
+	if status.Enabled || status.Status != "disabled" || status.Discovered == nil {
+		t.Fatalf("Expected a disabled protocol with a discovered count, got %+v", status)
+	}
+	if server.protocols.Enabled(protocolMDNSQuery) {
+		t.Fatalf("Expected mdns-query to be disabled")
+	}
+
+	rec = httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest(http.MethodPut, "/api/protocols/ssdp", strings.NewReader(`{"enabled":false}`)))
+	if rec.Code != http.StatusNotFound {
+		t.Fatalf("Expected 404 for an unknown protocol, got %d", rec.Code)
+	}
+}
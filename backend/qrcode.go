@@ -0,0 +1,599 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// A minimal QR code encoder (ISO/IEC 18004) for /api/qr: byte mode at error
+// correction level M, versions 1 to 10, which holds URLs of up to 213
+// bytes.
+
+// qrBlocks is the error correction layout of a version at level M: the
+// error correction codewords per block, and the data codewords of each
+// block.
+type qrBlocks struct {
+	ecPerBlock int
+	data       []int
+}
+
+var qrVersionsM = []qrBlocks{
+	1:  {10, []int{16}},
+	2:  {16, []int{28}},
+	3:  {26, []int{44}},
+	4:  {18, []int{32, 32}},
+	5:  {24, []int{43, 43}},
+	6:  {16, []int{27, 27, 27, 27}},
+	7:  {18, []int{31, 31, 31, 31}},
+	8:  {22, []int{38, 38, 39, 39}},
+	9:  {22, []int{36, 36, 36, 37, 37}},
+	10: {26, []int{43, 43, 43, 43, 44}},
+}
+
+// qrAlignment are the alignment pattern center coordinates per version.
+var qrAlignment = [][]int{
+	2:  {6, 18},
+	3:  {6, 22},
+	4:  {6, 26},
+	5:  {6, 30},
+	6:  {6, 34},
+	7:  {6, 22, 38},
+	8:  {6, 24, 42},
+	9:  {6, 26, 46},
+	10: {6, 28, 50},
+}
+
+var errQRTooLong = errors.New("too long for a QR code")
+
+// QRCode is an encoded symbol: Modules[y][x] is true for dark modules.
+type QRCode struct {
+	Version int
+	Modules [][]bool
+}
+
+// Size is the number of modules per side.
+func (q *QRCode) Size() int {
+	return len(q.Modules)
+}
+
+// qrMatrix is a symbol under construction.
+type qrMatrix struct {
+	version  int
+	size     int
+	modules  [][]bool
+	function [][]bool // finder, timing, alignment and format modules
+}
+
+// encodeQR encodes data in byte mode in the smallest version that holds it.
+func encodeQR(data []byte) (*QRCode, error) {
+	version := 0
+	for v := 1; v < len(qrVersionsM); v++ {
+		countBits := 8
+		if v >= 10 {
+			countBits = 16
+		}
+		if 4+countBits+8*len(data) <= 8*qrDataCodewords(v) {
+			version = v
+			break
+		}
+	}
+	if version == 0 {
+		return nil, fmt.Errorf("%d bytes: %w", len(data), errQRTooLong)
+	}
+
+	codewords := qrInterleave(version, qrDataBits(version, data))
+	m := newQRMatrix(version)
+	m.drawFunctionPatterns()
+	m.drawCodewords(codewords)
+
+	best, bestPenalty := -1, 0
+	for mask := 0; mask < 8; mask++ {
+		m.applyMask(mask)
+		m.drawFormat(mask)
+		if penalty := m.penalty(); best < 0 || penalty < bestPenalty {
+			best, bestPenalty = mask, penalty
+		}
+		m.applyMask(mask) // masking twice undoes it
+	}
+	m.applyMask(best)
+	m.drawFormat(best)
+	return &QRCode{Version: version, Modules: m.modules}, nil
+}
+
+func qrDataCodewords(version int) int {
+	n := 0
+	for _, d := range qrVersionsM[version].data {
+		n += d
+	}
+	return n
+}
+
+// qrDataBits lays out the data codewords: the byte mode indicator, the
+// length, the data, a terminator and padding.
+func qrDataBits(version int, data []byte) []byte {
+	var bits qrBitBuffer
+	bits.append(0b0100, 4)
+	if version >= 10 {
+		bits.append(len(data), 16)
+	} else {
+		bits.append(len(data), 8)
+	}
+	for _, b := range data {
+		bits.append(int(b), 8)
+	}
+	capacity := 8 * qrDataCodewords(version)
+	bits.append(0, min(4, capacity-len(bits)))
+	bits.append(0, (8-len(bits)%8)%8)
+	for pad := 0xEC; len(bits) < capacity; pad ^= 0xEC ^ 0x11 {
+		bits.append(pad, 8)
+	}
+	return bits.bytes()
+}
+
+type qrBitBuffer []bool
+
+func (b *qrBitBuffer) append(value, n int) {
+	for i := n - 1; i >= 0; i-- {
+		*b = append(*b, value>>i&1 == 1)
+	}
+}
+
+func (b qrBitBuffer) bytes() []byte {
+	out := make([]byte, len(b)/8)
+	for i, bit := range b {
+		if bit {
+			out[i/8] |= 0x80 >> (i % 8)
+		}
+	}
+	return out
+}
+
+// qrInterleave splits data into blocks, appends each block's error
+// correction codewords, and interleaves them in placement order.
+func qrInterleave(version int, data []byte) []byte {
+	layout := qrVersionsM[version]
+	generator := rsGenerator(layout.ecPerBlock)
+	var blocks, ecBlocks [][]byte
+	for _, n := range layout.data {
+		blocks = append(blocks, data[:n])
+		ecBlocks = append(ecBlocks, rsRemainder(data[:n], generator))
+		data = data[n:]
+	}
+
+	var out []byte
+	for i := 0; i < layout.data[len(layout.data)-1]; i++ {
+		for _, block := range blocks {
+			if i < len(block) {
+				out = append(out, block[i])
+			}
+		}
+	}
+	for i := 0; i < layout.ecPerBlock; i++ {
+		for _, ec := range ecBlocks {
+			out = append(out, ec[i])
+		}
+	}
+	return out
+}
+
+// gfMultiply multiplies in GF(2^8) modulo x^8 + x^4 + x^3 + x^2 + 1.
+func gfMultiply(x, y byte) byte {
+	var z byte
+	for i := 7; i >= 0; i-- {
+		carry := z >> 7
+		z <<= 1
+		z ^= carry * 0x1D
+		z ^= (y >> i & 1) * x
+	}
+	return z
+}
+
+// rsGenerator returns the coefficients, highest power first and the leading
+// 1 left out, of the Reed-Solomon generator polynomial of degree n.
+func rsGenerator(n int) []byte {
+	result := make([]byte, n)
+	result[n-1] = 1
+	var root byte = 1
+	for i := 0; i < n; i++ {
+		for j := range result {
+			result[j] = gfMultiply(result[j], root)
+			if j+1 < n {
+				result[j] ^= result[j+1]
+			}
+		}
+		root = gfMultiply(root, 0x02)
+	}
+	return result
+}
+
+// rsRemainder returns the error correction codewords of data.
+func rsRemainder(data, generator []byte) []byte {
+	result := make([]byte, len(generator))
+	for _, b := range data {
+		factor := b ^ result[0]
+		copy(result, result[1:])
+		result[len(result)-1] = 0
+		for i, coefficient := range generator {
+			result[i] ^= gfMultiply(coefficient, factor)
+		}
+	}
+	return result
+}
+
+func newQRMatrix(version int) *qrMatrix {
+	size := 17 + 4*version
+	m := &qrMatrix{version: version, size: size, modules: make([][]bool, size), function: make([][]bool, size)}
+	for y := range m.modules {
+		m.modules[y] = make([]bool, size)
+		m.function[y] = make([]bool, size)
+	}
+	return m
+}
+
+func (m *qrMatrix) set(x, y int, dark bool) {
+	m.modules[y][x] = dark
+	m.function[y][x] = true
+}
+
+func (m *qrMatrix) drawFunctionPatterns() {
+	for i := 0; i < m.size; i++ {
+		m.set(6, i, i%2 == 0)
+		m.set(i, 6, i%2 == 0)
+	}
+	m.drawFinder(3, 3)
+	m.drawFinder(m.size-4, 3)
+	m.drawFinder(3, m.size-4)
+
+	positions := qrAlignment[m.version]
+	last := len(positions) - 1
+	for i, x := range positions {
+		for j, y := range positions {
+			// Not over the finder patterns
+			if (i == 0 && j == 0) || (i == 0 && j == last) || (i == last && j == 0) {
+				continue
+			}
+			for dy := -2; dy <= 2; dy++ {
+				for dx := -2; dx <= 2; dx++ {
+					m.set(x+dx, y+dy, max(abs(dx), abs(dy)) != 1)
+				}
+			}
+		}
+	}
+
+	// Reserve the format areas, drawn per mask
+	m.drawFormat(0)
+	if m.version >= 7 {
+		m.drawVersion()
+	}
+}
+
+// drawFinder draws a finder pattern centered on x, y with its separator.
+func (m *qrMatrix) drawFinder(x, y int) {
+	for dy := -4; dy <= 4; dy++ {
+		for dx := -4; dx <= 4; dx++ {
+			if xx, yy := x+dx, y+dy; xx >= 0 && xx < m.size && yy >= 0 && yy < m.size {
+				d := max(abs(dx), abs(dy))
+				m.set(xx, yy, d != 2 && d != 4)
+			}
+		}
+	}
+}
+
+func abs(x int) int {
+	if x < 0 {
+		return -x
+	}
+	return x
+}
+
+// drawFormat draws both copies of the format information: level M and
+// mask, BCH-protected.
+func (m *qrMatrix) drawFormat(mask int) {
+	data := 0b00<<3 | mask // level M
+	rem := data
+	for i := 0; i < 10; i++ {
+		rem = rem<<1 ^ (rem>>9)*0x537
+	}
+	bits := (data<<10 | rem) ^ 0x5412
+	bit := func(i int) bool { return bits>>i&1 == 1 }
+
+	for i := 0; i <= 5; i++ {
+		m.set(8, i, bit(i))
+	}
+	m.set(8, 7, bit(6))
+	m.set(8, 8, bit(7))
+	m.set(7, 8, bit(8))
+	for i := 9; i < 15; i++ {
+		m.set(14-i, 8, bit(i))
+	}
+	for i := 0; i < 8; i++ {
+		m.set(m.size-1-i, 8, bit(i))
+	}
+	for i := 8; i < 15; i++ {
+		m.set(8, m.size-15+i, bit(i))
+	}
+	m.set(8, m.size-8, true) // the dark module
+}
+
+// drawVersion draws both copies of the version information of versions 7
+// and up.
+func (m *qrMatrix) drawVersion() {
+	rem := m.version
+	for i := 0; i < 12; i++ {
+		rem = rem<<1 ^ (rem>>11)*0x1F25
+	}
+	bits := m.version<<12 | rem
+	for i := 0; i < 18; i++ {
+		dark := bits>>i&1 == 1
+		a, b := m.size-11+i%3, i/3
+		m.set(a, b, dark)
+		m.set(b, a, dark)
+	}
+}
+
+// drawCodewords places the codewords in the zigzag order, two columns at a
+// time from the bottom right, skipping function modules.
+func (m *qrMatrix) drawCodewords(codewords []byte) {
+	i := 0
+	for right := m.size - 1; right >= 1; right -= 2 {
+		if right == 6 {
+			right = 5 // the vertical timing pattern
+		}
+		for vert := 0; vert < m.size; vert++ {
+			for j := 0; j < 2; j++ {
+				x := right - j
+				y := vert
+				if (right+1)&2 == 0 {
+					y = m.size - 1 - vert // upwards
+				}
+				if !m.function[y][x] && i < len(codewords)*8 {
+					m.modules[y][x] = codewords[i/8]>>(7-i%8)&1 == 1
+					i++
+				}
+			}
+		}
+	}
+}
+
+// qrMask reports whether mask inverts the module at x, y.
+func qrMask(mask, x, y int) bool {
+	switch mask {
+	case 0:
+		return (x+y)%2 == 0
+	case 1:
+		return y%2 == 0
+	case 2:
+		return x%3 == 0
+	case 3:
+		return (x+y)%3 == 0
+	case 4:
+		return (x/3+y/2)%2 == 0
+	case 5:
+		return x*y%2+x*y%3 == 0
+	case 6:
+		return (x*y%2+x*y%3)%2 == 0
+	default:
+		return ((x+y)%2+x*y%3)%2 == 0
+	}
+}
+
+func (m *qrMatrix) applyMask(mask int) {
+	for y := 0; y < m.size; y++ {
+		for x := 0; x < m.size; x++ {
+			if !m.function[y][x] && qrMask(mask, x, y) {
+				m.modules[y][x] = !m.modules[y][x]
+			}
+		}
+	}
+}
+
+// penalty scores how hard the symbol is to read, by the rules of the
+// standard: long runs, 2x2 blocks, finder-like patterns and an uneven
+// balance of dark modules.
+func (m *qrMatrix) penalty() int {
+	penalty, dark := 0, 0
+	line := func(at func(i int) bool) {
+		run := 1
+		for i := 1; i <= m.size; i++ {
+			if i < m.size && at(i) == at(i-1) {
+				run++
+				continue
+			}
+			if run >= 5 {
+				penalty += 3 + run - 5
+			}
+			run = 1
+		}
+		// 1:1:3:1:1 with four light modules on either side
+		pattern := []bool{true, false, true, true, true, false, true}
+		for i := 0; i+7 <= m.size; i++ {
+			match := true
+			for k, p := range pattern {
+				if at(i+k) != p {
+					match = false
+					break
+				}
+			}
+			if !match {
+				continue
+			}
+			light := func(from, to int) bool {
+				for k := from; k < to; k++ {
+					if k >= 0 && k < m.size && at(k) {
+						return false
+					}
+				}
+				return true
+			}
+			if light(i-4, i) || light(i+7, i+11) {
+				penalty += 40
+			}
+		}
+	}
+	for y := 0; y < m.size; y++ {
+		line(func(x int) bool { return m.modules[y][x] })
+	}
+	for x := 0; x < m.size; x++ {
+		line(func(y int) bool { return m.modules[y][x] })
+	}
+	for y := 0; y < m.size; y++ {
+		for x := 0; x < m.size; x++ {
+			if m.modules[y][x] {
+				dark++
+			}
+			if x+1 < m.size && y+1 < m.size {
+				c := m.modules[y][x]
+				if m.modules[y][x+1] == c && m.modules[y+1][x] == c && m.modules[y+1][x+1] == c {
+					penalty += 3
+				}
+			}
+		}
+	}
+	percent := dark * 100 / (m.size * m.size)
+	return penalty + abs(percent-50)/5*10
+}
+
+// qrQuietZone is the light border around the symbol, in modules.
+const qrQuietZone = 4
+
+// Image renders the symbol with scale pixels per module.
+func (q *QRCode) Image(scale int) image.Image {
+	size := (q.Size() + 2*qrQuietZone) * scale
+	img := image.NewGray(image.Rect(0, 0, size, size))
+	for i := range img.Pix {
+		img.Pix[i] = 0xff
+	}
+	for y, row := range q.Modules {
+		for x, dark := range row {
+			if !dark {
+				continue
+			}
+			for dy := 0; dy < scale; dy++ {
+				for dx := 0; dx < scale; dx++ {
+					img.SetGray((x+qrQuietZone)*scale+dx, (y+qrQuietZone)*scale+dy, color.Gray{})
+				}
+			}
+		}
+	}
+	return img
+}
+
+// SVG renders the symbol as an SVG path of unit squares, scale pixels per
+// module.
+func (q *QRCode) SVG(scale int) string {
+	size := q.Size() + 2*qrQuietZone
+	var path strings.Builder
+	for y, row := range q.Modules {
+		for x, dark := range row {
+			if dark {
+				fmt.Fprintf(&path, "M%d %dh1v1h-1z", x+qrQuietZone, y+qrQuietZone)
+			}
+		}
+	}
+	return fmt.Sprintf(`<svg xmlns="http://www.w3.org/2000/svg" width="%d" height="%d" viewBox="0 0 %d %d" shape-rendering="crispEdges">`+
+		`<rect width="100%%" height="100%%" fill="#fff"/><path fill="#000" d="%s"/></svg>`,
+		size*scale, size*scale, size, size, path.String())
+}
+
+// dashboardURL is where phones on the LAN reach the dashboard serving r:
+// -dashboard-url if set, otherwise r's scheme, host and base path, with a
+// loopback host replaced by the discovery interface's address.
+func (s *MDNSServer) dashboardURL(r *http.Request) string {
+	if s.dashboardBase != "" {
+		return s.dashboardBase
+	}
+
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	if proto := r.Header.Get("X-Forwarded-Proto"); proto == "http" || proto == "https" {
+		scheme = proto
+	}
+
+	host := r.Host
+	if forwarded := r.Header.Get("X-Forwarded-Host"); forwarded != "" {
+		host = strings.TrimSpace(strings.Split(forwarded, ",")[0])
+	}
+	name, port, err := net.SplitHostPort(host)
+	if err != nil {
+		name, port = host, ""
+	}
+	if ip := net.ParseIP(name); name == "localhost" || (ip != nil && ip.IsLoopback()) || name == "" {
+		s.mu.RLock()
+		iface := s.currentIface
+		s.mu.RUnlock()
+		if lan := interfaceIPv4(iface); lan != nil {
+			name = lan.String()
+		}
+	}
+	if port != "" {
+		host = net.JoinHostPort(name, port)
+	} else if strings.Contains(name, ":") {
+		host = "[" + name + "]"
+	} else {
+		host = name
+	}
+
+	base := strings.Trim(r.Header.Get("X-Forwarded-Prefix"), "/")
+	if base != "" {
+		base = "/" + base
+	}
+	return (&url.URL{Scheme: scheme, Host: host, Path: base + "/"}).String()
+}
+
+// QR handles GET /api/qr: a QR code of the dashboard's LAN URL, as a PNG or,
+// with ?format=svg, an SVG. ?scale= sets the pixels per module (default 8).
+func (s *MDNSServer) QR(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	scale := 8
+	if v := r.URL.Query().Get("scale"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > 40 {
+			writeError(w, http.StatusBadRequest, "scale must be between 1 and 40")
+			return
+		}
+		scale = n
+	}
+	format := r.URL.Query().Get("format")
+	if format != "" && format != "png" && format != "svg" {
+		writeError(w, http.StatusBadRequest, "format must be png or svg")
+		return
+	}
+
+	target := s.dashboardURL(r)
+	code, err := encodeQR([]byte(target))
+	if err != nil {
+		writeError(w, http.StatusUnprocessableEntity, fmt.Sprintf("dashboard URL %s: %v", target, err))
+		return
+	}
+
+	w.Header().Set("X-Dashboard-URL", target)
+	w.Header().Set("Cache-Control", "no-cache")
+	if format == "svg" {
+		w.Header().Set("Content-Type", "image/svg+xml")
+		io.WriteString(w, code.SVG(scale))
+		return
+	}
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, code.Image(scale)); err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	w.Header().Set("Content-Type", "image/png")
+	w.Write(buf.Bytes())
+}
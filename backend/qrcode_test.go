@@ -0,0 +1,211 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"image/png"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// TestReedSolomon verifies the error correction codewords against the
+// standard's HELLO WORLD 1-M example.
+func TestReedSolomon(t *testing.T) {
+	data := []byte{32, 91, 11, 120, 209, 114, 220, 77, 67, 64, 236, 17, 236, 17, 236, 17}
+	want := []byte{196, 35, 39, 119, 235, 215, 231, 226, 93, 23}
+	if got := rsRemainder(data, rsGenerator(10)); !bytes.Equal(got, want) {
+		t.Fatalf("Expected EC codewords %v, got %v", want, got)
+	}
+}
+
+// TestQRVersionInfo verifies the version information against the
+// standard's version 7 example.
+func TestQRVersionInfo(t *testing.T) {
+	m := newQRMatrix(7)
+	m.drawVersion()
+	bits := 0
+	for i := 17; i >= 0; i-- {
+		bits = bits<<1 | boolBit(m.modules[i/3][m.size-11+i%3])
+	}
+	if bits != 0x07C94 {
+		t.Fatalf("Expected version 7 information 0x07C94, got %#05x", bits)
+	}
+}
+
+// readQR undoes encodeQR: it reads the mask from the format information,
+// unmasks the symbol, reads the codewords back in placement order and
+// returns the byte-mode payload.
+func readQR(t *testing.T, code *QRCode) []byte {
+	t.Helper()
+	m := newQRMatrix(code.Version)
+	m.drawFunctionPatterns()
+	format := 0
+	for i := 14; i >= 9; i-- {
+		format = format<<1 | boolBit(code.Modules[8][14-i])
+	}
+	format = format<<1 | boolBit(code.Modules[7][8])
+	format = format<<1 | boolBit(code.Modules[8][8])
+	format = format<<1 | boolBit(code.Modules[8][7])
+	for i := 5; i >= 0; i-- {
+		format = format<<1 | boolBit(code.Modules[i][8])
+	}
+	format ^= 0x5412
+	if level := format >> 13; level != 0 {
+		t.Fatalf("Expected level M format bits, got %02b", level)
+	}
+	mask := format >> 10 & 7
+
+	m.modules = code.Modules
+	m.applyMask(mask)
+	defer m.applyMask(mask)
+	var bits qrBitBuffer
+	for right := m.size - 1; right >= 1; right -= 2 {
+		if right == 6 {
+			right = 5
+		}
+		for vert := 0; vert < m.size; vert++ {
+			for j := 0; j < 2; j++ {
+				x, y := right-j, vert
+				if (right+1)&2 == 0 {
+					y = m.size - 1 - vert
+				}
+				if !m.function[y][x] {
+					bits = append(bits, m.modules[y][x])
+				}
+			}
+		}
+	}
+	codewords := bits.bytes()
+
+	layout := qrVersionsM[code.Version]
+	blocks := make([][]byte, len(layout.data))
+	i := 0
+	for k := 0; k < layout.data[len(layout.data)-1]; k++ {
+		for b, n := range layout.data {
+			if k < n {
+				blocks[b] = append(blocks[b], codewords[i])
+				i++
+			}
+		}
+	}
+	generator := rsGenerator(layout.ecPerBlock)
+	var data []byte
+	for b, block := range blocks {
+		for k := 0; k < layout.ecPerBlock; k++ {
+			if got, want := codewords[i+k*len(blocks)+b], rsRemainder(block, generator)[k]; got != want {
+				t.Fatalf("Expected EC codeword %d of block %d to be %d, got %d", k, b, want, got)
+			}
+		}
+		data = append(data, block...)
+	}
+
+	if mode := data[0] >> 4; mode != 0b0100 {
+		t.Fatalf("Expected byte mode, got %04b", mode)
+	}
+	var length, offset int
+	if code.Version >= 10 {
+		length = int(data[0]&0xf)<<12 | int(data[1])<<4 | int(data[2]>>4)
+		offset = 2
+	} else {
+		length = int(data[0]&0xf)<<4 | int(data[1]>>4)
+		offset = 1
+	}
+	payload := make([]byte, length)
+	for k := range payload {
+		payload[k] = data[offset+k]<<4 | data[offset+k+1]>>4
+	}
+	return payload
+}
+
+func boolBit(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// TestEncodeQR verifies that URLs of every supported version read back,
+// in the smallest version that holds them.
+func TestEncodeQR(t *testing.T) {
+	for _, tt := range []struct {
+		length  int
+		version int
+	}{
+		{14, 1}, {15, 2}, {26, 2}, {40, 3}, {62, 4}, {84, 5},
+		{106, 6}, {122, 7}, {152, 8}, {180, 9}, {213, 10},
+	} {
+		payload := []byte("http://" + strings.Repeat("a", tt.length-7))
+		code, err := encodeQR(payload)
+		if err != nil {
+			t.Fatalf("Expected %d bytes to encode, got %v", tt.length, err)
+		}
+		if code.Version != tt.version || code.Size() != 17+4*tt.version {
+			t.Fatalf("Expected %d bytes in version %d, got version %d of size %d", tt.length, tt.version, code.Version, code.Size())
+		}
+		if got := readQR(t, code); !bytes.Equal(got, payload) {
+			t.Fatalf("Expected to read back %q, got %q", payload, got)
+		}
+		// The finder pattern's center and the dark module
+		if !code.Modules[3][3] || !code.Modules[code.Size()-8][8] {
+			t.Fatalf("Expected version %d function patterns to be drawn", tt.version)
+		}
+	}
+
+	if _, err := encodeQR(make([]byte, 214)); err == nil {
+		t.Fatalf("Expected 214 bytes to be too long")
+	}
+}
+
+// TestQRHandler verifies /api/qr encodes the dashboard URL, honoring TLS,
+// forwarded headers and -dashboard-url.
+func TestQRHandler(t *testing.T) {
+	server := NewMDNSServer()
+
+	rec := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, "/api/qr?scale=2", nil)
+	req.Host = "192.168.1.20:9999"
+	server.QR(rec, req)
+	if rec.Code != http.StatusOK || rec.Header().Get("Content-Type") != "image/png" {
+		t.Fatalf("Expected a PNG, got %d %s", rec.Code, rec.Header().Get("Content-Type"))
+	}
+	if got := rec.Header().Get("X-Dashboard-URL"); got != "http://192.168.1.20:9999/" {
+		t.Fatalf("Expected the request's URL, got %s", got)
+	}
+	img, err := png.Decode(rec.Body)
+	if err != nil {
+		t.Fatalf("Expected a valid PNG, got %v", err)
+	}
+	if size := img.Bounds().Dx(); size != (25+2*qrQuietZone)*2 {
+		t.Fatalf("Expected a version 2 symbol at scale 2, got %d pixels", size)
+	}
+
+	rec = httptest.NewRecorder()
+	req = httptest.NewRequest(http.MethodGet, "/api/qr?format=svg", nil)
+	req.Host = "nas.local"
+	req.TLS = &tls.ConnectionState{}
+	req.Header.Set("X-Forwarded-Prefix", "/netview/")
+	server.QR(rec, req)
+	if got := rec.Header().Get("X-Dashboard-URL"); got != "https://nas.local/netview/" {
+		t.Fatalf("Expected the TLS URL under the base path, got %s", got)
+	}
+	if !strings.HasPrefix(rec.Body.String(), "<svg") || rec.Header().Get("Content-Type") != "image/svg+xml" {
+		t.Fatalf("Expected an SVG, got %s", rec.Body.String())
+	}
+
+	server.dashboardBase = "https://view.example.com/"
+	rec = httptest.NewRecorder()
+	server.QR(rec, httptest.NewRequest(http.MethodGet, "/api/qr", nil))
+	if got := rec.Header().Get("X-Dashboard-URL"); got != "https://view.example.com/" {
+		t.Fatalf("Expected -dashboard-url, got %s", got)
+	}
+
+	for _, query := range []string{"format=gif", "scale=0", "scale=x"} {
+		rec = httptest.NewRecorder()
+		server.QR(rec, httptest.NewRequest(http.MethodGet, "/api/qr?"+query, nil))
+		if rec.Code != http.StatusBadRequest {
+			t.Fatalf("Expected 400 for %s, got %d", query, rec.Code)
+		}
+	}
+}
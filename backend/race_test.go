@@ -0,0 +1,7 @@
+//go:build race
+
+package main
+
+// raceEnabled is whether the tests run with the race detector, whose
+// instrumentation allocates on its own.
+const raceEnabled = true
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// reachabilityConcurrency bounds the connections a check has open at once.
+const reachabilityConcurrency = 16
+
+// ReachabilityChecker connects to the advertised host:port of every local
+// TCP service, so services whose device rebooted or whose daemon stopped
+// show as reachable: false instead of as live until their records expire.
+// Services outside the scan scope are never checked.
+type ReachabilityChecker struct {
+	interval time.Duration
+	timeout  time.Duration
+	// dial connects to address; replaced in tests
+	dial func(address string, timeout time.Duration) error
+
+	mu          sync.Mutex
+	checkedAt   time.Time
+	checked     int
+	unreachable int
+}
+
+func NewReachabilityChecker(interval time.Duration) *ReachabilityChecker {
+	return &ReachabilityChecker{
+		interval: interval,
+		timeout:  2 * time.Second,
+		dial:     dialTCP,
+	}
+}
+
+func dialTCP(address string, timeout time.Duration) error {
+	conn, err := net.DialTimeout("tcp", address, timeout)
+	if err != nil {
+		return err
+	}
+	return conn.Close()
+}
+
+// Run checks every interval. It never returns.
+func (c *ReachabilityChecker) Run(server *MDNSServer) {
+	for {
+		c.checkAll(server, time.Now())
+		time.Sleep(c.interval)
+	}
+}
+
+// checkAll checks every local TCP service with a port, records the results
+// in the service table and publishes the services whose reachability
+// changed. It returns how many changed.
+func (c *ReachabilityChecker) checkAll(server *MDNSServer, now time.Time) int {
+	type target struct {
+		key, address string
+		reachable    bool
+	}
+	var targets []*target
+	for key, service := range server.table.view() {
+		if service.Site != server.site || service.Port == 0 || !strings.HasSuffix(serviceTypeName(service.Type), "._tcp") {
+			continue
+		}
+		if err := scanScope.check(service.IP); err != nil {
+			continue
+		}
+		targets = append(targets, &target{key: key, address: net.JoinHostPort(service.IP, strconv.Itoa(int(service.Port)))})
+	}
+
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, reachabilityConcurrency)
+	for _, t := range targets {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func() {
+			defer wg.Done()
+			defer func() { <-sem }()
+			t.reachable = c.dial(t.address, c.timeout) == nil
+		}()
+	}
+	wg.Wait()
+
+	unreachable := 0
+	server.order.Lock()
+	var changed []*MDNSService
+	server.table.do(func() {
+		for _, t := range targets {
+			if !t.reachable {
+				unreachable++
+			}
+			if service := server.table.markReachable(t.key, t.reachable, now.Unix()); service != nil {
+				changed = append(changed, service)
+			}
+		}
+	})
+	for _, service := range changed {
+		if !*service.Reachable {
+			log.Printf("Service unreachable: %s (%s) at %s:%d", service.Name, service.Type, service.IP, service.Port)
+		}
+		server.bus.Publish(TopicService, &DiscoveryResponse{Service: *service})
+	}
+	server.order.Unlock()
+
+	c.mu.Lock()
+	c.checkedAt, c.checked, c.unreachable = now, len(targets), unreachable
+	c.mu.Unlock()
+	return len(changed)
+}
+
+// Status is the reachability section of /api/status.
+func (c *ReachabilityChecker) Status() map[string]interface{} {
+	if c == nil {
+		return map[string]interface{}{"enabled": false}
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	status := map[string]interface{}{
+		"enabled":     true,
+		"interval":    c.interval.String(),
+		"checked":     c.checked,
+		"unreachable": c.unreachable,
+	}
+	if !c.checkedAt.IsZero() {
+		status["checkedAt"] = c.checkedAt.Unix()
+	}
+	return status
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+// TestReachabilityCheck verifies local TCP services are marked by whether
+// their port accepts connections, with an event only when that changes,
+// and services outside the scan scope are left unchecked
+func TestReachabilityCheck(t *testing.T) {
+	saved := scanScope
+	scanScope, _ = ParseScanScope("10.0.0.0/24", "")
+	t.Cleanup(func() { scanScope = saved })
+
+	server := NewMDNSServer()
+	for name, ip := range map[string]string{"printer": "10.0.0.5", "nas": "10.0.0.6", "remote": "192.168.9.9"} {
+		service := &MDNSService{Name: name, Type: "_ipp._tcp.local.", IP: ip, Port: 631}
+		server.changeService(server.identity(service), service, false)
+	}
+	var events []*DiscoveryResponse
+	server.bus.Subscribe("test", func(e BusEvent) {
+		events = append(events, e.Payload.(*DiscoveryResponse))
+	}, TopicService)
+
+	down := map[string]bool{"10.0.0.6:631": true}
+	checker := NewReachabilityChecker(time.Minute)
+	checker.dial = func(address string, timeout time.Duration) error {
+		if down[address] {
+			return errors.New("connection refused")
+		}
+		return nil
+	}
+
+	now := time.Unix(1700000000, 0)
+	if n := checker.checkAll(server, now); n != 2 || len(events) != 2 {
+		t.Fatalf("Expected both local services to change on their first check, got %d and %+v", n, events)
+	}
+	services := make(map[string]MDNSService)
+	for _, service := range server.listServices(defaultSite) {
+		services[service.Name] = service
+	}
+	if printer := services["printer"]; printer.Reachable == nil || !*printer.Reachable || printer.CheckedAt != now.Unix() || printer.ReachableAt != now.Unix() {
+		t.Fatalf("Expected the printer reachable, got %+v", printer)
+	}
+	if nas := services["nas"]; nas.Reachable == nil || *nas.Reachable || nas.ReachableAt != 0 {
+		t.Fatalf("Expected the NAS unreachable, got %+v", nas)
+	}
+	if remote := services["remote"]; remote.Reachable != nil || remote.CheckedAt != 0 {
+		t.Fatalf("Expected the service outside the scope unchecked, got %+v", remote)
+	}
+
+	events = nil
+	if n := checker.checkAll(server, now.Add(time.Minute)); n != 0 || len(events) != 0 {
+		t.Fatalf("Expected no events while nothing changes, got %+v", events)
+	}
+	delete(down, "10.0.0.6:631")
+	if n := checker.checkAll(server, now.Add(2*time.Minute)); n != 1 || events[0].Service.Name != "nas" || !*events[0].Service.Reachable {
+		t.Fatalf("Expected the NAS to be reported reachable again, got %+v", events)
+	}
+	if status := checker.Status(); status["checked"] != 2 || status["unreachable"] != 0 {
+		t.Fatalf("Expected 2 services checked and none unreachable, got %v", status)
+	}
+}
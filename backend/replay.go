@@ -0,0 +1,107 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// maxReplayEvents caps the replay buffer regardless of its time window so a
+// burst of churn cannot grow it without bound.
+const maxReplayEvents = 10000
+
+type replayRecord struct {
+	seq   uint64
+	at    time.Time
+	event *DiscoveryResponse
+}
+
+// ReplayBuffer keeps the events broadcast during the last window so newly
+// connected dashboards can show recent churn instead of starting blank, and
+// so long-polling clients can resume from a cursor. The cursor is the
+// events' sequence number on the bus (see EventBus).
+type ReplayBuffer struct {
+	mu      sync.Mutex
+	window  time.Duration
+	events  []replayRecord
+	seq     uint64 // of the latest event
+	expired uint64 // of the latest event dropped from the buffer
+	changed chan struct{}
+}
+
+// NewReplayBuffer creates a buffer holding events for window. A zero window
+// disables replay and polling.
+func NewReplayBuffer(window time.Duration) *ReplayBuffer {
+	return &ReplayBuffer{window: window, changed: make(chan struct{})}
+}
+
+// Window returns how far back the buffer reaches.
+func (b *ReplayBuffer) Window() time.Duration {
+	return b.window
+}
+
+// Add appends an event and expires events older than the window.
+func (b *ReplayBuffer) Add(event *DiscoveryResponse, now time.Time) {
+	if b.window <= 0 {
+		return
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	// Events that weren't published are numbered after the latest one
+	b.seq = max(event.Seq, b.seq+1)
+	b.events = append(b.events, replayRecord{seq: b.seq, at: now, event: event})
+
+	// Wake up every waiting poller
+	close(b.changed)
+	b.changed = make(chan struct{})
+
+	cutoff := now.Add(-b.window)
+	drop := 0
+	for drop < len(b.events) && (b.events[drop].at.Before(cutoff) || len(b.events)-drop > maxReplayEvents) {
+		drop++
+	}
+	if drop > 0 {
+		b.expired = b.events[drop-1].seq
+		b.events = append(b.events[:0], b.events[drop:]...)
+	}
+}
+
+// Since returns the buffered events recorded at or after t, oldest first.
+func (b *ReplayBuffer) Since(t time.Time) []*DiscoveryResponse {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	var result []*DiscoveryResponse
+	for _, rec := range b.events {
+		if !rec.at.Before(t) {
+			result = append(result, rec.event)
+		}
+	}
+	return result
+}
+
+// After returns the buffered events with a sequence number greater than
+// cursor, the cursor to resume from, and whether some events after cursor
+// have already expired from the buffer. It also returns a channel that is
+// closed when the next event is added.
+func (b *ReplayBuffer) After(cursor uint64) (events []*DiscoveryResponse, next uint64, gap bool, changed <-chan struct{}) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for _, rec := range b.events {
+		if rec.seq > cursor {
+			events = append(events, rec.event)
+		}
+	}
+	// Sequence numbers skip the events of other topics, so a cursor past
+	// the latest buffered event is still current
+	return events, max(cursor, b.seq), cursor < b.expired, b.changed
+}
+
+// Latest returns the sequence number of the most recent event.
+func (b *ReplayBuffer) Latest() uint64 {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.seq
+}
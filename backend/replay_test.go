@@ -0,0 +1,166 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestReplayBufferWindow verifies events older than the window expire
+func TestReplayBufferWindow(t *testing.T) {
+	buffer := NewReplayBuffer(5 * time.Minute)
+	start := time.Date(2026, 3, 10, 12, 0, 0, 0, time.UTC)
+
+	buffer.Add(&DiscoveryResponse{Service: MDNSService{Name: "old"}}, start)
+	buffer.Add(&DiscoveryResponse{Service: MDNSService{Name: "recent"}}, start.Add(4*time.Minute))
+	buffer.Add(&DiscoveryResponse{Service: MDNSService{Name: "new"}}, start.Add(6*time.Minute))
+
+	events := buffer.Since(start)
+	if len(events) != 2 || events[0].Service.Name != "recent" {
+		t.Fatalf("Expected the old event to expire, got %d events", len(events))
+	}
+
+	events = buffer.Since(start.Add(5 * time.Minute))
+	if len(events) != 1 || events[0].Service.Name != "new" {
+		t.Fatalf("Expected only the newest event since minute 5, got %d events", len(events))
+	}
+}
+
+// TestSubscribeClientReplay verifies a new client receives the backlog
+func TestSubscribeClientReplay(t *testing.T) {
+	server := NewMDNSServer()
+	server.replay = NewReplayBuffer(time.Minute)
+	server.fanOut(newStreamEvent(&DiscoveryResponse{Service: MDNSService{Name: "printer"}}))
+
+	client := &streamClient{ch: make(chan *streamEvent, 1)}
+	backlog, _ := server.subscribeClient(client, time.Minute)
+	if len(backlog) != 1 || backlog[0].Service.Name != "printer" {
+		t.Fatalf("Expected the printer event to be replayed, got %v", backlog)
+	}
+}
+
+// TestReplayBufferAfter verifies cursor-based reads and gap detection
+func TestReplayBufferAfter(t *testing.T) {
+	buffer := NewReplayBuffer(time.Minute)
+	start := time.Date(2026, 3, 10, 12, 0, 0, 0, time.UTC)
+
+	buffer.Add(&DiscoveryResponse{Service: MDNSService{Name: "a"}}, start)
+	buffer.Add(&DiscoveryResponse{Service: MDNSService{Name: "b"}}, start.Add(2*time.Minute))
+
+	events, next, gap, _ := buffer.After(0)
+	if len(events) != 1 || events[0].Service.Name != "b" || next != 2 || !gap {
+		t.Fatalf("Expected only b with a gap and cursor 2, got %d events, cursor %d, gap %v", len(events), next, gap)
+	}
+
+	events, next, gap, changed := buffer.After(2)
+	if len(events) != 0 || next != 2 || gap {
+		t.Fatalf("Expected no events at the latest cursor, got %d events, cursor %d, gap %v", len(events), next, gap)
+	}
+
+	buffer.Add(&DiscoveryResponse{Service: MDNSService{Name: "c"}}, start.Add(3*time.Minute))
+	select {
+	case <-changed:
+	default:
+		t.Fatalf("Expected the changed channel to close when an event is added")
+	}
+}
+
+// TestReplayBufferSequence verifies the buffer is keyed by the events'
+// sequence numbers, which skip those of other topics
+func TestReplayBufferSequence(t *testing.T) {
+	buffer := NewReplayBuffer(time.Minute)
+	start := time.Date(2026, 3, 10, 12, 0, 0, 0, time.UTC)
+
+	buffer.Add(&DiscoveryResponse{Service: MDNSService{Name: "a"}, Seq: 3}, start)
+	buffer.Add(&DiscoveryResponse{Service: MDNSService{Name: "b"}, Seq: 7}, start.Add(2*time.Minute))
+
+	events, next, gap, _ := buffer.After(4)
+	if len(events) != 1 || events[0].Service.Name != "b" || next != 7 || gap {
+		t.Fatalf("Expected only b without a gap after the expired a, got %d events, cursor %d, gap %v", len(events), next, gap)
+	}
+	if _, _, gap, _ := buffer.After(2); !gap {
+		t.Fatalf("Expected a gap before the expired a")
+	}
+	if events, next, gap, _ := buffer.After(9); len(events) != 0 || next != 9 || gap {
+		t.Fatalf("Expected a cursor past b to stay current, got %d events, cursor %d, gap %v", len(events), next, gap)
+	}
+}
+
+// TestDiscoverResume verifies a reconnecting stream client gets the events
+// after its Last-Event-ID, each with its sequence number as the ID
+func TestDiscoverResume(t *testing.T) {
+	server := NewMDNSServer()
+	server.replay = NewReplayBuffer(time.Minute)
+	for _, name := range []string{"a", "b", "c"} {
+		server.changeService(name, &MDNSService{Name: name, Type: "_http._tcp.local.", IP: "10.0.0.1"}, false)
+	}
+	// broadcast hands the events to the dispatcher
+	for server.replay.Latest() < 3 {
+		time.Sleep(time.Millisecond)
+	}
+
+	ts := httptest.NewServer(http.HandlerFunc(server.Discover))
+	defer ts.Close()
+	stream := func(lastEventID string) string {
+		ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+		defer cancel()
+		req, _ := http.NewRequestWithContext(ctx, http.MethodGet, ts.URL, nil)
+		req.Header.Set("Last-Event-ID", lastEventID)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("Expected the stream to open, got %v", err)
+		}
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		return string(body)
+	}
+
+	body := stream("1")
+	if strings.Contains(body, `"name":"a"`) || !strings.Contains(body, "id: 2\ndata: ") || !strings.Contains(body, "id: 3\ndata: ") {
+		t.Fatalf("Expected events 2 and 3 with their IDs, got %q", body)
+	}
+	if body := stream("99"); !strings.HasPrefix(body, "event: gap\n") {
+		t.Fatalf("Expected a gap for an ID from before a restart, got %q", body)
+	}
+}
+
+// TestDiscoverInventory verifies a new stream client first gets the known
+// services, with the seq they reflect as the ID to resume from, and a
+// client that can't resume gets them after the gap
+func TestDiscoverInventory(t *testing.T) {
+	server := NewMDNSServer()
+	for _, name := range []string{"a", "b"} {
+		server.changeService(name, &MDNSService{Name: name, Type: "_http._tcp.local.", IP: "10.0.0.1"}, false)
+	}
+	server.changeService("a", &MDNSService{Name: "a", Type: "_http._tcp.local.", IP: "10.0.0.1"}, true)
+
+	ts := httptest.NewServer(http.HandlerFunc(server.Discover))
+	defer ts.Close()
+	stream := func(lastEventID string) string {
+		ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+		defer cancel()
+		req, _ := http.NewRequestWithContext(ctx, http.MethodGet, ts.URL, nil)
+		if lastEventID != "" {
+			req.Header.Set("Last-Event-ID", lastEventID)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("Expected the stream to open, got %v", err)
+		}
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		return string(body)
+	}
+
+	body := stream("")
+	if strings.Contains(body, `"name":"a"`) || !strings.HasPrefix(body, "id: 3\ndata: ") || !strings.Contains(body, `"name":"b"`) {
+		t.Fatalf("Expected only the known service b at seq 3, got %q", body)
+	}
+	if body := stream("99"); !strings.HasPrefix(body, "event: gap\n") || !strings.Contains(body, `"name":"b"`) {
+		t.Fatalf("Expected the inventory after the gap, got %q", body)
+	}
+}
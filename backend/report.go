@@ -0,0 +1,255 @@
+package main
+
+import (
+	"fmt"
+	"html/template"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+// defaultReportPeriod is how far back a report's findings and changes go.
+const defaultReportPeriod = 7 * 24 * time.Hour
+
+// Report is the network documentation /api/report renders: the inventory,
+// the anomalies found, and the services that came and went.
+type Report struct {
+	Site        string
+	Interface   string
+	GeneratedAt time.Time
+	Since       time.Time
+	Summary     Summary
+	Devices     []*DeviceSummary
+	Findings    []HistoryEntry
+	Changes     []HistoryEntry
+}
+
+// buildReport assembles the report of site over the period since since.
+func (s *MDNSServer) buildReport(site string, since, now time.Time) Report {
+	s.mu.RLock()
+	iface := s.currentIface
+	s.mu.RUnlock()
+
+	devices := s.summarizeDevices(s.listDevices(site, ""), site)
+	report := Report{
+		Site:        site,
+		Interface:   iface,
+		GeneratedAt: now,
+		Since:       since,
+		Summary:     summarize(site, devices, now, 10),
+		Devices:     devices,
+	}
+	for _, entry := range s.history.Since(since) {
+		switch {
+		case entry.Anomaly != nil:
+			report.Findings = append(report.Findings, entry)
+		case entry.Change != nil && inSite(&entry.Change.Service, site):
+			report.Changes = append(report.Changes, entry)
+		}
+	}
+	// Most recent first
+	sort.SliceStable(report.Findings, func(i, j int) bool { return report.Findings[i].Time.After(report.Findings[j].Time) })
+	sort.SliceStable(report.Changes, func(i, j int) bool { return report.Changes[i].Time.After(report.Changes[j].Time) })
+	return report
+}
+
+// reportServices lists a device's services as "type:port".
+func reportServices(device *DeviceSummary) string {
+	services := make([]string, 0, len(device.Services))
+	for _, service := range device.Services {
+		services = append(services, fmt.Sprintf("%s:%d", strings.TrimSuffix(service.Type, ".local."), service.Port))
+	}
+	return strings.Join(services, ", ")
+}
+
+// reportTime formats a time for the report, in the server's timezone.
+func reportTime(t time.Time) string {
+	return t.Format("2006-01-02 15:04")
+}
+
+// reportUnix formats Unix seconds like reportTime, or "" for 0.
+func reportUnix(secs int64) string {
+	if secs == 0 {
+		return ""
+	}
+	return reportTime(time.Unix(secs, 0))
+}
+
+// reportChange describes a service change.
+func reportChange(change *DiscoveryResponse) string {
+	verb := "appeared"
+	if change.Removed {
+		verb = "removed"
+	}
+	return fmt.Sprintf("%s (%s) at %s %s", change.Service.Name, strings.TrimSuffix(change.Service.Type, ".local."), change.Service.IP, verb)
+}
+
+func reportSite(site string) string {
+	if site == "" {
+		return "all sites"
+	}
+	return site
+}
+
+var reportTemplate = template.Must(template.New("report").Funcs(template.FuncMap{
+	"time":     reportTime,
+	"unix":     reportUnix,
+	"services": reportServices,
+	"change":   reportChange,
+	"site":     reportSite,
+	"join":     strings.Join,
+}).Parse(`<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<title>Network report: {{site .Site}}, {{time .GeneratedAt}}</title>
+<style>
+body { font: 14px/1.4 -apple-system, "Helvetica Neue", Arial, sans-serif; color: #222; margin: 2em; }
+h1 { font-size: 1.6em; margin-bottom: 0; }
+h2 { font-size: 1.2em; margin-top: 2em; border-bottom: 1px solid #ccc; }
+.meta { color: #666; }
+table { border-collapse: collapse; width: 100%; }
+th, td { text-align: left; padding: 4px 8px; border-bottom: 1px solid #eee; vertical-align: top; }
+th { background: #f5f5f5; }
+.counts td:first-child { width: 12em; }
+.high { color: #b00020; font-weight: bold; }
+.medium { color: #b35c00; }
+@media print { body { margin: 0; } h2 { break-after: avoid; } tr { break-inside: avoid; } }
+</style>
+</head>
+<body>
+<h1>Network report: {{site .Site}}</h1>
+<p class="meta">Generated {{time .GeneratedAt}} on interface {{.Interface}}. Findings and changes since {{time .Since}}.</p>
+
+<h2>Summary</h2>
+<table class="counts">
+<tr><td>Devices</td><td>{{.Summary.Devices}} ({{.Summary.Online}} online, {{.Summary.Offline}} offline, {{.Summary.New}} new in the last 24 hours)</td></tr>
+<tr><td>Findings</td><td>{{len .Findings}}</td></tr>
+<tr><td>Service changes</td><td>{{len .Changes}}</td></tr>
+</table>
+
+<h2>Inventory</h2>
+<table>
+<tr><th>Device</th><th>Category</th><th>Vendor</th><th>Addresses</th><th>MAC</th><th>Owner / location</th><th>Services</th><th>Last seen</th></tr>
+{{range .Devices}}<tr><td>{{.ID}}</td><td>{{.Category}}</td><td>{{.Vendor}}</td><td>{{join .Addresses ", "}}</td><td>{{.MAC}}</td><td>{{.Owner}}{{if and .Owner .Location}} / {{end}}{{.Location}}</td><td>{{services .}}</td><td>{{unix .LastSeen}}</td></tr>
+{{else}}<tr><td colspan="8">No devices.</td></tr>
+{{end}}</table>
+
+<h2>Findings</h2>
+<table>
+<tr><th>Time</th><th>Severity</th><th>Kind</th><th>Device</th><th>Message</th></tr>
+{{range .Findings}}<tr><td>{{time .Time}}</td><td class="{{.Anomaly.Severity}}">{{.Anomaly.Severity}}</td><td>{{.Anomaly.Kind}}</td><td>{{.Anomaly.Device}}</td><td>{{.Anomaly.Message}}</td></tr>
+{{else}}<tr><td colspan="5">No findings.</td></tr>
+{{end}}</table>
+
+<h2>Recent changes</h2>
+<table>
+<tr><th>Time</th><th>Change</th></tr>
+{{range .Changes}}<tr><td>{{time .Time}}</td><td>{{change .Change}}</td></tr>
+{{else}}<tr><td colspan="2">No changes.</td></tr>
+{{end}}</table>
+</body>
+</html>
+`))
+
+// pdf renders the report as a PDF of plain text sections.
+func (report Report) pdf() []byte {
+	var doc pdfDocument
+	doc.text("Network report: "+reportSite(report.Site), 18, true)
+	doc.text(fmt.Sprintf("Generated %s on interface %s. Findings and changes since %s.", reportTime(report.GeneratedAt), report.Interface, reportTime(report.Since)), 9, false)
+
+	section := func(title string) {
+		doc.space(10)
+		doc.text(title, 13, true)
+		doc.space(2)
+	}
+	section("Summary")
+	doc.text(fmt.Sprintf("Devices: %d (%d online, %d offline, %d new in the last 24 hours)", report.Summary.Devices, report.Summary.Online, report.Summary.Offline, report.Summary.New), 9, false)
+	doc.text(fmt.Sprintf("Findings: %d. Service changes: %d.", len(report.Findings), len(report.Changes)), 9, false)
+
+	section("Inventory")
+	if len(report.Devices) == 0 {
+		doc.text("No devices.", 9, false)
+	}
+	for _, device := range report.Devices {
+		doc.space(3)
+		doc.text(fmt.Sprintf("%s (%s)", device.ID, device.Category), 10, true)
+		details := []string{"Addresses: " + strings.Join(device.Addresses, ", ")}
+		for _, field := range []struct{ name, value string }{
+			{"MAC", device.MAC}, {"Vendor", device.Vendor}, {"Owner", device.Owner}, {"Location", device.Location},
+			{"Services", reportServices(device)}, {"Last seen", reportUnix(device.LastSeen)},
+		} {
+			if field.value != "" {
+				details = append(details, field.name+": "+field.value)
+			}
+		}
+		doc.text(strings.Join(details, ". "), 9, false)
+	}
+
+	section("Findings")
+	if len(report.Findings) == 0 {
+		doc.text("No findings.", 9, false)
+	}
+	for _, entry := range report.Findings {
+		line := reportTime(entry.Time) + "  "
+		if entry.Anomaly.Severity != "" {
+			line += "[" + entry.Anomaly.Severity + "] "
+		}
+		doc.text(line+entry.Anomaly.Kind+": "+entry.Anomaly.Message, 9, false)
+	}
+
+	section("Recent changes")
+	if len(report.Changes) == 0 {
+		doc.text("No changes.", 9, false)
+	}
+	for _, entry := range report.Changes {
+		doc.text(reportTime(entry.Time)+"  "+reportChange(entry.Change), 9, false)
+	}
+	return doc.bytes()
+}
+
+// ReportHandler handles GET /api/report: a self-contained HTML report of the
+// inventory of the site selected by ?site=, the anomalies found and the
+// service changes over the last ?since= (default 168h), or a PDF with
+// ?format=pdf. ?download=1 asks browsers to save it.
+func (s *MDNSServer) ReportHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	period := defaultReportPeriod
+	if v := r.URL.Query().Get("since"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d <= 0 {
+			writeError(w, http.StatusBadRequest, "invalid since duration")
+			return
+		}
+		period = d
+	}
+	format := r.URL.Query().Get("format")
+	if format == "" {
+		format = "html"
+	}
+	if format != "html" && format != "pdf" {
+		writeError(w, http.StatusBadRequest, "format must be html or pdf")
+		return
+	}
+
+	now := time.Now()
+	report := s.buildReport(s.siteParam(r), now.Add(-period), now)
+	if r.URL.Query().Get("download") == "1" {
+		w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="network-report-%s.%s"`, now.Format("2006-01-02"), format))
+	}
+	if format == "pdf" {
+		w.Header().Set("Content-Type", "application/pdf")
+		w.Write(report.pdf())
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err := reportTemplate.Execute(w, report); err != nil {
+		log.Printf("⚠️  Rendering report: %v", err)
+	}
+}
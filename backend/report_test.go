@@ -0,0 +1,77 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestEventHistory verifies service changes and anomalies are recorded and
+// bounded by historyMax
+func TestEventHistory(t *testing.T) {
+	saved := historyMax
+	historyMax = 3
+	defer func() { historyMax = saved }()
+
+	bus := NewEventBus()
+	history := NewEventHistory(bus)
+	bus.Publish(TopicHost, HostEvent{ID: "nas.local"})
+	for _, name := range []string{"a", "b", "c"} {
+		bus.Publish(TopicService, &DiscoveryResponse{Service: MDNSService{Name: name}})
+	}
+	bus.Publish(TopicAnomaly, AnomalyEvent{Kind: "spoofing"})
+
+	entries := history.Since(time.Time{})
+	if len(entries) != 3 || entries[0].Change.Service.Name != "b" || entries[2].Anomaly.Kind != "spoofing" {
+		t.Fatalf("Expected the last 3 service and anomaly events, got %+v", entries)
+	}
+	if entries := history.Since(time.Now().Add(time.Hour)); len(entries) != 0 {
+		t.Fatalf("Expected no entries in the future, got %d", len(entries))
+	}
+}
+
+// TestReportHandler verifies the HTML and PDF reports include the inventory,
+// findings and changes
+func TestReportHandler(t *testing.T) {
+	server := NewMDNSServer()
+	server.metadata, _ = NewMetadataStore(openTestStore(t, "json", t.TempDir()))
+	printer := &MDNSService{Name: "Office <Printer>", Type: "_ipp._tcp.local.", IP: "192.168.1.30", Port: 631, Timestamp: time.Now().Unix()}
+	server.addService("a", printer)
+	server.bus.Publish(TopicService, &DiscoveryResponse{Service: *printer})
+	server.bus.Publish(TopicAnomaly, AnomalyEvent{Kind: "spoofing", Severity: "high", Message: "Two hosts claim printer.local"})
+
+	rec := httptest.NewRecorder()
+	server.ReportHandler(rec, httptest.NewRequest(http.MethodGet, "/api/report", nil))
+	body := rec.Body.String()
+	if rec.Code != http.StatusOK || !strings.HasPrefix(rec.Header().Get("Content-Type"), "text/html") {
+		t.Fatalf("Expected an HTML report, got %d %s", rec.Code, rec.Header().Get("Content-Type"))
+	}
+	for _, want := range []string{"_ipp._tcp:631", "192.168.1.30", "Two hosts claim printer.local", "Office &lt;Printer&gt; (_ipp._tcp) at 192.168.1.30 appeared"} {
+		if !strings.Contains(body, want) {
+			t.Fatalf("Expected %q in the report", want)
+		}
+	}
+
+	rec = httptest.NewRecorder()
+	server.ReportHandler(rec, httptest.NewRequest(http.MethodGet, "/api/report?format=pdf&download=1", nil))
+	if rec.Header().Get("Content-Type") != "application/pdf" || !bytes.HasPrefix(rec.Body.Bytes(), []byte("%PDF-")) {
+		t.Fatalf("Expected a PDF report, got %s", rec.Header().Get("Content-Type"))
+	}
+	if !strings.Contains(rec.Header().Get("Content-Disposition"), ".pdf") {
+		t.Fatalf("Expected a download filename, got %q", rec.Header().Get("Content-Disposition"))
+	}
+	if !bytes.Contains(rec.Body.Bytes(), []byte("Two hosts claim printer.local")) {
+		t.Fatalf("Expected the finding in the PDF")
+	}
+
+	for _, query := range []string{"?since=x", "?format=doc"} {
+		rec = httptest.NewRecorder()
+		server.ReportHandler(rec, httptest.NewRequest(http.MethodGet, "/api/report"+query, nil))
+		if rec.Code != http.StatusBadRequest {
+			t.Fatalf("Expected 400 for %s, got %d", query, rec.Code)
+		}
+	}
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// prunable is implemented by stores whose records age out under a retention
+// policy.
+type prunable interface {
+	Prune(before time.Time) int
+}
+
+// storageReporter is implemented by every persisted subsystem so its size
+// can be reported on /api/storage.
+type storageReporter interface {
+	Records() int
+}
+
+// parseRetention parses a comma-separated list of name=duration policies,
+// e.g. "availability=90d". Durations accept a "d" suffix for days in
+// addition to the units understood by time.ParseDuration; "0" or "never"
+// disables pruning for that store.
+func parseRetention(spec string) (map[string]time.Duration, error) {
+	policies := make(map[string]time.Duration)
+	for _, part := range strings.Split(spec, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		name, value, ok := strings.Cut(part, "=")
+		if !ok {
+			return nil, fmt.Errorf("retention %q: expected name=duration", part)
+		}
+		d, err := parseDays(value)
+		if err != nil {
+			return nil, fmt.Errorf("retention %q: %v", part, err)
+		}
+		policies[strings.TrimSpace(name)] = d
+	}
+	return policies, nil
+}
+
+// parseDays is time.ParseDuration with support for a "d" (day) suffix.
+func parseDays(value string) (time.Duration, error) {
+	value = strings.TrimSpace(value)
+	if value == "never" || value == "0" {
+		return 0, nil
+	}
+	if n, ok := strings.CutSuffix(value, "d"); ok {
+		days, err := strconv.Atoi(n)
+		if err != nil || days < 0 {
+			return 0, fmt.Errorf("invalid number of days %q", n)
+		}
+		return time.Duration(days) * 24 * time.Hour, nil
+	}
+	return time.ParseDuration(value)
+}
+
+func formatRetention(d time.Duration) string {
+	if d <= 0 {
+		return "never"
+	}
+	if d%(24*time.Hour) == 0 {
+		return fmt.Sprintf("%dd", d/(24*time.Hour))
+	}
+	return d.String()
+}
+
+// StorageStats describes one persisted store on /api/storage.
+type StorageStats struct {
+	Name      string `json:"name"`
+	Records   int    `json:"records"`
+	Retention string `json:"retention"`
+	Pruned    int    `json:"pruned"`
+}
+
+// Vacuum periodically prunes stores according to their retention policies.
+// Stores registered without a policy are never pruned.
+type Vacuum struct {
+	mu       sync.Mutex
+	policies map[string]time.Duration
+	stores   map[string]storageReporter
+	pruned   map[string]int
+	lastRun  time.Time
+}
+
+// NewVacuum creates a vacuum job enforcing the given policies.
+func NewVacuum(policies map[string]time.Duration) *Vacuum {
+	return &Vacuum{
+		policies: policies,
+		stores:   make(map[string]storageReporter),
+		pruned:   make(map[string]int),
+	}
+}
+
+// Register adds a store under name. Stores that also implement prunable are
+// pruned when a policy exists for name.
+func (v *Vacuum) Register(name string, store storageReporter) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	v.stores[name] = store
+}
+
+// Run prunes all stores every interval. It never returns.
+func (v *Vacuum) Run(interval time.Duration) {
+	v.runOnce(time.Now())
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for now := range ticker.C {
+		v.runOnce(now)
+	}
+}
+
+func (v *Vacuum) runOnce(now time.Time) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	for name, store := range v.stores {
+		keep := v.policies[name]
+		p, ok := store.(prunable)
+		if keep <= 0 || !ok {
+			continue
+		}
+		if n := p.Prune(now.Add(-keep)); n > 0 {
+			v.pruned[name] += n
+			log.Printf("🧹 Pruned %d %s records older than %s", n, name, formatRetention(keep))
+		}
+	}
+	v.lastRun = now
+}
+
+// Stats reports the record count and retention of every registered store.
+func (v *Vacuum) Stats() []StorageStats {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	stats := make([]StorageStats, 0, len(v.stores))
+	for name, store := range v.stores {
+		stats = append(stats, StorageStats{
+			Name:      name,
+			Records:   store.Records(),
+			Retention: formatRetention(v.policies[name]),
+			Pruned:    v.pruned[name],
+		})
+	}
+	sort.Slice(stats, func(i, j int) bool { return stats[i].Name < stats[j].Name })
+	return stats
+}
+
+// LastRun returns when the vacuum job last completed.
+func (v *Vacuum) LastRun() time.Time {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	return v.lastRun
+}
+
+// Storage handles GET /api/storage, reporting the storage backend's size on
+// disk, the record count and retention of each subsystem, and the estimated
+// size of the in-memory state.
+func (s *MDNSServer) Storage(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	response := map[string]interface{}{
+		"backend":   s.storeKind,
+		"encrypted": rawStore(s.store) != s.store,
+		"bytes":     s.store.Size(),
+		"stores":    s.vacuum.Stats(),
+		"memory":    s.memory.Stats(),
+	}
+	if last := s.vacuum.LastRun(); !last.IsZero() {
+		response["lastVacuum"] = last.Unix()
+	}
+	writeJSON(w, http.StatusOK, response)
+}
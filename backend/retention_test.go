@@ -0,0 +1,61 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// TestParseRetention verifies day suffixes and disabled policies
+func TestParseRetention(t *testing.T) {
+	policies, err := parseRetention("availability=90d, latency=36h, devices=never")
+	if err != nil {
+		t.Fatalf("Failed to parse retention: %v", err)
+	}
+	if policies["availability"] != 90*24*time.Hour {
+		t.Fatalf("Expected 90 days, got %v", policies["availability"])
+	}
+	if policies["latency"] != 36*time.Hour {
+		t.Fatalf("Expected 36 hours, got %v", policies["latency"])
+	}
+	if policies["devices"] != 0 {
+		t.Fatalf("Expected never to disable pruning, got %v", policies["devices"])
+	}
+
+	if _, err := parseRetention("availability"); err == nil {
+		t.Fatalf("Expected an error for a policy without a duration")
+	}
+}
+
+// TestVacuumPrunesAvailability verifies old intervals are dropped and
+// device records are left alone
+func TestVacuumPrunesAvailability(t *testing.T) {
+	store := openTestStore(t, "json", t.TempDir())
+	availability, _ := NewAvailabilityTracker(store)
+	metadata, _ := NewMetadataStore(store)
+
+	now := time.Date(2026, 3, 10, 12, 0, 0, 0, time.UTC)
+	availability.Sighted("old.local", now.Add(-100*24*time.Hour))
+	availability.Sighted("new.local", now.Add(-time.Hour))
+	metadata.Update(defaultSite, "old.local", func(d *DeviceMetadata) { d.Owner = "alex" })
+
+	vacuum := NewVacuum(map[string]time.Duration{"availability": 90 * 24 * time.Hour})
+	vacuum.Register("availability", availability)
+	vacuum.Register("devices", metadata)
+	vacuum.runOnce(now)
+
+	if got := availability.History("old.local"); len(got) != 0 {
+		t.Fatalf("Expected old history to be pruned, got %v", got)
+	}
+	if got := availability.History("new.local"); len(got) != 1 {
+		t.Fatalf("Expected recent history to be kept, got %v", got)
+	}
+	if metadata.Get(defaultSite, "old.local") == nil {
+		t.Fatalf("Expected device records to never be pruned")
+	}
+
+	for _, stats := range vacuum.Stats() {
+		if stats.Name == "availability" && stats.Pruned != 1 {
+			t.Fatalf("Expected 1 pruned availability record, got %d", stats.Pruned)
+		}
+	}
+}
@@ -0,0 +1,371 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/icmp"
+	"golang.org/x/net/ipv6"
+)
+
+// Router advertisement monitoring settings.
+const (
+	// raLearnPeriod is how long after startup advertising routers are
+	// trusted when no -ra-routers are configured
+	raLearnPeriod = 10 * time.Minute
+	raRetry       = time.Minute
+	maxRouters    = 64
+	maxRAAlerts   = 100
+)
+
+// RAPrefix is a prefix information option of a router advertisement.
+type RAPrefix struct {
+	Prefix            string `json:"prefix"`
+	OnLink            bool   `json:"onLink"`
+	Autonomous        bool   `json:"autonomous"` // usable for SLAAC
+	ValidLifetime     uint32 `json:"validLifetime"`
+	PreferredLifetime uint32 `json:"preferredLifetime"`
+}
+
+// RouterAdvertisement is the content of an ICMPv6 router advertisement
+// (RFC 4861), with the RDNSS and DNSSL options of RFC 8106.
+type RouterAdvertisement struct {
+	HopLimit    uint8      `json:"hopLimit"`
+	Managed     bool       `json:"managed"`     // addresses from DHCPv6
+	OtherConfig bool       `json:"otherConfig"` // other configuration from DHCPv6
+	Preference  string     `json:"preference"`  // high, medium or low
+	Lifetime    uint16     `json:"lifetime"`    // as default router, 0 when it isn't one
+	MTU         uint32     `json:"mtu,omitempty"`
+	MAC         string     `json:"mac,omitempty"`
+	Prefixes    []RAPrefix `json:"prefixes"`
+	DNS         []string   `json:"dns,omitempty"`
+	DNSSearch   []string   `json:"dnsSearch,omitempty"`
+	DNSLifetime uint32     `json:"dnsLifetime,omitempty"`
+}
+
+var raPreferences = [4]string{"medium", "high", "reserved", "low"}
+
+// parseRouterAdvertisement decodes an ICMPv6 router advertisement message,
+// starting at its type.
+func parseRouterAdvertisement(b []byte) (*RouterAdvertisement, error) {
+	if len(b) < 16 || b[0] != byte(ipv6.ICMPTypeRouterAdvertisement) || b[1] != 0 {
+		return nil, errors.New("not a router advertisement")
+	}
+	ra := &RouterAdvertisement{
+		HopLimit:    b[4],
+		Managed:     b[5]&0x80 != 0,
+		OtherConfig: b[5]&0x40 != 0,
+		Preference:  raPreferences[b[5]>>3&3],
+		Lifetime:    binary.BigEndian.Uint16(b[6:8]),
+		Prefixes:    []RAPrefix{},
+	}
+
+	options := b[16:]
+	for len(options) > 0 {
+		if len(options) < 2 || options[1] == 0 || len(options) < int(options[1])*8 {
+			return nil, errors.New("malformed option")
+		}
+		kind, option := options[0], options[2:int(options[1])*8]
+		options = options[int(options[1])*8:]
+
+		switch kind {
+		case 1: // source link-layer address
+			if len(option) >= 6 {
+				ra.MAC = net.HardwareAddr(option[:6]).String()
+			}
+		case 3: // prefix information
+			if len(option) < 30 || option[0] > 128 {
+				continue
+			}
+			prefix := &net.IPNet{IP: net.IP(append([]byte(nil), option[14:30]...)), Mask: net.CIDRMask(int(option[0]), 128)}
+			prefix.IP = prefix.IP.Mask(prefix.Mask)
+			ra.Prefixes = append(ra.Prefixes, RAPrefix{
+				Prefix:            prefix.String(),
+				OnLink:            option[1]&0x80 != 0,
+				Autonomous:        option[1]&0x40 != 0,
+				ValidLifetime:     binary.BigEndian.Uint32(option[2:6]),
+				PreferredLifetime: binary.BigEndian.Uint32(option[6:10]),
+			})
+		case 5: // MTU
+			if len(option) >= 6 {
+				ra.MTU = binary.BigEndian.Uint32(option[2:6])
+			}
+		case 25: // recursive DNS servers
+			if len(option) < 6 {
+				continue
+			}
+			ra.DNSLifetime = binary.BigEndian.Uint32(option[2:6])
+			for addrs := option[6:]; len(addrs) >= 16; addrs = addrs[16:] {
+				ra.DNS = append(ra.DNS, net.IP(addrs[:16]).String())
+			}
+		case 31: // DNS search list, as uncompressed DNS names
+			if len(option) < 6 {
+				continue
+			}
+			ra.DNSSearch = append(ra.DNSSearch, parseDNSSearchList(option[6:])...)
+		}
+	}
+	return ra, nil
+}
+
+// parseDNSSearchList decodes a sequence of uncompressed DNS names, padded
+// with zeros.
+func parseDNSSearchList(b []byte) []string {
+	var names []string
+	var labels []string
+	for len(b) > 0 {
+		n := int(b[0])
+		if n == 0 {
+			if len(labels) > 0 {
+				names = append(names, strings.Join(labels, "."))
+				labels = nil
+			}
+			b = b[1:]
+			continue
+		}
+		if n > 63 || len(b) < 1+n {
+			break
+		}
+		labels = append(labels, string(b[1:1+n]))
+		b = b[1+n:]
+	}
+	return names
+}
+
+// Router is a router seen advertising on the discovery interface.
+type Router struct {
+	Address string `json:"address"` // its link-local source address
+	RouterAdvertisement
+	// Expected routers are listed in -ra-routers or, without it, were
+	// advertising during the learning period after startup
+	Expected  bool  `json:"expected"`
+	FirstSeen int64 `json:"firstSeen"`
+	LastSeen  int64 `json:"lastSeen"`
+	Count     int   `json:"count"` // advertisements received
+}
+
+// RAMonitor listens for IPv6 router advertisements on the discovery
+// interface and records each router's prefixes, lifetimes and DNS options.
+// Routers that aren't expected are "rogue-ra" anomalies: a rogue router can
+// redirect IPv6 traffic or hand out its own DNS servers.
+type RAMonitor struct {
+	bus      *EventBus
+	expected []string // addresses or MACs of the legitimate routers
+	started  time.Time
+	// open opens the raw ICMPv6 socket: listenICMPv6, or the privileged
+	// helper's ListenICMPv6 for a server that dropped its privileges
+	open func() (net.PacketConn, error)
+
+	mu      sync.Mutex
+	iface   string
+	err     string
+	routers map[string]*Router
+	alerts  []AnomalyEvent // latest last
+}
+
+// NewRAMonitor creates a monitor. With expected routers, given by
+// link-local address or MAC, every other router is reported; without,
+// routers are learned for raLearnPeriod.
+func NewRAMonitor(bus *EventBus, expected []string) *RAMonitor {
+	m := &RAMonitor{bus: bus, started: time.Now(), open: listenICMPv6, routers: make(map[string]*Router)}
+	for _, router := range expected {
+		if router = strings.ToLower(strings.TrimSpace(router)); router != "" {
+			m.expected = append(m.expected, router)
+		}
+	}
+	return m
+}
+
+// isExpected reports whether the router at addr with mac is legitimate.
+// Must be called with m.mu held.
+func (m *RAMonitor) isExpected(addr, mac string, now time.Time) bool {
+	if len(m.expected) == 0 {
+		return now.Sub(m.started) < raLearnPeriod
+	}
+	for _, expected := range m.expected {
+		if expected == addr || expected == mac {
+			return true
+		}
+	}
+	return false
+}
+
+// observe records an advertisement from src.
+func (m *RAMonitor) observe(src string, ra *RouterAdvertisement, now time.Time) {
+	m.mu.Lock()
+	router := m.routers[src]
+	if router != nil {
+		router.RouterAdvertisement = *ra
+		router.LastSeen = now.Unix()
+		router.Count++
+		m.mu.Unlock()
+		return
+	}
+	if len(m.routers) >= maxRouters {
+		m.mu.Unlock()
+		return
+	}
+	router = &Router{Address: src, RouterAdvertisement: *ra, FirstSeen: now.Unix(), LastSeen: now.Unix(), Count: 1}
+	router.Expected = m.isExpected(src, ra.MAC, now)
+	m.routers[src] = router
+	if router.Expected {
+		iface := m.iface
+		m.mu.Unlock()
+		log.Printf("IPv6 router %s advertising on %s", src, iface)
+		return
+	}
+
+	var prefixes []string
+	for _, prefix := range ra.Prefixes {
+		prefixes = append(prefixes, prefix.Prefix)
+	}
+	event := newAnomaly("rogue-ra", "rogue-ra", map[string]string{
+		"router": src, "mac": ra.MAC, "prefixes": fmt.Sprint(prefixes), "dns": fmt.Sprint(ra.DNS),
+	})
+	event.Device, event.Severity = src, "high"
+	m.alerts = append(m.alerts, event)
+	if n := len(m.alerts) - maxRAAlerts; n > 0 {
+		m.alerts = append([]AnomalyEvent(nil), m.alerts[n:]...)
+	}
+	m.mu.Unlock()
+
+	m.bus.Publish(TopicAnomaly, event)
+}
+
+// listenICMPv6 opens a raw ICMPv6 socket in this process.
+func listenICMPv6() (net.PacketConn, error) {
+	return net.ListenPacket("ip6:ipv6-icmp", "::")
+}
+
+// Run listens on the server's current interface, following interface
+// switches. It needs root (CAP_NET_RAW on Linux) for the ICMPv6 socket,
+// unless the privileged helper opens it.
+func (m *RAMonitor) Run(server *MDNSServer) {
+	for {
+		server.mu.RLock()
+		iface := server.currentIface
+		server.mu.RUnlock()
+
+		err := m.listen(server, iface)
+		if err != nil {
+			log.Printf("Router advertisement monitoring on %s failed: %v", iface, err)
+			m.mu.Lock()
+			m.err = err.Error()
+			m.mu.Unlock()
+			time.Sleep(raRetry)
+		}
+	}
+}
+
+// listen receives advertisements on iface until it fails or the server
+// switches interfaces. A router solicitation gets the routers to advertise
+// right away rather than at their next periodic advertisement.
+func (m *RAMonitor) listen(server *MDNSServer, iface string) error {
+	ifi, err := net.InterfaceByName(iface)
+	if err != nil {
+		return err
+	}
+	conn, err := m.open()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	p := ipv6.NewPacketConn(conn)
+	var filter ipv6.ICMPFilter
+	filter.SetAll(true)
+	filter.Accept(ipv6.ICMPTypeRouterAdvertisement)
+	p.SetICMPFilter(&filter)
+	if err := p.SetControlMessage(ipv6.FlagInterface|ipv6.FlagHopLimit, true); err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	m.iface, m.err = iface, ""
+	m.mu.Unlock()
+
+	solicitation, _ := (&icmp.Message{Type: ipv6.ICMPTypeRouterSolicitation, Body: &icmp.RawBody{Data: make([]byte, 4)}}).Marshal(nil)
+	p.SetMulticastInterface(ifi)
+	p.SetMulticastHopLimit(255)
+	if _, err := p.WriteTo(solicitation, nil, &net.IPAddr{IP: net.ParseIP("ff02::2"), Zone: iface}); err != nil {
+		log.Printf("Router solicitation on %s failed: %v", iface, err)
+	}
+
+	buffer := make([]byte, 1500)
+	for {
+		p.SetReadDeadline(time.Now().Add(time.Second))
+		n, cm, src, err := p.ReadFrom(buffer)
+		if err != nil {
+			if errors.Is(err, os.ErrDeadlineExceeded) {
+				server.mu.RLock()
+				changed := server.currentIface != iface
+				server.mu.RUnlock()
+				if changed {
+					return nil
+				}
+				continue
+			}
+			return err
+		}
+		// Advertisements are only valid from link-local routers with the
+		// hop limit untouched, i.e. from the link itself
+		addr, ok := src.(*net.IPAddr)
+		if !ok || !addr.IP.IsLinkLocalUnicast() || cm == nil || cm.IfIndex != ifi.Index || cm.HopLimit != 255 {
+			continue
+		}
+		if ra, err := parseRouterAdvertisement(buffer[:n]); err == nil {
+			m.observe(addr.IP.String(), ra, time.Now())
+		}
+	}
+}
+
+// Routers returns the routers seen, by address.
+func (m *RAMonitor) Routers() []Router {
+	routers := []Router{}
+	if m == nil {
+		return routers
+	}
+	m.mu.Lock()
+	for _, router := range m.routers {
+		routers = append(routers, *router)
+	}
+	m.mu.Unlock()
+	sort.Slice(routers, func(i, j int) bool { return routers[i].Address < routers[j].Address })
+	return routers
+}
+
+// RouterAdvertisements handles GET /api/ipv6/routers: the routers seen
+// advertising on the discovery interface with their prefixes and DNS
+// options, and the rogue router alerts.
+func (s *MDNSServer) RouterAdvertisements(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	if s.ra == nil {
+		writeJSON(w, http.StatusOK, map[string]interface{}{"enabled": false, "routers": []Router{}})
+		return
+	}
+
+	routers := s.ra.Routers()
+	s.ra.mu.Lock()
+	response := map[string]interface{}{
+		"enabled":   true,
+		"interface": s.ra.iface,
+		"routers":   routers,
+		"alerts":    append([]AnomalyEvent{}, s.ra.alerts...),
+	}
+	if s.ra.err != "" {
+		response["error"] = s.ra.err
+	}
+	s.ra.mu.Unlock()
+	writeJSON(w, http.StatusOK, response)
+}
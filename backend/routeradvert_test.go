@@ -0,0 +1,116 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// testRouterAdvertisement builds a router advertisement with a source
+// link-layer address, a prefix, an MTU, RDNSS and DNSSL option.
+func testRouterAdvertisement() []byte {
+	b := []byte{134, 0, 0, 0, 64, 0x40 | 0x08, 0x07, 0x08, 0, 0, 0, 0, 0, 0, 0, 0}
+
+	b = append(b, 1, 1, 0xaa, 0xbb, 0xcc, 0, 0, 0x01)
+
+	prefix := make([]byte, 32)
+	prefix[0], prefix[1], prefix[2], prefix[3] = 3, 4, 64, 0xc0
+	binary.BigEndian.PutUint32(prefix[4:], 86400)
+	binary.BigEndian.PutUint32(prefix[8:], 14400)
+	copy(prefix[16:], net.ParseIP("2001:db8:1:2::"))
+	b = append(b, prefix...)
+
+	b = append(b, 5, 1, 0, 0, 0, 0, 0x05, 0xdc)
+
+	rdnss := make([]byte, 24)
+	rdnss[0], rdnss[1] = 25, 3
+	binary.BigEndian.PutUint32(rdnss[4:], 1800)
+	copy(rdnss[8:], net.ParseIP("2001:db8:1:2::53"))
+	b = append(b, rdnss...)
+
+	dnssl := make([]byte, 24)
+	dnssl[0], dnssl[1] = 31, 3
+	copy(dnssl[8:], "\x04home\x04arpa\x00")
+	return append(b, dnssl...)
+}
+
+// TestParseRouterAdvertisement verifies the decoding of the header and the
+// options.
+func TestParseRouterAdvertisement(t *testing.T) {
+	ra, err := parseRouterAdvertisement(testRouterAdvertisement())
+	if err != nil {
+		t.Fatalf("Expected the advertisement to parse: %v", err)
+	}
+	if ra.HopLimit != 64 || ra.Managed || !ra.OtherConfig || ra.Preference != "high" || ra.Lifetime != 1800 {
+		t.Fatalf("Unexpected header %+v", ra)
+	}
+	if ra.MAC != "aa:bb:cc:00:00:01" || ra.MTU != 1500 {
+		t.Fatalf("Unexpected MAC %q or MTU %d", ra.MAC, ra.MTU)
+	}
+	if len(ra.Prefixes) != 1 || ra.Prefixes[0] != (RAPrefix{Prefix: "2001:db8:1:2::/64", OnLink: true, Autonomous: true, ValidLifetime: 86400, PreferredLifetime: 14400}) {
+		t.Fatalf("Unexpected prefixes %+v", ra.Prefixes)
+	}
+	if len(ra.DNS) != 1 || ra.DNS[0] != "2001:db8:1:2::53" || ra.DNSLifetime != 1800 {
+		t.Fatalf("Unexpected DNS %v (%d)", ra.DNS, ra.DNSLifetime)
+	}
+	if len(ra.DNSSearch) != 1 || ra.DNSSearch[0] != "home.arpa" {
+		t.Fatalf("Unexpected DNS search list %v", ra.DNSSearch)
+	}
+
+	truncated := testRouterAdvertisement()
+	if _, err := parseRouterAdvertisement(truncated[:len(truncated)-4]); err == nil {
+		t.Fatalf("Expected a truncated option to fail")
+	}
+}
+
+// TestRAMonitorRogueRouters verifies that routers are learned after
+// startup, that later ones are rogue, and that -ra-routers overrides the
+// learning.
+func TestRAMonitorRogueRouters(t *testing.T) {
+	ra, _ := parseRouterAdvertisement(testRouterAdvertisement())
+	bus := NewEventBus()
+	var anomalies []AnomalyEvent
+	bus.Subscribe("test", func(e BusEvent) { anomalies = append(anomalies, e.Payload.(AnomalyEvent)) }, TopicAnomaly)
+
+	monitor := NewRAMonitor(bus, nil)
+	now := time.Now()
+	monitor.observe("fe80::1", ra, now)
+	monitor.observe("fe80::1", ra, now.Add(time.Hour))
+	if len(anomalies) != 0 {
+		t.Fatalf("Expected the router seen at startup to be trusted, got %+v", anomalies)
+	}
+	monitor.observe("fe80::666", ra, now.Add(time.Hour))
+	if len(anomalies) != 1 || anomalies[0].Kind != "rogue-ra" || anomalies[0].Severity != "high" || anomalies[0].Device != "fe80::666" {
+		t.Fatalf("Expected a rogue-ra anomaly, got %+v", anomalies)
+	}
+
+	server := NewMDNSServer()
+	server.ra = monitor
+	rec := httptest.NewRecorder()
+	server.RouterAdvertisements(rec, httptest.NewRequest(http.MethodGet, "/api/ipv6/routers", nil))
+	var resp struct {
+		Routers []Router       `json:"routers"`
+		Alerts  []AnomalyEvent `json:"alerts"`
+	}
+	json.NewDecoder(rec.Body).Decode(&resp)
+	if len(resp.Routers) != 2 || !resp.Routers[0].Expected || resp.Routers[0].Count != 2 || resp.Routers[1].Expected || len(resp.Alerts) != 1 {
+		t.Fatalf("Unexpected routers %+v", resp)
+	}
+	if len(resp.Routers[0].Prefixes) != 1 || resp.Routers[0].Prefixes[0].Prefix != "2001:db8:1:2::/64" {
+		t.Fatalf("Expected the router's prefixes, got %+v", resp.Routers[0])
+	}
+
+	anomalies = nil
+	monitor = NewRAMonitor(bus, []string{"AA:BB:CC:00:00:01"})
+	monitor.observe("fe80::1", ra, now)
+	other := *ra
+	other.MAC = "aa:bb:cc:00:00:99"
+	monitor.observe("fe80::2", &other, now)
+	if len(anomalies) != 1 || anomalies[0].Device != "fe80::2" {
+		t.Fatalf("Expected only the unlisted router to be rogue, got %+v", anomalies)
+	}
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"strings"
+	"sync/atomic"
+)
+
+// scopeLocal in -scan-allow stands for the subnets of the local interfaces
+// and loopback, so the default follows the interfaces as they change.
+const scopeLocal = "local"
+
+// ScanScope bounds the addresses active features may send probes to: pings,
+// answer checks of expectations, SNMP polls, time server queries and the
+// identification of the gateway. Passive discovery isn't affected: devices
+// outside the scope are still listed, they just aren't probed. Excluded
+// addresses, e.g. the gateway or a NAS under load, are never probed, even
+// inside an allowed network.
+type ScanScope struct {
+	allow    []string // as configured, for /api/status
+	exclude  []string
+	local    bool
+	allowed  []*net.IPNet // none, without local, allows everything
+	excluded []*net.IPNet
+	refused  atomic.Uint64
+}
+
+// scanScope is the scope every probe is checked against. It allows
+// everything until main configures it from -scan-allow and -scan-exclude.
+var scanScope = &ScanScope{}
+
+// scopeError is a probe the scan scope refused.
+type scopeError struct {
+	ip     string
+	reason string
+}
+
+func (e *scopeError) Error() string {
+	return e.ip + " is " + e.reason
+}
+
+// ParseScanScope parses the comma-separated networks or addresses probes
+// may go to, "local" for the local subnets, and those they must never go
+// to. An empty allow list allows everything not excluded.
+func ParseScanScope(allow, exclude string) (*ScanScope, error) {
+	scope := &ScanScope{}
+	var networks []string
+	for _, entry := range strings.Split(allow, ",") {
+		if entry = strings.TrimSpace(entry); entry == scopeLocal {
+			scope.local = true
+		} else {
+			networks = append(networks, entry)
+		}
+	}
+	var err error
+	if scope.allowed, err = parseNetworks(networks); err != nil {
+		return nil, err
+	}
+	if scope.excluded, err = parseNetworks(strings.Split(exclude, ",")); err != nil {
+		return nil, err
+	}
+	scope.allow, scope.exclude = scopeEntries(allow), scopeEntries(exclude)
+	return scope, nil
+}
+
+func scopeEntries(spec string) []string {
+	entries := []string{}
+	for _, entry := range strings.Split(spec, ",") {
+		if entry = strings.TrimSpace(entry); entry != "" {
+			entries = append(entries, entry)
+		}
+	}
+	return entries
+}
+
+// check returns a *scopeError if ip may not be probed.
+func (s *ScanScope) check(ip string) error {
+	// Link-local IPv6 addresses may carry their interface
+	host, _, _ := strings.Cut(ip, "%")
+	parsed := net.ParseIP(host)
+	if parsed == nil {
+		s.refused.Add(1)
+		return &scopeError{ip: ip, reason: "not an address"}
+	}
+	if containsIP(s.excluded, parsed) {
+		s.refused.Add(1)
+		return &scopeError{ip: ip, reason: "excluded from scans"}
+	}
+	if !s.local && len(s.allowed) == 0 || containsIP(s.allowed, parsed) {
+		return nil
+	}
+	if s.local && (parsed.IsLoopback() || localNetworks.interfaceFor(host) != "") {
+		return nil
+	}
+	s.refused.Add(1)
+	return &scopeError{ip: ip, reason: "outside the scan scope"}
+}
+
+// outOfScope reports whether err is a probe the scan scope refused.
+func outOfScope(err error) bool {
+	var scopeErr *scopeError
+	return errors.As(err, &scopeErr)
+}
+
+func containsIP(networks []*net.IPNet, ip net.IP) bool {
+	for _, network := range networks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// Status is the scanScope section of /api/status.
+func (s *ScanScope) Status() map[string]interface{} {
+	allow := s.allow
+	if allow == nil {
+		allow = []string{}
+	}
+	exclude := s.exclude
+	if exclude == nil {
+		exclude = []string{}
+	}
+	return map[string]interface{}{
+		"allow":   allow,
+		"exclude": exclude,
+		"refused": s.refused.Load(),
+	}
+}
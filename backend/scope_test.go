@@ -0,0 +1,63 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// TestScanScope verifies probes are allowed inside the configured networks
+// only, and never to excluded addresses
+func TestScanScope(t *testing.T) {
+	scope, err := ParseScanScope("10.20.0.0/16, 192.168.1.5", "10.20.0.1")
+	if err != nil {
+		t.Fatalf("Failed to parse the scope: %v", err)
+	}
+	for ip, allowed := range map[string]bool{"10.20.3.4": true, "192.168.1.5": true, "10.20.0.1": false, "192.168.1.6": false, "8.8.8.8": false, "printer.local": false} {
+		if err := scope.check(ip); (err == nil) != allowed || err != nil && !outOfScope(err) {
+			t.Fatalf("Expected %s allowed=%v, got %v", ip, allowed, err)
+		}
+	}
+	if refused := scope.Status()["refused"]; refused != uint64(4) {
+		t.Fatalf("Expected 4 refused probes, got %v", refused)
+	}
+
+	if _, err := ParseScanScope("10.20.0.0/33", ""); err == nil {
+		t.Fatalf("Expected an invalid network to be rejected")
+	}
+}
+
+// TestScanScopeLocal verifies the local scope allows loopback and the
+// local subnets, and an empty one everything not excluded
+func TestScanScopeLocal(t *testing.T) {
+	local, _ := ParseScanScope(scopeLocal, "")
+	if err := local.check("127.0.0.1"); err != nil {
+		t.Fatalf("Expected loopback in the local scope, got %v", err)
+	}
+	if err := local.check("198.51.100.7"); err == nil {
+		t.Fatalf("Expected a documentation address outside the local scope")
+	}
+
+	open, _ := ParseScanScope("", "198.51.100.7")
+	if err := open.check("203.0.113.9"); err != nil {
+		t.Fatalf("Expected an empty scope to allow any address, got %v", err)
+	}
+	if err := open.check("198.51.100.7"); err == nil {
+		t.Fatalf("Expected the excluded address to be refused")
+	}
+}
+
+// TestScanScopePing verifies a ping outside the scope is refused before
+// the helper is asked
+func TestScanScopePing(t *testing.T) {
+	saved := scanScope
+	scanScope, _ = ParseScanScope("10.0.0.0/8", "")
+	t.Cleanup(func() { scanScope = saved })
+
+	helper := NewHelperClient(t.TempDir() + "/missing.sock")
+	if _, err := helper.Ping("192.168.1.1", time.Second); !outOfScope(err) {
+		t.Fatalf("Expected the ping to be refused by the scope, got %v", err)
+	}
+	if _, err := helper.Ping("10.1.2.3", time.Second); err == nil || outOfScope(err) {
+		t.Fatalf("Expected the ping to reach for the helper, got %v", err)
+	}
+}
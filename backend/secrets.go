@@ -0,0 +1,218 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/exec"
+	"regexp"
+	"runtime"
+	"strings"
+)
+
+// secretsService is the Keychain service secrets are kept under: one generic
+// password per secret, with the secret's name as the account.
+const secretsService = "network-view-osx"
+
+// knownSecrets are the secrets the server looks up at startup, with what
+// they are used for. Notifiers name their own webhook secrets.
+var knownSecrets = []struct{ name, usage string }{
+	{"snmp-community", "-snmp-community when the flag isn't given"},
+	{"aws-access-key-id", "$AWS_ACCESS_KEY_ID for -backup-s3"},
+	{"aws-secret-access-key", "$AWS_SECRET_ACCESS_KEY for -backup-s3"},
+	{"login-password", "password of the web UI login"},
+	{"api-token", "bearer token of API clients"},
+}
+
+var (
+	errSecretNotSet        = errors.New("secret not set")
+	errKeychainUnavailable = errors.New("the Keychain is only available on macOS")
+)
+
+var secretNamePattern = regexp.MustCompile(`^[a-z0-9][a-z0-9._-]*$`)
+
+// secretBackend keeps secrets by service and account. Get returns
+// errSecretNotSet for a secret that isn't there.
+type secretBackend interface {
+	Get(service, account string) (string, error)
+	Set(service, account, value string) error
+	Delete(service, account string) error
+}
+
+// keychain is where secrets are kept, replaced in tests.
+var keychain secretBackend = securityKeychain{}
+
+// securityKeychain keeps secrets in the user's login Keychain through the
+// security command line tool.
+type securityKeychain struct{}
+
+// securityNotFound is the exit status of security for a missing item.
+const securityNotFound = 44
+
+func (securityKeychain) run(stdin string, args ...string) ([]byte, error) {
+	if runtime.GOOS != "darwin" {
+		return nil, errKeychainUnavailable
+	}
+	cmd := exec.Command("security", args...)
+	cmd.Stdin = strings.NewReader(stdin)
+	out, err := cmd.Output()
+	var exit *exec.ExitError
+	if errors.As(err, &exit) {
+		if exit.ExitCode() == securityNotFound {
+			return nil, errSecretNotSet
+		}
+		if msg := strings.TrimSpace(string(exit.Stderr)); msg != "" {
+			return nil, fmt.Errorf("security: %s", msg)
+		}
+	}
+	return out, err
+}
+
+// Get reads a generic password; an empty account matches any.
+func (k securityKeychain) Get(service, account string) (string, error) {
+	args := []string{"find-generic-password", "-s", service}
+	if account != "" {
+		args = append(args, "-a", account)
+	}
+	out, err := k.run("", append(args, "-w")...)
+	return strings.TrimSpace(string(out)), err
+}
+
+// Set adds or updates a generic password. The command is given to security
+// on standard input rather than as arguments, so the value doesn't show up
+// in the process list.
+func (k securityKeychain) Set(service, account, value string) error {
+	if strings.ContainsAny(value, "\r\n") {
+		return errors.New("secrets can't contain line breaks")
+	}
+	command := fmt.Sprintf("add-generic-password -U -s %s -a %s -w %s\n", securityQuote(service), securityQuote(account), securityQuote(value))
+	_, err := k.run(command, "-i")
+	return err
+}
+
+func (k securityKeychain) Delete(service, account string) error {
+	_, err := k.run("", "delete-generic-password", "-s", service, "-a", account)
+	return err
+}
+
+// securityQuote quotes an argument for security's interactive mode.
+func securityQuote(s string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(s) + `"`
+}
+
+// secretEnv is the environment variable that overrides a secret, e.g.
+// NETWORK_VIEW_SECRET_SNMP_COMMUNITY, for machines without a Keychain.
+func secretEnv(name string) string {
+	return "NETWORK_VIEW_SECRET_" + strings.ToUpper(strings.NewReplacer("-", "_", ".", "_").Replace(name))
+}
+
+// lookupSecret returns a secret from its environment variable or else the
+// Keychain. A secret that is in neither is errSecretNotSet.
+func lookupSecret(name string) (string, error) {
+	if value := os.Getenv(secretEnv(name)); value != "" {
+		return value, nil
+	}
+	value, err := keychain.Get(secretsService, name)
+	if errors.Is(err, errKeychainUnavailable) || (err == nil && value == "") {
+		err = errSecretNotSet
+	}
+	if errors.Is(err, errSecretNotSet) {
+		return "", fmt.Errorf("secret %s is not set (use the secrets subcommand or $%s): %w", name, secretEnv(name), errSecretNotSet)
+	}
+	if err != nil {
+		return "", fmt.Errorf("secret %s: %v", name, err)
+	}
+	return value, nil
+}
+
+// optionalSecret returns a secret, or fallback when it isn't set. Other
+// errors, e.g. a locked Keychain, are logged.
+func optionalSecret(name, fallback string) string {
+	if fallback != "" {
+		return fallback
+	}
+	value, err := lookupSecret(name)
+	if err != nil && !errors.Is(err, errSecretNotSet) {
+		log.Printf("⚠️  %v", err)
+	}
+	return value
+}
+
+// runSecrets is the secrets subcommand, which keeps the secrets the server
+// reads at startup in the Keychain instead of in flags or scripts:
+//
+//	network-view-osx secrets set <name> [value]
+//	network-view-osx secrets delete <name>
+//	network-view-osx secrets list
+//
+// Without a value, set reads it from the first line of standard input.
+func runSecrets(args []string, stdin io.Reader, stdout, stderr io.Writer) int {
+	flags := flag.NewFlagSet("secrets", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	flags.Usage = func() {
+		fmt.Fprintln(stderr, "Usage: network-view-osx secrets set <name> [value] | delete <name> | list")
+	}
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	command, rest := flags.Arg(0), flags.Args()
+	if len(rest) > 0 {
+		rest = rest[1:]
+	}
+
+	switch {
+	case command == "list" && len(rest) == 0:
+		for _, secret := range knownSecrets {
+			state := "not set"
+			if os.Getenv(secretEnv(secret.name)) != "" {
+				state = "set in $" + secretEnv(secret.name)
+			} else if _, err := keychain.Get(secretsService, secret.name); err == nil {
+				state = "set"
+			} else if !errors.Is(err, errSecretNotSet) && !errors.Is(err, errKeychainUnavailable) {
+				state = err.Error()
+			}
+			fmt.Fprintf(stdout, "%-22s %-10s %s\n", secret.name, state, secret.usage)
+		}
+		return 0
+	case (command == "set" && (len(rest) == 1 || len(rest) == 2)) || (command == "delete" && len(rest) == 1):
+	default:
+		flags.Usage()
+		return 2
+	}
+
+	name := rest[0]
+	if !secretNamePattern.MatchString(name) {
+		fmt.Fprintf(stderr, "secrets: invalid name %q (lower case letters, digits, dots and dashes)\n", name)
+		return 2
+	}
+	var err error
+	if command == "delete" {
+		err = keychain.Delete(secretsService, name)
+	} else {
+		value := ""
+		if len(rest) == 2 {
+			value = rest[1]
+		} else {
+			data, _ := io.ReadAll(io.LimitReader(stdin, 64<<10))
+			value, _, _ = strings.Cut(string(data), "\n")
+			value = strings.TrimSuffix(value, "\r")
+		}
+		if value == "" {
+			fmt.Fprintln(stderr, "secrets: empty value")
+			return 2
+		}
+		err = keychain.Set(secretsService, name, value)
+	}
+	if errors.Is(err, errKeychainUnavailable) {
+		fmt.Fprintf(stderr, "secrets: %v; set $%s instead\n", err, secretEnv(name))
+		return 1
+	}
+	if err != nil {
+		fmt.Fprintf(stderr, "secrets: %s %s: %v\n", command, name, err)
+		return 1
+	}
+	return 0
+}
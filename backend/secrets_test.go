@@ -0,0 +1,111 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+)
+
+// memoryKeychain is a secretBackend in memory.
+type memoryKeychain map[string]string
+
+func (k memoryKeychain) Get(service, account string) (string, error) {
+	for key, value := range k {
+		if s, a, _ := strings.Cut(key, "/"); s == service && (account == "" || a == account) {
+			return value, nil
+		}
+	}
+	return "", errSecretNotSet
+}
+
+func (k memoryKeychain) Set(service, account, value string) error {
+	k[service+"/"+account] = value
+	return nil
+}
+
+func (k memoryKeychain) Delete(service, account string) error {
+	if _, ok := k[service+"/"+account]; !ok {
+		return errSecretNotSet
+	}
+	delete(k, service+"/"+account)
+	return nil
+}
+
+// useMemoryKeychain replaces the Keychain for the duration of a test.
+func useMemoryKeychain(t *testing.T) memoryKeychain {
+	saved := keychain
+	k := memoryKeychain{}
+	keychain = k
+	t.Cleanup(func() { keychain = saved })
+	return k
+}
+
+// TestSecretsCommand verifies the secrets subcommand sets, lists and
+// deletes Keychain secrets
+func TestSecretsCommand(t *testing.T) {
+	k := useMemoryKeychain(t)
+	var stdout, stderr bytes.Buffer
+	if code := runSecrets([]string{"set", "snmp-community", "s3cret"}, nil, &stdout, &stderr); code != 0 {
+		t.Fatalf("Expected the secret to be set, got %d: %s", code, stderr.String())
+	}
+	if code := runSecrets([]string{"set", "webhook-ops"}, strings.NewReader("from stdin\nignored\n"), &stdout, &stderr); code != 0 {
+		t.Fatalf("Expected the secret to be read from stdin, got %d: %s", code, stderr.String())
+	}
+	if k[secretsService+"/snmp-community"] != "s3cret" || k[secretsService+"/webhook-ops"] != "from stdin" {
+		t.Fatalf("Expected both secrets in the Keychain, got %v", k)
+	}
+
+	if code := runSecrets([]string{"list"}, nil, &stdout, &stderr); code != 0 {
+		t.Fatalf("Expected the secrets to be listed, got %d", code)
+	}
+	if !strings.Contains(stdout.String(), "snmp-community         set") || !strings.Contains(stdout.String(), "aws-access-key-id      not set") {
+		t.Fatalf("Expected which secrets are set, got:\n%s", stdout.String())
+	}
+
+	if code := runSecrets([]string{"delete", "snmp-community"}, nil, &stdout, &stderr); code != 0 {
+		t.Fatalf("Expected the secret to be deleted, got %d: %s", code, stderr.String())
+	}
+	if code := runSecrets([]string{"delete", "snmp-community"}, nil, &stdout, &stderr); code != 1 {
+		t.Fatalf("Expected deleting a missing secret to fail, got %d", code)
+	}
+	for _, args := range [][]string{{}, {"get", "x"}, {"set"}, {"set", "Bad Name", "x"}, {"set", "empty"}} {
+		if code := runSecrets(args, strings.NewReader(""), &stdout, &stderr); code != 2 {
+			t.Fatalf("Expected usage errors for %v, got %d", args, code)
+		}
+	}
+}
+
+// TestLookupSecret verifies secrets come from their environment variable
+// before the Keychain
+func TestLookupSecret(t *testing.T) {
+	k := useMemoryKeychain(t)
+	if _, err := lookupSecret("snmp-community"); !errors.Is(err, errSecretNotSet) {
+		t.Fatalf("Expected an unset secret, got %v", err)
+	}
+	if value := optionalSecret("snmp-community", "flag"); value != "flag" {
+		t.Fatalf("Expected an explicit value to win, got %q", value)
+	}
+
+	k.Set(secretsService, "snmp-community", "keychain")
+	if value, err := lookupSecret("snmp-community"); err != nil || value != "keychain" {
+		t.Fatalf("Expected the Keychain secret, got %q %v", value, err)
+	}
+	t.Setenv("NETWORK_VIEW_SECRET_SNMP_COMMUNITY", "env")
+	if value := optionalSecret("snmp-community", ""); value != "env" {
+		t.Fatalf("Expected the environment to override the Keychain, got %q", value)
+	}
+
+	k.Set(secretsService, "store-key", testEncryptionKey)
+	if key, err := loadEncryptionKey("secret:store-key"); err != nil || len(key) != 32 {
+		t.Fatalf("Expected the encryption key from a secret, got %v", err)
+	}
+}
+
+// TestSecurityQuote verifies values are quoted for security's interactive
+// mode
+func TestSecurityQuote(t *testing.T) {
+	if got := securityQuote(`pa "ss\word`); got != `"pa \"ss\\word"` {
+		t.Fatalf("Expected quotes and backslashes escaped, got %s", got)
+	}
+}
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"log"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// selfRefreshInterval is how often the local addresses are re-read.
+const selfRefreshInterval = 10 * time.Second
+
+// maxSentQueries is how many of our recent query IDs are remembered.
+const maxSentQueries = 256
+
+// SelfFilter recognizes traffic the server generated itself. Our queries
+// are tagged with their DNS message ID, so when they loop back to the
+// multicast listener, directly or through a reflector, they are dropped
+// instead of being processed as someone else's. Services on the server's own
+// addresses are marked Self, and excluded from discovery results unless
+// includeSelf is set. The addresses are tracked per interface by Watch, as
+// they come and go with DHCP leases, VPNs and interfaces.
+type SelfFilter struct {
+	includeSelf bool
+
+	mu     sync.Mutex
+	sent   map[uint16]time.Time
+	order  []uint16
+	addrs  map[string]string // address -> interface
+	loaded time.Time
+	// lookup returns the addresses of every interface by name
+	lookup  func() (map[string][]net.Addr, error)
+	packets atomic.Uint64 // our own packets dropped by the listener
+	skipped atomic.Uint64 // services on our own addresses not published
+}
+
+func NewSelfFilter(includeSelf bool) *SelfFilter {
+	return &SelfFilter{
+		includeSelf: includeSelf,
+		sent:        make(map[uint16]time.Time),
+		lookup:      interfaceAddrs,
+	}
+}
+
+// interfaceAddrs returns the addresses of the local interfaces by name.
+func interfaceAddrs() (map[string][]net.Addr, error) {
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return nil, err
+	}
+	addrs := make(map[string][]net.Addr, len(ifaces))
+	for _, iface := range ifaces {
+		if list, err := iface.Addrs(); err == nil && len(list) > 0 {
+			addrs[iface.Name] = list
+		}
+	}
+	return addrs, nil
+}
+
+// newQuery returns a query for name and records its ID as ours. The dns
+// client reads answers up to the size the query advertises.
+func (f *SelfFilter) newQuery(name string, qtype uint16) *dns.Msg {
+	m := new(dns.Msg)
+	m.SetQuestion(name, qtype)
+	m.RecursionDesired = false
+	m.SetEdns0(mdnsPayloadSize, false)
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if len(f.order) >= maxSentQueries {
+		delete(f.sent, f.order[0])
+		f.order = f.order[1:]
+	}
+	f.sent[m.Id] = time.Now()
+	f.order = append(f.order, m.Id)
+	return m
+}
+
+// ownPacket reports whether msg is one of our own queries. mDNS responses to
+// multicast queries carry ID 0, so only queries are matched.
+func (f *SelfFilter) ownPacket(msg *dns.Msg) bool {
+	if msg.Response || msg.Id == 0 {
+		return false
+	}
+
+	f.mu.Lock()
+	_, ok := f.sent[msg.Id]
+	f.mu.Unlock()
+	if ok {
+		f.packets.Add(1)
+	}
+	return ok
+}
+
+// refresh re-reads the local addresses and returns those that were added
+// and removed since the last time, as "address (interface)". It must be
+// called with f.mu held.
+func (f *SelfFilter) refresh() (added, removed []string) {
+	f.loaded = time.Now()
+	lookup, err := f.lookup()
+	if err != nil {
+		return nil, nil
+	}
+	addrs := make(map[string]string)
+	for iface, list := range lookup {
+		for _, addr := range list {
+			if ipnet, ok := addr.(*net.IPNet); ok {
+				addrs[ipnet.IP.String()] = iface
+			}
+		}
+	}
+	for addr, iface := range addrs {
+		if f.addrs[addr] != iface {
+			added = append(added, addr+" ("+iface+")")
+		}
+	}
+	for addr, iface := range f.addrs {
+		if addrs[addr] != iface {
+			removed = append(removed, addr+" ("+iface+")")
+		}
+	}
+	f.addrs = addrs
+	sort.Strings(added)
+	sort.Strings(removed)
+	return added, removed
+}
+
+// Watch re-reads the local addresses every selfRefreshInterval and calls
+// changed after they changed. It never returns.
+func (f *SelfFilter) Watch(changed func()) {
+	for {
+		f.mu.Lock()
+		first := f.loaded.IsZero()
+		added, removed := f.refresh()
+		f.mu.Unlock()
+
+		if !first && len(added)+len(removed) > 0 {
+			if len(added) > 0 {
+				log.Printf("Local addresses added: %s", strings.Join(added, ", "))
+			}
+			if len(removed) > 0 {
+				log.Printf("Local addresses removed: %s", strings.Join(removed, ", "))
+			}
+			changed()
+		}
+		time.Sleep(selfRefreshInterval)
+	}
+}
+
+// isLocal reports whether ip is one of the server's own addresses.
+func (f *SelfFilter) isLocal(ip string) bool {
+	if parsed := net.ParseIP(ip); parsed != nil && parsed.IsLoopback() {
+		return true
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	// Watch keeps them current; this is for the checks before it starts
+	if time.Since(f.loaded) > selfRefreshInterval {
+		f.refresh()
+	}
+	_, ok := f.addrs[ip]
+	return ok
+}
+
+// owns reports whether service runs on this host.
+func (f *SelfFilter) owns(service *MDNSService) bool {
+	return f.isLocal(service.IP) || service.IP6 != "" && f.isLocal(service.IP6)
+}
+
+// excluded marks service Self if it runs on this host, and reports whether
+// it must be left out of discovery results because of that.
+func (f *SelfFilter) excluded(service *MDNSService) bool {
+	service.Self = f.owns(service)
+	if f.includeSelf || !service.Self {
+		return false
+	}
+	f.skipped.Add(1)
+	return true
+}
+
+// Status is the self section of /api/status.
+func (f *SelfFilter) Status() map[string]interface{} {
+	f.mu.Lock()
+	addrs := make([]string, 0, len(f.addrs))
+	interfaces := make(map[string][]string)
+	for addr, iface := range f.addrs {
+		addrs = append(addrs, addr)
+		interfaces[iface] = append(interfaces[iface], addr)
+	}
+	f.mu.Unlock()
+	sort.Strings(addrs)
+	for _, list := range interfaces {
+		sort.Strings(list)
+	}
+
+	return map[string]interface{}{
+		"includeSelf":     f.includeSelf,
+		"addresses":       addrs,
+		"interfaces":      interfaces,
+		"packetsFiltered": f.packets.Load(),
+		"servicesSkipped": f.skipped.Load(),
+	}
+}
+
+// markSelf marks the local services that run on this host after its
+// addresses changed, and unmarks those that no longer do.
+func (s *MDNSServer) markSelf() {
+	var n int
+	s.table.do(func() { n = s.table.markSelf(s.site, s.self.owns) })
+	if n > 0 {
+		log.Printf("Local addresses changed: %s marked or unmarked as this host's", plural(n, "service"))
+	}
+}
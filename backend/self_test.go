@@ -0,0 +1,93 @@
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// TestSelfFilterQueries verifies our own queries are recognized when they
+// loop back, while responses and other hosts' queries are not
+func TestSelfFilterQueries(t *testing.T) {
+	f := NewSelfFilter(false)
+	ours := f.newQuery("_http._tcp.local.", dns.TypePTR)
+
+	if !f.ownPacket(ours) {
+		t.Fatalf("Expected our own query to be recognized")
+	}
+	if opt := ours.IsEdns0(); opt == nil || opt.UDPSize() != mdnsPayloadSize {
+		t.Fatalf("Expected our query to advertise %d bytes with EDNS0, got %v", mdnsPayloadSize, opt)
+	}
+
+	other := new(dns.Msg)
+	other.SetQuestion("_http._tcp.local.", dns.TypePTR)
+	other.Id = ours.Id + 1
+	if f.ownPacket(other) {
+		t.Fatalf("Expected another host's query not to be filtered")
+	}
+
+	response := new(dns.Msg)
+	response.SetReply(ours)
+	if f.ownPacket(response) {
+		t.Fatalf("Expected a response not to be filtered")
+	}
+	if n := f.packets.Load(); n != 1 {
+		t.Fatalf("Expected 1 filtered packet, got %d", n)
+	}
+}
+
+// TestSelfFilterServices verifies services on our own addresses are left out
+// of discovery results unless included
+func TestSelfFilterServices(t *testing.T) {
+	lookup := func() (map[string][]net.Addr, error) {
+		return map[string][]net.Addr{"en0": {&net.IPNet{IP: net.ParseIP("192.168.1.20"), Mask: net.CIDRMask(24, 32)}}}, nil
+	}
+
+	server := NewMDNSServer()
+	server.self.lookup = lookup
+	own := &MDNSService{Name: "This Mac", Type: "_ssh._tcp.local.", IP: "192.168.1.20", Port: 22}
+	if server.publishService(sourceQuery, server.identity(own), own, time.Now()) {
+		t.Fatalf("Expected a service on our own address not to be published")
+	}
+	other := &MDNSService{Name: "Printer", Type: "_ipp._tcp.local.", IP: "192.168.1.30", Port: 631}
+	if !server.publishService(sourceQuery, server.identity(other), other, time.Now()) {
+		t.Fatalf("Expected another host's service to be published")
+	}
+
+	server.self = NewSelfFilter(true)
+	server.self.lookup = lookup
+	if !server.publishService(sourceQuery, server.identity(own), own, time.Now()) || !own.Self {
+		t.Fatalf("Expected -include-self to publish our own services, marked as ours")
+	}
+}
+
+// TestSelfAddressChange verifies services are marked as this host's, and
+// unmarked, as its addresses come and go
+func TestSelfAddressChange(t *testing.T) {
+	addrs := map[string][]net.Addr{"en0": {&net.IPNet{IP: net.ParseIP("192.168.1.20"), Mask: net.CIDRMask(24, 32)}}}
+	server := NewMDNSServer()
+	server.self = NewSelfFilter(true)
+	server.self.lookup = func() (map[string][]net.Addr, error) { return addrs, nil }
+	vpn := &MDNSService{Name: "This Mac", Type: "_ssh._tcp.local.", IP: "10.8.0.2", Port: 22}
+	server.publishService(sourceQuery, server.identity(vpn), vpn, time.Now())
+	if services := server.listServices(defaultSite); len(services) != 1 || services[0].Self {
+		t.Fatalf("Expected the service not to be ours yet, got %+v", services)
+	}
+
+	addrs = map[string][]net.Addr{"utun3": {&net.IPNet{IP: net.ParseIP("10.8.0.2"), Mask: net.CIDRMask(32, 32)}}}
+	server.self.mu.Lock()
+	added, removed := server.self.refresh()
+	server.self.mu.Unlock()
+	if len(added) != 1 || added[0] != "10.8.0.2 (utun3)" || len(removed) != 1 || removed[0] != "192.168.1.20 (en0)" {
+		t.Fatalf("Expected the address to move to utun3, got +%v -%v", added, removed)
+	}
+	server.markSelf()
+	if services := server.listServices(defaultSite); !services[0].Self {
+		t.Fatalf("Expected the service on the new address to be ours, got %+v", services)
+	}
+	if interfaces := server.self.Status()["interfaces"].(map[string][]string); len(interfaces["utun3"]) != 1 {
+		t.Fatalf("Expected the addresses per interface, got %v", interfaces)
+	}
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"time"
+)
+
+// serviceTypeName normalizes a service type for comparison: "_http._tcp",
+// "_HTTP._tcp.local" and "_http._tcp.local." are the same type.
+func serviceTypeName(serviceType string) string {
+	return strings.TrimSuffix(strings.TrimSuffix(strings.ToLower(serviceType), "."), ".local")
+}
+
+// seenOnInterface reports whether a service was seen on the local interface
+// iface.
+func seenOnInterface(service *MDNSService, iface string) bool {
+	for _, seen := range service.Interfaces {
+		if seen.Name == iface {
+			return true
+		}
+	}
+	return false
+}
+
+// Services handles GET /api/services, the service table as it is now, so
+// a client can render it at once and then apply the stream from the seq it
+// reflects. ?type= and ?iface= select the services of a type and those seen
+// on a local interface, and ?filter= takes a filter expression like
+// /api/devices. Each service carries its freshness.
+func (s *MDNSServer) Services(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	filter, err := filterParam(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	query := r.URL.Query()
+	serviceType, iface := serviceTypeName(query.Get("type")), query.Get("iface")
+
+	site := s.siteParam(r)
+	// As of the seq of the latest event, like /api/devices
+	s.order.Lock()
+	seq := s.bus.Latest()
+	all := s.listServices(site)
+	s.order.Unlock()
+
+	now := time.Now()
+	var services []scoredService
+	for i := range all {
+		service := &all[i]
+		switch {
+		case serviceType != "" && serviceTypeName(service.Type) != serviceType:
+		case iface != "" && !seenOnInterface(service, iface):
+		case filter != nil && !filter.Match(s.serviceFields(service)):
+		default:
+			services = append(services, scoredService{*service, s.freshness(service, now)})
+		}
+	}
+	writeJSONList(w, r, "services", len(services), func(i int) interface{} { return services[i] }, map[string]interface{}{"seq": seq})
+}
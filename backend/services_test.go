@@ -0,0 +1,43 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// TestServicesSnapshot verifies /api/services lists the current services
+// with the seq they reflect, selected by type and interface
+func TestServicesSnapshot(t *testing.T) {
+	server := NewMDNSServer()
+	for name, seen := range map[string]struct{ serviceType, iface string }{
+		"printer": {"_ipp._tcp.local.", "en0"},
+		"nas":     {"_smb._tcp.local.", "en0"},
+		"tv":      {"_airplay._tcp.local.", "en1"},
+	} {
+		service := &MDNSService{Name: name, Type: seen.serviceType, IP: "10.0.0.5", Interfaces: []ServiceInterface{{Name: seen.iface}}}
+		server.changeService(server.identity(service), service, false)
+	}
+
+	for query, want := range map[string]int{"": 3, "?type=_ipp._tcp": 1, "?type=_IPP._tcp.local.": 1, "?iface=en0": 2, "?iface=en0&type=_airplay._tcp": 0, "?iface=wlan9": 0} {
+		rec := httptest.NewRecorder()
+		server.Services(rec, httptest.NewRequest(http.MethodGet, "/api/services"+query, nil))
+		var body struct {
+			Services []MDNSService `json:"services"`
+			Seq      uint64        `json:"seq"`
+		}
+		if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil {
+			t.Fatalf("Failed to decode %q: %v", query, err)
+		}
+		if len(body.Services) != want || body.Seq != 3 {
+			t.Fatalf("Expected %d services at seq 3 for %q, got %d at %d", want, query, len(body.Services), body.Seq)
+		}
+	}
+
+	rec := httptest.NewRecorder()
+	server.Services(rec, httptest.NewRequest(http.MethodPost, "/api/services", nil))
+	if rec.Code != http.StatusMethodNotAllowed {
+		t.Fatalf("Expected 405 for POST, got %d", rec.Code)
+	}
+}
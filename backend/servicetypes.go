@@ -0,0 +1,269 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"maps"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+)
+
+const serviceTypesBucket = "service-types"
+
+// defaultServiceTypes are browsed and queried without -service-types.
+var defaultServiceTypes = []string{
+	"_http._tcp",
+	"_https._tcp",
+	"_ssh._tcp",
+	"_sftp._tcp",
+	"_smb._tcp",
+	"_afpovertcp._tcp",
+	"_nfs._tcp",
+	"_ldap._tcp",
+	"_sip._tcp",
+	"_xmpp._tcp",
+	"_workstation._tcp",
+	"_device-info._tcp",
+	"_ntp._udp",
+}
+
+// parseServiceType normalizes a service type such as "_HTTP._tcp.local."
+// to the form it is browsed in, "_http._tcp", checking it like an
+// advertised one.
+func parseServiceType(spec string) (string, error) {
+	serviceType := serviceTypeName(strings.TrimSpace(spec))
+	if !serviceTypePattern.MatchString(serviceType) {
+		return "", fmt.Errorf("invalid service type %q (use e.g. _http._tcp)", spec)
+	}
+	return serviceType, nil
+}
+
+// parseServiceTypes parses -service-types: comma-separated service types,
+// or the path of a file listing one per line, with # comments. It returns
+// the default types for an empty spec.
+func parseServiceTypes(spec string) ([]string, error) {
+	if spec = strings.TrimSpace(spec); spec == "" {
+		return slices.Clone(defaultServiceTypes), nil
+	}
+	entries := strings.Split(spec, ",")
+	if !strings.HasPrefix(spec, "_") {
+		data, err := os.ReadFile(spec)
+		if err != nil {
+			return nil, err
+		}
+		entries = nil
+		for _, line := range strings.Split(string(data), "\n") {
+			line, _, _ = strings.Cut(line, "#")
+			entries = append(entries, line)
+		}
+	}
+
+	var types []string
+	for _, entry := range entries {
+		if strings.TrimSpace(entry) == "" {
+			continue
+		}
+		serviceType, err := parseServiceType(entry)
+		if err != nil {
+			return nil, err
+		}
+		if !slices.Contains(types, serviceType) {
+			types = append(types, serviceType)
+		}
+	}
+	if len(types) == 0 {
+		return nil, fmt.Errorf("no service types in %q", spec)
+	}
+	return types, nil
+}
+
+// ServiceTypes are the service types browsed and queried: the configured
+// ones, with the types added and removed at runtime. Runtime changes
+// persist across restarts as changes to the configured list, so types
+// configured later are still picked up. Types discovered on the network
+// are browsed too, but not persisted, as they are discovered again.
+type ServiceTypes struct {
+	store Store
+	mu    sync.RWMutex
+	types []string
+	// removed are the types removed at runtime, never browsed when
+	// discovered
+	removed map[string]bool
+}
+
+// serviceTypeState is a persisted entry of the service types bucket: a
+// type added (true) or removed (false) at runtime.
+type serviceTypeState struct {
+	Enabled bool `json:"enabled"`
+}
+
+// newServiceTypes returns the configured types, persisting changes to
+// store unless it is nil.
+func newServiceTypes(configured []string, store Store) *ServiceTypes {
+	return &ServiceTypes{store: store, types: slices.Clone(configured), removed: make(map[string]bool)}
+}
+
+// NewServiceTypes applies the runtime changes persisted in store to the
+// configured types.
+func NewServiceTypes(configured []string, store Store) (*ServiceTypes, error) {
+	t := newServiceTypes(configured, store)
+
+	entries, err := store.Load(serviceTypesBucket)
+	if err != nil {
+		return nil, err
+	}
+	// Types added at runtime follow the configured ones, sorted
+	names := slices.Sorted(maps.Keys(entries))
+	for _, serviceType := range names {
+		var state serviceTypeState
+		if err := json.Unmarshal(entries[serviceType], &state); err != nil {
+			return nil, fmt.Errorf("service type %s: %v", serviceType, err)
+		}
+		t.apply(serviceType, state.Enabled)
+	}
+	return t, nil
+}
+
+// apply adds or removes a type. It must be called with t.mu held, or
+// before t is shared.
+func (t *ServiceTypes) apply(serviceType string, enabled bool) bool {
+	if enabled {
+		delete(t.removed, serviceType)
+	} else {
+		t.removed[serviceType] = true
+	}
+	i := slices.Index(t.types, serviceType)
+	switch {
+	case enabled && i < 0:
+		t.types = append(t.types, serviceType)
+	case !enabled && i >= 0:
+		t.types = slices.Delete(t.types, i, i+1)
+	default:
+		return false
+	}
+	return true
+}
+
+// List returns the types in the order they are browsed.
+func (t *ServiceTypes) List() []string {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return slices.Clone(t.types)
+}
+
+// Has reports whether serviceType, in browse form, is browsed.
+func (t *ServiceTypes) Has(serviceType string) bool {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return slices.Contains(t.types, serviceType)
+}
+
+// Discover adds a type discovered on the network, and reports whether it
+// wasn't browsed before. Types removed at runtime stay removed.
+func (t *ServiceTypes) Discover(serviceType string) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.removed[serviceType] || slices.Contains(t.types, serviceType) {
+		return false
+	}
+	t.types = append(t.types, serviceType)
+	return true
+}
+
+// serviceTypeChanges parses the types to add and remove into the change of
+// each type: true to add it, false to remove it.
+func serviceTypeChanges(add, remove []string) (map[string]bool, error) {
+	changes := make(map[string]bool)
+	for _, list := range []struct {
+		types   []string
+		enabled bool
+	}{{add, true}, {remove, false}} {
+		for _, spec := range list.types {
+			serviceType, err := parseServiceType(spec)
+			if err != nil {
+				return nil, err
+			}
+			if enabled, ok := changes[serviceType]; ok && enabled != list.enabled {
+				return nil, fmt.Errorf("%s is both added and removed", serviceType)
+			}
+			changes[serviceType] = list.enabled
+		}
+	}
+	return changes, nil
+}
+
+// Change applies and persists changes, and returns the types that weren't
+// browsed before.
+func (t *ServiceTypes) Change(changes map[string]bool) ([]string, error) {
+	entries := make(map[string][]byte, len(changes))
+	for serviceType, enabled := range changes {
+		entries[serviceType], _ = json.Marshal(serviceTypeState{Enabled: enabled})
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.store != nil && len(entries) > 0 {
+		if err := t.store.Put(serviceTypesBucket, entries); err != nil {
+			return nil, err
+		}
+	}
+	var added []string
+	for _, serviceType := range slices.Sorted(maps.Keys(changes)) {
+		if t.apply(serviceType, changes[serviceType]) && changes[serviceType] {
+			added = append(added, serviceType)
+		}
+	}
+	return added, nil
+}
+
+// browseAdded starts browsing a type that wasn't browsed before, and
+// queries and browses it right away rather than on the next round.
+func (s *MDNSServer) browseAdded(serviceType string) {
+	s.workers.Go("browse "+serviceType, func() { browseServiceType(s, serviceType) })
+	go discoverService(s, serviceType+".local.")
+	go lookupServiceType(s, serviceType)
+}
+
+// ServiceTypeList handles GET and POST /api/service-types. POST takes the
+// types to "add" and "remove"; added types are browsed and queried right
+// away.
+func (s *MDNSServer) ServiceTypeList(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		writeJSON(w, http.StatusOK, map[string]interface{}{
+			"serviceTypes": s.serviceTypes.List(),
+		})
+
+	case http.MethodPost:
+		var req struct {
+			Add    []string `json:"add"`
+			Remove []string `json:"remove"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		changes, err := serviceTypeChanges(req.Add, req.Remove)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		added, err := s.serviceTypes.Change(changes)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		for _, serviceType := range added {
+			s.browseAdded(serviceType)
+		}
+		writeJSON(w, http.StatusOK, map[string]interface{}{
+			"serviceTypes": s.serviceTypes.List(),
+		})
+
+	default:
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+	}
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// TestParseServiceTypes verifies -service-types takes a list or a file,
+// normalizes the types, and defaults to the built-in list
+func TestParseServiceTypes(t *testing.T) {
+	types, err := parseServiceTypes("_HTTP._tcp.local., _prometheus-http._tcp,_http._tcp")
+	if err != nil || !slices.Equal(types, []string{"_http._tcp", "_prometheus-http._tcp"}) {
+		t.Fatalf("Expected the normalized types without duplicates, got %v, %v", types, err)
+	}
+
+	file := filepath.Join(t.TempDir(), "types")
+	os.WriteFile(file, []byte("# monitoring\n_prometheus-http._tcp\n\n_ipp._tcp # printers\n"), 0o600)
+	if types, err := parseServiceTypes(file); err != nil || !slices.Equal(types, []string{"_prometheus-http._tcp", "_ipp._tcp"}) {
+		t.Fatalf("Expected the types of the file, got %v, %v", types, err)
+	}
+
+	if types, _ := parseServiceTypes(""); !slices.Equal(types, defaultServiceTypes) {
+		t.Fatalf("Expected the default types, got %v", types)
+	}
+	for _, spec := range []string{"_http._smtp", "_http._tcp,http"} {
+		if _, err := parseServiceTypes(spec); err == nil {
+			t.Fatalf("Expected %q to be rejected", spec)
+		}
+	}
+}
+
+// TestServiceTypesChange verifies types added and removed at runtime stay
+// so after a restart, on top of the configured ones
+func TestServiceTypesChange(t *testing.T) {
+	dir := t.TempDir()
+	types, err := NewServiceTypes([]string{"_http._tcp", "_ssh._tcp"}, openTestStore(t, "json", dir))
+	if err != nil {
+		t.Fatalf("Failed to load service types: %v", err)
+	}
+	changes, err := serviceTypeChanges([]string{"_prometheus-http._tcp", "_http._tcp"}, []string{"_ssh._tcp"})
+	if err != nil {
+		t.Fatalf("Expected the changes to parse, got %v", err)
+	}
+	if added, err := types.Change(changes); err != nil || !slices.Equal(added, []string{"_prometheus-http._tcp"}) {
+		t.Fatalf("Expected only the new type to be added, got %v, %v", added, err)
+	}
+
+	reloaded, err := NewServiceTypes([]string{"_http._tcp", "_ssh._tcp", "_ipp._tcp"}, openTestStore(t, "json", dir))
+	if err != nil {
+		t.Fatalf("Failed to reload service types: %v", err)
+	}
+	if list := reloaded.List(); !slices.Equal(list, []string{"_http._tcp", "_ipp._tcp", "_prometheus-http._tcp"}) {
+		t.Fatalf("Expected the runtime changes applied to the new configuration, got %v", list)
+	}
+
+	if _, err := serviceTypeChanges([]string{"_ipp._tcp"}, []string{"_ipp._tcp.local."}); err == nil {
+		t.Fatalf("Expected a type both added and removed to be rejected")
+	}
+}
+
+// TestServiceTypeList verifies GET lists the browsed types and a POST with
+// an invalid type changes nothing
+func TestServiceTypeList(t *testing.T) {
+	server := NewMDNSServer()
+	rec := httptest.NewRecorder()
+	server.ServiceTypeList(rec, httptest.NewRequest(http.MethodPost, "/api/service-types", strings.NewReader(`{"add": ["prometheus"]}`)))
+	if rec.Code != http.StatusBadRequest {
+		t.Fatalf("Expected 400 for an invalid type, got %d", rec.Code)
+	}
+
+	rec = httptest.NewRecorder()
+	server.ServiceTypeList(rec, httptest.NewRequest(http.MethodGet, "/api/service-types", nil))
+	if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), `"_ntp._udp"`) || strings.Contains(rec.Body.String(), "prometheus") {
+		t.Fatalf("Expected the default types, got %d %s", rec.Code, rec.Body)
+	}
+}
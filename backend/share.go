@@ -0,0 +1,393 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// sharesBucket is the Store bucket share links are kept in.
+const sharesBucket = "shares"
+
+var (
+	// defaultShareTTL and maxShareTTL bound how long a share link works
+	defaultShareTTL = 24 * time.Hour
+	maxShareTTL     = 30 * 24 * time.Hour
+	// shareRate and shareBurst limit the requests per share link: one per
+	// second, with bursts of 20 for a page load
+	shareRate  = 1.0
+	shareBurst = 20.0
+)
+
+// Share is a guest link granting read-only access to a redacted device list
+// and event stream. Only a hash of its token is stored; the token itself is
+// shown once, when the link is created.
+type Share struct {
+	ID        string        `json:"id"` // the first 12 hex digits of the token's hash
+	Label     string        `json:"label,omitempty"`
+	Site      string        `json:"site"`
+	CreatedAt int64         `json:"createdAt"`
+	ExpiresAt int64         `json:"expiresAt"`
+	revoked   chan struct{} // closed when the link is revoked
+}
+
+// shareRecord is a share as persisted.
+type shareRecord struct {
+	Share
+	Hash string `json:"hash"`
+}
+
+// shareLimiter is a token bucket.
+type shareLimiter struct {
+	tokens float64
+	last   time.Time
+}
+
+// allow takes a token if one is available.
+func (l *shareLimiter) allow(now time.Time) bool {
+	if !l.last.IsZero() {
+		l.tokens = min(shareBurst, l.tokens+now.Sub(l.last).Seconds()*shareRate)
+	}
+	l.last = now
+	if l.tokens < 1 {
+		return false
+	}
+	l.tokens--
+	return true
+}
+
+var errShareExpired = errors.New("share link expired or revoked")
+var errShareRateLimited = errors.New("too many requests for this share link")
+
+// ShareStore keeps the share links and their rate limiters.
+type ShareStore struct {
+	mu       sync.Mutex
+	store    Store
+	shares   map[string]*Share // by token hash
+	limiters map[string]*shareLimiter
+}
+
+// NewShareStore loads the share links from store, dropping expired ones.
+func NewShareStore(store Store) (*ShareStore, error) {
+	s := &ShareStore{store: store, shares: make(map[string]*Share), limiters: make(map[string]*shareLimiter)}
+	entries, err := store.Load(sharesBucket)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now().Unix()
+	var expired []string
+	for hash, data := range entries {
+		var record shareRecord
+		if err := json.Unmarshal(data, &record); err != nil {
+			return nil, fmt.Errorf("share %s: %v", hash, err)
+		}
+		if record.ExpiresAt <= now {
+			expired = append(expired, hash)
+			continue
+		}
+		share := record.Share
+		share.revoked = make(chan struct{})
+		s.shares[hash] = &share
+	}
+	if len(expired) > 0 {
+		if err := store.Delete(sharesBucket, expired...); err != nil {
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+func hashShareToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// Create makes a share link of site valid for ttl and returns it with its
+// token.
+func (s *ShareStore) Create(label, site string, ttl time.Duration) (Share, string, error) {
+	raw := make([]byte, 24)
+	if _, err := rand.Read(raw); err != nil {
+		return Share{}, "", err
+	}
+	token := hex.EncodeToString(raw)
+	hash := hashShareToken(token)
+	now := time.Now()
+	share := Share{ID: hash[:12], Label: label, Site: site, CreatedAt: now.Unix(), ExpiresAt: now.Add(ttl).Unix(), revoked: make(chan struct{})}
+
+	data, err := json.Marshal(shareRecord{Share: share, Hash: hash})
+	if err != nil {
+		return Share{}, "", err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.store.Put(sharesBucket, map[string][]byte{hash: data}); err != nil {
+		return Share{}, "", err
+	}
+	s.shares[hash] = &share
+	return share, token, nil
+}
+
+// Authorize returns the share a token grants, counting the request against
+// its rate limit.
+func (s *ShareStore) Authorize(token string, now time.Time) (Share, error) {
+	hash := hashShareToken(token)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	share, ok := s.shares[hash]
+	if !ok || share.ExpiresAt <= now.Unix() {
+		return Share{}, errShareExpired
+	}
+	limiter := s.limiters[hash]
+	if limiter == nil {
+		limiter = &shareLimiter{tokens: shareBurst}
+		s.limiters[hash] = limiter
+	}
+	if !limiter.allow(now) {
+		return *share, errShareRateLimited
+	}
+	return *share, nil
+}
+
+// List returns the share links that haven't expired, newest first.
+func (s *ShareStore) List(now time.Time) []Share {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	shares := make([]Share, 0, len(s.shares))
+	for _, share := range s.shares {
+		if share.ExpiresAt > now.Unix() {
+			shares = append(shares, *share)
+		}
+	}
+	sort.Slice(shares, func(i, j int) bool { return shares[i].CreatedAt > shares[j].CreatedAt })
+	return shares
+}
+
+// Revoke deletes the share link with id and reports whether there was one.
+func (s *ShareStore) Revoke(id string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for hash, share := range s.shares {
+		if share.ID != id {
+			continue
+		}
+		if err := s.store.Delete(sharesBucket, hash); err != nil {
+			return false, err
+		}
+		delete(s.shares, hash)
+		delete(s.limiters, hash)
+		close(share.revoked)
+		return true, nil
+	}
+	return false, nil
+}
+
+// SharedService is what guests see of a service: no port, TXT or
+// interface details.
+type SharedService struct {
+	Name string `json:"name"`
+	Type string `json:"type"`
+	Host string `json:"host,omitempty"`
+	IP   string `json:"ip"`
+}
+
+// SharedDevice is what guests see of a device: no MAC, switch port, ports,
+// notes, tags, SNMP details or traffic.
+type SharedDevice struct {
+	ID        string          `json:"id"`
+	Category  string          `json:"category"`
+	Vendor    string          `json:"vendor,omitempty"`
+	Location  string          `json:"location,omitempty"`
+	Addresses []string        `json:"addresses"`
+	Services  []SharedService `json:"services"`
+	LastSeen  int64           `json:"lastSeen,omitempty"`
+}
+
+// sharedEvent is a /discover event for guests.
+type sharedEvent struct {
+	Service SharedService `json:"service"`
+	Removed bool          `json:"removed"`
+}
+
+func redactService(service *MDNSService) SharedService {
+	return SharedService{Name: service.Name, Type: service.Type, Host: service.Host, IP: service.IP}
+}
+
+func redactDevice(device *DeviceSummary) SharedDevice {
+	shared := SharedDevice{
+		ID:        device.ID,
+		Category:  device.Category,
+		Vendor:    device.Vendor,
+		Location:  device.Location,
+		Addresses: device.Addresses,
+		Services:  make([]SharedService, len(device.Services)),
+		LastSeen:  device.LastSeen,
+	}
+	for i := range device.Services {
+		shared.Services[i] = redactService(&device.Services[i])
+	}
+	return shared
+}
+
+// Shares handles /api/share: GET lists the share links and POST creates one
+// from {"label", "expiresIn", "site"}, answering with its token and the
+// dashboard URL that uses it. The token is not shown again.
+func (s *MDNSServer) Shares(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		writeJSON(w, http.StatusOK, map[string]interface{}{"shares": s.shares.List(time.Now())})
+
+	case http.MethodPost:
+		var req struct {
+			Label     string `json:"label"`
+			ExpiresIn string `json:"expiresIn"`
+			Site      string `json:"site"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		ttl := defaultShareTTL
+		if req.ExpiresIn != "" {
+			d, err := time.ParseDuration(req.ExpiresIn)
+			if err != nil || d <= 0 || d > maxShareTTL {
+				writeError(w, http.StatusBadRequest, "expiresIn must be a duration of at most "+maxShareTTL.String())
+				return
+			}
+			ttl = d
+		}
+		site := req.Site
+		if site == "" {
+			site = s.site
+		}
+
+		share, token, err := s.shares.Create(req.Label, site, ttl)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		writeJSON(w, http.StatusCreated, map[string]interface{}{
+			"share": share,
+			"token": token,
+			"url":   s.dashboardURL(r) + "?share=" + token,
+		})
+
+	default:
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+	}
+}
+
+// ShareItem handles DELETE /api/share/{id}, revoking a share link.
+func (s *MDNSServer) ShareItem(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodDelete {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	revoked, err := s.shares.Revoke(r.PathValue("id"))
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if !revoked {
+		writeError(w, http.StatusNotFound, "share not found")
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]string{"status": "ok"})
+}
+
+// authorizeShare checks the {token} of a guest request, answering 404 for
+// unknown and expired links and 429 when the link is over its rate limit.
+func (s *MDNSServer) authorizeShare(w http.ResponseWriter, r *http.Request) (Share, bool) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return Share{}, false
+	}
+	share, err := s.shares.Authorize(r.PathValue("token"), time.Now())
+	switch {
+	case errors.Is(err, errShareRateLimited):
+		w.Header().Set("Retry-After", "1")
+		writeError(w, http.StatusTooManyRequests, err.Error())
+		return share, false
+	case err != nil:
+		writeError(w, http.StatusNotFound, err.Error())
+		return share, false
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	return share, true
+}
+
+// SharedDevices handles GET /api/shared/{token}/devices, the redacted
+// device list of a share link's site.
+func (s *MDNSServer) SharedDevices(w http.ResponseWriter, r *http.Request) {
+	share, ok := s.authorizeShare(w, r)
+	if !ok {
+		return
+	}
+	devices := s.summarizeDevices(s.listDevices(share.Site, ""), share.Site)
+	shared := make([]SharedDevice, len(devices))
+	for i, device := range devices {
+		shared[i] = redactDevice(device)
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"devices":   shared,
+		"expiresAt": share.ExpiresAt,
+	})
+}
+
+// SharedDiscover handles GET /api/shared/{token}/discover, the redacted
+// event stream of a share link's site. It ends when the link expires or is
+// revoked.
+func (s *MDNSServer) SharedDiscover(w http.ResponseWriter, r *http.Request) {
+	share, ok := s.authorizeShare(w, r)
+	if !ok {
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeError(w, http.StatusInternalServerError, "streaming unsupported")
+		return
+	}
+
+	client := newStreamClient(r, s.clientBuffer)
+	client.transport = "share"
+	client.site = share.Site
+	client.filters = map[string]string{"share": share.ID}
+	// Share links only stream changes, without an inventory
+	s.registerClient(client)
+	defer s.unregisterClient(client)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	expiry := time.NewTimer(time.Until(time.Unix(share.ExpiresAt, 0)))
+	defer expiry.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-client.disconnect:
+			return
+		case <-share.revoked:
+			fmt.Fprintf(w, "event: disconnect\ndata: {\"reason\":%q}\n\n", errShareExpired.Error())
+			flusher.Flush()
+			return
+		case <-expiry.C:
+			fmt.Fprintf(w, "event: disconnect\ndata: {\"reason\":%q}\n\n", errShareExpired.Error())
+			flusher.Flush()
+			return
+		case ev := <-client.ch:
+			data, _ := json.Marshal(sharedEvent{Service: redactService(&ev.response.Service), Removed: ev.response.Removed})
+			fmt.Fprintf(w, "data: %s\n\n", data)
+			flusher.Flush()
+			client.delivered.Add(1)
+		}
+	}
+}
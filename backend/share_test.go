@@ -0,0 +1,115 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestShareStore verifies tokens authorize until revoked, survive reloading
+// the store, and are rate limited
+func TestShareStore(t *testing.T) {
+	dir := t.TempDir()
+	shares, err := NewShareStore(openTestStore(t, "json", dir))
+	if err != nil {
+		t.Fatalf("Failed to create store: %v", err)
+	}
+	share, token, err := shares.Create("contractor", defaultSite, time.Hour)
+	if err != nil {
+		t.Fatalf("Failed to create share: %v", err)
+	}
+
+	reloaded, err := NewShareStore(openTestStore(t, "json", dir))
+	if err != nil {
+		t.Fatalf("Failed to reload store: %v", err)
+	}
+	now := time.Now()
+	if got, err := reloaded.Authorize(token, now); err != nil || got.ID != share.ID || got.Label != "contractor" {
+		t.Fatalf("Expected the token to authorize after reload, got %+v %v", got, err)
+	}
+	if _, err := reloaded.Authorize(token+"0", now); err != errShareExpired {
+		t.Fatalf("Expected an unknown token to be rejected, got %v", err)
+	}
+	if _, err := reloaded.Authorize(token, now.Add(2*time.Hour)); err != errShareExpired {
+		t.Fatalf("Expected an expired token to be rejected, got %v", err)
+	}
+
+	for i := 1; i < int(shareBurst); i++ {
+		if _, err := reloaded.Authorize(token, now); err != nil {
+			t.Fatalf("Expected request %d of the burst to pass, got %v", i+1, err)
+		}
+	}
+	if _, err := reloaded.Authorize(token, now); err != errShareRateLimited {
+		t.Fatalf("Expected the request after the burst to be limited, got %v", err)
+	}
+	if _, err := reloaded.Authorize(token, now.Add(time.Second)); err != nil {
+		t.Fatalf("Expected a token back after a second, got %v", err)
+	}
+
+	if revoked, err := reloaded.Revoke(share.ID); !revoked || err != nil {
+		t.Fatalf("Expected the share to be revoked, got %v %v", revoked, err)
+	}
+	if _, err := reloaded.Authorize(token, now); err != errShareExpired {
+		t.Fatalf("Expected a revoked token to be rejected, got %v", err)
+	}
+	if len(reloaded.List(now)) != 0 {
+		t.Fatalf("Expected no shares after revoking")
+	}
+}
+
+// TestSharedDevices verifies guests get devices without MACs or ports
+func TestSharedDevices(t *testing.T) {
+	server := NewMDNSServer()
+	server.metadata, _ = NewMetadataStore(openTestStore(t, "json", t.TempDir()))
+	server.shares, _ = NewShareStore(openTestStore(t, "json", t.TempDir()))
+	server.metadata.Update(defaultSite, "nas.local", func(d *DeviceMetadata) {
+		d.Location = "office"
+		d.Notes = map[string]string{"admin password": "hunter2"}
+	})
+	server.addService("a", &MDNSService{Name: "NAS", Type: "_smb._tcp.local.", Host: "nas.local", IP: "192.168.1.10", Port: 445})
+
+	rec := httptest.NewRecorder()
+	server.Shares(rec, httptest.NewRequest(http.MethodPost, "/api/share", strings.NewReader(`{"label": "contractor", "expiresIn": "2h"}`)))
+	var created struct {
+		Share Share  `json:"share"`
+		Token string `json:"token"`
+		URL   string `json:"url"`
+	}
+	if err := json.NewDecoder(rec.Body).Decode(&created); err != nil || rec.Code != http.StatusCreated {
+		t.Fatalf("Expected the share to be created, got %d %v", rec.Code, err)
+	}
+	if !strings.HasSuffix(created.URL, "?share="+created.Token) || created.Share.ExpiresAt-created.Share.CreatedAt != 7200 {
+		t.Fatalf("Expected a 2h share with its URL, got %+v", created)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/api/shared/x/devices", nil)
+	req.SetPathValue("token", created.Token)
+	rec = httptest.NewRecorder()
+	server.SharedDevices(rec, req)
+	body := rec.Body.String()
+	if rec.Code != http.StatusOK || !strings.Contains(body, `"location":"office"`) || !strings.Contains(body, "_smb._tcp") {
+		t.Fatalf("Expected the shared device list, got %d %s", rec.Code, body)
+	}
+	for _, hidden := range []string{"port", "445", "mac", "hunter2", "notes"} {
+		if strings.Contains(body, hidden) {
+			t.Fatalf("Expected %q to be redacted, got %s", hidden, body)
+		}
+	}
+
+	req = httptest.NewRequest(http.MethodGet, "/api/shared/x/devices", nil)
+	req.SetPathValue("token", "nope")
+	rec = httptest.NewRecorder()
+	server.SharedDevices(rec, req)
+	if rec.Code != http.StatusNotFound {
+		t.Fatalf("Expected 404 for an unknown token, got %d", rec.Code)
+	}
+
+	rec = httptest.NewRecorder()
+	server.Shares(rec, httptest.NewRequest(http.MethodPost, "/api/share", strings.NewReader(`{"expiresIn": "800h"}`)))
+	if rec.Code != http.StatusBadRequest {
+		t.Fatalf("Expected 400 beyond the maximum lifetime, got %d", rec.Code)
+	}
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"net"
+	"sort"
+	"sync"
+	"time"
+)
+
+// networksRefreshInterval bounds how often the interface addresses are
+// re-read.
+const networksRefreshInterval = 30 * time.Second
+
+// ServiceInterface is a local interface a service was seen on.
+type ServiceInterface struct {
+	Name     string `json:"name"`
+	LastSeen int64  `json:"lastSeen"`
+}
+
+// seenOn returns a copy of interfaces with name marked as seen at lastSeen,
+// sorted by name. It never modifies interfaces, which copies of a service
+// may share.
+func seenOn(interfaces []ServiceInterface, name string, lastSeen int64) []ServiceInterface {
+	result := make([]ServiceInterface, 0, len(interfaces)+1)
+	found := false
+	for _, iface := range interfaces {
+		if iface.Name == name {
+			iface.LastSeen = lastSeen
+			found = true
+		}
+		result = append(result, iface)
+	}
+	if !found {
+		result = append(result, ServiceInterface{Name: name, LastSeen: lastSeen})
+		sort.Slice(result, func(i, j int) bool { return result[i].Name < result[j].Name })
+	}
+	return result
+}
+
+type interfaceNetwork struct {
+	name   string
+	subnet *net.IPNet
+}
+
+// interfaceNetworks caches the subnets and names of the local interfaces,
+// to tell which interface a sighting came in on.
+type interfaceNetworks struct {
+	mu       sync.Mutex
+	networks []interfaceNetwork
+	names    map[int]string
+	loaded   time.Time
+}
+
+var localNetworks = &interfaceNetworks{}
+
+// refresh must be called with n.mu held.
+func (n *interfaceNetworks) refresh() {
+	if time.Since(n.loaded) < networksRefreshInterval {
+		return
+	}
+	n.loaded = time.Now()
+
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return
+	}
+	n.networks = n.networks[:0]
+	n.names = make(map[int]string, len(ifaces))
+	for _, iface := range ifaces {
+		n.names[iface.Index] = iface.Name
+		if iface.Flags&net.FlagUp == 0 || iface.Flags&net.FlagLoopback != 0 {
+			continue
+		}
+		addrs, err := iface.Addrs()
+		if err != nil {
+			continue
+		}
+		for _, addr := range addrs {
+			if subnet, ok := addr.(*net.IPNet); ok {
+				n.networks = append(n.networks, interfaceNetwork{name: iface.Name, subnet: subnet})
+			}
+		}
+	}
+}
+
+// interfaceFor returns the interface whose subnet holds ip, or "".
+func (n *interfaceNetworks) interfaceFor(ip string) string {
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return ""
+	}
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.refresh()
+	for _, network := range n.networks {
+		if network.subnet.Contains(parsed) {
+			return network.name
+		}
+	}
+	return ""
+}
+
+// interfaceName returns the name of the interface with the given index.
+func (n *interfaceNetworks) interfaceName(index int) string {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.refresh()
+	return n.names[index]
+}
@@ -0,0 +1,44 @@
+package main
+
+import "testing"
+
+// TestSeenOn verifies per-interface last-seen times are updated without
+// modifying the slice a copy of the service may share
+func TestSeenOn(t *testing.T) {
+	interfaces := seenOn(nil, "en0", 100)
+	merged := seenOn(interfaces, "en5", 105)
+	merged = seenOn(merged, "en0", 110)
+
+	if len(merged) != 2 || merged[0] != (ServiceInterface{"en0", 110}) || merged[1] != (ServiceInterface{"en5", 105}) {
+		t.Fatalf("Expected en0 at 110 and en5 at 105, got %+v", merged)
+	}
+	if interfaces[0].LastSeen != 100 {
+		t.Fatalf("Expected the original slice to be left alone, got %+v", interfaces)
+	}
+}
+
+// TestMergeInterfaces verifies a service seen on two interfaces is one
+// record listing both
+func TestMergeInterfaces(t *testing.T) {
+	server := NewMDNSServer()
+	key := "printer._ipp._tcp.local."
+
+	wifi := &MDNSService{Name: "Printer", Type: "_ipp._tcp.local.", IP: "192.168.1.30", Port: 631,
+		Interfaces: []ServiceInterface{{Name: "en0"}}}
+	if !server.addService(key, wifi) {
+		t.Fatalf("Expected the first sighting to be new")
+	}
+	wired := &MDNSService{Name: "Printer", Type: "_ipp._tcp.local.", IP: "192.168.1.30", Port: 631,
+		Interfaces: []ServiceInterface{{Name: "en5"}}}
+	if server.addService(key, wired) {
+		t.Fatalf("Expected the sighting on another interface not to be a new service")
+	}
+
+	services := server.listServices(defaultSite)
+	if len(services) != 1 {
+		t.Fatalf("Expected 1 service, got %d", len(services))
+	}
+	if ifaces := services[0].Interfaces; len(ifaces) != 2 || ifaces[0].Name != "en0" || ifaces[1].Name != "en5" || ifaces[1].LastSeen == 0 {
+		t.Fatalf("Expected the service on en0 and en5 with last-seen times, got %+v", ifaces)
+	}
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"sort"
+	"time"
+)
+
+// defaultSite names the network this instance discovers on when -site is
+// not given.
+const defaultSite = "local"
+
+// siteKey scopes a per-site identifier such as a device ID or a service
+// dedup key so identical hostnames on different networks never collide.
+func siteKey(site, id string) string {
+	return site + "/" + id
+}
+
+// siteParam returns the site an API request is scoped to: the ?site= query
+// parameter, or this instance's own site when it is absent. ?site=* returns
+// the empty string, which matches every site.
+func (s *MDNSServer) siteParam(r *http.Request) string {
+	return s.scopeSite(r.URL.Query().Get("site"))
+}
+
+// scopeSite applies the siteParam rules to a site name from any API.
+func (s *MDNSServer) scopeSite(site string) string {
+	switch site {
+	case "":
+		return s.site
+	case "*":
+		return ""
+	default:
+		return site
+	}
+}
+
+// deviceSite is siteParam for endpoints addressing a single device. A device
+// always belongs to exactly one site, so ?site=* falls back to the local site.
+func (s *MDNSServer) deviceSite(r *http.Request) string {
+	if site := s.siteParam(r); site != "" {
+		return site
+	}
+	return s.site
+}
+
+// inSite reports whether a service belongs to the site returned by siteParam.
+func inSite(service *MDNSService, site string) bool {
+	return site == "" || service.Site == site
+}
+
+// SiteSummary describes one site on /api/sites.
+type SiteSummary struct {
+	Name     string `json:"name"`
+	Local    bool   `json:"local"`
+	Services int    `json:"services"`
+	LastSeen int64  `json:"lastSeen,omitempty"`
+}
+
+// Sites handles GET /api/sites, listing this instance's own site and every
+// site an agent has reported services for.
+func (s *MDNSServer) Sites(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	sites := map[string]*SiteSummary{
+		s.site: {Name: s.site, Local: true},
+	}
+	for _, service := range s.table.view() {
+		summary, ok := sites[service.Site]
+		if !ok {
+			summary = &SiteSummary{Name: service.Site}
+			sites[service.Site] = summary
+		}
+		summary.Services++
+		if service.Timestamp > summary.LastSeen {
+			summary.LastSeen = service.Timestamp
+		}
+	}
+
+	result := make([]*SiteSummary, 0, len(sites))
+	for _, summary := range sites {
+		result = append(result, summary)
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Name < result[j].Name })
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"sites": result,
+	})
+}
+
+// SiteServices handles POST /api/sites/{site}/services, through which an
+// agent running on another network reports discovery events. The body is a
+// DiscoveryResponse exactly as sent on /discover; the service is tagged with
+// the site from the path and fanned out to local stream clients.
+func (s *MDNSServer) SiteServices(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	site := r.PathValue("site")
+	if site == s.site {
+		writeError(w, http.StatusBadRequest, "cannot report services for the local site")
+		return
+	}
+
+	var event DiscoveryResponse
+	if err := json.NewDecoder(r.Body).Decode(&event); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	service := event.Service
+	if service.IP == "" || service.Type == "" {
+		writeError(w, http.StatusBadRequest, "service ip and type are required")
+		return
+	}
+	service.Site = site
+	service.Name, service.Type, service.Host = sanitizeName(service.Name), sanitizeName(service.Type), sanitizeName(service.Host)
+	if service.Timestamp == 0 {
+		service.Timestamp = time.Now().Unix()
+	}
+
+	key := s.identity(&service)
+	if s.changeService(key, &service, event.Removed) && !event.Removed {
+		log.Printf("Agent for site %s reported service: %s (%s) at %s:%d", site, service.Name, service.Type, service.IP, service.Port)
+	}
+
+	writeJSON(w, http.StatusOK, map[string]string{"status": "ok"})
+}
@@ -0,0 +1,447 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// A minimal SNMPv2c client: GET and GETNEXT requests, and walks built on
+// GETNEXT, which every agent supports. Only the BER subset SNMP uses is
+// implemented.
+
+// BER and SNMP tags.
+const (
+	berInteger     = 0x02
+	berOctetString = 0x04
+	berNull        = 0x05
+	berOID         = 0x06
+	berSequence    = 0x30
+
+	snmpIPAddress   = 0x40
+	snmpCounter32   = 0x41
+	snmpGauge32     = 0x42
+	snmpTimeTicks   = 0x43
+	snmpCounter64   = 0x46
+	snmpNoSuchObj   = 0x80
+	snmpNoSuchInst  = 0x81
+	snmpEndOfMib    = 0x82
+	snmpGetRequest  = 0xa0
+	snmpGetNext     = 0xa1
+	snmpGetResponse = 0xa2
+)
+
+const snmpVersion2c = 1
+
+// maxWalkRows bounds a walk, so a misbehaving agent can't keep it going.
+const maxWalkRows = 10000
+
+// snmpVarbind is a variable binding. Value is an int64 (INTEGER), uint64
+// (counters, gauges, time ticks), []byte (OCTET STRING), string (OID or IP
+// address) or nil (NULL and the exceptions, see Exception).
+type snmpVarbind struct {
+	OID       string
+	Type      byte
+	Value     interface{}
+	Exception bool // noSuchObject, noSuchInstance or endOfMibView
+}
+
+// berLength encodes a BER length.
+func berLength(n int) []byte {
+	if n < 0x80 {
+		return []byte{byte(n)}
+	}
+	var b []byte
+	for ; n > 0; n >>= 8 {
+		b = append([]byte{byte(n)}, b...)
+	}
+	return append([]byte{0x80 | byte(len(b))}, b...)
+}
+
+func berTLV(tag byte, content ...[]byte) []byte {
+	var body []byte
+	for _, c := range content {
+		body = append(body, c...)
+	}
+	return append(append([]byte{tag}, berLength(len(body))...), body...)
+}
+
+func berInt(tag byte, v int64) []byte {
+	var b []byte
+	for {
+		b = append([]byte{byte(v)}, b...)
+		v >>= 8
+		if (v == 0 && b[0]&0x80 == 0) || (v == -1 && b[0]&0x80 != 0) {
+			break
+		}
+	}
+	return berTLV(tag, b)
+}
+
+func berUint(tag byte, v uint64) []byte {
+	var b []byte
+	for {
+		b = append([]byte{byte(v)}, b...)
+		v >>= 8
+		if v == 0 {
+			break
+		}
+	}
+	if b[0]&0x80 != 0 {
+		b = append([]byte{0}, b...)
+	}
+	return berTLV(tag, b)
+}
+
+// encodeOID encodes a dotted OID such as "1.3.6.1.2.1.1.5.0".
+func encodeOID(oid string) ([]byte, error) {
+	parts := strings.Split(strings.TrimPrefix(oid, "."), ".")
+	if len(parts) < 2 {
+		return nil, fmt.Errorf("invalid OID %q", oid)
+	}
+	ids := make([]uint64, len(parts))
+	for i, p := range parts {
+		id, err := strconv.ParseUint(p, 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("invalid OID %q", oid)
+		}
+		ids[i] = id
+	}
+
+	b := []byte{byte(ids[0]*40 + ids[1])}
+	for _, id := range ids[2:] {
+		var sub []byte
+		sub = append(sub, byte(id&0x7f))
+		for id >>= 7; id > 0; id >>= 7 {
+			sub = append([]byte{byte(id&0x7f) | 0x80}, sub...)
+		}
+		b = append(b, sub...)
+	}
+	return berTLV(berOID, b), nil
+}
+
+func decodeOID(b []byte) (string, error) {
+	if len(b) == 0 {
+		return "", errors.New("empty OID")
+	}
+	parts := []string{strconv.Itoa(int(b[0]) / 40), strconv.Itoa(int(b[0]) % 40)}
+	var id uint64
+	for i, c := range b[1:] {
+		id = id<<7 | uint64(c&0x7f)
+		if c&0x80 == 0 {
+			parts = append(parts, strconv.FormatUint(id, 10))
+			id = 0
+		} else if i == len(b)-2 {
+			return "", errors.New("truncated OID")
+		}
+	}
+	return strings.Join(parts, "."), nil
+}
+
+// berElement is one decoded TLV.
+type berElement struct {
+	tag     byte
+	content []byte
+}
+
+// decodeBER reads the TLV at the start of b and returns it and the rest.
+func decodeBER(b []byte) (berElement, []byte, error) {
+	if len(b) < 2 {
+		return berElement{}, nil, errors.New("truncated BER element")
+	}
+	tag, n := b[0], int(b[1])
+	b = b[2:]
+	if n&0x80 != 0 {
+		size := n & 0x7f
+		if size == 0 || size > 4 || len(b) < size {
+			return berElement{}, nil, errors.New("invalid BER length")
+		}
+		n = 0
+		for _, c := range b[:size] {
+			n = n<<8 | int(c)
+		}
+		b = b[size:]
+	}
+	if n > len(b) {
+		return berElement{}, nil, errors.New("truncated BER element")
+	}
+	return berElement{tag: tag, content: b[:n]}, b[n:], nil
+}
+
+// decodeBERSequence decodes every element of a constructed value.
+func decodeBERSequence(b []byte) ([]berElement, error) {
+	var elements []berElement
+	for len(b) > 0 {
+		el, rest, err := decodeBER(b)
+		if err != nil {
+			return nil, err
+		}
+		elements = append(elements, el)
+		b = rest
+	}
+	return elements, nil
+}
+
+func berToInt(b []byte) int64 {
+	var v int64
+	for i, c := range b {
+		if i == 0 && c&0x80 != 0 {
+			v = -1
+		}
+		v = v<<8 | int64(c)
+	}
+	return v
+}
+
+func berToUint(b []byte) uint64 {
+	var v uint64
+	for _, c := range b {
+		v = v<<8 | uint64(c)
+	}
+	return v
+}
+
+// encodeVarbind encodes a binding; Value must be one of the types listed on
+// snmpVarbind, or nil for NULL.
+func encodeVarbind(vb snmpVarbind) ([]byte, error) {
+	oid, err := encodeOID(vb.OID)
+	if err != nil {
+		return nil, err
+	}
+	var value []byte
+	switch v := vb.Value.(type) {
+	case nil:
+		tag := vb.Type
+		if tag == 0 {
+			tag = berNull
+		}
+		value = berTLV(tag)
+	case int64:
+		value = berInt(berInteger, v)
+	case uint64:
+		value = berUint(vb.Type, v)
+	case []byte:
+		value = berTLV(berOctetString, v)
+	case string:
+		if vb.Type == snmpIPAddress {
+			ip := net.ParseIP(v).To4()
+			if ip == nil {
+				return nil, fmt.Errorf("invalid IP address %q", v)
+			}
+			value = berTLV(snmpIPAddress, ip)
+		} else if value, err = encodeOID(v); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("unsupported value %T", v)
+	}
+	return berTLV(berSequence, oid, value), nil
+}
+
+func decodeVarbind(el berElement) (snmpVarbind, error) {
+	parts, err := decodeBERSequence(el.content)
+	if err != nil || len(parts) != 2 || parts[0].tag != berOID {
+		return snmpVarbind{}, errors.New("invalid variable binding")
+	}
+	oid, err := decodeOID(parts[0].content)
+	if err != nil {
+		return snmpVarbind{}, err
+	}
+
+	vb := snmpVarbind{OID: oid, Type: parts[1].tag}
+	content := parts[1].content
+	switch parts[1].tag {
+	case berInteger:
+		vb.Value = berToInt(content)
+	case berOctetString:
+		vb.Value = content
+	case berOID:
+		if vb.Value, err = decodeOID(content); err != nil {
+			return vb, err
+		}
+	case snmpIPAddress:
+		vb.Value = net.IP(content).String()
+	case snmpCounter32, snmpGauge32, snmpTimeTicks, snmpCounter64:
+		vb.Value = berToUint(content)
+	case snmpNoSuchObj, snmpNoSuchInst, snmpEndOfMib:
+		vb.Exception = true
+	}
+	return vb, nil
+}
+
+// snmpPDU is a decoded SNMP message.
+type snmpPDU struct {
+	Community  string
+	Type       byte
+	RequestID  int64
+	ErrorIndex int64
+	Error      int64
+	Varbinds   []snmpVarbind
+}
+
+func encodeSNMP(pdu snmpPDU) ([]byte, error) {
+	var bindings []byte
+	for _, vb := range pdu.Varbinds {
+		b, err := encodeVarbind(vb)
+		if err != nil {
+			return nil, err
+		}
+		bindings = append(bindings, b...)
+	}
+	return berTLV(berSequence,
+		berInt(berInteger, snmpVersion2c),
+		berTLV(berOctetString, []byte(pdu.Community)),
+		berTLV(pdu.Type,
+			berInt(berInteger, pdu.RequestID),
+			berInt(berInteger, pdu.Error),
+			berInt(berInteger, pdu.ErrorIndex),
+			berTLV(berSequence, bindings),
+		),
+	), nil
+}
+
+func decodeSNMP(b []byte) (snmpPDU, error) {
+	var pdu snmpPDU
+	msg, _, err := decodeBER(b)
+	if err != nil || msg.tag != berSequence {
+		return pdu, errors.New("invalid SNMP message")
+	}
+	parts, err := decodeBERSequence(msg.content)
+	if err != nil || len(parts) != 3 || parts[0].tag != berInteger || parts[1].tag != berOctetString {
+		return pdu, errors.New("invalid SNMP message")
+	}
+	if v := berToInt(parts[0].content); v != snmpVersion2c {
+		return pdu, fmt.Errorf("unsupported SNMP version %d", v)
+	}
+	pdu.Community = string(parts[1].content)
+	pdu.Type = parts[2].tag
+
+	fields, err := decodeBERSequence(parts[2].content)
+	if err != nil || len(fields) != 4 || fields[3].tag != berSequence {
+		return pdu, errors.New("invalid SNMP PDU")
+	}
+	pdu.RequestID = berToInt(fields[0].content)
+	pdu.Error = berToInt(fields[1].content)
+	pdu.ErrorIndex = berToInt(fields[2].content)
+
+	bindings, err := decodeBERSequence(fields[3].content)
+	if err != nil {
+		return pdu, err
+	}
+	for _, el := range bindings {
+		vb, err := decodeVarbind(el)
+		if err != nil {
+			return pdu, err
+		}
+		pdu.Varbinds = append(pdu.Varbinds, vb)
+	}
+	return pdu, nil
+}
+
+// snmpClient queries one agent.
+type snmpClient struct {
+	addr      string // host:port
+	community string
+	timeout   time.Duration
+	retries   int
+}
+
+func (c *snmpClient) request(pduType byte, oids ...string) ([]snmpVarbind, error) {
+	req := snmpPDU{Community: c.community, Type: pduType, RequestID: int64(rand.Int32())}
+	for _, oid := range oids {
+		req.Varbinds = append(req.Varbinds, snmpVarbind{OID: oid})
+	}
+	packet, err := encodeSNMP(req)
+	if err != nil {
+		return nil, err
+	}
+
+	conn, err := net.Dial("udp", c.addr)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	buffer := make([]byte, 65535)
+	for attempt := 0; attempt <= c.retries; attempt++ {
+		if _, err = conn.Write(packet); err != nil {
+			return nil, err
+		}
+		conn.SetReadDeadline(time.Now().Add(c.timeout))
+		for {
+			var n int
+			n, err = conn.Read(buffer)
+			if err != nil {
+				break
+			}
+			resp, err := decodeSNMP(buffer[:n])
+			if err != nil || resp.Type != snmpGetResponse || resp.RequestID != req.RequestID {
+				continue
+			}
+			if resp.Error != 0 {
+				return nil, fmt.Errorf("SNMP error %d at index %d", resp.Error, resp.ErrorIndex)
+			}
+			return resp.Varbinds, nil
+		}
+	}
+	return nil, err
+}
+
+// get fetches the values of oids.
+func (c *snmpClient) get(oids ...string) ([]snmpVarbind, error) {
+	return c.request(snmpGetRequest, oids...)
+}
+
+// walk calls fn for every binding below root, in order.
+func (c *snmpClient) walk(root string, fn func(vb snmpVarbind)) error {
+	prefix := root + "."
+	oid := root
+	for i := 0; i < maxWalkRows; i++ {
+		vbs, err := c.request(snmpGetNext, oid)
+		if err != nil {
+			return err
+		}
+		if len(vbs) != 1 {
+			return errors.New("invalid GETNEXT response")
+		}
+		vb := vbs[0]
+		if vb.Exception || !strings.HasPrefix(vb.OID, prefix) {
+			return nil
+		}
+		fn(vb)
+		oid = vb.OID
+	}
+	return nil
+}
+
+// snmpString returns an OCTET STRING value as a string.
+func snmpString(v interface{}) string {
+	if b, ok := v.([]byte); ok {
+		return strings.TrimRight(string(b), "\x00")
+	}
+	return ""
+}
+
+// snmpNumber returns an INTEGER or counter value as an int64.
+func snmpNumber(v interface{}) int64 {
+	switch v := v.(type) {
+	case int64:
+		return v
+	case uint64:
+		return int64(v)
+	}
+	return 0
+}
+
+// oidIndex returns the index part of oid below table ("" if it isn't).
+func oidIndex(oid, table string) string {
+	index, _ := strings.CutPrefix(oid, table+".")
+	if index == oid {
+		return ""
+	}
+	return index
+}
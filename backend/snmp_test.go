@@ -0,0 +1,121 @@
+package main
+
+import (
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// compareOIDs orders OIDs by their numeric sub-identifiers.
+func compareOIDs(a, b string) int {
+	as, bs := strings.Split(a, "."), strings.Split(b, ".")
+	for i := 0; i < len(as) && i < len(bs); i++ {
+		x, _ := strconv.Atoi(as[i])
+		y, _ := strconv.Atoi(bs[i])
+		if x != y {
+			return x - y
+		}
+	}
+	return len(as) - len(bs)
+}
+
+// startTestAgent serves SNMP GET and GETNEXT for objects on a local port.
+func startTestAgent(t *testing.T, community string, objects []snmpVarbind) int {
+	conn, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	sort.Slice(objects, func(i, j int) bool { return compareOIDs(objects[i].OID, objects[j].OID) < 0 })
+
+	go func() {
+		buffer := make([]byte, 65535)
+		for {
+			n, addr, err := conn.ReadFrom(buffer)
+			if err != nil {
+				return
+			}
+			req, err := decodeSNMP(buffer[:n])
+			if err != nil || req.Community != community {
+				continue
+			}
+			resp := snmpPDU{Community: community, Type: snmpGetResponse, RequestID: req.RequestID}
+			for _, vb := range req.Varbinds {
+				answer := snmpVarbind{OID: vb.OID, Type: snmpNoSuchObj}
+				for _, obj := range objects {
+					if (req.Type == snmpGetRequest && obj.OID == vb.OID) || (req.Type == snmpGetNext && compareOIDs(obj.OID, vb.OID) > 0) {
+						answer = obj
+						break
+					}
+				}
+				if req.Type == snmpGetNext && answer.Type == snmpNoSuchObj {
+					answer.Type = snmpEndOfMib
+				}
+				resp.Varbinds = append(resp.Varbinds, answer)
+			}
+			packet, err := encodeSNMP(resp)
+			if err != nil {
+				t.Errorf("Failed to encode response: %v", err)
+				return
+			}
+			conn.WriteTo(packet, addr)
+		}
+	}()
+	return conn.LocalAddr().(*net.UDPAddr).Port
+}
+
+// TestSNMPCodec verifies messages survive encoding and decoding
+func TestSNMPCodec(t *testing.T) {
+	pdu := snmpPDU{Community: "public", Type: snmpGetResponse, RequestID: -12345, Varbinds: []snmpVarbind{
+		{OID: "1.3.6.1.2.1.1.5.0", Value: []byte("switch-1")},
+		{OID: "1.3.6.1.2.1.1.3.0", Type: snmpTimeTicks, Value: uint64(4294967295)},
+		{OID: "1.3.6.1.2.1.2.2.1.8.1", Value: int64(-200)},
+		{OID: "1.3.6.1.2.1.1.2.0", Value: "1.3.6.1.4.1.9.1.516"},
+		{OID: "1.3.6.1.2.1.4.20.1.1.10.0.0.1", Type: snmpIPAddress, Value: "10.0.0.1"},
+		{OID: "1.3.6.1.2.1.1.9.0", Type: snmpEndOfMib},
+	}}
+
+	packet, err := encodeSNMP(pdu)
+	if err != nil {
+		t.Fatalf("Failed to encode: %v", err)
+	}
+	decoded, err := decodeSNMP(packet)
+	if err != nil {
+		t.Fatalf("Failed to decode: %v", err)
+	}
+	if decoded.Community != "public" || decoded.RequestID != -12345 || len(decoded.Varbinds) != 6 {
+		t.Fatalf("Unexpected message %+v", decoded)
+	}
+	vbs := decoded.Varbinds
+	if snmpString(vbs[0].Value) != "switch-1" || vbs[1].Value != uint64(4294967295) || vbs[2].Value != int64(-200) ||
+		vbs[3].Value != "1.3.6.1.4.1.9.1.516" || vbs[4].Value != "10.0.0.1" || !vbs[5].Exception {
+		t.Fatalf("Unexpected values %+v", vbs)
+	}
+}
+
+// TestSNMPWalk verifies a walk returns exactly the rows under its root
+func TestSNMPWalk(t *testing.T) {
+	port := startTestAgent(t, "public", []snmpVarbind{
+		{OID: oidIfDescr + ".1", Value: []byte("lo")},
+		{OID: oidIfDescr + ".10", Value: []byte("eth1")},
+		{OID: oidIfDescr + ".2", Value: []byte("eth0")},
+		{OID: oidIfOperStatus + ".1", Value: int64(1)},
+	})
+	c := &snmpClient{addr: net.JoinHostPort("127.0.0.1", strconv.Itoa(port)), community: "public", timeout: time.Second}
+
+	var names []string
+	if err := c.walk(oidIfDescr, func(vb snmpVarbind) { names = append(names, snmpString(vb.Value)) }); err != nil {
+		t.Fatalf("Walk failed: %v", err)
+	}
+	if strings.Join(names, ",") != "lo,eth0,eth1" {
+		t.Fatalf("Expected lo,eth0,eth1 in OID order, got %v", names)
+	}
+
+	wrong := &snmpClient{addr: c.addr, community: "private", timeout: 100 * time.Millisecond}
+	if _, err := wrong.get(oidSysName); err == nil {
+		t.Fatalf("Expected a timeout with the wrong community")
+	}
+}
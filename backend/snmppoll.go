@@ -0,0 +1,316 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MIB-II, IF-MIB and BRIDGE-MIB objects read from SNMP agents.
+const (
+	oidSysDescr  = "1.3.6.1.2.1.1.1.0"
+	oidSysUpTime = "1.3.6.1.2.1.1.3.0"
+	oidSysName   = "1.3.6.1.2.1.1.5.0"
+
+	oidIfDescr      = "1.3.6.1.2.1.2.2.1.2"
+	oidIfOperStatus = "1.3.6.1.2.1.2.2.1.8"
+	oidIfInOctets   = "1.3.6.1.2.1.2.2.1.10"
+	oidIfOutOctets  = "1.3.6.1.2.1.2.2.1.16"
+
+	oidBasePortIfIndex = "1.3.6.1.2.1.17.1.4.1.2"     // dot1dBasePortIfIndex
+	oidTpFdbPort       = "1.3.6.1.2.1.17.4.3.1.2"     // dot1dTpFdbPort.<mac>
+	oidQTpFdbPort      = "1.3.6.1.2.1.17.7.1.2.2.1.2" // dot1qTpFdbPort.<vlan>.<mac>
+)
+
+// maxMACTable bounds the forwarding table kept per switch.
+const maxMACTable = 4096
+
+// snmpConcurrency is how many agents are polled at once.
+const snmpConcurrency = 8
+
+var ifOperStatuses = map[int64]string{1: "up", 2: "down", 3: "testing", 5: "dormant", 6: "notPresent", 7: "lowerLayerDown"}
+
+// SNMPInterface is an interface of an SNMP agent with its counters.
+type SNMPInterface struct {
+	Index     int    `json:"index"`
+	Name      string `json:"name"`
+	Status    string `json:"status"`
+	InOctets  uint64 `json:"inOctets"`
+	OutOctets uint64 `json:"outOctets"`
+}
+
+// SNMPMACEntry is an entry of a switch's forwarding table: a MAC address
+// learned on a bridge port.
+type SNMPMACEntry struct {
+	MAC       string `json:"mac"`
+	VLAN      int    `json:"vlan,omitempty"`
+	Port      int    `json:"port"`
+	IfIndex   int    `json:"ifIndex,omitempty"`
+	Interface string `json:"interface,omitempty"`
+}
+
+// SNMPInfo is what a device's SNMP agent reported.
+type SNMPInfo struct {
+	IP         string          `json:"ip"`
+	SysName    string          `json:"sysName"`
+	SysDescr   string          `json:"sysDescr"`
+	Uptime     int64           `json:"uptimeSeconds"`
+	Interfaces []SNMPInterface `json:"interfaces"`
+	// MACTable is the forwarding table of switches (BRIDGE-MIB)
+	MACTable []SNMPMACEntry `json:"macTable,omitempty"`
+	PolledAt int64          `json:"polledAt"`
+}
+
+// SNMPPoller periodically polls the discovered devices' SNMP agents. Only
+// devices that answer are kept.
+type SNMPPoller struct {
+	community string
+	port      int
+	timeout   time.Duration
+
+	mu      sync.RWMutex
+	devices map[string]*SNMPInfo // keyed by siteKey(site, device ID)
+	polled  time.Time
+}
+
+func NewSNMPPoller(community string) *SNMPPoller {
+	return &SNMPPoller{
+		community: community,
+		port:      161,
+		timeout:   time.Second,
+		devices:   make(map[string]*SNMPInfo),
+	}
+}
+
+// Get returns the SNMP info of a device, or nil.
+func (p *SNMPPoller) Get(site, id string) *SNMPInfo {
+	if p == nil {
+		return nil
+	}
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.devices[siteKey(site, id)]
+}
+
+// List returns the SNMP info of every device of site (every site when
+// empty), keyed by device ID.
+func (p *SNMPPoller) List(site string) map[string]*SNMPInfo {
+	result := make(map[string]*SNMPInfo)
+	if p == nil {
+		return result
+	}
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	for key, info := range p.devices {
+		if keySite, id, _ := strings.Cut(key, "/"); site == "" || keySite == site {
+			result[id] = info
+		}
+	}
+	return result
+}
+
+// Run polls every interval.
+func (p *SNMPPoller) Run(server *MDNSServer, interval time.Duration) {
+	for {
+		if server.protocols.Enabled(protocolSNMP) {
+			p.pollAll(server)
+		}
+		time.Sleep(interval)
+	}
+}
+
+// pollAll polls the IPv4 address of every local device.
+func (p *SNMPPoller) pollAll(server *MDNSServer) {
+	targets := make(map[string]string) // device key -> IP
+	for _, service := range server.listServices(server.site) {
+		if ip := net.ParseIP(service.IP); ip != nil && ip.To4() != nil {
+			targets[siteKey(service.Site, deviceID(&service))] = service.IP
+		}
+	}
+
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, snmpConcurrency)
+	results := make(map[string]*SNMPInfo)
+	var mu sync.Mutex
+	for key, ip := range targets {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func() {
+			defer wg.Done()
+			defer func() { <-sem }()
+			info, err := p.poll(ip)
+			if err != nil {
+				return
+			}
+			mu.Lock()
+			results[key] = info
+			mu.Unlock()
+		}()
+	}
+	wg.Wait()
+
+	p.mu.Lock()
+	p.devices = results
+	p.polled = time.Now()
+	p.mu.Unlock()
+	if len(results) > 0 {
+		log.Printf("SNMP: %d of %d devices answered", len(results), len(targets))
+	}
+}
+
+// poll reads the system group, the interface table and, for switches, the
+// forwarding table of the agent at ip.
+func (p *SNMPPoller) poll(ip string) (*SNMPInfo, error) {
+	if err := scanScope.check(ip); err != nil {
+		return nil, err
+	}
+	c := &snmpClient{addr: net.JoinHostPort(ip, strconv.Itoa(p.port)), community: p.community, timeout: p.timeout}
+
+	vbs, err := c.get(oidSysName, oidSysDescr, oidSysUpTime)
+	if err != nil {
+		return nil, err
+	}
+	if len(vbs) != 3 {
+		return nil, fmt.Errorf("expected 3 values, got %d", len(vbs))
+	}
+	info := &SNMPInfo{
+		IP:       ip,
+		SysName:  snmpString(vbs[0].Value),
+		SysDescr: snmpString(vbs[1].Value),
+		Uptime:   snmpNumber(vbs[2].Value) / 100, // TimeTicks are 1/100s
+		PolledAt: time.Now().Unix(),
+	}
+
+	interfaces := make(map[int]*SNMPInterface)
+	iface := func(index string) *SNMPInterface {
+		i, err := strconv.Atoi(index)
+		if err != nil {
+			return nil
+		}
+		if interfaces[i] == nil {
+			interfaces[i] = &SNMPInterface{Index: i}
+		}
+		return interfaces[i]
+	}
+	c.walk(oidIfDescr, func(vb snmpVarbind) {
+		if i := iface(oidIndex(vb.OID, oidIfDescr)); i != nil {
+			i.Name = snmpString(vb.Value)
+		}
+	})
+	c.walk(oidIfOperStatus, func(vb snmpVarbind) {
+		if i := iface(oidIndex(vb.OID, oidIfOperStatus)); i != nil {
+			i.Status = ifOperStatuses[snmpNumber(vb.Value)]
+		}
+	})
+	c.walk(oidIfInOctets, func(vb snmpVarbind) {
+		if i := iface(oidIndex(vb.OID, oidIfInOctets)); i != nil {
+			i.InOctets = uint64(snmpNumber(vb.Value))
+		}
+	})
+	c.walk(oidIfOutOctets, func(vb snmpVarbind) {
+		if i := iface(oidIndex(vb.OID, oidIfOutOctets)); i != nil {
+			i.OutOctets = uint64(snmpNumber(vb.Value))
+		}
+	})
+	info.Interfaces = make([]SNMPInterface, 0, len(interfaces))
+	for _, i := range interfaces {
+		info.Interfaces = append(info.Interfaces, *i)
+	}
+	sort.Slice(info.Interfaces, func(a, b int) bool { return info.Interfaces[a].Index < info.Interfaces[b].Index })
+
+	info.MACTable = p.macTable(c, interfaces)
+	return info, nil
+}
+
+// macTable walks the BRIDGE-MIB forwarding table, falling back to the
+// Q-BRIDGE-MIB one that VLAN-aware switches keep instead.
+func (p *SNMPPoller) macTable(c *snmpClient, interfaces map[int]*SNMPInterface) []SNMPMACEntry {
+	var entries []SNMPMACEntry
+	add := func(index string, vlan int, port int64) {
+		if len(entries) >= maxMACTable {
+			return
+		}
+		if mac := macFromOID(index); mac != "" {
+			entries = append(entries, SNMPMACEntry{MAC: mac, VLAN: vlan, Port: int(port)})
+		}
+	}
+
+	c.walk(oidTpFdbPort, func(vb snmpVarbind) {
+		add(oidIndex(vb.OID, oidTpFdbPort), 0, snmpNumber(vb.Value))
+	})
+	if len(entries) == 0 {
+		c.walk(oidQTpFdbPort, func(vb snmpVarbind) {
+			vlan, mac, ok := strings.Cut(oidIndex(vb.OID, oidQTpFdbPort), ".")
+			if n, err := strconv.Atoi(vlan); ok && err == nil {
+				add(mac, n, snmpNumber(vb.Value))
+			}
+		})
+	}
+	if len(entries) == 0 {
+		return nil
+	}
+
+	// Bridge ports are mapped to interfaces through dot1dBasePortIfIndex
+	ports := make(map[int]int)
+	c.walk(oidBasePortIfIndex, func(vb snmpVarbind) {
+		if port, err := strconv.Atoi(oidIndex(vb.OID, oidBasePortIfIndex)); err == nil {
+			ports[port] = int(snmpNumber(vb.Value))
+		}
+	})
+	for i := range entries {
+		if ifIndex, ok := ports[entries[i].Port]; ok {
+			entries[i].IfIndex = ifIndex
+			if iface := interfaces[ifIndex]; iface != nil {
+				entries[i].Interface = iface.Name
+			}
+		}
+	}
+	sort.Slice(entries, func(a, b int) bool { return entries[a].MAC < entries[b].MAC })
+	return entries
+}
+
+// macFromOID converts a MAC address index ("0.27.33.1.2.3") to its
+// colon-separated form.
+func macFromOID(index string) string {
+	parts := strings.Split(index, ".")
+	if len(parts) != 6 {
+		return ""
+	}
+	octets := make([]string, 6)
+	for i, p := range parts {
+		n, err := strconv.Atoi(p)
+		if err != nil || n < 0 || n > 255 {
+			return ""
+		}
+		octets[i] = fmt.Sprintf("%02x", n)
+	}
+	return strings.Join(octets, ":")
+}
+
+// SNMP handles GET /api/snmp, what the SNMP agents of the devices of
+// ?site= reported at the last poll, keyed by device ID.
+func (s *MDNSServer) SNMP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	response := map[string]interface{}{
+		"enabled": s.snmp != nil && s.protocols.Enabled(protocolSNMP),
+		"devices": s.snmp.List(s.siteParam(r)),
+	}
+	if s.snmp != nil {
+		s.snmp.mu.RLock()
+		if !s.snmp.polled.IsZero() {
+			response["polledAt"] = s.snmp.polled.Unix()
+		}
+		s.snmp.mu.RUnlock()
+	}
+	writeJSON(w, http.StatusOK, response)
+}
@@ -0,0 +1,35 @@
+package main
+
+import "testing"
+
+// TestSNMPPoll verifies the system group, interfaces and a switch's
+// forwarding table are read and bridge ports mapped to interfaces
+func TestSNMPPoll(t *testing.T) {
+	port := startTestAgent(t, "public", []snmpVarbind{
+		{OID: oidSysName, Value: []byte("switch-1")},
+		{OID: oidSysDescr, Value: []byte("Managed Switch")},
+		{OID: oidSysUpTime, Type: snmpTimeTicks, Value: uint64(360000)},
+		{OID: oidIfDescr + ".12", Value: []byte("port12")},
+		{OID: oidIfOperStatus + ".12", Value: int64(1)},
+		{OID: oidIfInOctets + ".12", Type: snmpCounter32, Value: uint64(1000)},
+		{OID: oidIfOutOctets + ".12", Type: snmpCounter32, Value: uint64(2000)},
+		{OID: oidTpFdbPort + ".0.27.33.1.2.3", Value: int64(5)},
+		{OID: oidBasePortIfIndex + ".5", Value: int64(12)},
+	})
+
+	p := NewSNMPPoller("public")
+	p.port = port
+	info, err := p.poll("127.0.0.1")
+	if err != nil {
+		t.Fatalf("Poll failed: %v", err)
+	}
+	if info.SysName != "switch-1" || info.SysDescr != "Managed Switch" || info.Uptime != 3600 {
+		t.Fatalf("Unexpected system group %+v", info)
+	}
+	if len(info.Interfaces) != 1 || info.Interfaces[0] != (SNMPInterface{Index: 12, Name: "port12", Status: "up", InOctets: 1000, OutOctets: 2000}) {
+		t.Fatalf("Unexpected interfaces %+v", info.Interfaces)
+	}
+	if len(info.MACTable) != 1 || info.MACTable[0] != (SNMPMACEntry{MAC: "00:1b:21:01:02:03", Port: 5, IfIndex: 12, Interface: "port12"}) {
+		t.Fatalf("Unexpected MAC table %+v", info.MACTable)
+	}
+}
@@ -0,0 +1,33 @@
+//go:build windows
+
+package main
+
+import (
+	"syscall"
+)
+
+// reusePortControl sets SO_REUSEADDR; Windows has no SO_REUSEPORT, and
+// SO_REUSEADDR already lets sockets share a port there.
+func reusePortControl(network, address string, c syscall.RawConn) error {
+	var sockErr error
+	err := c.Control(func(fd uintptr) {
+		sockErr = syscall.SetsockoptInt(syscall.Handle(fd), syscall.SOL_SOCKET, syscall.SO_REUSEADDR, 1)
+	})
+	if err != nil {
+		return err
+	}
+	return sockErr
+}
+
+// broadcastControl sets SO_BROADCAST so the socket may send to broadcast
+// addresses, e.g. Wake-on-LAN packets.
+func broadcastControl(network, address string, c syscall.RawConn) error {
+	var sockErr error
+	err := c.Control(func(fd uintptr) {
+		sockErr = syscall.SetsockoptInt(syscall.Handle(fd), syscall.SOL_SOCKET, syscall.SO_BROADCAST, 1)
+	})
+	if err != nil {
+		return err
+	}
+	return sockErr
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"bytes"
+	"io/fs"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+)
+
+// SPA serves the built frontend: its files as they are, and index.html
+// for every other path, which the frontend routes itself.
+//
+// Files are opened through an os.Root, so no path, symlink or ".." can
+// reach outside the directory, whatever the file system's case rules.
+// Directories aren't listed, and dot files aren't served.
+type SPA struct {
+	root  fs.FS
+	files http.Handler
+
+	mu       sync.Mutex
+	index    []byte // index.html as last read
+	indexMod time.Time
+	indexLen int64
+}
+
+// NewSPA serves the frontend built into dir.
+func NewSPA(dir string) (*SPA, error) {
+	root, err := os.OpenRoot(dir)
+	if err != nil {
+		return nil, err
+	}
+	files := root.FS()
+	return &SPA{root: files, files: http.FileServerFS(files)}, nil
+}
+
+// spaFile returns the name below the frontend directory a URL path asks
+// for, "" for the root, and false for names that are never served: those
+// with dot files or that fs.FS doesn't accept.
+func spaFile(urlPath string) (string, bool) {
+	name := strings.TrimPrefix(path.Clean("/"+urlPath), "/")
+	if name == "" {
+		return "", true
+	}
+	if !fs.ValidPath(name) || strings.Contains(name, "\\") {
+		return "", false
+	}
+	for _, element := range strings.Split(name, "/") {
+		if strings.HasPrefix(element, ".") {
+			return "", false
+		}
+	}
+	return name, true
+}
+
+func (s *SPA) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	// API routes are handled by their own handlers
+	if _, ok := apiPath(r.URL.Path); ok || r.URL.Path == "/api" || r.URL.Path == "/health" {
+		http.NotFound(w, r)
+		return
+	}
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	name, ok := spaFile(r.URL.Path)
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	if name != "" && name != "index.html" {
+		if info, err := fs.Stat(s.root, name); err == nil && info.Mode().IsRegular() {
+			s.files.ServeHTTP(w, r)
+			return
+		}
+	}
+	s.serveIndex(w, r)
+}
+
+// serveIndex serves index.html from memory, reading it again only when it
+// has changed on disk, e.g. after a rebuild.
+func (s *SPA) serveIndex(w http.ResponseWriter, r *http.Request) {
+	info, err := fs.Stat(s.root, "index.html")
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	s.mu.Lock()
+	if s.index == nil || !info.ModTime().Equal(s.indexMod) || info.Size() != s.indexLen {
+		data, err := fs.ReadFile(s.root, "index.html")
+		if err != nil {
+			s.mu.Unlock()
+			http.Error(w, "cannot read index.html", http.StatusInternalServerError)
+			return
+		}
+		s.index, s.indexMod, s.indexLen = data, info.ModTime(), info.Size()
+	}
+	index, mod := s.index, s.indexMod
+	s.mu.Unlock()
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	// The index names the hashed assets of the current build, so it must
+	// not be cached without asking
+	w.Header().Set("Cache-Control", "no-cache")
+	http.ServeContent(w, r, "index.html", mod, bytes.NewReader(index))
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+const spaSecret = "outside the frontend"
+
+// newTestSPA builds a frontend directory next to a file it must never
+// serve, with a symlink pointing at it.
+func newTestSPA(t testing.TB) (*SPA, string) {
+	base := t.TempDir()
+	dist := filepath.Join(base, "dist")
+	os.MkdirAll(filepath.Join(dist, "assets"), 0o755)
+	os.WriteFile(filepath.Join(dist, "index.html"), []byte("<html>app</html>"), 0o644)
+	os.WriteFile(filepath.Join(dist, "assets", "app.js"), []byte("console.log(1)"), 0o644)
+	os.WriteFile(filepath.Join(dist, ".env"), []byte(spaSecret), 0o644)
+	os.WriteFile(filepath.Join(base, "secret.txt"), []byte(spaSecret), 0o644)
+	os.Symlink(filepath.Join(base, "secret.txt"), filepath.Join(dist, "linked.txt"))
+	os.Symlink(base, filepath.Join(dist, "up"))
+	spa, err := NewSPA(dist)
+	if err != nil {
+		t.Fatalf("Expected the frontend to be served, got %v", err)
+	}
+	return spa, dist
+}
+
+func getSPA(spa *SPA, method, target string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, "/", nil)
+	req.URL.Path = target
+	rec := httptest.NewRecorder()
+	spa.ServeHTTP(rec, req)
+	return rec
+}
+
+// TestSPA verifies files are served, other paths get index.html, and
+// nothing outside the directory is reachable
+func TestSPA(t *testing.T) {
+	spa, _ := newTestSPA(t)
+	for target, want := range map[string]string{
+		"/":              "<html>app</html>",
+		"/devices/abc":   "<html>app</html>",
+		"/assets":        "<html>app</html>",
+		"/assets/app.js": "console.log(1)",
+	} {
+		rec := getSPA(spa, http.MethodGet, target)
+		if rec.Code != http.StatusOK || rec.Body.String() != want {
+			t.Fatalf("Expected %q for %s, got %d %q", want, target, rec.Code, rec.Body.String())
+		}
+	}
+	if rec := getSPA(spa, http.MethodGet, "/"); rec.Header().Get("Cache-Control") != "no-cache" || !strings.HasPrefix(rec.Header().Get("Content-Type"), "text/html") {
+		t.Fatalf("Expected an uncached HTML index, got %v", rec.Header())
+	}
+	for _, target := range []string{"/.env", "/api/devices", "/discover", "/health"} {
+		if rec := getSPA(spa, http.MethodGet, target); rec.Code != http.StatusNotFound {
+			t.Fatalf("Expected 404 for %s, got %d", target, rec.Code)
+		}
+	}
+	for _, target := range []string{"/linked.txt", "/up/secret.txt", "/../secret.txt", "/assets/../../secret.txt", "/..%2fsecret.txt", "/..\\secret.txt"} {
+		if rec := getSPA(spa, http.MethodGet, target); strings.Contains(rec.Body.String(), spaSecret) {
+			t.Fatalf("Expected %s not to escape the frontend directory", target)
+		}
+	}
+	if rec := getSPA(spa, http.MethodPost, "/"); rec.Code != http.StatusMethodNotAllowed {
+		t.Fatalf("Expected POST to be refused, got %d", rec.Code)
+	}
+}
+
+// TestSPAIndexCache verifies index.html is read again once it changes
+func TestSPAIndexCache(t *testing.T) {
+	spa, dist := newTestSPA(t)
+	getSPA(spa, http.MethodGet, "/")
+	index := filepath.Join(dist, "index.html")
+	os.WriteFile(index, []byte("<html>new build</html>"), 0o644)
+	later := time.Now().Add(time.Minute)
+	os.Chtimes(index, later, later)
+	if rec := getSPA(spa, http.MethodGet, "/devices"); rec.Body.String() != "<html>new build</html>" {
+		t.Fatalf("Expected the rebuilt index, got %q", rec.Body.String())
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set("If-Modified-Since", later.UTC().Format(http.TimeFormat))
+	rec := httptest.NewRecorder()
+	spa.ServeHTTP(rec, req)
+	if rec.Code != http.StatusNotModified {
+		t.Fatalf("Expected a conditional request to be answered 304, got %d", rec.Code)
+	}
+}
+
+// FuzzSPAPath verifies no request path serves anything from outside the
+// frontend directory or a dot file
+func FuzzSPAPath(f *testing.F) {
+	for _, seed := range []string{"/", "/assets/app.js", "/../secret.txt", "/up/secret.txt", "/linked.txt", "/.env", "//..//secret.txt", "/assets/..\\..\\secret.txt", "/ASSETS/APP.JS", "/%2e%2e/secret.txt"} {
+		f.Add(seed)
+	}
+	spa, _ := newTestSPA(f)
+	f.Fuzz(func(t *testing.T, target string) {
+		rec := getSPA(spa, http.MethodGet, "/"+strings.TrimPrefix(target, "/"))
+		if strings.Contains(rec.Body.String(), spaSecret) {
+			t.Fatalf("Expected %q not to serve a file outside the frontend", target)
+		}
+	})
+}
@@ -0,0 +1,425 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// speedTestBucket is the Store bucket speed test results are kept in.
+const speedTestBucket = "speedtest"
+
+// Speed test defaults and bounds.
+const (
+	speedTestPings         = 10
+	defaultDownloadBytes   = 25_000_000
+	defaultUploadBytes     = 10_000_000
+	maxSpeedTestBytes      = 250_000_000
+	maxSpeedTestHistory    = 500
+	speedTestProgressEvery = 250 * time.Millisecond
+)
+
+var errSpeedTestRunning = errors.New("a speed test is already running")
+
+// SpeedTestEndpoint is the server tests are run against. Kind selects the
+// URL layout: "cloudflare" (speed.cloudflare.com's /__down and /__up) or
+// "librespeed" (garbage.php, empty.php).
+type SpeedTestEndpoint struct {
+	Kind string `json:"kind"`
+	URL  string `json:"url"`
+}
+
+func (e SpeedTestEndpoint) validate() error {
+	if e.Kind != "cloudflare" && e.Kind != "librespeed" {
+		return fmt.Errorf("unknown speed test endpoint kind %q (expected cloudflare or librespeed)", e.Kind)
+	}
+	if !strings.HasPrefix(e.URL, "http://") && !strings.HasPrefix(e.URL, "https://") {
+		return fmt.Errorf("invalid speed test URL %q", e.URL)
+	}
+	return nil
+}
+
+// pingURL is a request with an empty response, for latency.
+func (e SpeedTestEndpoint) pingURL() string {
+	base := strings.TrimSuffix(e.URL, "/")
+	if e.Kind == "librespeed" {
+		return base + "/empty.php"
+	}
+	return base + "/__down?bytes=0"
+}
+
+// downloadURL returns n bytes. LibreSpeed serves whole 1MiB chunks.
+func (e SpeedTestEndpoint) downloadURL(n int64) string {
+	base := strings.TrimSuffix(e.URL, "/")
+	if e.Kind == "librespeed" {
+		return fmt.Sprintf("%s/garbage.php?ckSize=%d", base, max(1, (n+1<<20-1)>>20))
+	}
+	return fmt.Sprintf("%s/__down?bytes=%d", base, n)
+}
+
+// uploadURL accepts and discards a request body.
+func (e SpeedTestEndpoint) uploadURL() string {
+	base := strings.TrimSuffix(e.URL, "/")
+	if e.Kind == "librespeed" {
+		return base + "/empty.php"
+	}
+	return base + "/__up"
+}
+
+// SpeedTestOptions are the sizes of a test's transfers.
+type SpeedTestOptions struct {
+	DownloadBytes int64 `json:"downloadBytes,omitempty"`
+	UploadBytes   int64 `json:"uploadBytes,omitempty"`
+}
+
+// SpeedTestProgress is streamed while a test runs.
+type SpeedTestProgress struct {
+	Phase string  `json:"phase"` // "latency", "download" or "upload"
+	Bytes int64   `json:"bytes,omitempty"`
+	Total int64   `json:"total,omitempty"`
+	Mbps  float64 `json:"mbps,omitempty"`
+	RTTMs float64 `json:"rttMs,omitempty"`
+}
+
+// SpeedTestResult is a finished test.
+type SpeedTestResult struct {
+	Time          int64   `json:"time"`
+	Endpoint      string  `json:"endpoint"`
+	LatencyMs     float64 `json:"latencyMs"` // median round trip
+	JitterMs      float64 `json:"jitterMs"`  // mean difference between consecutive round trips
+	DownloadMbps  float64 `json:"downloadMbps"`
+	UploadMbps    float64 `json:"uploadMbps"`
+	DownloadBytes int64   `json:"downloadBytes"`
+	UploadBytes   int64   `json:"uploadBytes"`
+	DurationMs    int64   `json:"durationMs"`
+}
+
+// SpeedTester runs one speed test at a time and keeps the history of
+// results in the persistent Store.
+type SpeedTester struct {
+	endpoint SpeedTestEndpoint
+	client   *http.Client
+	store    Store
+
+	mu      sync.Mutex
+	running bool
+	history []SpeedTestResult // oldest first
+}
+
+// NewSpeedTester loads the results of earlier tests from store.
+func NewSpeedTester(store Store, endpoint SpeedTestEndpoint) (*SpeedTester, error) {
+	if err := endpoint.validate(); err != nil {
+		return nil, err
+	}
+	t := &SpeedTester{endpoint: endpoint, client: &http.Client{}, store: store}
+
+	entries, err := store.Load(speedTestBucket)
+	if err != nil {
+		return nil, err
+	}
+	for key, data := range entries {
+		var result SpeedTestResult
+		if err := json.Unmarshal(data, &result); err != nil {
+			return nil, fmt.Errorf("speed test %s: %v", key, err)
+		}
+		t.history = append(t.history, result)
+	}
+	sort.Slice(t.history, func(i, j int) bool { return t.history[i].Time < t.history[j].Time })
+	return t, nil
+}
+
+// History returns up to limit of the latest results (all when limit is 0),
+// oldest first.
+func (t *SpeedTester) History(limit int) []SpeedTestResult {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	history := t.history
+	if limit > 0 && len(history) > limit {
+		history = history[len(history)-limit:]
+	}
+	return append([]SpeedTestResult{}, history...)
+}
+
+// Run measures latency, then download and upload throughput, reporting
+// progress along the way, and records the result.
+func (t *SpeedTester) Run(ctx context.Context, opts SpeedTestOptions, progress func(SpeedTestProgress)) (*SpeedTestResult, error) {
+	t.mu.Lock()
+	if t.running {
+		t.mu.Unlock()
+		return nil, errSpeedTestRunning
+	}
+	t.running = true
+	t.mu.Unlock()
+	defer func() {
+		t.mu.Lock()
+		t.running = false
+		t.mu.Unlock()
+	}()
+
+	if opts.DownloadBytes <= 0 {
+		opts.DownloadBytes = defaultDownloadBytes
+	}
+	if opts.UploadBytes <= 0 {
+		opts.UploadBytes = defaultUploadBytes
+	}
+	opts.DownloadBytes = min(opts.DownloadBytes, maxSpeedTestBytes)
+	opts.UploadBytes = min(opts.UploadBytes, maxSpeedTestBytes)
+
+	start := time.Now()
+	result := &SpeedTestResult{Time: start.Unix(), Endpoint: t.endpoint.URL}
+
+	var err error
+	if result.LatencyMs, result.JitterMs, err = t.latency(ctx, progress); err != nil {
+		return nil, fmt.Errorf("latency: %v", err)
+	}
+	if result.DownloadBytes, result.DownloadMbps, err = t.download(ctx, opts.DownloadBytes, progress); err != nil {
+		return nil, fmt.Errorf("download: %v", err)
+	}
+	if result.UploadBytes, result.UploadMbps, err = t.upload(ctx, opts.UploadBytes, progress); err != nil {
+		return nil, fmt.Errorf("upload: %v", err)
+	}
+	result.DurationMs = time.Since(start).Milliseconds()
+
+	t.record(*result)
+	return result, nil
+}
+
+// record appends a result to the history, dropping the oldest beyond
+// maxSpeedTestHistory.
+func (t *SpeedTester) record(result SpeedTestResult) {
+	t.mu.Lock()
+	t.history = append(t.history, result)
+	var dropped []SpeedTestResult
+	if n := len(t.history) - maxSpeedTestHistory; n > 0 {
+		dropped = append(dropped, t.history[:n]...)
+		t.history = append([]SpeedTestResult(nil), t.history[n:]...)
+	}
+	t.mu.Unlock()
+
+	data, _ := json.Marshal(result)
+	t.store.Put(speedTestBucket, map[string][]byte{speedTestKey(result): data})
+	if len(dropped) > 0 {
+		keys := make([]string, len(dropped))
+		for i, r := range dropped {
+			keys[i] = speedTestKey(r)
+		}
+		t.store.Delete(speedTestBucket, keys...)
+	}
+}
+
+// speedTestKey sorts results by time.
+func speedTestKey(r SpeedTestResult) string {
+	return fmt.Sprintf("%020d", r.Time)
+}
+
+// latency times round trips of empty requests. The first one, which sets
+// up the connection, isn't counted.
+func (t *SpeedTester) latency(ctx context.Context, progress func(SpeedTestProgress)) (median, jitter float64, err error) {
+	rtts := make([]float64, 0, speedTestPings)
+	for i := 0; i <= speedTestPings; i++ {
+		start := time.Now()
+		if err := t.fetch(ctx, t.endpoint.pingURL(), io.Discard); err != nil {
+			return 0, 0, err
+		}
+		if i == 0 {
+			continue
+		}
+		rtt := float64(time.Since(start).Microseconds()) / 1000
+		rtts = append(rtts, rtt)
+		progress(SpeedTestProgress{Phase: "latency", RTTMs: rtt})
+	}
+
+	for i := 1; i < len(rtts); i++ {
+		d := rtts[i] - rtts[i-1]
+		if d < 0 {
+			d = -d
+		}
+		jitter += d
+	}
+	jitter /= float64(len(rtts) - 1)
+	sorted := append([]float64(nil), rtts...)
+	sort.Float64s(sorted)
+	return sorted[len(sorted)/2], jitter, nil
+}
+
+func (t *SpeedTester) fetch(ctx context.Context, url string, w io.Writer) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := t.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s: %s", url, resp.Status)
+	}
+	_, err = io.Copy(w, resp.Body)
+	return err
+}
+
+func (t *SpeedTester) download(ctx context.Context, n int64, progress func(SpeedTestProgress)) (int64, float64, error) {
+	meter := newTransferMeter("download", n, progress)
+	if err := t.fetch(ctx, t.endpoint.downloadURL(n), meter); err != nil {
+		return 0, 0, err
+	}
+	return meter.done()
+}
+
+func (t *SpeedTester) upload(ctx context.Context, n int64, progress func(SpeedTestProgress)) (int64, float64, error) {
+	meter := newTransferMeter("upload", n, progress)
+	body := io.TeeReader(io.LimitReader(zeroReader{}, n), meter)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, t.endpoint.uploadURL(), body)
+	if err != nil {
+		return 0, 0, err
+	}
+	req.ContentLength = n
+	req.Header.Set("Content-Type", "application/octet-stream")
+	resp, err := t.client.Do(req)
+	if err != nil {
+		return 0, 0, err
+	}
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return 0, 0, fmt.Errorf("%s: %s", req.URL, resp.Status)
+	}
+	return meter.done()
+}
+
+// zeroReader is an endless upload payload.
+type zeroReader struct{}
+
+func (zeroReader) Read(p []byte) (int, error) {
+	clear(p)
+	return len(p), nil
+}
+
+// transferMeter counts the bytes written to it and reports progress at
+// most every speedTestProgressEvery.
+type transferMeter struct {
+	phase    string
+	total    int64
+	progress func(SpeedTestProgress)
+
+	start    time.Time
+	reported time.Time
+	bytes    int64
+}
+
+func newTransferMeter(phase string, total int64, progress func(SpeedTestProgress)) *transferMeter {
+	now := time.Now()
+	return &transferMeter{phase: phase, total: total, progress: progress, start: now, reported: now}
+}
+
+func (m *transferMeter) Write(p []byte) (int, error) {
+	m.bytes += int64(len(p))
+	if now := time.Now(); now.Sub(m.reported) >= speedTestProgressEvery {
+		m.reported = now
+		m.progress(SpeedTestProgress{Phase: m.phase, Bytes: m.bytes, Total: m.total, Mbps: m.mbps()})
+	}
+	return len(p), nil
+}
+
+func (m *transferMeter) mbps() float64 {
+	seconds := time.Since(m.start).Seconds()
+	if seconds <= 0 {
+		return 0
+	}
+	return float64(m.bytes) * 8 / seconds / 1e6
+}
+
+// done reports the final progress and returns the bytes transferred and
+// the throughput.
+func (m *transferMeter) done() (int64, float64, error) {
+	if m.bytes == 0 {
+		return 0, 0, errors.New("nothing transferred")
+	}
+	mbps := m.mbps()
+	m.progress(SpeedTestProgress{Phase: m.phase, Bytes: m.bytes, Total: m.total, Mbps: mbps})
+	return m.bytes, mbps, nil
+}
+
+// SpeedTest handles GET /api/speedtest, the history of results (?limit=N
+// for the latest N), and POST /api/speedtest, which runs a test. With
+// "Accept: text/event-stream" the progress is streamed as "progress" events
+// followed by a "result" (or "error") event; otherwise the response is the
+// result once the test is done.
+func (s *MDNSServer) SpeedTest(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		limit := 0
+		if v := r.URL.Query().Get("limit"); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil || n < 0 {
+				writeError(w, http.StatusBadRequest, "invalid limit")
+				return
+			}
+			limit = n
+		}
+		writeJSON(w, http.StatusOK, map[string]interface{}{
+			"endpoint": s.speedtest.endpoint,
+			"results":  s.speedtest.History(limit),
+		})
+	case http.MethodPost:
+		s.runSpeedTest(w, r)
+	default:
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+	}
+}
+
+func (s *MDNSServer) runSpeedTest(w http.ResponseWriter, r *http.Request) {
+	var opts SpeedTestOptions
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&opts); err != nil && err != io.EOF {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+	}
+
+	if !strings.Contains(r.Header.Get("Accept"), "text/event-stream") {
+		result, err := s.speedtest.Run(r.Context(), opts, func(SpeedTestProgress) {})
+		switch {
+		case errors.Is(err, errSpeedTestRunning):
+			writeError(w, http.StatusConflict, err.Error())
+		case err != nil:
+			writeError(w, http.StatusBadGateway, err.Error())
+		default:
+			writeJSON(w, http.StatusOK, result)
+		}
+		return
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeError(w, http.StatusInternalServerError, "streaming unsupported")
+		return
+	}
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	send := func(event string, v interface{}) {
+		data, _ := json.Marshal(v)
+		fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event, data)
+		flusher.Flush()
+	}
+	result, err := s.speedtest.Run(r.Context(), opts, func(p SpeedTestProgress) { send("progress", p) })
+	if err != nil {
+		send("error", map[string]string{"error": err.Error()})
+		return
+	}
+	send("result", result)
+}
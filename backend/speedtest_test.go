@@ -0,0 +1,108 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// startSpeedTestServer serves the Cloudflare speed test endpoints.
+func startSpeedTestServer(t *testing.T) *httptest.Server {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/__down", func(w http.ResponseWriter, r *http.Request) {
+		n, _ := strconv.ParseInt(r.URL.Query().Get("bytes"), 10, 64)
+		io.Copy(w, io.LimitReader(zeroReader{}, n))
+	})
+	mux.HandleFunc("/__up", func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(io.Discard, r.Body)
+	})
+	server := httptest.NewServer(mux)
+	t.Cleanup(server.Close)
+	return server
+}
+
+// TestSpeedTestRun verifies a test measures all three phases, reports
+// progress and keeps its result across restarts
+func TestSpeedTestRun(t *testing.T) {
+	endpoint := startSpeedTestServer(t)
+	store := openTestStore(t, "json", t.TempDir())
+
+	tester, err := NewSpeedTester(store, SpeedTestEndpoint{Kind: "cloudflare", URL: endpoint.URL})
+	if err != nil {
+		t.Fatalf("Failed to create tester: %v", err)
+	}
+	phases := make(map[string]bool)
+	result, err := tester.Run(context.Background(), SpeedTestOptions{DownloadBytes: 1 << 20, UploadBytes: 1 << 19}, func(p SpeedTestProgress) {
+		phases[p.Phase] = true
+	})
+	if err != nil {
+		t.Fatalf("Speed test failed: %v", err)
+	}
+	if result.DownloadBytes != 1<<20 || result.UploadBytes != 1<<19 {
+		t.Fatalf("Expected the requested transfer sizes, got %+v", result)
+	}
+	if result.DownloadMbps <= 0 || result.UploadMbps <= 0 || result.LatencyMs <= 0 {
+		t.Fatalf("Expected positive measurements, got %+v", result)
+	}
+	for _, phase := range []string{"latency", "download", "upload"} {
+		if !phases[phase] {
+			t.Fatalf("Expected progress for %s, got %v", phase, phases)
+		}
+	}
+
+	reloaded, err := NewSpeedTester(store, SpeedTestEndpoint{Kind: "cloudflare", URL: endpoint.URL})
+	if err != nil {
+		t.Fatalf("Failed to reload tester: %v", err)
+	}
+	if history := reloaded.History(0); len(history) != 1 || history[0].DownloadBytes != result.DownloadBytes {
+		t.Fatalf("Expected the result in the reloaded history, got %+v", history)
+	}
+}
+
+// TestSpeedTestEndpoint verifies the URL layouts and endpoint validation
+func TestSpeedTestEndpoint(t *testing.T) {
+	libre := SpeedTestEndpoint{Kind: "librespeed", URL: "http://speed.lan/backend/"}
+	if got := libre.downloadURL(3<<20 + 1); got != "http://speed.lan/backend/garbage.php?ckSize=4" {
+		t.Fatalf("Unexpected LibreSpeed download URL %q", got)
+	}
+	if got := libre.uploadURL(); got != "http://speed.lan/backend/empty.php" {
+		t.Fatalf("Unexpected LibreSpeed upload URL %q", got)
+	}
+
+	if err := (SpeedTestEndpoint{Kind: "ookla", URL: "http://x"}).validate(); err == nil {
+		t.Fatalf("Expected an unknown kind to be rejected")
+	}
+	if err := (SpeedTestEndpoint{Kind: "cloudflare", URL: "speed.cloudflare.com"}).validate(); err == nil {
+		t.Fatalf("Expected a URL without a scheme to be rejected")
+	}
+}
+
+// TestSpeedTestStream verifies POST /api/speedtest streams progress and
+// ends with the result
+func TestSpeedTestStream(t *testing.T) {
+	endpoint := startSpeedTestServer(t)
+	server := NewMDNSServer()
+	tester, err := NewSpeedTester(openTestStore(t, "json", t.TempDir()), SpeedTestEndpoint{Kind: "cloudflare", URL: endpoint.URL})
+	if err != nil {
+		t.Fatalf("Failed to create tester: %v", err)
+	}
+	server.speedtest = tester
+
+	req := httptest.NewRequest(http.MethodPost, "/api/speedtest", strings.NewReader(`{"downloadBytes":65536,"uploadBytes":65536}`))
+	req.Header.Set("Accept", "text/event-stream")
+	w := httptest.NewRecorder()
+	server.SpeedTest(w, req)
+
+	body := w.Body.String()
+	progress, result := strings.Index(body, "event: progress\n"), strings.Index(body, "event: result\n")
+	if progress < 0 || result < progress {
+		t.Fatalf("Expected progress events followed by a result, got %q", body)
+	}
+	if len(tester.History(0)) != 1 {
+		t.Fatalf("Expected the streamed test to be recorded")
+	}
+}
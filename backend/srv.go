@@ -0,0 +1,148 @@
+package main
+
+import (
+	"cmp"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// ServiceTarget is one of the hosts an instance's SRV records point to. A
+// replicated service has several; clients pick among those of the lowest
+// priority, in proportion to their weights (RFC 2782).
+type ServiceTarget struct {
+	Host     string `json:"host"`
+	Port     uint16 `json:"port"`
+	Priority uint16 `json:"priority"`
+	Weight   uint16 `json:"weight"`
+	IP       string `json:"ip,omitempty"` // as the service's, "" if unresolved
+	IP6      string `json:"ip6,omitempty"`
+	// ExpiresAt is when the target's record runs out unless it is
+	// announced again
+	ExpiresAt int64 `json:"expiresAt"`
+}
+
+// compareTargets orders targets by preference: the lowest priority first,
+// and the highest weight first among the same priority, which is what most
+// clients end up using.
+func compareTargets(a, b ServiceTarget) int {
+	return cmp.Or(
+		cmp.Compare(a.Priority, b.Priority),
+		cmp.Compare(b.Weight, a.Weight),
+		strings.Compare(a.Host, b.Host),
+		cmp.Compare(a.Port, b.Port),
+	)
+}
+
+// hasSRV reports whether a packet has an SRV record of an instance.
+func hasSRV(msg *dns.Msg, instance string) bool {
+	for _, section := range [][]dns.RR{msg.Answer, msg.Extra} {
+		for _, rr := range section {
+			if srv, ok := rr.(*dns.SRV); ok && strings.EqualFold(srv.Hdr.Name, instance) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// firstSRV reports whether record is the first SRV record of its instance
+// in a packet, so instances with several are handled once.
+func firstSRV(msg *dns.Msg, record *dns.SRV) bool {
+	for _, section := range [][]dns.RR{msg.Answer, msg.Extra} {
+		for _, rr := range section {
+			if srv, ok := rr.(*dns.SRV); ok && strings.EqualFold(srv.Hdr.Name, record.Hdr.Name) {
+				return srv == record
+			}
+		}
+	}
+	return false
+}
+
+// srvTargets resolves the targets of the SRV records of an instance in a
+// packet, at the addresses they have in the packet or else resolve to
+// within follow, in order of preference. ttl is that of the first record.
+func srvTargets(server *MDNSServer, msg *dns.Msg, instance string, follow *followUps, received time.Time) (targets []ServiceTarget, ttl uint32) {
+	for _, section := range [][]dns.RR{msg.Answer, msg.Extra} {
+		for _, rr := range section {
+			record, ok := rr.(*dns.SRV)
+			if !ok || !strings.EqualFold(record.Hdr.Name, instance) {
+				continue
+			}
+			host := strings.TrimSuffix(record.Target, ".")
+			if hasTarget(targets, host, record.Port) {
+				continue
+			}
+			if targets == nil {
+				ttl = record.Hdr.Ttl
+			}
+			target := ServiceTarget{
+				Host:      host,
+				Port:      record.Port,
+				Priority:  record.Priority,
+				Weight:    record.Weight,
+				ExpiresAt: received.Add(time.Duration(record.Hdr.Ttl) * time.Second).Unix(),
+			}
+			ip4, ip6 := packetAddress(msg, record.Target)
+			if ip4 == "" && ip6 == "" && localHost(host) && follow.allow(host, received) {
+				ip4, ip6 = resolveHostIP(server, host)
+			}
+			target.IP, target.IP6 = ip4, ip6
+			if ip4 == "" {
+				target.IP = ip6
+			}
+			targets = append(targets, target)
+		}
+	}
+	if len(targets) > 1 {
+		slices.SortFunc(targets, compareTargets)
+	}
+	return targets, ttl
+}
+
+func hasTarget(targets []ServiceTarget, host string, port uint16) bool {
+	for _, target := range targets {
+		if target.Host == host && target.Port == port {
+			return true
+		}
+	}
+	return false
+}
+
+// setTargets sets a service's targets, and its host, port and addresses to
+// those of the most preferred target that resolved. It reports false if
+// none did.
+func (service *MDNSService) setTargets(targets []ServiceTarget) bool {
+	for _, target := range targets {
+		if target.IP != "" {
+			service.Targets = targets
+			service.Host, service.Port = target.Host, target.Port
+			return service.setAddresses(target.IP, target.IP6)
+		}
+	}
+	return false
+}
+
+// mergeTargets adds the targets of a refresh to those known, replacing the
+// ones it announces again and dropping those that expired before now, in
+// Unix seconds. Replicas each announce their own target, so a refresh
+// rarely has them all.
+func mergeTargets(known, refreshed []ServiceTarget, now int64) []ServiceTarget {
+	var merged []ServiceTarget
+	for _, target := range known {
+		if target.ExpiresAt < now || hasTarget(refreshed, target.Host, target.Port) {
+			continue
+		}
+		if merged == nil {
+			merged = slices.Clone(refreshed)
+		}
+		merged = append(merged, target)
+	}
+	if merged == nil {
+		return refreshed
+	}
+	slices.SortFunc(merged, compareTargets)
+	return merged
+}
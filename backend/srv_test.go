@@ -0,0 +1,61 @@
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// replicaAnnouncement announces the instance "api._http._tcp.local." at the
+// SRV target of each of hosts, with its address in the packet.
+func replicaAnnouncement(hosts map[string]*dns.SRV) *dns.Msg {
+	msg := new(dns.Msg)
+	msg.Response = true
+	for host, srv := range hosts {
+		srv.Hdr = dns.RR_Header{Name: "api._http._tcp.local.", Rrtype: dns.TypeSRV, Class: dns.ClassINET, Ttl: 120}
+		srv.Target = host + ".local."
+		ip := net.IPv4(10, 0, 0, byte(len(msg.Extra)+10))
+		msg.Extra = append(msg.Extra, srv, &dns.A{Hdr: dns.RR_Header{Name: srv.Target, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 120}, A: ip})
+	}
+	return msg
+}
+
+// TestHandleMDNSPacketTargets verifies an instance with several SRV
+// targets is one service at the most preferred one, listing them all, and
+// replicas announcing their own target add to it
+func TestHandleMDNSPacketTargets(t *testing.T) {
+	server := NewMDNSServer()
+	now := time.Now()
+	handleMDNSPacket(server, replicaAnnouncement(map[string]*dns.SRV{
+		"backup":  {Priority: 20, Weight: 0, Port: 8080},
+		"primary": {Priority: 10, Weight: 5, Port: 8080},
+		"second":  {Priority: 10, Weight: 60, Port: 8081},
+	}), "en0", nil, now)
+
+	services := server.listServices(defaultSite)
+	if len(services) != 1 {
+		t.Fatalf("Expected one service for the instance, got %+v", services)
+	}
+	service := services[0]
+	if len(service.Targets) != 3 || service.Host != "second.local" || service.Port != 8081 || service.IP != service.Targets[0].IP {
+		t.Fatalf("Expected the service at the highest weight of the lowest priority, got %+v", service)
+	}
+	if service.Targets[1].Host != "primary.local" || service.Targets[2].Host != "backup.local" || service.Targets[2].Priority != 20 {
+		t.Fatalf("Expected the targets in order of preference, got %+v", service.Targets)
+	}
+
+	handleMDNSPacket(server, replicaAnnouncement(map[string]*dns.SRV{"replica": {Priority: 10, Weight: 10, Port: 8080}}), "en0", nil, now)
+	services = server.listServices(defaultSite)
+	if len(services) != 1 || len(services[0].Targets) != 4 || services[0].Targets[1].Host != "replica.local" || services[0].Host != "second.local" {
+		t.Fatalf("Expected the replica's target added to the known ones, got %+v", services)
+	}
+
+	// Once the others expire, the replica alone is left
+	handleMDNSPacket(server, replicaAnnouncement(map[string]*dns.SRV{"replica": {Priority: 10, Weight: 10, Port: 8080}}), "en0", nil, now.Add(5*time.Minute))
+	services = server.listServices(defaultSite)
+	if len(services[0].Targets) != 1 || services[0].Host != "replica.local" || services[0].Port != 8080 {
+		t.Fatalf("Expected the service to move to the replica, got %+v", services[0])
+	}
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// stableIDsBucket is the Store bucket stable device IDs are kept in.
+const stableIDsBucket = "stableids"
+
+// stableIDPrefix starts every stable ID, so they can't be mistaken for the
+// host names and addresses device IDs are.
+const stableIDPrefix = "dev_"
+
+// stableIDRecord is what a stable ID was assigned to.
+type stableIDRecord struct {
+	ID     string `json:"id"`
+	Site   string `json:"site"`
+	Device string `json:"device"` // the device ID, its host name or address
+	MAC    string `json:"mac,omitempty"`
+}
+
+// StableIDs assigns devices IDs that don't change when their address or
+// host name does, for tools that reference devices from configuration. A
+// device's stable ID is derived from its MAC address when one is known the
+// first time it is seen, and from its site and device ID otherwise. Once
+// assigned an ID is kept, so learning the MAC address later, or the device
+// getting another host name with the same MAC address, keeps it.
+type StableIDs struct {
+	mu       sync.RWMutex
+	store    Store
+	ids      map[string]*stableIDRecord // by stable ID
+	byDevice map[string]string          // site/device ID to stable ID
+	byMAC    map[string]string
+}
+
+// NewStableIDs loads the assigned stable IDs from store.
+func NewStableIDs(store Store) (*StableIDs, error) {
+	s := &StableIDs{store: store, ids: make(map[string]*stableIDRecord), byDevice: make(map[string]string), byMAC: make(map[string]string)}
+	entries, err := store.Load(stableIDsBucket)
+	if err != nil {
+		return nil, err
+	}
+	for key, data := range entries {
+		record := &stableIDRecord{}
+		if err := json.Unmarshal(data, record); err != nil {
+			return nil, fmt.Errorf("stable ID %s: %v", key, err)
+		}
+		s.index(record)
+	}
+	return s, nil
+}
+
+// index must be called with s.mu held for writing, or before s is shared.
+func (s *StableIDs) index(record *stableIDRecord) {
+	s.ids[record.ID] = record
+	s.byDevice[siteKey(record.Site, strings.ToLower(record.Device))] = record.ID
+	if record.MAC != "" {
+		s.byMAC[record.MAC] = record.ID
+	}
+}
+
+// stableID derives a stable ID from a MAC address or, without one, a site
+// and device ID: the first 16 hex digits of the SHA-256 of "mac:<mac>" or
+// "name:<site>/<device ID>", lower case.
+func stableID(site, device, mac string) string {
+	key := "name:" + site + "/" + strings.ToLower(device)
+	if mac != "" {
+		key = "mac:" + strings.ToLower(mac)
+	}
+	sum := sha256.Sum256([]byte(key))
+	return stableIDPrefix + hex.EncodeToString(sum[:8])
+}
+
+// Assign returns the stable ID of a device, assigning one the first time.
+// It returns "" on a nil StableIDs.
+func (s *StableIDs) Assign(site, device, mac string) string {
+	if s == nil {
+		return ""
+	}
+	deviceKey := siteKey(site, strings.ToLower(device))
+	s.mu.RLock()
+	id, known := s.byDevice[deviceKey]
+	bound := known && s.ids[id].MAC != ""
+	s.mu.RUnlock()
+	if known && (mac == "" || bound) {
+		return id
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var record *stableIDRecord
+	id, known = s.byDevice[deviceKey]
+	switch {
+	case known:
+		// The MAC address is learned after the ID was assigned. A device
+		// whose MAC address changes, e.g. a randomized one, keeps its ID.
+		existing := s.ids[id]
+		if existing.MAC != "" || mac == "" || s.byMAC[mac] != "" {
+			return id
+		}
+		record = &stableIDRecord{ID: id, Site: existing.Site, Device: existing.Device, MAC: mac}
+	case mac != "" && s.byMAC[mac] != "":
+		// The device is known under another host name
+		id = s.byMAC[mac]
+		record = &stableIDRecord{ID: id, Site: site, Device: device, MAC: mac}
+	default:
+		id = stableID(site, device, mac)
+		record = &stableIDRecord{ID: id, Site: site, Device: device, MAC: mac}
+	}
+
+	data, err := json.Marshal(record)
+	if err == nil {
+		err = s.store.Put(stableIDsBucket, map[string][]byte{id: data})
+	}
+	if err != nil {
+		log.Printf("⚠️  Saving stable ID of %s: %v", device, err)
+	}
+	s.index(record)
+	return id
+}
+
+// Lookup returns what a stable ID was assigned to, or nil.
+func (s *StableIDs) Lookup(id string) *stableIDRecord {
+	if s == nil {
+		return nil
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if record, ok := s.ids[strings.ToLower(id)]; ok {
+		c := *record
+		return &c
+	}
+	return nil
+}
+
+// StableDevice is a device found by /api/v1/lookup.
+type StableDevice struct {
+	StableID   string `json:"stableId"`
+	APIVersion string `json:"apiVersion"`
+	Site       string `json:"site"`
+	ID         string `json:"id"`
+	MAC        string `json:"mac,omitempty"`
+	// Present is whether the device currently advertises services, and
+	// Device its current state while it is known
+	Present bool           `json:"present"`
+	Device  *DeviceSummary `json:"device,omitempty"`
+}
+
+// Lookup handles GET /api/v1/lookup/{key}: the device with the stable ID,
+// device ID, address or MAC address key, by its stable ID. Only served
+// under /api/v1, so scripts and infrastructure-as-code referencing it keep
+// getting the same shape.
+func (s *MDNSServer) Lookup(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	key := r.PathValue("key")
+	site := s.deviceSite(r)
+	var found *StableDevice
+	if record := s.stableIDs.Lookup(key); record != nil {
+		found = &StableDevice{StableID: record.ID, Site: record.Site, ID: record.Device, MAC: record.MAC}
+		site = record.Site
+		key = record.Device
+	}
+	if mac, err := net.ParseMAC(key); err == nil && found == nil {
+		key = mac.String()
+	}
+	if device := s.findDevice(site, key); device != nil {
+		found = &StableDevice{StableID: device.StableID, Site: device.Site, ID: device.ID, MAC: device.MAC, Present: len(device.Services) > 0, Device: device}
+	}
+	if found == nil || found.StableID == "" {
+		writeError(w, http.StatusNotFound, "no device "+r.PathValue("key"))
+		return
+	}
+	found.APIVersion = apiVersion
+	writeJSON(w, http.StatusOK, found)
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestStableIDs verifies stable IDs survive learning the MAC address, host
+// name changes and restarts
+func TestStableIDs(t *testing.T) {
+	store := openTestStore(t, "json", t.TempDir())
+	ids, err := NewStableIDs(store)
+	if err != nil {
+		t.Fatalf("Failed to load stable IDs: %v", err)
+	}
+
+	nas := ids.Assign(defaultSite, "nas.local", "")
+	if nas != stableID(defaultSite, "nas.local", "") || !strings.HasPrefix(nas, stableIDPrefix) || len(nas) != len(stableIDPrefix)+16 {
+		t.Fatalf("Expected the name-derived ID, got %q", nas)
+	}
+	if got := ids.Assign(defaultSite, "NAS.local", "00:11:32:aa:bb:cc"); got != nas {
+		t.Fatalf("Expected the ID kept once the MAC is known, got %q", got)
+	}
+	if got := ids.Assign(defaultSite, "diskstation.local", "00:11:32:aa:bb:cc"); got != nas {
+		t.Fatalf("Expected the ID kept across a host name change, got %q", got)
+	}
+	printer := ids.Assign(defaultSite, "printer.local", "00:1b:21:01:02:03")
+	if printer != stableID("", "", "00:1b:21:01:02:03") {
+		t.Fatalf("Expected the MAC-derived ID, got %q", printer)
+	}
+	if got := ids.Assign("office", "printer.local", ""); got == printer {
+		t.Fatalf("Expected devices of other sites to get their own IDs")
+	}
+
+	reloaded, err := NewStableIDs(store)
+	if err != nil {
+		t.Fatalf("Failed to reload stable IDs: %v", err)
+	}
+	if got := reloaded.Assign(defaultSite, "diskstation.local", ""); got != nas {
+		t.Fatalf("Expected the ID kept across restarts, got %q", got)
+	}
+	if record := reloaded.Lookup(printer); record == nil || record.Device != "printer.local" || record.MAC != "00:1b:21:01:02:03" {
+		t.Fatalf("Expected the printer's record, got %+v", record)
+	}
+
+	var none *StableIDs
+	if none.Assign(defaultSite, "nas.local", "") != "" || none.Lookup(nas) != nil {
+		t.Fatalf("Expected a nil StableIDs to assign nothing")
+	}
+}
+
+// TestLookupHandler verifies devices are found by stable ID and device ID,
+// also after they go offline
+func TestLookupHandler(t *testing.T) {
+	server := NewMDNSServer()
+	store := openTestStore(t, "json", t.TempDir())
+	server.metadata, _ = NewMetadataStore(store)
+	server.stableIDs, _ = NewStableIDs(store)
+	printer := &MDNSService{Name: "Printer", Type: "_ipp._tcp.local.", Host: "printer.local.", IP: "192.168.1.30", Port: 631, Site: defaultSite, Timestamp: time.Now().Unix()}
+	server.addService("a", printer)
+
+	lookup := func(key string) (int, StableDevice) {
+		req := httptest.NewRequest(http.MethodGet, "/api/v1/lookup/"+key, nil)
+		req.SetPathValue("key", key)
+		rec := httptest.NewRecorder()
+		server.Lookup(rec, req)
+		var device StableDevice
+		json.NewDecoder(rec.Body).Decode(&device)
+		return rec.Code, device
+	}
+
+	code, byName := lookup("printer.local")
+	if code != http.StatusOK || byName.StableID == "" || !byName.Present || byName.APIVersion != apiVersion || byName.Device.StableID != byName.StableID {
+		t.Fatalf("Expected the printer by device ID, got %d %+v", code, byName)
+	}
+	if code, byID := lookup(byName.StableID); code != http.StatusOK || byID.ID != "printer.local" {
+		t.Fatalf("Expected the printer by stable ID, got %d %+v", code, byID)
+	}
+
+	server.removeService("a", printer)
+	if code, offline := lookup(byName.StableID); code != http.StatusOK || offline.Present || offline.ID != "printer.local" {
+		t.Fatalf("Expected the offline printer by stable ID, got %d %+v", code, offline)
+	}
+	if code, _ := lookup("tv.local"); code != http.StatusNotFound {
+		t.Fatalf("Expected 404 for an unknown device, got %d", code)
+	}
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// formatInterval renders a discovery interval, where 0 means the activity is
+// switched off.
+func formatInterval(d time.Duration) string {
+	if d <= 0 {
+		return "off"
+	}
+	return d.String()
+}
+
+// Status handles GET /api/status, the server's operating state: the
+// discovery interface and site, connected clients, the current discovery
+// mode with its intervals, the health of the multicast listener, the
+// background workers and the privileged helper, and the server's clock and
+// timezone.
+func (s *MDNSServer) Status(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	s.mu.RLock()
+	iface := s.currentIface
+	clients := len(s.clients)
+	s.mu.RUnlock()
+
+	mode, since := s.intensity.Mode()
+	query, browse := s.intensity.Intervals()
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"interface": iface,
+		"site":      s.site,
+		"clients":   clients,
+		"discovery": map[string]interface{}{
+			"mode":           mode,
+			"since":          since.Unix(),
+			"queryInterval":  formatInterval(query),
+			"browseInterval": formatInterval(browse),
+			"idleAfter":      s.intensity.config.IdleAfter.String(),
+		},
+		"listener":     s.listener.Status(),
+		"listener6":    s.listener6.Status(),
+		"workers":      s.workers.Status(),
+		"helper":       s.helper.Status(),
+		"self":         s.self.Status(),
+		"nsec":         s.negative.Status(),
+		"lookups":      s.lookups.Status(),
+		"scanScope":    scanScope.Status(),
+		"reachability": s.reachability.Status(),
+		"clock":        serverClock(time.Now()),
+	})
+}
+
+// serverClock describes the server's clock and timezone, so clients can
+// render its timestamps and notice when its clock differs from theirs.
+func serverClock(now time.Time) map[string]interface{} {
+	zone, offset := now.Zone()
+	return map[string]interface{}{
+		"time":          now.Format(time.RFC3339Nano),
+		"unixMs":        now.UnixMilli(),
+		"timezone":      timezoneName(),
+		"zone":          zone,
+		"offsetSeconds": offset,
+	}
+}
+
+// timezoneName returns the IANA name of the local timezone, e.g.
+// "Europe/Berlin", from $TZ or the /etc/localtime link, or the name Go
+// knows it by.
+func timezoneName() string {
+	if tz := strings.TrimPrefix(os.Getenv("TZ"), ":"); tz != "" {
+		return tz
+	}
+	if target, err := os.Readlink("/etc/localtime"); err == nil {
+		if _, name, ok := strings.Cut(target, "zoneinfo/"); ok {
+			return name
+		}
+	}
+	return time.Local.String()
+}
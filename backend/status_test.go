@@ -0,0 +1,22 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// TestServerClock verifies /api/status describes the clock with its UTC
+// offset.
+func TestServerClock(t *testing.T) {
+	now := time.Date(2024, 3, 1, 12, 0, 0, 0, time.FixedZone("CET", 3600))
+	clock := serverClock(now)
+	if clock["time"] != "2024-03-01T12:00:00+01:00" || clock["offsetSeconds"] != 3600 || clock["zone"] != "CET" {
+		t.Fatalf("Expected the time with its +01:00 offset, got %v", clock)
+	}
+	if clock["unixMs"] != now.UnixMilli() {
+		t.Fatalf("Expected unixMs %d, got %v", now.UnixMilli(), clock["unixMs"])
+	}
+	if clock["timezone"] == "" {
+		t.Fatalf("Expected a timezone name")
+	}
+}
@@ -0,0 +1,301 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// Store is a persistent key/value store partitioned into named buckets.
+// Values are JSON documents; every persisted subsystem keeps its records in
+// its own bucket so backends can be swapped without touching the callers.
+type Store interface {
+	// Load returns every key/value pair in bucket.
+	Load(bucket string) (map[string][]byte, error)
+	// Put writes all entries to bucket in a single transaction.
+	Put(bucket string, entries map[string][]byte) error
+	// Delete removes keys from bucket.
+	Delete(bucket string, keys ...string) error
+	// Buckets lists the buckets that hold data.
+	Buckets() ([]string, error)
+	// Size returns the number of bytes the store occupies on disk.
+	Size() int64
+	Close() error
+}
+
+// openStore opens the storage backend of the given kind in dir. Supported
+// kinds are "json" (one file per bucket) and "bolt" (a single bbolt file).
+func openStore(kind, dir string) (Store, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+
+	switch kind {
+	case "json":
+		return &jsonStore{dir: dir, buckets: make(map[string]map[string]json.RawMessage)}, nil
+	case "bolt":
+		db, err := bolt.Open(filepath.Join(dir, "network-view.db"), 0o600, &bolt.Options{Timeout: time.Second})
+		if err != nil {
+			return nil, err
+		}
+		return &boltStore{db: db}, nil
+	default:
+		return nil, fmt.Errorf("unknown store backend %q (expected json or bolt)", kind)
+	}
+}
+
+// migrateStore copies every bucket from src into dst and returns the number
+// of records copied.
+func migrateStore(src, dst Store) (int, error) {
+	buckets, err := src.Buckets()
+	if err != nil {
+		return 0, err
+	}
+
+	copied := 0
+	for _, bucket := range buckets {
+		entries, err := src.Load(bucket)
+		if err != nil {
+			return copied, fmt.Errorf("load %s: %v", bucket, err)
+		}
+		if err := dst.Put(bucket, entries); err != nil {
+			return copied, fmt.Errorf("write %s: %v", bucket, err)
+		}
+		copied += len(entries)
+	}
+	return copied, nil
+}
+
+// jsonStore keeps each bucket as a JSON object in <dir>/<bucket>.json. The
+// whole bucket is rewritten on every change, which is fine for the small
+// inventories of a home or office network.
+type jsonStore struct {
+	mu      sync.Mutex
+	dir     string
+	buckets map[string]map[string]json.RawMessage
+}
+
+// bucketNamePattern is what bucket names are made of. They name the json
+// store's files, and come back from backup files, so they must not reach
+// out of the data directory.
+var bucketNamePattern = regexp.MustCompile(`^[a-z0-9_-]+$`)
+
+// checkBucketName returns an error for a name that isn't a bucket's.
+func checkBucketName(name string) error {
+	if !bucketNamePattern.MatchString(name) {
+		return fmt.Errorf("invalid bucket name %q", name)
+	}
+	return nil
+}
+
+func (s *jsonStore) path(bucket string) string {
+	return filepath.Join(s.dir, bucket+".json")
+}
+
+// bucket returns the cached contents of a bucket, reading it from disk on
+// first use. The caller must hold s.mu.
+func (s *jsonStore) bucket(name string) (map[string]json.RawMessage, error) {
+	if b, ok := s.buckets[name]; ok {
+		return b, nil
+	}
+	if err := checkBucketName(name); err != nil {
+		return nil, err
+	}
+
+	b := make(map[string]json.RawMessage)
+	data, err := os.ReadFile(s.path(name))
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	if err == nil {
+		if err := json.Unmarshal(data, &b); err != nil {
+			return nil, fmt.Errorf("%s: %v", s.path(name), err)
+		}
+	}
+	s.buckets[name] = b
+	return b, nil
+}
+
+// flush writes a bucket to disk. The caller must hold s.mu.
+func (s *jsonStore) flush(name string, b map[string]json.RawMessage) error {
+	data, err := json.MarshalIndent(b, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	// Write to a temporary file first so a crash never leaves a truncated file
+	tmp := s.path(name) + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.path(name))
+}
+
+func (s *jsonStore) Load(bucket string) (map[string][]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	b, err := s.bucket(bucket)
+	if err != nil {
+		return nil, err
+	}
+	entries := make(map[string][]byte, len(b))
+	for k, v := range b {
+		entries[k] = append([]byte(nil), v...)
+	}
+	return entries, nil
+}
+
+func (s *jsonStore) Put(bucket string, entries map[string][]byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	b, err := s.bucket(bucket)
+	if err != nil {
+		return err
+	}
+	// Change a copy, and keep it only once it is on disk, so a rejected or
+	// failed write leaves the bucket as the file has it
+	updated := maps.Clone(b)
+	for k, v := range entries {
+		if !json.Valid(v) {
+			return fmt.Errorf("%s/%s: value is not valid JSON", bucket, k)
+		}
+		updated[k] = append(json.RawMessage(nil), v...)
+	}
+	if err := s.flush(bucket, updated); err != nil {
+		return err
+	}
+	s.buckets[bucket] = updated
+	return nil
+}
+
+func (s *jsonStore) Delete(bucket string, keys ...string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	b, err := s.bucket(bucket)
+	if err != nil {
+		return err
+	}
+	updated := maps.Clone(b)
+	for _, k := range keys {
+		delete(updated, k)
+	}
+	if err := s.flush(bucket, updated); err != nil {
+		return err
+	}
+	s.buckets[bucket] = updated
+	return nil
+}
+
+func (s *jsonStore) Buckets() ([]string, error) {
+	matches, err := filepath.Glob(filepath.Join(s.dir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	buckets := make([]string, 0, len(matches))
+	for _, m := range matches {
+		buckets = append(buckets, strings.TrimSuffix(filepath.Base(m), ".json"))
+	}
+	sort.Strings(buckets)
+	return buckets, nil
+}
+
+func (s *jsonStore) Size() int64 {
+	buckets, _ := s.Buckets()
+	var size int64
+	for _, b := range buckets {
+		if info, err := os.Stat(s.path(b)); err == nil {
+			size += info.Size()
+		}
+	}
+	return size
+}
+
+func (s *jsonStore) Close() error {
+	return nil
+}
+
+// boltStore keeps all buckets in a single bbolt database, a pure-Go
+// embedded KV store that needs no CGO.
+type boltStore struct {
+	db *bolt.DB
+}
+
+func (s *boltStore) Load(bucket string) (map[string][]byte, error) {
+	entries := make(map[string][]byte)
+	err := s.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(bucket))
+		if b == nil {
+			return nil
+		}
+		return b.ForEach(func(k, v []byte) error {
+			entries[string(k)] = append([]byte(nil), v...)
+			return nil
+		})
+	})
+	return entries, err
+}
+
+func (s *boltStore) Put(bucket string, entries map[string][]byte) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists([]byte(bucket))
+		if err != nil {
+			return err
+		}
+		for k, v := range entries {
+			if err := b.Put([]byte(k), v); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (s *boltStore) Delete(bucket string, keys ...string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(bucket))
+		if b == nil {
+			return nil
+		}
+		for _, k := range keys {
+			if err := b.Delete([]byte(k)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (s *boltStore) Buckets() ([]string, error) {
+	var buckets []string
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return tx.ForEach(func(name []byte, _ *bolt.Bucket) error {
+			buckets = append(buckets, string(name))
+			return nil
+		})
+	})
+	return buckets, err
+}
+
+func (s *boltStore) Size() int64 {
+	if info, err := os.Stat(s.db.Path()); err == nil {
+		return info.Size()
+	}
+	return 0
+}
+
+func (s *boltStore) Close() error {
+	return s.db.Close()
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// openTestStore opens a store backend in dir and closes it when the test ends
+func openTestStore(t *testing.T, kind, dir string) Store {
+	t.Helper()
+	store, err := openStore(kind, dir)
+	if err != nil {
+		t.Fatalf("Failed to open %s store: %v", kind, err)
+	}
+	t.Cleanup(func() { store.Close() })
+	return store
+}
+
+// TestStoreBackends exercises put, load and delete on every backend
+func TestStoreBackends(t *testing.T) {
+	for _, kind := range []string{"json", "bolt"} {
+		t.Run(kind, func(t *testing.T) {
+			store := openTestStore(t, kind, t.TempDir())
+
+			err := store.Put("devices", map[string][]byte{
+				"nas.local":    []byte(`{"id":"nas.local"}`),
+				"camera.local": []byte(`{"id":"camera.local"}`),
+			})
+			if err != nil {
+				t.Fatalf("Put failed: %v", err)
+			}
+			if err := store.Delete("devices", "camera.local"); err != nil {
+				t.Fatalf("Delete failed: %v", err)
+			}
+
+			entries, err := store.Load("devices")
+			if err != nil {
+				t.Fatalf("Load failed: %v", err)
+			}
+			if len(entries) != 1 || string(entries["nas.local"]) != `{"id":"nas.local"}` {
+				t.Fatalf("Unexpected entries after delete: %v", entries)
+			}
+
+			buckets, _ := store.Buckets()
+			if len(buckets) != 1 || buckets[0] != "devices" {
+				t.Fatalf("Expected a single devices bucket, got %v", buckets)
+			}
+		})
+	}
+}
+
+// TestJSONStoreFailedPut verifies a rejected or failed write leaves the
+// cached bucket as it was on disk
+func TestJSONStoreFailedPut(t *testing.T) {
+	dir := t.TempDir()
+	store := openTestStore(t, "json", dir)
+	if err := store.Put("devices", map[string][]byte{"nas.local": []byte(`{"id":"nas.local"}`)}); err != nil {
+		t.Fatalf("Put failed: %v", err)
+	}
+
+	err := store.Put("devices", map[string][]byte{"tv.local": []byte(`{}`), "camera.local": []byte(`{`)})
+	if err == nil {
+		t.Fatalf("Expected invalid JSON to be rejected")
+	}
+	// A directory in the way of the temporary file fails the write
+	if err := os.Mkdir(filepath.Join(dir, "devices.json.tmp"), 0o700); err != nil {
+		t.Fatalf("Failed to block the write: %v", err)
+	}
+	if err := store.Put("devices", map[string][]byte{"tv.local": []byte(`{}`)}); err == nil {
+		t.Fatalf("Expected the write to fail")
+	}
+	if err := store.Delete("devices", "nas.local"); err == nil {
+		t.Fatalf("Expected the delete to fail")
+	}
+
+	entries, _ := store.Load("devices")
+	if len(entries) != 1 || string(entries["nas.local"]) != `{"id":"nas.local"}` {
+		t.Fatalf("Expected only the stored entry, got %v", entries)
+	}
+}
+
+// TestMigrateStore verifies all buckets are copied between backends
+func TestMigrateStore(t *testing.T) {
+	dir := t.TempDir()
+	src := openTestStore(t, "json", dir)
+	dst := openTestStore(t, "bolt", dir)
+
+	src.Put("devices", map[string][]byte{"nas.local": []byte(`{"id":"nas.local","owner":"alex"}`)})
+	src.Put("availability", map[string][]byte{"nas.local": []byte(`[{"start":1,"end":2}]`)})
+
+	n, err := migrateStore(src, dst)
+	if err != nil {
+		t.Fatalf("Migration failed: %v", err)
+	}
+	if n != 2 {
+		t.Fatalf("Expected 2 records migrated, got %d", n)
+	}
+
+	metadata, err := NewMetadataStore(dst)
+	if err != nil {
+		t.Fatalf("Failed to load migrated metadata: %v", err)
+	}
+	if meta := metadata.Get(defaultSite, "nas.local"); meta == nil || meta.Owner != "alex" {
+		t.Fatalf("Expected migrated owner, got %+v", meta)
+	}
+}
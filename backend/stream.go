@@ -0,0 +1,109 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"sort"
+)
+
+// jsonStream writes a large JSON response as it is produced, one element
+// at a time, instead of marshaling it into memory first. net/http sends
+// it chunked, as it has no Content-Length. Errors can only end the
+// response early, once it has started; they are kept in err.
+type jsonStream struct {
+	w     io.Writer
+	enc   *json.Encoder
+	comma bool // whether the next element needs one
+	err   error
+}
+
+// newJSONStream starts a JSON response with the given status code.
+func newJSONStream(w http.ResponseWriter, status int) *jsonStream {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	return &jsonStream{w: w, enc: json.NewEncoder(w)}
+}
+
+// raw writes literal JSON, such as `{"rows":[` around elements, and starts
+// a new list of elements.
+func (s *jsonStream) raw(text string) {
+	if s.err == nil {
+		_, s.err = io.WriteString(s.w, text)
+	}
+	s.comma = false
+}
+
+// element writes the next element of a list.
+func (s *jsonStream) element(v interface{}) {
+	if s.err != nil {
+		return
+	}
+	if s.comma {
+		if _, s.err = io.WriteString(s.w, ","); s.err != nil {
+			return
+		}
+	}
+	s.err = s.enc.Encode(v)
+	s.comma = true
+}
+
+// value writes a single value, e.g. after a key.
+func (s *jsonStream) value(v interface{}) {
+	if s.err == nil {
+		s.err = s.enc.Encode(v)
+	}
+}
+
+// writeJSONList writes {"<key>": [...]} with the n elements item returns,
+// followed by fields, compacted like writeJSONFor if r asks for
+// ?compact=1. Like writeJSON, it stops at the first error, which is usually
+// the client going away.
+func writeJSONList(w http.ResponseWriter, r *http.Request, key string, n int, item func(i int) interface{}, fields map[string]interface{}) {
+	compact := wantsCompact(r)
+	s := newJSONStream(w, http.StatusOK)
+	s.raw("{")
+	comma := ""
+	// Compact responses leave empty lists out
+	if !compact || n > 0 {
+		if short, ok := compactKeys[key]; ok && compact {
+			key = short
+		}
+		name, _ := json.Marshal(key)
+		s.raw(string(name) + ":[")
+		for i := 0; i < n && s.err == nil; i++ {
+			v := item(i)
+			if compact {
+				data, err := compactJSON(v)
+				if err != nil {
+					return
+				}
+				v = json.RawMessage(data)
+			}
+			s.element(v)
+		}
+		s.raw("]")
+		comma = ","
+	}
+	names := make([]string, 0, len(fields))
+	for name := range fields {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		// Each field on its own is an object to take the members from
+		field := map[string]interface{}{name: fields[name]}
+		data, err := json.Marshal(field)
+		if compact {
+			data, err = compactJSON(field)
+		}
+		if err != nil {
+			return
+		}
+		if members := data[1 : len(data)-1]; len(members) > 0 {
+			s.raw(comma + string(members))
+			comma = ","
+		}
+	}
+	s.raw("}\n")
+}
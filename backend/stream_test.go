@@ -0,0 +1,50 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+// TestWriteJSONList verifies streamed lists decode like marshaled ones, and
+// are compacted like writeJSONFor
+func TestWriteJSONList(t *testing.T) {
+	services := []MDNSService{{Name: "NAS", Port: 445}, {Name: "TV", Port: 8009}}
+	item := func(i int) interface{} { return services[i] }
+
+	rec := httptest.NewRecorder()
+	writeJSONList(rec, httptest.NewRequest(http.MethodGet, "/api/devices", nil), "devices", len(services), item, nil)
+	var body struct {
+		Devices []MDNSService `json:"devices"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil || len(body.Devices) != 2 || body.Devices[1].Name != "TV" {
+		t.Fatalf("Expected both services, got %v %s", err, rec.Body)
+	}
+	if rec.Header().Get("Content-Type") != "application/json" {
+		t.Fatalf("Expected a JSON response, got %q", rec.Header().Get("Content-Type"))
+	}
+
+	rec = httptest.NewRecorder()
+	writeJSONList(rec, httptest.NewRequest(http.MethodGet, "/api/devices?compact=1", nil), "devices", len(services), item, nil)
+	want, _ := compactJSON(map[string]interface{}{"devices": services})
+	var got, expected interface{}
+	json.Unmarshal(rec.Body.Bytes(), &got)
+	json.Unmarshal(want, &expected)
+	if !reflect.DeepEqual(got, expected) {
+		t.Fatalf("Expected %s, got %s", want, rec.Body)
+	}
+
+	rec = httptest.NewRecorder()
+	writeJSONList(rec, httptest.NewRequest(http.MethodGet, "/api/devices?compact=1", nil), "devices", 0, item, nil)
+	if rec.Body.String() != "{}\n" {
+		t.Fatalf("Expected an empty compact list to be left out, got %q", rec.Body)
+	}
+
+	rec = httptest.NewRecorder()
+	writeJSONList(rec, httptest.NewRequest(http.MethodGet, "/api/devices", nil), "devices", 0, item, map[string]interface{}{"seq": 42})
+	if rec.Body.String() != `{"devices":[],"seq":42}`+"\n" {
+		t.Fatalf("Expected the seq after the list, got %q", rec.Body)
+	}
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// summaryNewWithin is how recently a device must have been first discovered
+// to count as new on /api/summary.
+const summaryNewWithin = 24 * time.Hour
+
+// ServiceTypeCount is how many services of a type were discovered, on how
+// many devices.
+type ServiceTypeCount struct {
+	Type     string `json:"type"`
+	Services int    `json:"services"`
+	Devices  int    `json:"devices"`
+}
+
+// Summary is the dashboard's overview of a site's devices.
+type Summary struct {
+	Site    string `json:"site,omitempty"` // empty for every site
+	Devices int    `json:"devices"`
+	// Online devices have current services; offline ones are known only
+	// from their stored metadata
+	Online  int `json:"online"`
+	Offline int `json:"offline"`
+	// New devices were first discovered within the last 24 hours
+	New             int                `json:"new"`
+	ByCategory      map[string]int     `json:"byCategory"`
+	ByVendor        map[string]int     `json:"byVendor"`
+	TopServiceTypes []ServiceTypeCount `json:"topServiceTypes"`
+	GeneratedAt     int64              `json:"generatedAt"`
+}
+
+// summarize counts devices by state, category and vendor, and service types
+// by how many services they have, keeping the top ones.
+func summarize(site string, devices []*DeviceSummary, now time.Time, top int) Summary {
+	summary := Summary{
+		Site:            site,
+		Devices:         len(devices),
+		ByCategory:      make(map[string]int),
+		ByVendor:        make(map[string]int),
+		TopServiceTypes: []ServiceTypeCount{},
+		GeneratedAt:     now.Unix(),
+	}
+	types := make(map[string]*ServiceTypeCount)
+	for _, device := range devices {
+		if len(device.Services) > 0 {
+			summary.Online++
+		} else {
+			summary.Offline++
+		}
+		summary.ByCategory[device.Category]++
+		vendor := device.Vendor
+		if vendor == "" {
+			vendor = "unknown"
+		}
+		summary.ByVendor[vendor]++
+
+		var firstSeen int64
+		seen := make(map[string]bool)
+		for _, service := range device.Services {
+			if firstSeen == 0 || (service.Timestamp != 0 && service.Timestamp < firstSeen) {
+				firstSeen = service.Timestamp
+			}
+			t := strings.TrimSuffix(service.Type, ".local.")
+			count := types[t]
+			if count == nil {
+				count = &ServiceTypeCount{Type: t}
+				types[t] = count
+			}
+			count.Services++
+			if !seen[t] {
+				seen[t] = true
+				count.Devices++
+			}
+		}
+		if firstSeen != 0 && now.Sub(time.Unix(firstSeen, 0)) < summaryNewWithin {
+			summary.New++
+		}
+	}
+
+	for _, count := range types {
+		summary.TopServiceTypes = append(summary.TopServiceTypes, *count)
+	}
+	sort.Slice(summary.TopServiceTypes, func(i, j int) bool {
+		a, b := summary.TopServiceTypes[i], summary.TopServiceTypes[j]
+		if a.Services != b.Services {
+			return a.Services > b.Services
+		}
+		return a.Type < b.Type
+	})
+	if len(summary.TopServiceTypes) > top {
+		summary.TopServiceTypes = summary.TopServiceTypes[:top]
+	}
+	return summary
+}
+
+// Summary handles GET /api/summary: device counts by state, category and
+// vendor, the devices new in the last 24 hours and the ?top= (default 10)
+// service types of the site selected by ?site=, so the dashboard's home
+// screen needs one request.
+func (s *MDNSServer) Summary(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	top := 10
+	if v := r.URL.Query().Get("top"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			writeError(w, http.StatusBadRequest, "invalid top")
+			return
+		}
+		top = n
+	}
+
+	site := s.siteParam(r)
+	devices := s.summarizeDevices(s.listDevices(site, ""), site)
+	writeJSONFor(w, r, http.StatusOK, summarize(site, devices, time.Now(), top))
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// TestSummarize verifies devices are counted by state, category and vendor,
+// and service types ranked
+func TestSummarize(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	old := now.Add(-48 * time.Hour).Unix()
+	devices := []*DeviceSummary{
+		{DeviceMetadata: &DeviceMetadata{ID: "printer"}, Category: "printer", Vendor: "Acme", Services: []MDNSService{
+			{Type: "_ipp._tcp.local.", Timestamp: old}, {Type: "_http._tcp.local.", Timestamp: old},
+		}},
+		{DeviceMetadata: &DeviceMetadata{ID: "nas"}, Category: "storage", Services: []MDNSService{
+			{Type: "_http._tcp.local.", Timestamp: now.Add(-time.Hour).Unix()}, {Type: "_http._tcp.local.", Timestamp: old},
+		}},
+		{DeviceMetadata: &DeviceMetadata{ID: "phone"}, Category: "phone", Vendor: randomVendor, Services: []MDNSService{
+			{Type: "_apple-mobdev2._tcp.local.", Timestamp: now.Add(-time.Hour).Unix()},
+		}},
+		{DeviceMetadata: &DeviceMetadata{ID: "annotated"}, Category: "other"},
+	}
+
+	summary := summarize(defaultSite, devices, now, 2)
+	if summary.Devices != 4 || summary.Online != 3 || summary.Offline != 1 {
+		t.Fatalf("Expected 3 of 4 devices online, got %+v", summary)
+	}
+	if summary.New != 1 {
+		t.Fatalf("Expected only the phone to be new, got %d", summary.New)
+	}
+	if summary.ByCategory["printer"] != 1 || summary.ByCategory["other"] != 1 {
+		t.Fatalf("Expected counts by category, got %v", summary.ByCategory)
+	}
+	if summary.ByVendor["Acme"] != 1 || summary.ByVendor[randomVendor] != 1 || summary.ByVendor["unknown"] != 2 {
+		t.Fatalf("Expected counts by vendor, got %v", summary.ByVendor)
+	}
+	if len(summary.TopServiceTypes) != 2 {
+		t.Fatalf("Expected the top 2 service types, got %+v", summary.TopServiceTypes)
+	}
+	if http := summary.TopServiceTypes[0]; http.Type != "_http._tcp" || http.Services != 3 || http.Devices != 2 {
+		t.Fatalf("Expected _http._tcp first with 3 services on 2 devices, got %+v", http)
+	}
+	if second := summary.TopServiceTypes[1]; second.Type != "_apple-mobdev2._tcp" {
+		t.Fatalf("Expected ties broken by type, got %+v", second)
+	}
+}
+
+// TestSummaryHandler verifies /api/summary over the discovered services
+func TestSummaryHandler(t *testing.T) {
+	server := NewMDNSServer()
+	server.metadata, _ = NewMetadataStore(openTestStore(t, "json", t.TempDir()))
+	server.addService("a", &MDNSService{Name: "Printer", Type: "_ipp._tcp.local.", IP: "192.168.1.30", Port: 631, Timestamp: time.Now().Unix()})
+
+	rec := httptest.NewRecorder()
+	server.Summary(rec, httptest.NewRequest(http.MethodGet, "/api/summary", nil))
+	var summary Summary
+	if err := json.NewDecoder(rec.Body).Decode(&summary); err != nil {
+		t.Fatalf("Expected a JSON response, got %v", err)
+	}
+	if summary.Devices != 1 || summary.Online != 1 || summary.New != 1 || summary.ByCategory["printer"] != 1 {
+		t.Fatalf("Expected the new printer, got %+v", summary)
+	}
+
+	rec = httptest.NewRecorder()
+	server.Summary(rec, httptest.NewRequest(http.MethodGet, "/api/summary?top=x", nil))
+	if rec.Code != http.StatusBadRequest {
+		t.Fatalf("Expected 400 for an invalid top, got %d", rec.Code)
+	}
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"runtime/debug"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Worker states.
+const (
+	workerRunning    = "running"
+	workerRestarting = "restarting" // failed, waiting for its backoff
+)
+
+// Restart backoff: doubled after each failure up to maxWorkerBackoff, and
+// reset once a worker has run for longer than that.
+const (
+	workerBackoff    = time.Second
+	maxWorkerBackoff = time.Minute
+)
+
+// errWorkerReturned is the failure of a worker that returned. Workers run
+// until the process exits, so returning at all is a failure.
+var errWorkerReturned = errors.New("worker returned")
+
+// Supervisor runs the long-lived background goroutines and restarts any that
+// panics or returns, so a failing worker doesn't silently stop discovery.
+type Supervisor struct {
+	mu      sync.Mutex
+	workers map[string]*worker
+	// backoff is the wait before the first restart, workerBackoff by default
+	backoff time.Duration
+	// onFailure is called after a worker failed, before it is restarted
+	onFailure func(name string, err error)
+}
+
+type worker struct {
+	state       string
+	started     time.Time
+	restarts    int
+	lastError   string
+	lastFailure time.Time
+}
+
+// WorkerStatus is a worker's entry in the workers section of /api/status.
+type WorkerStatus struct {
+	Name        string `json:"name"`
+	State       string `json:"state"`
+	Started     int64  `json:"started"`
+	Restarts    int    `json:"restarts"`
+	LastError   string `json:"lastError,omitempty"`
+	LastFailure int64  `json:"lastFailure,omitempty"`
+}
+
+func NewSupervisor() *Supervisor {
+	return &Supervisor{workers: make(map[string]*worker), backoff: workerBackoff}
+}
+
+// Go starts run as the worker name and reports whether it was started. A
+// worker runs only once: Go returns false when name is already supervised.
+func (s *Supervisor) Go(name string, run func()) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.workers[name]; ok {
+		return false
+	}
+	w := &worker{state: workerRunning, started: time.Now()}
+	s.workers[name] = w
+	go s.supervise(name, w, run)
+	return true
+}
+
+func (s *Supervisor) supervise(name string, w *worker, run func()) {
+	backoff := s.backoff
+	for {
+		started := time.Now()
+		err := runWorker(run)
+		if time.Since(started) > maxWorkerBackoff {
+			backoff = s.backoff
+		}
+
+		s.mu.Lock()
+		w.state = workerRestarting
+		w.restarts++
+		w.lastError = err.Error()
+		w.lastFailure = time.Now()
+		s.mu.Unlock()
+
+		log.Printf("⚠️  Worker %s failed (%v); restarting in %s", name, err, backoff)
+		if s.onFailure != nil {
+			s.onFailure(name, err)
+		}
+
+		time.Sleep(backoff)
+		backoff = min(backoff*2, maxWorkerBackoff)
+
+		s.mu.Lock()
+		w.state = workerRunning
+		w.started = time.Now()
+		s.mu.Unlock()
+	}
+}
+
+// runWorker runs run and returns why it stopped.
+func runWorker(run func()) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			log.Printf("Worker panic: %v\n%s", r, debug.Stack())
+			err = fmt.Errorf("panic: %v", r)
+		}
+	}()
+	run()
+	return errWorkerReturned
+}
+
+// Status returns the health of every worker, sorted by name.
+func (s *Supervisor) Status() []WorkerStatus {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	statuses := make([]WorkerStatus, 0, len(s.workers))
+	for name, w := range s.workers {
+		status := WorkerStatus{
+			Name:      name,
+			State:     w.state,
+			Started:   w.started.Unix(),
+			Restarts:  w.restarts,
+			LastError: w.lastError,
+		}
+		if !w.lastFailure.IsZero() {
+			status.LastFailure = w.lastFailure.Unix()
+		}
+		statuses = append(statuses, status)
+	}
+	sort.Slice(statuses, func(i, j int) bool { return statuses[i].Name < statuses[j].Name })
+	return statuses
+}
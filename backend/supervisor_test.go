@@ -0,0 +1,66 @@
+package main
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// TestSupervisorRestart verifies a panicking worker is restarted and its
+// failures are reported
+func TestSupervisorRestart(t *testing.T) {
+	s := NewSupervisor()
+	s.backoff = time.Millisecond
+	failures := make(chan string, 10)
+	s.onFailure = func(name string, err error) { failures <- err.Error() }
+
+	var runs atomic.Int32
+	block := make(chan struct{})
+	defer close(block)
+	s.Go("flaky", func() {
+		if runs.Add(1) <= 2 {
+			panic("boom")
+		}
+		<-block
+	})
+
+	for i := 0; i < 2; i++ {
+		select {
+		case err := <-failures:
+			if err != "panic: boom" {
+				t.Fatalf("Expected the panic as the failure, got %q", err)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatalf("Expected failure %d to be reported", i+1)
+		}
+	}
+
+	deadline := time.Now().Add(2 * time.Second)
+	for runs.Load() < 3 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	time.Sleep(10 * time.Millisecond)
+
+	status := s.Status()
+	if len(status) != 1 || status[0].State != workerRunning || status[0].Restarts != 2 || status[0].LastError != "panic: boom" {
+		t.Fatalf("Expected a running worker after 2 restarts, got %+v", status)
+	}
+}
+
+// TestSupervisorRunsOnce verifies a worker name is only started once, so
+// restarting discovery doesn't duplicate its workers
+func TestSupervisorRunsOnce(t *testing.T) {
+	s := NewSupervisor()
+	block := make(chan struct{})
+	defer close(block)
+
+	if !s.Go("worker", func() { <-block }) {
+		t.Fatalf("Expected the first Go to start the worker")
+	}
+	if s.Go("worker", func() { <-block }) {
+		t.Fatalf("Expected the second Go not to start the worker again")
+	}
+	if n := len(s.Status()); n != 1 {
+		t.Fatalf("Expected 1 worker, got %d", n)
+	}
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"time"
+)
+
+const servicesBucket = "services"
+
+// suppressionWindow is how long a service known before a restart stays
+// suppressed. A service seen again within it is only announced if it changed.
+const suppressionWindow = 24 * time.Hour
+
+// knownService is a persisted entry of the service table.
+type knownService struct {
+	MDNSService
+	SeenAt int64 `json:"seenAt"`
+}
+
+// sameService reports whether b announces the same thing as a.
+func sameService(a, b *MDNSService) bool {
+	return a.Name == b.Name && a.Type == b.Type && a.Host == b.Host && a.Port == b.Port
+}
+
+// restoreServices loads the service table persisted before the last
+// shutdown. Its services are not listed as discovered; they only suppress
+// the announcement of identical services rediscovered after the restart, so
+// restarting does not flood sinks with services that never went away.
+func (s *MDNSServer) restoreServices(store Store) error {
+	entries, err := store.Load(servicesBucket)
+	if err != nil {
+		return err
+	}
+
+	cutoff := time.Now().Add(-suppressionWindow).Unix()
+
+	restored := make(map[string]*knownService, len(entries))
+	for key, data := range entries {
+		var known knownService
+		if err := json.Unmarshal(data, &known); err != nil {
+			return fmt.Errorf("service %s: %v", key, err)
+		}
+		restored[key] = &known
+	}
+	t := s.table
+	t.do(func() {
+		for key, known := range restored {
+			t.persisted[key] = true
+			if known.SeenAt >= cutoff {
+				t.suppressed[key] = known
+			}
+		}
+	})
+	return nil
+}
+
+// saveServices writes the service table to store, keeping the suppressed
+// services that have not been rediscovered yet until their window expires.
+func (s *MDNSServer) saveServices(store Store, now time.Time) error {
+	cutoff := now.Add(-suppressionWindow).Unix()
+
+	t := s.table
+	puts := make(map[string][]byte)
+	var deletes []string
+	var err error
+	t.do(func() {
+		for key, service := range t.services {
+			data, e := json.Marshal(knownService{MDNSService: *service, SeenAt: now.Unix()})
+			if e != nil {
+				err = e
+				return
+			}
+			puts[key] = data
+		}
+		for key, known := range t.suppressed {
+			if known.SeenAt < cutoff {
+				delete(t.suppressed, key)
+			}
+		}
+		for key := range t.persisted {
+			_, live := t.services[key]
+			_, suppressed := t.suppressed[key]
+			if !live && !suppressed {
+				deletes = append(deletes, key)
+				delete(t.persisted, key)
+			}
+		}
+		for key := range puts {
+			t.persisted[key] = true
+		}
+	})
+	if err != nil {
+		return err
+	}
+
+	if len(puts) > 0 {
+		if err := store.Put(servicesBucket, puts); err != nil {
+			return err
+		}
+	}
+	if len(deletes) > 0 {
+		return store.Delete(servicesBucket, deletes...)
+	}
+	return nil
+}
+
+// persistServices saves the service table every minute.
+func (s *MDNSServer) persistServices(store Store) {
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+
+	for now := range ticker.C {
+		if err := s.saveServices(store, now); err != nil {
+			log.Printf("Failed to save service table: %v", err)
+		}
+	}
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// TestRestoredServicesSuppressed verifies services known before a restart
+// are not announced again unless they changed
+func TestRestoredServicesSuppressed(t *testing.T) {
+	store := openTestStore(t, "json", t.TempDir())
+
+	before := NewMDNSServer()
+	before.addService("10.0.0.2:_smb._tcp.local.:445", &MDNSService{Name: "NAS", Type: "_smb._tcp.local.", IP: "10.0.0.2", Port: 445})
+	before.addService("10.0.0.3:_ipp._tcp.local.:631", &MDNSService{Name: "Printer", Type: "_ipp._tcp.local.", IP: "10.0.0.3", Port: 631})
+	if err := before.saveServices(store, time.Now()); err != nil {
+		t.Fatalf("Failed to save services: %v", err)
+	}
+
+	after := NewMDNSServer()
+	if err := after.restoreServices(store); err != nil {
+		t.Fatalf("Failed to restore services: %v", err)
+	}
+	if len(after.listServices("")) != 0 {
+		t.Fatalf("Expected restored services not to be listed before rediscovery")
+	}
+
+	if after.addService("10.0.0.2:_smb._tcp.local.:445", &MDNSService{Name: "NAS", Type: "_smb._tcp.local.", IP: "10.0.0.2", Port: 445}) {
+		t.Fatalf("Expected the unchanged NAS to be suppressed")
+	}
+	if !after.addService("10.0.0.3:_ipp._tcp.local.:631", &MDNSService{Name: "Office Printer", Type: "_ipp._tcp.local.", IP: "10.0.0.3", Port: 631}) {
+		t.Fatalf("Expected the renamed printer to be announced")
+	}
+	if !after.addService("10.0.0.4:_ssh._tcp.local.:22", &MDNSService{Name: "Pi", Type: "_ssh._tcp.local.", IP: "10.0.0.4", Port: 22}) {
+		t.Fatalf("Expected a new service to be announced")
+	}
+}
+
+// TestSuppressionExpires verifies services not rediscovered within the
+// suppression window are dropped from the store
+func TestSuppressionExpires(t *testing.T) {
+	store := openTestStore(t, "json", t.TempDir())
+	now := time.Now()
+
+	before := NewMDNSServer()
+	before.addService("10.0.0.2:_smb._tcp.local.:445", &MDNSService{Name: "NAS", IP: "10.0.0.2"})
+	before.saveServices(store, now.Add(-2*suppressionWindow))
+
+	after := NewMDNSServer()
+	after.restoreServices(store)
+	var suppressed int
+	after.table.do(func() { suppressed = len(after.table.suppressed) })
+	if suppressed != 0 {
+		t.Fatalf("Expected the expired service not to be suppressed")
+	}
+	if err := after.saveServices(store, now); err != nil {
+		t.Fatalf("Failed to save services: %v", err)
+	}
+	entries, _ := store.Load(servicesBucket)
+	if len(entries) != 0 {
+		t.Fatalf("Expected the expired service to be deleted, got %d entries", len(entries))
+	}
+}
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"maps"
+	"sync/atomic"
+)
+
+// ServiceTable holds the discovered services. One goroutine, its writer,
+// owns the table and applies every change in the order they are submitted,
+// so check-then-set changes such as "add unless known" never race with one
+// another. Readers don't lock: they get an immutable snapshot of the table,
+// which the writer rebuilds on the first read after a change.
+//
+// Services are never modified once they are in the table; a refresh stores
+// an updated copy. Snapshots, and the services handed out with them, must
+// not be modified either.
+type ServiceTable struct {
+	ops      chan func()
+	snapshot atomic.Pointer[map[string]*MDNSService]
+	dirty    atomic.Bool // whether the table changed since the snapshot
+
+	// Owned by the writer
+	services   map[string]*MDNSService  // by site key
+	suppressed map[string]*knownService // known before the restart, not yet rediscovered
+	persisted  map[string]bool          // keys in the services bucket
+}
+
+// NewServiceTable creates an empty table. Its writer is Run.
+func NewServiceTable() *ServiceTable {
+	t := &ServiceTable{
+		ops:        make(chan func(), 64),
+		services:   make(map[string]*MDNSService),
+		suppressed: make(map[string]*knownService),
+		persisted:  make(map[string]bool),
+	}
+	t.snapshot.Store(&map[string]*MDNSService{})
+	return t
+}
+
+// Run is the writer, applying changes as they come. It never returns.
+func (t *ServiceTable) Run() {
+	for op := range t.ops {
+		op()
+	}
+}
+
+// do runs fn on the writer, after every change submitted before it, and
+// waits for it to finish.
+func (t *ServiceTable) do(fn func()) {
+	done := make(chan struct{})
+	t.ops <- func() {
+		defer close(done)
+		fn()
+	}
+	<-done
+}
+
+// changed marks the snapshot stale. It must be called on the writer.
+func (t *ServiceTable) changed() {
+	t.dirty.Store(true)
+}
+
+// view returns the services by site key as of the last change.
+func (t *ServiceTable) view() map[string]*MDNSService {
+	if t.dirty.Load() {
+		t.do(func() {
+			// Readers that found it stale at once share one rebuild
+			if t.dirty.Load() {
+				snapshot := maps.Clone(t.services)
+				t.snapshot.Store(&snapshot)
+				t.dirty.Store(false)
+			}
+		})
+	}
+	return *t.snapshot.Load()
+}
+
+// add stores a service under key and reports whether it was not already
+// known, refreshing the known one otherwise. Services known before a
+// restart only count as new if they changed. It must be called on the
+// writer.
+func (t *ServiceTable) add(key string, service *MDNSService) bool {
+	t.changed()
+	if existing, ok := t.services[key]; ok {
+		refreshed := *existing
+		refreshed.LastRefreshed = service.LastRefreshed
+		refreshed.LastSeen = service.LastSeen
+		refreshed.ExpiresAt = service.ExpiresAt
+		refreshed.Self = service.Self
+		if service.TXT != nil {
+			refreshed.TXT = service.TXT
+		}
+		if service.IP != service.IP6 && existing.IP == existing.IP6 {
+			// Heard of on IPv6 only at first, it now has an IPv4 address
+			refreshed.IP = service.IP
+		}
+		if service.IP6 != "" {
+			refreshed.IP6 = service.IP6
+		}
+		for _, iface := range service.Interfaces {
+			refreshed.Interfaces = seenOn(refreshed.Interfaces, iface.Name, iface.LastSeen)
+		}
+		if service.Targets != nil {
+			refreshed.Targets = mergeTargets(existing.Targets, service.Targets, service.LastRefreshed)
+			if !hasTarget(refreshed.Targets, refreshed.Host, refreshed.Port) {
+				// Its target is gone, so the service is at another one
+				refreshed.setTargets(refreshed.Targets)
+			}
+		}
+		t.services[key] = &refreshed
+		return false
+	}
+	t.services[key] = service
+	if known, ok := t.suppressed[key]; ok {
+		delete(t.suppressed, key)
+		return !sameService(&known.MDNSService, service)
+	}
+	return true
+}
+
+// remove drops the service under key and reports whether it was known. It
+// must be called on the writer.
+func (t *ServiceTable) remove(key string) bool {
+	if _, ok := t.services[key]; !ok {
+		return false
+	}
+	delete(t.services, key)
+	t.changed()
+	return true
+}
+
+// forget drops the services matching match, and the suppressed ones, and
+// returns those that were listed. It must be called on the writer.
+func (t *ServiceTable) forget(match func(service *MDNSService) bool) []MDNSService {
+	var removed []MDNSService
+	for key, service := range t.services {
+		if match(service) {
+			removed = append(removed, *service)
+			delete(t.services, key)
+		}
+	}
+	for key, known := range t.suppressed {
+		if match(&known.MDNSService) {
+			delete(t.suppressed, key)
+		}
+	}
+	t.changed()
+	return removed
+}
+
+// expire drops the services of site whose records expired before now, in
+// Unix seconds, and returns them. It must be called on the writer.
+func (t *ServiceTable) expire(site string, now int64) []MDNSService {
+	var expired []MDNSService
+	for key, service := range t.services {
+		if service.Site == site && service.ExpiresAt > 0 && service.ExpiresAt < now {
+			expired = append(expired, *service)
+			delete(t.services, key)
+		}
+	}
+	if len(expired) > 0 {
+		t.changed()
+	}
+	return expired
+}
+
+// markSelf sets Self on the services of site to whether own reports them
+// as running on this host, and returns how many changed. It must be called
+// on the writer.
+func (t *ServiceTable) markSelf(site string, own func(service *MDNSService) bool) int {
+	n := 0
+	for key, service := range t.services {
+		if service.Site != site {
+			continue
+		}
+		if self := own(service); self != service.Self {
+			marked := *service
+			marked.Self = self
+			t.services[key] = &marked
+			n++
+		}
+	}
+	if n > 0 {
+		t.changed()
+	}
+	return n
+}
+
+// markReachable records a reachability check of the service under key at
+// now, in Unix seconds, and returns the updated service if its
+// reachability changed, nil otherwise or if it is gone. It must be called
+// on the writer.
+func (t *ServiceTable) markReachable(key string, reachable bool, now int64) *MDNSService {
+	service, ok := t.services[key]
+	if !ok {
+		return nil
+	}
+	checked := *service
+	checked.CheckedAt = now
+	if reachable {
+		checked.ReachableAt = now
+	}
+	changed := service.Reachable == nil || *service.Reachable != reachable
+	if changed {
+		checked.Reachable = &reachable
+	}
+	t.services[key] = &checked
+	t.changed()
+	if !changed {
+		return nil
+	}
+	return &checked
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+)
+
+// TestServiceTableConcurrentAdds verifies a service announced at once from
+// many goroutines is new exactly once
+func TestServiceTableConcurrentAdds(t *testing.T) {
+	server := NewMDNSServer()
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	added := 0
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if server.addService("nas", &MDNSService{Name: "nas", Type: "_smb._tcp.local.", IP: "10.0.0.20"}) {
+				mu.Lock()
+				added++
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	if added != 1 {
+		t.Fatalf("Expected one new service, got %d", added)
+	}
+	if services := server.listServices(""); len(services) != 1 {
+		t.Fatalf("Expected one service listed, got %d", len(services))
+	}
+}
+
+// TestServiceTableSnapshots verifies a snapshot is left as it was by later
+// refreshes and removals
+func TestServiceTableSnapshots(t *testing.T) {
+	server := NewMDNSServer()
+	for i := 0; i < 3; i++ {
+		server.addService(fmt.Sprintf("svc-%d", i), &MDNSService{Name: fmt.Sprintf("svc-%d", i), IP: "10.0.0.1", LastRefreshed: 100})
+	}
+	before := server.table.view()
+	refreshed := before[siteKey(server.site, "svc-0")].LastRefreshed
+
+	server.addService("svc-0", &MDNSService{Name: "svc-0", IP: "10.0.0.1", LastRefreshed: 200})
+	server.removeService("svc-1", &MDNSService{Name: "svc-1"})
+	if len(before) != 3 || before[siteKey(server.site, "svc-0")].LastRefreshed != refreshed {
+		t.Fatalf("Expected the snapshot to be unchanged, got %d services", len(before))
+	}
+	after := server.table.view()
+	if len(after) != 2 || after[siteKey(server.site, "svc-0")].LastRefreshed != 200 {
+		t.Fatalf("Expected the refresh and removal in a new snapshot, got %d services", len(after))
+	}
+}
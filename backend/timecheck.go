@@ -0,0 +1,213 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// NTP check settings.
+const (
+	ntpTimeout = 2 * time.Second
+	// clockSkewThreshold is the offset from the network's time servers the
+	// local clock is reported as skewed at
+	clockSkewThreshold = time.Second
+)
+
+// ntpEpochOffset is the number of seconds from 1900, the NTP epoch, to
+// 1970.
+const ntpEpochOffset = 2208988800
+
+// NTPResult is the answer of one time server.
+type NTPResult struct {
+	Server   string  `json:"server"`
+	Source   string  `json:"source"` // mdns, gateway or configured
+	Device   string  `json:"device,omitempty"`
+	Stratum  uint8   `json:"stratum,omitempty"`
+	RefID    string  `json:"refId,omitempty"`
+	Leap     uint8   `json:"leap,omitempty"` // 3 when the server's clock isn't synchronized
+	OffsetMs float64 `json:"offsetMs"`       // the server's time minus the local time
+	DelayMs  float64 `json:"delayMs"`
+	Error    string  `json:"error,omitempty"`
+}
+
+// ntpTime converts t to a 64-bit NTP timestamp.
+func ntpTime(t time.Time) uint64 {
+	secs := uint64(t.Unix() + ntpEpochOffset)
+	frac := uint64(t.Nanosecond()) << 32 / 1e9
+	return secs<<32 | frac
+}
+
+// fromNTPTime converts a 64-bit NTP timestamp to a time.
+func fromNTPTime(ts uint64) time.Time {
+	secs := int64(ts>>32) - ntpEpochOffset
+	nanos := int64((ts & 0xffffffff) * 1e9 >> 32)
+	return time.Unix(secs, nanos)
+}
+
+// queryNTP sends an SNTP (RFC 4330) client request to addr, on port 123
+// unless it has one, and computes the clock offset and round-trip delay
+// from the answer.
+func queryNTP(ctx context.Context, addr string) (NTPResult, error) {
+	result := NTPResult{Server: addr}
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		addr = net.JoinHostPort(addr, "123")
+	}
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "udp", addr)
+	if err != nil {
+		return result, err
+	}
+	defer conn.Close()
+	deadline, ok := ctx.Deadline()
+	if !ok || time.Until(deadline) > ntpTimeout {
+		deadline = time.Now().Add(ntpTimeout)
+	}
+	conn.SetDeadline(deadline)
+
+	request := make([]byte, 48)
+	request[0] = 0<<6 | 4<<3 | 3 // no leap warning, version 4, client
+	sent := time.Now()
+	binary.BigEndian.PutUint64(request[40:], ntpTime(sent))
+	if _, err := conn.Write(request); err != nil {
+		return result, err
+	}
+
+	response := make([]byte, 128)
+	for {
+		n, err := conn.Read(response)
+		if err != nil {
+			return result, err
+		}
+		received := time.Now()
+		// The origin timestamp echoes ours, which rules out stray packets
+		if n < 48 || response[0]&7 != 4 || binary.BigEndian.Uint64(response[24:32]) != binary.BigEndian.Uint64(request[40:48]) {
+			continue
+		}
+		result.Leap = response[0] >> 6
+		result.Stratum = response[1]
+		if result.Stratum == 0 {
+			// A kiss-of-death packet, e.g. RATE
+			return result, fmt.Errorf("server refused: %s", strings.TrimRight(string(response[12:16]), "\x00"))
+		}
+		if result.Stratum == 1 {
+			result.RefID = strings.TrimRight(string(response[12:16]), "\x00")
+		} else {
+			result.RefID = net.IP(response[12:16]).String()
+		}
+
+		t2 := fromNTPTime(binary.BigEndian.Uint64(response[32:40]))
+		t3 := fromNTPTime(binary.BigEndian.Uint64(response[40:48]))
+		offset := (t2.Sub(sent) + t3.Sub(received)) / 2
+		delay := received.Sub(sent) - t3.Sub(t2)
+		result.OffsetMs = milliseconds(offset)
+		result.DelayMs = milliseconds(max(delay, 0))
+		return result, nil
+	}
+}
+
+// timeServers returns the time servers to check: the _ntp._udp services of
+// the local site, the default gateway, and the configured ones.
+func (s *MDNSServer) timeServers() []NTPResult {
+	var servers []NTPResult
+	seen := make(map[string]bool)
+	add := func(result NTPResult) {
+		if result.Server != "" && !seen[result.Server] {
+			seen[result.Server] = true
+			servers = append(servers, result)
+		}
+	}
+	for _, service := range s.listServices(s.site) {
+		if strings.HasPrefix(service.Type, "_ntp._udp") {
+			add(NTPResult{Server: service.IP, Source: "mdns", Device: deviceID(&service)})
+		}
+	}
+	if gateway, err := defaultGateway(); err == nil {
+		add(NTPResult{Server: gateway, Source: "gateway"})
+	}
+	for _, server := range s.ntpServers {
+		add(NTPResult{Server: server, Source: "configured"})
+	}
+	return servers
+}
+
+// clockSkew summarizes the answers: the median offset of the synchronized
+// servers and whether it is beyond clockSkewThreshold.
+func clockSkew(results []NTPResult) map[string]interface{} {
+	var offsets []float64
+	for _, result := range results {
+		if result.Error == "" && result.Leap != 3 {
+			offsets = append(offsets, result.OffsetMs)
+		}
+	}
+	summary := map[string]interface{}{"servers": len(offsets)}
+	if len(offsets) == 0 {
+		return summary
+	}
+	sort.Float64s(offsets)
+	median := offsets[len(offsets)/2]
+	if len(offsets)%2 == 0 {
+		median = (offsets[len(offsets)/2-1] + median) / 2
+	}
+	summary["offsetMs"] = median
+	summary["skewed"] = math.Abs(median) >= milliseconds(clockSkewThreshold)
+	return summary
+}
+
+// Time handles GET /api/time: the time servers on the network, _ntp._udp
+// advertisers and the gateway, with their stratum and offset, and the skew of
+// the local clock relative to them.
+func (s *MDNSServer) Time(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	results := s.timeServers()
+
+	ctx, cancel := context.WithTimeout(r.Context(), ntpTimeout)
+	defer cancel()
+	var wg sync.WaitGroup
+	for i := range results {
+		// Configured servers were asked for by name, and are usually
+		// outside the network; the discovered ones are probes
+		if results[i].Source != "configured" {
+			if err := scanScope.check(results[i].Server); err != nil {
+				results[i].Error = err.Error()
+				continue
+			}
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			answer, err := queryNTP(ctx, results[i].Server)
+			if err != nil {
+				var netErr net.Error
+				if errors.As(err, &netErr) && netErr.Timeout() {
+					err = errors.New("no answer")
+				}
+				results[i].Error = err.Error()
+			}
+			results[i].Stratum, results[i].RefID, results[i].Leap = answer.Stratum, answer.RefID, answer.Leap
+			results[i].OffsetMs, results[i].DelayMs = answer.OffsetMs, answer.DelayMs
+		}()
+	}
+	wg.Wait()
+
+	if results == nil {
+		results = []NTPResult{}
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"localTime": time.Now().UnixMilli(),
+		"servers":   results,
+		"clock":     clockSkew(results),
+	})
+}
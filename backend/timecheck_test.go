@@ -0,0 +1,107 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"math"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// startNTPServer answers SNTP requests with a clock ahead by skew.
+func startNTPServer(t *testing.T, skew time.Duration) string {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	go func() {
+		buffer := make([]byte, 48)
+		for {
+			n, peer, err := conn.ReadFrom(buffer)
+			if err != nil {
+				return
+			}
+			if n < 48 {
+				continue
+			}
+			now := ntpTime(time.Now().Add(skew))
+			response := make([]byte, 48)
+			response[0] = 4<<3 | 4 // version 4, server
+			response[1] = 2
+			copy(response[12:16], net.ParseIP("10.0.0.1").To4())
+			copy(response[24:32], buffer[40:48])
+			binary.BigEndian.PutUint64(response[32:], now)
+			binary.BigEndian.PutUint64(response[40:], now)
+			conn.WriteTo(response, peer)
+		}
+	}()
+	return conn.LocalAddr().String()
+}
+
+// TestNTPTimestamps verifies the conversion to and from NTP timestamps.
+func TestNTPTimestamps(t *testing.T) {
+	now := time.Unix(1699564800, 250000000)
+	if back := fromNTPTime(ntpTime(now)); back.Sub(now).Abs() > time.Microsecond {
+		t.Fatalf("Expected %v back, got %v", now, back)
+	}
+	if ntpTime(time.Unix(0, 0))>>32 != ntpEpochOffset {
+		t.Fatalf("Expected the Unix epoch at %d NTP seconds", ntpEpochOffset)
+	}
+}
+
+// TestQueryNTP verifies that the offset and stratum of a server are
+// measured.
+func TestQueryNTP(t *testing.T) {
+	addr := startNTPServer(t, 3*time.Second)
+	result, err := queryNTP(context.Background(), addr)
+	if err != nil {
+		t.Fatalf("Expected an answer: %v", err)
+	}
+	if math.Abs(result.OffsetMs-3000) > 100 || result.Stratum != 2 || result.RefID != "10.0.0.1" {
+		t.Fatalf("Unexpected result %+v", result)
+	}
+}
+
+// TestTimeEndpoint verifies that skew against the time servers is
+// reported from their median offset.
+func TestTimeEndpoint(t *testing.T) {
+	server := NewMDNSServer()
+	server.ntpServers = []string{startNTPServer(t, 2*time.Second), startNTPServer(t, 2*time.Second), startNTPServer(t, 0)}
+
+	rec := httptest.NewRecorder()
+	server.Time(rec, httptest.NewRequest(http.MethodGet, "/api/time", nil))
+	var resp struct {
+		Servers []NTPResult `json:"servers"`
+		Clock   struct {
+			Servers  int     `json:"servers"`
+			OffsetMs float64 `json:"offsetMs"`
+			Skewed   bool    `json:"skewed"`
+		} `json:"clock"`
+	}
+	json.NewDecoder(rec.Body).Decode(&resp)
+	configured := 0
+	for _, result := range resp.Servers {
+		if result.Source == "configured" {
+			configured++
+			if result.Error != "" {
+				t.Fatalf("Unexpected error %+v", result)
+			}
+		}
+	}
+	if configured != 3 {
+		t.Fatalf("Expected the three configured servers, got %+v", resp.Servers)
+	}
+	// The gateway may answer too, where there is one
+	if resp.Clock.Servers == 3 && (!resp.Clock.Skewed || math.Abs(resp.Clock.OffsetMs-2000) > 100) {
+		t.Fatalf("Expected a 2s skew from three servers, got %+v", resp.Clock)
+	}
+
+	if summary := clockSkew([]NTPResult{{OffsetMs: 5}, {OffsetMs: 500, Leap: 3}, {Error: "no answer"}}); summary["servers"] != 1 || summary["skewed"] != false {
+		t.Fatalf("Expected unsynchronized and failed servers to be ignored, got %+v", summary)
+	}
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+)
+
+// SwitchPort is the switch port a device hangs off.
+type SwitchPort struct {
+	SwitchID  string `json:"switchId"`
+	Switch    string `json:"switch"` // the switch's sysName, or its ID
+	Port      int    `json:"port"`
+	Interface string `json:"interface,omitempty"`
+	VLAN      int    `json:"vlan,omitempty"`
+	Label     string `json:"label"` // e.g. "core-switch, port 12"
+}
+
+// switchPorts maps MAC addresses to the switch ports they were learned on,
+// from the forwarding tables of the SNMP-polled switches of site. A MAC
+// behind an uplink is learned on every switch on the way, so the port that
+// learned the fewest MACs wins: that is the edge port the device is on.
+func (s *MDNSServer) switchPorts(site string) map[string]*SwitchPort {
+	type candidate struct {
+		port  *SwitchPort
+		count int
+	}
+	best := make(map[string]candidate)
+
+	for id, info := range s.snmp.List(site) {
+		counts := make(map[int]int)
+		for _, entry := range info.MACTable {
+			counts[entry.Port]++
+		}
+		name := info.SysName
+		if name == "" {
+			name = id
+		}
+		for _, entry := range info.MACTable {
+			c, ok := best[entry.MAC]
+			if ok && c.count <= counts[entry.Port] {
+				continue
+			}
+			port := &SwitchPort{
+				SwitchID:  id,
+				Switch:    name,
+				Port:      entry.Port,
+				Interface: entry.Interface,
+				VLAN:      entry.VLAN,
+				Label:     fmt.Sprintf("%s, port %d", name, entry.Port),
+			}
+			best[entry.MAC] = candidate{port: port, count: counts[entry.Port]}
+		}
+	}
+
+	ports := make(map[string]*SwitchPort, len(best))
+	for mac, c := range best {
+		ports[mac] = c.port
+	}
+	return ports
+}
+
+// locateDevices sets the MAC address and switch port of the local devices
+// among summaries, from the ARP table and the switches' forwarding tables.
+func (s *MDNSServer) locateDevices(summaries []*DeviceSummary) {
+	ports := s.switchPorts(s.site)
+	for _, summary := range summaries {
+		if summary.Site != s.site {
+			continue
+		}
+		for _, ip := range summary.Addresses {
+			if mac := neighbors.lookup(ip); mac != "" {
+				summary.MAC = mac
+				summary.SwitchPort = ports[mac]
+				break
+			}
+		}
+	}
+}
+
+// TopologyNode is a device or switch in the topology graph.
+type TopologyNode struct {
+	ID    string `json:"id"`
+	Label string `json:"label"`
+	Kind  string `json:"kind"` // "switch" or "device"
+}
+
+// TopologyEdge links a device to the switch port it hangs off.
+type TopologyEdge struct {
+	From      string `json:"from"`
+	To        string `json:"to"`
+	Port      int    `json:"port"`
+	Interface string `json:"interface,omitempty"`
+	Label     string `json:"label"`
+}
+
+// Topology handles GET /api/topology, the local devices and the switches
+// they are connected to.
+func (s *MDNSServer) Topology(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	summaries := s.summarizeDevices(s.listDevices(s.site, ""), s.site)
+	nodes := []TopologyNode{}
+	edges := []TopologyEdge{}
+	for _, summary := range summaries {
+		if len(summary.Services) == 0 && summary.SNMP == nil {
+			continue
+		}
+		node := TopologyNode{ID: summary.ID, Label: summary.ID, Kind: "device"}
+		if summary.SNMP != nil {
+			if summary.SNMP.SysName != "" {
+				node.Label = summary.SNMP.SysName
+			}
+			if len(summary.SNMP.MACTable) > 0 {
+				node.Kind = "switch"
+			}
+		}
+		nodes = append(nodes, node)
+
+		if sp := summary.SwitchPort; sp != nil && sp.SwitchID != summary.ID {
+			edges = append(edges, TopologyEdge{
+				From:      summary.ID,
+				To:        sp.SwitchID,
+				Port:      sp.Port,
+				Interface: sp.Interface,
+				Label:     sp.Label,
+			})
+		}
+	}
+	sort.Slice(edges, func(i, j int) bool { return edges[i].From < edges[j].From })
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"nodes": nodes,
+		"edges": edges,
+	})
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// TestSwitchPortMapping verifies a device is placed on the edge port that
+// learned its MAC, not on the uplink of another switch
+func TestSwitchPortMapping(t *testing.T) {
+	defer func(read func() (map[string]string, error)) {
+		neighbors.mu.Lock()
+		neighbors.read, neighbors.loaded = read, time.Time{}
+		neighbors.mu.Unlock()
+	}(neighbors.read)
+	neighbors.mu.Lock()
+	neighbors.read = func() (map[string]string, error) {
+		return map[string]string{"192.168.1.30": "00:1b:21:01:02:03"}, nil
+	}
+	neighbors.loaded = time.Time{}
+	neighbors.mu.Unlock()
+
+	server := NewMDNSServer()
+	server.metadata, _ = NewMetadataStore(openTestStore(t, "json", t.TempDir()))
+	server.snmp = NewSNMPPoller("public")
+	server.snmp.devices = map[string]*SNMPInfo{
+		// The core switch learns the printer on its uplink, with other MACs
+		siteKey(defaultSite, "core.local"): {SysName: "core", MACTable: []SNMPMACEntry{
+			{MAC: "00:1b:21:01:02:03", Port: 1}, {MAC: "00:1b:21:0a:0b:0c", Port: 1},
+		}},
+		siteKey(defaultSite, "office.local"): {SysName: "office-switch", MACTable: []SNMPMACEntry{
+			{MAC: "00:1b:21:01:02:03", Port: 12, Interface: "ge-0/0/12"},
+		}},
+	}
+	server.addService("printer", &MDNSService{Name: "Printer", Type: "_ipp._tcp.local.", IP: "192.168.1.30", Port: 631})
+
+	summaries := server.summarizeDevices(server.listDevices(defaultSite, ""), defaultSite)
+	var printer *DeviceSummary
+	for _, summary := range summaries {
+		if summary.ID == "192.168.1.30" {
+			printer = summary
+		}
+	}
+	if printer == nil || printer.MAC != "00:1b:21:01:02:03" || printer.SwitchPort == nil {
+		t.Fatalf("Expected the printer with its MAC and switch port, got %+v", printer)
+	}
+	if sp := printer.SwitchPort; sp.SwitchID != "office.local" || sp.Port != 12 || sp.Label != "office-switch, port 12" {
+		t.Fatalf("Expected office-switch port 12, got %+v", sp)
+	}
+}
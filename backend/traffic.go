@@ -0,0 +1,182 @@
+package main
+
+import (
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// trafficHours is how many hourly buckets are kept per device.
+const trafficHours = 48
+
+// TrafficHour is what a device sent and received during an hour.
+type TrafficHour struct {
+	Hour     int64  `json:"hour"` // Unix time of the start of the hour
+	InBytes  uint64 `json:"inBytes"`
+	OutBytes uint64 `json:"outBytes"`
+}
+
+// DeviceTraffic is a device's traffic over the last 24 hours, on its
+// record on /api/devices.
+type DeviceTraffic struct {
+	InBytes  uint64 `json:"inBytes"`
+	OutBytes uint64 `json:"outBytes"`
+}
+
+// TrafficAccounting counts the bytes each local device sends and receives
+// per hour, from captured packets attributed through a deviceIndex.
+type TrafficAccounting struct {
+	devices *deviceIndex
+
+	mu     sync.Mutex
+	hours  map[string][]TrafficHour // device ID -> hours, oldest first
+	pruned time.Time
+}
+
+// NewTrafficAccounting creates the accounting of the devices in index.
+func NewTrafficAccounting(index *deviceIndex) *TrafficAccounting {
+	return &TrafficAccounting{devices: index, hours: make(map[string][]TrafficHour)}
+}
+
+// Record counts a captured packet.
+func (t *TrafficAccounting) Record(p packetInfo, now time.Time) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if now.Sub(t.pruned) >= time.Hour {
+		t.prune(now)
+		t.pruned = now
+	}
+	hour := now.Truncate(time.Hour).Unix()
+	if id := t.devices.lookup(p.Src, now); id != "" {
+		t.bucket(id, hour).OutBytes += uint64(p.Length)
+	}
+	if id := t.devices.lookup(p.Dst, now); id != "" {
+		t.bucket(id, hour).InBytes += uint64(p.Length)
+	}
+}
+
+// prune drops expired hours. Must be called with t.mu held.
+func (t *TrafficAccounting) prune(now time.Time) {
+	cutoff := now.Add(-trafficHours * time.Hour).Unix()
+	for id, hours := range t.hours {
+		i := 0
+		for i < len(hours) && hours[i].Hour <= cutoff {
+			i++
+		}
+		if i == len(hours) {
+			delete(t.hours, id)
+		} else if i > 0 {
+			t.hours[id] = append([]TrafficHour(nil), hours[i:]...)
+		}
+	}
+}
+
+// bucket returns the counters of id for hour. Must be called with t.mu held.
+func (t *TrafficAccounting) bucket(id string, hour int64) *TrafficHour {
+	hours := t.hours[id]
+	if n := len(hours); n == 0 || hours[n-1].Hour != hour {
+		hours = append(hours, TrafficHour{Hour: hour})
+		t.hours[id] = hours
+	}
+	return &hours[len(hours)-1]
+}
+
+// Series returns the hours of every device since since.
+func (t *TrafficAccounting) Series(since time.Time) map[string][]TrafficHour {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	start := since.Truncate(time.Hour).Unix()
+	series := make(map[string][]TrafficHour, len(t.hours))
+	for id, hours := range t.hours {
+		var kept []TrafficHour
+		for _, h := range hours {
+			if h.Hour >= start {
+				kept = append(kept, h)
+			}
+		}
+		if len(kept) > 0 {
+			series[id] = kept
+		}
+	}
+	return series
+}
+
+// Totals returns the traffic of id over the last 24 hours, or nil.
+func (t *TrafficAccounting) Totals(id string) *DeviceTraffic {
+	if t == nil {
+		return nil
+	}
+	hours := t.Series(time.Now().Add(-23 * time.Hour))[id]
+	if len(hours) == 0 {
+		return nil
+	}
+	totals := &DeviceTraffic{}
+	for _, h := range hours {
+		totals.InBytes += h.InBytes
+		totals.OutBytes += h.OutBytes
+	}
+	return totals
+}
+
+// TrafficSeries is a device's entry on /api/traffic.
+type TrafficSeries struct {
+	Device   string        `json:"device"`
+	InBytes  uint64        `json:"inBytes"`
+	OutBytes uint64        `json:"outBytes"`
+	Hours    []TrafficHour `json:"hours"`
+}
+
+// Traffic handles GET /api/traffic, the hourly traffic of the local devices
+// over the last ?hours= (24 by default, up to 48), busiest first. ?device=
+// selects a single device.
+func (s *MDNSServer) Traffic(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	if s.capture == nil {
+		writeJSON(w, http.StatusOK, map[string]interface{}{"enabled": false, "devices": []TrafficSeries{}})
+		return
+	}
+
+	hours := 24
+	if v := r.URL.Query().Get("hours"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > trafficHours {
+			writeError(w, http.StatusBadRequest, "invalid hours")
+			return
+		}
+		hours = n
+	}
+	device := r.URL.Query().Get("device")
+
+	devices := []TrafficSeries{}
+	for id, series := range s.traffic.Series(time.Now().Add(-time.Duration(hours-1) * time.Hour)) {
+		if device != "" && id != device {
+			continue
+		}
+		entry := TrafficSeries{Device: id, Hours: series}
+		for _, h := range series {
+			entry.InBytes += h.InBytes
+			entry.OutBytes += h.OutBytes
+		}
+		devices = append(devices, entry)
+	}
+	sort.Slice(devices, func(i, j int) bool {
+		a, b := devices[i].InBytes+devices[i].OutBytes, devices[j].InBytes+devices[j].OutBytes
+		if a != b {
+			return a > b
+		}
+		return devices[i].Device < devices[j].Device
+	})
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"enabled": true,
+		"capture": s.capture.Status(),
+		"devices": devices,
+	})
+}
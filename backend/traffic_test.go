@@ -0,0 +1,72 @@
+package main
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// TestTrafficAccounting verifies packets are counted per device, hour and
+// direction, and traffic off the local networks isn't
+func TestTrafficAccounting(t *testing.T) {
+	server := NewMDNSServer()
+	server.addService("10.0.0.2:_smb._tcp.local.:445", &MDNSService{Host: "nas.local", IP: "10.0.0.2", Type: "_smb._tcp.local.", Port: 445})
+	server.addService("10.0.0.3:_airplay._tcp.local.:7000", &MDNSService{Host: "tv.local", IP: "10.0.0.3", Type: "_airplay._tcp.local.", Port: 7000})
+	traffic := NewTrafficAccounting(newDeviceIndex(server))
+
+	now := time.Now()
+	traffic.Record(packetInfo{Src: net.ParseIP("10.0.0.2"), Dst: net.ParseIP("10.0.0.3"), Length: 1000}, now)
+	traffic.Record(packetInfo{Src: net.ParseIP("10.0.0.3"), Dst: net.ParseIP("10.0.0.2"), Length: 100}, now)
+	traffic.Record(packetInfo{Src: net.ParseIP("10.0.0.3"), Dst: net.ParseIP("8.8.8.8"), Length: 10}, now)
+	traffic.Record(packetInfo{Src: net.ParseIP("10.0.0.2"), Dst: net.ParseIP("10.0.0.3"), Length: 1}, now.Add(-time.Hour))
+
+	nas := traffic.Totals("nas.local")
+	if nas == nil || nas.OutBytes != 1001 || nas.InBytes != 100 {
+		t.Fatalf("Unexpected traffic for nas.local: %+v", nas)
+	}
+	tv := traffic.Totals("tv.local")
+	if tv == nil || tv.OutBytes != 110 || tv.InBytes != 1001 {
+		t.Fatalf("Unexpected traffic for tv.local: %+v", tv)
+	}
+	if hours := traffic.Series(now.Add(-time.Hour))["nas.local"]; len(hours) != 2 {
+		t.Fatalf("Expected 2 hours for nas.local, got %+v", hours)
+	}
+	if _, ok := traffic.Series(now.Add(-time.Hour))["8.8.8.8"]; ok {
+		t.Fatalf("Expected traffic of a public address not to be counted")
+	}
+}
+
+// TestTrafficHandler verifies /api/traffic lists the busiest device first
+func TestTrafficHandler(t *testing.T) {
+	server := NewMDNSServer()
+	server.addService("10.0.0.2:_smb._tcp.local.:445", &MDNSService{Host: "nas.local", IP: "10.0.0.2", Type: "_smb._tcp.local.", Port: 445})
+	server.addService("10.0.0.3:_airplay._tcp.local.:7000", &MDNSService{Host: "tv.local", IP: "10.0.0.3", Type: "_airplay._tcp.local.", Port: 7000})
+	server.traffic = NewTrafficAccounting(newDeviceIndex(server))
+	server.capture = NewCapture(server.traffic.Record)
+	server.traffic.Record(packetInfo{Src: net.ParseIP("10.0.0.2"), Dst: net.ParseIP("10.0.0.3"), Length: 5000}, time.Now())
+	server.traffic.Record(packetInfo{Src: net.ParseIP("10.0.0.3"), Dst: net.ParseIP("10.0.0.2"), Length: 10}, time.Now())
+
+	w := httptest.NewRecorder()
+	server.Traffic(w, httptest.NewRequest(http.MethodGet, "/api/traffic?hours=2", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected 200, got %d: %s", w.Code, w.Body)
+	}
+	var response struct {
+		Devices []TrafficSeries `json:"devices"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil {
+		t.Fatalf("Invalid response: %v", err)
+	}
+	if len(response.Devices) != 2 || response.Devices[0].Device != "nas.local" || response.Devices[0].OutBytes != 5000 {
+		t.Fatalf("Expected nas.local first, got %+v", response.Devices)
+	}
+
+	w = httptest.NewRecorder()
+	server.Traffic(w, httptest.NewRequest(http.MethodGet, "/api/traffic?hours=100", nil))
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("Expected 400 for too many hours, got %d", w.Code)
+	}
+}
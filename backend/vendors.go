@@ -0,0 +1,166 @@
+package main
+
+import (
+	"bufio"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// randomVendor is the vendor of locally administered MAC addresses, which
+// phones and laptops randomize per network: they name no manufacturer.
+const randomVendor = "random"
+
+var ouiPrefixPattern = regexp.MustCompile(`^[0-9A-Fa-f]{2}([:-][0-9A-Fa-f]{2}){2,5}$`)
+
+// VendorDB names the manufacturers of MAC addresses from their OUI, the
+// IEEE-assigned prefix.
+type VendorDB struct {
+	// prefixes maps prefix bits to vendors, keyed by prefix length: 24 for
+	// MA-L assignments, 28 and 36 for the smaller MA-M and MA-S blocks
+	prefixes map[int]map[uint64]string
+}
+
+// LoadVendorDB reads a Wireshark manuf file, or the IEEE registry as oui.txt
+// or oui.csv.
+func LoadVendorDB(path string) (*VendorDB, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	db := &VendorDB{prefixes: make(map[int]map[uint64]string)}
+	if strings.HasSuffix(strings.ToLower(path), ".csv") {
+		err = db.readCSV(f)
+	} else {
+		err = db.readText(f)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	if db.Len() == 0 {
+		return nil, fmt.Errorf("%s: no OUI assignments", path)
+	}
+	return db, nil
+}
+
+// readText reads manuf lines ("00:1B:63<TAB>Apple<TAB>Apple, Inc.", with a
+// "/28" suffix for smaller blocks) and oui.txt lines ("00-1B-63   (hex)
+// Apple, Inc.").
+func (db *VendorDB) readText(r io.Reader) error {
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") || strings.Contains(line, "(base 16)") {
+			continue
+		}
+		if prefix, vendor, ok := strings.Cut(line, "(hex)"); ok {
+			db.add(strings.TrimSpace(prefix), 24, strings.TrimSpace(vendor))
+			continue
+		}
+		fields := strings.Split(line, "\t")
+		if len(fields) < 2 {
+			continue
+		}
+		vendor := strings.TrimSpace(fields[len(fields)-1]) // the long name
+		prefix, bits := fields[0], 24
+		if p, b, ok := strings.Cut(prefix, "/"); ok {
+			n, err := strconv.Atoi(b)
+			if err != nil {
+				continue
+			}
+			prefix, bits = p, n
+		}
+		if !ouiPrefixPattern.MatchString(prefix) {
+			continue // an address line of oui.txt
+		}
+		db.add(prefix, bits, vendor)
+	}
+	return scanner.Err()
+}
+
+// readCSV reads the IEEE registry's CSV export: Registry, Assignment
+// (hex digits), Organization Name, Organization Address.
+func (db *VendorDB) readCSV(r io.Reader) error {
+	reader := csv.NewReader(r)
+	reader.FieldsPerRecord = -1
+	records, err := reader.ReadAll()
+	if err != nil {
+		return err
+	}
+	bits := map[string]int{"MA-L": 24, "MA-M": 28, "MA-S": 36}
+	for _, record := range records {
+		if len(record) < 3 || bits[record[0]] == 0 {
+			continue // the header
+		}
+		db.add(record[1], bits[record[0]], strings.TrimSpace(record[2]))
+	}
+	return nil
+}
+
+// add records vendor for the first bits of the hex digits in prefix.
+func (db *VendorDB) add(prefix string, bits int, vendor string) {
+	if vendor == "" || (bits != 24 && bits != 28 && bits != 36) {
+		return
+	}
+	value, ok := macBits(prefix, bits)
+	if !ok {
+		return
+	}
+	if db.prefixes[bits] == nil {
+		db.prefixes[bits] = make(map[uint64]string)
+	}
+	db.prefixes[bits][value] = vendor
+}
+
+// macBits returns the first bits of the hex digits of a MAC address or
+// prefix, ignoring separators.
+func macBits(mac string, bits int) (uint64, bool) {
+	digits := strings.Map(func(r rune) rune {
+		if r == ':' || r == '-' || r == '.' {
+			return -1
+		}
+		return r
+	}, mac)
+	if len(digits) < bits/4 {
+		return 0, false
+	}
+	value, err := strconv.ParseUint(digits[:bits/4], 16, 64)
+	return value, err == nil
+}
+
+// Len returns the number of assignments loaded.
+func (db *VendorDB) Len() int {
+	n := 0
+	for _, prefixes := range db.prefixes {
+		n += len(prefixes)
+	}
+	return n
+}
+
+// Lookup returns the vendor of mac: the most specific assignment holding
+// it, randomVendor for a locally administered address, or "" when unknown.
+func (db *VendorDB) Lookup(mac string) string {
+	mac = normalizeMAC(mac)
+	if first, ok := macBits(mac, 8); !ok {
+		return ""
+	} else if first&0x02 != 0 {
+		return randomVendor
+	}
+	if db == nil {
+		return ""
+	}
+	for _, bits := range []int{36, 28, 24} {
+		if value, ok := macBits(mac, bits); ok {
+			if vendor, ok := db.prefixes[bits][value]; ok {
+				return vendor
+			}
+		}
+	}
+	return ""
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// TestLoadVendorDB verifies the manuf, oui.txt and oui.csv formats, with
+// the most specific assignment winning
+func TestLoadVendorDB(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]string{
+		"manuf": "# Wireshark manuf\n00:1B:63\tApple\tApple, Inc.\n70:B3:D5:04:60:00/36\tAcme\tAcme Sensors\n70:B3:D5\tIeeeRegi\tIEEE Registration Authority\n",
+		"oui.txt": "OUI/MA-L                                                    Organization\n" +
+			"00-1B-63   (hex)\t\tApple, Inc.\n001B63     (base 16)\t\tApple, Inc.\n\t\t\t\t1 Infinite Loop\n\t\t\t\tCupertino  CA  95014\n\t\t\t\tUS\n",
+		"oui.csv": "Registry,Assignment,Organization Name,Organization Address\nMA-L,001B63,\"Apple, Inc.\",1 Infinite Loop Cupertino CA US 95014\n",
+	}
+	for name, content := range files {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		db, err := LoadVendorDB(path)
+		if err != nil {
+			t.Fatalf("Expected %s to load, got %v", name, err)
+		}
+		if got := db.Lookup("0:1b:63:aa:bb:cc"); got != "Apple, Inc." {
+			t.Fatalf("Expected Apple from %s, got %q", name, got)
+		}
+	}
+
+	db, _ := LoadVendorDB(filepath.Join(dir, "manuf"))
+	if got := db.Lookup("70:b3:d5:04:6a:01"); got != "Acme Sensors" {
+		t.Fatalf("Expected the MA-S block over its MA-L, got %q", got)
+	}
+	if got := db.Lookup("70:b3:d5:ff:00:01"); got != "IEEE Registration Authority" {
+		t.Fatalf("Expected the MA-L outside the MA-S block, got %q", got)
+	}
+	if got := db.Lookup("00:11:22:33:44:55"); got != "" {
+		t.Fatalf("Expected an unknown vendor, got %q", got)
+	}
+
+	if err := os.WriteFile(filepath.Join(dir, "empty"), []byte("# nothing\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LoadVendorDB(filepath.Join(dir, "empty")); err == nil {
+		t.Fatalf("Expected a file without assignments to fail")
+	}
+}
+
+// TestVendorRandomMAC verifies locally administered addresses are random,
+// without a database too
+func TestVendorRandomMAC(t *testing.T) {
+	var db *VendorDB
+	if got := db.Lookup("da:a1:19:00:00:01"); got != randomVendor {
+		t.Fatalf("Expected a randomized MAC, got %q", got)
+	}
+	if got := db.Lookup("00:1b:63:00:00:01"); got != "" {
+		t.Fatalf("Expected no vendor without a database, got %q", got)
+	}
+	if got := db.Lookup(""); got != "" {
+		t.Fatalf("Expected no vendor without a MAC, got %q", got)
+	}
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// apiVersion is the current stable API version. Every endpoint is served
+// under /api/<apiVersion>/; breaking changes go into a new version.
+const apiVersion = "v1"
+
+// The unversioned paths predate /api/v1 and keep working until legacySunset,
+// announced with Deprecation and Sunset headers (RFC 9745, RFC 8594).
+var (
+	legacyDeprecated = time.Date(2026, time.October, 14, 0, 0, 0, 0, time.UTC)
+	legacySunset     = time.Date(2027, time.October, 14, 0, 0, 0, 0, time.UTC)
+)
+
+// versionedPath maps a legacy path such as /api/devices or /discover to its
+// /api/v1 equivalent.
+func versionedPath(legacy string) string {
+	return "/api/" + apiVersion + strings.TrimPrefix(legacy, "/api")
+}
+
+// handleAPI registers h under its versioned path and under the legacy path,
+// where responses carry deprecation headers pointing at the successor.
+func handleAPI(mux *http.ServeMux, legacy string, h http.HandlerFunc) {
+	mux.HandleFunc(versionedPath(legacy), h)
+	mux.HandleFunc(legacy, deprecated(h))
+}
+
+func deprecated(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Deprecation", fmt.Sprintf("@%d", legacyDeprecated.Unix()))
+		w.Header().Set("Sunset", legacySunset.Format(http.TimeFormat))
+		w.Header().Set("Link", fmt.Sprintf("<%s>; rel=\"successor-version\"", versionedPath(r.URL.Path)))
+		h(w, r)
+	}
+}
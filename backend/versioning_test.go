@@ -0,0 +1,41 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// TestHandleAPIDeprecation verifies legacy paths keep working with
+// deprecation headers while /api/v1 paths are served without them
+func TestHandleAPIDeprecation(t *testing.T) {
+	mux := http.NewServeMux()
+	handleAPI(mux, "/api/devices/{id}", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, map[string]string{"id": r.PathValue("id")})
+	})
+
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/api/v1/devices/printer.local", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Expected 200 on the versioned path, got %d", rec.Code)
+	}
+	if rec.Header().Get("Deprecation") != "" {
+		t.Fatalf("Expected no Deprecation header on the versioned path")
+	}
+
+	rec = httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/api/devices/printer.local", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Expected 200 on the legacy path, got %d", rec.Code)
+	}
+	if rec.Header().Get("Deprecation") == "" || rec.Header().Get("Sunset") == "" {
+		t.Fatalf("Expected Deprecation and Sunset headers on the legacy path")
+	}
+	if link := rec.Header().Get("Link"); link != `</api/v1/devices/printer.local>; rel="successor-version"` {
+		t.Fatalf("Expected successor link, got %q", link)
+	}
+
+	if versionedPath("/discover") != "/api/v1/discover" {
+		t.Fatalf("Expected /discover to map to /api/v1/discover, got %s", versionedPath("/discover"))
+	}
+}
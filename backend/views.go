@@ -0,0 +1,293 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// viewsBucket is the Store bucket dashboard views are kept in.
+const viewsBucket = "views"
+
+// defaultProfile is the profile of view requests that name none.
+const defaultProfile = "default"
+
+// maxViewName bounds the length of profile and view names.
+const maxViewName = 64
+
+// View is a saved dashboard layout: the filters, sort order and columns of
+// the device table, and the devices pinned to its top. Views belong to a
+// named profile, so each person's layouts follow them across browsers.
+type View struct {
+	Profile string            `json:"profile"`
+	Name    string            `json:"name"`
+	Filters map[string]string `json:"filters,omitempty"` // e.g. {"category": "printer", "q": "office"}
+	// Sort lists the columns to sort by, in order, "-" first for
+	// descending, e.g. ["category", "-lastSeen"]
+	Sort      []string `json:"sort,omitempty"`
+	Columns   []string `json:"columns,omitempty"`
+	Pinned    []string `json:"pinned,omitempty"` // device IDs
+	CreatedAt int64    `json:"createdAt"`
+	UpdatedAt int64    `json:"updatedAt"`
+}
+
+var errViewExists = errors.New("view already exists")
+
+// validateViewName checks a profile or view name, which is used in URLs.
+func validateViewName(kind, name string) error {
+	if name == "" {
+		return fmt.Errorf("%s name is required", kind)
+	}
+	if len(name) > maxViewName {
+		return fmt.Errorf("%s name is longer than %d bytes", kind, maxViewName)
+	}
+	if strings.ContainsAny(name, "/\x00") {
+		return fmt.Errorf("%s name must not contain '/'", kind)
+	}
+	return nil
+}
+
+func (v *View) validate() error {
+	if err := validateViewName("profile", v.Profile); err != nil {
+		return err
+	}
+	if err := validateViewName("view", v.Name); err != nil {
+		return err
+	}
+	for _, column := range append(append([]string{}, v.Sort...), v.Columns...) {
+		if strings.TrimPrefix(column, "-") == "" {
+			return errors.New("sort and columns must not contain empty column names")
+		}
+	}
+	return nil
+}
+
+func (v *View) copy() *View {
+	c := *v
+	if v.Filters != nil {
+		c.Filters = make(map[string]string, len(v.Filters))
+		for k, value := range v.Filters {
+			c.Filters[k] = value
+		}
+	}
+	c.Sort = append([]string(nil), v.Sort...)
+	c.Columns = append([]string(nil), v.Columns...)
+	c.Pinned = append([]string(nil), v.Pinned...)
+	return &c
+}
+
+// ViewStore keeps dashboard views in memory and writes every change through
+// to the persistent Store.
+type ViewStore struct {
+	mu    sync.RWMutex
+	store Store
+	views map[string]*View // by profile/name
+}
+
+// NewViewStore loads all views from store.
+func NewViewStore(store Store) (*ViewStore, error) {
+	v := &ViewStore{store: store, views: make(map[string]*View)}
+	entries, err := store.Load(viewsBucket)
+	if err != nil {
+		return nil, err
+	}
+	for key, data := range entries {
+		view := &View{}
+		if err := json.Unmarshal(data, view); err != nil {
+			return nil, fmt.Errorf("view %s: %v", key, err)
+		}
+		v.views[siteKey(view.Profile, view.Name)] = view
+	}
+	return v, nil
+}
+
+// Get returns a copy of a profile's view, or nil.
+func (v *ViewStore) Get(profile, name string) *View {
+	v.mu.RLock()
+	defer v.mu.RUnlock()
+	if view, ok := v.views[siteKey(profile, name)]; ok {
+		return view.copy()
+	}
+	return nil
+}
+
+// List returns copies of a profile's views, by name.
+func (v *ViewStore) List(profile string) []*View {
+	v.mu.RLock()
+	defer v.mu.RUnlock()
+	views := make([]*View, 0)
+	for _, view := range v.views {
+		if view.Profile == profile {
+			views = append(views, view.copy())
+		}
+	}
+	sort.Slice(views, func(i, j int) bool { return views[i].Name < views[j].Name })
+	return views
+}
+
+// Profiles lists the profiles that have views.
+func (v *ViewStore) Profiles() []string {
+	v.mu.RLock()
+	defer v.mu.RUnlock()
+	seen := make(map[string]bool)
+	profiles := make([]string, 0)
+	for _, view := range v.views {
+		if !seen[view.Profile] {
+			seen[view.Profile] = true
+			profiles = append(profiles, view.Profile)
+		}
+	}
+	sort.Strings(profiles)
+	return profiles
+}
+
+// Save stores view, replacing the profile's view of that name unless create
+// is set, in which case an existing view is errViewExists.
+func (v *ViewStore) Save(view *View, create bool) (*View, error) {
+	if err := view.validate(); err != nil {
+		return nil, err
+	}
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	key := siteKey(view.Profile, view.Name)
+	now := time.Now().Unix()
+	saved := view.copy()
+	saved.CreatedAt, saved.UpdatedAt = now, now
+	if existing, ok := v.views[key]; ok {
+		if create {
+			return nil, errViewExists
+		}
+		saved.CreatedAt = existing.CreatedAt
+	}
+
+	data, err := json.Marshal(saved)
+	if err != nil {
+		return nil, err
+	}
+	if err := v.store.Put(viewsBucket, map[string][]byte{key: data}); err != nil {
+		return nil, err
+	}
+	v.views[key] = saved
+	return saved.copy(), nil
+}
+
+// Delete removes a profile's view and reports whether there was one.
+func (v *ViewStore) Delete(profile, name string) (bool, error) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	key := siteKey(profile, name)
+	if _, ok := v.views[key]; !ok {
+		return false, nil
+	}
+	if err := v.store.Delete(viewsBucket, key); err != nil {
+		return false, err
+	}
+	delete(v.views, key)
+	return true, nil
+}
+
+// viewProfile returns the profile a views request is for: ?profile=, or
+// the default profile.
+func viewProfile(r *http.Request) string {
+	if profile := r.URL.Query().Get("profile"); profile != "" {
+		return profile
+	}
+	return defaultProfile
+}
+
+// Views handles /api/views: GET lists the views of the profile selected by
+// ?profile= (and the profiles there are), POST creates one from
+// {"name", "filters", "sort", "columns", "pinned"}, with 409 when the
+// profile already has a view of that name.
+func (s *MDNSServer) Views(w http.ResponseWriter, r *http.Request) {
+	profile := viewProfile(r)
+
+	switch r.Method {
+	case http.MethodGet:
+		writeJSON(w, http.StatusOK, map[string]interface{}{
+			"profile":  profile,
+			"profiles": s.views.Profiles(),
+			"views":    s.views.List(profile),
+		})
+
+	case http.MethodPost:
+		var view View
+		if err := json.NewDecoder(r.Body).Decode(&view); err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		view.Profile = profile
+		if err := view.validate(); err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		saved, err := s.views.Save(&view, true)
+		switch {
+		case errors.Is(err, errViewExists):
+			writeError(w, http.StatusConflict, fmt.Sprintf("%q: %v", view.Name, err))
+		case err != nil:
+			writeError(w, http.StatusInternalServerError, err.Error())
+		default:
+			writeJSON(w, http.StatusCreated, saved)
+		}
+
+	default:
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+	}
+}
+
+// ViewItem handles GET, PUT and DELETE /api/views/{name} of the profile selected
+// by ?profile=. A PUT replaces the whole view, creating it if needed.
+func (s *MDNSServer) ViewItem(w http.ResponseWriter, r *http.Request) {
+	profile, name := viewProfile(r), r.PathValue("name")
+
+	switch r.Method {
+	case http.MethodGet:
+		view := s.views.Get(profile, name)
+		if view == nil {
+			writeError(w, http.StatusNotFound, "view not found")
+			return
+		}
+		writeJSON(w, http.StatusOK, view)
+
+	case http.MethodPut:
+		var view View
+		if err := json.NewDecoder(r.Body).Decode(&view); err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		view.Profile, view.Name = profile, name
+		if err := view.validate(); err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		saved, err := s.views.Save(&view, false)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		writeJSON(w, http.StatusOK, saved)
+
+	case http.MethodDelete:
+		removed, err := s.views.Delete(profile, name)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		if !removed {
+			writeError(w, http.StatusNotFound, "view not found")
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]string{"status": "ok"})
+
+	default:
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+	}
+}
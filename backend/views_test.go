@@ -0,0 +1,97 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// TestViewStorePersistence verifies views survive reloading the store, and
+// replacing a view keeps its creation time
+func TestViewStorePersistence(t *testing.T) {
+	dir := t.TempDir()
+	views, err := NewViewStore(openTestStore(t, "json", dir))
+	if err != nil {
+		t.Fatalf("Failed to create store: %v", err)
+	}
+
+	created, err := views.Save(&View{Profile: "alex", Name: "printers", Filters: map[string]string{"category": "printer"}, Sort: []string{"-lastSeen"}}, true)
+	if err != nil {
+		t.Fatalf("Failed to save view: %v", err)
+	}
+	if _, err := views.Save(&View{Profile: "alex", Name: "printers"}, true); err != errViewExists {
+		t.Fatalf("Expected creating an existing view to fail, got %v", err)
+	}
+	if _, err := views.Save(&View{Profile: "alex", Name: "printers", Columns: []string{"name", "ip"}, Pinned: []string{"office-printer.local"}}, false); err != nil {
+		t.Fatalf("Failed to replace view: %v", err)
+	}
+
+	reloaded, err := NewViewStore(openTestStore(t, "json", dir))
+	if err != nil {
+		t.Fatalf("Failed to reload store: %v", err)
+	}
+	view := reloaded.Get("alex", "printers")
+	if view == nil || view.Filters != nil || len(view.Columns) != 2 || view.Pinned[0] != "office-printer.local" {
+		t.Fatalf("Expected the replaced view after reload, got %+v", view)
+	}
+	if view.CreatedAt != created.CreatedAt {
+		t.Fatalf("Expected the creation time to be kept, got %d", view.CreatedAt)
+	}
+	if reloaded.Get(defaultProfile, "printers") != nil {
+		t.Fatalf("Expected views to be per profile")
+	}
+}
+
+// TestViewsHandler verifies the /api/views CRUD round trip
+func TestViewsHandler(t *testing.T) {
+	server := NewMDNSServer()
+	server.views, _ = NewViewStore(openTestStore(t, "json", t.TempDir()))
+
+	do := func(handler http.HandlerFunc, method, target, body string, name string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, target, strings.NewReader(body))
+		req.SetPathValue("name", name)
+		rec := httptest.NewRecorder()
+		handler(rec, req)
+		return rec
+	}
+
+	rec := do(server.Views, http.MethodPost, "/api/views?profile=alex", `{"name": "garage", "filters": {"q": "garage"}}`, "")
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("Expected 201, got %d %s", rec.Code, rec.Body.String())
+	}
+	if rec := do(server.Views, http.MethodPost, "/api/views?profile=alex", `{"name": "garage"}`, ""); rec.Code != http.StatusConflict {
+		t.Fatalf("Expected 409 for an existing view, got %d", rec.Code)
+	}
+	if rec := do(server.Views, http.MethodPost, "/api/views", `{"name": ""}`, ""); rec.Code != http.StatusBadRequest {
+		t.Fatalf("Expected 400 without a name, got %d", rec.Code)
+	}
+
+	rec = do(server.Views, http.MethodGet, "/api/views?profile=alex", "", "")
+	var list struct {
+		Profiles []string `json:"profiles"`
+		Views    []View   `json:"views"`
+	}
+	if err := json.NewDecoder(rec.Body).Decode(&list); err != nil {
+		t.Fatalf("Expected a JSON response, got %v", err)
+	}
+	if len(list.Profiles) != 1 || list.Profiles[0] != "alex" || len(list.Views) != 1 || list.Views[0].Filters["q"] != "garage" {
+		t.Fatalf("Expected alex's garage view, got %+v", list)
+	}
+
+	rec = do(server.ViewItem, http.MethodPut, "/api/views/garage?profile=alex", `{"name": "ignored", "sort": ["name"]}`, "garage")
+	var view View
+	if err := json.NewDecoder(rec.Body).Decode(&view); err != nil || view.Name != "garage" || view.Sort[0] != "name" {
+		t.Fatalf("Expected the path to name the replaced view, got %+v (%v)", view, err)
+	}
+	if rec := do(server.ViewItem, http.MethodGet, "/api/views/garage", "", "garage"); rec.Code != http.StatusNotFound {
+		t.Fatalf("Expected 404 in the default profile, got %d", rec.Code)
+	}
+	if rec := do(server.ViewItem, http.MethodDelete, "/api/views/garage?profile=alex", "", "garage"); rec.Code != http.StatusOK {
+		t.Fatalf("Expected the view to be deleted, got %d", rec.Code)
+	}
+	if rec := do(server.ViewItem, http.MethodGet, "/api/views/garage?profile=alex", "", "garage"); rec.Code != http.StatusNotFound {
+		t.Fatalf("Expected 404 after deleting, got %d", rec.Code)
+	}
+}
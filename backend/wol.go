@@ -0,0 +1,101 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+)
+
+// wakePort is the UDP port magic packets are sent to, the discard port most
+// network cards listen on.
+const wakePort = 9
+
+// magicPacket is the Wake-on-LAN packet for mac: six 0xFF bytes, then the
+// MAC address sixteen times.
+func magicPacket(mac net.HardwareAddr) []byte {
+	packet := make([]byte, 0, 6+16*len(mac))
+	for i := 0; i < 6; i++ {
+		packet = append(packet, 0xff)
+	}
+	for i := 0; i < 16; i++ {
+		packet = append(packet, mac...)
+	}
+	return packet
+}
+
+// wakeTargets are the broadcast addresses magic packets go to on iface: the
+// limited broadcast and the interface's directed broadcast, which routers
+// that drop the former may forward.
+var wakeTargets = func(iface string) []string {
+	targets := []string{net.JoinHostPort("255.255.255.255", fmt.Sprint(wakePort))}
+	if ifi, err := net.InterfaceByName(iface); err == nil {
+		if addrs, err := ifi.Addrs(); err == nil {
+			for _, addr := range addrs {
+				ipnet, ok := addr.(*net.IPNet)
+				if !ok || ipnet.IP.To4() == nil {
+					continue
+				}
+				broadcast := make(net.IP, 4)
+				for i := range broadcast {
+					broadcast[i] = ipnet.IP.To4()[i] | ^ipnet.Mask[len(ipnet.Mask)-4+i]
+				}
+				targets = append(targets, net.JoinHostPort(broadcast.String(), fmt.Sprint(wakePort)))
+			}
+		}
+	}
+	return targets
+}
+
+// wake sends a magic packet for mac to every wake target on iface and
+// returns the addresses it went to.
+func wake(mac, iface string) ([]string, error) {
+	hw, err := net.ParseMAC(mac)
+	if err != nil || len(hw) != 6 {
+		return nil, fmt.Errorf("invalid MAC address %q", mac)
+	}
+	listen := net.ListenConfig{Control: broadcastControl}
+	conn, err := listen.ListenPacket(context.Background(), "udp4", ":0")
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	packet := magicPacket(hw)
+	var sent []string
+	var errs []error
+	for _, target := range wakeTargets(iface) {
+		addr, err := net.ResolveUDPAddr("udp4", target)
+		if err == nil {
+			_, err = conn.WriteTo(packet, addr)
+		}
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		sent = append(sent, target)
+	}
+	if len(sent) == 0 {
+		return nil, errors.Join(errs...)
+	}
+	return sent, nil
+}
+
+// deviceMAC returns the MAC address of a device of this instance's site, by
+// ID, from the ARP table entry of any of its addresses.
+func (s *MDNSServer) deviceMAC(id string) string {
+	if mac, err := net.ParseMAC(id); err == nil {
+		return mac.String()
+	}
+	id = strings.TrimSuffix(id, ".")
+	for _, service := range s.listServices(s.site) {
+		if deviceID(&service) != id && service.IP != id {
+			continue
+		}
+		if mac := neighbors.lookup(service.IP); mac != "" {
+			return mac
+		}
+	}
+	return neighbors.lookup(id)
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"bytes"
+	"net"
+	"testing"
+	"time"
+)
+
+// TestMagicPacket verifies the magic packet layout
+func TestMagicPacket(t *testing.T) {
+	mac, _ := net.ParseMAC("00:1b:63:aa:bb:cc")
+	packet := magicPacket(mac)
+	if len(packet) != 102 || !bytes.Equal(packet[:6], bytes.Repeat([]byte{0xff}, 6)) {
+		t.Fatalf("Expected 6 bytes of 0xff and 16 copies of the MAC, got %x", packet)
+	}
+	for i := 0; i < 16; i++ {
+		if !bytes.Equal(packet[6+6*i:12+6*i], mac) {
+			t.Fatalf("Expected copy %d of the MAC, got %x", i, packet[6+6*i:12+6*i])
+		}
+	}
+}
+
+// TestWake verifies the packet reaches the wake targets
+func TestWake(t *testing.T) {
+	conn, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	defer conn.Close()
+
+	previous := wakeTargets
+	wakeTargets = func(string) []string { return []string{conn.LocalAddr().String()} }
+	defer func() { wakeTargets = previous }()
+
+	sent, err := wake("00-1B-63-AA-BB-CC", "lo0")
+	if err != nil || len(sent) != 1 {
+		t.Fatalf("Expected the packet to be sent, got %v %v", sent, err)
+	}
+	buf := make([]byte, 200)
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	n, _, err := conn.ReadFrom(buf)
+	if err != nil || n != 102 || buf[6] != 0x00 || buf[11] != 0xcc {
+		t.Fatalf("Expected the magic packet, got %x (%v)", buf[:n], err)
+	}
+
+	if _, err := wake("00:1b:63", "lo0"); err == nil {
+		t.Fatalf("Expected a short MAC to be rejected")
+	}
+}
@@ -0,0 +1,281 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/websocket"
+)
+
+// wsFrame is a message on the /discover/ws connection: an "event", "gap" or
+// "disconnect" from the server, like the /discover stream's, or the
+// "response" to a command, correlated by the command's ID.
+type wsFrame struct {
+	Type   string          `json:"type"`
+	Data   json.RawMessage `json:"data,omitempty"`
+	ID     string          `json:"id,omitempty"`
+	OK     *bool           `json:"ok,omitempty"`
+	Result interface{}     `json:"result,omitempty"`
+	Error  string          `json:"error,omitempty"`
+}
+
+// wsCommand is a command frame from the client. Connections opened with a
+// session cookie send the session's CSRF token in every command frame, as
+// browsers can't add headers to WebSocket messages.
+type wsCommand struct {
+	ID        string          `json:"id"`
+	Command   string          `json:"command"`
+	Params    json.RawMessage `json:"params"`
+	CSRFToken string          `json:"csrfToken,omitempty"`
+}
+
+// wsConn serializes the frames written to a WebSocket, which events and
+// command responses share.
+type wsConn struct {
+	mu sync.Mutex
+	ws *websocket.Conn
+}
+
+func (c *wsConn) send(frame wsFrame) error {
+	data, err := json.Marshal(frame)
+	if err != nil {
+		return err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return websocket.Message.Send(c.ws, string(data))
+}
+
+// DiscoverWS handles /discover/ws, the event stream over a WebSocket, with
+// the same ?site=, ?replay=, ?after=, ?filter= and ?compact= parameters as /discover. The
+// client can send command frames on the same connection: {"id": "1",
+// "command": "scan" | "wake" | "tag", "params": {...}}, each answered by a
+// response frame with its ID. Browsers may only connect from pages of the
+// same host, as they send the session cookie along whatever page opens the
+// socket.
+func (s *MDNSServer) DiscoverWS(w http.ResponseWriter, r *http.Request) {
+	site := s.siteParam(r)
+	replay, err := s.replayParam(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	filter, err := filterParam(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	after, err := resumeParam(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	server := websocket.Server{
+		Handshake: func(_ *websocket.Config, r *http.Request) error { return checkOrigin(r) },
+		Handler: func(ws *websocket.Conn) {
+			s.serveWS(&wsConn{ws: ws}, r, site, filter, replay, after)
+		},
+	}
+	server.ServeHTTP(w, r)
+}
+
+func (s *MDNSServer) serveWS(conn *wsConn, r *http.Request, site string, filter *Filter, replay time.Duration, after uint64) {
+	client := newStreamClient(r, s.clientBuffer)
+	client.transport = "websocket"
+	client.site = site
+	client.filter = filter
+	client.after = after
+	backlog, gap := s.subscribeClient(client, replay)
+	defer s.unregisterClient(client)
+
+	if gap {
+		if err := conn.send(wsFrame{Type: "gap", Data: json.RawMessage(fmt.Sprintf(`{"after":%d}`, after))}); err != nil {
+			return
+		}
+	}
+
+	for _, response := range backlog {
+		if !s.delivers(client, &response.Service) {
+			continue
+		}
+		if err := conn.send(wsFrame{Type: "event", Data: newStreamEvent(response).encoded(client.compact)}); err != nil {
+			return
+		}
+		client.delivered.Add(1)
+	}
+
+	closed := make(chan struct{})
+	go func() {
+		defer close(closed)
+		s.readCommands(conn, r)
+	}()
+
+	for {
+		select {
+		case <-closed:
+			return
+		case <-client.disconnect:
+			data, _ := json.Marshal(map[string]interface{}{
+				"reason":  "slow client: event queue full for longer than " + s.slowClientTimeout.String(),
+				"dropped": client.dropped.Load(),
+			})
+			conn.send(wsFrame{Type: "disconnect", Data: data})
+			return
+		case ev := <-client.ch:
+			if err := conn.send(wsFrame{Type: "event", Data: ev.encoded(client.compact)}); err != nil {
+				return
+			}
+			client.delivered.Add(1)
+		}
+	}
+}
+
+// checkOrigin accepts a WebSocket handshake without an Origin, as sent by
+// clients other than browsers, or from a page of the host it connects to.
+func checkOrigin(r *http.Request) error {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return nil
+	}
+	u, err := url.Parse(origin)
+	if err != nil || !strings.EqualFold(u.Host, r.Host) {
+		return fmt.Errorf("origin %s not allowed", origin)
+	}
+	return nil
+}
+
+// readCommands runs the client's commands until the connection closes.
+// Commands run concurrently; their responses carry the command's ID. r is
+// the request that opened the connection.
+func (s *MDNSServer) readCommands(conn *wsConn, r *http.Request) {
+	for {
+		var data []byte
+		if err := websocket.Message.Receive(conn.ws, &data); err != nil {
+			return
+		}
+		var cmd wsCommand
+		if err := json.Unmarshal(data, &cmd); err != nil {
+			conn.send(wsResponse("", nil, fmt.Errorf("invalid command frame: %v", err)))
+			continue
+		}
+		if err := s.authorizeCommand(r, cmd); err != nil {
+			conn.send(wsResponse(cmd.ID, nil, err))
+			continue
+		}
+		go func() {
+			result, err := s.runCommand(cmd)
+			conn.send(wsResponse(cmd.ID, result, err))
+		}()
+	}
+}
+
+// authorizeCommand holds a command frame to the rules of the REST requests
+// that change state, as every command does: it must come from the
+// -admin-allow networks, and on a connection opened with a session cookie
+// carry the session's CSRF token while the session lasts. The upgrade is a
+// GET, which neither rule applies to.
+func (s *MDNSServer) authorizeCommand(r *http.Request, cmd wsCommand) error {
+	ip := remoteIP(r)
+	if !s.adminAllow.Allows(net.ParseIP(ip)) {
+		s.adminAllow.audit.Record(auditAdminDenied, ip, "WS "+cmd.Command+" "+r.URL.Path)
+		return fmt.Errorf("changes are not allowed from %s", ip)
+	}
+	if !s.auth.Enabled() {
+		return nil
+	}
+	if _, ok := bearerToken(r); ok {
+		// Checked when the connection was opened
+		return nil
+	}
+	_, session := s.auth.session(r)
+	if session == nil {
+		return errors.New("authentication required")
+	}
+	if subtle.ConstantTimeCompare([]byte(cmd.CSRFToken), []byte(session.csrf)) != 1 {
+		return errors.New("missing or invalid csrfToken")
+	}
+	return nil
+}
+
+func wsResponse(id string, result interface{}, err error) wsFrame {
+	ok := err == nil
+	frame := wsFrame{Type: "response", ID: id, OK: &ok, Result: result}
+	if err != nil {
+		frame.Error = err.Error()
+	}
+	return frame
+}
+
+// runCommand runs a command frame's command:
+//   - scan starts a discovery burst, browsing and querying every service
+//     type right away;
+//   - wake sends a Wake-on-LAN packet to {"mac"}, or to the MAC address of
+//     {"device"} from the ARP table;
+//   - tag adds the tags {"add"} to {"device"} of {"site"} and removes
+//     {"remove"}.
+func (s *MDNSServer) runCommand(cmd wsCommand) (interface{}, error) {
+	var params struct {
+		MAC    string   `json:"mac"`
+		Device string   `json:"device"`
+		Site   string   `json:"site"`
+		Add    []string `json:"add"`
+		Remove []string `json:"remove"`
+	}
+	if len(cmd.Params) > 0 {
+		if err := json.Unmarshal(cmd.Params, &params); err != nil {
+			return nil, fmt.Errorf("invalid params: %v", err)
+		}
+	}
+
+	switch cmd.Command {
+	case "scan":
+		if s.bursting.Load() {
+			return map[string]string{"status": "running"}, nil
+		}
+		go s.burstDiscovery()
+		return map[string]string{"status": "started"}, nil
+
+	case "wake":
+		mac := params.MAC
+		if mac == "" && params.Device != "" {
+			if mac = s.deviceMAC(params.Device); mac == "" {
+				return nil, fmt.Errorf("no MAC address known for %s", params.Device)
+			}
+		}
+		if mac == "" {
+			return nil, errors.New("mac or device is required")
+		}
+		s.mu.RLock()
+		iface := s.currentIface
+		s.mu.RUnlock()
+		sent, err := wake(mac, iface)
+		if err != nil {
+			return nil, err
+		}
+		return map[string]interface{}{"mac": mac, "sent": sent}, nil
+
+	case "tag":
+		if params.Device == "" {
+			return nil, errors.New("device is required")
+		}
+		site := params.Site
+		if site == "" {
+			site = s.site
+		}
+		return s.metadata.Update(site, params.Device, func(d *DeviceMetadata) {
+			d.tag(params.Add, params.Remove)
+		})
+
+	default:
+		return nil, fmt.Errorf("unknown command %q", cmd.Command)
+	}
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/net/websocket"
+)
+
+// dialWS connects to a test server running DiscoverWS.
+func dialWS(t *testing.T, server *MDNSServer, query string) *websocket.Conn {
+	t.Helper()
+	ts := httptest.NewServer(http.HandlerFunc(server.DiscoverWS))
+	t.Cleanup(ts.Close)
+	ws, err := websocket.Dial("ws"+strings.TrimPrefix(ts.URL, "http")+"/discover/ws"+query, "", ts.URL)
+	if err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	t.Cleanup(func() { ws.Close() })
+	return ws
+}
+
+// receiveFrame reads the next frame of the given type, skipping others.
+func receiveFrame(t *testing.T, ws *websocket.Conn, frameType string) wsFrame {
+	t.Helper()
+	ws.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for {
+		var frame wsFrame
+		if err := websocket.JSON.Receive(ws, &frame); err != nil {
+			t.Fatalf("Expected a %s frame, got %v", frameType, err)
+		}
+		if frame.Type == frameType {
+			return frame
+		}
+	}
+}
+
+// TestDiscoverWSEvents verifies the WebSocket carries replayed and live
+// events like the /discover stream, compact when asked
+func TestDiscoverWSEvents(t *testing.T) {
+	server := NewMDNSServer()
+	server.replay = NewReplayBuffer(time.Minute)
+	server.fanOut(newStreamEvent(&DiscoveryResponse{Service: MDNSService{Name: "printer", Site: defaultSite}}))
+
+	ws := dialWS(t, server, "?replay=1m&compact=1")
+	var event map[string]interface{}
+	json.Unmarshal(receiveFrame(t, ws, "event").Data, &event)
+	if event["sv"].(map[string]interface{})["n"] != "printer" {
+		t.Fatalf("Expected the replayed printer event, compact, got %v", event)
+	}
+
+	// The client is registered before the backlog is sent
+	server.fanOut(newStreamEvent(&DiscoveryResponse{Service: MDNSService{Name: "tv", Site: defaultSite}}))
+	json.Unmarshal(receiveFrame(t, ws, "event").Data, &event)
+	if event["sv"].(map[string]interface{})["n"] != "tv" {
+		t.Fatalf("Expected the live tv event, got %v", event)
+	}
+}
+
+// TestDiscoverWSCommands verifies command responses are correlated by ID,
+// and bad commands answered with errors
+func TestDiscoverWSCommands(t *testing.T) {
+	server := NewMDNSServer()
+	server.metadata, _ = NewMetadataStore(openTestStore(t, "json", t.TempDir()))
+	server.metadata.Update(defaultSite, "nas.local", func(d *DeviceMetadata) { d.Tags = []string{"backup"} })
+	ws := dialWS(t, server, "")
+
+	websocket.Message.Send(ws, `{"id": "7", "command": "tag", "params": {"device": "nas.local", "add": ["storage", " office "], "remove": ["backup"]}}`)
+	frame := receiveFrame(t, ws, "response")
+	if frame.ID != "7" || frame.OK == nil || !*frame.OK {
+		t.Fatalf("Expected a successful response to command 7, got %+v", frame)
+	}
+	if tags := server.metadata.Get(defaultSite, "nas.local").Tags; strings.Join(tags, ",") != "office,storage" {
+		t.Fatalf("Expected the tags to be updated, got %v", tags)
+	}
+
+	for _, tc := range []struct {
+		frame string
+		id    string
+		error string
+	}{
+		{`{"id": "8", "command": "reboot"}`, "8", `unknown command "reboot"`},
+		{`{"id": "9", "command": "tag", "params": {}}`, "9", "device is required"},
+		{`{"id": "10", "command": "wake", "params": {"mac": "nope"}}`, "10", `invalid MAC address "nope"`},
+		{`not json`, "", "invalid command frame"},
+	} {
+		websocket.Message.Send(ws, tc.frame)
+		frame := receiveFrame(t, ws, "response")
+		if frame.ID != tc.id || frame.OK == nil || *frame.OK || !strings.HasPrefix(frame.Error, tc.error) {
+			t.Fatalf("Expected error %q for %s, got %+v", tc.error, tc.frame, frame)
+		}
+	}
+}
+
+// TestDiscoverWSOrigin verifies browsers can't connect from pages of other
+// hosts
+func TestDiscoverWSOrigin(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(NewMDNSServer().DiscoverWS))
+	defer ts.Close()
+	url := "ws" + strings.TrimPrefix(ts.URL, "http") + "/discover/ws"
+	if ws, err := websocket.Dial(url, "", "http://evil.example"); err == nil {
+		ws.Close()
+		t.Fatalf("Expected a foreign origin to be refused")
+	}
+}
+
+// TestDiscoverWSCommandAuthorization verifies commands are held to the
+// allowlist, and need the session's CSRF token on a session connection
+func TestDiscoverWSCommandAuthorization(t *testing.T) {
+	auth := NewAuth("hunter2", "", time.Hour)
+	server := NewMDNSServer()
+	server.auth = auth
+	server.metadata, _ = NewMetadataStore(openTestStore(t, "json", t.TempDir()))
+	mux := http.NewServeMux()
+	handleAPI(mux, "/api/login", auth.Login)
+	mux.HandleFunc("/discover/ws", server.DiscoverWS)
+	ts := httptest.NewServer(auth.Wrap(mux))
+	defer ts.Close()
+
+	resp, err := http.Post(ts.URL+"/api/login", "application/json", strings.NewReader(`{"password":"hunter2"}`))
+	if err != nil {
+		t.Fatalf("Failed to log in: %v", err)
+	}
+	var info sessionInfo
+	json.NewDecoder(resp.Body).Decode(&info)
+	resp.Body.Close()
+
+	config, _ := websocket.NewConfig("ws"+strings.TrimPrefix(ts.URL, "http")+"/discover/ws", ts.URL)
+	config.Header.Set("Cookie", resp.Cookies()[0].String())
+	ws, err := websocket.DialConfig(config)
+	if err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	defer ws.Close()
+
+	websocket.Message.Send(ws, `{"id": "1", "command": "tag", "params": {"device": "nas.local", "add": ["x"]}}`)
+	if frame := receiveFrame(t, ws, "response"); *frame.OK || frame.Error != "missing or invalid csrfToken" {
+		t.Fatalf("Expected a command without the CSRF token to be refused, got %+v", frame)
+	}
+	websocket.Message.Send(ws, `{"id": "2", "command": "tag", "params": {"device": "nas.local", "add": ["x"]}, "csrfToken": "`+info.CSRFToken+`"}`)
+	if frame := receiveFrame(t, ws, "response"); !*frame.OK {
+		t.Fatalf("Expected a command with the CSRF token to run, got %+v", frame)
+	}
+
+	denied := NewMDNSServer()
+	denied.adminAllow, _ = ParseAdminAllowlist("10.20.0.0/24")
+	ws = dialWS(t, denied, "")
+	websocket.Message.Send(ws, `{"id": "3", "command": "scan"}`)
+	if frame := receiveFrame(t, ws, "response"); *frame.OK || !strings.HasPrefix(frame.Error, "changes are not allowed from") {
+		t.Fatalf("Expected a command from outside the allowlist to be refused, got %+v", frame)
+	}
+}
@@ -1,6 +1,16 @@
 import { defineConfig } from 'vite'
 import { svelte } from '@sveltejs/vite-plugin-svelte'
 
+// The dev server proxies the API, so the frontend talks to its own origin
+// as when the backend serves it, and the session cookie is sent
+const backend = process.env.BACKEND_URL || 'http://localhost:9999'
+
 export default defineConfig({
   plugins: [svelte()],
+  server: {
+    proxy: {
+      '/api': backend,
+      '/discover': { target: backend, ws: true },
+    },
+  },
 })